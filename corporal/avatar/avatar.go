@@ -16,6 +16,10 @@ type Avatar struct {
 	ContentLength int64
 	Body          io.ReadCloser
 	UriHash       string
+
+	// ContentHash identifies the image itself, so that images coming from different URIs can be told to be the same.
+	// It's empty for empty avatars.
+	ContentHash string
 }
 
 type AvatarReader struct {
@@ -59,6 +63,7 @@ func (me *AvatarReader) Read(avatarUri string) (*Avatar, error) {
 
 		avatar.ContentLength = int64(len(dataBytes))
 		avatar.Body = ioutil.NopCloser(bytes.NewReader(dataBytes))
+		avatar.ContentHash = util.Sha512(string(dataBytes))
 
 		return avatar, nil
 	}
@@ -83,6 +88,7 @@ func (me *AvatarReader) Read(avatarUri string) (*Avatar, error) {
 	avatar.ContentType = resp.Header.Get("Content-Type")
 	avatar.ContentLength = int64(len(bodyBytes))
 	avatar.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	avatar.ContentHash = util.Sha512(string(bodyBytes))
 
 	return avatar, nil
 }
@@ -1,22 +1,46 @@
 package configuration
 
 import (
+	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/ldap"
 	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/reconciliation"
+	"devture-matrix-corporal/corporal/util"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
 type Configuration struct {
-	Matrix         Matrix
-	Corporal       Corporal
-	Reconciliation Reconciliation
-	HttpApi        HttpApi
-	HttpGateway    HttpGateway
-	PolicyProvider PolicyProvider
-	Misc           Misc
+	Matrix                  Matrix
+	Corporal                Corporal
+	Reconciliation          Reconciliation
+	ReconciliationReports   ReconciliationReports
+	HttpApi                 HttpApi
+	HttpGateway             HttpGateway
+	PolicyProvider          PolicyProvider
+	PolicySigning           PolicySigning
+	PolicyIncludes          PolicyIncludes
+	PolicyDocuments         PolicyDocuments
+	PolicyHistory           PolicyHistory
+	PolicyFreshness         PolicyFreshness
+	PolicyCache             PolicyCache
+	PolicyLoadNotifications PolicyLoadNotifications
+	Vault                   Vault
+	RestAuth                RestAuth
+	RestAuthCache           RestAuthCache
+	Ldap                    Ldap
+	OAuthIntrospection      OAuthIntrospection
+	Jwt                     Jwt
+	SecondFactorStore       SecondFactorStore
+	AccessTokenStore        AccessTokenStore
+	OutboundProxy           OutboundProxy
+	Misc                    Misc
 }
 
 type HttpApi struct {
@@ -31,6 +55,20 @@ type HttpGateway struct {
 	TimeoutMilliseconds int
 	InternalRESTAuth    HttpGatewayInternalRESTAuth
 	UserMappingResolver HttpGatewayUserMappingResolver
+
+	LoginIdentifierNormalization HttpGatewayLoginIdentifierNormalization
+
+	// TrustedProxyNetworks contains the networks (in CIDR notation) of the reverse-proxies in front of the HTTP gateway,
+	// whose `X-Forwarded-For` headers are trusted to tell where requests come from (see httphelp.GetClientIp).
+	// This matters for the per-IP address login lockouts (see policy.LoginLockout).
+	TrustedProxyNetworks []string
+}
+
+// HttpGatewayLoginIdentifierNormalization controls how leniently login identifiers are matched to users in the policy (see interceptor.LoginIdentifierNormalization)
+type HttpGatewayLoginIdentifierNormalization struct {
+	CaseInsensitiveLocalparts    bool
+	TrimDomainQualifiedUsernames bool
+	EmailDomains                 []string
 }
 
 type HttpGatewayInternalRESTAuth struct {
@@ -48,11 +86,111 @@ type HttpGatewayUserMappingResolver struct {
 }
 
 type Matrix struct {
-	HomeserverDomainName     string
-	HomeserverApiEndpoint    string
+	HomeserverDomainName  string
+	HomeserverApiEndpoint string
+
+	// AdminApiEndpoint (if specified) is where requests for the homeserver's admin APIs go (see connector.ApiConnector.SetAdminApiEndpoint),
+	// instead of to HomeserverApiEndpoint
+	AdminApiEndpoint string
+
 	AuthSharedSecret         string
 	RegistrationSharedSecret string
 	TimeoutMilliseconds      int
+
+	// CategoryTimeoutsMilliseconds overrides TimeoutMilliseconds for requests of certain categories (see connector.ApiConnector.SetCategoryTimeouts)
+	CategoryTimeoutsMilliseconds map[string]int
+
+	// HomeserverImplementation specifies which homeserver software is being managed, which decides the admin APIs that get used:
+	// `synapse` (connector.HomeserverImplementationSynapse), `dendrite` (connector.HomeserverImplementationDendrite),
+	// `conduit` (connector.HomeserverImplementationConduit), `conduwuit` (connector.HomeserverImplementationConduwuit)
+	// or `noop` (connector.HomeserverImplementationNoop), which makes no requests to the homeserver at all (for dry runs).
+	HomeserverImplementation string
+
+	// AppServiceToken is the `as_token` of the application service that matrix-corporal is registered with the homeserver as (if any).
+	// When specified, users are acted as through the application service, instead of by logging in as them (see connector.ApiConnector.SetAppServiceToken).
+	// It's required for Conduit and conduwuit (see connector.ConduitConnector).
+	AppServiceToken string
+
+	// ServerNoticesUserId is the user that the homeserver sends server notices as (if server notices are enabled),
+	// which account cleanup leaves alone (see policy.AccountCleanup).
+	// The homeserver doesn't tell us which one it is, so this needs to be specified.
+	ServerNoticesUserId string
+
+	// AuthenticationService is for Synapse servers which have delegated authentication to matrix-authentication-service (see connector.MasConnector)
+	AuthenticationService MatrixAuthenticationService
+
+	// AdminApiLogin is for Synapse servers without shared-secret-auth, for which access tokens and logins are to be obtained via the admin login API
+	AdminApiLogin MatrixAdminApiLogin
+
+	// HttpClient tunes the HTTP client that the homeserver's APIs are called with (see connector.HttpTransportOptions)
+	HttpClient MatrixHttpClient
+
+	// Retries specifies how API calls failing because of the homeserver being unavailable are retried (see connector.RetryPolicy)
+	Retries MatrixRetries
+
+	// CircuitBreaker makes API calls fail right away while the homeserver appears to be unavailable (see connector.CircuitBreaker)
+	CircuitBreaker MatrixCircuitBreaker
+}
+
+type MatrixRetries struct {
+	// MaxRetries specifies how many times (idempotent) calls are retried. 0 disables retrying.
+	MaxRetries int
+
+	InitialBackoffMilliseconds int
+	MaxBackoffMilliseconds     int
+}
+
+type MatrixCircuitBreaker struct {
+	// FailureThreshold specifies after how many consecutive failed calls the circuit opens. 0 disables the circuit breaker.
+	FailureThreshold int
+
+	// OpenDurationMilliseconds specifies for how long calls fail right away, before one is let through to check whether the homeserver is back
+	OpenDurationMilliseconds int
+}
+
+type MatrixHttpClient struct {
+	// KeepAliveMilliseconds is the interval between TCP keep-alive probes (a negative value disables them)
+	KeepAliveMilliseconds int
+
+	// IdleConnectionTimeoutMilliseconds specifies how long idle connections are kept around for
+	IdleConnectionTimeoutMilliseconds int
+
+	MaxIdleConnections        int
+	MaxIdleConnectionsPerHost int
+
+	// MaxConnectionsPerHost limits how many connections there are to the homeserver (0 means no limit)
+	MaxConnectionsPerHost int
+
+	TlsCaPath                string
+	TlsClientCertificatePath string
+	TlsClientKeyPath         string
+	TlsInsecureSkipVerify    bool
+}
+
+type MatrixAuthenticationService struct {
+	Enabled bool
+
+	// ApiEndpoint is the base URL of matrix-authentication-service (e.g. `http://matrix-authentication-service:8080`)
+	ApiEndpoint string
+
+	// ClientId and ClientSecret identify the client (in matrix-authentication-service) that the Admin API gets accessed with
+	ClientId     string
+	ClientSecret string
+
+	// ClientCredentialsForSynapseAdminApi makes the Synapse admin APIs get called with access tokens obtained with the client's credentials,
+	// instead of with the matrix-corporal user's access token (see connector.MasConnector.EnableClientCredentialsForSynapseAdminApi)
+	ClientCredentialsForSynapseAdminApi bool
+}
+
+type MatrixAdminApiLogin struct {
+	// Enabled makes logins through the HTTP gateway be forwarded as token logins, with login tokens obtained (via the admin login API)
+	// for the users logging in (see interceptor.LoginInterceptor.SetLoginTokenIssuer), instead of as shared-secret-auth password logins.
+	Enabled bool
+
+	// CorporalUserAccessToken is an access token of the Corporal.UserID user, to be used instead of logging in as it
+	// (see connector.SynapseConnector.SetCorporalUserAccessToken), as the admin login API cannot be used for logging in as oneself.
+	// It's not needed when acting as an application service (see AppServiceToken), as that's how logging in as it happens then.
+	CorporalUserAccessToken string
 }
 
 type Corporal struct {
@@ -61,6 +199,269 @@ type Corporal struct {
 
 type Reconciliation struct {
 	RetryIntervalMilliseconds int
+
+	// DryRun makes reconciliation only report (log) the actions it would take, without changing anything on the homeserver
+	DryRun bool
+
+	// Workers specifies for how many users reconciliation happens at the same time
+	Workers int
+
+	// ApiCategoryConcurrencyLimits optionally limits how many calls of a given API category (see reconciliation.KnownApiCategories)
+	// happen at the same time, across all workers.
+	ApiCategoryConcurrencyLimits map[string]int
+
+	// RequestsPerSecond optionally limits how many requests per second (on average) are made to the homeserver's APIs,
+	// so that reconciliation leaves enough capacity for interactive traffic. Zero means no limit.
+	RequestsPerSecond float64
+
+	// Schedule is an optional cron-style schedule (see reconciliation.Schedule) for full reconciliations of the current policy
+	Schedule string
+
+	// DriftDetectionSchedule is an optional cron-style schedule (see reconciliation.Schedule) for comparing the current policy
+	// to the homeserver's state and reporting how they differ, without correcting anything
+	DriftDetectionSchedule string
+
+	// DisableOnPolicyLoad makes policies (and policy changes) not get reconciled as soon as they're loaded,
+	// leaving reconciliation to Schedule (or to the HTTP API).
+	DisableOnPolicyLoad bool
+
+	// RequestBurst specifies how many requests can be made in quick succession (when RequestsPerSecond is set),
+	// as long as no requests have been made for a while.
+	RequestBurst int
+
+	// CheckpointIntervalSeconds (if non-zero) makes full reconciliation runs store their progress this often (at most),
+	// so that an interrupted run can be resumed after restarting.
+	CheckpointIntervalSeconds int
+
+	// QuarantineAfterFailures (if non-zero) makes users whose actions have failed during this many runs in a row get quarantined,
+	// so that their actions get skipped (instead of making every run fail) until they're released via the HTTP API.
+	QuarantineAfterFailures int
+}
+
+type ReconciliationReports struct {
+	// WebhookUrls specifies URLs to POST a report to, after each reconciliation run (successful or not).
+	WebhookUrls []string
+
+	// AuthorizationBearerToken is an optional token to send (as `Authorization: Bearer ..`) to the webhooks.
+	AuthorizationBearerToken string
+
+	TimeoutMilliseconds int
+
+	// Directory specifies a directory to write each report to (as a separate JSON file).
+	Directory string
+}
+
+type PolicySigning struct {
+	// PublicKeys maps key identifiers to base64-encoded Ed25519 public keys.
+	// When at least one key is defined, only policies signed by one of these keys will be loaded.
+	PublicKeys map[string]string
+}
+
+// PolicyIncludes restricts what policies may include (see the policy's `includes` field).
+//
+// Without any restrictions, policies loaded from policy providers may include any local file or URL,
+// while policies pushed via the HTTP API may not include anything.
+// Once restrictions are defined, they apply to all policies.
+type PolicyIncludes struct {
+	// AllowedDirectories specifies local directories, whose files may be included.
+	AllowedDirectories []string
+
+	// AllowedUrlPrefixes specifies http:// or https:// URL prefixes (e.g. `https://policies.example.com/matrix/`), whose URLs may be included.
+	AllowedUrlPrefixes []string
+}
+
+// PolicyDocuments limits the policy documents that get read (loaded by policy providers, pushed via the HTTP API or included).
+type PolicyDocuments struct {
+	// MaxSizeBytes specifies how large documents may be (after decompression).
+	// A value of 0 means the default (see policy.DefaultMaxDocumentSizeBytes).
+	MaxSizeBytes int64
+}
+
+type PolicyHistory struct {
+	// Size specifies how many of the last-loaded policies to keep.
+	// Setting it to a negative number disables policy history.
+	Size int
+
+	// Path specifies a local file where policy history will be persisted.
+	// If empty, history is only kept in memory.
+	Path string
+
+	// EncryptionKey is an optional base64-encoded 32-byte key, used for encrypting the history file (with AES-256-GCM).
+	EncryptionKey string
+}
+
+type PolicyFreshness struct {
+	// DegradedMode specifies what happens when the policy expires (see the policy's `expiresAt` and `maxAgeSeconds` fields),
+	// without a newer policy being loaded: `warn`, `readOnly` or `rejectLogins`.
+	DegradedMode string
+
+	// CheckIntervalMilliseconds specifies how often to check whether the policy has expired (and to log warnings about it).
+	CheckIntervalMilliseconds int
+}
+
+type PolicyCache struct {
+	// Path specifies a local file where the last-known-good policy (the last one loaded into the store) will be persisted.
+	// It gets restored on startup, when the policy provider fails to start. If empty, this is disabled.
+	Path string
+
+	// EncryptionKey is an optional base64-encoded 32-byte key, used for encrypting the cache file (with AES-256-GCM).
+	EncryptionKey string
+
+	// MaxStalenessSeconds specifies for how long (since it was originally loaded) a restored policy may be served.
+	// Past that, corporal refuses to serve requests until a newer policy gets loaded. 0 means no limit.
+	MaxStalenessSeconds int
+}
+
+type PolicyLoadNotifications struct {
+	// WebhookUrls specifies URLs to POST a summary to, after each policy load attempt (successful or not).
+	WebhookUrls []string
+
+	// AuthorizationBearerToken is an optional token to send (as `Authorization: Bearer ..`) to the webhooks.
+	AuthorizationBearerToken string
+
+	TimeoutMilliseconds int
+}
+
+// RestAuth configures how requests are made for `rest` (and `rest-with-cache-fallback`) authentication (see userauth.RestAuthenticator)
+type RestAuth struct {
+	// TlsClientCertificatePath and TlsClientKeyPath specify a TLS client certificate, which gets presented to REST endpoints
+	TlsClientCertificatePath string
+	TlsClientKeyPath         string
+
+	// TlsCaPath pins the certificate authorities trusted for REST endpoints (instead of the system ones)
+	TlsCaPath string
+
+	// HmacSecret (if set) makes requests get signed with it (see userauth.RestAuthenticator.SetHmacSecret)
+	HmacSecret string
+}
+
+// RestAuthCache configures the caching of `rest` (and `rest-with-cache-fallback`) authentication decisions (see userauth.DecisionCachingAuthenticator)
+type RestAuthCache struct {
+	// MaxEntries specifies how many decisions (for different user and credential combinations) are cached at most
+	MaxEntries int
+
+	// PositiveTtlSeconds and NegativeTtlSeconds specify for how long successful and unsuccessful decisions are reused.
+	// 0 disables caching them.
+	PositiveTtlSeconds int
+	NegativeTtlSeconds int
+}
+
+// Ldap configures the LDAP (or Active Directory) server that users of the `ldap` auth type get authenticated against (see userauth.LdapAuthenticator)
+type Ldap struct {
+	// Url is the LDAP server's URL (e.g. `ldaps://ldap.example.com`).
+	// LDAP authentication is disabled when this is empty.
+	Url string
+
+	// StartTls makes `ldap://` connections get upgraded to TLS (see ldap.Options)
+	StartTls bool
+
+	// CaCertificatePath specifies a file with (PEM-encoded) certificates of the certificate authorities to trust for TLS connections,
+	// instead of the system's ones.
+	CaCertificatePath string
+
+	TimeoutMilliseconds int
+
+	// PoolSize specifies how many idle connections are kept around for reuse
+	PoolSize int
+
+	// BindDnTemplate, SearchBaseDn, SearchFilter, SearchBindDn and SearchBindPassword decide the DN that users get bound as (see ldap.Options)
+	BindDnTemplate     string
+	SearchBaseDn       string
+	SearchFilter       string
+	SearchBindDn       string
+	SearchBindPassword string
+}
+
+// OAuthIntrospection configures the OAuth token introspection (RFC 7662) endpoint,
+// which the access tokens of users of the `oauth-introspection` auth type get validated against (see userauth.OAuthIntrospectionAuthenticator)
+type OAuthIntrospection struct {
+	// Url is the authorization server's (IdP's) token introspection endpoint.
+	// OAuth introspection authentication is disabled when this is empty.
+	Url string
+
+	// ClientId and ClientSecret are the credentials that matrix-corporal authenticates to the introspection endpoint with (via HTTP Basic authentication)
+	ClientId     string
+	ClientSecret string
+
+	// SubjectField is the introspection response field, which gets matched against the subject expected for the user (`sub`, by default)
+	SubjectField string
+
+	// RequiredScopes lists the scopes that tokens need to have been granted (all of them)
+	RequiredScopes []string
+
+	TimeoutMilliseconds int
+}
+
+// Jwt configures how the JSON Web Tokens of users of the `jwt` auth type get validated (see userauth.JwtAuthenticator)
+type Jwt struct {
+	// JwksUrl is the URL of the issuer's JSON Web Key Set, which tokens are signed with.
+	// JWT authentication is disabled when this is empty.
+	JwksUrl string
+
+	// Issuer and Audience are what tokens' `iss` and `aud` claims need to match
+	Issuer   string
+	Audience string
+
+	// SubjectClaim is the claim, which gets matched against the subject expected for the user (`sub`, by default)
+	SubjectClaim string
+
+	// ClockSkewSeconds specifies how much clock skew (between us and the issuer) to tolerate when checking expiration times, etc.
+	ClockSkewSeconds int
+
+	// JwksRefreshIntervalSeconds specifies how often keys get refetched from JwksUrl
+	JwksRefreshIntervalSeconds int
+
+	TimeoutMilliseconds int
+}
+
+type Vault struct {
+	// Address is the URL of the HashiCorp Vault server (e.g. `https://vault.example.com:8200`).
+	// Vault integration is disabled when this is empty.
+	Address string
+
+	// Token is the Vault token to authenticate with. It gets renewed automatically, if renewable.
+	Token string
+
+	// TokenPath specifies a file to read the Vault token from (e.g. a Vault Agent sink), instead of using Token.
+	// The file is re-read for each request and whoever writes it is in charge of renewing the token.
+	TokenPath string
+
+	// Namespace specifies the Vault Enterprise namespace to work with (optional).
+	Namespace string
+
+	TimeoutMilliseconds int
+}
+
+type SecondFactorStore struct {
+	// Path specifies a local file where second factors provisioned via the HTTP API will be persisted (see policy.SecondFactorStore).
+	// If empty, they're only kept in memory.
+	Path string
+
+	// EncryptionKey is an optional base64-encoded 32-byte key, used for encrypting the file (with AES-256-GCM).
+	EncryptionKey string
+}
+
+type AccessTokenStore struct {
+	// Path specifies a local file where the access tokens obtained by corporal (for managed users and for itself) will be persisted,
+	// so that they get reused after restarts (see connector.AccessTokenStore). If empty, this is disabled.
+	Path string
+
+	// EncryptionKey is a base64-encoded 32-byte key, used for encrypting the file (with AES-256-GCM).
+	EncryptionKey string
+
+	// EncryptionKeyPath specifies a file to read the (base64-encoded) encryption key from, instead of using EncryptionKey.
+	EncryptionKeyPath string
+}
+
+type OutboundProxy struct {
+	// Url is the proxy (`http://`, `https://` or `socks5://`) to route outbound HTTP traffic through (policy providers, hooks, etc.).
+	// When empty, the standard `HTTP_PROXY`/`HTTPS_PROXY`/`NO_PROXY` environment variables are respected instead.
+	Url string
+
+	// Bypass lists destinations to reach directly (host names, `.domain` suffixes, IP addresses, CIDR ranges or `*`).
+	// The Matrix homeserver (Matrix.HomeserverApiEndpoint and Matrix.AdminApiEndpoint) and matrix-authentication-service
+	// (Matrix.AuthenticationService.ApiEndpoint) are always reached directly.
+	Bypass []string
 }
 
 type Misc struct {
@@ -93,6 +494,90 @@ func LoadConfiguration(filePath string, logger *logrus.Logger) (*Configuration,
 }
 
 func setConfigurationDefaults(configuration *Configuration) {
+	if configuration.PolicyHistory.Size == 0 {
+		configuration.PolicyHistory.Size = 10
+	}
+
+	if configuration.Matrix.Retries.InitialBackoffMilliseconds == 0 {
+		configuration.Matrix.Retries.InitialBackoffMilliseconds = 500
+	}
+
+	if configuration.Matrix.Retries.MaxBackoffMilliseconds == 0 {
+		configuration.Matrix.Retries.MaxBackoffMilliseconds = 10 * 1000
+	}
+
+	if configuration.Matrix.CircuitBreaker.OpenDurationMilliseconds == 0 {
+		configuration.Matrix.CircuitBreaker.OpenDurationMilliseconds = 30 * 1000
+	}
+
+	if configuration.Matrix.HomeserverImplementation == "" {
+		configuration.Matrix.HomeserverImplementation = connector.HomeserverImplementationSynapse
+	}
+
+	if configuration.PolicyFreshness.DegradedMode == "" {
+		configuration.PolicyFreshness.DegradedMode = "warn"
+	}
+
+	if configuration.PolicyFreshness.CheckIntervalMilliseconds == 0 {
+		configuration.PolicyFreshness.CheckIntervalMilliseconds = 60 * 1000
+	}
+
+	if configuration.PolicyLoadNotifications.TimeoutMilliseconds == 0 {
+		configuration.PolicyLoadNotifications.TimeoutMilliseconds = 15 * 1000
+	}
+
+	if configuration.Reconciliation.Workers == 0 {
+		configuration.Reconciliation.Workers = 1
+	}
+
+	if configuration.Reconciliation.RequestBurst == 0 {
+		configuration.Reconciliation.RequestBurst = 10
+	}
+
+	if configuration.ReconciliationReports.TimeoutMilliseconds == 0 {
+		configuration.ReconciliationReports.TimeoutMilliseconds = 15 * 1000
+	}
+
+	if configuration.RestAuthCache.MaxEntries == 0 {
+		configuration.RestAuthCache.MaxEntries = 10000
+	}
+
+	if configuration.Ldap.TimeoutMilliseconds == 0 {
+		configuration.Ldap.TimeoutMilliseconds = 10 * 1000
+	}
+
+	if configuration.Ldap.PoolSize == 0 {
+		configuration.Ldap.PoolSize = 5
+	}
+
+	if configuration.OAuthIntrospection.SubjectField == "" {
+		configuration.OAuthIntrospection.SubjectField = "sub"
+	}
+
+	if configuration.OAuthIntrospection.TimeoutMilliseconds == 0 {
+		configuration.OAuthIntrospection.TimeoutMilliseconds = 10 * 1000
+	}
+
+	if configuration.Jwt.SubjectClaim == "" {
+		configuration.Jwt.SubjectClaim = "sub"
+	}
+
+	if configuration.Jwt.ClockSkewSeconds == 0 {
+		configuration.Jwt.ClockSkewSeconds = 60
+	}
+
+	if configuration.Jwt.JwksRefreshIntervalSeconds == 0 {
+		configuration.Jwt.JwksRefreshIntervalSeconds = 60 * 60
+	}
+
+	if configuration.Jwt.TimeoutMilliseconds == 0 {
+		configuration.Jwt.TimeoutMilliseconds = 10 * 1000
+	}
+
+	if configuration.Vault.TimeoutMilliseconds == 0 {
+		configuration.Vault.TimeoutMilliseconds = 30 * 1000
+	}
+
 	if configuration.HttpGateway.UserMappingResolver.CacheSize == 0 {
 		configuration.HttpGateway.UserMappingResolver.CacheSize = 10000
 	}
@@ -111,14 +596,131 @@ func validateConfiguration(configuration *Configuration, logger *logrus.Logger)
 		)
 	}
 
+	if configuration.Matrix.ServerNoticesUserId != "" && !matrix.IsFullUserIdOfDomain(configuration.Matrix.ServerNoticesUserId, configuration.Matrix.HomeserverDomainName) {
+		return fmt.Errorf(
+			"Server notices user `%s` (specified in Matrix.ServerNoticesUserId) is not hosted on the managed homeserver domain (%s)",
+			configuration.Matrix.ServerNoticesUserId,
+			configuration.Matrix.HomeserverDomainName,
+		)
+	}
+
 	if configuration.Matrix.TimeoutMilliseconds <= 0 {
 		return fmt.Errorf("Matrix.TimeoutMilliseconds needs to be a positive number")
 	}
 
+	for category, timeoutMilliseconds := range configuration.Matrix.CategoryTimeoutsMilliseconds {
+		if timeoutMilliseconds <= 0 {
+			return fmt.Errorf("Matrix.CategoryTimeoutsMilliseconds (for %s) needs to be a positive number", category)
+		}
+	}
+
+	if !util.IsStringInArray(configuration.Matrix.HomeserverImplementation, connector.KnownHomeserverImplementations) {
+		return fmt.Errorf(
+			"Matrix.HomeserverImplementation (%s) needs to be one of: %s",
+			configuration.Matrix.HomeserverImplementation,
+			strings.Join(connector.KnownHomeserverImplementations, ", "),
+		)
+	}
+
+	if configuration.Matrix.AppServiceToken == "" && util.IsStringInArray(configuration.Matrix.HomeserverImplementation, []string{
+		connector.HomeserverImplementationConduit,
+		connector.HomeserverImplementationConduwuit,
+	}) {
+		return fmt.Errorf("Matrix.AppServiceToken needs to be specified for %s", configuration.Matrix.HomeserverImplementation)
+	}
+
+	if configuration.Matrix.HttpClient.IdleConnectionTimeoutMilliseconds < 0 ||
+		configuration.Matrix.HttpClient.MaxIdleConnections < 0 ||
+		configuration.Matrix.HttpClient.MaxIdleConnectionsPerHost < 0 ||
+		configuration.Matrix.HttpClient.MaxConnectionsPerHost < 0 {
+		return fmt.Errorf("Matrix.HttpClient timeouts and connection limits cannot be negative")
+	}
+
+	if configuration.Matrix.Retries.MaxRetries < 0 || configuration.Matrix.Retries.InitialBackoffMilliseconds < 0 || configuration.Matrix.Retries.MaxBackoffMilliseconds < 0 {
+		return fmt.Errorf("Matrix.Retries values cannot be negative")
+	}
+
+	if configuration.Matrix.CircuitBreaker.FailureThreshold < 0 || configuration.Matrix.CircuitBreaker.OpenDurationMilliseconds < 0 {
+		return fmt.Errorf("Matrix.CircuitBreaker values cannot be negative")
+	}
+
+	if configuration.Matrix.AuthenticationService.Enabled {
+		if configuration.Matrix.AppServiceToken != "" {
+			// Application service logins (which are still needed for the matrix-corporal user) are not possible with matrix-authentication-service
+			return fmt.Errorf("Matrix.AppServiceToken cannot be used along with Matrix.AuthenticationService")
+		}
+
+		if configuration.Matrix.HomeserverImplementation != connector.HomeserverImplementationSynapse {
+			return fmt.Errorf("Matrix.AuthenticationService can only be enabled for %s", connector.HomeserverImplementationSynapse)
+		}
+
+		if configuration.Matrix.AuthenticationService.ApiEndpoint == "" {
+			return fmt.Errorf("Matrix.AuthenticationService.ApiEndpoint needs to be specified")
+		}
+
+		if configuration.Matrix.AuthenticationService.ClientId == "" || configuration.Matrix.AuthenticationService.ClientSecret == "" {
+			return fmt.Errorf("Matrix.AuthenticationService.ClientId and Matrix.AuthenticationService.ClientSecret need to be specified")
+		}
+	}
+
+	if configuration.Matrix.AdminApiLogin.Enabled {
+		if configuration.Matrix.HomeserverImplementation != connector.HomeserverImplementationSynapse {
+			return fmt.Errorf("Matrix.AdminApiLogin can only be enabled for %s", connector.HomeserverImplementationSynapse)
+		}
+
+		if configuration.Matrix.AuthenticationService.Enabled {
+			// Logins happen via matrix-authentication-service then, which Synapse's admin login API doesn't work with
+			return fmt.Errorf("Matrix.AdminApiLogin cannot be used along with Matrix.AuthenticationService")
+		}
+
+		if configuration.Matrix.AdminApiLogin.CorporalUserAccessToken == "" && configuration.Matrix.AppServiceToken == "" {
+			return fmt.Errorf("Matrix.AdminApiLogin.CorporalUserAccessToken needs to be specified (unless Matrix.AppServiceToken is)")
+		}
+	}
+
 	if configuration.Reconciliation.RetryIntervalMilliseconds <= 0 {
 		return fmt.Errorf("Reconciliation.RetryIntervalMilliseconds needs to be a positive number")
 	}
 
+	_, err := reconciliation.NewConcurrencyLimiter(
+		configuration.Reconciliation.Workers,
+		configuration.Reconciliation.ApiCategoryConcurrencyLimits,
+	)
+	if err != nil {
+		return fmt.Errorf("Reconciliation.Workers or Reconciliation.ApiCategoryConcurrencyLimits is invalid: %s", err)
+	}
+
+	if configuration.Reconciliation.Schedule != "" {
+		_, err := reconciliation.ParseSchedule(configuration.Reconciliation.Schedule)
+		if err != nil {
+			return fmt.Errorf("Reconciliation.Schedule is invalid: %s", err)
+		}
+	} else if configuration.Reconciliation.DisableOnPolicyLoad {
+		logger.Warn("Reconciliation.DisableOnPolicyLoad is enabled, but there's no Reconciliation.Schedule. Full reconciliation will never happen")
+	}
+
+	if configuration.Reconciliation.DriftDetectionSchedule != "" {
+		_, err := reconciliation.ParseSchedule(configuration.Reconciliation.DriftDetectionSchedule)
+		if err != nil {
+			return fmt.Errorf("Reconciliation.DriftDetectionSchedule is invalid: %s", err)
+		}
+	}
+
+	if configuration.Reconciliation.RequestsPerSecond < 0 {
+		return fmt.Errorf("Reconciliation.RequestsPerSecond needs to be a non-negative number")
+	}
+	if configuration.Reconciliation.RequestBurst < 0 {
+		return fmt.Errorf("Reconciliation.RequestBurst needs to be a positive number")
+	}
+
+	if configuration.Reconciliation.CheckpointIntervalSeconds < 0 {
+		return fmt.Errorf("Reconciliation.CheckpointIntervalSeconds needs to be a non-negative number")
+	}
+
+	if configuration.Reconciliation.QuarantineAfterFailures < 0 {
+		return fmt.Errorf("Reconciliation.QuarantineAfterFailures needs to be a non-negative number")
+	}
+
 	if configuration.HttpGateway.TimeoutMilliseconds <= 0 {
 		return fmt.Errorf("HttpGateway.TimeoutMilliseconds needs to be a positive number")
 	}
@@ -129,6 +731,9 @@ func validateConfiguration(configuration *Configuration, logger *logrus.Logger)
 			configuration.Matrix.TimeoutMilliseconds,
 		)
 	}
+	if _, err := httphelp.ParseIpNetworks(configuration.HttpGateway.TrustedProxyNetworks); err != nil {
+		return fmt.Errorf("HttpGateway.TrustedProxyNetworks is invalid: %s", err)
+	}
 	if configuration.HttpGateway.InternalRESTAuth.Enabled == nil || !(*configuration.HttpGateway.InternalRESTAuth.Enabled) {
 		logger.Warn("HttpGateway.InternalRESTAuth.Enabled is neither explicitly enabled, nor disabled. Interactive Auth may not work without it. Define it as enabled or disabled to get rid of this warning")
 	} else {
@@ -145,5 +750,122 @@ func validateConfiguration(configuration *Configuration, logger *logrus.Logger)
 		return fmt.Errorf("HttpApi.TimeoutMilliseconds needs to be a positive number")
 	}
 
+	if configuration.PolicyFreshness.CheckIntervalMilliseconds <= 0 {
+		return fmt.Errorf("PolicyFreshness.CheckIntervalMilliseconds needs to be a positive number")
+	}
+
+	if configuration.PolicyLoadNotifications.TimeoutMilliseconds <= 0 {
+		return fmt.Errorf("PolicyLoadNotifications.TimeoutMilliseconds needs to be a positive number")
+	}
+
+	if configuration.ReconciliationReports.TimeoutMilliseconds <= 0 {
+		return fmt.Errorf("ReconciliationReports.TimeoutMilliseconds needs to be a positive number")
+	}
+
+	if configuration.PolicyDocuments.MaxSizeBytes < 0 {
+		return fmt.Errorf("PolicyDocuments.MaxSizeBytes cannot be negative")
+	}
+
+	if configuration.PolicyHistory.EncryptionKey != "" {
+		encryptionKey, err := base64.StdEncoding.DecodeString(configuration.PolicyHistory.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("PolicyHistory.EncryptionKey is not valid base64: %s", err)
+		}
+		if len(encryptionKey) != 32 {
+			return fmt.Errorf("PolicyHistory.EncryptionKey needs to be 32 bytes long (before base64-encoding), not %d", len(encryptionKey))
+		}
+	}
+
+	if configuration.SecondFactorStore.EncryptionKey != "" {
+		encryptionKey, err := base64.StdEncoding.DecodeString(configuration.SecondFactorStore.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("SecondFactorStore.EncryptionKey is not valid base64: %s", err)
+		}
+		if len(encryptionKey) != 32 {
+			return fmt.Errorf("SecondFactorStore.EncryptionKey needs to be 32 bytes long (before base64-encoding), not %d", len(encryptionKey))
+		}
+	}
+
+	if configuration.PolicyCache.MaxStalenessSeconds < 0 {
+		return fmt.Errorf("PolicyCache.MaxStalenessSeconds needs to be a non-negative number")
+	}
+	if configuration.PolicyCache.EncryptionKey != "" {
+		encryptionKey, err := base64.StdEncoding.DecodeString(configuration.PolicyCache.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("PolicyCache.EncryptionKey is not valid base64: %s", err)
+		}
+		if len(encryptionKey) != 32 {
+			return fmt.Errorf("PolicyCache.EncryptionKey needs to be 32 bytes long (before base64-encoding), not %d", len(encryptionKey))
+		}
+	}
+
+	if configuration.AccessTokenStore.Path != "" {
+		if configuration.AccessTokenStore.EncryptionKey == "" && configuration.AccessTokenStore.EncryptionKeyPath == "" {
+			return fmt.Errorf("AccessTokenStore.EncryptionKey or AccessTokenStore.EncryptionKeyPath needs to be specified when AccessTokenStore.Path is")
+		}
+		if configuration.AccessTokenStore.EncryptionKey != "" {
+			encryptionKey, err := base64.StdEncoding.DecodeString(configuration.AccessTokenStore.EncryptionKey)
+			if err != nil {
+				return fmt.Errorf("AccessTokenStore.EncryptionKey is not valid base64: %s", err)
+			}
+			if len(encryptionKey) != 32 {
+				return fmt.Errorf("AccessTokenStore.EncryptionKey needs to be 32 bytes long (before base64-encoding), not %d", len(encryptionKey))
+			}
+		}
+	}
+
+	if (configuration.RestAuth.TlsClientCertificatePath == "") != (configuration.RestAuth.TlsClientKeyPath == "") {
+		return fmt.Errorf("RestAuth.TlsClientCertificatePath and RestAuth.TlsClientKeyPath need to be specified together")
+	}
+
+	if configuration.RestAuthCache.MaxEntries < 0 || configuration.RestAuthCache.PositiveTtlSeconds < 0 || configuration.RestAuthCache.NegativeTtlSeconds < 0 {
+		return fmt.Errorf("RestAuthCache.MaxEntries, RestAuthCache.PositiveTtlSeconds and RestAuthCache.NegativeTtlSeconds cannot be negative")
+	}
+
+	if configuration.Ldap.Url != "" {
+		if configuration.Ldap.TimeoutMilliseconds < 0 || configuration.Ldap.PoolSize < 0 {
+			return fmt.Errorf("Ldap.TimeoutMilliseconds and Ldap.PoolSize cannot be negative")
+		}
+
+		_, err := ldap.NewClient(ldap.Options{
+			Url:            configuration.Ldap.Url,
+			StartTls:       configuration.Ldap.StartTls,
+			BindDnTemplate: configuration.Ldap.BindDnTemplate,
+			SearchBaseDn:   configuration.Ldap.SearchBaseDn,
+			SearchFilter:   configuration.Ldap.SearchFilter,
+		})
+		if err != nil {
+			return fmt.Errorf("Ldap configuration is invalid: %s", err)
+		}
+	}
+
+	if configuration.OAuthIntrospection.Url != "" {
+		if !strings.HasPrefix(configuration.OAuthIntrospection.Url, "https://") && !strings.HasPrefix(configuration.OAuthIntrospection.Url, "http://") {
+			return fmt.Errorf("OAuthIntrospection.Url needs to be an http:// or https:// URL")
+		}
+		if configuration.OAuthIntrospection.ClientId == "" {
+			return fmt.Errorf("OAuthIntrospection.ClientId needs to be specified when OAuthIntrospection.Url is")
+		}
+		if configuration.OAuthIntrospection.TimeoutMilliseconds < 0 {
+			return fmt.Errorf("OAuthIntrospection.TimeoutMilliseconds cannot be negative")
+		}
+	}
+
+	if configuration.Jwt.JwksUrl != "" {
+		if !strings.HasPrefix(configuration.Jwt.JwksUrl, "https://") && !strings.HasPrefix(configuration.Jwt.JwksUrl, "http://") {
+			return fmt.Errorf("Jwt.JwksUrl needs to be an http:// or https:// URL")
+		}
+		if configuration.Jwt.Issuer == "" || configuration.Jwt.Audience == "" {
+			return fmt.Errorf("Jwt.Issuer and Jwt.Audience need to be specified when Jwt.JwksUrl is")
+		}
+		if configuration.Jwt.ClockSkewSeconds < 0 || configuration.Jwt.JwksRefreshIntervalSeconds < 0 || configuration.Jwt.TimeoutMilliseconds < 0 {
+			return fmt.Errorf("Jwt.ClockSkewSeconds, Jwt.JwksRefreshIntervalSeconds and Jwt.TimeoutMilliseconds cannot be negative")
+		}
+	}
+
+	if configuration.Vault.Address != "" && configuration.Vault.Token == "" && configuration.Vault.TokenPath == "" {
+		return fmt.Errorf("Vault.Token or Vault.TokenPath needs to be specified when Vault.Address is")
+	}
+
 	return nil
 }
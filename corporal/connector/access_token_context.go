@@ -1,17 +1,36 @@
 package connector
 
 import (
+	"errors"
 	"log"
 	"sync"
 	"time"
+
+	"github.com/matrix-org/gomatrix"
 )
 
+// ErrReadOnlyAccessTokenContext is what obtaining access tokens with a read-only context fails with (see AccessTokenContext.SetReadOnly)
+var ErrReadOnlyAccessTokenContext = errors.New("acting as users is not possible in read-only mode (e.g. during dry runs)")
+
 type AccessTokenContext struct {
 	connector       MatrixConnector
 	deviceId        string
 	validitySeconds int
 
 	userIdToAccessTokenMap *sync.Map
+
+	// userIdToLockMap contains a lock for each user, so that (when used from multiple goroutines)
+	// we obtain a single access token per user, instead of each goroutine obtaining its own.
+	userIdToLockMap *sync.Map
+
+	// roomStateCache (if set) is for not fetching the same room's state repeatedly (see SetRoomStateCache)
+	roomStateCache *RoomStateCache
+
+	// accessTokenStore (if set) is where obtained access tokens get persisted (see SetAccessTokenStore)
+	accessTokenStore *AccessTokenStore
+
+	// readOnly makes the context refuse to obtain access tokens (see SetReadOnly)
+	readOnly bool
 }
 
 func NewAccessTokenContext(connector MatrixConnector, deviceId string, validitySeconds int) *AccessTokenContext {
@@ -21,10 +40,64 @@ func NewAccessTokenContext(connector MatrixConnector, deviceId string, validityS
 		validitySeconds: validitySeconds,
 
 		userIdToAccessTokenMap: &sync.Map{},
+		userIdToLockMap:        &sync.Map{},
 	}
 }
 
+// SetRoomStateCache makes room state determined using this context (e.g. during a reconciliation run) be cached (see RoomStateCache).
+// This is to be called before the context gets used.
+func (me *AccessTokenContext) SetRoomStateCache(roomStateCache *RoomStateCache) {
+	me.roomStateCache = roomStateCache
+}
+
+// SetAccessTokenStore makes access tokens obtained by this context be persisted to the given store (see AccessTokenStore),
+// and tokens persisted there previously (e.g. before a restart) be reused, for as long as they're valid.
+//
+// Persisted tokens are not destroyed when the context gets released, as they're meant to be reused later on.
+// This is to be called before the context gets used.
+func (me *AccessTokenContext) SetAccessTokenStore(accessTokenStore *AccessTokenStore) {
+	me.accessTokenStore = accessTokenStore
+}
+
+// SetReadOnly makes this context refuse to obtain access tokens (failing with ErrReadOnlyAccessTokenContext),
+// because logging in as users (creating devices for them, etc.) changes things on the server.
+// Connectors read whatever they can via admin APIs instead (see IsReadOnly), which is what dry runs rely on.
+// This is to be called before the context gets used.
+func (me *AccessTokenContext) SetReadOnly() {
+	me.readOnly = true
+}
+
+// IsReadOnly tells whether access tokens are not to be obtained using this context (see SetReadOnly)
+func (me *AccessTokenContext) IsReadOnly() bool {
+	return me != nil && me.readOnly
+}
+
+// getRoomState returns the state events of the given room, from the room state cache (if any) or by using the fetcher
+func (me *AccessTokenContext) getRoomState(roomId string, fetcher func() ([]gomatrix.Event, error)) ([]gomatrix.Event, error) {
+	if me == nil || me.roomStateCache == nil {
+		return fetcher()
+	}
+	return me.roomStateCache.get(roomId, fetcher)
+}
+
+// invalidateRoomState makes the room state cache (if any) forget about the given (changed) room
+func (me *AccessTokenContext) invalidateRoomState(roomId string) {
+	if me == nil || me.roomStateCache == nil {
+		return
+	}
+	me.roomStateCache.invalidate(roomId)
+}
+
 func (me *AccessTokenContext) GetAccessTokenForUserId(userId string) (string, error) {
+	if me.readOnly {
+		return "", ErrReadOnlyAccessTokenContext
+	}
+
+	lockInterface, _ := me.userIdToLockMap.LoadOrStore(userId, &sync.Mutex{})
+	lock := lockInterface.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+
 	accessTokenInterface, ok := me.userIdToAccessTokenMap.Load(userId)
 	if ok {
 		accessToken := accessTokenInterface.(*AccessToken)
@@ -41,8 +114,66 @@ func (me *AccessTokenContext) GetAccessTokenForUserId(userId string) (string, er
 		// So, we can only forget about it and proceed to getting a new one.
 
 		me.ClearAccessTokenForUserId(userId)
+	} else if accessToken := me.loadPersistedAccessTokenForUserId(userId); accessToken != nil {
+		return accessToken.Token(), nil
 	}
 
+	return me.obtainAccessTokenForUserId(userId)
+}
+
+// RefreshAccessTokenForUserId replaces the given (no longer working) access token of the user with a newly obtained one.
+// If the token has already been replaced (e.g. by another goroutine having run into the same problem), the replacement is returned instead.
+func (me *AccessTokenContext) RefreshAccessTokenForUserId(userId string, invalidAccessToken string) (string, error) {
+	if me.readOnly {
+		return "", ErrReadOnlyAccessTokenContext
+	}
+
+	lockInterface, _ := me.userIdToLockMap.LoadOrStore(userId, &sync.Mutex{})
+	lock := lockInterface.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	accessTokenInterface, ok := me.userIdToAccessTokenMap.Load(userId)
+	if ok {
+		accessToken := accessTokenInterface.(*AccessToken)
+		if accessToken.Token() != invalidAccessToken && !accessToken.Expired() {
+			return accessToken.Token(), nil
+		}
+
+		// Like with expired tokens (see GetAccessTokenForUserId), there's no point in trying to destroy it.
+		me.ClearAccessTokenForUserId(userId)
+	}
+
+	return me.obtainAccessTokenForUserId(userId)
+}
+
+// loadPersistedAccessTokenForUserId returns the user's access token persisted in the access token store (if any), if it still works.
+// The user's lock needs to be held.
+func (me *AccessTokenContext) loadPersistedAccessTokenForUserId(userId string) *AccessToken {
+	if me.accessTokenStore == nil {
+		return nil
+	}
+
+	accessToken := me.accessTokenStore.get(me.deviceId, userId)
+	if accessToken == nil {
+		return nil
+	}
+
+	// The token may have stopped working while we weren't using it (e.g. due to a password change).
+	// Not all requests made with it can recover from that (see tokenRefreshingTransport), so we verify it before using it.
+	err := me.connector.VerifyAccessToken(userId, accessToken.Token())
+	if err != nil {
+		me.ClearAccessTokenForUserId(userId)
+		return nil
+	}
+
+	me.userIdToAccessTokenMap.Store(userId, accessToken)
+
+	return accessToken
+}
+
+// obtainAccessTokenForUserId obtains a new access token for the user and stores it. The user's lock needs to be held.
+func (me *AccessTokenContext) obtainAccessTokenForUserId(userId string) (string, error) {
 	var validUntil *time.Time
 	if me.validitySeconds != 0 {
 		validUntilT := time.Now().Add(time.Duration(me.validitySeconds) * time.Second)
@@ -64,17 +195,38 @@ func (me *AccessTokenContext) GetAccessTokenForUserId(userId string) (string, er
 
 	me.userIdToAccessTokenMap.Store(userId, accessToken)
 
+	if me.accessTokenStore != nil {
+		err = me.accessTokenStore.put(me.deviceId, userId, accessToken)
+		if err != nil {
+			// We can do without persisting it, at the expense of obtaining a new one after a restart.
+			log.Printf("failed persisting access token for user %s: %s", userId, err)
+		}
+	}
+
 	return accessTokenString, nil
 }
 
 func (me *AccessTokenContext) ClearAccessTokenForUserId(userId string) {
 	me.userIdToAccessTokenMap.Delete(userId)
+
+	if me.accessTokenStore != nil {
+		err := me.accessTokenStore.delete(me.deviceId, userId)
+		if err != nil {
+			log.Printf("failed forgetting persisted access token for user %s: %s", userId, err)
+		}
+	}
 }
 
 func (me *AccessTokenContext) Release() {
 	me.userIdToAccessTokenMap.Range(func(userId interface{}, accessTokenInterface interface{}) bool {
 		accessToken := accessTokenInterface.(*AccessToken)
 
+		if me.accessTokenStore != nil {
+			// Persisted tokens are kept around for reuse (see SetAccessTokenStore)
+			me.userIdToAccessTokenMap.Delete(userId)
+			return true
+		}
+
 		err := me.connector.DestroyAccessToken(userId.(string), accessToken.Token())
 		if err != nil {
 			log.Printf("failed destroying access token for user %s: %s", userId.(string), err)
@@ -0,0 +1,167 @@
+package connector
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessTokenStore persists access tokens obtained by access token contexts (see AccessTokenContext.SetAccessTokenStore)
+// to a local file, encrypted with AES-256-GCM.
+//
+// This way, tokens survive restarts (sparing us from logging in as every managed user again),
+// without them ever being written to disk in plaintext.
+type AccessTokenStore struct {
+	path string
+	aead cipher.AEAD
+
+	lock sync.Mutex
+
+	// tokens contains access tokens by device id and user id
+	tokens map[string]map[string]storedAccessToken
+}
+
+type storedAccessToken struct {
+	Token      string     `json:"token"`
+	ValidUntil *time.Time `json:"validUntil"`
+}
+
+// NewAccessTokenStore creates a store persisted to the given path, loading the tokens persisted there previously (if any).
+// The encryptionKey needs to be a 32-byte AES-256 key.
+func NewAccessTokenStore(path string, encryptionKey []byte) (*AccessTokenStore, error) {
+	if len(encryptionKey) != 32 {
+		return nil, fmt.Errorf("the encryption key needs to be 32 bytes long, not %d", len(encryptionKey))
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	me := &AccessTokenStore{
+		path:   path,
+		aead:   aead,
+		tokens: map[string]map[string]storedAccessToken{},
+	}
+
+	err = me.read()
+	if err != nil {
+		return nil, fmt.Errorf("failed loading access tokens from %s: %s", path, err)
+	}
+
+	return me, nil
+}
+
+// get returns the (not yet expired) access token persisted for the given user and device, if any
+func (me *AccessTokenStore) get(deviceId string, userId string) *AccessToken {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	stored, exists := me.tokens[deviceId][userId]
+	if !exists {
+		return nil
+	}
+
+	accessToken := newAccessToken(stored.Token, stored.ValidUntil)
+	if accessToken.Expired() {
+		return nil
+	}
+	return accessToken
+}
+
+// put persists the given access token of the user and device, replacing the previous one (if any)
+func (me *AccessTokenStore) put(deviceId string, userId string, accessToken *AccessToken) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if _, exists := me.tokens[deviceId]; !exists {
+		me.tokens[deviceId] = map[string]storedAccessToken{}
+	}
+	me.tokens[deviceId][userId] = storedAccessToken{
+		Token:      accessToken.token,
+		ValidUntil: accessToken.validUntil,
+	}
+
+	return me.write()
+}
+
+// delete forgets about the access token of the given user and device (if any)
+func (me *AccessTokenStore) delete(deviceId string, userId string) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if _, exists := me.tokens[deviceId][userId]; !exists {
+		return nil
+	}
+	delete(me.tokens[deviceId], userId)
+
+	return me.write()
+}
+
+// write persists all tokens, leaving out expired ones. The lock needs to be held.
+func (me *AccessTokenStore) write() error {
+	for deviceId, userIdToToken := range me.tokens {
+		for userId, stored := range userIdToToken {
+			if newAccessToken(stored.Token, stored.ValidUntil).Expired() {
+				delete(userIdToToken, userId)
+			}
+		}
+		if len(userIdToToken) == 0 {
+			delete(me.tokens, deviceId)
+		}
+	}
+
+	plaintext, err := json.Marshal(me.tokens)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, me.aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+
+	// Writing to a temporary file and renaming it, so that a crash midway doesn't leave us with a broken file.
+	temporaryPath := me.path + ".tmp"
+	err = ioutil.WriteFile(temporaryPath, me.aead.Seal(nonce, nonce, plaintext, nil), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, me.path)
+}
+
+// read loads the persisted tokens, if the file exists
+func (me *AccessTokenStore) read() error {
+	ciphertext, err := ioutil.ReadFile(me.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if len(ciphertext) < me.aead.NonceSize() {
+		return fmt.Errorf("data is too short")
+	}
+
+	nonce, sealed := ciphertext[:me.aead.NonceSize()], ciphertext[me.aead.NonceSize():]
+	plaintext, err := me.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return fmt.Errorf("failed decrypting (is the encryption key right?): %s", err)
+	}
+
+	return json.Unmarshal(plaintext, &me.tokens)
+}
@@ -0,0 +1,70 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"fmt"
+)
+
+// GetUserAccountData returns the account data of the given type for the user.
+// When a room id is given, the account data for that room is returned instead of the global one.
+// Account data which doesn't exist yet is returned as an empty map.
+func (me *ApiConnector) GetUserAccountData(
+	ctx *AccessTokenContext,
+	userId string,
+	roomId string,
+	accountDataType string,
+) (map[string]interface{}, error) {
+	if roomId == "" {
+		return me.GetUserAccountDataContentByType(ctx, userId, accountDataType)
+	}
+
+	if me.isReadingAsAdmin(ctx) {
+		return me.adminReader.getUserAccountDataAsAdmin(userId, roomId, accountDataType)
+	}
+
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var accountData map[string]interface{}
+	err = client.MakeRequest(
+		"GET",
+		client.BuildURL(
+			fmt.Sprintf("/user/%s/rooms/%s/account_data/%s", userId, roomId, accountDataType),
+		),
+		nil,
+		&accountData,
+	)
+
+	if err != nil {
+		if matrix.IsErrorWithCode(err, matrix.ErrorNotFound) {
+			// No such account data
+			return map[string]interface{}{}, nil
+		}
+		return nil, err
+	}
+
+	return accountData, nil
+}
+
+// SetUserAccountData replaces the account data of the given type (global, or for the given room) for the user
+func (me *ApiConnector) SetUserAccountData(
+	ctx *AccessTokenContext,
+	userId string,
+	roomId string,
+	accountDataType string,
+	content map[string]interface{},
+) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("/user/%s/account_data/%s", userId, accountDataType)
+	if roomId != "" {
+		path = fmt.Sprintf("/user/%s/rooms/%s/account_data/%s", userId, roomId, accountDataType)
+	}
+
+	return client.MakeRequest("PUT", client.BuildURL(path), content, nil)
+}
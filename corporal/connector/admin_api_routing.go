@@ -0,0 +1,74 @@
+package connector
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// adminApiPathPrefixes are the path prefixes of the homeserver's admin APIs (see adminApiRoutingTransport)
+var adminApiPathPrefixes = []string{
+	"/_synapse/admin/",
+	"/_dendrite/admin/",
+}
+
+// adminApiRoutingTransport is an http.RoundTripper, which sends requests for the homeserver's admin APIs (see adminApiPathPrefixes)
+// to a separate endpoint (if set, see ApiConnector.SetAdminApiEndpoint), instead of to the homeserver's API endpoint.
+//
+// This is for setups where the homeserver API endpoint is a load balancer in front of workers, some of which don't serve admin APIs.
+// Other requests (including ones to other services, like matrix-authentication-service) are sent as they are.
+type adminApiRoutingTransport struct {
+	next http.RoundTripper
+
+	homeserverApiUrl *url.URL
+
+	// adminApiUrl (if set) is where admin API requests get sent to
+	adminApiUrl *url.URL
+}
+
+func (me *adminApiRoutingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if me.adminApiUrl == nil || request.URL.Host != me.homeserverApiUrl.Host {
+		return me.next.RoundTrip(request)
+	}
+
+	homeserverApiPathPrefix := strings.TrimSuffix(me.homeserverApiUrl.Path, "/")
+	path := strings.TrimPrefix(request.URL.Path, homeserverApiPathPrefix)
+	if !isAdminApiPath(path) {
+		return me.next.RoundTrip(request)
+	}
+
+	adminApiPathPrefix := strings.TrimSuffix(me.adminApiUrl.Path, "/")
+
+	routedRequest := request.Clone(request.Context())
+	routedRequest.Host = me.adminApiUrl.Host
+	routedRequest.URL.Scheme = me.adminApiUrl.Scheme
+	routedRequest.URL.Host = me.adminApiUrl.Host
+	routedRequest.URL.Path = adminApiPathPrefix + path
+	if request.URL.RawPath != "" {
+		routedRequest.URL.RawPath = adminApiPathPrefix + strings.TrimPrefix(request.URL.RawPath, homeserverApiPathPrefix)
+	}
+
+	return me.next.RoundTrip(routedRequest)
+}
+
+func isAdminApiPath(path string) bool {
+	for _, prefix := range adminApiPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseApiEndpoint parses an API endpoint URL (like `http://synapse:8008`), making sure it's an absolute one
+func parseApiEndpoint(endpoint string) (*url.URL, error) {
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpointUrl.Scheme == "" || endpointUrl.Host == "" {
+		return nil, fmt.Errorf("%s is not an absolute URL", endpoint)
+	}
+	return endpointUrl, nil
+}
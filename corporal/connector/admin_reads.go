@@ -0,0 +1,30 @@
+package connector
+
+import (
+	"github.com/matrix-org/gomatrix"
+)
+
+// adminReader reads what's otherwise only readable by acting as the users it belongs to, using admin APIs instead.
+//
+// Read-only contexts (see AccessTokenContext.SetReadOnly) can't obtain access tokens for users,
+// so connectors which have such admin APIs (like SynapseConnector) take these reads over from the ApiConnector they're based on.
+type adminReader interface {
+	createAdminClient(subject string, purpose string) (*gomatrix.Client, error)
+	getUserAccountDataAsAdmin(userId string, roomId string, accountDataType string) (map[string]interface{}, error)
+	getUserThreePidsAsAdmin(userId string) ([]CurrentUserThreePid, error)
+}
+
+// isReadingAsAdmin tells whether reads done with the given context are to go through the admin reader (see adminReader).
+// Acting as an application service (see SetAppServiceToken) doesn't involve obtaining access tokens, so it's fine in read-only mode too.
+func (me *ApiConnector) isReadingAsAdmin(ctx *AccessTokenContext) bool {
+	return ctx.IsReadOnly() && me.appServiceToken == "" && me.adminReader != nil
+}
+
+// createRoomReadingClient creates a client for reading something (described by purpose) about the given room as the acting user.
+// When reading as an admin (see isReadingAsAdmin), the admin client is used instead, so the room needs to be visible to it.
+func (me *ApiConnector) createRoomReadingClient(ctx *AccessTokenContext, roomId string, actingUserId string, purpose string) (*gomatrix.Client, error) {
+	if me.isReadingAsAdmin(ctx) {
+		return me.adminReader.createAdminClient(roomId, purpose)
+	}
+	return me.createMatrixClientForUserId(ctx, actingUserId)
+}
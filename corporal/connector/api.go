@@ -3,8 +3,11 @@ package connector
 import (
 	"devture-matrix-corporal/corporal/avatar"
 	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/util"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -14,7 +17,14 @@ import (
 )
 
 const (
-	accountDataTypeAvatarSourceUriHashes = "com.devture.matrix.corporal.avatar_source_uri_hashes"
+	accountDataTypeAvatarSourceUriHashes    = "com.devture.matrix.corporal.avatar_source_uri_hashes"
+	accountDataTypeDeliveredServerNoticeIds = "com.devture.matrix.corporal.delivered_server_notices"
+	accountDataTypeDeclaredRoomIds          = "com.devture.matrix.corporal.declared_rooms"
+	accountDataTypeDeprovisioning           = "com.devture.matrix.corporal.deprovisioning"
+	accountDataTypeAvatarUploadCache        = "com.devture.matrix.corporal.avatar_upload_cache"
+	accountDataTypeReconciliationCheckpoint = "com.devture.matrix.corporal.reconciliation_checkpoint"
+	accountDataTypeUserIdMigrations         = "com.devture.matrix.corporal.user_id_migrations"
+	accountDataTypeManagedRoomIds           = "com.devture.matrix.corporal.managed_rooms"
 )
 
 // ApiConnector is an abstract implementation of MatrixConnector for integrating with a Matrix server via API.
@@ -25,6 +35,27 @@ type ApiConnector struct {
 	logger                            *logrus.Logger
 
 	httpClient *http.Client
+
+	// transport makes httpClient's requests rate-limit aware (see SetRequestBudget)
+	transport *rateLimitAwareTransport
+
+	// resilientTransport makes httpClient's requests get retried and fail fast while the homeserver is unavailable (see SetRetryPolicy and SetCircuitBreaker)
+	resilientTransport *resilientTransport
+
+	// adminApiRoutingTransport makes httpClient's requests for admin APIs go to a separate endpoint (see SetAdminApiEndpoint)
+	adminApiRoutingTransport *adminApiRoutingTransport
+
+	// instrumentedTransport makes each attempt at making one of httpClient's requests get recorded (see SetRequestMetrics and SetHttpTransport)
+	instrumentedTransport *instrumentedTransport
+
+	// accessTokenStore (if set) persists the matrix-corporal user's access tokens (see SetAccessTokenStore)
+	accessTokenStore *AccessTokenStore
+
+	// appServiceToken is the `as_token` of the application service that we act as users through (see SetAppServiceToken)
+	appServiceToken string
+
+	// adminReader (if set) reads what's otherwise only readable by acting as users, when that's not possible (see isReadingAsAdmin)
+	adminReader adminReader
 }
 
 func NewApiConnector(
@@ -36,8 +67,33 @@ func NewApiConnector(
 	// We've had certain versions of Synapse (like 0.33.2) get stuck forever while processing requests.
 	// It's hard to debug when it happens, because we get stuck too.
 	// We never want to get stuck, so we'll use our own http client for gomatrix (set in createMatrixClientForUserIdAndToken()).
-	httpClient := &http.Client{
-		Timeout: time.Duration(timeoutMilliseconds) * time.Millisecond,
+	//
+	// The timeout applies to each attempt at making a request.
+	// Requests which get rate-limited are retried (see rateLimitAwareTransport), which may take longer than that.
+	instrumentedTransport := &instrumentedTransport{}
+	transport := &rateLimitAwareTransport{
+		logger: logger,
+		attemptClient: &http.Client{
+			Timeout:   time.Duration(timeoutMilliseconds) * time.Millisecond,
+			Transport: instrumentedTransport,
+		},
+	}
+
+	// Each request (retried because of the homeserver being unavailable) may in turn be retried because of rate limits.
+	resilientTransport := &resilientTransport{
+		logger: logger,
+		next:   transport,
+	}
+
+	// Requests to an invalid homeserver API endpoint fail anyway, so there would be nothing to route.
+	homeserverApiUrl, _ := url.Parse(homeserverApiEndpoint)
+	if homeserverApiUrl == nil {
+		homeserverApiUrl = &url.URL{}
+	}
+
+	adminApiRoutingTransport := &adminApiRoutingTransport{
+		next:             resilientTransport,
+		homeserverApiUrl: homeserverApiUrl,
 	}
 
 	return &ApiConnector{
@@ -45,34 +101,125 @@ func NewApiConnector(
 		sharedSecretAuthPasswordGenerator: sharedSecretAuthPasswordGenerator,
 		logger:                            logger,
 
-		httpClient: httpClient,
+		httpClient: &http.Client{
+			Transport: adminApiRoutingTransport,
+		},
+		transport:                transport,
+		resilientTransport:       resilientTransport,
+		adminApiRoutingTransport: adminApiRoutingTransport,
+		instrumentedTransport:    instrumentedTransport,
+	}
+}
+
+// SetAdminApiEndpoint makes requests for the homeserver's admin APIs (see adminApiRoutingTransport) go to the given endpoint
+// (e.g. Synapse's main process), while all other requests keep going to the homeserver API endpoint (e.g. a load balancer in front of workers).
+// This is to be called before any requests are made.
+func (me *ApiConnector) SetAdminApiEndpoint(adminApiEndpoint string) error {
+	adminApiUrl, err := parseApiEndpoint(adminApiEndpoint)
+	if err != nil {
+		return fmt.Errorf("invalid admin API endpoint: %s", err)
+	}
+
+	me.adminApiRoutingTransport.adminApiUrl = adminApiUrl
+
+	return nil
+}
+
+// SetRequestMetrics makes requests to the homeserver's APIs get counted and timed (see RequestMetrics).
+// This is to be called before any requests are made.
+func (me *ApiConnector) SetRequestMetrics(requestMetrics *RequestMetrics) {
+	me.instrumentedTransport.requestMetrics = requestMetrics
+	me.transport.requestMetrics = requestMetrics
+}
+
+// SetCategoryTimeouts makes requests of the given categories (see determineApiCategory) time out after the given durations,
+// instead of after the connector's default timeout.
+// Keys may either be exact categories (e.g. `synapse_admin.deactivate`) or whole APIs (e.g. `synapse_admin`).
+// This lets slow operations (like erasing users or deleting rooms) take as long as they need to,
+// without letting fast ones (like fetching profiles) get stuck for as long.
+// This is to be called before any requests are made.
+func (me *ApiConnector) SetCategoryTimeouts(timeouts map[string]time.Duration) {
+	me.transport.categoryAttemptClients = make(map[string]*http.Client, len(timeouts))
+	for category, timeout := range timeouts {
+		me.transport.categoryAttemptClients[category] = &http.Client{
+			Timeout:   timeout,
+			Transport: me.instrumentedTransport,
+		}
 	}
 }
 
+// SetRequestBudget limits how many requests get made to the homeserver's APIs (see RequestBudget).
+// This is to be called before any requests are made.
+func (me *ApiConnector) SetRequestBudget(budget *RequestBudget) {
+	me.transport.budget = budget
+}
+
+// SetRetryPolicy makes requests failing because of the homeserver being unavailable get retried (see RetryPolicy).
+// This is to be called before any requests are made.
+func (me *ApiConnector) SetRetryPolicy(retryPolicy *RetryPolicy) {
+	me.resilientTransport.retryPolicy = retryPolicy
+}
+
+// SetCircuitBreaker makes requests fail right away while the homeserver appears to be unavailable (see CircuitBreaker),
+// instead of each one waiting to time out.
+// This is to be called before any requests are made.
+func (me *ApiConnector) SetCircuitBreaker(circuitBreaker *CircuitBreaker) {
+	me.resilientTransport.circuitBreaker = circuitBreaker
+}
+
+// SetHttpTransport makes requests to the homeserver go through the given transport (see NewHttpTransport),
+// instead of through Go's default one.
+// This is to be called before any requests are made.
+func (me *ApiConnector) SetHttpTransport(transport *http.Transport) {
+	me.instrumentedTransport.next = transport
+}
+
+// SetAccessTokenStore makes the access tokens obtained for the matrix-corporal user be persisted to the given store
+// (see AccessTokenContext.SetAccessTokenStore), so that they get reused after restarts.
+// This is to be called before creating connectors based on this one (like SynapseConnector).
+func (me *ApiConnector) SetAccessTokenStore(accessTokenStore *AccessTokenStore) {
+	me.accessTokenStore = accessTokenStore
+}
+
+// SetAppServiceToken makes us act as users on behalf of the application service with the given `as_token`,
+// whose namespace is to cover all managed users (and the matrix-corporal user).
+//
+// Requests made as users (see createMatrixClientForUserId) then use the application service's identity assertion (the `user_id` query parameter),
+// instead of access tokens obtained by logging in as them. Access tokens which are still needed (e.g. for the matrix-corporal user)
+// are obtained with application service logins (see matrix.LoginTypeApplicationService), instead of with passwords.
+// This is to be called before any requests are made.
+func (me *ApiConnector) SetAppServiceToken(appServiceToken string) {
+	me.appServiceToken = appServiceToken
+}
+
 func (me *ApiConnector) ObtainNewAccessTokenForUserId(userId, deviceId string, validUntil *time.Time) (string, error) {
 	// We ignore validUntil, because the specced /login API does not support token expiration (yet).
 
-	client, _ := me.createMatrixClientForUserIdAndToken("", "")
+	client, _ := me.createMatrixClientForUserIdAndToken("", me.appServiceToken)
 
 	var resp *gomatrix.RespLogin
-	err := matrix.ExecuteWithRateLimitRetries(me.logger, "user.obtain_access_token", func() error {
-		payload := &matrix.ApiLoginRequestPayload{
-			Type: matrix.LoginTypePassword,
+	payload := &matrix.ApiLoginRequestPayload{
+		Type: matrix.LoginTypePassword,
 
-			// Old deprecated field
+		// Old deprecated field
+		User: userId,
+
+		Identifier: matrix.ApiLoginRequestIdentifier{
+			Type: matrix.LoginIdentifierTypeUser,
 			User: userId,
+		},
 
-			Identifier: matrix.ApiLoginRequestIdentifier{
-				Type: matrix.LoginIdentifierTypeUser,
-				User: userId,
-			},
+		Password: me.sharedSecretAuthPasswordGenerator.GenerateForUserId(userId),
+		DeviceID: deviceId,
+	}
 
-			Password: me.sharedSecretAuthPasswordGenerator.GenerateForUserId(userId),
-			DeviceID: deviceId,
-		}
+	if me.appServiceToken != "" {
+		payload.Type = matrix.LoginTypeApplicationService
+		payload.User = ""
+		payload.Password = ""
+	}
 
-		return client.MakeRequest("POST", client.BuildURL("/login"), payload, &resp)
-	})
+	err := client.MakeRequest("POST", client.BuildURL("/login"), payload, &resp)
 
 	if err != nil {
 		return "", err
@@ -83,6 +230,7 @@ func (me *ApiConnector) ObtainNewAccessTokenForUserId(userId, deviceId string, v
 
 func (me *ApiConnector) DestroyAccessToken(userId, accessToken string) error {
 	client, _ := gomatrix.NewClient(me.homeserverApiEndpoint, userId, accessToken)
+	client.Client = me.httpClient
 	_, err := client.Logout()
 
 	if matrix.IsErrorWithCode(err, matrix.ErrorUnknownToken) {
@@ -121,23 +269,38 @@ func (me *ApiConnector) DetermineCurrentState(
 	return nil, fmt.Errorf("not implemented")
 }
 
+func (me *ApiConnector) DetermineUnmanagedUsers(
+	ctx *AccessTokenContext,
+	knownUserIds []string,
+	adminUserId string,
+) ([]CurrentUnmanagedUserState, error) {
+	// Listing all accounts cannot be done using standard (implementation-agnostic) Client-Server APIs.
+	return nil, fmt.Errorf("not implemented")
+}
+
+// getUserStateByUserId determines the current state of the given user.
+//
+// If the user's profile or joined rooms are already known (e.g. fetched in bulk along with all other users, or using admin APIs),
+// they can be passed along, so that we don't need to fetch them again. Otherwise (nil), they get fetched.
 func (me *ApiConnector) getUserStateByUserId(
 	ctx *AccessTokenContext,
 	userId string,
+	userProfile *matrix.ApiUserProfileResponse,
+	joinedRoomIds []string,
 ) (*CurrentUserState, error) {
-	client, err := me.createMatrixClientForUserId(ctx, userId)
-	if err != nil {
-		return nil, err
-	}
-
-	joinedRoomIds, err := me.getJoinedRoomIdsByUserId(ctx, userId)
-	if err != nil {
-		return nil, err
+	var err error
+	if joinedRoomIds == nil {
+		joinedRoomIds, err = me.DetermineUserJoinedRoomIds(ctx, userId)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	userProfile, err := me.GetUserProfileByUserId(ctx, userId)
-	if err != nil {
-		return nil, err
+	if userProfile == nil {
+		userProfile, err = me.GetUserProfileByUserId(ctx, userId)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	displayName := userProfile.DisplayName
@@ -165,16 +328,123 @@ func (me *ApiConnector) getUserStateByUserId(
 		}
 	}
 
+	threePids, err := me.getThreePidsByUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveredServerNoticeIds, err := me.getDeliveredServerNoticeIdsByUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
 	return &CurrentUserState{
-		Id:                  client.UserID,
+		Id:                  userId,
 		Active:              !isDeactivated,
 		DisplayName:         displayName,
 		AvatarMxcUri:        userProfile.AvatarUrl,
 		AvatarSourceUriHash: avatarSourceUriHash,
 		JoinedRoomIds:       joinedRoomIds,
+		ThreePids:           threePids,
+
+		DeliveredServerNoticeIds: deliveredServerNoticeIds,
 	}, nil
 }
 
+func (me *ApiConnector) getThreePidsByUserId(
+	ctx *AccessTokenContext,
+	userId string,
+) ([]CurrentUserThreePid, error) {
+	if me.isReadingAsAdmin(ctx) {
+		return me.adminReader.getUserThreePidsAsAdmin(userId)
+	}
+
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var response matrix.ApiAccountThreePidsResponse
+	err = client.MakeRequest("GET", client.BuildURL("/account/3pid"), nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	threePids := make([]CurrentUserThreePid, 0, len(response.ThreePids))
+	for _, threePid := range response.ThreePids {
+		threePids = append(threePids, CurrentUserThreePid{
+			Medium:  threePid.Medium,
+			Address: threePid.Address,
+		})
+	}
+
+	return threePids, nil
+}
+
+func (me *ApiConnector) getDeliveredServerNoticeIdsByUserId(
+	ctx *AccessTokenContext,
+	userId string,
+) ([]string, error) {
+	accountDataPayload, err := me.GetUserAccountDataContentByType(
+		ctx,
+		userId,
+		accountDataTypeDeliveredServerNoticeIds,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveredServerNoticeIds := make([]string, 0)
+
+	ids, ok := accountDataPayload["ids"].([]interface{})
+	if !ok {
+		return deliveredServerNoticeIds, nil
+	}
+
+	for _, id := range ids {
+		if idString, ok := id.(string); ok {
+			deliveredServerNoticeIds = append(deliveredServerNoticeIds, idString)
+		}
+	}
+
+	return deliveredServerNoticeIds, nil
+}
+
+// markServerNoticeAsDeliveredToUser records (in the user's account data) that the given server notice was delivered,
+// so that we wouldn't deliver it again during subsequent reconciliation runs.
+func (me *ApiConnector) markServerNoticeAsDeliveredToUser(
+	ctx *AccessTokenContext,
+	userId string,
+	noticeId string,
+) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	deliveredServerNoticeIds, err := me.getDeliveredServerNoticeIdsByUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"ids": append(deliveredServerNoticeIds, noticeId),
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		client.BuildURL(
+			fmt.Sprintf(
+				"/user/%s/account_data/%s",
+				userId,
+				accountDataTypeDeliveredServerNoticeIds,
+			),
+		),
+		payload,
+		nil,
+	)
+}
+
 func (me *ApiConnector) storeAvatarSourceUriHashForUserAndMxcUri(
 	ctx *AccessTokenContext,
 	userId string,
@@ -190,22 +460,20 @@ func (me *ApiConnector) storeAvatarSourceUriHashForUserAndMxcUri(
 		mxcUri: avatarSourceUriHash,
 	}
 
-	err = matrix.ExecuteWithRateLimitRetries(me.logger, "user.set_account_data", func() error {
-		// We'll completely overwrite the old account data at that key,
-		// storing only the avatar hash for the given mxcUri and purging everything else.
-		return client.MakeRequest(
-			"PUT",
-			client.BuildURL(
-				fmt.Sprintf(
-					"/user/%s/account_data/%s",
-					userId,
-					accountDataTypeAvatarSourceUriHashes,
-				),
+	// We'll completely overwrite the old account data at that key,
+	// storing only the avatar hash for the given mxcUri and purging everything else.
+	err = client.MakeRequest(
+		"PUT",
+		client.BuildURL(
+			fmt.Sprintf(
+				"/user/%s/account_data/%s",
+				userId,
+				accountDataTypeAvatarSourceUriHashes,
 			),
-			payload,
-			nil,
-		)
-	})
+		),
+		payload,
+		nil,
+	)
 
 	return err
 }
@@ -237,16 +505,130 @@ func (me *ApiConnector) determineAvatarSourceUriHashByUserAndMxcUri(
 	return valueAsString, nil
 }
 
-func (me *ApiConnector) EnsureUserAccountExists(userId, password string) error {
+func (me *ApiConnector) EnsureUserAccountExists(userId, password, userType string) error {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) AddThreePid(ctx *AccessTokenContext, userId string, medium string, address string) error {
+	// Standard (implementation-agnostic) Client-Server APIs only let us add 3pids that have gone through validation.
+	return fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) RemoveThreePid(ctx *AccessTokenContext, userId string, medium string, address string) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	payload := matrix.ApiAccountThreePidDeleteRequest{
+		Medium:  medium,
+		Address: address,
+	}
+
+	return client.MakeRequest("POST", client.BuildURL("/account/3pid/delete"), payload, nil)
+}
+
+func (me *ApiConnector) SendServerNotice(ctx *AccessTokenContext, userId string, noticeId string, message string) error {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return fmt.Errorf("not implemented")
+}
+
+// SendDirectMessage sends a message to the given user, in a new direct message room created by the sender (who invites the user into it).
+// Like with server notices, the notice id (if any) gets recorded as delivered (see markServerNoticeAsDeliveredToUser).
+func (me *ApiConnector) SendDirectMessage(ctx *AccessTokenContext, senderUserId string, userId string, noticeId string, message string) error {
+	roomId, err := me.CreateRoom(ctx, senderUserId, &CreateRoomRequest{
+		Preset:   "trusted_private_chat",
+		Invite:   []string{userId},
+		IsDirect: true,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed creating direct message room: %s", err)
+	}
+
+	client, err := me.createMatrixClientForUserId(ctx, senderUserId)
+	if err != nil {
+		return err
+	}
+
+	txnId := util.Sha512(fmt.Sprintf("%s\x00%s\x00%s", noticeId, userId, roomId))[:32]
+
+	err = client.MakeRequest(
+		"PUT",
+		client.BuildURL(fmt.Sprintf("/rooms/%s/send/m.room.message/%s", roomId, txnId)),
+		gomatrix.TextMessage{MsgType: "m.text", Body: message},
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed sending message to direct message room %s: %s", roomId, err)
+	}
+
+	if noticeId == "" {
+		return nil
+	}
+
+	return me.markServerNoticeAsDeliveredToUser(ctx, userId, noticeId)
+}
+
+func (me *ApiConnector) SetUserServerAdmin(ctx *AccessTokenContext, userId string, admin bool) error {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) SetUserType(ctx *AccessTokenContext, userId string, userType string) error {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) SetUserShadowBanned(ctx *AccessTokenContext, userId string, shadowBanned bool) error {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) DeactivateUserAccount(ctx *AccessTokenContext, userId string, erase bool) error {
+	// The Client-Server API only lets users deactivate their own account, which requires interactive authentication.
+	return fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) DeleteUserMedia(ctx *AccessTokenContext, userId string) error {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) DeleteRoom(ctx *AccessTokenContext, roomId string) error {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) QuarantineMedia(serverName string, mediaId string) error {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) UnquarantineMedia(serverName string, mediaId string) error {
 	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
 	return fmt.Errorf("not implemented")
 }
 
+func (me *ApiConnector) QuarantineRoomMedia(roomId string) (int, error) {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return 0, fmt.Errorf("not implemented")
+}
+
+func (me *ApiConnector) QuarantineUserMedia(userId string) (int, error) {
+	// This cannot be implemented using standard (implementation-agnostic) Client-Server APIs.
+	return 0, fmt.Errorf("not implemented")
+}
+
 func (me *ApiConnector) GetUserAccountDataContentByType(
 	ctx *AccessTokenContext,
 	userId string,
 	accountDataType string,
 ) (map[string]interface{}, error) {
+	if me.isReadingAsAdmin(ctx) {
+		return me.adminReader.getUserAccountDataAsAdmin(userId, "", accountDataType)
+	}
+
 	client, err := me.createMatrixClientForUserId(ctx, userId)
 	if err != nil {
 		return nil, err
@@ -289,7 +671,8 @@ func (me *ApiConnector) GetUserProfileByUserId(ctx *AccessTokenContext, userId s
 	return &resp, nil
 }
 
-func (me *ApiConnector) getJoinedRoomIdsByUserId(
+// DetermineUserJoinedRoomIds fetches the ids of all rooms the given user is joined to (acting as the user)
+func (me *ApiConnector) DetermineUserJoinedRoomIds(
 	ctx *AccessTokenContext,
 	userId string,
 ) ([]string, error) {
@@ -324,9 +707,7 @@ func (me *ApiConnector) SetUserAvatar(
 		// and we don't know if it's used elsewhere.
 		// It's not our job to delete it.
 
-		return matrix.ExecuteWithRateLimitRetries(me.logger, "user.set_avatar", func() error {
-			return client.SetAvatarURL("")
-		})
+		return client.SetAvatarURL("")
 	}
 
 	// Request for setting a new avatar.
@@ -334,26 +715,55 @@ func (me *ApiConnector) SetUserAvatar(
 	// There may be an old avatar whose image we're leaving behind. We intentionally do not care.
 	// We apply the same reasoning as above (for avatar removal).
 
+	mxcUri, err := me.UploadAvatar(ctx, userId, avatar)
+	if err != nil {
+		return err
+	}
+
+	return me.SetUserAvatarMxcUri(ctx, userId, mxcUri, avatar.UriHash)
+}
+
+// UploadAvatar uploads the given avatar image to the content repository (as the given user) and returns its mxc:// URI
+func (me *ApiConnector) UploadAvatar(
+	ctx *AccessTokenContext,
+	uploaderUserId string,
+	avatar *avatar.Avatar,
+) (string, error) {
+	client, err := me.createMatrixClientForUserId(ctx, uploaderUserId)
+	if err != nil {
+		return "", err
+	}
+
 	// This request cannot be retried so easily, as we'd need to rewind the Body somehow.
 	resp, err := client.UploadToContentRepo(avatar.Body, avatar.ContentType, avatar.ContentLength)
 	if err != nil {
-		return fmt.Errorf("failed uploading avatar: %s", err)
+		return "", fmt.Errorf("failed uploading avatar: %s", err)
 	}
 
-	mxcUri := resp.ContentURI
+	return resp.ContentURI, nil
+}
 
-	err = matrix.ExecuteWithRateLimitRetries(me.logger, "user.set_avatar", func() error {
-		return client.SetAvatarURL(mxcUri)
-	})
+// SetUserAvatarMxcUri sets the user's avatar to an already uploaded image,
+// remembering which source (see avatar.UriHash) it's derived from.
+func (me *ApiConnector) SetUserAvatarMxcUri(
+	ctx *AccessTokenContext,
+	userId string,
+	mxcUri string,
+	avatarSourceUriHash string,
+) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	err = client.SetAvatarURL(mxcUri)
 	if err != nil {
 		return fmt.Errorf("failed setting avatar: %s", err)
 	}
 
 	// To keep track of what this avatar is derived from, store a mapping
 	// between the file and the uri hash of its source.
-	err = matrix.ExecuteWithRateLimitRetries(me.logger, "user.store_avatar_source_uri_hash", func() error {
-		return me.storeAvatarSourceUriHashForUserAndMxcUri(ctx, userId, mxcUri, avatar.UriHash)
-	})
+	err = me.storeAvatarSourceUriHashForUserAndMxcUri(ctx, userId, mxcUri, avatarSourceUriHash)
 	if err != nil {
 		return fmt.Errorf("failed storing avatar URI to avatar source uri hash mapping: %s", err)
 	}
@@ -371,9 +781,7 @@ func (me *ApiConnector) SetUserDisplayName(
 		return err
 	}
 
-	return matrix.ExecuteWithRateLimitRetries(me.logger, "user.set_display_name", func() error {
-		return client.SetDisplayName(displayName)
-	})
+	return client.SetDisplayName(displayName)
 }
 
 func (me *ApiConnector) InviteUserToRoom(
@@ -387,10 +795,10 @@ func (me *ApiConnector) InviteUserToRoom(
 		return err
 	}
 
-	return matrix.ExecuteWithRateLimitRetries(me.logger, "room.invite", func() error {
-		_, err := client.InviteUser(roomId, &gomatrix.ReqInviteUser{UserID: inviteeId})
-		return err
-	})
+	defer ctx.invalidateRoomState(roomId)
+
+	_, err = client.InviteUser(roomId, &gomatrix.ReqInviteUser{UserID: inviteeId})
+	return err
 }
 
 func (me *ApiConnector) JoinRoom(
@@ -403,11 +811,17 @@ func (me *ApiConnector) JoinRoom(
 		return err
 	}
 
-	return matrix.ExecuteWithRateLimitRetries(me.logger, "room.join", func() error {
-		// This request is idempotent.
-		_, err := client.JoinRoom(roomId, "", nil)
-		return err
-	})
+	defer ctx.invalidateRoomState(roomId)
+
+	// This request is idempotent.
+	_, err = client.JoinRoom(roomId, "", nil)
+	return err
+}
+
+// ForceJoinRoom makes the user join the given room (or room alias).
+// Without admin APIs, the user can only join by themselves, so this only works for rooms which they're allowed to join (e.g. public ones).
+func (me *ApiConnector) ForceJoinRoom(ctx *AccessTokenContext, userId string, roomIdOrAlias string) error {
+	return me.JoinRoom(ctx, userId, roomIdOrAlias)
 }
 
 func (me *ApiConnector) DemoteUserInRoom(
@@ -449,10 +863,10 @@ func (me *ApiConnector) DemoteUserInRoom(
 		return fmt.Errorf("failed setting user in power levels object: %s", err)
 	}
 
-	return matrix.ExecuteWithRateLimitRetries(me.logger, "user.demote", func() error {
-		_, err := client.SendStateEvent(roomId, "m.room.power_levels", "", jsonObj.Data())
-		return err
-	})
+	defer ctx.invalidateRoomState(roomId)
+
+	_, err = client.SendStateEvent(roomId, "m.room.power_levels", "", jsonObj.Data())
+	return err
 }
 
 func (me *ApiConnector) KickUserFromRoom(
@@ -470,13 +884,13 @@ func (me *ApiConnector) KickUserFromRoom(
 		return err
 	}
 
-	return matrix.ExecuteWithRateLimitRetries(me.logger, "room.kick", func() error {
-		// This request is idempotent.
-		_, err := client.KickUser(roomId, &gomatrix.ReqKickUser{
-			UserID: kickeeUserId,
-		})
-		return err
+	defer ctx.invalidateRoomState(roomId)
+
+	// This request is idempotent.
+	_, err = client.KickUser(roomId, &gomatrix.ReqKickUser{
+		UserID: kickeeUserId,
 	})
+	return err
 }
 
 func (me *ApiConnector) LeaveRoom(
@@ -489,25 +903,608 @@ func (me *ApiConnector) LeaveRoom(
 		return err
 	}
 
-	return matrix.ExecuteWithRateLimitRetries(me.logger, "room.leave", func() error {
-		// This request is idempotent.
-		_, err := client.LeaveRoom(roomId)
+	defer ctx.invalidateRoomState(roomId)
+
+	// This request is idempotent.
+	_, err = client.LeaveRoom(roomId)
+	return err
+}
+
+// DetermineCurrentRoomState fetches the given (empty state key) state events for a room, as seen by the admin user.
+func (me *ApiConnector) DetermineCurrentRoomState(
+	ctx *AccessTokenContext,
+	roomId string,
+	stateEventTypes []string,
+	adminUserId string,
+) (*CurrentRoomState, error) {
+	client, err := me.createMatrixClientForUserId(ctx, adminUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	roomState := &CurrentRoomState{
+		Id:                 roomId,
+		StateEventContents: map[string]map[string]interface{}{},
+	}
+
+	for _, eventType := range stateEventTypes {
+		var content map[string]interface{}
+		err = client.StateEvent(roomId, eventType, "", &content)
+		if err != nil {
+			if matrix.IsErrorWithCode(err, matrix.ErrorNotFound) {
+				// No such state event
+				continue
+			}
+			return nil, fmt.Errorf("failed fetching %s state for %s: %s", eventType, roomId, err)
+		}
+
+		roomState.StateEventContents[eventType] = content
+	}
+
+	return roomState, nil
+}
+
+// DetermineCurrentRoomMembers fetches the users who are joined to (or invited to) a room, as seen by the acting user.
+// The result maps user ids to their membership (`join` or `invite`).
+func (me *ApiConnector) DetermineCurrentRoomMembers(
+	ctx *AccessTokenContext,
+	roomId string,
+	actingUserId string,
+) (map[string]string, error) {
+	client, err := me.createMatrixClientForUserId(ctx, actingUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Chunk []gomatrix.Event `json:"chunk"`
+	}
+	err = client.MakeRequest("GET", client.BuildURL("rooms", roomId, "members"), nil, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching members of %s: %s", roomId, err)
+	}
+
+	members := map[string]string{}
+	for _, event := range response.Chunk {
+		if event.StateKey == nil {
+			continue
+		}
+
+		membership, _ := event.Content["membership"].(string)
+		if membership == "join" || membership == "invite" {
+			members[*event.StateKey] = membership
+		}
+	}
+
+	return members, nil
+}
+
+// CreateRoom creates a room (as the given user), returning its id.
+// If an avatar is given, it gets uploaded and set as part of the room's initial state.
+func (me *ApiConnector) CreateRoom(
+	ctx *AccessTokenContext,
+	creatorUserId string,
+	request *CreateRoomRequest,
+	avatar *avatar.Avatar,
+) (string, error) {
+	client, err := me.createMatrixClientForUserId(ctx, creatorUserId)
+	if err != nil {
+		return "", err
+	}
+
+	if avatar != nil && avatar.ContentType != "" {
+		// This request cannot be retried so easily, as we'd need to rewind the Body somehow.
+		resp, err := client.UploadToContentRepo(avatar.Body, avatar.ContentType, avatar.ContentLength)
+		if err != nil {
+			return "", fmt.Errorf("failed uploading avatar: %s", err)
+		}
+
+		request.InitialState = append(request.InitialState, CreateRoomRequestStateEvent{
+			Type:    "m.room.avatar",
+			Content: map[string]interface{}{"url": resp.ContentURI},
+		})
+	}
+
+	var response gomatrix.RespCreateRoom
+
+	// Not retrying on rate-limiting, as a request which has actually gone through would leave us with a duplicate room.
+	err = client.MakeRequest("POST", client.BuildURL("createRoom"), request, &response)
+	if err != nil {
+		return "", err
+	}
+
+	return response.RoomID, nil
+}
+
+// GetDeclaredRoomIds returns the ids of the rooms created for declared rooms (see policy.DeclaredRoom) by key,
+// as recorded in the given user's account data.
+func (me *ApiConnector) GetDeclaredRoomIds(ctx *AccessTokenContext, userId string) (map[string]string, error) {
+	accountDataPayload, err := me.GetUserAccountDataContentByType(ctx, userId, accountDataTypeDeclaredRoomIds)
+	if err != nil {
+		return nil, err
+	}
+
+	declaredRoomIds := map[string]string{}
+
+	rooms, ok := accountDataPayload["rooms"].(map[string]interface{})
+	if !ok {
+		return declaredRoomIds, nil
+	}
+
+	for key, roomId := range rooms {
+		if roomIdString, ok := roomId.(string); ok {
+			declaredRoomIds[key] = roomIdString
+		}
+	}
+
+	return declaredRoomIds, nil
+}
+
+// StoreDeclaredRoomId records (in the given user's account data) the id of the room created for a declared room,
+// so that we wouldn't create it again during subsequent reconciliation runs.
+func (me *ApiConnector) StoreDeclaredRoomId(ctx *AccessTokenContext, userId string, key string, roomId string) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
 		return err
-	})
+	}
+
+	declaredRoomIds, err := me.GetDeclaredRoomIds(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	declaredRoomIds[key] = roomId
+
+	payload := map[string]interface{}{
+		"rooms": declaredRoomIds,
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		client.BuildURL(
+			fmt.Sprintf(
+				"/user/%s/account_data/%s",
+				userId,
+				accountDataTypeDeclaredRoomIds,
+			),
+		),
+		payload,
+		nil,
+	)
+}
+
+// GetDeprovisioningState returns what the given user (the matrix-corporal user) has recorded about deprovisioning users (see StoreDeprovisioningState)
+func (me *ApiConnector) GetDeprovisioningState(ctx *AccessTokenContext, userId string) (*DeprovisioningState, error) {
+	accountDataPayload, err := me.GetUserAccountDataContentByType(ctx, userId, accountDataTypeDeprovisioning)
+	if err != nil {
+		return nil, err
+	}
+
+	deprovisioningState := NewDeprovisioningState()
+
+	if managedUserIds, ok := accountDataPayload["managedUserIds"].([]interface{}); ok {
+		for _, managedUserId := range managedUserIds {
+			if managedUserIdString, ok := managedUserId.(string); ok {
+				deprovisioningState.ManagedUserIds = append(deprovisioningState.ManagedUserIds, managedUserIdString)
+			}
+		}
+	}
+
+	if deprovisionedAt, ok := accountDataPayload["deprovisionedAt"].(map[string]interface{}); ok {
+		for deprovisionedUserId, timestamp := range deprovisionedAt {
+			if timestampFloat, ok := timestamp.(float64); ok {
+				deprovisioningState.DeprovisionedAt[deprovisionedUserId] = int64(timestampFloat)
+			}
+		}
+	}
+
+	return deprovisioningState, nil
+}
+
+// StoreDeprovisioningState records (in the given user's account data) what's known about deprovisioning users,
+// so that it survives restarts and is available during subsequent reconciliation runs.
+func (me *ApiConnector) StoreDeprovisioningState(ctx *AccessTokenContext, userId string, deprovisioningState *DeprovisioningState) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		client.BuildURL(
+			fmt.Sprintf(
+				"/user/%s/account_data/%s",
+				userId,
+				accountDataTypeDeprovisioning,
+			),
+		),
+		deprovisioningState,
+		nil,
+	)
+}
+
+// GetUserIdMigrationState returns what the given user (the matrix-corporal user) has recorded about user id migrations (see StoreUserIdMigrationState)
+func (me *ApiConnector) GetUserIdMigrationState(ctx *AccessTokenContext, userId string) (*UserIdMigrationState, error) {
+	accountDataPayload, err := me.GetUserAccountDataContentByType(ctx, userId, accountDataTypeUserIdMigrations)
+	if err != nil {
+		return nil, err
+	}
+
+	userIdMigrationState := NewUserIdMigrationState()
+
+	if completed, ok := accountDataPayload["completed"].(map[string]interface{}); ok {
+		for oldUserId, completedMigration := range completed {
+			completedMigrationMap, ok := completedMigration.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			newUserId, _ := completedMigrationMap["newUserId"].(string)
+			completedAt, _ := completedMigrationMap["completedAt"].(float64)
+			if newUserId == "" {
+				continue
+			}
+
+			userIdMigrationState.Completed[oldUserId] = CompletedUserIdMigration{
+				NewUserId:   newUserId,
+				CompletedAt: int64(completedAt),
+			}
+		}
+	}
+
+	return userIdMigrationState, nil
+}
+
+// StoreUserIdMigrationState records (in the given user's account data) which user id migrations have been completed,
+// so that they don't happen again during subsequent reconciliation runs.
+func (me *ApiConnector) StoreUserIdMigrationState(ctx *AccessTokenContext, userId string, userIdMigrationState *UserIdMigrationState) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		client.BuildURL(
+			fmt.Sprintf(
+				"/user/%s/account_data/%s",
+				userId,
+				accountDataTypeUserIdMigrations,
+			),
+		),
+		userIdMigrationState,
+		nil,
+	)
+}
+
+// GetManagedRoomIds returns the ids of the rooms which were managed as of the last reconciliation run (see StoreManagedRoomIds),
+// as recorded in the given user's account data. Nothing having been recorded yet is reported as a nil list.
+func (me *ApiConnector) GetManagedRoomIds(ctx *AccessTokenContext, userId string) ([]string, error) {
+	accountDataPayload, err := me.GetUserAccountDataContentByType(ctx, userId, accountDataTypeManagedRoomIds)
+	if err != nil {
+		return nil, err
+	}
+
+	roomIds, ok := accountDataPayload["roomIds"].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	managedRoomIds := make([]string, 0, len(roomIds))
+	for _, roomId := range roomIds {
+		if roomIdString, ok := roomId.(string); ok {
+			managedRoomIds = append(managedRoomIds, roomIdString)
+		}
+	}
+
+	return managedRoomIds, nil
+}
+
+// StoreManagedRoomIds records (in the given user's account data) the ids of the managed rooms,
+// so that rooms which are no longer managed can be told apart during subsequent reconciliation runs (see policy.OrphanedRooms).
+func (me *ApiConnector) StoreManagedRoomIds(ctx *AccessTokenContext, userId string, roomIds []string) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]interface{}{
+		"roomIds": roomIds,
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		client.BuildURL(
+			fmt.Sprintf(
+				"/user/%s/account_data/%s",
+				userId,
+				accountDataTypeManagedRoomIds,
+			),
+		),
+		payload,
+		nil,
+	)
+}
+
+// GetAvatarUploadCache returns what the given user (the matrix-corporal user) has recorded about uploaded avatars (see StoreAvatarUploadCache)
+func (me *ApiConnector) GetAvatarUploadCache(ctx *AccessTokenContext, userId string) (*AvatarUploadCache, error) {
+	accountDataPayload, err := me.GetUserAccountDataContentByType(ctx, userId, accountDataTypeAvatarUploadCache)
+	if err != nil {
+		return nil, err
+	}
+
+	avatarUploadCache := NewAvatarUploadCache()
+
+	if uploads, ok := accountDataPayload["uploads"].(map[string]interface{}); ok {
+		for sourceUriHash, upload := range uploads {
+			uploadMap, ok := upload.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			mxcUri, _ := uploadMap["mxcUri"].(string)
+			contentHash, _ := uploadMap["contentHash"].(string)
+			if mxcUri == "" {
+				continue
+			}
+
+			avatarUploadCache.Uploads[sourceUriHash] = AvatarUpload{
+				MxcUri:      mxcUri,
+				ContentHash: contentHash,
+			}
+		}
+	}
+
+	return avatarUploadCache, nil
+}
+
+// StoreAvatarUploadCache records (in the given user's account data) where avatars got uploaded to,
+// so that it survives restarts and uploads can be reused during subsequent reconciliation runs.
+func (me *ApiConnector) StoreAvatarUploadCache(ctx *AccessTokenContext, userId string, avatarUploadCache *AvatarUploadCache) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		client.BuildURL(
+			fmt.Sprintf(
+				"/user/%s/account_data/%s",
+				userId,
+				accountDataTypeAvatarUploadCache,
+			),
+		),
+		avatarUploadCache,
+		nil,
+	)
+}
+
+// GetReconciliationCheckpoint returns the checkpoint that the given user (the matrix-corporal user) has recorded (see StoreReconciliationCheckpoint),
+// or nil if there's none.
+func (me *ApiConnector) GetReconciliationCheckpoint(ctx *AccessTokenContext, userId string) (*ReconciliationCheckpoint, error) {
+	accountDataPayload, err := me.GetUserAccountDataContentByType(ctx, userId, accountDataTypeReconciliationCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(accountDataPayload) == 0 {
+		return nil, nil
+	}
+
+	// Actions have arbitrary payloads, so parsing by hand (like for other account data) is not an option
+	payloadBytes, err := json.Marshal(accountDataPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint ReconciliationCheckpoint
+	err = json.Unmarshal(payloadBytes, &checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing reconciliation checkpoint: %s", err)
+	}
+
+	return &checkpoint, nil
+}
+
+// StoreReconciliationCheckpoint records (in the given user's account data) the progress of a reconciliation run,
+// so that it survives restarts. A nil checkpoint clears any previously stored one.
+func (me *ApiConnector) StoreReconciliationCheckpoint(ctx *AccessTokenContext, userId string, checkpoint *ReconciliationCheckpoint) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	// Account data can't be deleted, so clearing means storing an empty object
+	var payload interface{} = map[string]interface{}{}
+	if checkpoint != nil {
+		payload = checkpoint
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		client.BuildURL(
+			fmt.Sprintf(
+				"/user/%s/account_data/%s",
+				userId,
+				accountDataTypeReconciliationCheckpoint,
+			),
+		),
+		payload,
+		nil,
+	)
+}
+
+// DetermineCurrentKeyedRoomState fetches all (not removed) state events of the given types for a room, as seen by the acting user.
+// The result maps event types to state keys and contents (see CurrentRoomState.KeyedStateEventContents).
+func (me *ApiConnector) DetermineCurrentKeyedRoomState(
+	ctx *AccessTokenContext,
+	roomId string,
+	stateEventTypes []string,
+	actingUserId string,
+) (map[string]map[string]map[string]interface{}, error) {
+	client, err := me.createMatrixClientForUserId(ctx, actingUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []gomatrix.Event
+	err = client.MakeRequest("GET", client.BuildURL("rooms", roomId, "state"), nil, &events)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching state for %s: %s", roomId, err)
+	}
+
+	contents := map[string]map[string]map[string]interface{}{}
+	for _, eventType := range stateEventTypes {
+		contents[eventType] = map[string]map[string]interface{}{}
+	}
+
+	for _, event := range events {
+		if event.StateKey == nil || len(event.Content) == 0 {
+			continue
+		}
+
+		contentsByStateKey, exists := contents[event.Type]
+		if !exists {
+			continue
+		}
+		contentsByStateKey[*event.StateKey] = event.Content
+	}
+
+	return contents, nil
+}
+
+func (me *ApiConnector) SetRoomState(
+	ctx *AccessTokenContext,
+	userId string,
+	roomId string,
+	eventType string,
+	stateKey string,
+	content map[string]interface{},
+) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	defer ctx.invalidateRoomState(roomId)
+
+	_, err = client.SendStateEvent(roomId, eventType, stateKey, content)
+	return err
+}
+
+// GetRoomDirectoryVisibility tells whether the room is listed in the homeserver's public room directory (`public`) or not (`private`)
+func (me *ApiConnector) GetRoomDirectoryVisibility(ctx *AccessTokenContext, roomId string, actingUserId string) (string, error) {
+	client, err := me.createRoomReadingClient(ctx, roomId, actingUserId, "determining the directory visibility of")
+	if err != nil {
+		return "", err
+	}
+
+	var response matrix.ApiRoomDirectoryVisibility
+	err = client.MakeRequest("GET", client.BuildURL(fmt.Sprintf("/directory/list/room/%s", roomId)), nil, &response)
+	if err != nil {
+		return "", fmt.Errorf("failed fetching the directory visibility of %s: %s", roomId, err)
+	}
+
+	return response.Visibility, nil
+}
+
+// SetRoomDirectoryVisibility lists the room in (or removes it from) the homeserver's public room directory.
+// The given user needs to have enough power in the room (or be a server admin).
+func (me *ApiConnector) SetRoomDirectoryVisibility(ctx *AccessTokenContext, userId string, roomId string, visibility string) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		client.BuildURL(fmt.Sprintf("/directory/list/room/%s", roomId)),
+		matrix.ApiRoomDirectoryVisibility{Visibility: visibility},
+		nil,
+	)
+}
+
+// GetRoomAliases returns the local aliases (those hosted on our homeserver), which point to the room
+func (me *ApiConnector) GetRoomAliases(ctx *AccessTokenContext, roomId string, actingUserId string) ([]string, error) {
+	client, err := me.createRoomReadingClient(ctx, roomId, actingUserId, "determining the aliases of")
+	if err != nil {
+		return nil, err
+	}
+
+	var response matrix.ApiRoomAliases
+	err = client.MakeRequest("GET", client.BuildURL(fmt.Sprintf("/rooms/%s/aliases", roomId)), nil, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching the aliases of %s: %s", roomId, err)
+	}
+
+	return response.Aliases, nil
+}
+
+// CreateRoomAlias makes the given (local) alias point to the room.
+// Creating an alias which already points to another room fails.
+func (me *ApiConnector) CreateRoomAlias(ctx *AccessTokenContext, userId string, roomId string, alias string) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		client.BuildURL(fmt.Sprintf("/directory/room/%s", alias)),
+		matrix.ApiRoomAliasCreateRequest{RoomId: roomId},
+		nil,
+	)
+}
+
+// DeleteRoomAlias deletes the given (local) alias.
+// The given user needs to have created the alias, have enough power in the room it points to (or be a server admin).
+func (me *ApiConnector) DeleteRoomAlias(ctx *AccessTokenContext, userId string, alias string) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest("DELETE", client.BuildURL(fmt.Sprintf("/directory/room/%s", alias)), nil, nil)
 }
 
 // createMatrixClientForUserId gets an access token (reuses or obtains a new one) for the user
-// and creates an API client with it
+// and creates an API client with it, which replaces the token if it stops working.
+// When acting as an application service (see SetAppServiceToken), no access token is needed and the client asserts the user's identity instead.
 func (me *ApiConnector) createMatrixClientForUserId(
 	ctx *AccessTokenContext,
 	userId string,
 ) (*gomatrix.Client, error) {
+	if me.appServiceToken != "" {
+		client, err := me.createMatrixClientForUserIdAndToken(userId, me.appServiceToken)
+		if err != nil {
+			return nil, err
+		}
+		client.AppServiceUserID = userId
+		return client, nil
+	}
+
 	accessToken, err := ctx.GetAccessTokenForUserId(userId)
 	if err != nil {
 		return nil, err
 	}
 
-	return me.createMatrixClientForUserIdAndToken(userId, accessToken)
+	client, err := me.createMatrixClientForUserIdAndToken(userId, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens may stop working while we're using them (see tokenRefreshingTransport)
+	client.Client = &http.Client{
+		Transport: &tokenRefreshingTransport{
+			logger: me.logger,
+			next:   me.httpClient.Transport,
+			ctx:    ctx,
+			userId: userId,
+		},
+	}
+
+	return client, nil
 }
 
 func (me *ApiConnector) createMatrixClientForUserIdAndToken(
@@ -527,7 +1524,7 @@ func (me *ApiConnector) createMatrixClientForUserIdAndToken(
 // VerifyAccessToken verifies that an access token works and belongs
 // to the user it's expected to belong to
 func (me *ApiConnector) VerifyAccessToken(userId string, accessToken string) error {
-	client, err := gomatrix.NewClient(me.homeserverApiEndpoint, userId, accessToken)
+	client, err := me.createMatrixClientForUserIdAndToken(userId, accessToken)
 	if err != nil {
 		return err
 	}
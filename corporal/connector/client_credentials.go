@@ -0,0 +1,100 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientCredentialsExpirationLeeway is how long before their expiration access tokens obtained by ClientCredentialsTokenSource get replaced
+const clientCredentialsExpirationLeeway = 30 * time.Second
+
+// ClientCredentialsTokenSource obtains OAuth 2.0 access tokens with the `client_credentials` grant (see RFC 6749, section 4.4).
+//
+// Each token gets reused until it's about to expire (see clientCredentialsExpirationLeeway), at which point a new one gets obtained.
+type ClientCredentialsTokenSource struct {
+	httpClient *http.Client
+
+	tokenEndpoint string
+	clientId      string
+	clientSecret  string
+	scope         string
+
+	lock sync.Mutex
+
+	accessToken           string
+	accessTokenValidUntil time.Time
+}
+
+func NewClientCredentialsTokenSource(
+	httpClient *http.Client,
+	tokenEndpoint string,
+	clientId string,
+	clientSecret string,
+	scope string,
+) *ClientCredentialsTokenSource {
+	return &ClientCredentialsTokenSource{
+		httpClient: httpClient,
+
+		tokenEndpoint: tokenEndpoint,
+		clientId:      clientId,
+		clientSecret:  clientSecret,
+		scope:         scope,
+	}
+}
+
+// GetAccessToken returns the current access token, obtaining a new one if there's none yet or it's about to expire
+func (me *ClientCredentialsTokenSource) GetAccessToken() (string, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if me.accessToken != "" && time.Now().Before(me.accessTokenValidUntil) {
+		return me.accessToken, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", me.scope)
+
+	request, err := http.NewRequest("POST", me.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(me.clientId), url.QueryEscape(me.clientSecret))
+
+	httpResponse, err := me.httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the token endpoint responded with HTTP %d: %s", httpResponse.StatusCode, string(responseBody))
+	}
+
+	var response matrix.ApiOAuthTokenResponse
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return "", fmt.Errorf("failed decoding token response: %s", err)
+	}
+	if response.AccessToken == "" {
+		return "", fmt.Errorf("the token endpoint did not provide an access token")
+	}
+
+	me.accessToken = response.AccessToken
+	me.accessTokenValidUntil = time.Now().Add(time.Duration(response.ExpiresIn)*time.Second - clientCredentialsExpirationLeeway)
+
+	return me.accessToken, nil
+}
@@ -0,0 +1,169 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// ConduitConnector is a MatrixConnector implementation for controlling a Conduit (or conduwuit) server.
+// It is based on the base ApiConnector for doing whatever's possible,
+// but also contains Conduit-specific logic here.
+//
+// Conduit doesn't have HTTP admin APIs, nor does it support the Shared Secret Authenticator password provider.
+// Instead, matrix-corporal acts as an application service (registered with the homeserver), whose namespace covers all users
+// (see ApiConnector.SetAppServiceToken, which is required): accounts get created on its behalf and users are acted as through it.
+//
+// Admin operations (like deactivating accounts) are performed by sending commands to the homeserver's admin room,
+// as the matrix-corporal user (who needs to be a member of it, which is what makes users server admins on Conduit).
+// Commands are carried out by the homeserver asynchronously and their results are not waited for.
+type ConduitConnector struct {
+	*ApiConnector
+
+	implementation       string
+	homeserverDomainName string
+	corporalUserID       string
+
+	corporalUserAccessTokenContext *AccessTokenContext
+
+	corporalUserIDLock *sync.Mutex
+}
+
+func NewConduitConnector(
+	apiConnector *ApiConnector,
+	implementation string,
+	homeserverDomainName string,
+	corporalUserID string,
+) *ConduitConnector {
+	me := &ConduitConnector{
+		ApiConnector: apiConnector,
+
+		implementation:       implementation,
+		homeserverDomainName: homeserverDomainName,
+		corporalUserID:       corporalUserID,
+
+		corporalUserIDLock: &sync.Mutex{},
+	}
+
+	// Like with SynapseConnector, the matrix-corporal user's token is obtained directly (via the ApiConnector, with an application service login)
+	// and is kept around until `Release()`.
+	me.corporalUserAccessTokenContext = NewAccessTokenContext(
+		me.ApiConnector,
+		deviceIdCorporal,
+		0,
+	)
+	me.corporalUserAccessTokenContext.SetAccessTokenStore(me.accessTokenStore)
+
+	return me
+}
+
+// EnsureUserAccountExists creates the given user's account (unless it exists already), on behalf of the application service.
+//
+// Accounts created this way don't have a password, so the given one is ignored (see ConduitConnector).
+// Conduit doesn't support user types.
+func (me *ConduitConnector) EnsureUserAccountExists(userId, password, userType string) error {
+	if userType != "" {
+		return fmt.Errorf("user types (%s) are not supported by %s", userType, me.implementation)
+	}
+
+	userIdLocalPart, err := gomatrix.ExtractUserLocalpart(userId)
+	if err != nil {
+		return err
+	}
+
+	client, _ := me.createMatrixClientForUserIdAndToken("", me.appServiceToken)
+
+	err = client.MakeRequest(
+		"POST",
+		client.BuildURL("/register"),
+		matrix.ApiApplicationServiceRegisterRequestPayload{
+			Type:     matrix.LoginTypeApplicationService,
+			Username: userIdLocalPart,
+
+			// We'd rather not have an access token (a device) created, as we don't need it.
+			InhibitLogin: true,
+		},
+		nil,
+	)
+
+	// Swallow "user already exists" errors.
+	// We don't care who created it and when. We only care that it exists.
+	if err != nil && !matrix.IsErrorWithCode(err, matrix.ErrorUserInUse) {
+		return err
+	}
+
+	return nil
+}
+
+// DeactivateUserAccount deactivates the given user's account, via an admin room command (see ConduitConnector).
+// Conduit doesn't support erasing accounts.
+func (me *ConduitConnector) DeactivateUserAccount(ctx *AccessTokenContext, userId string, erase bool) error {
+	if erase {
+		return fmt.Errorf("erasing accounts is not supported by %s", me.implementation)
+	}
+
+	command := fmt.Sprintf("deactivate-user %s", userId)
+	if me.implementation == HomeserverImplementationConduwuit {
+		command = fmt.Sprintf("users deactivate %s", userId)
+	}
+
+	return me.sendAdminCommand(userId, "deactivating", command)
+}
+
+// sendAdminCommand sends the given command to the homeserver's admin room (`#admins:<domain>`), as the matrix-corporal user.
+//
+// Conduit only handles commands addressed to its server user, while conduwuit expects them to start with `!admin`.
+func (me *ConduitConnector) sendAdminCommand(userId string, purpose string, command string) error {
+	client, err := me.createAdminClient(userId, purpose)
+	if err != nil {
+		return err
+	}
+
+	adminRoomAlias := fmt.Sprintf("#admins:%s", me.homeserverDomainName)
+
+	var resolveResponse matrix.ApiRoomAliasResolveResponse
+	err = client.MakeRequest("GET", client.BuildURL("directory", "room", adminRoomAlias), nil, &resolveResponse)
+	if err != nil {
+		return fmt.Errorf("failed resolving the admin room (%s): %s", adminRoomAlias, err)
+	}
+
+	message := fmt.Sprintf("@conduit:%s: %s", me.homeserverDomainName, command)
+	if me.implementation == HomeserverImplementationConduwuit {
+		message = fmt.Sprintf("!admin %s", command)
+	}
+
+	_, err = client.SendText(resolveResponse.RoomId, message)
+	if err != nil {
+		return fmt.Errorf("failed sending admin command (%s) to the admin room: %s", command, err)
+	}
+
+	return nil
+}
+
+func (me *ConduitConnector) createAdminClient(userId string, purpose string) (*gomatrix.Client, error) {
+	corporalUserAccessToken, err := me.getAccessTokenForCorporalUser()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"could not obtain access token for `%s`, necessary for %s `%s`: %s",
+			me.corporalUserID,
+			purpose,
+			userId,
+			err,
+		)
+	}
+
+	return me.createMatrixClientForUserIdAndToken(me.corporalUserID, corporalUserAccessToken)
+}
+
+func (me *ConduitConnector) Release() {
+	me.corporalUserAccessTokenContext.Release()
+}
+
+func (me *ConduitConnector) getAccessTokenForCorporalUser() (string, error) {
+	me.corporalUserIDLock.Lock()
+	defer me.corporalUserIDLock.Unlock()
+
+	return me.corporalUserAccessTokenContext.GetAccessTokenForUserId(me.corporalUserID)
+}
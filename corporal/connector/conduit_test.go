@@ -0,0 +1,251 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// createTestConduitConnector creates a connector (acting as the `as-token` application service) for a homeserver of the given implementation,
+// which handles requests with the given handler.
+func createTestConduitConnector(t *testing.T, implementation string, handler http.HandlerFunc) *ConduitConnector {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	apiConnector := NewApiConnector(server.URL, testPasswordGenerator, 1000, logger)
+	apiConnector.SetAppServiceToken("as-token")
+
+	return NewConduitConnector(apiConnector, implementation, "example.com", "@corporal:example.com")
+}
+
+func TestConduitConnectorEnsureUserAccountExists(t *testing.T) {
+	type testData struct {
+		name string
+
+		// registerErrorCode is what registering fails with (if anything)
+		registerErrorCode string
+
+		expectedErrorCode string
+	}
+
+	tests := []testData{
+		{"new account", "", ""},
+		{"existing account", matrix.ErrorUserInUse, ""},
+		{"registration failure", matrix.ErrorForbidden, matrix.ErrorForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registered := false
+
+			connector := createTestConduitConnector(t, HomeserverImplementationConduit, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method+" "+r.URL.Path != "POST /_matrix/client/r0/register" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+					writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+					return
+				}
+
+				if r.Header.Get("Authorization") != "Bearer as-token" {
+					t.Errorf("expected registration on behalf of the application service, got: %s", r.Header.Get("Authorization"))
+				}
+
+				var payload matrix.ApiApplicationServiceRegisterRequestPayload
+				json.NewDecoder(r.Body).Decode(&payload)
+
+				expectedPayload := matrix.ApiApplicationServiceRegisterRequestPayload{
+					Type:         matrix.LoginTypeApplicationService,
+					Username:     "user",
+					InhibitLogin: true,
+				}
+				if payload != expectedPayload {
+					t.Errorf("unexpected registration payload: %#v", payload)
+				}
+
+				registered = true
+
+				if test.registerErrorCode != "" {
+					writeTestMatrixError(w, http.StatusBadRequest, test.registerErrorCode)
+					return
+				}
+				w.Write([]byte(`{"user_id": "@user:example.com"}`))
+			})
+
+			err := connector.EnsureUserAccountExists("@user:example.com", "policy-password", "")
+			if test.expectedErrorCode == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.expectedErrorCode != "" && !matrix.IsErrorWithCode(err, test.expectedErrorCode) {
+				t.Fatalf("expected an error with code %s, got: %v", test.expectedErrorCode, err)
+			}
+
+			if !registered {
+				t.Errorf("expected the account to be registered")
+			}
+		})
+	}
+}
+
+func TestConduitConnectorEnsureUserAccountExistsRejectsUserTypes(t *testing.T) {
+	connector := createTestConduitConnector(t, HomeserverImplementationConduit, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+	})
+
+	err := connector.EnsureUserAccountExists("@user:example.com", "policy-password", "bot")
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// serveTestConduitAdminRoom handles what sending admin commands involves (logging in as the matrix-corporal user and resolving the admin room),
+// telling whether the request has been handled.
+func serveTestConduitAdminRoom(t *testing.T, w http.ResponseWriter, r *http.Request) bool {
+	switch r.Method + " " + r.URL.Path {
+	case "POST /_matrix/client/r0/login":
+		var payload matrix.ApiLoginRequestPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		// Conduit doesn't support the Shared Secret Authenticator, so we log in as the application service
+		if payload.Type != matrix.LoginTypeApplicationService || payload.Identifier.User != "@corporal:example.com" || payload.Password != "" {
+			t.Errorf("unexpected login payload: %#v", payload)
+		}
+		if r.Header.Get("Authorization") != "Bearer as-token" {
+			t.Errorf("expected logging in as the application service, got: %s", r.Header.Get("Authorization"))
+		}
+
+		w.Write([]byte(`{"access_token": "corporal-token"}`))
+	case "GET /_matrix/client/r0/account/whoami":
+		w.Write([]byte(`{"user_id": "@corporal:example.com"}`))
+	case "GET /_matrix/client/r0/directory/room/#admins:example.com":
+		w.Write([]byte(`{"room_id": "!admins:example.com"}`))
+	default:
+		return false
+	}
+
+	return true
+}
+
+func TestConduitConnectorDeactivateUserAccount(t *testing.T) {
+	type testData struct {
+		implementation  string
+		expectedMessage string
+	}
+
+	tests := []testData{
+		// Conduit only handles commands addressed to its server user
+		{HomeserverImplementationConduit, "@conduit:example.com: deactivate-user @user:example.com"},
+		{HomeserverImplementationConduwuit, "!admin users deactivate @user:example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.implementation, func(t *testing.T) {
+			sentMessages := []string{}
+
+			connector := createTestConduitConnector(t, test.implementation, func(w http.ResponseWriter, r *http.Request) {
+				if serveTestConduitAdminRoom(t, w, r) {
+					return
+				}
+
+				if r.Method != "PUT" || !strings.HasPrefix(r.URL.Path, "/_matrix/client/r0/rooms/!admins:example.com/send/m.room.message/") {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+					writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+					return
+				}
+
+				if r.Header.Get("Authorization") != "Bearer corporal-token" {
+					t.Errorf("expected the command to be sent as the matrix-corporal user, got: %s", r.Header.Get("Authorization"))
+				}
+				if r.URL.Query().Get("user_id") != "" {
+					t.Errorf("expected the command not to be sent on behalf of anyone, got: %s", r.URL.RawQuery)
+				}
+
+				var payload struct {
+					MsgType string `json:"msgtype"`
+					Body    string `json:"body"`
+				}
+				json.NewDecoder(r.Body).Decode(&payload)
+
+				if payload.MsgType != "m.text" {
+					t.Errorf("unexpected message type: %s", payload.MsgType)
+				}
+				sentMessages = append(sentMessages, payload.Body)
+
+				w.Write([]byte(`{"event_id": "$event"}`))
+			})
+
+			ctx := NewAccessTokenContext(connector, "device", 0)
+
+			err := connector.DeactivateUserAccount(ctx, "@user:example.com", false)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if len(sentMessages) != 1 || sentMessages[0] != test.expectedMessage {
+				t.Errorf("expected the `%s` command to be sent, got: %v", test.expectedMessage, sentMessages)
+			}
+		})
+	}
+}
+
+func TestConduitConnectorDeactivateUserAccountFailures(t *testing.T) {
+	type testData struct {
+		name  string
+		erase bool
+
+		// adminRoomResolvable tells whether the admin room alias resolves
+		adminRoomResolvable bool
+
+		// sendErrorCode is what sending the command fails with (if anything)
+		sendErrorCode string
+
+		expectedErrorContains string
+	}
+
+	tests := []testData{
+		{"erasing", true, true, "", "not supported"},
+		{"admin room not found", false, false, "", "failed resolving the admin room (#admins:example.com)"},
+		{"not a member of the admin room", false, true, matrix.ErrorForbidden, "failed sending admin command"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connector := createTestConduitConnector(t, HomeserverImplementationConduit, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/_matrix/client/r0/directory/room/#admins:example.com" && !test.adminRoomResolvable {
+					writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+					return
+				}
+
+				if serveTestConduitAdminRoom(t, w, r) {
+					return
+				}
+
+				if test.sendErrorCode != "" && strings.HasPrefix(r.URL.Path, "/_matrix/client/r0/rooms/!admins:example.com/send/") {
+					writeTestMatrixError(w, http.StatusForbidden, test.sendErrorCode)
+					return
+				}
+
+				t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+			})
+
+			ctx := NewAccessTokenContext(connector, "device", 0)
+
+			err := connector.DeactivateUserAccount(ctx, "@user:example.com", test.erase)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !strings.Contains(err.Error(), test.expectedErrorContains) {
+				t.Errorf("expected the error to mention `%s`, got: %s", test.expectedErrorContains, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// DendriteConnector is a MatrixConnector implementation for controlling a Dendrite server.
+// It is based on the base ApiConnector for doing whatever's possible,
+// but also contains Dendrite-specific API calls here.
+//
+// Dendrite doesn't support the Shared Secret Authenticator password provider, which ApiConnector (and the HTTP gateway) rely on
+// for logging in as users. Instead, users' homeserver passwords are the ones that the authenticator would have accepted
+// (see matrix.SharedSecretAuthPasswordGenerator): accounts get created with such a password and it gets reset (via the admin API)
+// for accounts which have a different one.
+type DendriteConnector struct {
+	*ApiConnector
+
+	registrationSharedSecret string
+	corporalUserID           string
+
+	corporalUserAccessTokenContext *AccessTokenContext
+
+	corporalUserIDLock *sync.Mutex
+}
+
+func NewDendriteConnector(
+	apiConnector *ApiConnector,
+	registrationSharedSecret string,
+	corporalUserID string,
+) *DendriteConnector {
+	me := &DendriteConnector{
+		ApiConnector: apiConnector,
+
+		registrationSharedSecret: registrationSharedSecret,
+		corporalUserID:           corporalUserID,
+
+		corporalUserIDLock: &sync.Mutex{},
+	}
+
+	// Like with SynapseConnector, the matrix-corporal user's token is obtained directly (via the ApiConnector)
+	// and is kept around until `Release()`.
+	me.corporalUserAccessTokenContext = NewAccessTokenContext(
+		me.ApiConnector,
+		deviceIdCorporal,
+		0,
+	)
+	me.corporalUserAccessTokenContext.SetAccessTokenStore(me.accessTokenStore)
+
+	return me
+}
+
+// ObtainNewAccessTokenForUserId is a reimplementation of ApiConnector.ObtainNewAccessTokenForUserId,
+// which resets the user's password (see DendriteConnector) if logging in fails, and then tries again.
+//
+// The matrix-corporal user's password is never reset, as we need to be logged in as it to do so.
+func (me *DendriteConnector) ObtainNewAccessTokenForUserId(userId, deviceId string, validUntil *time.Time) (string, error) {
+	accessToken, err := me.ApiConnector.ObtainNewAccessTokenForUserId(userId, deviceId, validUntil)
+	if err == nil || userId == me.corporalUserID || !matrix.IsErrorWithCode(err, matrix.ErrorForbidden) {
+		return accessToken, err
+	}
+
+	me.logger.Infof("Resetting the password of %s, as logging in as them failed: %s", userId, err)
+
+	err = me.resetUserPassword(userId, me.sharedSecretAuthPasswordGenerator.GenerateForUserId(userId))
+	if err != nil {
+		return "", fmt.Errorf("failed resetting password, after failing to log in: %s", err)
+	}
+
+	return me.ApiConnector.ObtainNewAccessTokenForUserId(userId, deviceId, validUntil)
+}
+
+// resetUserPassword changes the given user's password (without logging out their devices), using the Dendrite Admin API
+func (me *DendriteConnector) resetUserPassword(userId string, password string) error {
+	client, err := me.createAdminClient(userId, "resetting the password of")
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest(
+		"POST",
+		buildPrefixlessURL(client, fmt.Sprintf("/_dendrite/admin/resetPassword/%s", userId), map[string]string{}),
+		matrix.ApiDendriteAdminRequestResetPassword{
+			Password:      password,
+			LogoutDevices: false,
+		},
+		nil,
+	)
+}
+
+// EnsureUserAccountExists creates the given user's account (unless it exists already), using the Shared-Secret Registration API.
+//
+// Accounts are created with the password that we log in with (see DendriteConnector), instead of the given one.
+// Dendrite doesn't support user types.
+func (me *DendriteConnector) EnsureUserAccountExists(userId, password, userType string) error {
+	if userType != "" {
+		return fmt.Errorf("user types (%s) are not supported by Dendrite", userType)
+	}
+
+	return me.registerUserAccount(me.registrationSharedSecret, userId, me.sharedSecretAuthPasswordGenerator.GenerateForUserId(userId), "")
+}
+
+// DetermineCurrentDevices returns the devices of the given user, using the (admin-only) Client-Server whois API.
+// Unlike listing devices as the user, this doesn't require obtaining an access token (a new device) for the user.
+//
+// Dendrite tells when each connection of a device has last been seen, so devices are considered last seen at the most recent one.
+func (me *DendriteConnector) DetermineCurrentDevices(ctx *AccessTokenContext, userId string) ([]CurrentUserDevice, error) {
+	client, err := me.createAdminClient(userId, "determining the devices of")
+	if err != nil {
+		return nil, err
+	}
+
+	var response matrix.ApiAdminWhoisResponse
+	err = client.MakeRequest("GET", client.BuildURL("admin", "whois", userId), nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]CurrentUserDevice, 0, len(response.Devices))
+	for deviceId, whoisDevice := range response.Devices {
+		device := CurrentUserDevice{
+			Id: deviceId,
+		}
+		for _, session := range whoisDevice.Sessions {
+			for _, connection := range session.Connections {
+				if connection.LastSeen > device.LastSeenTs {
+					device.LastSeenTs = connection.LastSeen
+				}
+			}
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+func (me *DendriteConnector) createAdminClient(userId string, purpose string) (*gomatrix.Client, error) {
+	corporalUserAccessToken, err := me.getAccessTokenForCorporalUser()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"could not obtain access token for `%s`, necessary for %s `%s`: %s",
+			me.corporalUserID,
+			purpose,
+			userId,
+			err,
+		)
+	}
+
+	return me.createMatrixClientForUserIdAndToken(me.corporalUserID, corporalUserAccessToken)
+}
+
+func (me *DendriteConnector) Release() {
+	me.corporalUserAccessTokenContext.Release()
+}
+
+func (me *DendriteConnector) getAccessTokenForCorporalUser() (string, error) {
+	me.corporalUserIDLock.Lock()
+	defer me.corporalUserIDLock.Unlock()
+
+	return me.corporalUserAccessTokenContext.GetAccessTokenForUserId(me.corporalUserID)
+}
@@ -0,0 +1,278 @@
+package connector
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"devture-matrix-corporal/corporal/matrix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testPasswordGenerator generates the passwords that connectors log in with (in tests)
+var testPasswordGenerator = matrix.NewSharedSecretAuthPasswordGenerator("shared-secret")
+
+// createTestDendriteConnector creates a connector for a homeserver which handles requests with the given handler.
+// Registration uses the `registration-secret` shared secret.
+func createTestDendriteConnector(t *testing.T, handler http.HandlerFunc) *DendriteConnector {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return NewDendriteConnector(
+		NewApiConnector(server.URL, testPasswordGenerator, 1000, logger),
+		"registration-secret",
+		"@corporal:example.com",
+	)
+}
+
+// writeTestMatrixError responds like homeservers do when requests fail
+func writeTestMatrixError(w http.ResponseWriter, statusCode int, errorCode string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"errcode": errorCode, "error": "Something went wrong"})
+}
+
+func TestDendriteConnectorEnsureUserAccountExists(t *testing.T) {
+	type testData struct {
+		name string
+
+		// registerErrorCode is what registering fails with (if anything)
+		registerErrorCode string
+
+		expectedErrorCode string
+		expectedLogout    bool
+	}
+
+	tests := []testData{
+		{"new account", "", "", true},
+		{"existing account", matrix.ErrorUserInUse, "", false},
+		{"registration failure", matrix.ErrorForbidden, matrix.ErrorForbidden, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loggedOut := false
+			var registerPayload matrix.ApiUserAccountRegisterRequestPayload
+
+			connector := createTestDendriteConnector(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method + " " + r.URL.Path {
+				case "GET /_synapse/admin/v1/register":
+					w.Write([]byte(`{"nonce": "some-nonce"}`))
+				case "POST /_synapse/admin/v1/register":
+					json.NewDecoder(r.Body).Decode(&registerPayload)
+
+					if test.registerErrorCode != "" {
+						writeTestMatrixError(w, http.StatusBadRequest, test.registerErrorCode)
+						return
+					}
+					w.Write([]byte(`{"access_token": "registration-token", "user_id": "@user:example.com"}`))
+				case "POST /_matrix/client/r0/logout":
+					if r.Header.Get("Authorization") != "Bearer registration-token" {
+						t.Errorf("expected the registration token to be logged out, got: %s", r.Header.Get("Authorization"))
+					}
+					loggedOut = true
+					w.Write([]byte(`{}`))
+				default:
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+					writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+				}
+			})
+
+			err := connector.EnsureUserAccountExists("@user:example.com", "policy-password", "")
+			if test.expectedErrorCode == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.expectedErrorCode != "" && !matrix.IsErrorWithCode(err, test.expectedErrorCode) {
+				t.Fatalf("expected an error with code %s, got: %v", test.expectedErrorCode, err)
+			}
+
+			// Accounts get the password that we log in with, instead of the one from the policy
+			expectedPassword := testPasswordGenerator.GenerateForUserId("@user:example.com")
+			if registerPayload.Username != "user" || registerPayload.Password != expectedPassword {
+				t.Errorf("unexpected registration payload: %#v", registerPayload)
+			}
+
+			mac := hmac.New(sha1.New, []byte("registration-secret"))
+			mac.Write([]byte("some-nonce\x00user\x00" + expectedPassword + "\x00notadmin"))
+			if registerPayload.Mac != fmt.Sprintf("%x", mac.Sum(nil)) {
+				t.Errorf("unexpected registration MAC: %s", registerPayload.Mac)
+			}
+
+			if loggedOut != test.expectedLogout {
+				t.Errorf("expected logging out of the registration token to be %t, got %t", test.expectedLogout, loggedOut)
+			}
+		})
+	}
+}
+
+func TestDendriteConnectorEnsureUserAccountExistsRejectsUserTypes(t *testing.T) {
+	connector := createTestDendriteConnector(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+	})
+
+	err := connector.EnsureUserAccountExists("@user:example.com", "policy-password", "bot")
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestDendriteConnectorObtainNewAccessTokenForUserIdResetsPassword(t *testing.T) {
+	passwordReset := false
+	var userLoginAttempts int
+
+	connector := createTestDendriteConnector(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /_matrix/client/r0/login":
+			var payload matrix.ApiLoginRequestPayload
+			json.NewDecoder(r.Body).Decode(&payload)
+
+			if payload.Type != matrix.LoginTypePassword || payload.Password != testPasswordGenerator.GenerateForUserId(payload.Identifier.User) {
+				t.Errorf("unexpected login payload: %#v", payload)
+			}
+
+			if payload.Identifier.User == "@corporal:example.com" {
+				w.Write([]byte(`{"access_token": "corporal-token"}`))
+				return
+			}
+
+			userLoginAttempts++
+			if !passwordReset {
+				writeTestMatrixError(w, http.StatusForbidden, matrix.ErrorForbidden)
+				return
+			}
+			w.Write([]byte(`{"access_token": "user-token"}`))
+		case "GET /_matrix/client/r0/account/whoami":
+			w.Write([]byte(`{"user_id": "@corporal:example.com"}`))
+		case "POST /_dendrite/admin/resetPassword/@user:example.com":
+			if r.Header.Get("Authorization") != "Bearer corporal-token" {
+				t.Errorf("expected the password to be reset as the matrix-corporal user, got: %s", r.Header.Get("Authorization"))
+			}
+
+			var payload matrix.ApiDendriteAdminRequestResetPassword
+			json.NewDecoder(r.Body).Decode(&payload)
+
+			if payload.Password != testPasswordGenerator.GenerateForUserId("@user:example.com") || payload.LogoutDevices {
+				t.Errorf("unexpected password reset payload: %#v", payload)
+			}
+
+			passwordReset = true
+			w.Write([]byte(`{"password_updated": true}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+		}
+	})
+
+	accessToken, err := connector.ObtainNewAccessTokenForUserId("@user:example.com", "device", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if accessToken != "user-token" {
+		t.Errorf("unexpected access token: %s", accessToken)
+	}
+	if !passwordReset {
+		t.Errorf("expected the password to be reset")
+	}
+	if userLoginAttempts != 2 {
+		t.Errorf("expected logging in to be attempted again after resetting the password, got %d attempts", userLoginAttempts)
+	}
+}
+
+func TestDendriteConnectorObtainNewAccessTokenForUserIdDoesNotAlwaysResetPassword(t *testing.T) {
+	type testData struct {
+		name           string
+		userId         string
+		loginErrorCode string
+	}
+
+	tests := []testData{
+		// We'd need to be logged in as the matrix-corporal user to reset its password
+		{"matrix-corporal user", "@corporal:example.com", matrix.ErrorForbidden},
+		{"login failure unrelated to the password", "@user:example.com", matrix.ErrorUserDeactivated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connector := createTestDendriteConnector(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method+" "+r.URL.Path != "POST /_matrix/client/r0/login" {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+				writeTestMatrixError(w, http.StatusForbidden, test.loginErrorCode)
+			})
+
+			_, err := connector.ObtainNewAccessTokenForUserId(test.userId, "device", nil)
+			if !matrix.IsErrorWithCode(err, test.loginErrorCode) {
+				t.Errorf("expected an error with code %s, got: %v", test.loginErrorCode, err)
+			}
+		})
+	}
+}
+
+func TestDendriteConnectorDetermineCurrentDevices(t *testing.T) {
+	connector := createTestDendriteConnector(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /_matrix/client/r0/login":
+			w.Write([]byte(`{"access_token": "corporal-token"}`))
+		case "GET /_matrix/client/r0/account/whoami":
+			w.Write([]byte(`{"user_id": "@corporal:example.com"}`))
+		case "GET /_matrix/client/r0/admin/whois/@user:example.com":
+			if r.Header.Get("Authorization") != "Bearer corporal-token" {
+				t.Errorf("expected devices to be determined as the matrix-corporal user, got: %s", r.Header.Get("Authorization"))
+			}
+
+			w.Write([]byte(`{
+				"user_id": "@user:example.com",
+				"devices": {
+					"PHONE": {"sessions": [
+						{"connections": [{"last_seen": 1600000001000}, {"last_seen": 1600000003000}]},
+						{"connections": [{"last_seen": 1600000002000}]}
+					]},
+					"LAPTOP": {"sessions": []}
+				}
+			}`))
+		case "GET /_matrix/client/r0/admin/whois/@unknown:example.com":
+			writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+		}
+	})
+
+	ctx := NewAccessTokenContext(connector, "device", 0)
+
+	devices, err := connector.DetermineCurrentDevices(ctx, "@user:example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	lastSeenTsByDeviceId := map[string]int64{}
+	for _, device := range devices {
+		lastSeenTsByDeviceId[device.Id] = device.LastSeenTs
+	}
+
+	// Devices are last seen at their most recent connection
+	expectedLastSeenTsByDeviceId := map[string]int64{"PHONE": 1600000003000, "LAPTOP": 0}
+	if len(devices) != len(expectedLastSeenTsByDeviceId) {
+		t.Fatalf("expected %d devices, got: %#v", len(expectedLastSeenTsByDeviceId), devices)
+	}
+	for deviceId, expectedLastSeenTs := range expectedLastSeenTsByDeviceId {
+		lastSeenTs, exists := lastSeenTsByDeviceId[deviceId]
+		if !exists || lastSeenTs != expectedLastSeenTs {
+			t.Errorf("expected device %s to be last seen at %d, got: %#v", deviceId, expectedLastSeenTs, devices)
+		}
+	}
+
+	_, err = connector.DetermineCurrentDevices(ctx, "@unknown:example.com")
+	if !matrix.IsErrorWithCode(err, matrix.ErrorNotFound) {
+		t.Errorf("expected an error with code %s, got: %v", matrix.ErrorNotFound, err)
+	}
+}
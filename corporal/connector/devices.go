@@ -0,0 +1,41 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"fmt"
+)
+
+// DetermineCurrentDevices returns the devices (sessions) of the given user
+func (me *ApiConnector) DetermineCurrentDevices(ctx *AccessTokenContext, userId string) ([]CurrentUserDevice, error) {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var response matrix.ApiDevicesResponse
+	err = client.MakeRequest("GET", client.BuildURL("devices"), nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return convertApiDevices(response.Devices), nil
+}
+
+func (me *ApiConnector) DeleteDevices(ctx *AccessTokenContext, userId string, deviceIds []string) error {
+	// Deleting devices via the Client-Server API requires interactive authentication.
+	return fmt.Errorf("not implemented")
+}
+
+func convertApiDevices(apiDevices []matrix.ApiDevice) []CurrentUserDevice {
+	devices := make([]CurrentUserDevice, 0, len(apiDevices))
+	for _, apiDevice := range apiDevices {
+		device := CurrentUserDevice{
+			Id: apiDevice.DeviceId,
+		}
+		if apiDevice.LastSeenTs != nil {
+			device.LastSeenTs = *apiDevice.LastSeenTs
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
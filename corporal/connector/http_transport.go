@@ -0,0 +1,95 @@
+package connector
+
+import (
+	"crypto/tls"
+	"devture-matrix-corporal/corporal/httphelp"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HttpTransportOptions tunes the transport that the connector talks to the homeserver with (see NewHttpTransport).
+// Zero values mean "use the default".
+type HttpTransportOptions struct {
+	// KeepAlive is the interval between TCP keep-alive probes. A negative value disables them.
+	KeepAlive time.Duration
+
+	// IdleConnectionTimeout is how long idle (keep-alive) connections are kept around for, before getting closed
+	IdleConnectionTimeout time.Duration
+
+	// MaxIdleConnections limits how many idle connections are kept around (across all hosts)
+	MaxIdleConnections int
+
+	// MaxIdleConnectionsPerHost limits how many idle connections are kept around for each host.
+	// Go's default is very low (2), which makes most concurrent requests (see reconciliation.ConcurrencyLimiter) set up new connections.
+	MaxIdleConnectionsPerHost int
+
+	// MaxConnectionsPerHost limits how many connections (active or idle) there are to each host. Zero means no limit.
+	MaxConnectionsPerHost int
+
+	// TlsCaPath (if specified) makes only the CA certificates in it be trusted, instead of the system ones
+	TlsCaPath string
+
+	// TlsClientCertificatePath and TlsClientKeyPath (if specified) are the client certificate to present
+	TlsClientCertificatePath string
+	TlsClientKeyPath         string
+
+	// TlsInsecureSkipVerify disables verifying the homeserver's certificate. It's only meant for testing.
+	TlsInsecureSkipVerify bool
+}
+
+const (
+	defaultHttpTransportKeepAlive             = 30 * time.Second
+	defaultHttpTransportIdleConnectionTimeout = 90 * time.Second
+	defaultHttpTransportMaxIdleConnections    = 100
+)
+
+// NewHttpTransport creates a transport for talking to the homeserver (see ApiConnector.SetHttpTransport), which reuses connections across requests.
+//
+// Unless specified otherwise, as many idle connections are kept around for the homeserver as there are in total,
+// so that connections get reused even when making lots of requests at the same time.
+func NewHttpTransport(options HttpTransportOptions) (*http.Transport, error) {
+	tlsConfig, err := httphelp.NewTlsConfig(options.TlsClientCertificatePath, options.TlsClientKeyPath, options.TlsCaPath)
+	if err != nil {
+		return nil, err
+	}
+	if options.TlsInsecureSkipVerify {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	keepAlive := options.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = defaultHttpTransportKeepAlive
+	}
+
+	idleConnectionTimeout := options.IdleConnectionTimeout
+	if idleConnectionTimeout == 0 {
+		idleConnectionTimeout = defaultHttpTransportIdleConnectionTimeout
+	}
+
+	maxIdleConnections := options.MaxIdleConnections
+	if maxIdleConnections == 0 {
+		maxIdleConnections = defaultHttpTransportMaxIdleConnections
+	}
+
+	maxIdleConnectionsPerHost := options.MaxIdleConnectionsPerHost
+	if maxIdleConnectionsPerHost == 0 {
+		maxIdleConnectionsPerHost = maxIdleConnections
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: keepAlive,
+	}).DialContext
+	transport.IdleConnTimeout = idleConnectionTimeout
+	transport.MaxIdleConns = maxIdleConnections
+	transport.MaxIdleConnsPerHost = maxIdleConnectionsPerHost
+	transport.MaxConnsPerHost = options.MaxConnectionsPerHost
+	transport.TLSClientConfig = tlsConfig
+
+	return transport, nil
+}
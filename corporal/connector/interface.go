@@ -6,21 +6,110 @@ import (
 	"time"
 )
 
+const (
+	// HomeserverImplementationSynapse is for controlling Synapse servers (see SynapseConnector)
+	HomeserverImplementationSynapse = "synapse"
+
+	// HomeserverImplementationDendrite is for controlling Dendrite servers (see DendriteConnector)
+	HomeserverImplementationDendrite = "dendrite"
+
+	// HomeserverImplementationConduit is for controlling Conduit servers (see ConduitConnector)
+	HomeserverImplementationConduit = "conduit"
+
+	// HomeserverImplementationConduwuit is for controlling conduwuit servers (see ConduitConnector), which differ from Conduit in their admin commands
+	HomeserverImplementationConduwuit = "conduwuit"
+
+	// HomeserverImplementationNoop is for not controlling any server at all, but merely logging what would have been done (see NoopConnector)
+	HomeserverImplementationNoop = "noop"
+)
+
+// KnownHomeserverImplementations lists the homeserver implementations that there are connectors for
+var KnownHomeserverImplementations = []string{
+	HomeserverImplementationSynapse,
+	HomeserverImplementationDendrite,
+	HomeserverImplementationConduit,
+	HomeserverImplementationConduwuit,
+	HomeserverImplementationNoop,
+}
+
 type MatrixConnector interface {
 	ObtainNewAccessTokenForUserId(userId, deviceId string, validUntil *time.Time) (string, error)
 	VerifyAccessToken(userId, accessToken string) error
 	DestroyAccessToken(userId, accessToken string) error
 	LogoutAllAccessTokensForUser(ctx *AccessTokenContext, userId string) error
+	DeactivateUserAccount(ctx *AccessTokenContext, userId string, erase bool) error
+	DeleteUserMedia(ctx *AccessTokenContext, userId string) error
+	DeleteRoom(ctx *AccessTokenContext, roomId string) error
+
+	QuarantineMedia(serverName string, mediaId string) error
+	UnquarantineMedia(serverName string, mediaId string) error
+	QuarantineRoomMedia(roomId string) (int, error)
+	QuarantineUserMedia(userId string) (int, error)
+
+	DetermineCurrentDevices(ctx *AccessTokenContext, userId string) ([]CurrentUserDevice, error)
+	DeleteDevices(ctx *AccessTokenContext, userId string, deviceIds []string) error
 
 	DetermineCurrentState(ctx *AccessTokenContext, managedUserIds []string, adminUserId string) (*CurrentState, error)
+	DetermineUnmanagedUsers(ctx *AccessTokenContext, knownUserIds []string, adminUserId string) ([]CurrentUnmanagedUserState, error)
+	DetermineCurrentRoomState(ctx *AccessTokenContext, roomId string, stateEventTypes []string, adminUserId string) (*CurrentRoomState, error)
+	DetermineCurrentRoomMembers(ctx *AccessTokenContext, roomId string, actingUserId string) (map[string]string, error)
+	DetermineUserJoinedRoomIds(ctx *AccessTokenContext, userId string) ([]string, error)
+	DetermineCurrentKeyedRoomState(ctx *AccessTokenContext, roomId string, stateEventTypes []string, actingUserId string) (map[string]map[string]map[string]interface{}, error)
 
-	EnsureUserAccountExists(userId, password string) error
+	EnsureUserAccountExists(userId, password, userType string) error
 
 	GetUserProfileByUserId(ctx *AccessTokenContext, userId string) (*matrix.ApiUserProfileResponse, error)
 	SetUserDisplayName(ctx *AccessTokenContext, userId string, displayName string) error
 	SetUserAvatar(ctx *AccessTokenContext, userId string, avatar *avatar.Avatar) error
+	UploadAvatar(ctx *AccessTokenContext, uploaderUserId string, avatar *avatar.Avatar) (string, error)
+	SetUserAvatarMxcUri(ctx *AccessTokenContext, userId string, mxcUri string, avatarSourceUriHash string) error
+	SetUserServerAdmin(ctx *AccessTokenContext, userId string, admin bool) error
+	SetUserType(ctx *AccessTokenContext, userId string, userType string) error
+	SetUserShadowBanned(ctx *AccessTokenContext, userId string, shadowBanned bool) error
 
 	InviteUserToRoom(ctx *AccessTokenContext, inviterId string, inviteeId string, roomId string) error
 	JoinRoom(ctx *AccessTokenContext, userId string, roomId string) error
+	ForceJoinRoom(ctx *AccessTokenContext, userId string, roomIdOrAlias string) error
 	LeaveRoom(ctx *AccessTokenContext, userId string, roomId string) error
+	KickUserFromRoom(ctx *AccessTokenContext, kickerId string, kickeeId string, roomId string) error
+	CreateRoom(ctx *AccessTokenContext, creatorUserId string, request *CreateRoomRequest, avatar *avatar.Avatar) (string, error)
+	SetRoomState(ctx *AccessTokenContext, userId string, roomId string, eventType string, stateKey string, content map[string]interface{}) error
+
+	GetRoomDirectoryVisibility(ctx *AccessTokenContext, roomId string, actingUserId string) (string, error)
+	SetRoomDirectoryVisibility(ctx *AccessTokenContext, userId string, roomId string, visibility string) error
+
+	GetRoomAliases(ctx *AccessTokenContext, roomId string, actingUserId string) ([]string, error)
+	CreateRoomAlias(ctx *AccessTokenContext, userId string, roomId string, alias string) error
+	DeleteRoomAlias(ctx *AccessTokenContext, userId string, alias string) error
+
+	AddThreePid(ctx *AccessTokenContext, userId string, medium string, address string) error
+	RemoveThreePid(ctx *AccessTokenContext, userId string, medium string, address string) error
+
+	SendServerNotice(ctx *AccessTokenContext, userId string, noticeId string, message string) error
+	SendDirectMessage(ctx *AccessTokenContext, senderUserId string, userId string, noticeId string, message string) error
+
+	DetermineCurrentPushRules(ctx *AccessTokenContext, userId string, ruleIdPrefix string) ([]CurrentUserPushRule, error)
+	SetPushRule(ctx *AccessTokenContext, userId string, kind string, ruleId string, rule *matrix.ApiPushRuleRequest) error
+	DeletePushRule(ctx *AccessTokenContext, userId string, kind string, ruleId string) error
+
+	GetUserAccountData(ctx *AccessTokenContext, userId string, roomId string, accountDataType string) (map[string]interface{}, error)
+	SetUserAccountData(ctx *AccessTokenContext, userId string, roomId string, accountDataType string, content map[string]interface{}) error
+
+	GetDeclaredRoomIds(ctx *AccessTokenContext, userId string) (map[string]string, error)
+	StoreDeclaredRoomId(ctx *AccessTokenContext, userId string, key string, roomId string) error
+
+	GetDeprovisioningState(ctx *AccessTokenContext, userId string) (*DeprovisioningState, error)
+	StoreDeprovisioningState(ctx *AccessTokenContext, userId string, deprovisioningState *DeprovisioningState) error
+
+	GetUserIdMigrationState(ctx *AccessTokenContext, userId string) (*UserIdMigrationState, error)
+	StoreUserIdMigrationState(ctx *AccessTokenContext, userId string, userIdMigrationState *UserIdMigrationState) error
+
+	GetManagedRoomIds(ctx *AccessTokenContext, userId string) ([]string, error)
+	StoreManagedRoomIds(ctx *AccessTokenContext, userId string, roomIds []string) error
+
+	GetAvatarUploadCache(ctx *AccessTokenContext, userId string) (*AvatarUploadCache, error)
+	StoreAvatarUploadCache(ctx *AccessTokenContext, userId string, avatarUploadCache *AvatarUploadCache) error
+
+	GetReconciliationCheckpoint(ctx *AccessTokenContext, userId string) (*ReconciliationCheckpoint, error)
+	StoreReconciliationCheckpoint(ctx *AccessTokenContext, userId string, checkpoint *ReconciliationCheckpoint) error
 }
@@ -0,0 +1,337 @@
+package connector
+
+import (
+	"bytes"
+	"devture-matrix-corporal/corporal/matrix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+const (
+	// masAdminScope is the scope that access tokens for the MAS Admin API need to have
+	masAdminScope = "urn:mas:admin"
+
+	// masSynapseAdminScope is the scope that access tokens (issued by MAS) for the Synapse admin APIs need to have
+	masSynapseAdminScope = "urn:synapse:admin:*"
+
+	// masSessionsPageSize is how many sessions are fetched with each request, when finishing all of a user's sessions
+	masSessionsPageSize = 100
+)
+
+// masSessionTypes lists the kinds of sessions that MAS keeps for users, by Admin API collection
+var masSessionTypes = []string{"compat-sessions", "oauth2-sessions"}
+
+// MasConnector is a MatrixConnector implementation for controlling a Synapse server,
+// which has delegated authentication to matrix-authentication-service (MAS), as per MSC3861.
+// It is based on the SynapseConnector for doing whatever's possible,
+// but manages users (and their sessions) via the MAS Admin API instead.
+//
+// With authentication delegated, Synapse's own user admin APIs (like registration and logging in as users) are no longer available.
+// Like with DendriteConnector, users' passwords (in MAS) are the ones that the Shared Secret Authenticator would have accepted
+// (see matrix.SharedSecretAuthPasswordGenerator): accounts get created with such a password and it gets reset for accounts which have a different one.
+// Logging in happens via MAS's compatibility layer for the regular `/login` endpoint.
+//
+// The MAS Admin API gets accessed with a client (in MAS) which is allowed to use the `client_credentials` grant with the admin scope.
+type MasConnector struct {
+	*SynapseConnector
+
+	apiEndpoint  string
+	clientId     string
+	clientSecret string
+
+	// adminAccessTokenSource provides access tokens for the MAS Admin API
+	adminAccessTokenSource *ClientCredentialsTokenSource
+}
+
+func NewMasConnector(
+	synapseConnector *SynapseConnector,
+	apiEndpoint string,
+	clientId string,
+	clientSecret string,
+) *MasConnector {
+	me := &MasConnector{
+		SynapseConnector: synapseConnector,
+
+		apiEndpoint:  strings.TrimRight(apiEndpoint, "/"),
+		clientId:     clientId,
+		clientSecret: clientSecret,
+	}
+
+	me.adminAccessTokenSource = me.newClientCredentialsTokenSource(masAdminScope)
+
+	// The matrix-corporal user's token needs to be obtained like everyone else's (see ObtainNewAccessTokenForUserId below),
+	// so that its password can be reset as well.
+	me.corporalUserAccessTokenContext = NewAccessTokenContext(
+		me,
+		deviceIdCorporal,
+		0,
+	)
+	me.corporalUserAccessTokenContext.SetAccessTokenStore(me.accessTokenStore)
+
+	return me
+}
+
+// ObtainNewAccessTokenForUserId is a reimplementation of SynapseConnector.ObtainNewAccessTokenForUserId,
+// which logs in with a password (see MasConnector) and resets it (via the MAS Admin API) if logging in fails, and then tries again.
+//
+// Unlike with DendriteConnector, the matrix-corporal user's password gets reset too, as the MAS Admin API doesn't require being logged in as it.
+func (me *MasConnector) ObtainNewAccessTokenForUserId(userId, deviceId string, validUntil *time.Time) (string, error) {
+	accessToken, err := me.ApiConnector.ObtainNewAccessTokenForUserId(userId, deviceId, validUntil)
+	if err == nil || !matrix.IsErrorWithCode(err, matrix.ErrorForbidden) {
+		return accessToken, err
+	}
+
+	me.logger.Infof("Resetting the password of %s, as logging in as them failed: %s", userId, err)
+
+	masUserId, err := me.getMasUserId(userId)
+	if err != nil {
+		return "", err
+	}
+
+	err = me.setUserPassword(masUserId, me.sharedSecretAuthPasswordGenerator.GenerateForUserId(userId))
+	if err != nil {
+		return "", fmt.Errorf("failed resetting password, after failing to log in: %s", err)
+	}
+
+	return me.ApiConnector.ObtainNewAccessTokenForUserId(userId, deviceId, validUntil)
+}
+
+// EnsureUserAccountExists creates the given user's account in MAS (unless it exists already), which creates it in Synapse as well.
+//
+// Accounts are created with the password that we log in with (see MasConnector), instead of the given one.
+// The user type (if any) is set afterwards, using the Synapse User Admin API.
+func (me *MasConnector) EnsureUserAccountExists(userId, password, userType string) error {
+	userIdLocalPart, err := gomatrix.ExtractUserLocalpart(userId)
+	if err != nil {
+		return err
+	}
+
+	err = me.makeAdminRequest("GET", fmt.Sprintf("/users/by-username/%s", url.PathEscape(userIdLocalPart)), nil, nil)
+	if err == nil {
+		// We don't care who created it and when. We only care that it exists.
+		return nil
+	}
+	if !isMasErrorWithStatusCode(err, http.StatusNotFound) {
+		return err
+	}
+
+	var response matrix.ApiMasAdminResponseUser
+	err = me.makeAdminRequest("POST", "/users", matrix.ApiMasAdminRequestAddUser{Username: userIdLocalPart}, &response)
+	if err != nil {
+		return fmt.Errorf("failed creating user: %s", err)
+	}
+
+	err = me.setUserPassword(response.Data.Id, me.sharedSecretAuthPasswordGenerator.GenerateForUserId(userId))
+	if err != nil {
+		return fmt.Errorf("failed setting the password of the newly created user: %s", err)
+	}
+
+	if userType == "" {
+		return nil
+	}
+
+	return me.SynapseConnector.SetUserType(nil, userId, userType)
+}
+
+// LogoutAllAccessTokensForUser finishes all of the given user's sessions (both compatibility and OAuth 2.0 ones), using the MAS Admin API.
+func (me *MasConnector) LogoutAllAccessTokensForUser(ctx *AccessTokenContext, userId string) error {
+	masUserId, err := me.getMasUserId(userId)
+	if err != nil {
+		return err
+	}
+
+	for _, sessionType := range masSessionTypes {
+		err = me.finishSessions(masUserId, sessionType)
+		if err != nil {
+			return fmt.Errorf("failed finishing %s: %s", sessionType, err)
+		}
+	}
+
+	// Like with ApiConnector.LogoutAllAccessTokensForUser, the token that the context may be holding on to is no longer valid.
+	ctx.ClearAccessTokenForUserId(userId)
+
+	return nil
+}
+
+// finishSessions finishes all active sessions of the given type (see masSessionTypes), one page at a time.
+// Finished sessions are no longer active, so the first page is always the one to finish next.
+func (me *MasConnector) finishSessions(masUserId string, sessionType string) error {
+	query := url.Values{}
+	query.Set("filter[user]", masUserId)
+	query.Set("filter[status]", "active")
+	query.Set("page[first]", fmt.Sprintf("%d", masSessionsPageSize))
+
+	for {
+		var response matrix.ApiMasAdminResponseResources
+		err := me.makeAdminRequest("GET", fmt.Sprintf("/%s?%s", sessionType, query.Encode()), nil, &response)
+		if err != nil {
+			return err
+		}
+
+		for _, session := range response.Data {
+			err = me.makeAdminRequest("POST", fmt.Sprintf("/%s/%s/finish", sessionType, session.Id), nil, nil)
+			if err != nil {
+				return fmt.Errorf("failed finishing session %s: %s", session.Id, err)
+			}
+		}
+
+		if len(response.Data) < masSessionsPageSize {
+			return nil
+		}
+	}
+}
+
+// DeactivateUserAccount deactivates the given user's account, using the MAS Admin API (which deactivates it in Synapse as well).
+// With erase, MAS makes Synapse erase the user (see SynapseConnector.DeactivateUserAccount).
+func (me *MasConnector) DeactivateUserAccount(ctx *AccessTokenContext, userId string, erase bool) error {
+	masUserId, err := me.getMasUserId(userId)
+	if err != nil {
+		return err
+	}
+
+	err = me.makeAdminRequest(
+		"POST",
+		fmt.Sprintf("/users/%s/deactivate", masUserId),
+		matrix.ApiMasAdminRequestDeactivateUser{SkipErase: !erase},
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Deactivation invalidates all of the user's access tokens, including any that the context may be holding on to.
+	ctx.ClearAccessTokenForUserId(userId)
+
+	return nil
+}
+
+// getMasUserId returns the id (a ULID) that MAS knows the given user by
+func (me *MasConnector) getMasUserId(userId string) (string, error) {
+	userIdLocalPart, err := gomatrix.ExtractUserLocalpart(userId)
+	if err != nil {
+		return "", err
+	}
+
+	var response matrix.ApiMasAdminResponseUser
+	err = me.makeAdminRequest("GET", fmt.Sprintf("/users/by-username/%s", url.PathEscape(userIdLocalPart)), nil, &response)
+	if err != nil {
+		return "", fmt.Errorf("failed looking up %s in MAS: %s", userId, err)
+	}
+
+	return response.Data.Id, nil
+}
+
+func (me *MasConnector) setUserPassword(masUserId string, password string) error {
+	return me.makeAdminRequest(
+		"POST",
+		fmt.Sprintf("/users/%s/set-password", masUserId),
+		matrix.ApiMasAdminRequestSetPassword{
+			Password: password,
+
+			// Our passwords are long and random, but may not satisfy whatever complexity policy MAS has been configured with.
+			SkipPasswordCheck: true,
+		},
+		nil,
+	)
+}
+
+// makeAdminRequest makes a request to the MAS Admin API (at the given path, relative to `/api/admin/v1`),
+// decoding the JSON response into the given response (unless nil).
+// Requests which don't succeed fail with a masError.
+func (me *MasConnector) makeAdminRequest(method string, path string, payload interface{}, response interface{}) error {
+	accessToken, err := me.adminAccessTokenSource.GetAccessToken()
+	if err != nil {
+		return fmt.Errorf("failed obtaining MAS Admin API access token: %s", err)
+	}
+
+	var body []byte
+	if payload != nil {
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(method, fmt.Sprintf("%s/api/admin/v1%s", me.apiEndpoint, path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	if payload != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	return me.doRequest(request, response)
+}
+
+// EnableClientCredentialsForSynapseAdminApi makes the Synapse admin APIs get called with access tokens obtained with the MAS client's credentials
+// (see SynapseConnector.SetAdminAccessTokenSource), instead of with the matrix-corporal user's access token.
+// This is to be called before any requests are made.
+func (me *MasConnector) EnableClientCredentialsForSynapseAdminApi() {
+	me.SetAdminAccessTokenSource(me.newClientCredentialsTokenSource(masSynapseAdminScope))
+}
+
+// newClientCredentialsTokenSource returns a source of access tokens with the given scope, obtained with the MAS client's credentials
+func (me *MasConnector) newClientCredentialsTokenSource(scope string) *ClientCredentialsTokenSource {
+	return NewClientCredentialsTokenSource(
+		me.httpClient,
+		fmt.Sprintf("%s/oauth2/token", me.apiEndpoint),
+		me.clientId,
+		me.clientSecret,
+		scope,
+	)
+}
+
+// doRequest makes the given request to MAS, decoding the JSON response into the given response (unless nil)
+func (me *MasConnector) doRequest(request *http.Request, response interface{}) error {
+	httpResponse, err := me.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		return masError{
+			StatusCode: httpResponse.StatusCode,
+			Body:       string(responseBody),
+		}
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(responseBody, response)
+	if err != nil {
+		return fmt.Errorf("failed decoding response: %s", err)
+	}
+
+	return nil
+}
+
+// masError is what unsuccessful MAS requests fail with
+type masError struct {
+	StatusCode int
+	Body       string
+}
+
+func (me masError) Error() string {
+	return fmt.Sprintf("MAS responded with HTTP %d: %s", me.StatusCode, me.Body)
+}
+
+func isMasErrorWithStatusCode(err error, statusCode int) bool {
+	masErr, ok := err.(masError)
+	return ok && masErr.StatusCode == statusCode
+}
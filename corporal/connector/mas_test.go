@@ -0,0 +1,622 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// createTestMasConnector creates a connector for a homeserver and a MAS instance which handle requests with the given handlers.
+//
+// Access tokens are handed out (to the `client-id` client) by the MAS instance itself, as `admin-token` (for the MAS Admin API)
+// and `synapse-admin-token` (for the Synapse admin APIs). MAS Admin API requests not made with the former ones fail without reaching masHandler.
+func createTestMasConnector(t *testing.T, homeserverHandler http.HandlerFunc, masHandler http.HandlerFunc) *MasConnector {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	homeserver := httptest.NewServer(homeserverHandler)
+	t.Cleanup(homeserver.Close)
+
+	mas := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Path == "/oauth2/token" {
+			clientId, clientSecret, _ := r.BasicAuth()
+			if clientId != "client-id" || clientSecret != "client-secret" || r.PostFormValue("grant_type") != "client_credentials" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "invalid_client"}`))
+				return
+			}
+
+			accessTokensByScope := map[string]string{
+				masAdminScope:        "admin-token",
+				masSynapseAdminScope: "synapse-admin-token",
+			}
+			json.NewEncoder(w).Encode(matrix.ApiOAuthTokenResponse{
+				AccessToken: accessTokensByScope[r.PostFormValue("scope")],
+				ExpiresIn:   300,
+			})
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer admin-token" {
+			t.Errorf("expected %s %s to be made with the admin token, got: %s", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		masHandler(w, r)
+	}))
+	t.Cleanup(mas.Close)
+
+	connector := NewMasConnector(
+		NewSynapseConnector(NewApiConnector(homeserver.URL, testPasswordGenerator, 1000, logger), "", "@corporal:example.com"),
+		mas.URL+"/",
+		"client-id",
+		"client-secret",
+	)
+	connector.EnableClientCredentialsForSynapseAdminApi()
+
+	return connector
+}
+
+// writeTestMasUser responds like the MAS Admin API does with a user resource
+func writeTestMasUser(w http.ResponseWriter, masUserId string) {
+	json.NewEncoder(w).Encode(matrix.ApiMasAdminResponseUser{
+		Data: matrix.ApiMasAdminResource{Type: "user", Id: masUserId},
+	})
+}
+
+func TestMasConnectorEnsureUserAccountExists(t *testing.T) {
+	type testData struct {
+		name     string
+		userType string
+
+		// existing tells whether MAS knows about the user already
+		existing bool
+
+		expectedRequests []string
+	}
+
+	tests := []testData{
+		{
+			"existing account",
+			"",
+			true,
+			[]string{"GET /api/admin/v1/users/by-username/user"},
+		},
+		{
+			"new account",
+			"",
+			false,
+			[]string{
+				"GET /api/admin/v1/users/by-username/user",
+				"POST /api/admin/v1/users",
+				"POST /api/admin/v1/users/01NEW/set-password",
+			},
+		},
+		{
+			"new account with a user type",
+			"bot",
+			false,
+			[]string{
+				"GET /api/admin/v1/users/by-username/user",
+				"POST /api/admin/v1/users",
+				"POST /api/admin/v1/users/01NEW/set-password",
+				"PUT /_synapse/admin/v2/users/@user:example.com",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := []string{}
+
+			connector := createTestMasConnector(
+				t,
+				func(w http.ResponseWriter, r *http.Request) {
+					requests = append(requests, r.Method+" "+r.URL.Path)
+
+					if r.Method+" "+r.URL.Path != "PUT /_synapse/admin/v2/users/@user:example.com" {
+						t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+						writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+						return
+					}
+
+					if r.Header.Get("Authorization") != "Bearer synapse-admin-token" {
+						t.Errorf("expected the user type to be set with the Synapse admin token, got: %s", r.Header.Get("Authorization"))
+					}
+
+					var payload matrix.ApiAdminRequestUserType
+					json.NewDecoder(r.Body).Decode(&payload)
+
+					if payload.UserType == nil || *payload.UserType != test.userType {
+						t.Errorf("unexpected user type payload: %#v", payload)
+					}
+
+					w.Write([]byte(`{}`))
+				},
+				func(w http.ResponseWriter, r *http.Request) {
+					requests = append(requests, r.Method+" "+r.URL.Path)
+
+					switch r.Method + " " + r.URL.Path {
+					case "GET /api/admin/v1/users/by-username/user":
+						if !test.existing {
+							w.WriteHeader(http.StatusNotFound)
+							w.Write([]byte(`{"errors": [{"title": "User not found"}]}`))
+							return
+						}
+						writeTestMasUser(w, "01EXISTING")
+					case "POST /api/admin/v1/users":
+						var payload matrix.ApiMasAdminRequestAddUser
+						json.NewDecoder(r.Body).Decode(&payload)
+
+						if payload.Username != "user" {
+							t.Errorf("unexpected user creation payload: %#v", payload)
+						}
+						writeTestMasUser(w, "01NEW")
+					case "POST /api/admin/v1/users/01NEW/set-password":
+						var payload matrix.ApiMasAdminRequestSetPassword
+						json.NewDecoder(r.Body).Decode(&payload)
+
+						// Accounts get the password that we log in with, instead of the one from the policy
+						expectedPayload := matrix.ApiMasAdminRequestSetPassword{
+							Password:          testPasswordGenerator.GenerateForUserId("@user:example.com"),
+							SkipPasswordCheck: true,
+						}
+						if payload != expectedPayload {
+							t.Errorf("unexpected password payload: %#v", payload)
+						}
+						w.WriteHeader(http.StatusNoContent)
+					default:
+						t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+						w.WriteHeader(http.StatusNotFound)
+					}
+				},
+			)
+
+			err := connector.EnsureUserAccountExists("@user:example.com", "policy-password", test.userType)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if strings.Join(requests, "\n") != strings.Join(test.expectedRequests, "\n") {
+				t.Errorf("expected requests %v, got: %v", test.expectedRequests, requests)
+			}
+		})
+	}
+}
+
+func TestMasConnectorEnsureUserAccountExistsFailures(t *testing.T) {
+	type testData struct {
+		name string
+
+		// failingRequest is the request which fails with an HTTP 500 error
+		failingRequest string
+
+		expectedErrorContains string
+	}
+
+	tests := []testData{
+		{"looking up the user", "GET /api/admin/v1/users/by-username/user", "MAS responded with HTTP 500"},
+		{"creating the user", "POST /api/admin/v1/users", "failed creating user: MAS responded with HTTP 500"},
+		{"setting the password", "POST /api/admin/v1/users/01NEW/set-password", "failed setting the password of the newly created user"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connector := createTestMasConnector(
+				t,
+				func(w http.ResponseWriter, r *http.Request) {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+					writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+				},
+				func(w http.ResponseWriter, r *http.Request) {
+					if r.Method+" "+r.URL.Path == test.failingRequest {
+						w.WriteHeader(http.StatusInternalServerError)
+						w.Write([]byte(`{"errors": [{"title": "Something went wrong"}]}`))
+						return
+					}
+
+					switch r.Method + " " + r.URL.Path {
+					case "GET /api/admin/v1/users/by-username/user":
+						w.WriteHeader(http.StatusNotFound)
+					case "POST /api/admin/v1/users":
+						writeTestMasUser(w, "01NEW")
+					default:
+						t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+						w.WriteHeader(http.StatusNotFound)
+					}
+				},
+			)
+
+			err := connector.EnsureUserAccountExists("@user:example.com", "policy-password", "")
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !strings.Contains(err.Error(), test.expectedErrorContains) {
+				t.Errorf("expected the error to mention `%s`, got: %s", test.expectedErrorContains, err)
+			}
+		})
+	}
+}
+
+func TestMasConnectorObtainNewAccessTokenForUserIdResetsPassword(t *testing.T) {
+	type testData struct {
+		name      string
+		userId    string
+		masUserId string
+	}
+
+	tests := []testData{
+		{"regular user", "@user:example.com", "01USER"},
+
+		// Unlike with Dendrite, resetting passwords doesn't require being logged in as the matrix-corporal user
+		{"matrix-corporal user", "@corporal:example.com", "01CORPORAL"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			passwordReset := false
+			loginAttempts := 0
+
+			connector := createTestMasConnector(
+				t,
+				func(w http.ResponseWriter, r *http.Request) {
+					if r.Method+" "+r.URL.Path != "POST /_matrix/client/r0/login" {
+						t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+						writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+						return
+					}
+
+					var payload matrix.ApiLoginRequestPayload
+					json.NewDecoder(r.Body).Decode(&payload)
+
+					if payload.Type != matrix.LoginTypePassword || payload.Identifier.User != test.userId || payload.Password != testPasswordGenerator.GenerateForUserId(test.userId) {
+						t.Errorf("unexpected login payload: %#v", payload)
+					}
+
+					loginAttempts++
+					if !passwordReset {
+						writeTestMatrixError(w, http.StatusForbidden, matrix.ErrorForbidden)
+						return
+					}
+					w.Write([]byte(`{"access_token": "user-token"}`))
+				},
+				func(w http.ResponseWriter, r *http.Request) {
+					localpart := strings.TrimPrefix(strings.Split(test.userId, ":")[0], "@")
+
+					switch r.Method + " " + r.URL.Path {
+					case "GET /api/admin/v1/users/by-username/" + localpart:
+						writeTestMasUser(w, test.masUserId)
+					case fmt.Sprintf("POST /api/admin/v1/users/%s/set-password", test.masUserId):
+						var payload matrix.ApiMasAdminRequestSetPassword
+						json.NewDecoder(r.Body).Decode(&payload)
+
+						if payload.Password != testPasswordGenerator.GenerateForUserId(test.userId) || !payload.SkipPasswordCheck {
+							t.Errorf("unexpected password payload: %#v", payload)
+						}
+
+						passwordReset = true
+						w.WriteHeader(http.StatusNoContent)
+					default:
+						t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+						w.WriteHeader(http.StatusNotFound)
+					}
+				},
+			)
+
+			accessToken, err := connector.ObtainNewAccessTokenForUserId(test.userId, "device", nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if accessToken != "user-token" {
+				t.Errorf("unexpected access token: %s", accessToken)
+			}
+			if !passwordReset {
+				t.Errorf("expected the password to be reset")
+			}
+			if loginAttempts != 2 {
+				t.Errorf("expected logging in to be attempted again after resetting the password, got %d attempts", loginAttempts)
+			}
+		})
+	}
+}
+
+func TestMasConnectorObtainNewAccessTokenForUserIdFailures(t *testing.T) {
+	type testData struct {
+		name           string
+		loginErrorCode string
+
+		// lookupExpected tells whether the user is expected to be looked up in MAS (which doesn't know about them)
+		lookupExpected bool
+
+		expectedErrorCode     string
+		expectedErrorContains string
+	}
+
+	tests := []testData{
+		{"login failure unrelated to the password", matrix.ErrorUserDeactivated, false, matrix.ErrorUserDeactivated, ""},
+		{"user unknown to MAS", matrix.ErrorForbidden, true, "", "failed looking up @user:example.com in MAS: MAS responded with HTTP 404"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connector := createTestMasConnector(
+				t,
+				func(w http.ResponseWriter, r *http.Request) {
+					if r.Method+" "+r.URL.Path != "POST /_matrix/client/r0/login" {
+						t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+					}
+					writeTestMatrixError(w, http.StatusForbidden, test.loginErrorCode)
+				},
+				func(w http.ResponseWriter, r *http.Request) {
+					if !test.lookupExpected || r.Method+" "+r.URL.Path != "GET /api/admin/v1/users/by-username/user" {
+						t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+					}
+					w.WriteHeader(http.StatusNotFound)
+				},
+			)
+
+			_, err := connector.ObtainNewAccessTokenForUserId("@user:example.com", "device", nil)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if test.expectedErrorCode != "" && !matrix.IsErrorWithCode(err, test.expectedErrorCode) {
+				t.Errorf("expected an error with code %s, got: %s", test.expectedErrorCode, err)
+			}
+			if !strings.Contains(err.Error(), test.expectedErrorContains) {
+				t.Errorf("expected the error to mention `%s`, got: %s", test.expectedErrorContains, err)
+			}
+		})
+	}
+}
+
+func TestMasConnectorLogoutAllAccessTokensForUser(t *testing.T) {
+	// More compatibility sessions than fit on a page, so that finishing them takes several pages
+	activeSessionIdsByType := map[string][]string{
+		"compat-sessions": {},
+		"oauth2-sessions": {"01OAUTH2"},
+	}
+	for i := 0; i < masSessionsPageSize+1; i++ {
+		activeSessionIdsByType["compat-sessions"] = append(activeSessionIdsByType["compat-sessions"], fmt.Sprintf("01COMPAT%d", i))
+	}
+
+	connector := createTestMasConnector(
+		t,
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method+" "+r.URL.Path == "GET /api/admin/v1/users/by-username/user" {
+				writeTestMasUser(w, "01USER")
+				return
+			}
+
+			parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/admin/v1/"), "/")
+			sessionIds, sessionTypeExists := activeSessionIdsByType[parts[0]]
+			if !sessionTypeExists {
+				t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if r.Method == "GET" && len(parts) == 1 {
+				query := r.URL.Query()
+				if query.Get("filter[user]") != "01USER" || query.Get("filter[status]") != "active" || query.Get("page[first]") != "100" {
+					t.Errorf("unexpected session filters: %s", r.URL.RawQuery)
+				}
+
+				response := matrix.ApiMasAdminResponseResources{Data: []matrix.ApiMasAdminResource{}}
+				for idx, sessionId := range sessionIds {
+					if idx == masSessionsPageSize {
+						break
+					}
+					response.Data = append(response.Data, matrix.ApiMasAdminResource{Type: parts[0], Id: sessionId})
+				}
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+
+			if r.Method == "POST" && len(parts) == 3 && parts[2] == "finish" {
+				remainingSessionIds := []string{}
+				for _, sessionId := range sessionIds {
+					if sessionId != parts[1] {
+						remainingSessionIds = append(remainingSessionIds, sessionId)
+					}
+				}
+				if len(remainingSessionIds) == len(sessionIds) {
+					t.Errorf("unexpected session being finished: %s", r.URL.Path)
+				}
+				activeSessionIdsByType[parts[0]] = remainingSessionIds
+
+				w.Write([]byte(`{}`))
+				return
+			}
+
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		},
+	)
+
+	ctx := NewAccessTokenContext(connector, "device", 0)
+	ctx.userIdToAccessTokenMap.Store("@user:example.com", newAccessToken("user-token", nil))
+
+	err := connector.LogoutAllAccessTokensForUser(ctx, "@user:example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for sessionType, sessionIds := range activeSessionIdsByType {
+		if len(sessionIds) != 0 {
+			t.Errorf("expected all %s to be finished, got remaining: %v", sessionType, sessionIds)
+		}
+	}
+
+	if _, exists := ctx.userIdToAccessTokenMap.Load("@user:example.com"); exists {
+		t.Errorf("expected the access token that the context was holding on to to be cleared")
+	}
+}
+
+func TestMasConnectorLogoutAllAccessTokensForUserFailure(t *testing.T) {
+	connector := createTestMasConnector(
+		t,
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method + " " + r.URL.Path {
+			case "GET /api/admin/v1/users/by-username/user":
+				writeTestMasUser(w, "01USER")
+			case "GET /api/admin/v1/compat-sessions":
+				w.Write([]byte(`{"data": [{"type": "compat-session", "id": "01COMPAT"}]}`))
+			case "POST /api/admin/v1/compat-sessions/01COMPAT/finish":
+				w.WriteHeader(http.StatusInternalServerError)
+			default:
+				t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusNotFound)
+			}
+		},
+	)
+
+	ctx := NewAccessTokenContext(connector, "device", 0)
+	ctx.userIdToAccessTokenMap.Store("@user:example.com", newAccessToken("user-token", nil))
+
+	err := connector.LogoutAllAccessTokensForUser(ctx, "@user:example.com")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	expectedErrorContains := "failed finishing compat-sessions: failed finishing session 01COMPAT: MAS responded with HTTP 500"
+	if !strings.Contains(err.Error(), expectedErrorContains) {
+		t.Errorf("expected the error to mention `%s`, got: %s", expectedErrorContains, err)
+	}
+
+	// Some sessions may still be active, so the user may still be logged in with the token
+	if _, exists := ctx.userIdToAccessTokenMap.Load("@user:example.com"); !exists {
+		t.Errorf("expected the access token that the context was holding on to to be kept")
+	}
+}
+
+func TestMasConnectorDeactivateUserAccount(t *testing.T) {
+	type testData struct {
+		erase             bool
+		expectedSkipErase bool
+	}
+
+	tests := []testData{
+		{true, false},
+		{false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("erase=%t", test.erase), func(t *testing.T) {
+			deactivated := false
+
+			connector := createTestMasConnector(
+				t,
+				func(w http.ResponseWriter, r *http.Request) {
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+					writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+				},
+				func(w http.ResponseWriter, r *http.Request) {
+					switch r.Method + " " + r.URL.Path {
+					case "GET /api/admin/v1/users/by-username/user":
+						writeTestMasUser(w, "01USER")
+					case "POST /api/admin/v1/users/01USER/deactivate":
+						if r.Header.Get("Content-Type") != "application/json" {
+							t.Errorf("unexpected content type: %s", r.Header.Get("Content-Type"))
+						}
+
+						var payload matrix.ApiMasAdminRequestDeactivateUser
+						json.NewDecoder(r.Body).Decode(&payload)
+
+						if payload.SkipErase != test.expectedSkipErase {
+							t.Errorf("unexpected deactivation payload: %#v", payload)
+						}
+
+						deactivated = true
+						writeTestMasUser(w, "01USER")
+					default:
+						t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+						w.WriteHeader(http.StatusNotFound)
+					}
+				},
+			)
+
+			ctx := NewAccessTokenContext(connector, "device", 0)
+			ctx.userIdToAccessTokenMap.Store("@user:example.com", newAccessToken("user-token", nil))
+
+			err := connector.DeactivateUserAccount(ctx, "@user:example.com", test.erase)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !deactivated {
+				t.Errorf("expected the user to be deactivated")
+			}
+			if _, exists := ctx.userIdToAccessTokenMap.Load("@user:example.com"); exists {
+				t.Errorf("expected the access token that the context was holding on to to be cleared")
+			}
+		})
+	}
+}
+
+func TestMasConnectorFailsWithoutAdminAccessToken(t *testing.T) {
+	connector := createTestMasConnector(
+		t,
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			writeTestMatrixError(w, http.StatusNotFound, matrix.ErrorNotFound)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		},
+	)
+	connector.clientSecret = "wrong-secret"
+	connector.adminAccessTokenSource = connector.newClientCredentialsTokenSource(masAdminScope)
+
+	err := connector.EnsureUserAccountExists("@user:example.com", "policy-password", "")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	expectedErrorContains := "failed obtaining MAS Admin API access token: the token endpoint responded with HTTP 401"
+	if !strings.Contains(err.Error(), expectedErrorContains) {
+		t.Errorf("expected the error to mention `%s`, got: %s", expectedErrorContains, err)
+	}
+}
+
+func TestIsMasErrorWithStatusCode(t *testing.T) {
+	type testData struct {
+		name           string
+		err            error
+		statusCode     int
+		expectedResult bool
+	}
+
+	tests := []testData{
+		{"matching status code", masError{StatusCode: http.StatusNotFound}, http.StatusNotFound, true},
+		{"other status code", masError{StatusCode: http.StatusInternalServerError}, http.StatusNotFound, false},
+		{"other error", fmt.Errorf("MAS responded with HTTP 404"), http.StatusNotFound, false},
+		{"no error", nil, http.StatusNotFound, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := isMasErrorWithStatusCode(test.err, test.statusCode); result != test.expectedResult {
+				t.Errorf("expected %t, got %t", test.expectedResult, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/avatar"
+	"devture-matrix-corporal/corporal/matrix"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NoopConnector is a MatrixConnector implementation, which doesn't talk to any homeserver.
+// It logs each call it gets (along with its parameters) and responds the way an empty homeserver would
+// (no users, no room state, no account data), with made-up access tokens, room ids, etc.
+//
+// This lets a whole configuration (policy provider, hooks, reconciliation, HTTP API) be exercised end-to-end against a production policy,
+// without touching the homeserver. Since nothing changes, each reconciliation run computes the same actions as the one before it.
+type NoopConnector struct {
+	logger               *logrus.Logger
+	homeserverDomainName string
+
+	// lastFakeId is for making up unique ids (see nextFakeId)
+	lastFakeId uint64
+}
+
+func NewNoopConnector(logger *logrus.Logger, homeserverDomainName string) *NoopConnector {
+	return &NoopConnector{
+		logger:               logger,
+		homeserverDomainName: homeserverDomainName,
+	}
+}
+
+// logCall logs a call to the given method, with the given parameters (name-value pairs)
+func (me *NoopConnector) logCall(method string, params ...interface{}) {
+	fields := logrus.Fields{}
+	for idx := 0; idx+1 < len(params); idx += 2 {
+		fields[fmt.Sprintf("%s", params[idx])] = params[idx+1]
+	}
+
+	me.logger.WithFields(fields).Infof("Noop connector: %s", method)
+}
+
+func (me *NoopConnector) nextFakeId() uint64 {
+	return atomic.AddUint64(&me.lastFakeId, 1)
+}
+
+func (me *NoopConnector) ObtainNewAccessTokenForUserId(userId, deviceId string, validUntil *time.Time) (string, error) {
+	me.logCall("ObtainNewAccessTokenForUserId", "userId", userId, "deviceId", deviceId, "validUntil", validUntil)
+	return fmt.Sprintf("noop_access_token_%d", me.nextFakeId()), nil
+}
+
+func (me *NoopConnector) VerifyAccessToken(userId, accessToken string) error {
+	me.logCall("VerifyAccessToken", "userId", userId)
+	return nil
+}
+
+func (me *NoopConnector) DestroyAccessToken(userId, accessToken string) error {
+	me.logCall("DestroyAccessToken", "userId", userId)
+	return nil
+}
+
+func (me *NoopConnector) LogoutAllAccessTokensForUser(ctx *AccessTokenContext, userId string) error {
+	me.logCall("LogoutAllAccessTokensForUser", "userId", userId)
+	return nil
+}
+
+func (me *NoopConnector) DeactivateUserAccount(ctx *AccessTokenContext, userId string, erase bool) error {
+	me.logCall("DeactivateUserAccount", "userId", userId, "erase", erase)
+	return nil
+}
+
+func (me *NoopConnector) DeleteUserMedia(ctx *AccessTokenContext, userId string) error {
+	me.logCall("DeleteUserMedia", "userId", userId)
+	return nil
+}
+
+func (me *NoopConnector) DeleteRoom(ctx *AccessTokenContext, roomId string) error {
+	me.logCall("DeleteRoom", "roomId", roomId)
+	return nil
+}
+
+func (me *NoopConnector) QuarantineMedia(serverName string, mediaId string) error {
+	me.logCall("QuarantineMedia", "serverName", serverName, "mediaId", mediaId)
+	return nil
+}
+
+func (me *NoopConnector) UnquarantineMedia(serverName string, mediaId string) error {
+	me.logCall("UnquarantineMedia", "serverName", serverName, "mediaId", mediaId)
+	return nil
+}
+
+func (me *NoopConnector) QuarantineRoomMedia(roomId string) (int, error) {
+	me.logCall("QuarantineRoomMedia", "roomId", roomId)
+	return 0, nil
+}
+
+func (me *NoopConnector) QuarantineUserMedia(userId string) (int, error) {
+	me.logCall("QuarantineUserMedia", "userId", userId)
+	return 0, nil
+}
+
+func (me *NoopConnector) DetermineCurrentDevices(ctx *AccessTokenContext, userId string) ([]CurrentUserDevice, error) {
+	me.logCall("DetermineCurrentDevices", "userId", userId)
+	return []CurrentUserDevice{}, nil
+}
+
+func (me *NoopConnector) DeleteDevices(ctx *AccessTokenContext, userId string, deviceIds []string) error {
+	me.logCall("DeleteDevices", "userId", userId, "deviceIds", deviceIds)
+	return nil
+}
+
+// DetermineCurrentState reports that none of the managed users exist (yet)
+func (me *NoopConnector) DetermineCurrentState(ctx *AccessTokenContext, managedUserIds []string, adminUserId string) (*CurrentState, error) {
+	me.logCall("DetermineCurrentState", "managedUserIds", managedUserIds, "adminUserId", adminUserId)
+	return &CurrentState{
+		Users: []CurrentUserState{},
+		Rooms: []CurrentRoomState{},
+	}, nil
+}
+
+func (me *NoopConnector) DetermineUnmanagedUsers(ctx *AccessTokenContext, knownUserIds []string, adminUserId string) ([]CurrentUnmanagedUserState, error) {
+	me.logCall("DetermineUnmanagedUsers", "knownUserIds", knownUserIds, "adminUserId", adminUserId)
+	return []CurrentUnmanagedUserState{}, nil
+}
+
+func (me *NoopConnector) DetermineCurrentRoomState(ctx *AccessTokenContext, roomId string, stateEventTypes []string, adminUserId string) (*CurrentRoomState, error) {
+	me.logCall("DetermineCurrentRoomState", "roomId", roomId, "stateEventTypes", stateEventTypes, "adminUserId", adminUserId)
+	return &CurrentRoomState{
+		Id:                 roomId,
+		StateEventContents: map[string]map[string]interface{}{},
+	}, nil
+}
+
+// DetermineCurrentRoomMembers reports that only the acting user is joined to the room
+func (me *NoopConnector) DetermineCurrentRoomMembers(ctx *AccessTokenContext, roomId string, actingUserId string) (map[string]string, error) {
+	me.logCall("DetermineCurrentRoomMembers", "roomId", roomId, "actingUserId", actingUserId)
+	return map[string]string{
+		actingUserId: "join",
+	}, nil
+}
+
+func (me *NoopConnector) DetermineUserJoinedRoomIds(ctx *AccessTokenContext, userId string) ([]string, error) {
+	me.logCall("DetermineUserJoinedRoomIds", "userId", userId)
+	return []string{}, nil
+}
+
+func (me *NoopConnector) DetermineCurrentKeyedRoomState(ctx *AccessTokenContext, roomId string, stateEventTypes []string, actingUserId string) (map[string]map[string]map[string]interface{}, error) {
+	me.logCall("DetermineCurrentKeyedRoomState", "roomId", roomId, "stateEventTypes", stateEventTypes, "actingUserId", actingUserId)
+	return map[string]map[string]map[string]interface{}{}, nil
+}
+
+func (me *NoopConnector) EnsureUserAccountExists(userId, password, userType string) error {
+	// The password is left out, as it's not something to be logging
+	me.logCall("EnsureUserAccountExists", "userId", userId, "userType", userType)
+	return nil
+}
+
+func (me *NoopConnector) GetUserProfileByUserId(ctx *AccessTokenContext, userId string) (*matrix.ApiUserProfileResponse, error) {
+	me.logCall("GetUserProfileByUserId", "userId", userId)
+	return &matrix.ApiUserProfileResponse{}, nil
+}
+
+func (me *NoopConnector) SetUserDisplayName(ctx *AccessTokenContext, userId string, displayName string) error {
+	me.logCall("SetUserDisplayName", "userId", userId, "displayName", displayName)
+	return nil
+}
+
+func (me *NoopConnector) SetUserAvatar(ctx *AccessTokenContext, userId string, avatar *avatar.Avatar) error {
+	me.logCall("SetUserAvatar", "userId", userId, "avatarUriHash", avatar.UriHash, "avatarContentHash", avatar.ContentHash)
+	return nil
+}
+
+// UploadAvatar makes up a content repository URI for the avatar, without reading it
+func (me *NoopConnector) UploadAvatar(ctx *AccessTokenContext, uploaderUserId string, avatar *avatar.Avatar) (string, error) {
+	me.logCall("UploadAvatar", "uploaderUserId", uploaderUserId, "avatarUriHash", avatar.UriHash, "avatarContentHash", avatar.ContentHash)
+	return fmt.Sprintf("mxc://%s/noop_media_%d", me.homeserverDomainName, me.nextFakeId()), nil
+}
+
+func (me *NoopConnector) SetUserAvatarMxcUri(ctx *AccessTokenContext, userId string, mxcUri string, avatarSourceUriHash string) error {
+	me.logCall("SetUserAvatarMxcUri", "userId", userId, "mxcUri", mxcUri, "avatarSourceUriHash", avatarSourceUriHash)
+	return nil
+}
+
+func (me *NoopConnector) SetUserServerAdmin(ctx *AccessTokenContext, userId string, admin bool) error {
+	me.logCall("SetUserServerAdmin", "userId", userId, "admin", admin)
+	return nil
+}
+
+func (me *NoopConnector) SetUserType(ctx *AccessTokenContext, userId string, userType string) error {
+	me.logCall("SetUserType", "userId", userId, "userType", userType)
+	return nil
+}
+
+func (me *NoopConnector) SetUserShadowBanned(ctx *AccessTokenContext, userId string, shadowBanned bool) error {
+	me.logCall("SetUserShadowBanned", "userId", userId, "shadowBanned", shadowBanned)
+	return nil
+}
+
+func (me *NoopConnector) InviteUserToRoom(ctx *AccessTokenContext, inviterId string, inviteeId string, roomId string) error {
+	me.logCall("InviteUserToRoom", "inviterId", inviterId, "inviteeId", inviteeId, "roomId", roomId)
+	return nil
+}
+
+func (me *NoopConnector) JoinRoom(ctx *AccessTokenContext, userId string, roomId string) error {
+	me.logCall("JoinRoom", "userId", userId, "roomId", roomId)
+	return nil
+}
+
+func (me *NoopConnector) ForceJoinRoom(ctx *AccessTokenContext, userId string, roomIdOrAlias string) error {
+	me.logCall("ForceJoinRoom", "userId", userId, "roomIdOrAlias", roomIdOrAlias)
+	return nil
+}
+
+func (me *NoopConnector) LeaveRoom(ctx *AccessTokenContext, userId string, roomId string) error {
+	me.logCall("LeaveRoom", "userId", userId, "roomId", roomId)
+	return nil
+}
+
+func (me *NoopConnector) KickUserFromRoom(ctx *AccessTokenContext, kickerId string, kickeeId string, roomId string) error {
+	me.logCall("KickUserFromRoom", "kickerId", kickerId, "kickeeId", kickeeId, "roomId", roomId)
+	return nil
+}
+
+// CreateRoom makes up an id for the room
+func (me *NoopConnector) CreateRoom(ctx *AccessTokenContext, creatorUserId string, request *CreateRoomRequest, avatar *avatar.Avatar) (string, error) {
+	params := []interface{}{"creatorUserId", creatorUserId, "request", request}
+	if avatar != nil {
+		params = append(params, "avatarUriHash", avatar.UriHash, "avatarContentHash", avatar.ContentHash)
+	}
+	me.logCall("CreateRoom", params...)
+
+	return fmt.Sprintf("!noop_room_%d:%s", me.nextFakeId(), me.homeserverDomainName), nil
+}
+
+func (me *NoopConnector) SetRoomState(ctx *AccessTokenContext, userId string, roomId string, eventType string, stateKey string, content map[string]interface{}) error {
+	me.logCall("SetRoomState", "userId", userId, "roomId", roomId, "eventType", eventType, "stateKey", stateKey, "content", content)
+	return nil
+}
+
+func (me *NoopConnector) GetRoomDirectoryVisibility(ctx *AccessTokenContext, roomId string, actingUserId string) (string, error) {
+	me.logCall("GetRoomDirectoryVisibility", "roomId", roomId, "actingUserId", actingUserId)
+	return "private", nil
+}
+
+func (me *NoopConnector) SetRoomDirectoryVisibility(ctx *AccessTokenContext, userId string, roomId string, visibility string) error {
+	me.logCall("SetRoomDirectoryVisibility", "userId", userId, "roomId", roomId, "visibility", visibility)
+	return nil
+}
+
+func (me *NoopConnector) GetRoomAliases(ctx *AccessTokenContext, roomId string, actingUserId string) ([]string, error) {
+	me.logCall("GetRoomAliases", "roomId", roomId, "actingUserId", actingUserId)
+	return []string{}, nil
+}
+
+func (me *NoopConnector) CreateRoomAlias(ctx *AccessTokenContext, userId string, roomId string, alias string) error {
+	me.logCall("CreateRoomAlias", "userId", userId, "roomId", roomId, "alias", alias)
+	return nil
+}
+
+func (me *NoopConnector) DeleteRoomAlias(ctx *AccessTokenContext, userId string, alias string) error {
+	me.logCall("DeleteRoomAlias", "userId", userId, "alias", alias)
+	return nil
+}
+
+func (me *NoopConnector) AddThreePid(ctx *AccessTokenContext, userId string, medium string, address string) error {
+	me.logCall("AddThreePid", "userId", userId, "medium", medium, "address", address)
+	return nil
+}
+
+func (me *NoopConnector) RemoveThreePid(ctx *AccessTokenContext, userId string, medium string, address string) error {
+	me.logCall("RemoveThreePid", "userId", userId, "medium", medium, "address", address)
+	return nil
+}
+
+func (me *NoopConnector) SendServerNotice(ctx *AccessTokenContext, userId string, noticeId string, message string) error {
+	me.logCall("SendServerNotice", "userId", userId, "noticeId", noticeId, "message", message)
+	return nil
+}
+
+func (me *NoopConnector) SendDirectMessage(ctx *AccessTokenContext, senderUserId string, userId string, noticeId string, message string) error {
+	me.logCall("SendDirectMessage", "senderUserId", senderUserId, "userId", userId, "noticeId", noticeId, "message", message)
+	return nil
+}
+
+func (me *NoopConnector) DetermineCurrentPushRules(ctx *AccessTokenContext, userId string, ruleIdPrefix string) ([]CurrentUserPushRule, error) {
+	me.logCall("DetermineCurrentPushRules", "userId", userId, "ruleIdPrefix", ruleIdPrefix)
+	return []CurrentUserPushRule{}, nil
+}
+
+func (me *NoopConnector) SetPushRule(ctx *AccessTokenContext, userId string, kind string, ruleId string, rule *matrix.ApiPushRuleRequest) error {
+	me.logCall("SetPushRule", "userId", userId, "kind", kind, "ruleId", ruleId, "rule", rule)
+	return nil
+}
+
+func (me *NoopConnector) DeletePushRule(ctx *AccessTokenContext, userId string, kind string, ruleId string) error {
+	me.logCall("DeletePushRule", "userId", userId, "kind", kind, "ruleId", ruleId)
+	return nil
+}
+
+func (me *NoopConnector) GetUserAccountData(ctx *AccessTokenContext, userId string, roomId string, accountDataType string) (map[string]interface{}, error) {
+	me.logCall("GetUserAccountData", "userId", userId, "roomId", roomId, "accountDataType", accountDataType)
+	return map[string]interface{}{}, nil
+}
+
+func (me *NoopConnector) SetUserAccountData(ctx *AccessTokenContext, userId string, roomId string, accountDataType string, content map[string]interface{}) error {
+	me.logCall("SetUserAccountData", "userId", userId, "roomId", roomId, "accountDataType", accountDataType, "content", content)
+	return nil
+}
+
+func (me *NoopConnector) GetDeclaredRoomIds(ctx *AccessTokenContext, userId string) (map[string]string, error) {
+	me.logCall("GetDeclaredRoomIds", "userId", userId)
+	return map[string]string{}, nil
+}
+
+func (me *NoopConnector) StoreDeclaredRoomId(ctx *AccessTokenContext, userId string, key string, roomId string) error {
+	me.logCall("StoreDeclaredRoomId", "userId", userId, "key", key, "roomId", roomId)
+	return nil
+}
+
+func (me *NoopConnector) GetDeprovisioningState(ctx *AccessTokenContext, userId string) (*DeprovisioningState, error) {
+	me.logCall("GetDeprovisioningState", "userId", userId)
+	return NewDeprovisioningState(), nil
+}
+
+func (me *NoopConnector) StoreDeprovisioningState(ctx *AccessTokenContext, userId string, deprovisioningState *DeprovisioningState) error {
+	me.logCall("StoreDeprovisioningState", "userId", userId, "deprovisioningState", deprovisioningState)
+	return nil
+}
+
+func (me *NoopConnector) GetUserIdMigrationState(ctx *AccessTokenContext, userId string) (*UserIdMigrationState, error) {
+	me.logCall("GetUserIdMigrationState", "userId", userId)
+	return NewUserIdMigrationState(), nil
+}
+
+func (me *NoopConnector) StoreUserIdMigrationState(ctx *AccessTokenContext, userId string, userIdMigrationState *UserIdMigrationState) error {
+	me.logCall("StoreUserIdMigrationState", "userId", userId, "userIdMigrationState", userIdMigrationState)
+	return nil
+}
+
+// GetManagedRoomIds reports that nothing has been recorded yet
+func (me *NoopConnector) GetManagedRoomIds(ctx *AccessTokenContext, userId string) ([]string, error) {
+	me.logCall("GetManagedRoomIds", "userId", userId)
+	return nil, nil
+}
+
+func (me *NoopConnector) StoreManagedRoomIds(ctx *AccessTokenContext, userId string, roomIds []string) error {
+	me.logCall("StoreManagedRoomIds", "userId", userId, "roomIds", roomIds)
+	return nil
+}
+
+func (me *NoopConnector) GetAvatarUploadCache(ctx *AccessTokenContext, userId string) (*AvatarUploadCache, error) {
+	me.logCall("GetAvatarUploadCache", "userId", userId)
+	return NewAvatarUploadCache(), nil
+}
+
+func (me *NoopConnector) StoreAvatarUploadCache(ctx *AccessTokenContext, userId string, avatarUploadCache *AvatarUploadCache) error {
+	me.logCall("StoreAvatarUploadCache", "userId", userId, "avatarUploadCache", avatarUploadCache)
+	return nil
+}
+
+// GetReconciliationCheckpoint reports that there's no checkpoint to resume from
+func (me *NoopConnector) GetReconciliationCheckpoint(ctx *AccessTokenContext, userId string) (*ReconciliationCheckpoint, error) {
+	me.logCall("GetReconciliationCheckpoint", "userId", userId)
+	return nil, nil
+}
+
+func (me *NoopConnector) StoreReconciliationCheckpoint(ctx *AccessTokenContext, userId string, checkpoint *ReconciliationCheckpoint) error {
+	me.logCall("StoreReconciliationCheckpoint", "userId", userId, "checkpoint", checkpoint)
+	return nil
+}
+
+// Ensure interface is implemented
+var _ MatrixConnector = &NoopConnector{}
@@ -0,0 +1,70 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"sort"
+	"strings"
+)
+
+// DetermineCurrentPushRules returns the (non-default) push rules of the given user, whose ids start with the given prefix
+func (me *ApiConnector) DetermineCurrentPushRules(ctx *AccessTokenContext, userId string, ruleIdPrefix string) ([]CurrentUserPushRule, error) {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var response matrix.ApiPushRulesResponse
+	err = client.MakeRequest("GET", client.BuildURL("pushrules/"), nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	kinds := make([]string, 0, len(response.Global))
+	for kind := range response.Global {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	pushRules := make([]CurrentUserPushRule, 0)
+	for _, kind := range kinds {
+		for _, rule := range response.Global[kind] {
+			if rule.Default || !strings.HasPrefix(rule.RuleId, ruleIdPrefix) {
+				continue
+			}
+
+			pushRules = append(pushRules, CurrentUserPushRule{
+				Kind:       kind,
+				RuleId:     rule.RuleId,
+				Actions:    rule.Actions,
+				Conditions: rule.Conditions,
+				Pattern:    rule.Pattern,
+			})
+		}
+	}
+
+	return pushRules, nil
+}
+
+// SetPushRule creates the given push rule for the user, or updates it (if a rule of the same kind and id already exists)
+func (me *ApiConnector) SetPushRule(ctx *AccessTokenContext, userId string, kind string, ruleId string, rule *matrix.ApiPushRuleRequest) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest("PUT", client.BuildURL("pushrules", "global", kind, ruleId), rule, nil)
+}
+
+func (me *ApiConnector) DeletePushRule(ctx *AccessTokenContext, userId string, kind string, ruleId string) error {
+	client, err := me.createMatrixClientForUserId(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	err = client.MakeRequest("DELETE", client.BuildURL("pushrules", "global", kind, ruleId), nil, nil)
+	if err != nil && matrix.IsErrorWithCode(err, matrix.ErrorNotFound) {
+		// Already gone. Nothing to do.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// rateLimitMaxRetries specifies how many times a rate-limited request is retried, before giving up
+	rateLimitMaxRetries = 5
+
+	// rateLimitInitialBackoff is how long we wait before retrying a rate-limited request, if the homeserver doesn't tell us (via `retry_after_ms`).
+	// It doubles with each retry.
+	rateLimitInitialBackoff = 1 * time.Second
+
+	// rateLimitMaxRetryAfter caps how long we wait before retrying a rate-limited request (even if the homeserver asks for more)
+	rateLimitMaxRetryAfter = 60 * time.Second
+)
+
+// RequestBudget limits how many requests per second are made to the homeserver (on average),
+// so that we leave enough capacity for interactive traffic.
+//
+// Up to `burst` requests can be made in quick succession, as long as the budget has not been used for a while.
+type RequestBudget struct {
+	interval time.Duration
+	burst    int
+
+	nextAt time.Time
+	lock   sync.Mutex
+}
+
+func NewRequestBudget(requestsPerSecond float64, burst int) (*RequestBudget, error) {
+	if requestsPerSecond <= 0 {
+		return nil, fmt.Errorf("requests per second needs to be a positive number")
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("burst needs to be a positive number")
+	}
+
+	return &RequestBudget{
+		interval: time.Duration(float64(time.Second) / requestsPerSecond),
+		burst:    burst,
+	}, nil
+}
+
+// Wait blocks until the budget allows for another request to be made
+func (me *RequestBudget) Wait() {
+	me.lock.Lock()
+	now := time.Now()
+	// Not letting unused budget accumulate beyond the burst size
+	earliestAt := now.Add(-time.Duration(me.burst-1) * me.interval)
+	if me.nextAt.Before(earliestAt) {
+		me.nextAt = earliestAt
+	}
+	waitUntil := me.nextAt
+	me.nextAt = me.nextAt.Add(me.interval)
+	me.lock.Unlock()
+
+	time.Sleep(time.Until(waitUntil))
+}
+
+// rateLimitAwareTransport is an http.RoundTripper, which makes requests within a request budget (if any)
+// and retries requests that the homeserver rate-limits (HTTP 429), honoring `retry_after_ms`.
+//
+// Being rate-limited pauses all requests going through the transport (not just the rate-limited one) until the homeserver
+// is ready to accept more (see pause), as others (e.g. made by other reconciliation workers) would most likely get rate-limited as well.
+//
+// Each attempt is made using attemptClient (or the one for the request's category, see attemptClientFor),
+// so that timeouts apply to each attempt (and not to all of them, including waiting).
+type rateLimitAwareTransport struct {
+	logger        *logrus.Logger
+	attemptClient *http.Client
+
+	// categoryAttemptClients contains clients with their own timeout, keyed by request category (see ApiConnector.SetCategoryTimeouts)
+	categoryAttemptClients map[string]*http.Client
+
+	// budget (if set) limits how many requests are made (see ApiConnector.SetRequestBudget)
+	budget *RequestBudget
+
+	// requestMetrics (if set) is where rate-limiting gets recorded (see ApiConnector.SetRequestMetrics)
+	requestMetrics *RequestMetrics
+
+	// pausedUntil is when requests can be made again, after having been rate-limited (see pause)
+	pausedUntil time.Time
+	pauseLock   sync.Mutex
+}
+
+func (me *rateLimitAwareTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	backoff := rateLimitInitialBackoff
+
+	for retry := 0; ; retry++ {
+		attemptRequest, err := prepareAttemptRequest(request, retry)
+		if err != nil {
+			return nil, err
+		}
+
+		err = me.waitWhilePaused(request)
+		if err != nil {
+			return nil, err
+		}
+
+		if me.budget != nil {
+			me.budget.Wait()
+		}
+
+		response, err := me.attemptClientFor(request).Do(attemptRequest)
+		if err != nil || response.StatusCode != http.StatusTooManyRequests {
+			return response, err
+		}
+
+		if retry == rateLimitMaxRetries || !isRequestRetriable(request) {
+			me.logger.Warnf(
+				"Request %s %s is still rate-limited after %d retries, giving up",
+				request.Method,
+				request.URL.Path,
+				retry,
+			)
+
+			if me.requestMetrics != nil {
+				me.requestMetrics.observeRateLimitExhausted(request)
+			}
+
+			return response, err
+		}
+
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		retryAfter := determineRetryAfter(response, body, backoff)
+		backoff *= 2
+
+		me.pause(request, retryAfter)
+	}
+}
+
+// pause holds back all requests for the given duration (unless they've been paused for longer already),
+// after the given request got rate-limited.
+//
+// Only the start (or extension) of a pause gets logged, so that sustained rate-limiting doesn't flood the logs
+// with an entry for each affected request. How long requests got held back for is tracked by the request metrics (if set).
+func (me *rateLimitAwareTransport) pause(request *http.Request, duration time.Duration) {
+	me.pauseLock.Lock()
+	defer me.pauseLock.Unlock()
+
+	now := time.Now()
+	pausedUntil := now.Add(duration)
+	if !pausedUntil.After(me.pausedUntil) {
+		me.logger.Debugf(
+			"Request %s %s hit a rate limit, will retry once requests are resumed",
+			request.Method,
+			request.URL.Path,
+		)
+		return
+	}
+
+	extension := pausedUntil.Sub(now)
+	if me.pausedUntil.After(now) {
+		extension = pausedUntil.Sub(me.pausedUntil)
+	}
+	me.pausedUntil = pausedUntil
+
+	me.logger.Warnf(
+		"Request %s %s hit a rate limit, pausing all requests to the homeserver for %s",
+		request.Method,
+		request.URL.Path,
+		duration,
+	)
+
+	if me.requestMetrics != nil {
+		me.requestMetrics.observeRateLimitPause(extension)
+	}
+}
+
+// waitWhilePaused blocks until requests are no longer paused (see pause), or until the request gets canceled
+func (me *rateLimitAwareTransport) waitWhilePaused(request *http.Request) error {
+	me.pauseLock.Lock()
+	wait := time.Until(me.pausedUntil)
+	me.pauseLock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	select {
+	case <-request.Context().Done():
+		return request.Context().Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// attemptClientFor returns the client to make attempts at the given request with, which decides its timeout.
+// A client for the request's exact category (e.g. `synapse_admin.deactivate`, see determineApiCategory) is preferred
+// over one for its whole API (e.g. `synapse_admin`), with the default attemptClient used otherwise.
+func (me *rateLimitAwareTransport) attemptClientFor(request *http.Request) *http.Client {
+	if len(me.categoryAttemptClients) == 0 {
+		return me.attemptClient
+	}
+
+	category := determineApiCategory(request.URL.Path)
+	if client, exists := me.categoryAttemptClients[category]; exists {
+		return client
+	}
+
+	api := strings.SplitN(category, ".", 2)[0]
+	if client, exists := me.categoryAttemptClients[api]; exists {
+		return client
+	}
+
+	return me.attemptClient
+}
+
+// prepareAttemptRequest returns a copy of the request, with a fresh body (as the previous attempt consumed the body)
+func prepareAttemptRequest(request *http.Request, retry int) (*http.Request, error) {
+	if retry == 0 || request.Body == nil || request.Body == http.NoBody {
+		return request.Clone(request.Context()), nil
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return nil, err
+	}
+
+	attemptRequest := request.Clone(request.Context())
+	attemptRequest.Body = body
+	return attemptRequest, nil
+}
+
+// isRequestRetriable tells whether the request can be made again, which requires its body (if any) to be re-readable
+func isRequestRetriable(request *http.Request) bool {
+	return request.Body == nil || request.Body == http.NoBody || request.GetBody != nil
+}
+
+// determineRetryAfter figures out how long to wait before retrying a rate-limited request,
+// preferring what the homeserver says (`retry_after_ms` or a `Retry-After` header) over our own backoff.
+func determineRetryAfter(response *http.Response, body []byte, backoff time.Duration) time.Duration {
+	retryAfter := matrix.GetRetryAfterFromResponseBody(body)
+
+	if retryAfter == 0 {
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if retryAfter == 0 {
+		retryAfter = backoff
+	}
+
+	if retryAfter > rateLimitMaxRetryAfter {
+		retryAfter = rateLimitMaxRetryAfter
+	}
+
+	return retryAfter
+}
@@ -0,0 +1,42 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRateLimitedRequestsAreRetriedOnlyByTheTransport(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"errcode": "M_LIMIT_EXCEEDED", "error": "Too Many Requests", "retry_after_ms": 1}`))
+	}))
+	defer server.Close()
+
+	connector := NewApiConnector(server.URL, nil, 1000, logger)
+	connector.SetAppServiceToken("as-token")
+
+	ctx := NewAccessTokenContext(connector, "device", 0)
+
+	err := connector.SetUserDisplayName(ctx, "@a:example.com", "A")
+	if !matrix.IsErrorWithCode(err, matrix.ErrorLimitExceeded) {
+		t.Errorf("expected a rate-limiting error, got: %v", err)
+	}
+
+	// The first attempt and each of the transport's retries, with nothing retrying on top of that
+	expectedAttempts := int32(1 + rateLimitMaxRetries)
+	if atomic.LoadInt32(&attempts) != expectedAttempts {
+		t.Errorf("expected %d attempts, got %d", expectedAttempts, atomic.LoadInt32(&attempts))
+	}
+}
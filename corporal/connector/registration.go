@@ -0,0 +1,92 @@
+package connector
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"devture-matrix-corporal/corporal/matrix"
+	"fmt"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// registerUserAccount creates the given user's account (unless it exists already), using the Shared-Secret Registration API
+// at `/_synapse/admin/v1/register` (which other homeservers, like Dendrite, also implement).
+//
+// The user type (if any) is part of the HMAC, so it's only to be specified for homeservers which support it (Synapse).
+func (me *ApiConnector) registerUserAccount(registrationSharedSecret string, userId string, password string, userType string) error {
+	userIdLocalPart, err := gomatrix.ExtractUserLocalpart(userId)
+	if err != nil {
+		return err
+	}
+
+	client, _ := gomatrix.NewClient(me.homeserverApiEndpoint, "", "")
+	client.Client = me.httpClient
+
+	var nonceResponse matrix.ApiUserAccountRegisterNonceResponse
+	err = client.MakeRequest(
+		"GET",
+		buildPrefixlessURL(client, "/_synapse/admin/v1/register", map[string]string{}),
+		nil,
+		&nonceResponse,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Generating the HMAC the same way that the `register_new_matrix_user` script from Matrix Synapse does it.
+	mac := hmac.New(sha1.New, []byte(registrationSharedSecret))
+	mac.Write([]byte(nonceResponse.Nonce))
+	mac.Write([]byte("\x00"))
+	mac.Write([]byte(userIdLocalPart))
+	mac.Write([]byte("\x00"))
+	mac.Write([]byte(password))
+	mac.Write([]byte("\x00"))
+	mac.Write([]byte("notadmin"))
+	if userType != "" {
+		mac.Write([]byte("\x00"))
+		mac.Write([]byte(userType))
+	}
+
+	payload := matrix.ApiUserAccountRegisterRequestPayload{
+		Nonce:    nonceResponse.Nonce,
+		Username: userIdLocalPart,
+		Password: password,
+		Mac:      fmt.Sprintf("%x", mac.Sum(nil)),
+		Type:     matrix.RegistrationTypeSharedSecret,
+		Admin:    false,
+		UserType: userType,
+	}
+
+	var registerResponse matrix.ApiUserAccountRegisterResponse
+
+	// The canonical admin/register API is available at `/_synapse/admin/v1/register`.
+	// What we hit below is an alias, which might stop working some time in the future.
+	// See above for why we can't easily use it.
+	err = client.MakeRequest(
+		"POST",
+		buildPrefixlessURL(client, "/_synapse/admin/v1/register", map[string]string{}),
+		payload,
+		&registerResponse,
+	)
+
+	if err != nil {
+		// Swallow "user already exists" errors.
+		// We don't care who created it and when. We only care that it exists.
+		if matrix.IsErrorWithCode(err, matrix.ErrorUserInUse) {
+			return nil
+		}
+
+		return err
+	}
+
+	// The register API creates an access token automatically.
+	// We don't need it and we'd rather be nice and get rid of it, to keep things clean.
+	clientForUser, _ := gomatrix.NewClient(me.homeserverApiEndpoint, userIdLocalPart, registerResponse.AccessToken)
+	clientForUser.Client = me.httpClient
+	_, err = clientForUser.Logout()
+	if err != nil {
+		me.logger.Warnf("failed logging out user %s: %s", userIdLocalPart, err)
+	}
+
+	return nil
+}
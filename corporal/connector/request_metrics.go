@@ -0,0 +1,144 @@
+package connector
+
+import (
+	"devture-matrix-corporal/corporal/metrics"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiCategoryPathPrefixes maps path prefixes to the API (used as part of the request category, see determineApiCategory) they belong to
+var apiCategoryPathPrefixes = []struct {
+	prefix string
+	api    string
+}{
+	{"/_matrix/client/", "client"},
+	{"/_matrix/media/", "media"},
+	{"/_synapse/admin/", "synapse_admin"},
+	{"/_dendrite/admin/", "dendrite_admin"},
+	{"/api/admin/", "mas_admin"},
+	{"/oauth2/", "oauth2"},
+}
+
+// apiVersionPathSegmentRegex matches the path segments specifying API versions (`r0`, `v3`, `unstable`, etc.)
+var apiVersionPathSegmentRegex = regexp.MustCompile(`^(r\d+|v\d+|unstable)$`)
+
+// RequestMetrics counts the requests made to the homeserver (and to services next to it, like matrix-authentication-service)
+// and tracks how long they take (see ApiConnector.SetRequestMetrics).
+//
+// Requests are labeled by API category (see determineApiCategory), HTTP method and status code (`error` when no response was received).
+// Each attempt counts, so retried and rate-limited requests count more than once.
+//
+// These categories are unrelated to the ones that reconciliation actions are grouped into (like reconciliation.ApiCategoryState),
+// as the same requests get made for different kinds of actions.
+//
+// Rate-limiting is tracked separately (see rateLimitAwareTransport), so that sustained rate-limiting can be alerted on.
+type RequestMetrics struct {
+	requests *metrics.Counter
+	duration *metrics.Histogram
+
+	rateLimitPause     *metrics.Counter
+	rateLimitExhausted *metrics.Counter
+}
+
+func NewRequestMetrics(registry *metrics.Registry) *RequestMetrics {
+	return &RequestMetrics{
+		requests: registry.NewCounter(
+			"matrix_corporal_homeserver_requests_total",
+			"Number of requests made to the homeserver's APIs.",
+			"category",
+			"method",
+			"status",
+		),
+		duration: registry.NewHistogram(
+			"matrix_corporal_homeserver_request_duration_seconds",
+			"How long requests made to the homeserver's APIs took.",
+			metrics.DefaultDurationBuckets,
+			"category",
+			"method",
+			"status",
+		),
+		rateLimitPause: registry.NewCounter(
+			"matrix_corporal_homeserver_rate_limit_pause_seconds_total",
+			"How long requests to the homeserver's APIs were paused for, because of the homeserver rate-limiting them.",
+		),
+		rateLimitExhausted: registry.NewCounter(
+			"matrix_corporal_homeserver_rate_limit_exhausted_total",
+			"Number of requests to the homeserver's APIs which were given up on, because of still being rate-limited after all retries.",
+			"category",
+			"method",
+		),
+	}
+}
+
+func (me *RequestMetrics) observe(request *http.Request, response *http.Response, err error, duration time.Duration) {
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(response.StatusCode)
+	}
+
+	category := determineApiCategory(request.URL.Path)
+
+	me.requests.Inc(category, request.Method, status)
+	me.duration.Observe(duration.Seconds(), category, request.Method, status)
+}
+
+func (me *RequestMetrics) observeRateLimitPause(duration time.Duration) {
+	me.rateLimitPause.Add(duration.Seconds())
+}
+
+func (me *RequestMetrics) observeRateLimitExhausted(request *http.Request) {
+	me.rateLimitExhausted.Inc(determineApiCategory(request.URL.Path), request.Method)
+}
+
+// instrumentedTransport is an http.RoundTripper, which records each request in the request metrics (if set)
+type instrumentedTransport struct {
+	next http.RoundTripper
+
+	// requestMetrics (if set) is where requests get recorded (see ApiConnector.SetRequestMetrics)
+	requestMetrics *RequestMetrics
+}
+
+func (me *instrumentedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	next := me.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	if me.requestMetrics == nil {
+		return next.RoundTrip(request)
+	}
+
+	startedAt := time.Now()
+	response, err := next.RoundTrip(request)
+	me.requestMetrics.observe(request, response, err, time.Since(startedAt))
+
+	return response, err
+}
+
+// determineApiCategory tells which API (see apiCategoryPathPrefixes) and which part of it (the first path segment after the API version)
+// a request path belongs to, e.g. `client.rooms` for `/_matrix/client/v3/rooms/{roomId}/state` or `synapse_admin.users` for `/_synapse/admin/v2/users`.
+//
+// Parts of paths which may contain ids are not included, so that there's a limited number of categories.
+func determineApiCategory(path string) string {
+	for _, apiCategoryPathPrefix := range apiCategoryPathPrefixes {
+		idx := strings.Index(path, apiCategoryPathPrefix.prefix)
+		if idx == -1 {
+			continue
+		}
+
+		segments := strings.Split(path[idx+len(apiCategoryPathPrefix.prefix):], "/")
+		if len(segments) > 1 && apiVersionPathSegmentRegex.MatchString(segments[0]) {
+			segments = segments[1:]
+		}
+
+		if segments[0] == "" {
+			return apiCategoryPathPrefix.api
+		}
+		return apiCategoryPathPrefix.api + "." + segments[0]
+	}
+
+	return "other"
+}
@@ -0,0 +1,196 @@
+package connector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetryPolicy specifies how requests which fail because of the homeserver being unavailable
+// (connection errors and HTTP 502, 503 or 504 responses) are retried (see ApiConnector.SetRetryPolicy).
+//
+// Only idempotent requests (GET, HEAD, OPTIONS, PUT and DELETE) are retried, as others may have taken effect already.
+type RetryPolicy struct {
+	MaxRetries int
+
+	// InitialBackoff is how long to wait before the first retry. It doubles with each retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// CircuitBreaker stops requests from being made to the homeserver for a while (making them fail right away instead),
+// once a number of consecutive ones have failed because of it being unavailable (see ApiConnector.SetCircuitBreaker).
+//
+// Once the open duration passes, a single request is let through to find out whether the homeserver is back.
+// Succeeding closes the circuit again, while failing keeps it open for another open duration.
+type CircuitBreaker struct {
+	failureThreshold int
+	openDuration     time.Duration
+
+	lock sync.Mutex
+
+	consecutiveFailures int
+	openUntil           time.Time
+	trialInProgress     bool
+}
+
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration) (*CircuitBreaker, error) {
+	if failureThreshold <= 0 {
+		return nil, fmt.Errorf("the failure threshold needs to be a positive number")
+	}
+	if openDuration <= 0 {
+		return nil, fmt.Errorf("the open duration needs to be positive")
+	}
+
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+	}, nil
+}
+
+// allow tells whether a request can be made now, failing with an explanation if not.
+// Allowed requests need to be followed by a call to record.
+func (me *CircuitBreaker) allow() error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if me.consecutiveFailures < me.failureThreshold {
+		return nil
+	}
+
+	if time.Now().Before(me.openUntil) || me.trialInProgress {
+		return fmt.Errorf(
+			"the homeserver appears to be unavailable (%d consecutive requests failed), not making requests to it until %s",
+			me.consecutiveFailures,
+			me.openUntil.Format(time.RFC3339),
+		)
+	}
+
+	me.trialInProgress = true
+
+	return nil
+}
+
+// record takes the outcome of an allowed request into account
+func (me *CircuitBreaker) record(failed bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.trialInProgress = false
+
+	if !failed {
+		me.consecutiveFailures = 0
+		return
+	}
+
+	me.consecutiveFailures++
+	if me.consecutiveFailures >= me.failureThreshold {
+		me.openUntil = time.Now().Add(me.openDuration)
+	}
+}
+
+// resilientTransport is an http.RoundTripper, which retries requests failing because of the homeserver being unavailable (see RetryPolicy)
+// and stops making requests while it is (see CircuitBreaker). Both are optional.
+type resilientTransport struct {
+	logger *logrus.Logger
+	next   http.RoundTripper
+
+	// retryPolicy (if set) is for retrying requests (see ApiConnector.SetRetryPolicy)
+	retryPolicy *RetryPolicy
+
+	// circuitBreaker (if set) is for failing fast (see ApiConnector.SetCircuitBreaker)
+	circuitBreaker *CircuitBreaker
+}
+
+func (me *resilientTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	maxRetries := 0
+	var backoff time.Duration
+	if me.retryPolicy != nil && isRequestIdempotent(request) && isRequestRetriable(request) {
+		maxRetries = me.retryPolicy.MaxRetries
+		backoff = me.retryPolicy.InitialBackoff
+	}
+
+	for retry := 0; ; retry++ {
+		attemptRequest, err := prepareAttemptRequest(request, retry)
+		if err != nil {
+			return nil, err
+		}
+
+		if me.circuitBreaker != nil {
+			err = me.circuitBreaker.allow()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := me.next.RoundTrip(attemptRequest)
+
+		failed := isHomeserverUnavailabilityFailure(request, response, err)
+		if me.circuitBreaker != nil {
+			me.circuitBreaker.record(failed)
+		}
+
+		if !failed || retry == maxRetries {
+			return response, err
+		}
+
+		if response != nil {
+			// We don't care about this response. Reading it fully lets the connection be reused.
+			ioutil.ReadAll(response.Body)
+			response.Body.Close()
+		}
+
+		me.logger.Infof(
+			"Request %s %s failed because of the homeserver being unavailable (%s), will retry in %s",
+			request.Method,
+			request.URL.Path,
+			describeHomeserverUnavailabilityFailure(response, err),
+			backoff,
+		)
+
+		select {
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if me.retryPolicy.MaxBackoff > 0 && backoff > me.retryPolicy.MaxBackoff {
+			backoff = me.retryPolicy.MaxBackoff
+		}
+	}
+}
+
+// isRequestIdempotent tells whether making the request more than once has the same effect as making it once
+func isRequestIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// isHomeserverUnavailabilityFailure tells whether the request failed because of the homeserver being unavailable,
+// as opposed to it having responded (with whatever error) or the request having been cancelled.
+func isHomeserverUnavailabilityFailure(request *http.Request, response *http.Response, err error) bool {
+	if err != nil {
+		return request.Context().Err() == nil
+	}
+
+	switch response.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func describeHomeserverUnavailabilityFailure(response *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("HTTP %d", response.StatusCode)
+}
@@ -0,0 +1,22 @@
+package connector
+
+// CreateRoomRequest is the request payload for creating rooms (see https://spec.matrix.org/latest/client-server-api/#post_matrixclientv3createroom).
+//
+// Unlike gomatrix.ReqCreateRoom, it supports `room_version` and doesn't send superfluous (event id, sender, etc.) fields for the initial state.
+type CreateRoomRequest struct {
+	RoomAliasName   string                        `json:"room_alias_name,omitempty"`
+	Name            string                        `json:"name,omitempty"`
+	Topic           string                        `json:"topic,omitempty"`
+	Preset          string                        `json:"preset,omitempty"`
+	RoomVersion     string                        `json:"room_version,omitempty"`
+	CreationContent map[string]interface{}        `json:"creation_content,omitempty"`
+	InitialState    []CreateRoomRequestStateEvent `json:"initial_state,omitempty"`
+	Invite          []string                      `json:"invite,omitempty"`
+	IsDirect        bool                          `json:"is_direct,omitempty"`
+}
+
+type CreateRoomRequestStateEvent struct {
+	Type     string                 `json:"type"`
+	StateKey string                 `json:"state_key"`
+	Content  map[string]interface{} `json:"content"`
+}
@@ -0,0 +1,75 @@
+package connector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// RoomStateCache keeps the full current state of rooms around for a short while (see AccessTokenContext.SetRoomStateCache),
+// so that determining different parts of a room's state (members, power levels, name, topic, etc.) fetches it only once.
+//
+// Rooms changed through the connector (joining, kicking, setting state, etc.) are forgotten about right away,
+// while changes made by others go unnoticed for up to the cache's TTL.
+type RoomStateCache struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*roomStateCacheEntry
+
+	// roomIdToLockMap contains a lock for each room, so that (when used from multiple goroutines)
+	// we fetch the state of each room once, instead of each goroutine fetching it on its own.
+	roomIdToLockMap *sync.Map
+}
+
+type roomStateCacheEntry struct {
+	events    []gomatrix.Event
+	fetchedAt time.Time
+}
+
+func NewRoomStateCache(ttl time.Duration) *RoomStateCache {
+	return &RoomStateCache{
+		ttl:             ttl,
+		entries:         map[string]*roomStateCacheEntry{},
+		roomIdToLockMap: &sync.Map{},
+	}
+}
+
+// get returns the state events of the given room, using the fetcher for rooms which haven't been fetched within the TTL
+func (me *RoomStateCache) get(roomId string, fetcher func() ([]gomatrix.Event, error)) ([]gomatrix.Event, error) {
+	lockInterface, _ := me.roomIdToLockMap.LoadOrStore(roomId, &sync.Mutex{})
+	lock := lockInterface.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	me.lock.Lock()
+	entry, exists := me.entries[roomId]
+	me.lock.Unlock()
+
+	if exists && time.Since(entry.fetchedAt) < me.ttl {
+		return entry.events, nil
+	}
+
+	events, err := fetcher()
+	if err != nil {
+		return nil, err
+	}
+
+	me.lock.Lock()
+	me.entries[roomId] = &roomStateCacheEntry{
+		events:    events,
+		fetchedAt: time.Now(),
+	}
+	me.lock.Unlock()
+
+	return events, nil
+}
+
+// invalidate forgets about the state of the given room, so that it gets fetched anew next time
+func (me *RoomStateCache) invalidate(roomId string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	delete(me.entries, roomId)
+}
@@ -1,7 +1,34 @@
 package connector
 
+import (
+	"devture-matrix-corporal/corporal/reconciliation"
+	"sort"
+	"time"
+)
+
 type CurrentState struct {
 	Users []CurrentUserState `json:"users"`
+	Rooms []CurrentRoomState `json:"rooms"`
+
+	// DeclaredRoomIds maps the keys of declared rooms (see policy.DeclaredRoom) to the ids of the rooms created for them so far
+	DeclaredRoomIds map[string]string `json:"declaredRoomIds"`
+
+	// Deprovisioning is what's known about deprovisioning users (see policy.Deprovisioning).
+	// It's only determined when the policy asks for deprovisioning to be tracked and is nil otherwise.
+	Deprovisioning *DeprovisioningState `json:"deprovisioning"`
+
+	// UserIdMigrations is what's known about user id migrations (see policy.UserIdMigration).
+	// It's only determined (during full runs) when the policy contains user id migrations and is nil otherwise.
+	UserIdMigrations *UserIdMigrationState `json:"userIdMigrations"`
+
+	// UnmanagedUsers contains the (active) accounts, which are not part of the policy (see policy.AccountCleanup).
+	// They're only determined (during full runs) when the policy asks for accounts to be cleaned up and are nil otherwise.
+	UnmanagedUsers []CurrentUnmanagedUserState `json:"unmanagedUsers"`
+
+	// ManagedRooms is what's known about rooms which used to be managed (see policy.OrphanedRooms).
+	// It's only determined (during full runs) when the policy asks for orphaned rooms to be handled and is nil otherwise.
+	// The current state of orphaned rooms (if needed) is in Rooms, along with the managed rooms.
+	ManagedRooms *ManagedRoomsState `json:"managedRooms"`
 }
 
 func (me *CurrentState) GetUserStateByUserId(userId string) *CurrentUserState {
@@ -13,6 +40,29 @@ func (me *CurrentState) GetUserStateByUserId(userId string) *CurrentUserState {
 	return nil
 }
 
+// GetJoinedUserIdsByRoomId tells which (known) users are joined to each room, based on the rooms of each user (see CurrentUserState.JoinedRoomIds)
+func (me *CurrentState) GetJoinedUserIdsByRoomId() map[string]map[string]bool {
+	joinedUserIdsByRoomId := map[string]map[string]bool{}
+	for _, userState := range me.Users {
+		for _, roomId := range userState.JoinedRoomIds {
+			if _, exists := joinedUserIdsByRoomId[roomId]; !exists {
+				joinedUserIdsByRoomId[roomId] = map[string]bool{}
+			}
+			joinedUserIdsByRoomId[roomId][userState.Id] = true
+		}
+	}
+	return joinedUserIdsByRoomId
+}
+
+func (me *CurrentState) GetRoomStateByRoomId(roomId string) *CurrentRoomState {
+	for _, roomState := range me.Rooms {
+		if roomState.Id == roomId {
+			return &roomState
+		}
+	}
+	return nil
+}
+
 type CurrentUserState struct {
 	Id                  string   `json:"id"`
 	Active              bool     `json:"active"`
@@ -20,4 +70,260 @@ type CurrentUserState struct {
 	AvatarMxcUri        string   `json:"avatarMxcUri"`
 	AvatarSourceUriHash string   `json:"avatarSourceUriHash"`
 	JoinedRoomIds       []string `json:"joinedRoomIds"`
+
+	ThreePids []CurrentUserThreePid `json:"threePids"`
+
+	// DeliveredServerNoticeIds contains the IDs of all policy server notices (see policy.ServerNotice) delivered to this user so far.
+	DeliveredServerNoticeIds []string `json:"deliveredServerNoticeIds"`
+
+	// ServerAdmin tells whether the user is a homeserver administrator
+	ServerAdmin bool `json:"serverAdmin"`
+
+	// UserType is the user's Synapse user type (e.g. `bot`). It's empty for regular users.
+	UserType string `json:"userType"`
+
+	// ShadowBanned tells whether the user is shadow-banned
+	ShadowBanned bool `json:"shadowBanned"`
+
+	// CreatedAt is when the user's account got created (in milliseconds since the epoch). It's zero if unknown.
+	CreatedAt int64 `json:"createdAt"`
+
+	// PushRules contains the user's managed push rules (see policy.PushRuleIdPrefix).
+	// They're only determined for users whose push rules are managed (see policy.UserPolicy.PushRules) and are nil otherwise.
+	PushRules []CurrentUserPushRule `json:"pushRules"`
+
+	// AccountData contains the user's account data entries of the types declared for the user (see policy.UserPolicy.AccountData).
+	// Other account data is not determined.
+	AccountData []CurrentUserAccountData `json:"accountData"`
+
+	// Devices contains the user's devices (sessions).
+	// They're only determined for users whose idle devices get deleted (see policy.Policy.GetMaxDeviceIdleDuration) and are nil otherwise.
+	Devices []CurrentUserDevice `json:"devices"`
+
+	// ServerDeactivated tells whether the account has been deactivated on the homeserver itself (not just marked as deactivated).
+	// This happens when erasing users (see policy.DeprovisioningModeErase) and cannot be undone by us.
+	// Nothing else is determined for such users.
+	ServerDeactivated bool `json:"serverDeactivated"`
+}
+
+// CurrentUnmanagedUserState is an (active) account, which is not part of the policy
+type CurrentUnmanagedUserState struct {
+	Id    string `json:"id"`
+	Guest bool   `json:"guest"`
+
+	// CreatedAt is when the account got created (in milliseconds since the epoch). It's zero if unknown.
+	CreatedAt int64 `json:"createdAt"`
+
+	ServerAdmin bool `json:"serverAdmin"`
+
+	// UserType is the account's type (e.g. `bot`). It's empty for regular users.
+	UserType string `json:"userType"`
+
+	// AppServiceId is the id of the application service which registered the account. It's empty for other accounts.
+	AppServiceId string `json:"appServiceId"`
+}
+
+// CurrentUserPushRule is a push rule that a user has (see policy.UserPushRule)
+type CurrentUserPushRule struct {
+	Kind       string                   `json:"kind"`
+	RuleId     string                   `json:"ruleId"`
+	Actions    []interface{}            `json:"actions"`
+	Conditions []map[string]interface{} `json:"conditions"`
+	Pattern    string                   `json:"pattern"`
+}
+
+// CurrentUserAccountData is an account data entry that a user has (see policy.UserAccountData).
+// Account data which doesn't exist has empty content.
+type CurrentUserAccountData struct {
+	Type    string                 `json:"type"`
+	RoomId  string                 `json:"roomId"`
+	Content map[string]interface{} `json:"content"`
+}
+
+// CurrentUserDevice is a device (session) that a user has.
+// LastSeenTs (in milliseconds) is zero for devices which have not been seen yet.
+type CurrentUserDevice struct {
+	Id         string `json:"id"`
+	LastSeenTs int64  `json:"lastSeenTs"`
+}
+
+// DeprovisioningState keeps track of deprovisioning users (see policy.Deprovisioning).
+// It's stored in the matrix-corporal user's account data.
+type DeprovisioningState struct {
+	// ManagedUserIds contains the ids of the users managed as of the last reconciliation run,
+	// so that users removed from the policy since then can be told apart (see policy.Deprovisioning.IncludeRemovedUsers).
+	ManagedUserIds []string `json:"managedUserIds"`
+
+	// DeprovisionedAt maps the ids of deprovisioned users to when they got deprovisioned (in milliseconds since the epoch).
+	DeprovisionedAt map[string]int64 `json:"deprovisionedAt"`
+}
+
+func NewDeprovisioningState() *DeprovisioningState {
+	return &DeprovisioningState{
+		ManagedUserIds:  []string{},
+		DeprovisionedAt: map[string]int64{},
+	}
+}
+
+// GetDeprovisionedAt tells when the given user got deprovisioned (if they did)
+func (me *DeprovisioningState) GetDeprovisionedAt(userId string) (time.Time, bool) {
+	if me == nil {
+		return time.Time{}, false
+	}
+
+	deprovisionedAtMs, exists := me.DeprovisionedAt[userId]
+	if !exists {
+		return time.Time{}, false
+	}
+	return time.Unix(0, deprovisionedAtMs*int64(time.Millisecond)), true
+}
+
+// ManagedRoomsState tells which rooms were managed as of the last reconciliation run and which of them are no longer managed (see policy.OrphanedRooms)
+type ManagedRoomsState struct {
+	// RecordedRoomIds contains the ids of the rooms managed as of the last reconciliation run.
+	// It's nil if nothing has been recorded yet. It's stored in the matrix-corporal user's account data.
+	RecordedRoomIds []string `json:"recordedRoomIds"`
+
+	// OrphanedRoomIds contains the recorded rooms which are no longer managed (not counting upgraded rooms, replaced by their successors)
+	OrphanedRoomIds []string `json:"orphanedRoomIds"`
+}
+
+// UserIdMigrationState keeps track of completed user id migrations (see policy.UserIdMigration).
+// It's stored in the matrix-corporal user's account data.
+type UserIdMigrationState struct {
+	// Completed maps the old user ids of completed migrations to how they got completed
+	Completed map[string]CompletedUserIdMigration `json:"completed"`
+}
+
+type CompletedUserIdMigration struct {
+	NewUserId string `json:"newUserId"`
+
+	// CompletedAt is when the migration got completed (in milliseconds since the epoch)
+	CompletedAt int64 `json:"completedAt"`
+}
+
+func NewUserIdMigrationState() *UserIdMigrationState {
+	return &UserIdMigrationState{
+		Completed: map[string]CompletedUserIdMigration{},
+	}
+}
+
+// IsCompleted tells whether the given user has been migrated to the given new user id already
+func (me *UserIdMigrationState) IsCompleted(oldUserId string, newUserId string) bool {
+	if me == nil {
+		return false
+	}
+
+	completed, exists := me.Completed[oldUserId]
+	return exists && completed.NewUserId == newUserId
+}
+
+// ReconciliationCheckpoint records the progress of a full reconciliation run, so that it can be resumed
+// (instead of started over) if matrix-corporal gets restarted in the middle of it.
+// It's stored in the matrix-corporal user's account data.
+type ReconciliationCheckpoint struct {
+	// PolicyHash identifies the policy being reconciled. Checkpoints of runs for some other policy are not resumed.
+	PolicyHash string `json:"policyHash"`
+
+	// StoredAt is when the checkpoint got stored (in milliseconds since the epoch)
+	StoredAt int64 `json:"storedAt"`
+
+	// LastProcessedUserId is the user, whose action was the last one to be performed
+	LastProcessedUserId string `json:"lastProcessedUserId"`
+
+	// PendingActions are the run's actions which hadn't been performed yet (in order).
+	// Sensitive payload data (like initial passwords) is redacted (see reconciliation.RedactActions).
+	PendingActions []*reconciliation.StateAction `json:"pendingActions"`
+}
+
+type CurrentUserThreePid struct {
+	Medium  string `json:"medium"`
+	Address string `json:"address"`
+}
+
+type CurrentRoomState struct {
+	Id string `json:"id"`
+
+	// StateEventContents maps (empty state key) state event types to their content.
+	// Only the state events which were asked for are here. Missing state events are not.
+	StateEventContents map[string]map[string]interface{} `json:"stateEventContents"`
+
+	// ActingUserId is the user (steward or matrix-corporal) that the room's state was determined as (see policy.RoomPolicy.GetActingUserId)
+	ActingUserId string `json:"actingUserId"`
+
+	// Members maps the ids of users who are joined to (or invited to) the room to their membership (`join` or `invite`).
+	// It's only determined for rooms with exclusive membership (see policy.RoomPolicy.ExclusiveMembership)
+	// and for orphaned rooms which are to be archived (see policy.OrphanedRooms). It's nil otherwise.
+	Members map[string]string `json:"members"`
+
+	// KeyedStateEventContents maps state event types (like `m.space.child`), whose state key is not empty, to state keys and contents.
+	// Only the types that the reconciler cares about are determined. Removed state events (those with an empty content) are not included.
+	KeyedStateEventContents map[string]map[string]map[string]interface{} `json:"keyedStateEventContents"`
+
+	// DirectoryVisibility tells whether the room is listed in the public room directory (`public`) or not (`private`).
+	// It's only determined for rooms whose directory visibility is managed (see policy.RoomPolicy.DirectoryVisibility) and is empty otherwise.
+	DirectoryVisibility string `json:"directoryVisibility"`
+
+	// Aliases contains the local aliases which point to the room.
+	// They're only determined for rooms whose aliases are managed (see policy.RoomPolicy.Aliases)
+	// and for orphaned rooms which are to be archived (see policy.OrphanedRooms). They're nil otherwise.
+	Aliases []string `json:"aliases"`
+}
+
+func (me *CurrentRoomState) GetStateEventContent(eventType string) map[string]interface{} {
+	content, exists := me.StateEventContents[eventType]
+	if !exists {
+		return nil
+	}
+	return content
+}
+
+func (me *CurrentRoomState) GetKeyedStateEventContent(eventType string, stateKey string) map[string]interface{} {
+	content, exists := me.KeyedStateEventContents[eventType][stateKey]
+	if !exists {
+		return nil
+	}
+	return content
+}
+
+// GetStateKeys returns the state keys of all (not removed) state events of the given type
+func (me *CurrentRoomState) GetStateKeys(eventType string) []string {
+	stateKeys := make([]string, 0, len(me.KeyedStateEventContents[eventType]))
+	for stateKey := range me.KeyedStateEventContents[eventType] {
+		stateKeys = append(stateKeys, stateKey)
+	}
+	sort.Strings(stateKeys)
+	return stateKeys
+}
+
+// AvatarUploadCache remembers which content repository (mxc://) URIs avatars got uploaded to,
+// so that reconciliation can reuse them, instead of downloading and uploading the same images over and over again.
+// It's stored in the matrix-corporal user's account data.
+type AvatarUploadCache struct {
+	// Uploads maps avatar source URI hashes (see avatar.UriHash) to where the avatar got uploaded
+	Uploads map[string]AvatarUpload `json:"uploads"`
+}
+
+// AvatarUpload is an avatar image, which has been uploaded to the content repository
+type AvatarUpload struct {
+	MxcUri string `json:"mxcUri"`
+
+	// ContentHash identifies the image itself (see avatar.Avatar.ContentHash)
+	ContentHash string `json:"contentHash"`
+}
+
+func NewAvatarUploadCache() *AvatarUploadCache {
+	return &AvatarUploadCache{
+		Uploads: map[string]AvatarUpload{},
+	}
+}
+
+// FindByContentHash returns an upload of the same image (which may have come from some other source URI)
+func (me *AvatarUploadCache) FindByContentHash(contentHash string) (AvatarUpload, bool) {
+	for _, upload := range me.Uploads {
+		if upload.ContentHash == contentHash {
+			return upload, true
+		}
+	}
+	return AvatarUpload{}, false
 }
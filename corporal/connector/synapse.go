@@ -7,14 +7,23 @@ import (
 	"sync"
 	"time"
 
-	"crypto/hmac"
-	"crypto/sha1"
-
 	"github.com/matrix-org/gomatrix"
 )
 
 const (
 	deviceIdCorporal = "matrix-corporal"
+
+	// adminUsersListPageSize is how many users are fetched with each request, when listing all users (see forEachUser)
+	adminUsersListPageSize = 1000
+
+	// roomDeletionPollInterval is how often the status of deleting a room is checked, while waiting for it to complete (see DeleteRoom)
+	roomDeletionPollInterval = 2 * time.Second
+
+	// roomDeletionMaxWait is how long DeleteRoom waits for deleting a room to complete
+	roomDeletionMaxWait = 10 * time.Minute
+
+	// loginTokenIssuingAccessTokenValidity is how long the access tokens that login tokens get requested with are valid for (see IssueLoginToken)
+	loginTokenIssuingAccessTokenValidity = 1 * time.Minute
 )
 
 // SynapseConnector is a MatrixConnector implementation for controlling a Synapse server.
@@ -29,6 +38,20 @@ type SynapseConnector struct {
 	corporalUserAccessTokenContext *AccessTokenContext
 
 	corporalUserIDLock *sync.Mutex
+
+	// stateDeterminationWorkers specifies for how many users the current state is determined at the same time (see SetStateDeterminationWorkers)
+	stateDeterminationWorkers int
+
+	// adminAccessTokenSource (if set) provides the access tokens that admin APIs get called with (see SetAdminAccessTokenSource)
+	adminAccessTokenSource AdminAccessTokenSource
+
+	// corporalUserAccessToken (if set) is the access token that the matrix-corporal user's requests are made with (see SetCorporalUserAccessToken)
+	corporalUserAccessToken string
+}
+
+// AdminAccessTokenSource provides access tokens for calling the Synapse admin APIs (see SynapseConnector.SetAdminAccessTokenSource)
+type AdminAccessTokenSource interface {
+	GetAccessToken() (string, error)
 }
 
 func NewSynapseConnector(
@@ -43,6 +66,8 @@ func NewSynapseConnector(
 		corporalUserID:           corporalUserID,
 
 		corporalUserIDLock: &sync.Mutex{},
+
+		stateDeterminationWorkers: 1,
 	}
 
 	// This is a special access token context that we only use for the matrix-corporal user.
@@ -55,10 +80,40 @@ func NewSynapseConnector(
 		// We release it manually from `Release()`.
 		0,
 	)
+	me.corporalUserAccessTokenContext.SetAccessTokenStore(me.accessTokenStore)
+
+	// Read-only contexts (used for dry runs) can't act as users, so we read users' things via admin APIs instead (see adminReader)
+	apiConnector.adminReader = me
 
 	return me
 }
 
+// SetStateDeterminationWorkers makes DetermineCurrentState determine the state of this many users at the same time
+func (me *SynapseConnector) SetStateDeterminationWorkers(workers int) {
+	me.stateDeterminationWorkers = workers
+}
+
+// SetAdminAccessTokenSource makes the admin APIs get called with access tokens from the given source (e.g. a ClientCredentialsTokenSource),
+// instead of with the matrix-corporal user's access token.
+//
+// Such tokens (e.g. ones issued by matrix-authentication-service for MSC3861 deployments) don't belong to the matrix-corporal user,
+// so admin APIs which act as the requester (like force-joining users to rooms that only the matrix-corporal user could invite to) may not work.
+// This is to be called before any requests are made.
+func (me *SynapseConnector) SetAdminAccessTokenSource(adminAccessTokenSource AdminAccessTokenSource) {
+	me.adminAccessTokenSource = adminAccessTokenSource
+}
+
+// SetCorporalUserAccessToken makes the matrix-corporal user's requests be made with the given (long-lived) access token,
+// instead of with one obtained by logging in as it (which relies on shared-secret-auth, unless acting as an application service).
+//
+// Together with the admin login API (used for everyone else, see ObtainNewAccessTokenForUserId) and IssueLoginToken,
+// this lets matrix-corporal work without shared-secret-auth.
+// The token is never destroyed by us (see DestroyAccessToken).
+// This is to be called before any requests are made.
+func (me *SynapseConnector) SetCorporalUserAccessToken(corporalUserAccessToken string) {
+	me.corporalUserAccessToken = corporalUserAccessToken
+}
+
 // ObtainNewAccessTokenForUserId is a reimplementation of ApiConnector.ObtainNewAccessTokenForUserId.
 //
 // ApiConnector.ObtainNewAccessTokenForUserId uses the regular `/_matrix/client/r0/login` endpoint
@@ -70,6 +125,12 @@ func NewSynapseConnector(
 // Not creating devices leads to better performance and UX (no need to notify others via federation; the user's device list does not get poluted).
 // This is Synapse-specific though.
 func (me *SynapseConnector) ObtainNewAccessTokenForUserId(userId, deviceId string, validUntil *time.Time) (string, error) {
+	if userId == me.corporalUserID && me.corporalUserAccessToken != "" {
+		// We can't log in as the matrix-corporal user (see SetCorporalUserAccessToken), so the configured token is all we can give out.
+		// DestroyAccessToken spares it, so our own cleanup doesn't break it.
+		return me.corporalUserAccessToken, nil
+	}
+
 	if userId == me.corporalUserID {
 		// Someone explicitly requested a token for the matrix-corporal user.
 		// If we try to proceed below (using the Admin user login API to log in as matrix-corporal),
@@ -87,17 +148,7 @@ func (me *SynapseConnector) ObtainNewAccessTokenForUserId(userId, deviceId strin
 		return me.ApiConnector.ObtainNewAccessTokenForUserId(userId, deviceId, validUntil)
 	}
 
-	corporalUserAccessToken, err := me.getAccessTokenForCorporalUser()
-	if err != nil {
-		return "", fmt.Errorf(
-			"could not obtain access token for `%s`, necessary for obtaining a token for `%s`: %s",
-			me.corporalUserID,
-			userId,
-			err,
-		)
-	}
-
-	client, err := me.createMatrixClientForUserIdAndToken(me.corporalUserID, corporalUserAccessToken)
+	client, err := me.createAdminClient(userId, "obtaining a token for")
 	if err != nil {
 		return "", err
 	}
@@ -121,151 +172,952 @@ func (me *SynapseConnector) ObtainNewAccessTokenForUserId(userId, deviceId strin
 	return response.AccessToken, nil
 }
 
+// DestroyAccessToken is a reimplementation of ApiConnector.DestroyAccessToken,
+// which leaves the matrix-corporal user's configured access token (see SetCorporalUserAccessToken) alone.
+func (me *SynapseConnector) DestroyAccessToken(userId, accessToken string) error {
+	if me.corporalUserAccessToken != "" && accessToken == me.corporalUserAccessToken {
+		return nil
+	}
+
+	return me.ApiConnector.DestroyAccessToken(userId, accessToken)
+}
+
+// IssueLoginToken obtains a short-lived `m.login.token` login token, with which the given user can log in (getting a new device),
+// without knowing (or having) a password (see interceptor.LoginInterceptor.SetLoginTokenIssuer).
+//
+// The token gets requested via the `POST /_matrix/client/v1/login/get_token` API (MSC3882),
+// with a short-lived access token obtained via the admin login API (see ObtainNewAccessTokenForUserId).
+// Synapse needs to have `login_via_existing_session` enabled (with `require_ui_auth` disabled) for this to work.
+func (me *SynapseConnector) IssueLoginToken(userId string) (string, error) {
+	validUntil := time.Now().Add(loginTokenIssuingAccessTokenValidity)
+
+	accessToken, err := me.ObtainNewAccessTokenForUserId(userId, "", &validUntil)
+	if err != nil {
+		return "", fmt.Errorf("could not obtain access token for `%s`, necessary for issuing a login token: %s", userId, err)
+	}
+
+	client, err := me.createMatrixClientForUserIdAndToken(userId, accessToken)
+	if err != nil {
+		return "", err
+	}
+
+	// The access token is not destroyed afterwards, as it expires soon anyway.
+	var response matrix.ApiLoginTokenResponse
+	err = client.MakeRequest(
+		"POST",
+		buildPrefixlessURL(client, "/_matrix/client/v1/login/get_token", map[string]string{}),
+		map[string]interface{}{},
+		&response,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if response.LoginToken == "" {
+		return "", fmt.Errorf("no login token was provided for `%s`", userId)
+	}
+
+	return response.LoginToken, nil
+}
+
 func (me *SynapseConnector) DetermineCurrentState(
 	ctx *AccessTokenContext,
 	managedUserIds []string,
 	adminUserId string,
 ) (*CurrentState, error) {
-	client, err := me.createMatrixClientForUserId(ctx, adminUserId)
+	client, err := me.createUsersListingClient(ctx, adminUserId)
 	if err != nil {
 		return nil, err
 	}
 
-	// The `/_synapse/admin/v2/users` API lets us use the `user_id` parameter
-	// to query for individual users.
+	// Instead of asking about each managed user individually (whether their account exists, is deactivated, etc.),
+	// we list all users (page by page) and look managed users up in there.
 	//
-	// Instead of looping through all users on the server (potentially millions?),
-	// we could loop over the managedUserIds, and fetch the state for them,
-	// instead of fetching all users (like we do below).
+	// On a server with millions of unmanaged users and a small subset of managed users,
+	// it'd be more beneficial to do it selectively.
 	//
-	// On a server with millions of unmanaged users and a subset of managed users,
-	// it's more beneficial to do it selectively.
+	// On a server where pretty much all users are managed users and there are lots of them (the more common case),
+	// this saves us from doing a round-trip for each one.
 	//
-	// On a server where pretty much all users are managed users and there are lots of them,
-	// it's better to avoid doing an individual query for each managed
+	// Only managed users are kept around, so even going through a large server's users doesn't take much memory.
+	managedUserIdsMap := make(map[string]bool, len(managedUserIds))
+	for _, userId := range managedUserIds {
+		managedUserIdsMap[userId] = true
+	}
 
-	url := buildPrefixlessURL(client, "/_synapse/admin/v2/users", map[string]string{
-		// We don't support pagination yet
-		"limit":       "100000000000",
+	currentUsers := make(map[string]matrix.ApiAdminEntityUser, len(managedUserIds))
+	err = me.forEachUser(client, map[string]string{
 		"guests":      "false",
 		"deactivated": "true",
+	}, func(user matrix.ApiAdminEntityUser) error {
+		if managedUserIdsMap[user.Id] {
+			currentUsers[user.Id] = user
+		}
+		return nil
 	})
-
-	var response matrix.ApiAdminResponseUsers
-	err = client.MakeRequest("GET", url, nil, &response)
 	if err != nil {
 		return nil, err
 	}
 
-	var currentUserIds []string
-	for _, user := range response.Users {
-		currentUserIds = append(currentUserIds, user.Id)
-	}
-
-	var usersState []CurrentUserState
-
+	var existingManagedUserIds []string
+	var serverDeactivatedUsersState []CurrentUserState
 	for _, userId := range managedUserIds {
-		if !util.IsStringInArray(userId, currentUserIds) {
+		user, exists := currentUsers[userId]
+		if !exists {
 			// Avoid trying to fetch the state for a user that doesn't exist.
 			// We'll get authentication errors.
 			// And it's not like there could be any state anyway, so.. skip it.
 			continue
 		}
 
-		userState, err := me.getUserStateByUserId(ctx, userId)
+		if user.Deactivated {
+			// We can't obtain access tokens for deactivated users (and there's no state worth fetching anyway).
+			serverDeactivatedUsersState = append(serverDeactivatedUsersState, CurrentUserState{
+				Id:                userId,
+				Active:            false,
+				ServerDeactivated: true,
+			})
+			continue
+		}
+
+		existingManagedUserIds = append(existingManagedUserIds, userId)
+	}
+
+	usersState := make([]CurrentUserState, len(existingManagedUserIds))
+	err = forEachInParallel(me.stateDeterminationWorkers, len(existingManagedUserIds), func(index int) error {
+		user := currentUsers[existingManagedUserIds[index]]
+
+		// The users list already contains everyone's profile, so there's no need to fetch it again for each user.
+		// Having it, the computator can tell which display names and avatars are already as they should be.
+		userProfile := &matrix.ApiUserProfileResponse{
+			DisplayName: user.DisplayName,
+			AvatarUrl:   user.AvatarURL,
+		}
+
+		joinedRoomIds, err := me.DetermineUserJoinedRoomIds(ctx, user.Id)
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		userState, err := me.getUserStateByUserId(ctx, user.Id, userProfile, joinedRoomIds)
+		if err != nil {
+			return err
+		}
+		userState.ServerAdmin = user.Admin
+		if user.UserType != nil {
+			userState.UserType = *user.UserType
 		}
-		usersState = append(usersState, *userState)
+		userState.ShadowBanned = user.ShadowBanned
+		userState.CreatedAt = user.CreationTs
+		usersState[index] = *userState
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	connectorState := &CurrentState{
-		Users: usersState,
+		Users: append(usersState, serverDeactivatedUsersState...),
 	}
 
 	return connectorState, nil
 }
 
-func (me *SynapseConnector) EnsureUserAccountExists(userId, password string) error {
-	userIdLocalPart, err := gomatrix.ExtractUserLocalpart(userId)
+// DetermineUnmanagedUsers returns the active accounts (including guest ones), which are not among the given (known) users.
+// It talks to the homeserver once per page of users and once per unmanaged (non-guest) user.
+func (me *SynapseConnector) DetermineUnmanagedUsers(
+	ctx *AccessTokenContext,
+	knownUserIds []string,
+	adminUserId string,
+) ([]CurrentUnmanagedUserState, error) {
+	client, err := me.createUsersListingClient(ctx, adminUserId)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	knownUserIdsMap := make(map[string]bool, len(knownUserIds))
+	for _, userId := range knownUserIds {
+		knownUserIdsMap[userId] = true
 	}
 
-	client, _ := gomatrix.NewClient(me.homeserverApiEndpoint, "", "")
+	unmanagedUsers := make([]CurrentUnmanagedUserState, 0)
+	err = me.forEachUser(client, map[string]string{
+		"guests":      "true",
+		"deactivated": "false",
+	}, func(user matrix.ApiAdminEntityUser) error {
+		if knownUserIdsMap[user.Id] || user.Deactivated {
+			return nil
+		}
+
+		unmanagedUser := CurrentUnmanagedUserState{
+			Id:          user.Id,
+			Guest:       user.Guest,
+			CreatedAt:   user.CreationTs,
+			ServerAdmin: user.Admin,
+		}
+		if user.UserType != nil {
+			unmanagedUser.UserType = *user.UserType
+		}
+
+		unmanagedUsers = append(unmanagedUsers, unmanagedUser)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	var nonceResponse matrix.ApiUserAccountRegisterNonceResponse
-	err = matrix.ExecuteWithRateLimitRetries(me.logger, "user.register.nonce", func() error {
-		return client.MakeRequest(
+	// Users list entries don't say which application service (if any) registered the user, so we need to ask for each user.
+	// Guests cannot be application service users, so there's no need to ask for them.
+	for idx, unmanagedUser := range unmanagedUsers {
+		if unmanagedUser.Guest {
+			continue
+		}
+
+		var userResponse matrix.ApiAdminResponseUser
+		err = client.MakeRequest(
 			"GET",
-			buildPrefixlessURL(client, "/_synapse/admin/v1/register", map[string]string{}),
+			buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v2/users/%s", unmanagedUser.Id), map[string]string{}),
 			nil,
-			&nonceResponse,
+			&userResponse,
 		)
+		if err != nil {
+			return nil, fmt.Errorf("failed fetching the details of %s: %s", unmanagedUser.Id, err)
+		}
+
+		if userResponse.AppServiceId != nil {
+			unmanagedUsers[idx].AppServiceId = *userResponse.AppServiceId
+		}
+	}
+
+	return unmanagedUsers, nil
+}
+
+// createUsersListingClient creates a client for listing users (see forEachUser) as the given admin user.
+// When reading as an admin (see isReadingAsAdmin), no access token can be obtained for that user, so the admin client is used instead.
+func (me *SynapseConnector) createUsersListingClient(ctx *AccessTokenContext, adminUserId string) (*gomatrix.Client, error) {
+	if me.isReadingAsAdmin(ctx) {
+		return me.createAdminClient(adminUserId, "listing users as")
+	}
+	return me.createMatrixClientForUserId(ctx, adminUserId)
+}
+
+// forEachUser calls the callback for each user matching the given filters (query parameters), going through the users list page by page.
+// Only one page is held in memory at a time, so this works for servers with lots of users too.
+// Once the callback fails, iteration stops and its error is returned.
+func (me *SynapseConnector) forEachUser(
+	client *gomatrix.Client,
+	filters map[string]string,
+	callback func(user matrix.ApiAdminEntityUser) error,
+) error {
+	listedCount := 0
+
+	from := "0"
+	for {
+		queryParams := map[string]string{
+			"from":  from,
+			"limit": fmt.Sprintf("%d", adminUsersListPageSize),
+		}
+		for key, value := range filters {
+			queryParams[key] = value
+		}
+
+		var response matrix.ApiAdminResponseUsers
+		err := client.MakeRequest("GET", buildPrefixlessURL(client, "/_synapse/admin/v2/users", queryParams), nil, &response)
+		if err != nil {
+			return fmt.Errorf("failed listing users (from %s): %s", from, err)
+		}
+
+		for _, user := range response.Users {
+			err = callback(user)
+			if err != nil {
+				return err
+			}
+		}
+
+		listedCount += len(response.Users)
+		me.logger.Debugf("Listed %d/%d users", listedCount, response.Total)
+
+		if response.NextToken == "" {
+			return nil
+		}
+		from = response.NextToken
+	}
+}
+
+// EnsureUserAccountExists creates the given user's account (unless it exists already), using the Synapse Shared-Secret Registration API.
+func (me *SynapseConnector) EnsureUserAccountExists(userId, password, userType string) error {
+	return me.registerUserAccount(me.registrationSharedSecret, userId, password, userType)
+}
+
+// AddThreePid associates a 3pid with the given user's account, using the Synapse User Admin API.
+//
+// Unlike the Client-Server API, the admin API doesn't require the 3pid to go through validation.
+func (me *SynapseConnector) AddThreePid(ctx *AccessTokenContext, userId string, medium string, address string) error {
+	return me.updateThreePids(userId, "user.add_3pid", func(threePids []matrix.ApiThreePid) ([]matrix.ApiThreePid, bool) {
+		for _, threePid := range threePids {
+			if threePid.Medium == medium && threePid.Address == address {
+				// Already there. Nothing to do.
+				return nil, false
+			}
+		}
+
+		return append(threePids, matrix.ApiThreePid{
+			Medium:  medium,
+			Address: address,
+		}), true
 	})
+}
+
+// RemoveThreePid dissociates a 3pid from the given user's account, using the Synapse User Admin API.
+//
+// Unlike the Client-Server API, this works for any user, including ones that we can't obtain access tokens for.
+func (me *SynapseConnector) RemoveThreePid(ctx *AccessTokenContext, userId string, medium string, address string) error {
+	return me.updateThreePids(userId, "user.remove_3pid", func(threePids []matrix.ApiThreePid) ([]matrix.ApiThreePid, bool) {
+		remainingThreePids := make([]matrix.ApiThreePid, 0, len(threePids))
+		for _, threePid := range threePids {
+			if threePid.Medium == medium && threePid.Address == address {
+				continue
+			}
+			remainingThreePids = append(remainingThreePids, threePid)
+		}
+
+		// If it's not there, there's nothing to do
+		return remainingThreePids, len(remainingThreePids) != len(threePids)
+	})
+}
+
+// updateThreePids replaces the given user's 3pids with what the update function makes of them (if it reports changes).
+// The admin API only lets us replace all of the user's 3pids at once, so we need to read them first.
+func (me *SynapseConnector) updateThreePids(
+	userId string,
+	operationName string,
+	update func(threePids []matrix.ApiThreePid) ([]matrix.ApiThreePid, bool),
+) error {
+	client, err := me.createAdminClient(userId, "changing the 3pids of")
 	if err != nil {
 		return err
 	}
 
-	// Generating the HMAC the same way that the `register_new_matrix_user` script from Matrix Synapse does it.
-	mac := hmac.New(sha1.New, []byte(me.registrationSharedSecret))
-	mac.Write([]byte(nonceResponse.Nonce))
-	mac.Write([]byte("\x00"))
-	mac.Write([]byte(userIdLocalPart))
-	mac.Write([]byte("\x00"))
-	mac.Write([]byte(password))
-	mac.Write([]byte("\x00"))
-	mac.Write([]byte("notadmin"))
-
-	payload := matrix.ApiUserAccountRegisterRequestPayload{
-		Nonce:    nonceResponse.Nonce,
-		Username: userIdLocalPart,
-		Password: password,
-		Mac:      fmt.Sprintf("%x", mac.Sum(nil)),
-		Type:     matrix.RegistrationTypeSharedSecret,
-		Admin:    false,
-	}
-
-	var registerResponse matrix.ApiUserAccountRegisterResponse
-
-	err = matrix.ExecuteWithRateLimitRetries(me.logger, "user.register.actual", func() error {
-		// The canonical admin/register API is available at `/_synapse/admin/v1/register`.
-		// What we hit below is an alias, which might stop working some time in the future.
-		// See above for why we can't easily use it.
-		return client.MakeRequest(
-			"POST",
-			buildPrefixlessURL(client, "/_synapse/admin/v1/register", map[string]string{}),
-			payload,
-			&registerResponse,
-		)
-	})
+	url := buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v2/users/%s", userId), map[string]string{})
 
+	var userResponse matrix.ApiAdminResponseUser
+	err = client.MakeRequest("GET", url, nil, &userResponse)
 	if err != nil {
-		// Swallow "user already exists" errors.
-		// We don't care who created it and when. We only care that it exists.
-		if matrix.IsErrorWithCode(err, matrix.ErrorUserInUse) {
-			return nil
+		return err
+	}
+
+	threePids, changed := update(userResponse.ThreePids)
+	if !changed {
+		return nil
+	}
+
+	return client.MakeRequest("PUT", url, matrix.ApiAdminRequestUserThreePids{ThreePids: threePids}, nil)
+}
+
+// getUserThreePidsAsAdmin fetches the given user's 3pids, using the Synapse User Admin API (see adminReader)
+func (me *SynapseConnector) getUserThreePidsAsAdmin(userId string) ([]CurrentUserThreePid, error) {
+	client, err := me.createAdminClient(userId, "determining the 3pids of")
+	if err != nil {
+		return nil, err
+	}
+
+	var userResponse matrix.ApiAdminResponseUser
+	err = client.MakeRequest(
+		"GET",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v2/users/%s", userId), map[string]string{}),
+		nil,
+		&userResponse,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching 3pids of %s: %s", userId, err)
+	}
+
+	threePids := make([]CurrentUserThreePid, 0, len(userResponse.ThreePids))
+	for _, threePid := range userResponse.ThreePids {
+		threePids = append(threePids, CurrentUserThreePid{
+			Medium:  threePid.Medium,
+			Address: threePid.Address,
+		})
+	}
+
+	return threePids, nil
+}
+
+// getUserAccountDataAsAdmin returns the account data of the given type (global, or for the given room) for the user,
+// using the Synapse User Admin API (see adminReader). Like with GetUserAccountData, account data which doesn't exist is returned as an empty map.
+//
+// The API only hands out all of the user's account data at once.
+func (me *SynapseConnector) getUserAccountDataAsAdmin(userId string, roomId string, accountDataType string) (map[string]interface{}, error) {
+	client, err := me.createAdminClient(userId, "determining the account data of")
+	if err != nil {
+		return nil, err
+	}
+
+	var response matrix.ApiAdminResponseUserAccountData
+	err = client.MakeRequest(
+		"GET",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/users/%s/accountdata", userId), map[string]string{}),
+		nil,
+		&response,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching account data of %s: %s", userId, err)
+	}
+
+	accountDataByType := response.AccountData.Global
+	if roomId != "" {
+		accountDataByType = response.AccountData.Rooms[roomId]
+	}
+
+	content, exists := accountDataByType[accountDataType]
+	if !exists || content == nil {
+		return map[string]interface{}{}, nil
+	}
+
+	return content, nil
+}
+
+// SendServerNotice delivers a server notice to the given user, using the Synapse Server Notices admin API.
+//
+// The transaction id is derived from the notice id and the user id,
+// so retrying a delivery (e.g. if we fail to record it as delivered) should not lead to duplicate messages.
+// Notices without an id are not recorded as delivered.
+func (me *SynapseConnector) SendServerNotice(ctx *AccessTokenContext, userId string, noticeId string, message string) error {
+	client, err := me.createAdminClient(userId, "sending a server notice to")
+	if err != nil {
+		return err
+	}
+
+	txnId := util.Sha512(fmt.Sprintf("%s\x00%s", noticeId, userId))[:32]
+	if noticeId == "" {
+		randomBytes, err := util.GenerateRandomBytes(16)
+		if err != nil {
+			return err
 		}
+		txnId = fmt.Sprintf("%x", randomBytes)
+	}
+
+	payload := matrix.ApiAdminRequestSendServerNotice{
+		UserId: userId,
+		Content: matrix.ApiAdminServerNoticeContent{
+			MsgType: "m.text",
+			Body:    message,
+		},
+	}
+
+	err = client.MakeRequest(
+		"PUT",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/send_server_notice/%s", txnId), map[string]string{}),
+		payload,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	if noticeId == "" {
+		return nil
+	}
 
+	return me.markServerNoticeAsDeliveredToUser(ctx, userId, noticeId)
+}
+
+// DeactivateUserAccount deactivates the given user's account, using the Synapse User Admin API.
+// With erase, the user's messages get hidden from new room members (GDPR erasure) and their profile gets cleared too.
+//
+// Unlike marking users as deactivated (see matrix.IsUserDeactivatedAccordingToDisplayName), this cannot be undone by us.
+func (me *SynapseConnector) DeactivateUserAccount(ctx *AccessTokenContext, userId string, erase bool) error {
+	client, err := me.createAdminClient(userId, "deactivating")
+	if err != nil {
 		return err
 	}
 
-	// The register API creates an access token automatically.
-	// We don't need it and we'd rather be nice and get rid of it, to keep things clean.
-	clientForUser, _ := gomatrix.NewClient(me.homeserverApiEndpoint, userIdLocalPart, registerResponse.AccessToken)
-	_, err = clientForUser.Logout()
+	err = client.MakeRequest(
+		"POST",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/deactivate/%s", userId), map[string]string{}),
+		matrix.ApiAdminRequestDeactivateUser{Erase: erase},
+		nil,
+	)
 	if err != nil {
-		me.logger.Warnf("failed logging out user %s: %s", userIdLocalPart, err)
+		return err
 	}
 
+	// Deactivation invalidates all of the user's access tokens, including any that the context may be holding on to.
+	ctx.ClearAccessTokenForUserId(userId)
+
 	return nil
 }
 
+// SetUserServerAdmin grants (or revokes) homeserver administrator rights to the given user, using the Synapse User Admin API.
+func (me *SynapseConnector) SetUserServerAdmin(ctx *AccessTokenContext, userId string, admin bool) error {
+	client, err := me.createAdminClient(userId, "changing the admin status of")
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/users/%s/admin", userId), map[string]string{}),
+		matrix.ApiAdminRequestUserAdmin{Admin: admin},
+		nil,
+	)
+}
+
+// SetUserType changes the given user's type (e.g. to `bot`, with an empty one meaning a regular user), using the Synapse User Admin API.
+func (me *SynapseConnector) SetUserType(ctx *AccessTokenContext, userId string, userType string) error {
+	client, err := me.createAdminClient(userId, "changing the user type of")
+	if err != nil {
+		return err
+	}
+
+	payload := matrix.ApiAdminRequestUserType{}
+	if userType != "" {
+		payload.UserType = &userType
+	}
+
+	return client.MakeRequest(
+		"PUT",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v2/users/%s", userId), map[string]string{}),
+		payload,
+		nil,
+	)
+}
+
+// SetUserShadowBanned shadow-bans (or un-shadow-bans) the given user, using the Synapse User Admin API.
+func (me *SynapseConnector) SetUserShadowBanned(ctx *AccessTokenContext, userId string, shadowBanned bool) error {
+	client, err := me.createAdminClient(userId, "changing the shadow-ban status of")
+	if err != nil {
+		return err
+	}
+
+	method := "DELETE"
+	if shadowBanned {
+		method = "POST"
+	}
+
+	return client.MakeRequest(
+		method,
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/users/%s/shadow_ban", userId), map[string]string{}),
+		map[string]interface{}{},
+		nil,
+	)
+}
+
+// ForceJoinRoom makes the user join the given room (or room alias), using the Synapse Room Membership Admin API.
+// The user doesn't need to be invited, but the corporal user needs to be in the room (and be able to invite) for rooms which are not public.
+func (me *SynapseConnector) ForceJoinRoom(ctx *AccessTokenContext, userId string, roomIdOrAlias string) error {
+	client, err := me.createAdminClient(userId, "joining a room for")
+	if err != nil {
+		return err
+	}
+
+	defer ctx.invalidateRoomState(roomIdOrAlias)
+
+	// This request is idempotent.
+	return client.MakeRequest(
+		"POST",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/join/%s", roomIdOrAlias), map[string]string{}),
+		matrix.ApiAdminRequestJoinRoom{UserId: userId},
+		nil,
+	)
+}
+
+// DetermineCurrentDevices returns the devices of the given user, using the Synapse User Admin API.
+// Unlike the Client-Server API, this doesn't require obtaining an access token (a new device) for the user.
+func (me *SynapseConnector) DetermineCurrentDevices(ctx *AccessTokenContext, userId string) ([]CurrentUserDevice, error) {
+	client, err := me.createAdminClient(userId, "determining the devices of")
+	if err != nil {
+		return nil, err
+	}
+
+	var response matrix.ApiDevicesResponse
+	err = client.MakeRequest(
+		"GET",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v2/users/%s/devices", userId), map[string]string{}),
+		nil,
+		&response,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return convertApiDevices(response.Devices), nil
+}
+
+// DeleteDevices deletes the given devices of the user (logging them out), using the Synapse User Admin API
+func (me *SynapseConnector) DeleteDevices(ctx *AccessTokenContext, userId string, deviceIds []string) error {
+	client, err := me.createAdminClient(userId, "deleting the devices of")
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest(
+		"POST",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v2/users/%s/delete_devices", userId), map[string]string{}),
+		matrix.ApiAdminRequestDeleteDevices{Devices: deviceIds},
+		nil,
+	)
+}
+
+// DeleteUserMedia deletes all media uploaded by the given user, using the Synapse User Admin API.
+// Media gets deleted in chunks, until there's none left.
+func (me *SynapseConnector) DeleteUserMedia(ctx *AccessTokenContext, userId string) error {
+	client, err := me.createAdminClient(userId, "deleting the media of")
+	if err != nil {
+		return err
+	}
+
+	url := buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/users/%s/media", userId), map[string]string{
+		"limit": "100",
+	})
+
+	for {
+		var response matrix.ApiAdminResponseDeleteUserMedia
+		err = client.MakeRequest("DELETE", url, nil, &response)
+		if err != nil {
+			return err
+		}
+
+		if len(response.DeletedMedia) == 0 {
+			return nil
+		}
+	}
+}
+
+// QuarantineMedia quarantines the given media (`mxc://{serverName}/{mediaId}`), using the Synapse Media Admin API.
+// Quarantined media can no longer be downloaded (and remote media doesn't get fetched again). Quarantining is idempotent.
+func (me *SynapseConnector) QuarantineMedia(serverName string, mediaId string) error {
+	return me.setMediaQuarantined(serverName, mediaId, "quarantine", "quarantining")
+}
+
+// UnquarantineMedia makes the given (quarantined) media available again, using the Synapse Media Admin API
+func (me *SynapseConnector) UnquarantineMedia(serverName string, mediaId string) error {
+	return me.setMediaQuarantined(serverName, mediaId, "unquarantine", "unquarantining")
+}
+
+func (me *SynapseConnector) setMediaQuarantined(serverName string, mediaId string, operation string, purpose string) error {
+	mxcUri := fmt.Sprintf("mxc://%s/%s", serverName, mediaId)
+
+	client, err := me.createAdminClient(mxcUri, purpose)
+	if err != nil {
+		return err
+	}
+
+	return client.MakeRequest(
+		"POST",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/media/%s/%s/%s", operation, serverName, mediaId), map[string]string{}),
+		map[string]interface{}{},
+		nil,
+	)
+}
+
+// QuarantineRoomMedia quarantines all media sent to the given room (local and remote), using the Synapse Media Admin API.
+// It returns how many media items got quarantined.
+func (me *SynapseConnector) QuarantineRoomMedia(roomId string) (int, error) {
+	return me.quarantineMediaInBulk(roomId, fmt.Sprintf("/_synapse/admin/v1/room/%s/media/quarantine", roomId))
+}
+
+// QuarantineUserMedia quarantines all media uploaded by the given (local) user, using the Synapse Media Admin API.
+// It returns how many media items got quarantined.
+func (me *SynapseConnector) QuarantineUserMedia(userId string) (int, error) {
+	return me.quarantineMediaInBulk(userId, fmt.Sprintf("/_synapse/admin/v1/user/%s/media/quarantine", userId))
+}
+
+func (me *SynapseConnector) quarantineMediaInBulk(id string, path string) (int, error) {
+	client, err := me.createAdminClient(id, "quarantining the media of")
+	if err != nil {
+		return 0, err
+	}
+
+	var response matrix.ApiAdminResponseQuarantineMedia
+	err = client.MakeRequest("POST", buildPrefixlessURL(client, path, map[string]string{}), map[string]interface{}{}, &response)
+	if err != nil {
+		return 0, err
+	}
+
+	return response.NumQuarantined, nil
+}
+
+// DeleteRoom deletes the given room, using the Synapse Admin API (v2).
+// Local users get kicked out of it, its local aliases get deleted and its history gets purged from the database.
+//
+// Deletion happens in the background, so we wait (polling its status) for it to complete, for up to roomDeletionMaxWait.
+// If deleting the room is already in progress (e.g. having been started by a previous reconciliation run), we wait for that instead of starting anew.
+func (me *SynapseConnector) DeleteRoom(ctx *AccessTokenContext, roomId string) error {
+	client, err := me.createAdminClient(roomId, "deleting")
+	if err != nil {
+		return err
+	}
+
+	deleteId, err := me.findRoomDeletionInProgress(client, roomId)
+	if err != nil {
+		return err
+	}
+
+	if deleteId == "" {
+		var response matrix.ApiAdminResponseDeleteRoom
+		err = client.MakeRequest(
+			"DELETE",
+			buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v2/rooms/%s", roomId), map[string]string{}),
+			matrix.ApiAdminRequestDeleteRoom{Purge: true},
+			&response,
+		)
+		if err != nil {
+			return err
+		}
+		deleteId = response.DeleteId
+	} else {
+		me.logger.Infof("Deleting room %s is already in progress (%s), waiting for it to complete", roomId, deleteId)
+	}
+
+	waitUntil := time.Now().Add(roomDeletionMaxWait)
+	for {
+		var status matrix.ApiAdminRoomDeletionStatus
+		err = client.MakeRequest(
+			"GET",
+			buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v2/rooms/delete_status/%s", deleteId), map[string]string{}),
+			nil,
+			&status,
+		)
+		if err != nil {
+			return fmt.Errorf("failed determining the status of deleting (%s): %s", deleteId, err)
+		}
+
+		switch status.Status {
+		case matrix.RoomDeletionStatusComplete:
+			return nil
+		case matrix.RoomDeletionStatusFailed:
+			return fmt.Errorf("deleting (%s) failed: %s", deleteId, status.Error)
+		}
+
+		if time.Now().After(waitUntil) {
+			return fmt.Errorf("deleting (%s) is still in progress (%s) after %s", deleteId, status.Status, roomDeletionMaxWait)
+		}
+
+		time.Sleep(roomDeletionPollInterval)
+	}
+}
+
+// findRoomDeletionInProgress returns the id of the deletion of the given room, which is in progress (if any)
+func (me *SynapseConnector) findRoomDeletionInProgress(client *gomatrix.Client, roomId string) (string, error) {
+	var response matrix.ApiAdminResponseRoomDeletionStatuses
+	err := client.MakeRequest(
+		"GET",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v2/rooms/%s/delete_status", roomId), map[string]string{}),
+		nil,
+		&response,
+	)
+	if err != nil {
+		if matrix.IsErrorWithCode(err, matrix.ErrorNotFound) {
+			// No deletions of this room are known about
+			return "", nil
+		}
+		return "", fmt.Errorf("failed determining whether deleting is in progress already: %s", err)
+	}
+
+	for _, status := range response.Results {
+		if status.Status == matrix.RoomDeletionStatusScheduled || status.Status == matrix.RoomDeletionStatusActive {
+			return status.DeleteId, nil
+		}
+	}
+
+	return "", nil
+}
+
+// createAdminClient creates a client for the matrix-corporal user, for doing something (described by purpose) to the given user via admin APIs
+// DetermineCurrentRoomState fetches the given (empty state key) state events for a room, using the Synapse Room Admin API (see getRoomState)
+func (me *SynapseConnector) DetermineCurrentRoomState(
+	ctx *AccessTokenContext,
+	roomId string,
+	stateEventTypes []string,
+	actingUserId string,
+) (*CurrentRoomState, error) {
+	events, err := me.getRoomState(ctx, roomId, actingUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	roomState := &CurrentRoomState{
+		Id:                 roomId,
+		StateEventContents: map[string]map[string]interface{}{},
+	}
+
+	for _, event := range events {
+		if event.StateKey == nil || *event.StateKey != "" || !util.IsStringInArray(event.Type, stateEventTypes) {
+			continue
+		}
+		roomState.StateEventContents[event.Type] = event.Content
+	}
+
+	return roomState, nil
+}
+
+// DetermineCurrentRoomMembers fetches the users who are joined to (or invited to) a room, using the Synapse Room Admin API (see getRoomState)
+func (me *SynapseConnector) DetermineCurrentRoomMembers(
+	ctx *AccessTokenContext,
+	roomId string,
+	actingUserId string,
+) (map[string]string, error) {
+	events, err := me.getRoomState(ctx, roomId, actingUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[string]string{}
+	for userId, membership := range determineMemberships(events) {
+		if membership == "join" || membership == "invite" {
+			members[userId] = membership
+		}
+	}
+
+	return members, nil
+}
+
+// DetermineUserJoinedRoomIds fetches the ids of all rooms the given user is joined to, using the Synapse User Admin API.
+// Unlike the Client-Server API, this doesn't require obtaining an access token for the user.
+func (me *SynapseConnector) DetermineUserJoinedRoomIds(ctx *AccessTokenContext, userId string) ([]string, error) {
+	client, err := me.createAdminClient(userId, "determining the joined rooms of")
+	if err != nil {
+		return nil, err
+	}
+
+	var response matrix.ApiAdminResponseUserJoinedRooms
+	err = client.MakeRequest(
+		"GET",
+		buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/users/%s/joined_rooms", userId), map[string]string{}),
+		nil,
+		&response,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching joined rooms of %s: %s", userId, err)
+	}
+
+	if response.JoinedRooms == nil {
+		// Telling "not joined to any rooms" apart from "not known" (see getUserStateByUserId)
+		return []string{}, nil
+	}
+
+	return response.JoinedRooms, nil
+}
+
+// DetermineCurrentKeyedRoomState fetches all (not removed) state events of the given types for a room,
+// using the Synapse Room Admin API (see getRoomState)
+func (me *SynapseConnector) DetermineCurrentKeyedRoomState(
+	ctx *AccessTokenContext,
+	roomId string,
+	stateEventTypes []string,
+	actingUserId string,
+) (map[string]map[string]map[string]interface{}, error) {
+	events, err := me.getRoomState(ctx, roomId, actingUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := map[string]map[string]map[string]interface{}{}
+	for _, eventType := range stateEventTypes {
+		contents[eventType] = map[string]map[string]interface{}{}
+	}
+
+	for _, event := range events {
+		if event.StateKey == nil || len(event.Content) == 0 {
+			continue
+		}
+
+		contentsByStateKey, exists := contents[event.Type]
+		if !exists {
+			continue
+		}
+		contentsByStateKey[*event.StateKey] = event.Content
+	}
+
+	return contents, nil
+}
+
+// getRoomState returns all current state events of the given room, using the Synapse Room Admin API.
+// They're cached (see AccessTokenContext.SetRoomStateCache), so that determining different parts of a room's state fetches it once.
+//
+// The admin API lets us see into any room, but the acting user is the one who'd be changing the room afterwards,
+// so (like with the Client-Server API) the room is considered not visible unless they're joined to it.
+func (me *SynapseConnector) getRoomState(ctx *AccessTokenContext, roomId string, actingUserId string) ([]gomatrix.Event, error) {
+	events, err := ctx.getRoomState(roomId, func() ([]gomatrix.Event, error) {
+		client, err := me.createAdminClient(roomId, "determining the state of")
+		if err != nil {
+			return nil, err
+		}
+
+		var response struct {
+			State []gomatrix.Event `json:"state"`
+		}
+		err = client.MakeRequest(
+			"GET",
+			buildPrefixlessURL(client, fmt.Sprintf("/_synapse/admin/v1/rooms/%s/state", roomId), map[string]string{}),
+			nil,
+			&response,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed fetching state for %s: %s", roomId, err)
+		}
+
+		return response.State, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if determineMemberships(events)[actingUserId] != "join" {
+		return nil, fmt.Errorf("%s is not joined to %s", actingUserId, roomId)
+	}
+
+	return events, nil
+}
+
+// determineMemberships returns the membership (`join`, `invite`, `leave`, etc.) of each user, according to the given room state events
+func determineMemberships(events []gomatrix.Event) map[string]string {
+	memberships := map[string]string{}
+	for _, event := range events {
+		if event.Type != "m.room.member" || event.StateKey == nil {
+			continue
+		}
+
+		membership, _ := event.Content["membership"].(string)
+		memberships[*event.StateKey] = membership
+	}
+	return memberships
+}
+
+func (me *SynapseConnector) createAdminClient(userId string, purpose string) (*gomatrix.Client, error) {
+	if me.adminAccessTokenSource != nil {
+		adminAccessToken, err := me.adminAccessTokenSource.GetAccessToken()
+		if err != nil {
+			return nil, fmt.Errorf("could not obtain admin access token, necessary for %s `%s`: %s", purpose, userId, err)
+		}
+
+		return me.createMatrixClientForUserIdAndToken(me.corporalUserID, adminAccessToken)
+	}
+
+	corporalUserAccessToken, err := me.getAccessTokenForCorporalUser()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"could not obtain access token for `%s`, necessary for %s `%s`: %s",
+			me.corporalUserID,
+			purpose,
+			userId,
+			err,
+		)
+	}
+
+	return me.createMatrixClientForUserIdAndToken(me.corporalUserID, corporalUserAccessToken)
+}
+
 func (me *SynapseConnector) Release() {
 	me.corporalUserAccessTokenContext.Release()
 }
 
 func (me *SynapseConnector) getAccessTokenForCorporalUser() (string, error) {
+	if me.corporalUserAccessToken != "" {
+		return me.corporalUserAccessToken, nil
+	}
+
 	me.corporalUserIDLock.Lock()
 	defer me.corporalUserIDLock.Unlock()
 
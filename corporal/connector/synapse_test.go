@@ -0,0 +1,81 @@
+package connector
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSynapseConnectorDetermineUnmanagedUsers(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	detailsRequestedFor := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_matrix/client/r0/account/whoami":
+			w.Write([]byte(`{"user_id": "@corporal:example.com"}`))
+		case "/_synapse/admin/v2/users":
+			if r.URL.Query().Get("guests") != "true" || r.URL.Query().Get("deactivated") != "false" {
+				t.Errorf("unexpected users list filters: %s", r.URL.RawQuery)
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"users": []map[string]interface{}{
+					{"name": "@managed:example.com", "creation_ts": 1600000000000},
+					{"name": "@guest:example.com", "is_guest": true, "creation_ts": 1600000000000},
+					{"name": "@admin:example.com", "admin": true, "creation_ts": 1600000000000},
+					{"name": "@bot:example.com", "user_type": "bot", "creation_ts": 1600000000000},
+					{"name": "@bridged:example.com", "creation_ts": 1600000000000},
+				},
+			})
+		case "/_synapse/admin/v2/users/@admin:example.com", "/_synapse/admin/v2/users/@bot:example.com":
+			detailsRequestedFor = append(detailsRequestedFor, r.URL.Path)
+			w.Write([]byte(`{"appservice_id": null}`))
+		case "/_synapse/admin/v2/users/@bridged:example.com":
+			detailsRequestedFor = append(detailsRequestedFor, r.URL.Path)
+			w.Write([]byte(`{"appservice_id": "bridge"}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode": "M_NOT_FOUND", "error": "Not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	connector := NewSynapseConnector(NewApiConnector(server.URL, nil, 1000, logger), "", "@corporal:example.com")
+	connector.SetCorporalUserAccessToken("corporal-token")
+
+	ctx := NewAccessTokenContext(connector, "device", 0)
+
+	unmanagedUsers, err := connector.DetermineUnmanagedUsers(ctx, []string{"@managed:example.com", "@corporal:example.com"}, "@corporal:example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expectedUnmanagedUsers := []CurrentUnmanagedUserState{
+		{Id: "@guest:example.com", Guest: true, CreatedAt: 1600000000000},
+		{Id: "@admin:example.com", CreatedAt: 1600000000000, ServerAdmin: true},
+		{Id: "@bot:example.com", CreatedAt: 1600000000000, UserType: "bot"},
+		{Id: "@bridged:example.com", CreatedAt: 1600000000000, AppServiceId: "bridge"},
+	}
+	if len(unmanagedUsers) != len(expectedUnmanagedUsers) {
+		t.Fatalf("expected %d unmanaged users, got: %#v", len(expectedUnmanagedUsers), unmanagedUsers)
+	}
+	for idx, expectedUnmanagedUser := range expectedUnmanagedUsers {
+		if unmanagedUsers[idx] != expectedUnmanagedUser {
+			t.Errorf("expected unmanaged user %d to be %#v, got: %#v", idx, expectedUnmanagedUser, unmanagedUsers[idx])
+		}
+	}
+
+	// Guests cannot be application service users, so there's no point in asking about them
+	if len(detailsRequestedFor) != 3 {
+		t.Errorf("expected the details of the 3 non-guest users to be requested, got: %v", detailsRequestedFor)
+	}
+}
@@ -0,0 +1,97 @@
+package connector
+
+import (
+	"bytes"
+	"devture-matrix-corporal/corporal/matrix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/sirupsen/logrus"
+)
+
+// tokenRefreshingTransport is an http.RoundTripper for requests made as a user with an access token from an AccessTokenContext.
+//
+// When the token stops working (the homeserver responds with M_UNKNOWN_TOKEN, e.g. after a password change or a soft-logout),
+// a new token is obtained (see AccessTokenContext.RefreshAccessTokenForUserId) and the request is retried once with it.
+// Subsequent requests (made with the same client) use the new token as well.
+type tokenRefreshingTransport struct {
+	logger *logrus.Logger
+	next   http.RoundTripper
+
+	ctx    *AccessTokenContext
+	userId string
+
+	lock sync.Mutex
+
+	// refreshedAccessToken is the token which replaced the client's own one (if it has been replaced)
+	refreshedAccessToken string
+}
+
+func (me *tokenRefreshingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if refreshedAccessToken := me.getRefreshedAccessToken(); refreshedAccessToken != "" {
+		request = withAccessToken(request, refreshedAccessToken)
+	}
+
+	response, err := me.next.RoundTrip(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized || !isRequestRetriable(request) {
+		return response, err
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var respError gomatrix.RespError
+	if json.Unmarshal(body, &respError) != nil || respError.ErrCode != matrix.ErrorUnknownToken {
+		return response, nil
+	}
+
+	me.logger.Infof("Access token of %s is no longer valid (%s), obtaining a new one and retrying", me.userId, respError.Err)
+
+	invalidAccessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	newAccessToken, err := me.ctx.RefreshAccessTokenForUserId(me.userId, invalidAccessToken)
+	if err != nil {
+		me.logger.Warnf("Failed obtaining a new access token for %s: %s", me.userId, err)
+
+		// The original failure is more telling to whoever made the request
+		return response, nil
+	}
+
+	me.setRefreshedAccessToken(newAccessToken)
+
+	retryRequest, err := prepareAttemptRequest(request, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed preparing request for retrying with a new access token: %s", err)
+	}
+
+	return me.next.RoundTrip(withAccessToken(retryRequest, newAccessToken))
+}
+
+func (me *tokenRefreshingTransport) getRefreshedAccessToken() string {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return me.refreshedAccessToken
+}
+
+func (me *tokenRefreshingTransport) setRefreshedAccessToken(accessToken string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.refreshedAccessToken = accessToken
+}
+
+// withAccessToken returns a copy of the request, which is authenticated with the given access token
+func withAccessToken(request *http.Request, accessToken string) *http.Request {
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return request
+}
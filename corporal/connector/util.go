@@ -2,6 +2,7 @@ package connector
 
 import (
 	"strings"
+	"sync"
 
 	"github.com/matrix-org/gomatrix"
 )
@@ -13,3 +14,52 @@ func buildPrefixlessURL(client *gomatrix.Client, path string, queryParams map[st
 	// We'd like to work at the top-level though, hence this hack.
 	return strings.Replace(url, "/_matrix/client/r0/", "/", 1)
 }
+
+// forEachInParallel calls the callback for each index (from 0 to count - 1), using the given number of goroutines.
+// Once a callback fails, no more callbacks are started and the first error is returned (after in-progress callbacks complete).
+func forEachInParallel(workers int, count int, callback func(index int) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > count {
+		workers = count
+	}
+
+	var lock sync.Mutex
+	var firstErr error
+	nextIndex := 0
+
+	takeIndex := func() (int, bool) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if firstErr != nil || nextIndex == count {
+			return 0, false
+		}
+		nextIndex++
+		return nextIndex - 1, true
+	}
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+
+			for index, ok := takeIndex(); ok; index, ok = takeIndex() {
+				err := callback(index)
+				if err != nil {
+					lock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	return firstErr
+}
@@ -1,6 +1,8 @@
 package container
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"devture-matrix-corporal/corporal/avatar"
 	"devture-matrix-corporal/corporal/configuration"
 	"devture-matrix-corporal/corporal/connector"
@@ -12,15 +14,24 @@ import (
 	"devture-matrix-corporal/corporal/httpgateway/hookrunner"
 	"devture-matrix-corporal/corporal/httpgateway/interceptor"
 	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/jwt"
+	"devture-matrix-corporal/corporal/ldap"
 	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/metrics"
 	"devture-matrix-corporal/corporal/policy"
 	"devture-matrix-corporal/corporal/policy/provider"
+	"devture-matrix-corporal/corporal/reconciliation"
 	"devture-matrix-corporal/corporal/reconciliation/computator"
 	"devture-matrix-corporal/corporal/reconciliation/reconciler"
 	"devture-matrix-corporal/corporal/userauth"
+	"devture-matrix-corporal/corporal/vault"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -50,6 +61,11 @@ func BuildContainer(
 	container := service.New()
 	shutdownHandler := &ContainerShutdownHandler{}
 
+	// Documents get read in many places (policy providers, the HTTP API, includes), which all share this limit
+	if configuration.PolicyDocuments.MaxSizeBytes != 0 {
+		policy.SetMaxDocumentSize(configuration.PolicyDocuments.MaxSizeBytes)
+	}
+
 	container.Set("logger", func(c service.Container) interface{} {
 		return logger
 	})
@@ -101,12 +117,42 @@ func BuildContainer(
 	})
 
 	container.Set("httpgateway.interceptor.login", func(c service.Container) interface{} {
-		return interceptor.NewLoginInterceptor(
+		instance := interceptor.NewLoginInterceptor(
 			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.freshness_guard").(*policy.FreshnessGuard),
 			configuration.Matrix.HomeserverDomainName,
 			container.Get("policy.userauth.checker").(*userauth.Checker),
 			container.Get("matrix.shared_secret_auth.password_generator").(*matrix.SharedSecretAuthPasswordGenerator),
 		)
+
+		switch configuration.Matrix.HomeserverImplementation {
+		case connector.HomeserverImplementationConduit, connector.HomeserverImplementationConduwuit:
+			// Users don't have passwords on these (see connector.ConduitConnector)
+			instance.SetApplicationServiceToken(configuration.Matrix.AppServiceToken)
+		}
+
+		instance.SetIdentifierNormalization(interceptor.LoginIdentifierNormalization{
+			CaseInsensitiveLocalparts:    configuration.HttpGateway.LoginIdentifierNormalization.CaseInsensitiveLocalparts,
+			TrimDomainQualifiedUsernames: configuration.HttpGateway.LoginIdentifierNormalization.TrimDomainQualifiedUsernames,
+			EmailDomains:                 configuration.HttpGateway.LoginIdentifierNormalization.EmailDomains,
+		})
+
+		trustedProxyNetworks, err := httphelp.ParseIpNetworks(configuration.HttpGateway.TrustedProxyNetworks)
+		if err != nil {
+			panic(fmt.Errorf("failed parsing HttpGateway.TrustedProxyNetworks: %s", err))
+		}
+		instance.SetLockoutTracker(container.Get("policy.userauth.lockout_tracker").(*userauth.LockoutTracker), trustedProxyNetworks)
+		instance.SetSecondFactorStore(container.Get("policy.second_factor_store").(*policy.SecondFactorStore))
+
+		if configuration.Matrix.AdminApiLogin.Enabled {
+			instance.SetLoginTokenIssuer(container.Get("connector.synapse").(*connector.SynapseConnector))
+		}
+
+		return instance
+	})
+
+	container.Set("policy.userauth.lockout_tracker", func(c service.Container) interface{} {
+		return userauth.NewLockoutTracker()
 	})
 
 	container.Set("httpgateway.hook_runner", func(c service.Container) interface{} {
@@ -124,6 +170,8 @@ func BuildContainer(
 			time.Duration(configuration.HttpGateway.TimeoutMilliseconds)*time.Millisecond,
 		)
 
+		instance.AddMiddleware(container.Get("httpgateway.unmanaged_user_restrictor").(*httpgateway.UnmanagedUserRestrictor).Middleware)
+
 		shutdownHandler.Add(func() {
 			err := instance.Stop()
 			if err != nil {
@@ -134,6 +182,15 @@ func BuildContainer(
 		return instance
 	})
 
+	container.Set("httpgateway.unmanaged_user_restrictor", func(c service.Container) interface{} {
+		return httpgateway.NewUnmanagedUserRestrictor(
+			logger,
+			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.checker").(*policy.Checker),
+			container.Get("matrix.user_mapping_resolver").(*matrix.UserMappingResolver),
+		)
+	})
+
 	container.Set("httpgateway.server.handler_registrators", func(c service.Container) interface{} {
 		return []httphelp.HandlerRegistrator{
 			container.Get("httpgateway.server.handler_registrator.internal_rest_auth").(httphelp.HandlerRegistrator),
@@ -147,6 +204,7 @@ func BuildContainer(
 	container.Set("httpgateway.server.handler_registrator.internal_rest_auth", func(c service.Container) interface{} {
 		return httpGatewayHandler.NewInternalRESTAuthHandler(
 			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.freshness_guard").(*policy.FreshnessGuard),
 			configuration.Matrix.HomeserverDomainName,
 			configuration.HttpGateway.InternalRESTAuth,
 			container.Get("policy.userauth.checker").(*userauth.Checker),
@@ -158,6 +216,7 @@ func BuildContainer(
 		return httpGatewayHandler.NewPolicyCheckedRoutesHandler(
 			container.Get("matrix.http_reverse_proxy").(*httputil.ReverseProxy),
 			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.freshness_guard").(*policy.FreshnessGuard),
 			container.Get("policy.checker").(*policy.Checker),
 			container.Get("httpgateway.hook_runner").(*hookrunner.HookRunner),
 			container.Get("matrix.user_mapping_resolver").(*matrix.UserMappingResolver),
@@ -210,21 +269,77 @@ func BuildContainer(
 	container.Set("httpapi.server.handler_registrators", func(c service.Container) interface{} {
 		return []httphelp.HandlerRegistrator{
 			container.Get("httpapi.server.handler_registrator.policy").(httphelp.HandlerRegistrator),
+			container.Get("httpapi.server.handler_registrator.policy_history").(httphelp.HandlerRegistrator),
 			container.Get("httpapi.server.handler_registrator.user").(httphelp.HandlerRegistrator),
+			container.Get("httpapi.server.handler_registrator.external_id").(httphelp.HandlerRegistrator),
+			container.Get("httpapi.server.handler_registrator.media").(httphelp.HandlerRegistrator),
+			container.Get("httpapi.server.handler_registrator.metrics").(httphelp.HandlerRegistrator),
+			container.Get("httpapi.server.handler_registrator.reconciliation").(httphelp.HandlerRegistrator),
+			container.Get("httpapi.server.handler_registrator.login_lockout").(httphelp.HandlerRegistrator),
+			container.Get("httpapi.server.handler_registrator.second_factor").(httphelp.HandlerRegistrator),
 		}
 	})
 
 	container.Set("httpapi.server.handler_registrator.policy", func(c service.Container) interface{} {
 		return httpApiHandler.NewPolicyApiHandlerRegistrator(
 			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.parser").(*policy.Parser),
 			container.Get("policy.provider").(provider.Provider),
+			container.Get("reconciliation.store_driven_reconciler").(*reconciler.StoreDrivenReconciler),
+		)
+	})
+
+	container.Set("httpapi.server.handler_registrator.reconciliation", func(c service.Container) interface{} {
+		return httpApiHandler.NewReconciliationApiHandlerRegistrator(
+			container.Get("policy.store").(*policy.Store),
+			container.Get("reconciliation.store_driven_reconciler").(*reconciler.StoreDrivenReconciler),
+		)
+	})
+
+	container.Set("httpapi.server.handler_registrator.login_lockout", func(c service.Container) interface{} {
+		return httpApiHandler.NewLoginLockoutApiHandlerRegistrator(
+			container.Get("policy.userauth.lockout_tracker").(*userauth.LockoutTracker),
+		)
+	})
+
+	container.Set("httpapi.server.handler_registrator.second_factor", func(c service.Container) interface{} {
+		return httpApiHandler.NewSecondFactorApiHandlerRegistrator(
+			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.second_factor_store").(*policy.SecondFactorStore),
+			configuration.Matrix.HomeserverDomainName,
+		)
+	})
+
+	container.Set("httpapi.server.handler_registrator.policy_history", func(c service.Container) interface{} {
+		return httpApiHandler.NewPolicyHistoryApiHandlerRegistrator(
+			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.history").(*policy.History),
 		)
 	})
 
 	container.Set("httpapi.server.handler_registrator.user", func(c service.Container) interface{} {
 		return httpApiHandler.NewUserApiHandlerRegistrator(
 			configuration.Matrix.HomeserverDomainName,
-			container.Get("connector.synapse").(*connector.SynapseConnector),
+			container.Get("connector").(connector.MatrixConnector),
+		)
+	})
+
+	container.Set("httpapi.server.handler_registrator.external_id", func(c service.Container) interface{} {
+		return httpApiHandler.NewExternalIdApiHandlerRegistrator(
+			container.Get("policy.store").(*policy.Store),
+		)
+	})
+
+	container.Set("httpapi.server.handler_registrator.media", func(c service.Container) interface{} {
+		return httpApiHandler.NewMediaApiHandlerRegistrator(
+			configuration.Matrix.HomeserverDomainName,
+			container.Get("connector").(connector.MatrixConnector),
+		)
+	})
+
+	container.Set("httpapi.server.handler_registrator.metrics", func(c service.Container) interface{} {
+		return httpApiHandler.NewMetricsApiHandlerRegistrator(
+			container.Get("metrics.registry").(*metrics.Registry),
 		)
 	})
 
@@ -233,16 +348,146 @@ func BuildContainer(
 	})
 
 	container.Set("hook.executor", func(c service.Container) interface{} {
-		return hook.NewExecutor(
+		instance := hook.NewExecutor(
+			container.Get("hook.rest_service_consultor").(*hook.RESTServiceConsultor),
+		)
+
+		instance.SetMediaQuarantiner(container.Get("connector").(connector.MatrixConnector))
+
+		return instance
+	})
+
+	container.Set("hook.reconciliation_executor", func(c service.Container) interface{} {
+		return hook.NewReconciliationExecutor(
 			container.Get("hook.rest_service_consultor").(*hook.RESTServiceConsultor),
 		)
 	})
 
 	container.Set("policy.store", func(c service.Container) interface{} {
-		return policy.NewStore(
+		instance := policy.NewStore(
 			logger,
 			container.Get("policy.validator").(*policy.Validator),
+			container.Get("policy.history").(*policy.History),
+		)
+
+		if len(configuration.PolicyLoadNotifications.WebhookUrls) > 0 {
+			instance.SetLoadReporter(container.Get("policy.load_notifier").(*policy.LoadNotifier))
+		}
+
+		return instance
+	})
+
+	container.Set("policy.load_notifier", func(c service.Container) interface{} {
+		instance := policy.NewLoadNotifier(
+			logger,
+			configuration.PolicyLoadNotifications.WebhookUrls,
+			configuration.PolicyLoadNotifications.AuthorizationBearerToken,
+			time.Duration(configuration.PolicyLoadNotifications.TimeoutMilliseconds)*time.Millisecond,
 		)
+
+		err := instance.Start()
+		if err != nil {
+			panic(err)
+		}
+
+		shutdownHandler.Add(func() {
+			instance.Stop()
+		})
+
+		return instance
+	})
+
+	container.Set("policy.freshness_guard", func(c service.Container) interface{} {
+		instance, err := policy.NewFreshnessGuard(
+			logger,
+			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.last_known_good_cache").(*policy.LastKnownGoodCache),
+			configuration.PolicyFreshness.DegradedMode,
+			time.Duration(configuration.PolicyFreshness.CheckIntervalMilliseconds)*time.Millisecond,
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		shutdownHandler.Add(func() {
+			instance.Stop()
+		})
+
+		return instance
+	})
+
+	container.Set("policy.last_known_good_cache", func(c service.Container) interface{} {
+		var encryptionKey []byte
+		if configuration.PolicyCache.EncryptionKey != "" {
+			var err error
+			encryptionKey, err = base64.StdEncoding.DecodeString(configuration.PolicyCache.EncryptionKey)
+			if err != nil {
+				panic(fmt.Errorf("failed decoding PolicyCache.EncryptionKey: %s", err))
+			}
+		}
+
+		instance, err := policy.NewLastKnownGoodCache(
+			logger,
+			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.parser").(*policy.Parser),
+			configuration.PolicyCache.Path,
+			encryptionKey,
+			time.Duration(configuration.PolicyCache.MaxStalenessSeconds)*time.Second,
+		)
+		if err != nil {
+			panic(fmt.Errorf("PolicyCache: %s", err))
+		}
+
+		shutdownHandler.Add(func() {
+			instance.Stop()
+		})
+
+		return instance
+	})
+
+	container.Set("policy.history", func(c service.Container) interface{} {
+		var encryptionKey []byte
+		if configuration.PolicyHistory.EncryptionKey != "" {
+			var err error
+			encryptionKey, err = base64.StdEncoding.DecodeString(configuration.PolicyHistory.EncryptionKey)
+			if err != nil {
+				panic(fmt.Errorf("failed decoding PolicyHistory.EncryptionKey: %s", err))
+			}
+		}
+
+		instance, err := policy.NewHistory(
+			logger,
+			configuration.PolicyHistory.Size,
+			configuration.PolicyHistory.Path,
+			encryptionKey,
+			container.Get("policy.parser").(*policy.Parser),
+		)
+		if err != nil {
+			panic(fmt.Errorf("PolicyHistory: %s", err))
+		}
+
+		return instance
+	})
+
+	container.Set("policy.second_factor_store", func(c service.Container) interface{} {
+		var encryptionKey []byte
+		if configuration.SecondFactorStore.EncryptionKey != "" {
+			var err error
+			encryptionKey, err = base64.StdEncoding.DecodeString(configuration.SecondFactorStore.EncryptionKey)
+			if err != nil {
+				panic(fmt.Errorf("failed decoding SecondFactorStore.EncryptionKey: %s", err))
+			}
+		}
+
+		instance, err := policy.NewSecondFactorStore(
+			configuration.SecondFactorStore.Path,
+			encryptionKey,
+		)
+		if err != nil {
+			panic(fmt.Errorf("SecondFactorStore: %s", err))
+		}
+
+		return instance
 	})
 
 	container.Set("policy.checker", func(c service.Container) interface{} {
@@ -255,6 +500,102 @@ func BuildContainer(
 		)
 	})
 
+	container.Set("policy.signature_verifier", func(c service.Container) interface{} {
+		instance, err := policy.NewSignatureVerifier(configuration.PolicySigning.PublicKeys)
+		if err != nil {
+			panic(err)
+		}
+		return instance
+	})
+
+	container.Set("policy.parser", func(c service.Container) interface{} {
+		instance := policy.NewParser(
+			container.Get("policy.signature_verifier").(*policy.SignatureVerifier),
+		)
+
+		vaultClient := container.Get("vault.client").(*vault.Client)
+		if vaultClient != nil {
+			instance.SetSecretResolver(vaultClient)
+		}
+
+		if len(configuration.PolicyIncludes.AllowedDirectories) != 0 || len(configuration.PolicyIncludes.AllowedUrlPrefixes) != 0 {
+			err := instance.SetIncludeRestrictions(
+				configuration.PolicyIncludes.AllowedDirectories,
+				configuration.PolicyIncludes.AllowedUrlPrefixes,
+			)
+			if err != nil {
+				panic(fmt.Errorf("PolicyIncludes: %s", err))
+			}
+		}
+
+		return instance
+	})
+
+	container.Set("vault.client", func(c service.Container) interface{} {
+		if configuration.Vault.Address == "" {
+			// Vault integration is disabled
+			return (*vault.Client)(nil)
+		}
+
+		instance := vault.NewClient(
+			logger,
+			configuration.Vault.Address,
+			configuration.Vault.Token,
+			configuration.Vault.TokenPath,
+			configuration.Vault.Namespace,
+			time.Duration(configuration.Vault.TimeoutMilliseconds)*time.Millisecond,
+		)
+
+		shutdownHandler.Add(func() {
+			instance.Stop()
+		})
+
+		return instance
+	})
+
+	container.Set("ldap.client", func(c service.Container) interface{} {
+		if configuration.Ldap.Url == "" {
+			// LDAP authentication is disabled
+			return (*ldap.Client)(nil)
+		}
+
+		tlsConfig := &tls.Config{}
+		if configuration.Ldap.CaCertificatePath != "" {
+			caCertificates, err := ioutil.ReadFile(configuration.Ldap.CaCertificatePath)
+			if err != nil {
+				panic(fmt.Errorf("failed reading LDAP CA certificates: %s", err))
+			}
+
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(caCertificates) {
+				panic(fmt.Errorf("no certificates found in %s", configuration.Ldap.CaCertificatePath))
+			}
+		}
+
+		instance, err := ldap.NewClient(ldap.Options{
+			Url:       configuration.Ldap.Url,
+			StartTls:  configuration.Ldap.StartTls,
+			TlsConfig: tlsConfig,
+			Timeout:   time.Duration(configuration.Ldap.TimeoutMilliseconds) * time.Millisecond,
+			PoolSize:  configuration.Ldap.PoolSize,
+
+			BindDnTemplate:     configuration.Ldap.BindDnTemplate,
+			SearchBaseDn:       configuration.Ldap.SearchBaseDn,
+			SearchFilter:       configuration.Ldap.SearchFilter,
+			SearchBindDn:       configuration.Ldap.SearchBindDn,
+			SearchBindPassword: configuration.Ldap.SearchBindPassword,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		shutdownHandler.Add(func() {
+			instance.Close()
+		})
+
+		return instance
+	})
+
 	container.Set("matrix.userauth.rest_cache", func(c service.Container) interface{} {
 		cache, err := lru.New(1000)
 		if err != nil {
@@ -263,6 +604,14 @@ func BuildContainer(
 		return cache
 	})
 
+	container.Set("matrix.userauth.rest_decision_cache", func(c service.Container) interface{} {
+		cache, err := lru.New(configuration.RestAuthCache.MaxEntries)
+		if err != nil {
+			panic(err)
+		}
+		return cache
+	})
+
 	container.Set("policy.userauth.checker", func(c service.Container) interface{} {
 		instance := userauth.NewChecker()
 
@@ -272,8 +621,37 @@ func BuildContainer(
 		instance.RegisterAuthenticator(userauth.NewSha256Authenticator())
 		instance.RegisterAuthenticator(userauth.NewSha512Authenticator())
 		instance.RegisterAuthenticator(userauth.NewBcryptAuthenticator())
+		instance.RegisterAuthenticator(userauth.NewArgon2idAuthenticator())
+		instance.RegisterAuthenticator(userauth.NewScryptAuthenticator())
+		instance.RegisterAuthenticator(userauth.NewPbkdf2Authenticator())
+
+		baseRestAuthenticator := userauth.NewRestAuthenticator()
+		restAuthTlsConfig, err := httphelp.NewTlsConfig(
+			configuration.RestAuth.TlsClientCertificatePath,
+			configuration.RestAuth.TlsClientKeyPath,
+			configuration.RestAuth.TlsCaPath,
+		)
+		if err != nil {
+			panic(fmt.Errorf("RestAuth: %s", err))
+		}
+		if restAuthTlsConfig != nil {
+			baseRestAuthenticator.SetTlsConfig(restAuthTlsConfig)
+		}
+		if configuration.RestAuth.HmacSecret != "" {
+			baseRestAuthenticator.SetHmacSecret([]byte(configuration.RestAuth.HmacSecret))
+		}
 
-		restAuthenticator := userauth.NewRestAuthenticator()
+		var restAuthenticator userauth.Authenticator = baseRestAuthenticator
+		if configuration.RestAuthCache.PositiveTtlSeconds != 0 || configuration.RestAuthCache.NegativeTtlSeconds != 0 {
+			restAuthenticator = userauth.NewDecisionCachingAuthenticator(
+				userauth.UserAuthTypeREST,
+				restAuthenticator,
+				container.Get("matrix.userauth.rest_decision_cache").(*lru.Cache),
+				time.Duration(configuration.RestAuthCache.PositiveTtlSeconds)*time.Second,
+				time.Duration(configuration.RestAuthCache.NegativeTtlSeconds)*time.Second,
+				logger,
+			)
+		}
 		instance.RegisterAuthenticator(restAuthenticator)
 		instance.RegisterAuthenticator(userauth.NewCacheFallackAuthenticator(
 			"rest-with-cache-fallback",
@@ -282,6 +660,38 @@ func BuildContainer(
 			logger,
 		))
 
+		ldapClient := container.Get("ldap.client").(*ldap.Client)
+		if ldapClient != nil {
+			instance.RegisterAuthenticator(userauth.NewLdapAuthenticator(ldapClient))
+		}
+
+		if configuration.Jwt.JwksUrl != "" {
+			keySet := jwt.NewKeySet(
+				logger,
+				configuration.Jwt.JwksUrl,
+				time.Duration(configuration.Jwt.JwksRefreshIntervalSeconds)*time.Second,
+				time.Duration(configuration.Jwt.TimeoutMilliseconds)*time.Millisecond,
+			)
+			verifier := jwt.NewVerifier(
+				keySet,
+				configuration.Jwt.Issuer,
+				configuration.Jwt.Audience,
+				time.Duration(configuration.Jwt.ClockSkewSeconds)*time.Second,
+			)
+			instance.RegisterAuthenticator(userauth.NewJwtAuthenticator(verifier, configuration.Jwt.SubjectClaim))
+		}
+
+		if configuration.OAuthIntrospection.Url != "" {
+			instance.RegisterAuthenticator(userauth.NewOAuthIntrospectionAuthenticator(
+				configuration.OAuthIntrospection.Url,
+				configuration.OAuthIntrospection.ClientId,
+				configuration.OAuthIntrospection.ClientSecret,
+				configuration.OAuthIntrospection.SubjectField,
+				configuration.OAuthIntrospection.RequiredScopes,
+				time.Duration(configuration.OAuthIntrospection.TimeoutMilliseconds)*time.Millisecond,
+			))
+		}
+
 		return instance
 	})
 
@@ -289,6 +699,8 @@ func BuildContainer(
 		instance, err := provider.CreateProviderByConfig(
 			configuration.PolicyProvider,
 			container.Get("policy.store").(*policy.Store),
+			container.Get("policy.parser").(*policy.Parser),
+			container.Get("vault.client").(*vault.Client),
 			logger,
 		)
 
@@ -314,13 +726,73 @@ func BuildContainer(
 	})
 
 	container.Set("reconciliation.reconciler", func(c service.Container) interface{} {
-		return reconciler.New(
+		instance := reconciler.New(
 			logger,
-			container.Get("connector.synapse").(*connector.SynapseConnector),
+			container.Get("connector").(connector.MatrixConnector),
 			container.Get("reconciliation.computator").(*computator.ReconciliationStateComputator),
 			configuration.Corporal.UserID,
 			container.Get("avatar.avatar_reader").(*avatar.AvatarReader),
 		)
+
+		if configuration.Matrix.ServerNoticesUserId != "" {
+			instance.SetServerNoticesUserId(configuration.Matrix.ServerNoticesUserId)
+		}
+
+		if len(configuration.ReconciliationReports.WebhookUrls) > 0 || configuration.ReconciliationReports.Directory != "" {
+			instance.SetRunReporter(container.Get("reconciliation.run_report_notifier").(*reconciliation.RunReportNotifier))
+		}
+
+		instance.SetConcurrencyLimiter(container.Get("reconciliation.concurrency_limiter").(*reconciliation.ConcurrencyLimiter))
+
+		instance.SetHookExecutor(container.Get("hook.reconciliation_executor").(*hook.ReconciliationExecutor))
+
+		instance.SetAccessTokenStore(container.Get("connector.access_token_store").(*connector.AccessTokenStore))
+
+		if configuration.Reconciliation.CheckpointIntervalSeconds > 0 {
+			instance.SetCheckpointInterval(time.Duration(configuration.Reconciliation.CheckpointIntervalSeconds) * time.Second)
+		}
+
+		if configuration.Reconciliation.QuarantineAfterFailures > 0 {
+			instance.SetQuarantineThreshold(configuration.Reconciliation.QuarantineAfterFailures)
+		}
+
+		instance.SetDeclaredRoomIdsListener(container.Get("policy.store").(*policy.Store))
+		instance.SetRoomSuccessorIdsListener(container.Get("policy.store").(*policy.Store))
+		instance.SetRemovedUserIdsListener(container.Get("policy.store").(*policy.Store))
+
+		return instance
+	})
+
+	container.Set("reconciliation.concurrency_limiter", func(c service.Container) interface{} {
+		instance, err := reconciliation.NewConcurrencyLimiter(
+			configuration.Reconciliation.Workers,
+			configuration.Reconciliation.ApiCategoryConcurrencyLimits,
+		)
+		if err != nil {
+			panic(err)
+		}
+		return instance
+	})
+
+	container.Set("reconciliation.run_report_notifier", func(c service.Container) interface{} {
+		instance := reconciliation.NewRunReportNotifier(
+			logger,
+			configuration.ReconciliationReports.WebhookUrls,
+			configuration.ReconciliationReports.AuthorizationBearerToken,
+			time.Duration(configuration.ReconciliationReports.TimeoutMilliseconds)*time.Millisecond,
+			configuration.ReconciliationReports.Directory,
+		)
+
+		err := instance.Start()
+		if err != nil {
+			panic(err)
+		}
+
+		shutdownHandler.Add(func() {
+			instance.Stop()
+		})
+
+		return instance
 	})
 
 	container.Set("reconciliation.store_driven_reconciler", func(c service.Container) interface{} {
@@ -329,8 +801,27 @@ func BuildContainer(
 			container.Get("policy.store").(*policy.Store),
 			container.Get("reconciliation.reconciler").(*reconciler.Reconciler),
 			configuration.Reconciliation.RetryIntervalMilliseconds,
+			configuration.Reconciliation.DryRun,
 		)
 
+		instance.SetReconcileOnPolicyLoad(!configuration.Reconciliation.DisableOnPolicyLoad)
+
+		if configuration.Reconciliation.Schedule != "" {
+			schedule, err := reconciliation.ParseSchedule(configuration.Reconciliation.Schedule)
+			if err != nil {
+				panic(err)
+			}
+			instance.SetSchedule(schedule)
+		}
+
+		if configuration.Reconciliation.DriftDetectionSchedule != "" {
+			schedule, err := reconciliation.ParseSchedule(configuration.Reconciliation.DriftDetectionSchedule)
+			if err != nil {
+				panic(err)
+			}
+			instance.SetDriftDetectionSchedule(schedule)
+		}
+
 		shutdownHandler.Add(func() {
 			instance.Stop()
 		})
@@ -339,12 +830,185 @@ func BuildContainer(
 	})
 
 	container.Set("connector.api", func(c service.Container) interface{} {
-		return connector.NewApiConnector(
+		instance := connector.NewApiConnector(
 			configuration.Matrix.HomeserverApiEndpoint,
 			container.Get("matrix.shared_secret_auth.password_generator").(*matrix.SharedSecretAuthPasswordGenerator),
 			configuration.Matrix.TimeoutMilliseconds,
 			logger,
 		)
+
+		instance.SetRequestMetrics(container.Get("connector.request_metrics").(*connector.RequestMetrics))
+
+		instance.SetAccessTokenStore(container.Get("connector.access_token_store").(*connector.AccessTokenStore))
+
+		transport, err := connector.NewHttpTransport(connector.HttpTransportOptions{
+			KeepAlive:                 time.Duration(configuration.Matrix.HttpClient.KeepAliveMilliseconds) * time.Millisecond,
+			IdleConnectionTimeout:     time.Duration(configuration.Matrix.HttpClient.IdleConnectionTimeoutMilliseconds) * time.Millisecond,
+			MaxIdleConnections:        configuration.Matrix.HttpClient.MaxIdleConnections,
+			MaxIdleConnectionsPerHost: configuration.Matrix.HttpClient.MaxIdleConnectionsPerHost,
+			MaxConnectionsPerHost:     configuration.Matrix.HttpClient.MaxConnectionsPerHost,
+			TlsCaPath:                 configuration.Matrix.HttpClient.TlsCaPath,
+			TlsClientCertificatePath:  configuration.Matrix.HttpClient.TlsClientCertificatePath,
+			TlsClientKeyPath:          configuration.Matrix.HttpClient.TlsClientKeyPath,
+			TlsInsecureSkipVerify:     configuration.Matrix.HttpClient.TlsInsecureSkipVerify,
+		})
+		if err != nil {
+			panic(fmt.Errorf("Matrix.HttpClient: %s", err))
+		}
+		instance.SetHttpTransport(transport)
+
+		if configuration.Matrix.AdminApiEndpoint != "" {
+			err := instance.SetAdminApiEndpoint(configuration.Matrix.AdminApiEndpoint)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		if len(configuration.Matrix.CategoryTimeoutsMilliseconds) != 0 {
+			categoryTimeouts := make(map[string]time.Duration, len(configuration.Matrix.CategoryTimeoutsMilliseconds))
+			for category, timeoutMilliseconds := range configuration.Matrix.CategoryTimeoutsMilliseconds {
+				categoryTimeouts[category] = time.Duration(timeoutMilliseconds) * time.Millisecond
+			}
+			instance.SetCategoryTimeouts(categoryTimeouts)
+		}
+
+		if configuration.Matrix.Retries.MaxRetries > 0 {
+			instance.SetRetryPolicy(&connector.RetryPolicy{
+				MaxRetries:     configuration.Matrix.Retries.MaxRetries,
+				InitialBackoff: time.Duration(configuration.Matrix.Retries.InitialBackoffMilliseconds) * time.Millisecond,
+				MaxBackoff:     time.Duration(configuration.Matrix.Retries.MaxBackoffMilliseconds) * time.Millisecond,
+			})
+		}
+
+		if configuration.Matrix.CircuitBreaker.FailureThreshold > 0 {
+			circuitBreaker, err := connector.NewCircuitBreaker(
+				configuration.Matrix.CircuitBreaker.FailureThreshold,
+				time.Duration(configuration.Matrix.CircuitBreaker.OpenDurationMilliseconds)*time.Millisecond,
+			)
+			if err != nil {
+				panic(err)
+			}
+			instance.SetCircuitBreaker(circuitBreaker)
+		}
+
+		if configuration.Matrix.AppServiceToken != "" {
+			instance.SetAppServiceToken(configuration.Matrix.AppServiceToken)
+		}
+
+		if configuration.Reconciliation.RequestsPerSecond > 0 {
+			budget, err := connector.NewRequestBudget(
+				configuration.Reconciliation.RequestsPerSecond,
+				configuration.Reconciliation.RequestBurst,
+			)
+			if err != nil {
+				panic(err)
+			}
+			instance.SetRequestBudget(budget)
+		}
+
+		return instance
+	})
+
+	container.Set("connector.access_token_store", func(c service.Container) interface{} {
+		if configuration.AccessTokenStore.Path == "" {
+			// Persisting access tokens is disabled
+			return (*connector.AccessTokenStore)(nil)
+		}
+
+		encodedEncryptionKey := configuration.AccessTokenStore.EncryptionKey
+		if configuration.AccessTokenStore.EncryptionKeyPath != "" {
+			encodedEncryptionKeyBytes, err := ioutil.ReadFile(configuration.AccessTokenStore.EncryptionKeyPath)
+			if err != nil {
+				panic(fmt.Errorf("failed reading AccessTokenStore.EncryptionKeyPath: %s", err))
+			}
+			encodedEncryptionKey = strings.TrimSpace(string(encodedEncryptionKeyBytes))
+		}
+
+		encryptionKey, err := base64.StdEncoding.DecodeString(encodedEncryptionKey)
+		if err != nil {
+			panic(fmt.Errorf("failed decoding the AccessTokenStore encryption key: %s", err))
+		}
+
+		instance, err := connector.NewAccessTokenStore(configuration.AccessTokenStore.Path, encryptionKey)
+		if err != nil {
+			panic(fmt.Errorf("AccessTokenStore: %s", err))
+		}
+
+		return instance
+	})
+
+	container.Set("connector.request_metrics", func(c service.Container) interface{} {
+		return connector.NewRequestMetrics(container.Get("metrics.registry").(*metrics.Registry))
+	})
+
+	container.Set("metrics.registry", func(c service.Container) interface{} {
+		return metrics.NewRegistry()
+	})
+
+	container.Set("connector", func(c service.Container) interface{} {
+		switch configuration.Matrix.HomeserverImplementation {
+		case connector.HomeserverImplementationDendrite:
+			return container.Get("connector.dendrite")
+		case connector.HomeserverImplementationConduit, connector.HomeserverImplementationConduwuit:
+			return container.Get("connector.conduit")
+		case connector.HomeserverImplementationNoop:
+			return container.Get("connector.noop")
+		}
+		if configuration.Matrix.AuthenticationService.Enabled {
+			return container.Get("connector.mas")
+		}
+		return container.Get("connector.synapse")
+	})
+
+	container.Set("connector.mas", func(c service.Container) interface{} {
+		instance := connector.NewMasConnector(
+			container.Get("connector.synapse").(*connector.SynapseConnector),
+			configuration.Matrix.AuthenticationService.ApiEndpoint,
+			configuration.Matrix.AuthenticationService.ClientId,
+			configuration.Matrix.AuthenticationService.ClientSecret,
+		)
+
+		if configuration.Matrix.AuthenticationService.ClientCredentialsForSynapseAdminApi {
+			instance.EnableClientCredentialsForSynapseAdminApi()
+		}
+
+		return instance
+	})
+
+	container.Set("connector.noop", func(c service.Container) interface{} {
+		return connector.NewNoopConnector(
+			container.Get("logger").(*logrus.Logger),
+			configuration.Matrix.HomeserverDomainName,
+		)
+	})
+
+	container.Set("connector.conduit", func(c service.Container) interface{} {
+		instance := connector.NewConduitConnector(
+			container.Get("connector.api").(*connector.ApiConnector),
+			configuration.Matrix.HomeserverImplementation,
+			configuration.Matrix.HomeserverDomainName,
+			configuration.Corporal.UserID,
+		)
+
+		shutdownHandler.Add(func() {
+			instance.Release()
+		})
+
+		return instance
+	})
+
+	container.Set("connector.dendrite", func(c service.Container) interface{} {
+		instance := connector.NewDendriteConnector(
+			container.Get("connector.api").(*connector.ApiConnector),
+			configuration.Matrix.RegistrationSharedSecret,
+			configuration.Corporal.UserID,
+		)
+
+		shutdownHandler.Add(func() {
+			instance.Release()
+		})
+
+		return instance
 	})
 
 	container.Set("connector.synapse", func(c service.Container) interface{} {
@@ -354,6 +1018,14 @@ func BuildContainer(
 			configuration.Corporal.UserID,
 		)
 
+		instance.SetStateDeterminationWorkers(
+			container.Get("reconciliation.concurrency_limiter").(*reconciliation.ConcurrencyLimiter).GetLimit(reconciliation.ApiCategoryState),
+		)
+
+		if configuration.Matrix.AdminApiLogin.CorporalUserAccessToken != "" {
+			instance.SetCorporalUserAccessToken(configuration.Matrix.AdminApiLogin.CorporalUserAccessToken)
+		}
+
 		shutdownHandler.Add(func() {
 			instance.Release()
 		})
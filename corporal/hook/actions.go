@@ -28,6 +28,11 @@ var (
 	// ActionPassModifiedResponse is an action that lets the request pass and then adjusts the JSON response.
 	// See passModifiedResponseActionHookDetails for fields related to this action.
 	ActionPassModifiedResponse = "pass.modifiedResponse"
+
+	// ActionQuarantineMedia is an action that quarantines some media (making it unavailable for download) and then executes another hook.
+	// This is mostly useful for hooks returned by REST services (e.g. content scanners), which have found some media to be objectionable.
+	// See quarantineMediaActionHookDetails for fields related to this action.
+	ActionQuarantineMedia = "quarantine.media"
 )
 
 var knownActions = []string{
@@ -37,4 +42,13 @@ var knownActions = []string{
 	ActionPassUnmodified,
 	ActionPassModifiedResponse,
 	ActionPassModifiedRequest,
+	ActionQuarantineMedia,
+}
+
+// reconciliationActions are the actions which reconciliation hooks (see reconciliationEventTypes) can use.
+// There's no request or response to respond with or modify.
+var reconciliationActions = []string{
+	ActionConsultRESTServiceURL,
+	ActionReject,
+	ActionPassUnmodified,
 }
@@ -75,6 +75,37 @@ var (
 	EventTypeAfterUnauthenticatedRequest = "afterUnauthenticatedRequest"
 )
 
+// Reconciliation hooks are not related to HTTP requests.
+// They fire while the reconciler applies the policy and carry the computed (or performed) actions instead.
+//
+// Only some actions make sense for them (see reconciliationActions) and they support no matching rules.
+var (
+	// EventTypeBeforeReconciliationRun is a hook event type which gets executed before a reconciliation run performs any actions.
+	//
+	// It carries all the actions about to be performed. Rejecting (see ActionReject) vetoes the whole run,
+	// so that nothing gets performed.
+	//
+	// This also fires for runs reconciling a single user.
+	EventTypeBeforeReconciliationRun = "beforeReconciliationRun"
+
+	// EventTypeAfterReconciliationUser is a hook event type which gets executed after all actions for a given user have been performed.
+	//
+	// It carries the user's actions and is only useful for observing (it's too late to veto anything).
+	// User hooks (see policy.UserPolicy.Hooks) for that user fire as well.
+	EventTypeAfterReconciliationUser = "afterReconciliationUser"
+
+	// EventTypeAfterReconciliationRun is a hook event type which gets executed after a reconciliation run (successful or not).
+	//
+	// It carries the run's report and is only useful for observing.
+	EventTypeAfterReconciliationRun = "afterReconciliationRun"
+)
+
+var reconciliationEventTypes = []string{
+	EventTypeBeforeReconciliationRun,
+	EventTypeAfterReconciliationUser,
+	EventTypeAfterReconciliationRun,
+}
+
 var knownEventTypes = []string{
 	EventTypeBeforeAnyRequest,
 	EventTypeBeforeAuthenticatedRequest,
@@ -85,4 +116,8 @@ var knownEventTypes = []string{
 	EventTypeAfterAuthenticatedRequest,
 	EventTypeAfterAuthenticatedPolicyCheckedRequest,
 	EventTypeAfterUnauthenticatedRequest,
+
+	EventTypeBeforeReconciliationRun,
+	EventTypeAfterReconciliationUser,
+	EventTypeAfterReconciliationRun,
 }
@@ -15,9 +15,17 @@ import (
 
 type executionHandler func(hookObj *Hook, w http.ResponseWriter, request *http.Request, response *http.Response, logger *logrus.Entry) ExecutionResult
 
+// MediaQuarantiner quarantines media (see ActionQuarantineMedia)
+type MediaQuarantiner interface {
+	QuarantineMedia(serverName string, mediaId string) error
+}
+
 type Executor struct {
 	restServiceConsultor *RESTServiceConsultor
 
+	// mediaQuarantiner (if set) is for executing ActionQuarantineMedia hooks (see SetMediaQuarantiner)
+	mediaQuarantiner MediaQuarantiner
+
 	actionToHandlerMap map[string]executionHandler
 }
 
@@ -33,11 +41,20 @@ func NewExecutor(restServiceConsultor *RESTServiceConsultor) *Executor {
 		ActionPassUnmodified:        executePassUnmodified,
 		ActionPassModifiedRequest:   executePassModifiedRequest,
 		ActionPassModifiedResponse:  executePassModifiedResponse,
+		ActionQuarantineMedia:       me.executeActionQuarantineMedia,
 	}
 
 	return me
 }
 
+// SetMediaQuarantiner makes ActionQuarantineMedia hooks possible to execute.
+// Without it, executing them fails.
+//
+// This is to be called before any hooks are executed.
+func (me *Executor) SetMediaQuarantiner(mediaQuarantiner MediaQuarantiner) {
+	me.mediaQuarantiner = mediaQuarantiner
+}
+
 func (me *Executor) Execute(hookObj *Hook, w http.ResponseWriter, request *http.Request, logger *logrus.Entry) ExecutionResult {
 	handler, exists := me.actionToHandlerMap[hookObj.Action]
 	if !exists {
@@ -289,6 +306,46 @@ func (me *Executor) executeActionConsultRESTServiceURL(hookObj *Hook, w http.Res
 	return executionResult
 }
 
+func (me *Executor) executeActionQuarantineMedia(hookObj *Hook, w http.ResponseWriter, request *http.Request, response *http.Response, logger *logrus.Entry) ExecutionResult {
+	if me.mediaQuarantiner == nil {
+		return createProcessingErrorExecutionResult(hookObj, fmt.Errorf("Quarantining media is not possible"))
+	}
+
+	if hookObj.QuarantineMediaUris == nil {
+		return createProcessingErrorExecutionResult(hookObj, fmt.Errorf("quarantineMediaUris information is required"))
+	}
+
+	for _, mxcUri := range *hookObj.QuarantineMediaUris {
+		serverName, mediaId, err := matrix.ParseMxcUri(mxcUri)
+		if err != nil {
+			return createProcessingErrorExecutionResult(hookObj, err)
+		}
+
+		err = me.mediaQuarantiner.QuarantineMedia(serverName, mediaId)
+		if err != nil {
+			return createProcessingErrorExecutionResult(hookObj, fmt.Errorf("Failed quarantining %s: %s", mxcUri, err))
+		}
+
+		logger.Infof("Hook Executor: quarantined media %s", mxcUri)
+	}
+
+	if hookObj.QuarantineResultHook == nil {
+		return executePassUnmodified(hookObj, w, request, response, logger)
+	}
+
+	// Like hooks coming from REST services, the result hook runs immediately (see executeTypelessHook).
+	resultHookObj := *hookObj.QuarantineResultHook
+	resultHookObj.EventType = ""
+	if resultHookObj.ID == "" {
+		resultHookObj.ID = fmt.Sprintf("%s-quarantine-result", hookObj.ID)
+	}
+
+	executionResult := me.Execute(&resultHookObj, w, request, logger)
+	executionResult.Hooks = []*Hook{hookObj}
+
+	return executionResult
+}
+
 func executeActionReject(hookObj *Hook, w http.ResponseWriter, request *http.Request, response *http.Response, logger *logrus.Entry) ExecutionResult {
 	if hookObj.RejectionErrorCode == nil {
 		return createProcessingErrorExecutionResult(hookObj, fmt.Errorf("A rejection error code is required"))
@@ -113,6 +113,18 @@ type passModifiedResponseActionHookDetails struct {
 	InjectHeadersIntoResponse *map[string]string `json:"injectHeadersIntoResponse,omitempty"`
 }
 
+// quarantineMediaActionHookDetails contains some fields which are useful when Hook.Action = ActionQuarantineMedia
+type quarantineMediaActionHookDetails struct {
+	// QuarantineMediaUris contains a list of content repository URIs (`mxc://..`) of the media to quarantine
+	// Required field.
+	QuarantineMediaUris *[]string `json:"quarantineMediaUris,omitempty"`
+
+	// QuarantineResultHook contains the hook to execute after quarantining (e.g. one rejecting the request).
+	//
+	// If not specified, the result is a new hook with Action = ActionPassUnmodified.
+	QuarantineResultHook *Hook `json:"quarantineResultHook,omitempty"`
+}
+
 type Hook struct {
 	// An identifier (name) for this hook
 	ID string `json:"id,omitempty"`
@@ -140,6 +152,8 @@ type Hook struct {
 	passModifiedRequestActionHookDetails
 
 	passModifiedResponseActionHookDetails
+
+	quarantineMediaActionHookDetails
 }
 
 func (me Hook) IsBeforeHook() bool {
@@ -150,6 +164,18 @@ func (me Hook) IsAfterHook() bool {
 	return strings.HasPrefix(me.EventType, "after")
 }
 
+// IsReconciliationHook tells whether the hook fires during reconciliation (see EventTypeBeforeReconciliationRun, etc.),
+// instead of for HTTP requests.
+func (me Hook) IsReconciliationHook() bool {
+	return util.IsStringInArray(me.EventType, reconciliationEventTypes)
+}
+
+// IsReconciliationRunHook tells whether the hook fires for whole reconciliation runs (as opposed to for a given user).
+// Such hooks cannot be user hooks.
+func (me Hook) IsReconciliationRunHook() bool {
+	return me.EventType == EventTypeBeforeReconciliationRun || me.EventType == EventTypeAfterReconciliationRun
+}
+
 func (me Hook) Validate() error {
 	if me.ID == "" {
 		return fmt.Errorf("Hook has no id")
@@ -170,6 +196,16 @@ func (me Hook) Validate() error {
 		return fmt.Errorf("action=%s cannot be combined with eventType=%s, found in hook #%s", me.Action, me.EventType, me.ID)
 	}
 
+	if me.IsReconciliationHook() {
+		if !util.IsStringInArray(me.Action, reconciliationActions) {
+			return fmt.Errorf("action=%s cannot be combined with eventType=%s, found in hook #%s", me.Action, me.EventType, me.ID)
+		}
+
+		if len(me.MatchRules) != 0 {
+			return fmt.Errorf("hook #%s cannot have match rules, because there's no request to match against for eventType=%s", me.ID, me.EventType)
+		}
+	}
+
 	for idx, matchRule := range me.MatchRules {
 		err := matchRule.validate()
 		if err != nil {
@@ -0,0 +1,138 @@
+package hook
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reconciliationHookMaxResultHooks bounds how many result-hooks (e.g. REST services pointing to other REST services) we follow for a single hook
+const reconciliationHookMaxResultHooks = 10
+
+// restServiceReconciliationConsultingRequest represents a request payload sent to a REST service for reconciliation hooks
+// (see reconciliationEventTypes).
+type restServiceReconciliationConsultingRequest struct {
+	Meta restServiceReconciliationConsultingRequestMetaInformation `json:"meta"`
+
+	// Reconciliation contains the event's data (computed actions, a run report, etc.), as provided by the reconciler
+	Reconciliation interface{} `json:"reconciliation"`
+}
+
+type restServiceReconciliationConsultingRequestMetaInformation struct {
+	// HookID contains the name of the hook that provoked this consultation.
+	HookID string `json:"hookId"`
+
+	EventType string `json:"eventType"`
+}
+
+// ConsultAboutReconciliation is like Consult, but is about reconciliation (see reconciliationEventTypes), instead of an HTTP request.
+// The given data is sent to the REST service as-is.
+func (me *RESTServiceConsultor) ConsultAboutReconciliation(eventType string, data interface{}, hook Hook, logger *logrus.Entry) (*Hook, error) {
+	consultingRequestPayload := restServiceReconciliationConsultingRequest{
+		Reconciliation: data,
+	}
+	consultingRequestPayload.Meta.HookID = hook.ID
+	consultingRequestPayload.Meta.EventType = eventType
+
+	consultingHTTPRequestFactory, err := prepareHTTPRequestFactory(consultingRequestPayload, hook, me.defaultTimeoutDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	return me.consult(consultingHTTPRequestFactory, hook, logger)
+}
+
+type ReconciliationExecutionResult struct {
+	Hooks []*Hook
+
+	// Rejected indicates that one of the hooks vetoed reconciliation (see ActionReject)
+	Rejected bool
+
+	// RejectionErrorMessage contains the rejecting hook's error message (if any)
+	RejectionErrorMessage string
+
+	ProcessingError error
+}
+
+// ReconciliationExecutor executes reconciliation hooks (see reconciliationEventTypes).
+//
+// Unlike Executor, there's no request to pass along, respond to or modify.
+// Hooks can only let reconciliation proceed (ActionPassUnmodified), veto it (ActionReject)
+// or leave it up to a REST service (ActionConsultRESTServiceURL), which replies with one of these.
+type ReconciliationExecutor struct {
+	restServiceConsultor *RESTServiceConsultor
+}
+
+func NewReconciliationExecutor(restServiceConsultor *RESTServiceConsultor) *ReconciliationExecutor {
+	return &ReconciliationExecutor{
+		restServiceConsultor: restServiceConsultor,
+	}
+}
+
+// RunAllMatchingType executes (in order) those of the given hooks, which are of the given event type.
+//
+// Execution stops at the first hook that rejects, hits a processing error or asks for the next hooks to be skipped.
+func (me *ReconciliationExecutor) RunAllMatchingType(hooks []*Hook, eventType string, data interface{}, logger *logrus.Entry) ReconciliationExecutionResult {
+	result := ReconciliationExecutionResult{
+		Hooks: make([]*Hook, 0),
+	}
+
+	logger = logger.WithField("hookEventType", eventType)
+
+	for _, hookObj := range hooks {
+		if hookObj.EventType != eventType {
+			continue
+		}
+
+		result.Hooks = append(result.Hooks, hookObj)
+
+		hookLogger := logger.WithFields(logrus.Fields{
+			"hookId":    hookObj.ID,
+			"hookChain": ListToChain(result.Hooks),
+		})
+
+		hookLogger.Infof("Executing hook")
+
+		resultHook, err := me.resolve(hookObj, eventType, data, hookLogger)
+		if err != nil {
+			hookLogger.Errorf("Reconciliation hook execution failed: %s", err)
+			result.ProcessingError = err
+			return result
+		}
+
+		if resultHook.Action == ActionReject {
+			result.Rejected = true
+			if resultHook.RejectionErrorMessage != nil {
+				result.RejectionErrorMessage = *resultHook.RejectionErrorMessage
+			}
+			return result
+		}
+
+		if hookObj.SkipNextHooksInChain || resultHook.SkipNextHooksInChain {
+			return result
+		}
+	}
+
+	return result
+}
+
+// resolve follows the hook (through any REST services it consults) until it gets to a hook which rejects or passes
+func (me *ReconciliationExecutor) resolve(hookObj *Hook, eventType string, data interface{}, logger *logrus.Entry) (*Hook, error) {
+	for i := 0; i < reconciliationHookMaxResultHooks; i++ {
+		switch hookObj.Action {
+		case ActionReject, ActionPassUnmodified:
+			return hookObj, nil
+		case ActionConsultRESTServiceURL:
+			resultHook, err := me.restServiceConsultor.ConsultAboutReconciliation(eventType, data, *hookObj, logger)
+			if err != nil {
+				return nil, err
+			}
+
+			hookObj = resultHook
+		default:
+			return nil, fmt.Errorf("Hook action = %s cannot be used for reconciliation hooks", hookObj.Action)
+		}
+	}
+
+	return nil, fmt.Errorf("Gave up after following %d result hooks", reconciliationHookMaxResultHooks)
+}
@@ -104,6 +104,11 @@ func (me *RESTServiceConsultor) Consult(request *http.Request, response *http.Re
 		return nil, err
 	}
 
+	return me.consult(consultingHTTPRequestFactory, hook, logger)
+}
+
+// consult calls the REST service (asynchronously or not, see Hook.RESTServiceAsync) and returns the result-Hook.
+func (me *RESTServiceConsultor) consult(consultingHTTPRequestFactory httpRequestFactory, hook Hook, logger *logrus.Entry) (*Hook, error) {
 	if hook.RESTServiceAsync {
 		// We do the same thing we do synchronously. We just do it in the background and don't care what happens.
 		// Still, logging, etc., is done.
@@ -241,6 +246,19 @@ func prepareConsultingHTTPRequestFactory(
 		return nil, fmt.Errorf("could not prepare request payload to be sent to the REST service: %s", err)
 	}
 
+	return prepareHTTPRequestFactory(consultingRequestPayload, hook, defaultTimeoutDuration)
+}
+
+// prepareHTTPRequestFactory returns a factory for requests to the hook's REST service, which carry the given payload (serialized as JSON)
+func prepareHTTPRequestFactory(
+	consultingRequestPayload interface{},
+	hook Hook,
+	defaultTimeoutDuration time.Duration,
+) (httpRequestFactory, error) {
+	if hook.RESTServiceURL == nil || *hook.RESTServiceURL == "" {
+		return nil, fmt.Errorf("cannot use NewRESTServiceConsultor with an empty RESTServiceURL")
+	}
+
 	consultingRequestPayloadBytes, err := json.Marshal(consultingRequestPayload)
 	if err != nil {
 		return nil, fmt.Errorf("could not serialize request payload to be sent to the REST service: %s", err)
@@ -15,6 +15,7 @@ const (
 	ErrorCodeUnknown          = matrix.ErrorUnknown
 	ErrorInvalidUsername      = matrix.ErrorInvalidUsername
 	ErrorCodeMissingParameter = matrix.ErrorMissingParameter
+	ErrorCodeNotFound         = matrix.ErrorNotFound
 )
 
 // ApiResponseError is a "standard error response" as per the Matrix Client-Server specification.
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/policy"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// apiExternalIdsResponse is a response for:
+// - GET /_matrix/corporal/user/{userId}/external-ids
+// - GET /_matrix/corporal/external-id/{type}?value={value}
+type apiExternalIdsResponse struct {
+	UserId      string            `json:"userId"`
+	ExternalIds map[string]string `json:"externalIds"`
+}
+
+type ExternalIdApiHandlerRegistrator struct {
+	policyStore *policy.Store
+}
+
+func NewExternalIdApiHandlerRegistrator(policyStore *policy.Store) *ExternalIdApiHandlerRegistrator {
+	return &ExternalIdApiHandlerRegistrator{
+		policyStore: policyStore,
+	}
+}
+
+func (me *ExternalIdApiHandlerRegistrator) RegisterRoutesWithRouter(router *mux.Router) {
+	router.HandleFunc("/_matrix/corporal/user/{userId}/external-ids", me.actionExternalIdsGetByUserId).Methods("GET")
+	// The value is passed as a query parameter, because external ids (LDAP DNs, etc.) may contain all sorts of characters.
+	router.HandleFunc("/_matrix/corporal/external-id/{type}", me.actionUserGetByExternalId).Methods("GET")
+}
+
+func (me *ExternalIdApiHandlerRegistrator) actionExternalIdsGetByUserId(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["userId"]
+
+	policyObj := me.getPolicy(w)
+	if policyObj == nil {
+		return
+	}
+
+	userPolicy := policyObj.GetUserPolicyByUserId(userId)
+	if userPolicy == nil {
+		Respond(w, http.StatusNotFound, ApiResponseError{
+			ErrorCode:    ErrorCodeNotFound,
+			ErrorMessage: fmt.Sprintf("User %s is not managed by the policy", userId),
+		})
+		return
+	}
+
+	me.respondWithUserPolicy(w, userPolicy)
+}
+
+func (me *ExternalIdApiHandlerRegistrator) actionUserGetByExternalId(w http.ResponseWriter, r *http.Request) {
+	idType := mux.Vars(r)["type"]
+	id := r.URL.Query().Get("value")
+
+	if id == "" {
+		Respond(w, http.StatusBadRequest, ApiResponseError{
+			ErrorCode:    ErrorCodeMissingParameter,
+			ErrorMessage: "Empty or missing `value` query parameter",
+		})
+		return
+	}
+
+	policyObj := me.getPolicy(w)
+	if policyObj == nil {
+		return
+	}
+
+	userPolicy := policyObj.GetUserPolicyByExternalId(idType, id)
+	if userPolicy == nil {
+		Respond(w, http.StatusNotFound, ApiResponseError{
+			ErrorCode:    ErrorCodeNotFound,
+			ErrorMessage: fmt.Sprintf("No user with a `%s` external id of %s", idType, id),
+		})
+		return
+	}
+
+	me.respondWithUserPolicy(w, userPolicy)
+}
+
+func (me *ExternalIdApiHandlerRegistrator) getPolicy(w http.ResponseWriter) *policy.Policy {
+	policyObj := me.policyStore.Get()
+	if policyObj == nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: "Missing policy",
+		})
+		return nil
+	}
+
+	return policyObj
+}
+
+func (me *ExternalIdApiHandlerRegistrator) respondWithUserPolicy(w http.ResponseWriter, userPolicy *policy.UserPolicy) {
+	externalIds := userPolicy.ExternalIds
+	if externalIds == nil {
+		externalIds = map[string]string{}
+	}
+
+	Respond(w, http.StatusOK, apiExternalIdsResponse{
+		UserId:      userPolicy.Id,
+		ExternalIds: externalIds,
+	})
+}
+
+// Ensure interface is implemented
+var _ httphelp.HandlerRegistrator = &ExternalIdApiHandlerRegistrator{}
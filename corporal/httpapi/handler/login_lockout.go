@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/userauth"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type LoginLockoutApiHandlerRegistrator struct {
+	lockoutTracker *userauth.LockoutTracker
+}
+
+func NewLoginLockoutApiHandlerRegistrator(lockoutTracker *userauth.LockoutTracker) *LoginLockoutApiHandlerRegistrator {
+	return &LoginLockoutApiHandlerRegistrator{
+		lockoutTracker: lockoutTracker,
+	}
+}
+
+func (me *LoginLockoutApiHandlerRegistrator) RegisterRoutesWithRouter(router *mux.Router) {
+	router.HandleFunc("/_matrix/corporal/login-lockout", me.actionList).Methods("GET")
+	router.HandleFunc("/_matrix/corporal/login-lockout/user/{userId}", me.actionClearUser).Methods("DELETE")
+	router.HandleFunc("/_matrix/corporal/login-lockout/ip/{ip}", me.actionClearIp).Methods("DELETE")
+}
+
+// actionList lists the users and IP addresses which are currently locked out, due to too many failed login attempts
+func (me *LoginLockoutApiHandlerRegistrator) actionList(w http.ResponseWriter, r *http.Request) {
+	Respond(w, http.StatusOK, map[string]interface{}{
+		"users": me.lockoutTracker.GetLockedOutUsers(),
+		"ips":   me.lockoutTracker.GetLockedOutIps(),
+	})
+}
+
+// actionClearUser lifts a user's lockout (if any) and forgets about their failed login attempts
+func (me *LoginLockoutApiHandlerRegistrator) actionClearUser(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["userId"]
+
+	if !me.lockoutTracker.ClearUser(userId) {
+		Respond(w, http.StatusNotFound, ApiResponseError{
+			ErrorCode:    ErrorCodeNotFound,
+			ErrorMessage: fmt.Sprintf("There are no failed login attempts for user %s", userId),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{})
+}
+
+// actionClearIp lifts an IP address's lockout (if any) and forgets about the failed login attempts made from it
+func (me *LoginLockoutApiHandlerRegistrator) actionClearIp(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	if parsedIp := net.ParseIP(ip); parsedIp != nil {
+		// IP addresses are tracked in their canonical form (which matters for IPv6 ones)
+		ip = parsedIp.String()
+	}
+
+	if !me.lockoutTracker.ClearIp(ip) {
+		Respond(w, http.StatusNotFound, ApiResponseError{
+			ErrorCode:    ErrorCodeNotFound,
+			ErrorMessage: fmt.Sprintf("There are no failed login attempts from IP address %s", ip),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{})
+}
+
+// Ensure interface is implemented
+var _ httphelp.HandlerRegistrator = &LoginLockoutApiHandlerRegistrator{}
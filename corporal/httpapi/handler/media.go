@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/matrix"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// apiMediaQuarantineResponse is a response for:
+// - POST /_matrix/corporal/room/{roomId}/media/quarantine
+// - POST /_matrix/corporal/user/{userId}/media/quarantine
+type apiMediaQuarantineResponse struct {
+	QuarantinedCount int `json:"quarantinedCount"`
+}
+
+type MediaApiHandlerRegistrator struct {
+	homeserverDomainName string
+	connector            connector.MatrixConnector
+}
+
+func NewMediaApiHandlerRegistrator(
+	homeserverDomainName string,
+	connector connector.MatrixConnector,
+) *MediaApiHandlerRegistrator {
+	return &MediaApiHandlerRegistrator{
+		homeserverDomainName: homeserverDomainName,
+		connector:            connector,
+	}
+}
+
+func (me *MediaApiHandlerRegistrator) RegisterRoutesWithRouter(router *mux.Router) {
+	router.HandleFunc("/_matrix/corporal/media/{serverName}/{mediaId}/quarantine", me.actionMediaQuarantine).Methods("POST")
+	router.HandleFunc("/_matrix/corporal/media/{serverName}/{mediaId}/quarantine", me.actionMediaUnquarantine).Methods("DELETE")
+	router.HandleFunc("/_matrix/corporal/room/{roomId}/media/quarantine", me.actionRoomMediaQuarantine).Methods("POST")
+	router.HandleFunc("/_matrix/corporal/user/{userId}/media/quarantine", me.actionUserMediaQuarantine).Methods("POST")
+}
+
+func (me *MediaApiHandlerRegistrator) actionMediaQuarantine(w http.ResponseWriter, r *http.Request) {
+	serverName := mux.Vars(r)["serverName"]
+	mediaId := mux.Vars(r)["mediaId"]
+
+	// This is idempotent.
+	err := me.connector.QuarantineMedia(serverName, mediaId)
+	if err != nil {
+		Respond(w, http.StatusInternalServerError, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Could not quarantine mxc://%s/%s: %s", serverName, mediaId, err),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (me *MediaApiHandlerRegistrator) actionMediaUnquarantine(w http.ResponseWriter, r *http.Request) {
+	serverName := mux.Vars(r)["serverName"]
+	mediaId := mux.Vars(r)["mediaId"]
+
+	// This is idempotent.
+	err := me.connector.UnquarantineMedia(serverName, mediaId)
+	if err != nil {
+		Respond(w, http.StatusInternalServerError, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Could not unquarantine mxc://%s/%s: %s", serverName, mediaId, err),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (me *MediaApiHandlerRegistrator) actionRoomMediaQuarantine(w http.ResponseWriter, r *http.Request) {
+	roomId := mux.Vars(r)["roomId"]
+
+	quarantinedCount, err := me.connector.QuarantineRoomMedia(roomId)
+	if err != nil {
+		Respond(w, http.StatusInternalServerError, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Could not quarantine the media of %s: %s", roomId, err),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, apiMediaQuarantineResponse{
+		QuarantinedCount: quarantinedCount,
+	})
+}
+
+func (me *MediaApiHandlerRegistrator) actionUserMediaQuarantine(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["userId"]
+
+	if !matrix.IsFullUserIdOfDomain(userId, me.homeserverDomainName) {
+		Respond(w, http.StatusBadRequest, ApiResponseError{
+			ErrorCode: ErrorInvalidUsername,
+			ErrorMessage: fmt.Sprintf(
+				"Bad user id (%s) - not part of the homeserver domain (%s)",
+				userId,
+				me.homeserverDomainName,
+			),
+		})
+		return
+	}
+
+	quarantinedCount, err := me.connector.QuarantineUserMedia(userId)
+	if err != nil {
+		Respond(w, http.StatusInternalServerError, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Could not quarantine the media of %s: %s", userId, err),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, apiMediaQuarantineResponse{
+		QuarantinedCount: quarantinedCount,
+	})
+}
+
+// Ensure interface is implemented
+var _ httphelp.HandlerRegistrator = &MediaApiHandlerRegistrator{}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"bytes"
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/metrics"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type MetricsApiHandlerRegistrator struct {
+	registry *metrics.Registry
+}
+
+func NewMetricsApiHandlerRegistrator(registry *metrics.Registry) *MetricsApiHandlerRegistrator {
+	return &MetricsApiHandlerRegistrator{
+		registry: registry,
+	}
+}
+
+func (me *MetricsApiHandlerRegistrator) RegisterRoutesWithRouter(router *mux.Router) {
+	router.HandleFunc("/_matrix/corporal/metrics", me.actionMetricsGet).Methods("GET")
+}
+
+func (me *MetricsApiHandlerRegistrator) actionMetricsGet(w http.ResponseWriter, r *http.Request) {
+	var buffer bytes.Buffer
+
+	err := me.registry.Render(&buffer)
+	if err != nil {
+		Respond(w, http.StatusInternalServerError, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Could not render metrics: %s", err),
+		})
+		return
+	}
+
+	httphelp.RespondWithBytes(w, http.StatusOK, metrics.ContentType, buffer.Bytes())
+}
+
+// Ensure interface is implemented
+var _ httphelp.HandlerRegistrator = &MetricsApiHandlerRegistrator{}
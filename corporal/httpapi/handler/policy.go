@@ -4,36 +4,60 @@ import (
 	"devture-matrix-corporal/corporal/httphelp"
 	"devture-matrix-corporal/corporal/policy"
 	"devture-matrix-corporal/corporal/policy/provider"
+	"devture-matrix-corporal/corporal/reconciliation/reconciler"
 	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
 )
 
+const (
+	// userPolicyReconcileFull makes a user policy change trigger a full reconciliation (like any other policy change)
+	userPolicyReconcileFull = "full"
+
+	// userPolicyReconcileUser makes a user policy change only trigger reconciliation for that user
+	userPolicyReconcileUser = "user"
+
+	// userPolicyReconcileNone makes a user policy change not trigger reconciliation at all
+	userPolicyReconcileNone = "none"
+)
+
 type PolicyApiHandlerRegistrator struct {
-	policyStore    *policy.Store
-	policyProvider provider.Provider
+	policyStore           *policy.Store
+	policyParser          *policy.Parser
+	policyProvider        provider.Provider
+	storeDrivenReconciler *reconciler.StoreDrivenReconciler
 }
 
 func NewPolicyApiHandlerRegistrator(
 	policyStore *policy.Store,
+	policyParser *policy.Parser,
 	policyProvider provider.Provider,
+	storeDrivenReconciler *reconciler.StoreDrivenReconciler,
 ) *PolicyApiHandlerRegistrator {
 	return &PolicyApiHandlerRegistrator{
-		policyStore:    policyStore,
-		policyProvider: policyProvider,
+		policyStore:           policyStore,
+		policyParser:          policyParser,
+		policyProvider:        policyProvider,
+		storeDrivenReconciler: storeDrivenReconciler,
 	}
 }
 
 func (me *PolicyApiHandlerRegistrator) RegisterRoutesWithRouter(router *mux.Router) {
 	router.HandleFunc("/_matrix/corporal/policy", me.actionPolicyGet).Methods("GET")
 	router.HandleFunc("/_matrix/corporal/policy", me.actionPolicyPut).Methods("PUT")
+	router.HandleFunc("/_matrix/corporal/policy/user/{userId}", me.actionUserPolicyPut).Methods("PUT")
 	router.HandleFunc("/_matrix/corporal/policy/provider/reload", me.actionPolicyProviderReload).Methods("POST")
 }
 
 func (me *PolicyApiHandlerRegistrator) actionPolicyGet(w http.ResponseWriter, r *http.Request) {
 	// May be nil
 	policy := me.policyStore.Get()
+	if policy != nil {
+		// Second factors can be used for generating codes, so they're not for showing
+		redacted := policy.WithSecondFactorsRedacted()
+		policy = &redacted
+	}
 
 	Respond(w, http.StatusOK, map[string]interface{}{
 		"policy": policy,
@@ -41,18 +65,41 @@ func (me *PolicyApiHandlerRegistrator) actionPolicyGet(w http.ResponseWriter, r
 }
 
 func (me *PolicyApiHandlerRegistrator) actionPolicyPut(w http.ResponseWriter, r *http.Request) {
-	var policy policy.Policy
+	// The body may be compressed (`Content-Encoding: gzip`), which is useful for large policies.
+	// Nothing else needs the body after us, so we read it directly (instead of via `httphelp.GetRequestBody`).
+	bodyBytes, err := policy.ReadDocument(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		Respond(w, http.StatusBadRequest, ApiResponseError{
+			ErrorCode:    ErrorCodeBadJson,
+			ErrorMessage: fmt.Sprintf("Bad body payload: %s", err),
+		})
+		return
+	}
 
-	err := httphelp.GetJsonFromRequestBody(r, &policy)
+	policyObj, err := me.policyParser.ParsePushedFormat(bodyBytes, policy.DetectFormat(r.Header.Get("Content-Type"), ""))
 	if err != nil {
 		Respond(w, http.StatusBadRequest, ApiResponseError{
 			ErrorCode:    ErrorCodeBadJson,
-			ErrorMessage: "Bad body payload",
+			ErrorMessage: fmt.Sprintf("Bad body payload: %s", err),
+		})
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun")
+	if dryRun != "" && dryRun != "0" && dryRun != "1" {
+		Respond(w, http.StatusBadRequest, ApiResponseError{
+			ErrorCode:    ErrorCodeMissingParameter,
+			ErrorMessage: fmt.Sprintf("Bad dryRun parameter (%s) - expected one of: 0, 1", dryRun),
 		})
 		return
 	}
 
-	err = me.policyStore.Set(&policy)
+	if dryRun == "1" {
+		me.dryRunPolicy(w, policyObj)
+		return
+	}
+
+	err = me.policyStore.Set(policyObj, policy.PolicySourceHttpApi)
 	if err != nil {
 		Respond(w, http.StatusOK, ApiResponseError{
 			ErrorCode:    ErrorCodeUnknown,
@@ -64,6 +111,101 @@ func (me *PolicyApiHandlerRegistrator) actionPolicyPut(w http.ResponseWriter, r
 	Respond(w, http.StatusOK, map[string]interface{}{})
 }
 
+// dryRunPolicy responds with a report of what reconciling the given policy would do, without storing (or reconciling) it
+func (me *PolicyApiHandlerRegistrator) dryRunPolicy(w http.ResponseWriter, policyObj *policy.Policy) {
+	err := me.policyStore.Validate(policyObj)
+	if err != nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Invalid policy: %s", err),
+		})
+		return
+	}
+
+	report, err := me.storeDrivenReconciler.DryRun(policyObj)
+	if err != nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Failed to compute reconciliation actions: %s", err),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{
+		"report": report,
+	})
+}
+
+func (me *PolicyApiHandlerRegistrator) actionUserPolicyPut(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["userId"]
+
+	reconcile := r.URL.Query().Get("reconcile")
+	if reconcile == "" {
+		reconcile = userPolicyReconcileFull
+	}
+	if reconcile != userPolicyReconcileFull && reconcile != userPolicyReconcileUser && reconcile != userPolicyReconcileNone {
+		Respond(w, http.StatusBadRequest, ApiResponseError{
+			ErrorCode:    ErrorCodeMissingParameter,
+			ErrorMessage: fmt.Sprintf("Bad reconcile parameter (%s) - expected one of: full, user, none", reconcile),
+		})
+		return
+	}
+
+	bodyBytes, err := policy.ReadDocument(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		Respond(w, http.StatusBadRequest, ApiResponseError{
+			ErrorCode:    ErrorCodeBadJson,
+			ErrorMessage: fmt.Sprintf("Bad body payload: %s", err),
+		})
+		return
+	}
+
+	format := policy.DetectFormat(r.Header.Get("Content-Type"), "")
+
+	userPolicy, err := me.policyParser.ParseUserPolicy(bodyBytes, format)
+	if err != nil {
+		Respond(w, http.StatusBadRequest, ApiResponseError{
+			ErrorCode:    ErrorCodeBadJson,
+			ErrorMessage: fmt.Sprintf("Bad body payload: %s", err),
+		})
+		return
+	}
+
+	if userPolicy.Id == "" {
+		userPolicy.Id = userId
+	}
+	if userPolicy.Id != userId {
+		Respond(w, http.StatusBadRequest, ApiResponseError{
+			ErrorCode:    ErrorInvalidUsername,
+			ErrorMessage: fmt.Sprintf("User policy id (%s) does not match the user id in the URL (%s)", userPolicy.Id, userId),
+		})
+		return
+	}
+
+	err = me.policyStore.Modify(
+		func(current policy.Policy) (*policy.Policy, error) {
+			modified := current.WithPushedUserPolicy(userPolicy, policy.PushedDocument{Data: bodyBytes, Format: format})
+			return &modified, nil
+		},
+		policy.PolicySourceHttpApiUser,
+		reconcile == userPolicyReconcileFull,
+	)
+	if err != nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Failed to set user policy: %s", err),
+		})
+		return
+	}
+
+	if reconcile == userPolicyReconcileUser {
+		// Errors are logged by the reconciler. Unlike full reconciliation, this is not retried.
+		go me.storeDrivenReconciler.ReconcileUser(userId)
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{})
+}
+
 func (me *PolicyApiHandlerRegistrator) actionPolicyProviderReload(w http.ResponseWriter, r *http.Request) {
 	go me.policyProvider.Reload()
 
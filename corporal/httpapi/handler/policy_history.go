@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/policy"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiPolicyHistoryEntry is a history entry (without the actual policy) as found in the response for: GET /_matrix/corporal/policy/history
+type apiPolicyHistoryEntry struct {
+	ID                  int       `json:"id"`
+	LoadedAt            time.Time `json:"loadedAt"`
+	Source              string    `json:"source"`
+	IdentificationStamp *string   `json:"identificationStamp"`
+}
+
+type PolicyHistoryApiHandlerRegistrator struct {
+	policyStore   *policy.Store
+	policyHistory *policy.History
+}
+
+func NewPolicyHistoryApiHandlerRegistrator(
+	policyStore *policy.Store,
+	policyHistory *policy.History,
+) *PolicyHistoryApiHandlerRegistrator {
+	return &PolicyHistoryApiHandlerRegistrator{
+		policyStore:   policyStore,
+		policyHistory: policyHistory,
+	}
+}
+
+func (me *PolicyHistoryApiHandlerRegistrator) RegisterRoutesWithRouter(router *mux.Router) {
+	router.HandleFunc("/_matrix/corporal/policy/history", me.actionHistoryList).Methods("GET")
+	router.HandleFunc("/_matrix/corporal/policy/history/{id:[0-9]+}", me.actionHistoryEntryGet).Methods("GET")
+	router.HandleFunc("/_matrix/corporal/policy/history/{id:[0-9]+}/rollback", me.actionHistoryEntryRollback).Methods("POST")
+}
+
+func (me *PolicyHistoryApiHandlerRegistrator) actionHistoryList(w http.ResponseWriter, r *http.Request) {
+	entries := make([]apiPolicyHistoryEntry, 0)
+	for _, entry := range me.policyHistory.List() {
+		entries = append(entries, apiPolicyHistoryEntry{
+			ID:                  entry.ID,
+			LoadedAt:            entry.LoadedAt,
+			Source:              entry.Source,
+			IdentificationStamp: entry.IdentificationStamp,
+		})
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+	})
+}
+
+func (me *PolicyHistoryApiHandlerRegistrator) actionHistoryEntryGet(w http.ResponseWriter, r *http.Request) {
+	entry := me.getEntryFromRequest(w, r)
+	if entry == nil {
+		return
+	}
+
+	// Second factors can be used for generating codes, so they're not for showing (unlike in the entry itself, used for rolling back)
+	redactedEntry := *entry
+	if entry.Policy != nil {
+		redactedPolicy := entry.Policy.WithSecondFactorsRedacted()
+		redactedEntry.Policy = &redactedPolicy
+	}
+
+	Respond(w, http.StatusOK, redactedEntry)
+}
+
+func (me *PolicyHistoryApiHandlerRegistrator) actionHistoryEntryRollback(w http.ResponseWriter, r *http.Request) {
+	entry := me.getEntryFromRequest(w, r)
+	if entry == nil {
+		return
+	}
+
+	err := me.policyStore.Set(entry.Policy, policy.PolicySourceRollback)
+	if err != nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Failed to roll back to policy #%d: %s", entry.ID, err),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (me *PolicyHistoryApiHandlerRegistrator) getEntryFromRequest(w http.ResponseWriter, r *http.Request) *policy.HistoryEntry {
+	// The route regex guarantees this is a number, but it may still overflow.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		Respond(w, http.StatusBadRequest, ApiResponseError{
+			ErrorCode:    ErrorCodeMissingParameter,
+			ErrorMessage: "Bad history entry id",
+		})
+		return nil
+	}
+
+	entry := me.policyHistory.GetByID(id)
+	if entry == nil {
+		Respond(w, http.StatusNotFound, ApiResponseError{
+			ErrorCode:    ErrorCodeNotFound,
+			ErrorMessage: fmt.Sprintf("No policy history entry #%d", id),
+		})
+		return nil
+	}
+
+	return entry
+}
+
+// Ensure interface is implemented
+var _ httphelp.HandlerRegistrator = &PolicyHistoryApiHandlerRegistrator{}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/reconciliation/reconciler"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// progressStreamKeepAliveInterval is how often keep-alive comments get sent over progress streams (see actionProgressStream)
+	progressStreamKeepAliveInterval = 15 * time.Second
+
+	// progressStreamRetryMilliseconds is how long clients are told to wait before reconnecting to progress streams
+	progressStreamRetryMilliseconds = 1000
+)
+
+type ReconciliationApiHandlerRegistrator struct {
+	policyStore           *policy.Store
+	storeDrivenReconciler *reconciler.StoreDrivenReconciler
+}
+
+func NewReconciliationApiHandlerRegistrator(
+	policyStore *policy.Store,
+	storeDrivenReconciler *reconciler.StoreDrivenReconciler,
+) *ReconciliationApiHandlerRegistrator {
+	return &ReconciliationApiHandlerRegistrator{
+		policyStore:           policyStore,
+		storeDrivenReconciler: storeDrivenReconciler,
+	}
+}
+
+func (me *ReconciliationApiHandlerRegistrator) RegisterRoutesWithRouter(router *mux.Router) {
+	router.HandleFunc("/_matrix/corporal/reconcile/user/{userId}", me.actionUserReconcile).Methods("POST")
+
+	router.HandleFunc("/_matrix/corporal/reconcile/control", me.actionControlStatus).Methods("GET")
+	router.HandleFunc("/_matrix/corporal/reconcile/control/pause", me.actionControlPause).Methods("POST")
+	router.HandleFunc("/_matrix/corporal/reconcile/control/resume", me.actionControlResume).Methods("POST")
+	router.HandleFunc("/_matrix/corporal/reconcile/control/cancel", me.actionControlCancel).Methods("POST")
+
+	router.HandleFunc("/_matrix/corporal/reconcile/quarantine", me.actionQuarantineList).Methods("GET")
+	router.HandleFunc("/_matrix/corporal/reconcile/quarantine/{userId}", me.actionQuarantineRelease).Methods("DELETE")
+
+	router.HandleFunc("/_matrix/corporal/reconcile/progress", me.actionProgressStream).Methods("GET")
+}
+
+// actionUserReconcile reconciles a single (managed) user right away and responds with a report of what was done.
+// If some other reconciliation is in progress, this waits for it to complete first.
+func (me *ReconciliationApiHandlerRegistrator) actionUserReconcile(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["userId"]
+
+	policyObj := me.policyStore.Get()
+	if policyObj == nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: "There is no policy yet",
+		})
+		return
+	}
+
+	if policyObj.GetUserPolicyByUserId(userId) == nil {
+		Respond(w, http.StatusNotFound, ApiResponseError{
+			ErrorCode:    ErrorCodeNotFound,
+			ErrorMessage: fmt.Sprintf("User %s is not part of the policy", userId),
+		})
+		return
+	}
+
+	runReport, err := me.storeDrivenReconciler.ReconcileUser(userId)
+	if err != nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Failed to reconcile user: %s", err),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{
+		"report": runReport,
+	})
+}
+
+// actionControlStatus tells whether reconciliation is paused and whether a run is in progress
+func (me *ReconciliationApiHandlerRegistrator) actionControlStatus(w http.ResponseWriter, r *http.Request) {
+	Respond(w, http.StatusOK, me.storeDrivenReconciler.GetRunControlStatus())
+}
+
+// actionControlPause makes reconciliation runs wait before proceeding with the next user, until resumed or cancelled
+func (me *ReconciliationApiHandlerRegistrator) actionControlPause(w http.ResponseWriter, r *http.Request) {
+	me.storeDrivenReconciler.PauseRuns()
+
+	Respond(w, http.StatusOK, me.storeDrivenReconciler.GetRunControlStatus())
+}
+
+// actionControlResume lets paused reconciliation runs proceed
+func (me *ReconciliationApiHandlerRegistrator) actionControlResume(w http.ResponseWriter, r *http.Request) {
+	me.storeDrivenReconciler.ResumeRuns()
+
+	Respond(w, http.StatusOK, me.storeDrivenReconciler.GetRunControlStatus())
+}
+
+// actionControlCancel makes the reconciliation run in progress (if any) stop before proceeding with the next user
+func (me *ReconciliationApiHandlerRegistrator) actionControlCancel(w http.ResponseWriter, r *http.Request) {
+	if !me.storeDrivenReconciler.CancelRuns() {
+		Respond(w, http.StatusNotFound, ApiResponseError{
+			ErrorCode:    ErrorCodeNotFound,
+			ErrorMessage: "There is no reconciliation run in progress",
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, me.storeDrivenReconciler.GetRunControlStatus())
+}
+
+// actionQuarantineList lists the users whose actions get skipped, as reconciling them has failed too many times in a row
+func (me *ReconciliationApiHandlerRegistrator) actionQuarantineList(w http.ResponseWriter, r *http.Request) {
+	Respond(w, http.StatusOK, map[string]interface{}{
+		"users": me.storeDrivenReconciler.GetQuarantinedUsers(),
+	})
+}
+
+// actionQuarantineRelease takes a user out of quarantine, so that their actions get performed again during subsequent runs
+func (me *ReconciliationApiHandlerRegistrator) actionQuarantineRelease(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["userId"]
+
+	if !me.storeDrivenReconciler.ReleaseQuarantinedUser(userId) {
+		Respond(w, http.StatusNotFound, ApiResponseError{
+			ErrorCode:    ErrorCodeNotFound,
+			ErrorMessage: fmt.Sprintf("User %s is not quarantined", userId),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{})
+}
+
+// Ensure interface is implemented
+// actionProgressStream streams the progress of reconciliation runs (see reconciler.RunProgress) as Server-Sent Events,
+// starting with the progress of the runs in progress (if any).
+//
+// The stream lasts until the client goes away (or the HTTP API's write timeout is reached), with keep-alive comments
+// being sent in between updates, so that idle connections don't get dropped by proxies.
+func (me *ReconciliationApiHandlerRegistrator) actionProgressStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: "Streaming is not supported",
+		})
+		return
+	}
+
+	progressChannel, unsubscribe := me.storeDrivenReconciler.SubscribeToProgress()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Clients (like EventSource) reconnect by themselves when the stream ends, which we'd like them to do quickly
+	fmt.Fprintf(w, "retry: %d\n\n", progressStreamRetryMilliseconds)
+	flusher.Flush()
+
+	keepAliveTicker := time.NewTicker(progressStreamKeepAliveInterval)
+	defer keepAliveTicker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAliveTicker.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case progress := <-progressChannel:
+			progressBytes, err := json.Marshal(progress)
+			if err != nil {
+				return
+			}
+
+			_, err = fmt.Fprintf(w, "event: progress\ndata: %s\n\n", progressBytes)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+var _ httphelp.HandlerRegistrator = &ReconciliationApiHandlerRegistrator{}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/totp"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// backupCodeCount is how many backup codes get generated when provisioning a second factor
+const backupCodeCount = 10
+
+type SecondFactorApiHandlerRegistrator struct {
+	policyStore          *policy.Store
+	secondFactorStore    *policy.SecondFactorStore
+	homeserverDomainName string
+}
+
+func NewSecondFactorApiHandlerRegistrator(
+	policyStore *policy.Store,
+	secondFactorStore *policy.SecondFactorStore,
+	homeserverDomainName string,
+) *SecondFactorApiHandlerRegistrator {
+	return &SecondFactorApiHandlerRegistrator{
+		policyStore:          policyStore,
+		secondFactorStore:    secondFactorStore,
+		homeserverDomainName: homeserverDomainName,
+	}
+}
+
+func (me *SecondFactorApiHandlerRegistrator) RegisterRoutesWithRouter(router *mux.Router) {
+	router.HandleFunc("/_matrix/corporal/user/{userId}/totp", me.actionProvision).Methods("POST")
+	router.HandleFunc("/_matrix/corporal/user/{userId}/totp", me.actionRemove).Methods("DELETE")
+}
+
+// actionProvision generates a new TOTP secret and new backup codes for a (managed) user, replacing the previous ones.
+// These are kept (hashed, for backup codes) in the second factor store, outside of the policy, and are only ever returned in this response.
+func (me *SecondFactorApiHandlerRegistrator) actionProvision(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["userId"]
+
+	if me.getUserPolicy(w, userId) == nil {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: err.Error(),
+		})
+		return
+	}
+
+	backupCodes, backupCodeHashes, err := totp.GenerateBackupCodes(backupCodeCount)
+	if err != nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: err.Error(),
+		})
+		return
+	}
+
+	err = me.secondFactorStore.Set(userId, policy.SecondFactor{
+		TotpSecret:       secret,
+		BackupCodeHashes: backupCodeHashes,
+	})
+	if err != nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Failed to store the second factor: %s", err),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{
+		"secret":      secret,
+		"uri":         totp.CreateKeyUri(me.homeserverDomainName, userId, secret),
+		"backupCodes": backupCodes,
+	})
+}
+
+// actionRemove removes a (managed) user's TOTP secret and backup codes, as provisioned by actionProvision.
+// Second factors defined in the user's policy can only be removed from the policy.
+func (me *SecondFactorApiHandlerRegistrator) actionRemove(w http.ResponseWriter, r *http.Request) {
+	userId := mux.Vars(r)["userId"]
+
+	userPolicy := me.getUserPolicy(w, userId)
+	if userPolicy == nil {
+		return
+	}
+
+	removed, err := me.secondFactorStore.Remove(userId)
+	if err != nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("Failed to remove the second factor: %s", err),
+		})
+		return
+	}
+
+	if !removed && (userPolicy.TotpSecret != "" || len(userPolicy.BackupCodeHashes) != 0) {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: fmt.Sprintf("The second factor of %s is defined in the policy and can only be removed from there", userId),
+		})
+		return
+	}
+
+	Respond(w, http.StatusOK, map[string]interface{}{})
+}
+
+// getUserPolicy returns the given user's policy from the current policy.
+// If there's none, a response has already been sent.
+func (me *SecondFactorApiHandlerRegistrator) getUserPolicy(w http.ResponseWriter, userId string) *policy.UserPolicy {
+	policyObj := me.policyStore.Get()
+	if policyObj == nil {
+		Respond(w, http.StatusOK, ApiResponseError{
+			ErrorCode:    ErrorCodeUnknown,
+			ErrorMessage: "There is no policy yet",
+		})
+		return nil
+	}
+
+	userPolicy := policyObj.GetUserPolicyByUserId(userId)
+	if userPolicy == nil {
+		Respond(w, http.StatusNotFound, ApiResponseError{
+			ErrorCode:    ErrorCodeNotFound,
+			ErrorMessage: fmt.Sprintf("User %s is not part of the policy", userId),
+		})
+		return nil
+	}
+
+	return userPolicy
+}
+
+// Ensure interface is implemented
+var _ httphelp.HandlerRegistrator = &SecondFactorApiHandlerRegistrator{}
@@ -16,6 +16,7 @@ import (
 
 type internalRestAuthHandler struct {
 	policyStore          *policy.Store
+	freshnessGuard       *policy.FreshnessGuard
 	homeserverDomainName string
 	configuration        configuration.HttpGatewayInternalRESTAuth
 	userAuthChecker      *userauth.Checker
@@ -26,6 +27,7 @@ type internalRestAuthHandler struct {
 
 func NewInternalRESTAuthHandler(
 	policyStore *policy.Store,
+	freshnessGuard *policy.FreshnessGuard,
 	homeserverDomainName string,
 	configuration configuration.HttpGatewayInternalRESTAuth,
 	userAuthChecker *userauth.Checker,
@@ -38,6 +40,7 @@ func NewInternalRESTAuthHandler(
 
 	return &internalRestAuthHandler{
 		policyStore:          policyStore,
+		freshnessGuard:       freshnessGuard,
 		homeserverDomainName: homeserverDomainName,
 		configuration:        configuration,
 		userAuthChecker:      userAuthChecker,
@@ -76,6 +79,11 @@ func (me *internalRestAuthHandler) actionCheckCredentials(w http.ResponseWriter,
 		return
 	}
 
+	if me.freshnessGuard.IsRefusingToServe() {
+		httphelp.RespondWithMatrixError(w, http.StatusServiceUnavailable, matrix.ErrorUnknown, "Policy is too stale")
+		return
+	}
+
 	policyObj := me.policyStore.Get()
 	if policyObj == nil {
 		httphelp.RespondWithMatrixError(w, http.StatusInternalServerError, matrix.ErrorUnknown, "Missing policy")
@@ -107,7 +115,7 @@ func (me *internalRestAuthHandler) actionCheckCredentials(w http.ResponseWriter,
 		return
 	}
 
-	if !userPolicy.Active {
+	if !userPolicy.IsActive() {
 		logger.Debug("Refusing to authenticate deactivated user")
 		httphelp.RespondWithJSON(w, http.StatusOK, userauth.NewUnsuccessfulRestAuthResponse())
 		return
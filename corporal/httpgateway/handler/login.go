@@ -83,6 +83,17 @@ func (me *loginHandler) createInterceptorHandler(name string, interceptorObj int
 				interceptorResult.ErrorMessage,
 			)
 
+			if interceptorResult.RetryAfter > 0 {
+				httphelp.RespondWithMatrixRatelimitError(
+					w,
+					interceptorResult.ErrorCode,
+					interceptorResult.ErrorMessage,
+					interceptorResult.RetryAfter,
+				)
+
+				return
+			}
+
 			httphelp.RespondWithMatrixError(
 				w,
 				http.StatusForbidden,
@@ -93,6 +104,14 @@ func (me *loginHandler) createInterceptorHandler(name string, interceptorObj int
 			return
 		}
 
+		if interceptorResult.Result == interceptor.InterceptorResultRespond {
+			logger.Infof("HTTP gateway (intercepted): responding with %d", interceptorResult.HttpStatusCode)
+
+			httphelp.RespondWithJSON(w, interceptorResult.HttpStatusCode, interceptorResult.ResponsePayload)
+
+			return
+		}
+
 		if interceptorResult.Result == interceptor.InterceptorResultProxy {
 			reverseProxyToUse := me.reverseProxy
 
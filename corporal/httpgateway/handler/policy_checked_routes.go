@@ -18,6 +18,7 @@ import (
 type policyCheckedRoutesHandler struct {
 	reverseProxy        *httputil.ReverseProxy
 	policyStore         *policy.Store
+	freshnessGuard      *policy.FreshnessGuard
 	policyChecker       *policy.Checker
 	hookRunner          *hookrunner.HookRunner
 	userMappingResolver *matrix.UserMappingResolver
@@ -27,6 +28,7 @@ type policyCheckedRoutesHandler struct {
 func NewPolicyCheckedRoutesHandler(
 	reverseProxy *httputil.ReverseProxy,
 	policyStore *policy.Store,
+	freshnessGuard *policy.FreshnessGuard,
 	policyChecker *policy.Checker,
 	hookRunner *hookrunner.HookRunner,
 	userMappingResolver *matrix.UserMappingResolver,
@@ -35,6 +37,7 @@ func NewPolicyCheckedRoutesHandler(
 	return &policyCheckedRoutesHandler{
 		reverseProxy:        reverseProxy,
 		policyStore:         policyStore,
+		freshnessGuard:      freshnessGuard,
 		policyChecker:       policyChecker,
 		hookRunner:          hookRunner,
 		userMappingResolver: userMappingResolver,
@@ -66,6 +69,22 @@ func (me *policyCheckedRoutesHandler) RegisterRoutesWithRouter(router *mux.Route
 
 	// Requests for an `apiVersion` that we don't support (and don't match below) are rejected via a `denyUnsupportedApiVersionsMiddleware` middleware.
 
+	// Rooms can be joined (and invites accepted) in multiple ways. Knocking is a request to join, so it's policed the same way.
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/rooms/{roomId}/join{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("room.join", policycheck.CheckRoomJoin, false),
+	).Methods("POST")
+
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/join/{roomIdOrAlias}{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("room.join", policycheck.CheckRoomJoin, false),
+	).Methods("POST")
+
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/knock/{roomIdOrAlias}{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("room.knock", policycheck.CheckRoomJoin, false),
+	).Methods("POST")
+
 	router.HandleFunc(
 		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/rooms/{roomId}/leave{optionalTrailingSlash:[/]?}`,
 		me.createPolicyCheckingHandler("room.leave", policycheck.CheckRoomLeave, false),
@@ -89,11 +108,44 @@ func (me *policyCheckedRoutesHandler) RegisterRoutesWithRouter(router *mux.Route
 		me.createPolicyCheckingHandler("room.subsequenly_enabling_encryption", policycheck.CheckRoomEncryptionStateChange, false),
 	).Methods("PUT")
 
+	// Some state events are enforced by room policies. Room admins should not be able to set them to something else.
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/rooms/{roomId}/state/{eventType:m\.room\.(?:retention|server_acl|join_rules|guest_access|history_visibility|power_levels)}{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("room.policy_enforced_state.set", policycheck.CheckRoomStateChange, false),
+	).Methods("PUT")
+
+	// Any other state event. This needs to come after all routes for specific state event types.
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/rooms/{roomId}/state/{eventType}{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("room.state.set", policycheck.CheckRoomEventSending, false),
+	).Methods("PUT")
+
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/rooms/{roomId}/state/{eventType}/{stateKey}{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("room.state.set", policycheck.CheckRoomEventSending, false),
+	).Methods("PUT")
+
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/rooms/{roomId}/redact/{eventId}/{txnId}{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("room.redact", policycheck.CheckRoomEventSending, false),
+	).Methods("PUT")
+
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/rooms/{roomId}/{action:(?:invite|ban|unban)}{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("room.membership.moderate", policycheck.CheckRoomEventSending, false),
+	).Methods("POST")
+
 	router.HandleFunc(
 		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/createRoom{optionalTrailingSlash:[/]?}`,
 		me.createPolicyCheckingHandler("room.create", policycheck.CheckRoomCreate, false),
 	).Methods("POST")
 
+	// Another way to end up with a room on some room version is to upgrade an existing room to it.
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/rooms/{roomId}/upgrade{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("room.upgrade", policycheck.CheckRoomUpgrade, false),
+	).Methods("POST")
+
 	router.HandleFunc(
 		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/rooms/{roomId}/send/{eventType}/{txnId}{optionalTrailingSlash:[/]?}`,
 		me.createPolicyCheckingHandler("room.send_event", policycheck.CheckRoomSendEvent, false),
@@ -114,6 +166,25 @@ func (me *policyCheckedRoutesHandler) RegisterRoutesWithRouter(router *mux.Route
 		me.createPolicyCheckingHandler("user.deactivate", policycheck.CheckUserDeactivate, false),
 	).Methods("POST")
 
+	// 3pids (email addresses, phone numbers) can be associated with the account (`/account/3pid`, `/account/3pid/add`),
+	// removed from it (`/account/3pid/delete`), or bound/unbound with an identity server (`/account/3pid/bind`, `/account/3pid/unbind`).
+	// Validation tokens (`/account/3pid/{medium}/requestToken`) are the first step of adding a new 3pid, so we police those too.
+	// Clients may request these without an access token, so we let such requests through (see `CheckUser3pidChange`).
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/account/3pid{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("user.3pid.change", policycheck.CheckUser3pidChange, false),
+	).Methods("POST")
+
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/account/3pid/{action:(?:add|bind|delete|unbind)}{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("user.3pid.change", policycheck.CheckUser3pidChange, false),
+	).Methods("POST")
+
+	router.HandleFunc(
+		`/_matrix/client/{apiVersion:(?:r0|v\d+)}/account/3pid/{medium}/requestToken{optionalTrailingSlash:[/]?}`,
+		me.createPolicyCheckingHandler("user.3pid.request_token", policycheck.CheckUser3pidChange, true),
+	).Methods("POST")
+
 	// This Client-Server API is used for 2 things:
 	// - setting new passwords for authenticated users (requests having an access token)
 	// - a "forgotten password" flow for unauthenticated users (they authenticate by verifying some 3pid)
@@ -195,6 +266,18 @@ func (me *policyCheckedRoutesHandler) createPolicyCheckingHandler(
 			}
 		}
 
+		if me.freshnessGuard.IsRefusingToServe() {
+			logger.Infof("HTTP gateway (policy-checked): denying (policy too stale)")
+
+			httphelp.RespondWithMatrixError(
+				w,
+				http.StatusServiceUnavailable,
+				matrix.ErrorUnknown,
+				"The policy is too stale to be trusted, so access cannot be allowed",
+			)
+			return
+		}
+
 		policy := me.policyStore.Get()
 		if policy == nil {
 			logger.Infof("HTTP gateway (policy-checked): denying (missing policy)")
@@ -208,7 +291,13 @@ func (me *policyCheckedRoutesHandler) createPolicyCheckingHandler(
 			return
 		}
 
-		policyResponse := policyCheckingCallback(r, r.Context(), *policy, *me.policyChecker)
+		policyToCheckAgainst := *policy
+		if me.freshnessGuard.IsEnforcingReadOnly() {
+			// The policy has expired and we can't trust it to be up-to-date anymore.
+			policyToCheckAgainst = policyToCheckAgainst.WithReadOnlyEnforced()
+		}
+
+		policyResponse := policyCheckingCallback(r, r.Context(), policyToCheckAgainst, *me.policyChecker)
 
 		if !policyResponse.Allow {
 			logger.Infof(
@@ -44,7 +44,13 @@ func (me *HookRunner) RunAllMatchingType(eventType string, w http.ResponseWriter
 
 	logger = logger.WithField("hookEventType", eventType)
 
-	for _, hookObj := range policyObj.Hooks {
+	// The user id is only available for authenticated requests (see the handlers which put it into the context).
+	userId := ""
+	if userIdInterface := request.Context().Value("userId"); userIdInterface != nil {
+		userId = userIdInterface.(string)
+	}
+
+	for _, hookObj := range policyObj.GetHooksForUserId(userId) {
 		if hookObj.EventType != eventType || !hookObj.MatchesRequest(request) {
 			continue
 		}
@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
@@ -33,27 +34,96 @@ import (
 // our fake passwords and grant access.
 // Those passwords are verified and trusted through the `matrix-shared-secret-auth` plugin for Synapse
 // and are generated to match via SharedSecretAuthPasswordGenerator.
+//
+// For homeservers which matrix-corporal logs into as an application service instead (see SetApplicationServiceToken),
+// authenticated requests are forwarded as application service logins.
+//
+// With a login token issuer (see SetLoginTokenIssuer), authenticated requests are forwarded as token logins instead,
+// so that the homeserver doesn't need shared-secret-auth either.
+//
+// Users requiring a second factor (see policy.UserPolicy.Require2fa) additionally need to provide a TOTP code or a backup code
+// (see checkSecondFactor), before their logins get forwarded.
 type LoginInterceptor struct {
 	policyStore                       *policy.Store
+	freshnessGuard                    *policy.FreshnessGuard
 	homeserverDomainName              string
 	userAuthChecker                   *userauth.Checker
 	sharedSecretAuthPasswordGenerator *matrix.SharedSecretAuthPasswordGenerator
+
+	// applicationServiceToken is the application service's `as_token`, if logins are to happen on its behalf
+	applicationServiceToken string
+
+	// loginTokenIssuer (if set) issues the login tokens that authenticated logins are forwarded with (see SetLoginTokenIssuer)
+	loginTokenIssuer LoginTokenIssuer
+
+	// identifierNormalization controls how login identifiers are matched to users in the policy (see SetIdentifierNormalization)
+	identifierNormalization LoginIdentifierNormalization
+
+	// lockoutTracker (if set) keeps track of failed authentication attempts (see SetLockoutTracker)
+	lockoutTracker       *userauth.LockoutTracker
+	trustedProxyNetworks []*net.IPNet
+
+	// secondFactorState keeps track of logins waiting for a second factor (see checkSecondFactor)
+	secondFactorState *secondFactorState
+
+	// secondFactorStore (if set) holds second factors provisioned outside of the policy (see SetSecondFactorStore)
+	secondFactorStore *policy.SecondFactorStore
+}
+
+// LoginTokenIssuer issues (short-lived) `m.login.token` login tokens for users (e.g. connector.SynapseConnector)
+type LoginTokenIssuer interface {
+	IssueLoginToken(userId string) (string, error)
 }
 
 func NewLoginInterceptor(
 	policyStore *policy.Store,
+	freshnessGuard *policy.FreshnessGuard,
 	homeserverDomainName string,
 	userAuthChecker *userauth.Checker,
 	sharedSecretAuthPasswordGenerator *matrix.SharedSecretAuthPasswordGenerator,
 ) *LoginInterceptor {
 	return &LoginInterceptor{
 		policyStore:                       policyStore,
+		freshnessGuard:                    freshnessGuard,
 		homeserverDomainName:              homeserverDomainName,
 		userAuthChecker:                   userAuthChecker,
 		sharedSecretAuthPasswordGenerator: sharedSecretAuthPasswordGenerator,
+		secondFactorState:                 newSecondFactorState(),
 	}
 }
 
+// SetApplicationServiceToken makes authenticated logins get forwarded as application service logins (see matrix.LoginTypeApplicationService),
+// made on behalf of the application service with the given `as_token`, instead of as password logins.
+func (me *LoginInterceptor) SetApplicationServiceToken(applicationServiceToken string) {
+	me.applicationServiceToken = applicationServiceToken
+}
+
+// SetLoginTokenIssuer makes authenticated logins get forwarded as token logins (see matrix.LoginTypeToken),
+// with login tokens issued by the given issuer, instead of as password logins.
+func (me *LoginInterceptor) SetLoginTokenIssuer(loginTokenIssuer LoginTokenIssuer) {
+	me.loginTokenIssuer = loginTokenIssuer
+}
+
+// SetIdentifierNormalization makes login identifiers get matched to users in the policy more leniently (see LoginIdentifierNormalization).
+// Logins by users found this way get forwarded with their exact user id.
+func (me *LoginInterceptor) SetIdentifierNormalization(identifierNormalization LoginIdentifierNormalization) {
+	me.identifierNormalization = identifierNormalization
+}
+
+// SetLockoutTracker makes failed authentication attempts get tracked, so that users and IP addresses get locked out
+// as specified in the policy (see policy.LoginLockout).
+// IP addresses are determined with the help of the given trusted proxy networks (see httphelp.GetClientIp).
+func (me *LoginInterceptor) SetLockoutTracker(lockoutTracker *userauth.LockoutTracker, trustedProxyNetworks []*net.IPNet) {
+	me.lockoutTracker = lockoutTracker
+	me.trustedProxyNetworks = trustedProxyNetworks
+}
+
+// SetSecondFactorStore makes second factors provisioned via the HTTP API (kept in the given store) be used for the users requiring a second factor,
+// instead of the ones defined in their policy.
+func (me *LoginInterceptor) SetSecondFactorStore(secondFactorStore *policy.SecondFactorStore) {
+	me.secondFactorStore = secondFactorStore
+}
+
 func (me *LoginInterceptor) Intercept(r *http.Request) InterceptorResponse {
 	loggingContextFields := logrus.Fields{}
 
@@ -67,6 +137,16 @@ func (me *LoginInterceptor) Intercept(r *http.Request) InterceptorResponse {
 
 	loggingContextFields["type"] = payload.Type
 
+	if me.freshnessGuard.IsRefusingToServe() {
+		return createInterceptorErrorResponse(loggingContextFields, matrix.ErrorForbidden, "Logins are temporarily disabled, because the policy is too stale")
+	}
+
+	if me.freshnessGuard.IsRejectingLogins() {
+		// The policy has expired and we can't trust it to be up-to-date anymore.
+		// We don't know who is (still) supposed to have access, so nobody gets in.
+		return createInterceptorErrorResponse(loggingContextFields, matrix.ErrorForbidden, "Logins are temporarily disabled, because the policy has expired")
+	}
+
 	if payload.Type == matrix.LoginTypeToken {
 		// This is a Token Authentication request related to SSO (CAS or SAML).
 		// Let it pass as-is to the upstream server in order to avoid breaking such login flows.
@@ -91,6 +171,21 @@ func (me *LoginInterceptor) Intercept(r *http.Request) InterceptorResponse {
 		return createInterceptorErrorResponse(loggingContextFields, matrix.ErrorUnknown, "Missing policy")
 	}
 
+	// isIdentifierNormalized tells whether the user id we've determined differs from what the homeserver would determine,
+	// in which case requests need to be forwarded with our user id
+	isIdentifierNormalized := false
+
+	mappedUserId := me.identifierNormalization.mapThirdPartyIdentifier(payload.Identifier, me.homeserverDomainName)
+	if mappedUserId != "" && me.identifierNormalization.findUserPolicy(policyObj, mappedUserId) != nil {
+		loggingContextFields["thirdPartyAddress"] = payload.Identifier.Address
+
+		payload.Identifier = matrix.ApiLoginRequestIdentifier{
+			Type: matrix.LoginIdentifierTypeUser,
+			User: mappedUserId,
+		}
+		isIdentifierNormalized = true
+	}
+
 	if util.IsStringInArray(payload.Identifier.Type, []string{matrix.LoginIdentifierTypeThirdParty, matrix.LoginIdentifierTypePhone}) {
 		// This is some 3pid login request.
 		// Letting it go through may have security implications, so we only do it if explicitly enabled.
@@ -117,7 +212,12 @@ func (me *LoginInterceptor) Intercept(r *http.Request) InterceptorResponse {
 
 	loggingContextFields["userId"] = userId
 
-	userIdFull, err := matrix.DetermineFullUserId(userId, me.homeserverDomainName)
+	trimmedUserId := me.identifierNormalization.trimDomainQualifiedUsername(userId, me.homeserverDomainName)
+	if trimmedUserId != userId {
+		isIdentifierNormalized = true
+	}
+
+	userIdFull, err := matrix.DetermineFullUserId(trimmedUserId, me.homeserverDomainName)
 	if err != nil {
 		return createInterceptorErrorResponse(loggingContextFields, matrix.ErrorForbidden, "Cannot interpret user id")
 	}
@@ -129,7 +229,13 @@ func (me *LoginInterceptor) Intercept(r *http.Request) InterceptorResponse {
 		return createInterceptorErrorResponse(loggingContextFields, matrix.ErrorForbidden, "Rejecting non-own domains")
 	}
 
-	userPolicy := policyObj.GetUserPolicyByUserId(userIdFull)
+	userPolicy := me.identifierNormalization.findUserPolicy(policyObj, userIdFull)
+	if userPolicy != nil && userPolicy.Id != userIdFull {
+		isIdentifierNormalized = true
+		userIdFull = userPolicy.Id
+		loggingContextFields["userId"] = userIdFull
+	}
+
 	if userPolicy == nil {
 		// Not a user we manage.
 		// Let it go through and let the upstream server's policies apply, whatever they may be.
@@ -139,7 +245,7 @@ func (me *LoginInterceptor) Intercept(r *http.Request) InterceptorResponse {
 		}
 	}
 
-	if !userPolicy.Active {
+	if !userPolicy.IsActive() {
 		return createInterceptorErrorResponse(loggingContextFields, matrix.ErrorUserDeactivated, "Deactivated in policy")
 	}
 
@@ -148,6 +254,16 @@ func (me *LoginInterceptor) Intercept(r *http.Request) InterceptorResponse {
 		// Users are created with an initial password as defined in userPolicy.AuthCredential,
 		// but password-management is then potentially left to the homeserver (depending on policyObj.Flags.AllowCustomPassthroughUserPasswords).
 		// Authentication always happens at the homeserver.
+		if isIdentifierNormalized {
+			payload.User = ""
+			payload.Identifier = matrix.ApiLoginRequestIdentifier{
+				Type: matrix.LoginIdentifierTypeUser,
+				User: userIdFull,
+			}
+
+			return me.createProxyResponseWithPayload(r, payload, loggingContextFields)
+		}
+
 		return InterceptorResponse{
 			Result:               InterceptorResultProxy,
 			LoggingContextFields: loggingContextFields,
@@ -158,6 +274,20 @@ func (me *LoginInterceptor) Intercept(r *http.Request) InterceptorResponse {
 
 	loggingContextFields["authType"] = userPolicy.AuthType
 
+	isLockoutEnabled := me.lockoutTracker != nil && policyObj.LoginLockout != nil
+
+	clientIp := ""
+	if isLockoutEnabled {
+		clientIp = httphelp.GetClientIp(r, me.trustedProxyNetworks)
+		loggingContextFields["clientIp"] = clientIp
+
+		// Locked out attempts are not checked at all, so that they cannot be used for guessing (and don't extend the lockout either)
+		retryAfter := me.lockoutTracker.GetLockoutRemaining(userIdFull, clientIp)
+		if retryAfter > 0 {
+			return createInterceptorRatelimitedResponse(loggingContextFields, "Too many failed login attempts, try again later", retryAfter)
+		}
+	}
+
 	isAuthenticated, err := me.userAuthChecker.Check(
 		userIdFull,
 		payload.Password,
@@ -170,13 +300,98 @@ func (me *LoginInterceptor) Intercept(r *http.Request) InterceptorResponse {
 	}
 
 	if !isAuthenticated {
+		if isLockoutEnabled {
+			me.recordFailedAttempt(*policyObj.LoginLockout, userIdFull, clientIp)
+		}
+
 		return createInterceptorErrorResponse(loggingContextFields, matrix.ErrorForbidden, "Failed authentication")
 	}
 
+	if userPolicy.Require2fa {
+		response, isFailedAttempt := me.checkSecondFactor(payload.Auth, userPolicy, loggingContextFields)
+		if response != nil {
+			if isFailedAttempt && isLockoutEnabled {
+				me.recordFailedAttempt(*policyObj.LoginLockout, userIdFull, clientIp)
+			}
+
+			return *response
+		}
+	}
+
+	if isLockoutEnabled {
+		me.lockoutTracker.RecordSuccess(userIdFull)
+	}
+
+	// The homeserver doesn't know about our second-factor stage
+	payload.Auth = nil
+
 	// We don't need to do it, but let's ensure the payload uses the full user id.
 	payload.User = userIdFull
 	payload.Password = me.sharedSecretAuthPasswordGenerator.GenerateForUserId(userIdFull)
 
+	if isIdentifierNormalized {
+		// The identifier takes precedence over the (deprecated) user field, so it needs to have our user id as well
+		payload.Identifier = matrix.ApiLoginRequestIdentifier{
+			Type: matrix.LoginIdentifierTypeUser,
+			User: userIdFull,
+		}
+	}
+
+	if me.applicationServiceToken != "" {
+		payload.Type = matrix.LoginTypeApplicationService
+		payload.User = ""
+		payload.Password = ""
+		payload.Identifier = matrix.ApiLoginRequestIdentifier{
+			Type: matrix.LoginIdentifierTypeUser,
+			User: userIdFull,
+		}
+
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", me.applicationServiceToken))
+	}
+
+	if me.loginTokenIssuer != nil {
+		loginToken, err := me.loginTokenIssuer.IssueLoginToken(userIdFull)
+		if err != nil {
+			loggingContextFields["err"] = err.Error()
+			return createInterceptorErrorResponse(loggingContextFields, matrix.ErrorUnknown, "Internal error")
+		}
+
+		payload = matrix.ApiLoginRequestPayload{
+			Type:                     matrix.LoginTypeToken,
+			Token:                    loginToken,
+			DeviceID:                 payload.DeviceID,
+			InitialDeviceDisplayName: payload.InitialDeviceDisplayName,
+		}
+	}
+
+	return me.createProxyResponseWithPayload(r, payload, loggingContextFields)
+}
+
+// recordFailedAttempt records a failed authentication attempt with the lockout tracker (see SetLockoutTracker)
+func (me *LoginInterceptor) recordFailedAttempt(loginLockout policy.LoginLockout, userId string, clientIp string) {
+	me.lockoutTracker.RecordFailure(
+		userId,
+		clientIp,
+		createLockoutThresholds(loginLockout, loginLockout.MaxFailedAttemptsPerUser),
+		createLockoutThresholds(loginLockout, loginLockout.MaxFailedAttemptsPerIp),
+	)
+}
+
+func createLockoutThresholds(loginLockout policy.LoginLockout, maxFailures int) userauth.LockoutThresholds {
+	return userauth.LockoutThresholds{
+		MaxFailures:        maxFailures,
+		FailureWindow:      loginLockout.GetFailureWindow(),
+		LockoutDuration:    loginLockout.GetLockoutDuration(),
+		MaxLockoutDuration: loginLockout.GetMaxLockoutDuration(),
+	}
+}
+
+// createProxyResponseWithPayload makes the request get proxied with the given payload (instead of its original one)
+func (me *LoginInterceptor) createProxyResponseWithPayload(
+	r *http.Request,
+	payload matrix.ApiLoginRequestPayload,
+	loggingContextFields logrus.Fields,
+) InterceptorResponse {
 	newBodyBytes, err := json.Marshal(payload)
 	if err != nil {
 		return createInterceptorErrorResponse(loggingContextFields, matrix.ErrorUnknown, "Internal error")
@@ -0,0 +1,69 @@
+package interceptor
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/policy"
+	"fmt"
+	"strings"
+)
+
+// LoginIdentifierNormalization controls how leniently login identifiers are matched to the users in the policy (see LoginInterceptor.SetIdentifierNormalization).
+//
+// Normalization only helps identify managed users. Logins which don't end up matching a user in the policy are left untouched.
+type LoginIdentifierNormalization struct {
+	// CaseInsensitiveLocalparts makes user ids match regardless of case (e.g. `John` logging in as `@john:example.com`)
+	CaseInsensitiveLocalparts bool
+
+	// TrimDomainQualifiedUsernames makes usernames qualified with the homeserver's domain (e.g. `john@example.com` or `john:example.com`)
+	// get treated as the plain username (`john`)
+	TrimDomainQualifiedUsernames bool
+
+	// EmailDomains lists the domains, whose email addresses (third-party `email` identifiers, like `john@example.com`)
+	// get mapped to the user with the same localpart on the homeserver (e.g. `@john:example.com`)
+	EmailDomains []string
+}
+
+// trimDomainQualifiedUsername turns usernames like `john@example.com` or `john:example.com` into `john`, if they're qualified with the given domain
+func (me LoginIdentifierNormalization) trimDomainQualifiedUsername(userId string, homeserverDomainName string) string {
+	if !me.TrimDomainQualifiedUsernames || strings.HasPrefix(userId, "@") {
+		return userId
+	}
+
+	for _, separator := range []string{"@", ":"} {
+		suffix := separator + homeserverDomainName
+		if len(userId) > len(suffix) && strings.EqualFold(userId[len(userId)-len(suffix):], suffix) {
+			return userId[:len(userId)-len(suffix)]
+		}
+	}
+
+	return userId
+}
+
+// mapThirdPartyIdentifier returns the user id that the given (third-party) identifier maps to, or an empty string if it doesn't map to any
+func (me LoginIdentifierNormalization) mapThirdPartyIdentifier(identifier matrix.ApiLoginRequestIdentifier, homeserverDomainName string) string {
+	if identifier.Type != matrix.LoginIdentifierTypeThirdParty || identifier.Medium != "email" {
+		return ""
+	}
+
+	idx := strings.LastIndex(identifier.Address, "@")
+	if idx < 1 {
+		return ""
+	}
+
+	localpart, domain := identifier.Address[:idx], identifier.Address[idx+1:]
+	for _, emailDomain := range me.EmailDomains {
+		if strings.EqualFold(domain, emailDomain) {
+			return fmt.Sprintf("@%s:%s", localpart, homeserverDomainName)
+		}
+	}
+
+	return ""
+}
+
+// findUserPolicy finds the user policy for the given user id (ignoring case differences, if enabled)
+func (me LoginIdentifierNormalization) findUserPolicy(policyObj *policy.Policy, userIdFull string) *policy.UserPolicy {
+	if me.CaseInsensitiveLocalparts {
+		return policyObj.GetUserPolicyByUserIdIgnoringCase(userIdFull)
+	}
+	return policyObj.GetUserPolicyByUserId(userIdFull)
+}
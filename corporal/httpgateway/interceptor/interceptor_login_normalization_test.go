@@ -0,0 +1,364 @@
+package interceptor
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/userauth"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// createTestNormalizingLoginInterceptor creates an interceptor for the `example.com` homeserver, with a policy
+// containing `@john:example.com` (authenticated by us) and `@pass:example.com` (authenticated by the homeserver), both with a `secret` password.
+func createTestNormalizingLoginInterceptor(t *testing.T, identifierNormalization LoginIdentifierNormalization) *LoginInterceptor {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	signatureVerifier, err := policy.NewSignatureVerifier(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	currentPolicy, err := policy.NewParser(signatureVerifier).Parse([]byte(`{
+		"schemaVersion": 1,
+		"users": [
+			{"id": "@john:example.com", "active": true, "authType": "plain", "authCredential": "secret"},
+			{"id": "@pass:example.com", "active": true, "authType": "passthrough", "authCredential": "secret"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	history, err := policy.NewHistory(logger, 0, "", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store := policy.NewStore(logger, policy.NewValidator("example.com"), history)
+	err = store.Set(currentPolicy, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	freshnessGuard, err := policy.NewFreshnessGuard(logger, store, nil, policy.DegradedModeWarn, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	userAuthChecker := userauth.NewChecker()
+	userAuthChecker.RegisterAuthenticator(userauth.NewPlainAuthenticator())
+
+	interceptor := NewLoginInterceptor(
+		store,
+		freshnessGuard,
+		"example.com",
+		userAuthChecker,
+		matrix.NewSharedSecretAuthPasswordGenerator("shared-secret"),
+	)
+	interceptor.SetIdentifierNormalization(identifierNormalization)
+
+	return interceptor
+}
+
+func TestLoginInterceptorNormalizesIdentifiers(t *testing.T) {
+	caseFolding := LoginIdentifierNormalization{CaseInsensitiveLocalparts: true}
+	domainTrimming := LoginIdentifierNormalization{TrimDomainQualifiedUsernames: true}
+	allNormalization := LoginIdentifierNormalization{
+		CaseInsensitiveLocalparts:    true,
+		TrimDomainQualifiedUsernames: true,
+		EmailDomains:                 []string{"corp.example"},
+	}
+
+	type testData struct {
+		name                    string
+		identifierNormalization LoginIdentifierNormalization
+		payload                 string
+
+		// expectedErrorCode is what the login gets denied with (if it does)
+		expectedErrorCode string
+
+		// expectedUserId is who the homeserver would log in (as determined from the forwarded payload)
+		expectedUserId string
+
+		// expectedAuthenticated tells whether we're expected to have authenticated the user (replacing the password with our own),
+		// instead of leaving authentication to the homeserver
+		expectedAuthenticated bool
+	}
+
+	tests := []testData{
+		// Bare localparts vs. full user ids, in the identifier vs. the legacy user field
+		{
+			"full user id via identifier",
+			LoginIdentifierNormalization{},
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "@john:example.com"}, "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"localpart via identifier",
+			LoginIdentifierNormalization{},
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "john"}, "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"full user id via legacy user field",
+			LoginIdentifierNormalization{},
+			`{"type": "m.login.password", "user": "@john:example.com", "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"localpart via legacy user field",
+			LoginIdentifierNormalization{},
+			`{"type": "m.login.password", "user": "john", "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"identifier taking precedence over legacy user field",
+			LoginIdentifierNormalization{},
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "john"}, "user": "@other:example.com", "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+
+		// Case folding
+		{
+			"case differences mattering by default",
+			LoginIdentifierNormalization{},
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "JOHN"}, "password": "secret"}`,
+			"", "@JOHN:example.com", false,
+		},
+		{
+			"case folding of localpart via identifier",
+			caseFolding,
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "JOHN"}, "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"case folding of full user id via legacy user field",
+			caseFolding,
+			`{"type": "m.login.password", "user": "@John:example.com", "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"case folding for user authenticated by the homeserver",
+			caseFolding,
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "PASS"}, "password": "secret"}`,
+			"", "@pass:example.com", false,
+		},
+
+		// Domain-qualified usernames
+		{
+			"domain-qualified username left alone by default",
+			LoginIdentifierNormalization{},
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "john@example.com"}, "password": "secret"}`,
+			"", "@john@example.com:example.com", false,
+		},
+		{
+			"username qualified with @domain",
+			domainTrimming,
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "john@example.com"}, "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"username qualified with :domain via legacy user field",
+			domainTrimming,
+			`{"type": "m.login.password", "user": "john:example.com", "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"domain-qualified username with case differences",
+			allNormalization,
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "JOHN@Example.com"}, "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+
+		// Foreign domains
+		{
+			"full user id of a foreign domain via identifier",
+			allNormalization,
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "@john:other.com"}, "password": "secret"}`,
+			matrix.ErrorForbidden, "", false,
+		},
+		{
+			"full user id of a foreign domain via legacy user field",
+			allNormalization,
+			`{"type": "m.login.password", "user": "@John:other.com", "password": "secret"}`,
+			matrix.ErrorForbidden, "", false,
+		},
+		{
+			"username qualified with a foreign domain",
+			allNormalization,
+			`{"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "john@notexample.com"}, "password": "secret"}`,
+			"", "@john@notexample.com:example.com", false,
+		},
+
+		// Email addresses
+		{
+			"email address of a listed domain",
+			LoginIdentifierNormalization{EmailDomains: []string{"corp.example"}},
+			`{"type": "m.login.password", "identifier": {"type": "m.id.thirdparty", "medium": "email", "address": "john@corp.example"}, "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"email address with case differences",
+			allNormalization,
+			`{"type": "m.login.password", "identifier": {"type": "m.id.thirdparty", "medium": "email", "address": "JOHN@CORP.example"}, "password": "secret"}`,
+			"", "@john:example.com", true,
+		},
+		{
+			"email address of an unlisted domain",
+			allNormalization,
+			`{"type": "m.login.password", "identifier": {"type": "m.id.thirdparty", "medium": "email", "address": "john@other.example"}, "password": "secret"}`,
+			matrix.ErrorUnknown, "", false,
+		},
+		{
+			"email address of a user not in the policy",
+			allNormalization,
+			`{"type": "m.login.password", "identifier": {"type": "m.id.thirdparty", "medium": "email", "address": "nobody@corp.example"}, "password": "secret"}`,
+			matrix.ErrorUnknown, "", false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			interceptor := createTestNormalizingLoginInterceptor(t, test.identifierNormalization)
+
+			r := httptest.NewRequest("POST", "/_matrix/client/v3/login", strings.NewReader(test.payload))
+
+			response := interceptor.Intercept(r)
+
+			if test.expectedErrorCode != "" {
+				if response.Result != InterceptorResultDeny || response.ErrorCode != test.expectedErrorCode {
+					t.Fatalf("expected a denial with error code %s, got: %#v", test.expectedErrorCode, response)
+				}
+				return
+			}
+
+			if response.Result != InterceptorResultProxy {
+				t.Fatalf("expected the login to be proxied, got: %#v", response)
+			}
+
+			var forwardedPayload matrix.ApiLoginRequestPayload
+			err := json.NewDecoder(r.Body).Decode(&forwardedPayload)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// Like us, the homeserver prefers the identifier over the legacy user field
+			forwardedUserId := forwardedPayload.Identifier.User
+			if forwardedUserId == "" {
+				forwardedUserId = forwardedPayload.User
+			}
+			forwardedUserIdFull, err := matrix.DetermineFullUserId(forwardedUserId, "example.com")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if forwardedUserIdFull != test.expectedUserId {
+				t.Errorf("expected the login to be forwarded for %s, got: %#v", test.expectedUserId, forwardedPayload)
+			}
+
+			expectedPassword := "secret"
+			if test.expectedAuthenticated {
+				expectedPassword = interceptor.sharedSecretAuthPasswordGenerator.GenerateForUserId(test.expectedUserId)
+			}
+			if forwardedPayload.Password != expectedPassword {
+				t.Errorf("expected the password to be %s, got: %s", expectedPassword, forwardedPayload.Password)
+			}
+		})
+	}
+}
+
+func TestLoginIdentifierNormalizationTrimDomainQualifiedUsername(t *testing.T) {
+	type testData struct {
+		userId         string
+		expectedUserId string
+	}
+
+	tests := []testData{
+		{"john@example.com", "john"},
+		{"john:example.com", "john"},
+		{"john@EXAMPLE.com", "john"},
+		{"john", "john"},
+
+		// Full user ids are left for the domain check to deal with
+		{"@john:example.com", "@john:example.com"},
+		{"@john:other.com", "@john:other.com"},
+
+		{"john@other.com", "john@other.com"},
+		{"john@notexample.com", "john@notexample.com"},
+		{"@example.com", "@example.com"},
+		{":example.com", ":example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.userId, func(t *testing.T) {
+			identifierNormalization := LoginIdentifierNormalization{TrimDomainQualifiedUsernames: true}
+			if result := identifierNormalization.trimDomainQualifiedUsername(test.userId, "example.com"); result != test.expectedUserId {
+				t.Errorf("expected %s, got %s", test.expectedUserId, result)
+			}
+
+			// Nothing gets trimmed, unless enabled
+			if result := (LoginIdentifierNormalization{}).trimDomainQualifiedUsername(test.userId, "example.com"); result != test.userId {
+				t.Errorf("expected %s to be left alone when disabled, got %s", test.userId, result)
+			}
+		})
+	}
+}
+
+func TestLoginIdentifierNormalizationMapThirdPartyIdentifier(t *testing.T) {
+	identifierNormalization := LoginIdentifierNormalization{EmailDomains: []string{"corp.example", "example.com"}}
+
+	type testData struct {
+		name           string
+		identifier     matrix.ApiLoginRequestIdentifier
+		expectedUserId string
+	}
+
+	tests := []testData{
+		{
+			"email address of a listed domain",
+			matrix.ApiLoginRequestIdentifier{Type: matrix.LoginIdentifierTypeThirdParty, Medium: "email", Address: "john@corp.example"},
+			"@john:example.com",
+		},
+		{
+			"email address of a listed domain with case differences",
+			matrix.ApiLoginRequestIdentifier{Type: matrix.LoginIdentifierTypeThirdParty, Medium: "email", Address: "John@Example.COM"},
+			"@John:example.com",
+		},
+		{
+			"email address with multiple @ characters",
+			matrix.ApiLoginRequestIdentifier{Type: matrix.LoginIdentifierTypeThirdParty, Medium: "email", Address: "john@other.example@corp.example"},
+			"@john@other.example:example.com",
+		},
+		{
+			"email address of an unlisted domain",
+			matrix.ApiLoginRequestIdentifier{Type: matrix.LoginIdentifierTypeThirdParty, Medium: "email", Address: "john@other.example"},
+			"",
+		},
+		{
+			"email address without a localpart",
+			matrix.ApiLoginRequestIdentifier{Type: matrix.LoginIdentifierTypeThirdParty, Medium: "email", Address: "@corp.example"},
+			"",
+		},
+		{
+			"phone number",
+			matrix.ApiLoginRequestIdentifier{Type: matrix.LoginIdentifierTypeThirdParty, Medium: "msisdn", Address: "123456789"},
+			"",
+		},
+		{
+			"user identifier",
+			matrix.ApiLoginRequestIdentifier{Type: matrix.LoginIdentifierTypeUser, User: "john@corp.example"},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := identifierNormalization.mapThirdPartyIdentifier(test.identifier, "example.com"); result != test.expectedUserId {
+				t.Errorf("expected `%s`, got `%s`", test.expectedUserId, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package interceptor
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/totp"
+	"devture-matrix-corporal/corporal/util"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Second-factor stages, which logins by users requiring a second factor (see policy.UserPolicy.Require2fa) need to complete.
+// These are matrix-corporal extensions, which homeservers don't know about.
+const (
+	LoginStageTypeTotp       = "io.devture.corporal.totp"
+	LoginStageTypeBackupCode = "io.devture.corporal.backup_code"
+)
+
+const (
+	// secondFactorSessionTtl is how long clients have for completing the second-factor stage, after the first one
+	secondFactorSessionTtl = 5 * time.Minute
+
+	// secondFactorMaxFailedAttempts is how many invalid codes in a row can be tried for a user (regardless of the session),
+	// before no more codes are accepted for a while (see secondFactorCooldown)
+	secondFactorMaxFailedAttempts = 5
+
+	// secondFactorFailureWindow is how long invalid codes are remembered for (after the last one)
+	secondFactorFailureWindow = 15 * time.Minute
+
+	// secondFactorCooldown is how long no more codes are accepted for a user, after too many invalid ones
+	secondFactorCooldown = 5 * time.Minute
+
+	// secondFactorPruneInterval is how often state which no longer matters gets dropped (see secondFactorState.pruneIfDue)
+	secondFactorPruneInterval = 1 * time.Minute
+)
+
+// Results of secondFactorState.verify
+const (
+	secondFactorSessionUnknown secondFactorVerificationResult = iota
+	secondFactorCodeValid
+	secondFactorCodeInvalid
+	secondFactorAttemptsExhausted
+)
+
+type secondFactorVerificationResult int
+
+type secondFactorSession struct {
+	userId    string
+	expiresAt time.Time
+}
+
+type secondFactorFailures struct {
+	count         int
+	lastFailureAt time.Time
+}
+
+// secondFactorState keeps track of logins waiting for a second factor (see LoginInterceptor.checkSecondFactor),
+// of the invalid codes recently tried for each user (see secondFactorFailureWindow),
+// as well as of the TOTP codes and backup codes which have already been used, so that they cannot be used again.
+//
+// This is in-memory only, so everything is forgotten when matrix-corporal restarts.
+// Used backup codes are best removed from the policy (see policy.UserPolicy.BackupCodeHashes) or replaced by newly provisioned ones.
+type secondFactorState struct {
+	now func() time.Time
+
+	lock                 sync.Mutex
+	sessions             map[string]*secondFactorSession
+	failedAttempts       map[string]*secondFactorFailures
+	cooldownUntil        map[string]time.Time
+	lastUsedTotpSteps    map[string]int64
+	usedBackupCodeHashes map[string]bool
+	lastPrunedAt         time.Time
+}
+
+func newSecondFactorState() *secondFactorState {
+	return &secondFactorState{
+		now:                  time.Now,
+		sessions:             map[string]*secondFactorSession{},
+		failedAttempts:       map[string]*secondFactorFailures{},
+		cooldownUntil:        map[string]time.Time{},
+		lastUsedTotpSteps:    map[string]int64{},
+		usedBackupCodeHashes: map[string]bool{},
+	}
+}
+
+// getCooldownRemaining tells how long no more codes are accepted for the given user for (zero if codes are accepted)
+func (me *secondFactorState) getCooldownRemaining(userId string) time.Duration {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	cooldownUntil, exists := me.cooldownUntil[userId]
+	if !exists {
+		return 0
+	}
+
+	remaining := cooldownUntil.Sub(me.now())
+	if remaining <= 0 {
+		delete(me.cooldownUntil, userId)
+		return 0
+	}
+	return remaining
+}
+
+func (me *secondFactorState) createSession(userId string) (string, error) {
+	sessionIdBytes, err := util.GenerateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	sessionId := hex.EncodeToString(sessionIdBytes)
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	now := me.now()
+	me.pruneIfDue(now)
+
+	me.sessions[sessionId] = &secondFactorSession{
+		userId:    userId,
+		expiresAt: now.Add(secondFactorSessionTtl),
+	}
+
+	return sessionId, nil
+}
+
+// verify checks the code given for the session (which needs to be one created for the user).
+//
+// Sessions end when a code is valid. Invalid codes keep the session going, until too many invalid codes in a row
+// have been tried for the user (across all of their sessions), which ends all of the user's sessions and starts a cooldown.
+func (me *secondFactorState) verify(sessionId string, userId string, secondFactor policy.SecondFactor, auth matrix.ApiLoginRequestAuth) (secondFactorVerificationResult, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	now := me.now()
+	me.pruneIfDue(now)
+
+	session, exists := me.sessions[sessionId]
+	if !exists || session.userId != userId {
+		return secondFactorSessionUnknown, nil
+	}
+	if now.After(session.expiresAt) {
+		delete(me.sessions, sessionId)
+		return secondFactorSessionUnknown, nil
+	}
+
+	isValid, err := me.verifyCode(userId, secondFactor, auth, now)
+	if err != nil {
+		return secondFactorSessionUnknown, err
+	}
+
+	if isValid {
+		delete(me.sessions, sessionId)
+		delete(me.failedAttempts, userId)
+		return secondFactorCodeValid, nil
+	}
+
+	failures, exists := me.failedAttempts[userId]
+	if !exists || failures.isStale(now) {
+		failures = &secondFactorFailures{}
+		me.failedAttempts[userId] = failures
+	}
+	failures.count++
+	failures.lastFailureAt = now
+
+	if failures.count < secondFactorMaxFailedAttempts {
+		return secondFactorCodeInvalid, nil
+	}
+
+	delete(me.failedAttempts, userId)
+	me.cooldownUntil[userId] = now.Add(secondFactorCooldown)
+	for id, session := range me.sessions {
+		if session.userId == userId {
+			delete(me.sessions, id)
+		}
+	}
+
+	return secondFactorAttemptsExhausted, nil
+}
+
+// isStale tells whether the failures are no longer to be counted, as there haven't been any for longer than the failure window
+func (me *secondFactorFailures) isStale(now time.Time) bool {
+	return now.Sub(me.lastFailureAt) > secondFactorFailureWindow
+}
+
+// pruneIfDue drops state which no longer matters (expired sessions and cooldowns, stale failures), so that memory usage doesn't keep growing.
+// This is to be called while holding the lock.
+func (me *secondFactorState) pruneIfDue(now time.Time) {
+	if now.Sub(me.lastPrunedAt) < secondFactorPruneInterval {
+		return
+	}
+	me.lastPrunedAt = now
+
+	for id, session := range me.sessions {
+		if now.After(session.expiresAt) {
+			delete(me.sessions, id)
+		}
+	}
+
+	for userId, failures := range me.failedAttempts {
+		if failures.isStale(now) {
+			delete(me.failedAttempts, userId)
+		}
+	}
+
+	for userId, cooldownUntil := range me.cooldownUntil {
+		if !cooldownUntil.After(now) {
+			delete(me.cooldownUntil, userId)
+		}
+	}
+}
+
+func (me *secondFactorState) verifyCode(userId string, secondFactor policy.SecondFactor, auth matrix.ApiLoginRequestAuth, now time.Time) (bool, error) {
+	switch auth.Type {
+	case LoginStageTypeTotp:
+		if secondFactor.TotpSecret == "" {
+			return false, nil
+		}
+
+		step, isValid, err := totp.Verify(secondFactor.TotpSecret, auth.Code, now, me.lastUsedTotpSteps[userId])
+		if err != nil || !isValid {
+			return false, err
+		}
+
+		me.lastUsedTotpSteps[userId] = step
+
+		return true, nil
+	case LoginStageTypeBackupCode:
+		hash := totp.HashBackupCode(auth.Code)
+
+		usedKey := userId + "\x00" + hash
+		if me.usedBackupCodeHashes[usedKey] {
+			return false, nil
+		}
+
+		for _, backupCodeHash := range secondFactor.BackupCodeHashes {
+			if strings.ToLower(backupCodeHash) == hash {
+				me.usedBackupCodeHashes[usedKey] = true
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// checkSecondFactor makes logins by users requiring a second factor (see policy.UserPolicy.Require2fa) go through an additional stage,
+// in the style of User-Interactive Authentication.
+// The second factor is the one provisioned via the HTTP API (see SetSecondFactorStore) or, if there's none, the one in the user's policy.
+//
+// Once the first stage (the password, already checked by the time this is called) is completed, clients get a 401 response
+// with a session id, listing the second-factor stages (LoginStageType*).
+// Clients then repeat the same login request, with an `auth` object containing the session id, the stage type and the code.
+// Invalid codes get the same session id back, so that they count towards the same limit (see secondFactorMaxFailedAttempts).
+//
+// A nil response means that the second factor was valid and the login can proceed.
+// Otherwise, the response is to be returned and the boolean tells whether it's for an invalid code (which counts as a failed attempt).
+func (me *LoginInterceptor) checkSecondFactor(
+	auth *matrix.ApiLoginRequestAuth,
+	userPolicy *policy.UserPolicy,
+	loggingContextFields logrus.Fields,
+) (*InterceptorResponse, bool) {
+	secondFactor := me.secondFactorStore.GetForUser(userPolicy)
+
+	if secondFactor.TotpSecret == "" && len(secondFactor.BackupCodeHashes) == 0 {
+		response := createInterceptorErrorResponse(
+			loggingContextFields,
+			matrix.ErrorForbidden,
+			"Two-factor authentication is required, but has not been set up for this account",
+		)
+		return &response, false
+	}
+
+	cooldownRemaining := me.secondFactorState.getCooldownRemaining(userPolicy.Id)
+	if cooldownRemaining > 0 {
+		response := createInterceptorRatelimitedResponse(loggingContextFields, "Too many invalid second factors, try again later", cooldownRemaining)
+		return &response, false
+	}
+
+	if auth == nil || auth.Session == "" {
+		return me.createNewSecondFactorStageResponse(userPolicy.Id, secondFactor, loggingContextFields, "", ""), false
+	}
+
+	loggingContextFields["secondFactorType"] = auth.Type
+
+	result, err := me.secondFactorState.verify(auth.Session, userPolicy.Id, secondFactor, *auth)
+	if err != nil {
+		loggingContextFields["err"] = err.Error()
+		response := createInterceptorErrorResponse(loggingContextFields, matrix.ErrorUnknown, "Internal authenticator error")
+		return &response, false
+	}
+
+	switch result {
+	case secondFactorCodeValid:
+		return nil, false
+	case secondFactorCodeInvalid:
+		response := createSecondFactorStageResponse(secondFactor, auth.Session, loggingContextFields, matrix.ErrorForbidden, "Invalid second factor")
+		return &response, true
+	case secondFactorAttemptsExhausted:
+		response := createInterceptorRatelimitedResponse(loggingContextFields, "Too many invalid second factors, try again later", secondFactorCooldown)
+		return &response, true
+	}
+
+	return me.createNewSecondFactorStageResponse(userPolicy.Id, secondFactor, loggingContextFields, matrix.ErrorForbidden, "Unknown or expired session, try again"), false
+}
+
+// createNewSecondFactorStageResponse creates the response asking for the second factor, with a new session
+func (me *LoginInterceptor) createNewSecondFactorStageResponse(
+	userId string,
+	secondFactor policy.SecondFactor,
+	loggingContextFields logrus.Fields,
+	errorCode string,
+	errorMessage string,
+) *InterceptorResponse {
+	sessionId, err := me.secondFactorState.createSession(userId)
+	if err != nil {
+		loggingContextFields["err"] = err.Error()
+		response := createInterceptorErrorResponse(loggingContextFields, matrix.ErrorUnknown, "Internal error")
+		return &response
+	}
+
+	response := createSecondFactorStageResponse(secondFactor, sessionId, loggingContextFields, errorCode, errorMessage)
+	return &response
+}
+
+// createSecondFactorStageResponse creates the response asking for the second factor for the given session
+func createSecondFactorStageResponse(
+	secondFactor policy.SecondFactor,
+	sessionId string,
+	loggingContextFields logrus.Fields,
+	errorCode string,
+	errorMessage string,
+) InterceptorResponse {
+	var flows []matrix.ApiUserInteractiveAuthFlow
+	if secondFactor.TotpSecret != "" {
+		flows = append(flows, matrix.ApiUserInteractiveAuthFlow{Stages: []string{matrix.LoginTypePassword, LoginStageTypeTotp}})
+	}
+	if len(secondFactor.BackupCodeHashes) != 0 {
+		flows = append(flows, matrix.ApiUserInteractiveAuthFlow{Stages: []string{matrix.LoginTypePassword, LoginStageTypeBackupCode}})
+	}
+
+	if errorMessage != "" {
+		loggingContextFields["secondFactorError"] = errorMessage
+	}
+
+	return InterceptorResponse{
+		Result:               InterceptorResultRespond,
+		LoggingContextFields: loggingContextFields,
+		HttpStatusCode:       http.StatusUnauthorized,
+		ResponsePayload: matrix.ApiUserInteractiveAuthResponse{
+			Flows:        flows,
+			Completed:    []string{matrix.LoginTypePassword},
+			Params:       map[string]map[string]interface{}{},
+			Session:      sessionId,
+			ErrorCode:    errorCode,
+			ErrorMessage: errorMessage,
+		},
+	}
+}
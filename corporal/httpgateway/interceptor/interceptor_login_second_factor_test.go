@@ -0,0 +1,314 @@
+package interceptor
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/totp"
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testClock is a clock which only moves when told to
+type testClock struct {
+	now time.Time
+}
+
+func (me *testClock) Now() time.Time {
+	return me.now
+}
+
+// createTestSecondFactorInterceptor creates an interceptor whose second-factor checks happen as of the time of the first RFC 6238 test vector,
+// at which `287082` is the valid TOTP code for the returned user policy.
+func createTestSecondFactorInterceptor() (*LoginInterceptor, *testClock, *policy.UserPolicy, []string) {
+	clock := &testClock{now: time.Unix(59, 0)}
+
+	state := newSecondFactorState()
+	state.now = clock.Now
+
+	backupCodes, backupCodeHashes, err := totp.GenerateBackupCodes(2)
+	if err != nil {
+		panic(err)
+	}
+
+	userPolicy := &policy.UserPolicy{
+		Id:               "@john:example.com",
+		Require2fa:       true,
+		TotpSecret:       base32.StdEncoding.EncodeToString([]byte("12345678901234567890")),
+		BackupCodeHashes: backupCodeHashes,
+	}
+
+	return &LoginInterceptor{secondFactorState: state}, clock, userPolicy, backupCodes
+}
+
+// startSecondFactorSession makes a login request without an `auth` object, returning the session that the response asks to continue with
+func startSecondFactorSession(t *testing.T, interceptor *LoginInterceptor, userPolicy *policy.UserPolicy) string {
+	response, isFailedAttempt := interceptor.checkSecondFactor(nil, userPolicy, logrus.Fields{})
+	if response == nil || isFailedAttempt {
+		t.Fatalf("expected a second-factor stage response, got %#v (failed attempt: %t)", response, isFailedAttempt)
+	}
+
+	return assertSecondFactorStageResponse(t, response, "")
+}
+
+// assertSecondFactorStageResponse checks that the response asks for the second factor (with the given error code), returning its session
+func assertSecondFactorStageResponse(t *testing.T, response *InterceptorResponse, expectedErrorCode string) string {
+	t.Helper()
+
+	if response == nil || response.Result != InterceptorResultRespond || response.HttpStatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a 401 second-factor stage response, got %#v", response)
+	}
+
+	payload := response.ResponsePayload.(matrix.ApiUserInteractiveAuthResponse)
+	if payload.ErrorCode != expectedErrorCode {
+		t.Fatalf("expected error code `%s`, got `%s`", expectedErrorCode, payload.ErrorCode)
+	}
+	if payload.Session == "" {
+		t.Fatalf("expected a session")
+	}
+
+	return payload.Session
+}
+
+func assertRatelimitedResponse(t *testing.T, response *InterceptorResponse) {
+	t.Helper()
+
+	if response == nil || response.Result != InterceptorResultDeny || response.ErrorCode != matrix.ErrorLimitExceeded || response.RetryAfter <= 0 {
+		t.Fatalf("expected a ratelimited response, got %#v", response)
+	}
+}
+
+func TestSecondFactorAcceptsValidTotpCode(t *testing.T) {
+	interceptor, _, userPolicy, _ := createTestSecondFactorInterceptor()
+
+	session := startSecondFactorSession(t, interceptor, userPolicy)
+
+	response, _ := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "287082"}, userPolicy, logrus.Fields{})
+	if response != nil {
+		t.Fatalf("expected the code to be accepted, got %#v", response)
+	}
+
+	// The session is over
+	response, isFailedAttempt := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "287082"}, userPolicy, logrus.Fields{})
+	newSession := assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden)
+	if newSession == session || isFailedAttempt {
+		t.Errorf("expected a new session (and no failed attempt) after the previous one ended")
+	}
+}
+
+func TestSecondFactorRejectsReplayedTotpCode(t *testing.T) {
+	interceptor, _, userPolicy, _ := createTestSecondFactorInterceptor()
+
+	session := startSecondFactorSession(t, interceptor, userPolicy)
+	response, _ := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "287082"}, userPolicy, logrus.Fields{})
+	if response != nil {
+		t.Fatalf("expected the code to be accepted, got %#v", response)
+	}
+
+	session = startSecondFactorSession(t, interceptor, userPolicy)
+	response, isFailedAttempt := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "287082"}, userPolicy, logrus.Fields{})
+	assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden)
+	if !isFailedAttempt {
+		t.Errorf("expected the replayed code to count as a failed attempt")
+	}
+}
+
+func TestSecondFactorBackupCodesAreSingleUse(t *testing.T) {
+	interceptor, _, userPolicy, backupCodes := createTestSecondFactorInterceptor()
+
+	session := startSecondFactorSession(t, interceptor, userPolicy)
+	response, _ := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeBackupCode, Session: session, Code: backupCodes[0]}, userPolicy, logrus.Fields{})
+	if response != nil {
+		t.Fatalf("expected the backup code to be accepted, got %#v", response)
+	}
+
+	session = startSecondFactorSession(t, interceptor, userPolicy)
+	response, isFailedAttempt := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeBackupCode, Session: session, Code: backupCodes[0]}, userPolicy, logrus.Fields{})
+	assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden)
+	if !isFailedAttempt {
+		t.Errorf("expected the reused backup code to count as a failed attempt")
+	}
+
+	// The other backup code still works
+	response, _ = interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeBackupCode, Session: session, Code: backupCodes[1]}, userPolicy, logrus.Fields{})
+	if response != nil {
+		t.Fatalf("expected the other backup code to be accepted, got %#v", response)
+	}
+}
+
+func TestSecondFactorInvalidCodesAreLimited(t *testing.T) {
+	interceptor, clock, userPolicy, _ := createTestSecondFactorInterceptor()
+
+	session := startSecondFactorSession(t, interceptor, userPolicy)
+
+	for attempt := 1; attempt < secondFactorMaxFailedAttempts; attempt++ {
+		response, isFailedAttempt := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "000000"}, userPolicy, logrus.Fields{})
+		if !isFailedAttempt {
+			t.Fatalf("attempt %d: expected a failed attempt", attempt)
+		}
+		if continuedSession := assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden); continuedSession != session {
+			t.Fatalf("attempt %d: expected the session to be continued, got a new one", attempt)
+		}
+	}
+
+	response, isFailedAttempt := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "000000"}, userPolicy, logrus.Fields{})
+	assertRatelimitedResponse(t, response)
+	if !isFailedAttempt {
+		t.Errorf("expected the last invalid code to count as a failed attempt")
+	}
+
+	// Even valid codes are not accepted during the cooldown, neither in a new session nor in the old one
+	response, _ = interceptor.checkSecondFactor(nil, userPolicy, logrus.Fields{})
+	assertRatelimitedResponse(t, response)
+	response, _ = interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "287082"}, userPolicy, logrus.Fields{})
+	assertRatelimitedResponse(t, response)
+
+	// Long after the cooldown, at the time of another RFC 6238 test vector
+	clock.now = time.Unix(1111111109, 0)
+
+	// The old session has ended, so a new one is needed
+	response, _ = interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "081804"}, userPolicy, logrus.Fields{})
+	session = assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden)
+
+	response, _ = interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "081804"}, userPolicy, logrus.Fields{})
+	if response != nil {
+		t.Fatalf("expected the code to be accepted after the cooldown, got %#v", response)
+	}
+}
+
+func TestSecondFactorInvalidCodesCountAcrossSessions(t *testing.T) {
+	interceptor, _, userPolicy, _ := createTestSecondFactorInterceptor()
+
+	for attempt := 1; attempt < secondFactorMaxFailedAttempts; attempt++ {
+		session := startSecondFactorSession(t, interceptor, userPolicy)
+		response, _ := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "000000"}, userPolicy, logrus.Fields{})
+		assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden)
+	}
+
+	session := startSecondFactorSession(t, interceptor, userPolicy)
+	response, _ := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "000000"}, userPolicy, logrus.Fields{})
+	assertRatelimitedResponse(t, response)
+}
+
+func TestSecondFactorSessionsExpire(t *testing.T) {
+	interceptor, clock, userPolicy, _ := createTestSecondFactorInterceptor()
+
+	session := startSecondFactorSession(t, interceptor, userPolicy)
+
+	clock.now = clock.now.Add(secondFactorSessionTtl + time.Second)
+
+	response, isFailedAttempt := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "287082"}, userPolicy, logrus.Fields{})
+	newSession := assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden)
+	if newSession == session || isFailedAttempt {
+		t.Errorf("expected a new session (and no failed attempt) for an expired session")
+	}
+}
+
+func TestSecondFactorSessionsAreBoundToUsers(t *testing.T) {
+	interceptor, _, userPolicy, _ := createTestSecondFactorInterceptor()
+
+	session := startSecondFactorSession(t, interceptor, userPolicy)
+
+	otherUserPolicy := *userPolicy
+	otherUserPolicy.Id = "@other:example.com"
+
+	response, _ := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "287082"}, &otherUserPolicy, logrus.Fields{})
+	if otherSession := assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden); otherSession == session {
+		t.Errorf("expected another user's session not to be usable")
+	}
+}
+
+func TestSecondFactorRequiresSetup(t *testing.T) {
+	interceptor, _, userPolicy, _ := createTestSecondFactorInterceptor()
+
+	userPolicy.TotpSecret = ""
+	userPolicy.BackupCodeHashes = nil
+
+	response, _ := interceptor.checkSecondFactor(nil, userPolicy, logrus.Fields{})
+	if response == nil || response.Result != InterceptorResultDeny || response.ErrorCode != matrix.ErrorForbidden {
+		t.Fatalf("expected a denial, got %#v", response)
+	}
+}
+
+func TestSecondFactorInvalidCodesAreForgottenAfterTheFailureWindow(t *testing.T) {
+	interceptor, clock, userPolicy, _ := createTestSecondFactorInterceptor()
+
+	session := startSecondFactorSession(t, interceptor, userPolicy)
+	for attempt := 1; attempt < secondFactorMaxFailedAttempts; attempt++ {
+		response, _ := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "000000"}, userPolicy, logrus.Fields{})
+		assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden)
+	}
+
+	clock.now = clock.now.Add(secondFactorFailureWindow + time.Second)
+
+	// The earlier invalid codes no longer count, so this one doesn't start a cooldown
+	session = startSecondFactorSession(t, interceptor, userPolicy)
+	response, _ := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "000000"}, userPolicy, logrus.Fields{})
+	assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden)
+
+	if failures := interceptor.secondFactorState.failedAttempts[userPolicy.Id]; failures == nil || failures.count != 1 {
+		t.Errorf("expected the failure count to start over, got %#v", failures)
+	}
+}
+
+func TestSecondFactorStateIsPruned(t *testing.T) {
+	interceptor, clock, userPolicy, _ := createTestSecondFactorInterceptor()
+	state := interceptor.secondFactorState
+
+	for i := 0; i < 100; i++ {
+		otherUserPolicy := *userPolicy
+		otherUserPolicy.Id = fmt.Sprintf("@user%d:example.com", i)
+
+		session := startSecondFactorSession(t, interceptor, &otherUserPolicy)
+		interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "000000"}, &otherUserPolicy, logrus.Fields{})
+	}
+	if len(state.failedAttempts) != 100 || len(state.sessions) != 100 {
+		t.Fatalf("expected failures and sessions for all users, got %d and %d", len(state.failedAttempts), len(state.sessions))
+	}
+
+	clock.now = clock.now.Add(secondFactorFailureWindow + time.Second)
+	startSecondFactorSession(t, interceptor, userPolicy)
+
+	if len(state.failedAttempts) != 0 || len(state.sessions) != 1 {
+		t.Errorf("expected stale failures and expired sessions to be dropped, got %d and %d", len(state.failedAttempts), len(state.sessions))
+	}
+}
+
+func TestSecondFactorPrefersStoredSecondFactors(t *testing.T) {
+	interceptor, _, userPolicy, _ := createTestSecondFactorInterceptor()
+
+	secondFactorStore, err := policy.NewSecondFactorStore("", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	interceptor.SetSecondFactorStore(secondFactorStore)
+
+	backupCodes, backupCodeHashes, err := totp.GenerateBackupCodes(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = secondFactorStore.Set(userPolicy.Id, policy.SecondFactor{BackupCodeHashes: backupCodeHashes})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The policy's TOTP secret is not used, as the stored second factor replaces it
+	session := startSecondFactorSession(t, interceptor, userPolicy)
+	response, isFailedAttempt := interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeTotp, Session: session, Code: "287082"}, userPolicy, logrus.Fields{})
+	assertSecondFactorStageResponse(t, response, matrix.ErrorForbidden)
+	if !isFailedAttempt {
+		t.Errorf("expected the policy's TOTP code to be rejected")
+	}
+	if flows := response.ResponsePayload.(matrix.ApiUserInteractiveAuthResponse).Flows; len(flows) != 1 || flows[0].Stages[1] != LoginStageTypeBackupCode {
+		t.Errorf("expected only the backup code stage to be offered, got %#v", flows)
+	}
+
+	response, _ = interceptor.checkSecondFactor(&matrix.ApiLoginRequestAuth{Type: LoginStageTypeBackupCode, Session: session, Code: backupCodes[0]}, userPolicy, logrus.Fields{})
+	if response != nil {
+		t.Fatalf("expected the stored backup code to be accepted, got %#v", response)
+	}
+}
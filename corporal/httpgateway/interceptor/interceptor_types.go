@@ -2,6 +2,7 @@ package interceptor
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -11,6 +12,9 @@ type InterceptorResult int
 const (
 	InterceptorResultProxy InterceptorResult = iota
 	InterceptorResultDeny
+
+	// InterceptorResultRespond makes the request get responded to with InterceptorResponse.ResponsePayload (instead of getting proxied)
+	InterceptorResultRespond
 )
 
 type InterceptorResponse struct {
@@ -20,6 +24,13 @@ type InterceptorResponse struct {
 
 	ErrorCode    string
 	ErrorMessage string
+
+	// RetryAfter (if non-zero) tells denied clients that they're being ratelimited and how long to wait before retrying
+	RetryAfter time.Duration
+
+	// HttpStatusCode and ResponsePayload are what gets responded with, for InterceptorResultRespond
+	HttpStatusCode  int
+	ResponsePayload interface{}
 }
 
 type Interceptor interface {
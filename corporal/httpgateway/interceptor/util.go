@@ -1,6 +1,9 @@
 package interceptor
 
 import (
+	"devture-matrix-corporal/corporal/matrix"
+	"time"
+
 	"github.com/sirupsen/logrus"
 )
 
@@ -12,3 +15,10 @@ func createInterceptorErrorResponse(loggingContextFields logrus.Fields, errorCod
 		ErrorMessage:         errorMessage,
 	}
 }
+
+// createInterceptorRatelimitedResponse denies the request, telling the client to retry after a while (see InterceptorResponse.RetryAfter)
+func createInterceptorRatelimitedResponse(loggingContextFields logrus.Fields, errorMessage string, retryAfter time.Duration) InterceptorResponse {
+	response := createInterceptorErrorResponse(loggingContextFields, matrix.ErrorLimitExceeded, errorMessage)
+	response.RetryAfter = retryAfter
+	return response
+}
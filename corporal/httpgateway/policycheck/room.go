@@ -5,7 +5,9 @@ import (
 	"devture-matrix-corporal/corporal/httphelp"
 	"devture-matrix-corporal/corporal/matrix"
 	"devture-matrix-corporal/corporal/policy"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/gomatrix"
@@ -15,6 +17,10 @@ import (
 func CheckRoomCreate(r *http.Request, ctx context.Context, policy policy.Policy, checker policy.Checker) PolicyCheckResponse {
 	userId := ctx.Value("userId").(string)
 
+	if !checker.CanUserSendEvents(policy, userId) {
+		return createReadOnlyPolicyCheckResponse()
+	}
+
 	if !checker.CanUserCreateRoom(policy, userId) {
 		return PolicyCheckResponse{
 			Allow:        false,
@@ -33,6 +39,29 @@ func CheckRoomCreate(r *http.Request, ctx context.Context, policy policy.Policy,
 		}
 	}
 
+	// gomatrix.ReqCreateRoom doesn't know about `room_version`, so we parse it separately.
+	var roomVersionRequest struct {
+		RoomVersion string `json:"room_version"`
+	}
+	err = httphelp.GetJsonFromRequestBody(r, &roomVersionRequest)
+	if err != nil {
+		return PolicyCheckResponse{
+			Allow:        false,
+			ErrorCode:    matrix.ErrorBadJson,
+			ErrorMessage: err.Error(),
+		}
+	}
+
+	// When `room_version` is omitted, the homeserver uses its default room version.
+	// We can't know what that is, so we only check explicitly requested versions.
+	if roomVersionRequest.RoomVersion != "" && !checker.CanUserUseRoomVersion(policy, userId, roomVersionRequest.RoomVersion) {
+		return PolicyCheckResponse{
+			Allow:        false,
+			ErrorCode:    matrix.ErrorForbidden,
+			ErrorMessage: fmt.Sprintf("Denied by policy (cannot use room version %s)", roomVersionRequest.RoomVersion),
+		}
+	}
+
 	isEncrypted := false
 	for _, stateEvent := range creationRequest.InitialState {
 		if stateEvent.Type == "m.room.encryption" {
@@ -64,10 +93,47 @@ func CheckRoomCreate(r *http.Request, ctx context.Context, policy policy.Policy,
 	}
 }
 
+// CheckRoomUpgrade is a policy checker for: /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/upgrade
+func CheckRoomUpgrade(r *http.Request, ctx context.Context, policy policy.Policy, checker policy.Checker) PolicyCheckResponse {
+	userId := ctx.Value("userId").(string)
+
+	if !checker.CanUserSendEvents(policy, userId) {
+		return createReadOnlyPolicyCheckResponse()
+	}
+
+	var upgradeRequest struct {
+		NewVersion string `json:"new_version"`
+	}
+	err := httphelp.GetJsonFromRequestBody(r, &upgradeRequest)
+	if err != nil {
+		return PolicyCheckResponse{
+			Allow:        false,
+			ErrorCode:    matrix.ErrorBadJson,
+			ErrorMessage: err.Error(),
+		}
+	}
+
+	if !checker.CanUserUseRoomVersion(policy, userId, upgradeRequest.NewVersion) {
+		return PolicyCheckResponse{
+			Allow:        false,
+			ErrorCode:    matrix.ErrorForbidden,
+			ErrorMessage: fmt.Sprintf("Denied by policy (cannot use room version %s)", upgradeRequest.NewVersion),
+		}
+	}
+
+	return PolicyCheckResponse{
+		Allow: true,
+	}
+}
+
 // CheckRoomEncryptionStateChange is a policy checker for: /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/state/m.room.encryption
 func CheckRoomEncryptionStateChange(r *http.Request, ctx context.Context, policy policy.Policy, checker policy.Checker) PolicyCheckResponse {
 	userId := ctx.Value("userId").(string)
 
+	if !checker.CanUserSendEvents(policy, userId) {
+		return createReadOnlyPolicyCheckResponse()
+	}
+
 	if !checker.CanUserCreateEncryptedRoom(policy, userId) {
 		return PolicyCheckResponse{
 			Allow:        false,
@@ -81,6 +147,41 @@ func CheckRoomEncryptionStateChange(r *http.Request, ctx context.Context, policy
 	}
 }
 
+// CheckRoomStateChange is a policy checker for: /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/state/{eventType}
+//
+// It's only meant to be used for state event types that room policies can enforce (see policy.RoomPolicy).
+func CheckRoomStateChange(r *http.Request, ctx context.Context, policy policy.Policy, checker policy.Checker) PolicyCheckResponse {
+	userId := ctx.Value("userId").(string)
+	roomId := mux.Vars(r)["roomId"]
+	eventType := mux.Vars(r)["eventType"]
+
+	if !checker.CanUserSendEvents(policy, userId) {
+		return createReadOnlyPolicyCheckResponse()
+	}
+
+	var content map[string]interface{}
+	err := httphelp.GetJsonFromRequestBody(r, &content)
+	if err != nil {
+		return PolicyCheckResponse{
+			Allow:        false,
+			ErrorCode:    matrix.ErrorBadJson,
+			ErrorMessage: err.Error(),
+		}
+	}
+
+	if !checker.CanUserSetRoomState(policy, userId, roomId, eventType, content) {
+		return PolicyCheckResponse{
+			Allow:        false,
+			ErrorCode:    matrix.ErrorForbidden,
+			ErrorMessage: fmt.Sprintf("Denied by policy (%s in this room cannot go against the policy)", eventType),
+		}
+	}
+
+	return PolicyCheckResponse{
+		Allow: true,
+	}
+}
+
 // CheckRoomSendEvent is a policy checker for: /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/send/{eventType}/{txnId}
 func CheckRoomSendEvent(r *http.Request, ctx context.Context, policy policy.Policy, checker policy.Checker) PolicyCheckResponse {
 	userId := ctx.Value("userId").(string)
@@ -100,6 +201,66 @@ func CheckRoomSendEvent(r *http.Request, ctx context.Context, policy policy.Poli
 	}
 }
 
+// CheckRoomJoin is a policy checker for:
+// - /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/join
+// - /_matrix/client/{apiVersion:(r0|v3)}/join/{roomIdOrAlias}
+// - /_matrix/client/{apiVersion:(r0|v3)}/knock/{roomIdOrAlias}
+//
+// Accepting an invite is also done by joining, so this covers invites too.
+func CheckRoomJoin(r *http.Request, ctx context.Context, policy policy.Policy, checker policy.Checker) PolicyCheckResponse {
+	userId := ctx.Value("userId").(string)
+
+	roomIdOrAlias := mux.Vars(r)["roomId"]
+	if roomIdOrAlias == "" {
+		roomIdOrAlias = mux.Vars(r)["roomIdOrAlias"]
+	}
+
+	if checker.CanUserJoinRoom(policy, userId, roomIdOrAlias) {
+		return PolicyCheckResponse{
+			Allow: true,
+		}
+	}
+
+	if strings.HasPrefix(roomIdOrAlias, "#") {
+		// We can't tell which room an alias points to, so we can't allow it for users restricted to certain rooms.
+		return PolicyCheckResponse{
+			Allow:        false,
+			ErrorCode:    matrix.ErrorForbidden,
+			ErrorMessage: "Denied by policy (rooms can only be joined by room id)",
+		}
+	}
+
+	return PolicyCheckResponse{
+		Allow:        false,
+		ErrorCode:    matrix.ErrorForbidden,
+		ErrorMessage: "Denied by policy (cannot join rooms other than the ones you're supposed to be in)",
+	}
+}
+
+// CheckRoomEventSending is a policy checker for endpoints which send events into rooms and which don't have a more specific checker:
+// - /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/state/{eventType}/{stateKey}
+// - /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/redact/{eventId}/{txnId}
+// - /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/{action:(invite|ban|unban)}
+func CheckRoomEventSending(r *http.Request, ctx context.Context, policy policy.Policy, checker policy.Checker) PolicyCheckResponse {
+	userId := ctx.Value("userId").(string)
+
+	if !checker.CanUserSendEvents(policy, userId) {
+		return createReadOnlyPolicyCheckResponse()
+	}
+
+	return PolicyCheckResponse{
+		Allow: true,
+	}
+}
+
+func createReadOnlyPolicyCheckResponse() PolicyCheckResponse {
+	return PolicyCheckResponse{
+		Allow:        false,
+		ErrorCode:    matrix.ErrorForbidden,
+		ErrorMessage: "Denied by policy (read-only users cannot send events)",
+	}
+}
+
 // CheckRoomLeave is a policy checker for: /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/leave
 func CheckRoomLeave(r *http.Request, ctx context.Context, policy policy.Policy, checker policy.Checker) PolicyCheckResponse {
 	userId := ctx.Value("userId").(string)
@@ -125,8 +286,12 @@ func CheckRoomMembershipStateChange(r *http.Request, ctx context.Context, policy
 	memberId := mux.Vars(r)["memberId"]
 
 	if userId != memberId {
-		// Someone is trying to update the membership details of another member.
-		// Let it go through and let the upstream server's policies apply, whatever they may be.
+		// Someone is trying to update the membership details of another member (inviting, banning, etc.).
+		// Unless the user is read-only, let it go through and let the upstream server's policies apply, whatever they may be.
+		if !checker.CanUserSendEvents(policy, userId) {
+			return createReadOnlyPolicyCheckResponse()
+		}
+
 		return PolicyCheckResponse{
 			Allow: true,
 		}
@@ -146,6 +311,36 @@ func CheckRoomMembershipStateChange(r *http.Request, ctx context.Context, policy
 		}
 	}
 
+	// Joining (or knocking) this way has to go through the same checks as the dedicated join APIs.
+	var membershipRequest struct {
+		Membership string `json:"membership"`
+	}
+	err := httphelp.GetJsonFromRequestBody(r, &membershipRequest)
+	if err != nil {
+		return PolicyCheckResponse{
+			Allow:        false,
+			ErrorCode:    matrix.ErrorBadJson,
+			ErrorMessage: err.Error(),
+		}
+	}
+
+	// Read-only users can still join and leave rooms, but not do anything else (changing their in-room name or avatar, etc.).
+	if membershipRequest.Membership != "join" && membershipRequest.Membership != "leave" {
+		if !checker.CanUserSendEvents(policy, userId) {
+			return createReadOnlyPolicyCheckResponse()
+		}
+	}
+
+	if membershipRequest.Membership == "join" || membershipRequest.Membership == "knock" {
+		if !checker.CanUserJoinRoom(policy, userId, roomId) {
+			return PolicyCheckResponse{
+				Allow:        false,
+				ErrorCode:    matrix.ErrorForbidden,
+				ErrorMessage: "Denied by policy (cannot join rooms other than the ones you're supposed to be in)",
+			}
+		}
+	}
+
 	return PolicyCheckResponse{
 		Allow: true,
 	}
@@ -156,6 +351,10 @@ func CheckRoomKick(r *http.Request, ctx context.Context, policy policy.Policy, c
 	userId := ctx.Value("userId").(string)
 	roomId := mux.Vars(r)["roomId"]
 
+	if !checker.CanUserSendEvents(policy, userId) {
+		return createReadOnlyPolicyCheckResponse()
+	}
+
 	if checker.CanUserChangeOwnMembershipStateInRoom(policy, userId, roomId) {
 		// As an optimization, leave early if the current user can change own membership state.
 		//
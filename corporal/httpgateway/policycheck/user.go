@@ -90,3 +90,28 @@ func CheckUserSetPassword(r *http.Request, ctx context.Context, policyObj policy
 		ErrorMessage: "Denied: non-passthrough users are always authenticated against matrix-corporal, so password resets make no sense",
 	}
 }
+
+// CheckUser3pidChange is a policy checker for the various 3pid-modifying routes at: /_matrix/client/{apiVersion:(r0|v3)}/account/3pid/*
+func CheckUser3pidChange(r *http.Request, ctx context.Context, policy policy.Policy, checker policy.Checker) PolicyCheckResponse {
+	userId, ok := ctx.Value("userId").(string)
+	if !ok {
+		// Unauthenticated request. Only the `requestToken` routes let these through.
+		// Requesting a validation token does not change anything by itself.
+		// Actually adding the 3pid afterwards requires authentication, so we'll get a chance to police it then.
+		return PolicyCheckResponse{
+			Allow: true,
+		}
+	}
+
+	if !checker.CanUserChange3pids(policy, userId) {
+		return PolicyCheckResponse{
+			Allow:        false,
+			ErrorCode:    matrix.ErrorForbidden,
+			ErrorMessage: "Denied by policy (cannot change 3pids)",
+		}
+	}
+
+	return PolicyCheckResponse{
+		Allow: true,
+	}
+}
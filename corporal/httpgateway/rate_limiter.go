@@ -0,0 +1,86 @@
+package httpgateway
+
+import (
+	"devture-matrix-corporal/corporal/policy"
+	"sync"
+	"time"
+)
+
+// rateLimiterPruneInterval is how often buckets which no longer matter get dropped (see userRateLimiter.pruneIfDue)
+const rateLimiterPruneInterval = 1 * time.Minute
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+
+	// refilledAt tells when the bucket becomes full again (at which point it's no different than a new bucket)
+	refilledAt time.Time
+}
+
+// userRateLimiter keeps a token bucket per user, refilled according to the rate limit that applies to the user at the time of each request.
+//
+// This is in-memory only, so everything is forgotten when matrix-corporal restarts.
+type userRateLimiter struct {
+	now func() time.Time
+
+	lock         sync.Mutex
+	buckets      map[string]*tokenBucket
+	lastPrunedAt time.Time
+}
+
+func newUserRateLimiter() *userRateLimiter {
+	return &userRateLimiter{
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// Allow takes a token from the user's bucket, telling whether there was one.
+// If there wasn't, it also tells how long it takes until there is.
+func (me *userRateLimiter) Allow(userId string, rateLimit policy.UnmanagedUserRateLimit) (bool, time.Duration) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	now := me.now()
+
+	me.pruneIfDue(now)
+
+	burst := float64(rateLimit.Burst)
+
+	bucket, exists := me.buckets[userId]
+	if !exists {
+		bucket = &tokenBucket{tokens: burst, updatedAt: now}
+		me.buckets[userId] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.updatedAt).Seconds() * rateLimit.RequestsPerSecond
+	if bucket.tokens > burst {
+		// The rate limit may have been lowered since the last request
+		bucket.tokens = burst
+	}
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		missingTokens := 1 - bucket.tokens
+		return false, time.Duration(missingTokens / rateLimit.RequestsPerSecond * float64(time.Second))
+	}
+
+	bucket.tokens--
+	bucket.refilledAt = now.Add(time.Duration((burst - bucket.tokens) / rateLimit.RequestsPerSecond * float64(time.Second)))
+
+	return true, 0
+}
+
+// pruneIfDue drops buckets which have been refilled, so that memory usage doesn't keep growing
+func (me *userRateLimiter) pruneIfDue(now time.Time) {
+	if now.Sub(me.lastPrunedAt) < rateLimiterPruneInterval {
+		return
+	}
+	me.lastPrunedAt = now
+
+	for userId, bucket := range me.buckets {
+		if !bucket.refilledAt.After(now) {
+			delete(me.buckets, userId)
+		}
+	}
+}
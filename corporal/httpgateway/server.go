@@ -16,6 +16,7 @@ type Server struct {
 	configuration       configuration.HttpGateway
 	handlerRegistrators []httphelp.HandlerRegistrator
 	writeTimeout        time.Duration
+	middlewares         []mux.MiddlewareFunc
 
 	server *http.Server
 }
@@ -36,6 +37,12 @@ func NewServer(
 	}
 }
 
+// AddMiddleware adds a middleware that all requests go through (before reaching any of the handlers).
+// This is to be called before Start.
+func (me *Server) AddMiddleware(middleware mux.MiddlewareFunc) {
+	me.middlewares = append(me.middlewares, middleware)
+}
+
 func (me *Server) Start() error {
 	me.server = &http.Server{
 		Handler:      me.createRouter(),
@@ -69,6 +76,7 @@ func (me *Server) createRouter() http.Handler {
 	r := mux.NewRouter()
 
 	r.Use(denyUnsupportedApiVersionsMiddleware)
+	r.Use(me.middlewares...)
 
 	for _, registrator := range me.handlerRegistrators {
 		registrator.RegisterRoutesWithRouter(r)
@@ -0,0 +1,102 @@
+package httpgateway
+
+import (
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/policy"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UnmanagedUserRestrictor restricts which routes unmanaged users can access and how many requests they can make
+// (see policy.UnmanagedUserDefaults.AllowedRoutes and policy.UnmanagedUserDefaults.RateLimit).
+//
+// It applies to all requests coming through the gateway, be it ones that we handle (policy-checked, login, etc.) or ones we proxy as-is.
+// Requests which are not authenticated (or which fail to be) are left for the handlers to deal with.
+type UnmanagedUserRestrictor struct {
+	logger              *logrus.Logger
+	policyStore         *policy.Store
+	policyChecker       *policy.Checker
+	userMappingResolver *matrix.UserMappingResolver
+
+	rateLimiter *userRateLimiter
+}
+
+func NewUnmanagedUserRestrictor(
+	logger *logrus.Logger,
+	policyStore *policy.Store,
+	policyChecker *policy.Checker,
+	userMappingResolver *matrix.UserMappingResolver,
+) *UnmanagedUserRestrictor {
+	return &UnmanagedUserRestrictor{
+		logger:              logger,
+		policyStore:         policyStore,
+		policyChecker:       policyChecker,
+		userMappingResolver: userMappingResolver,
+
+		rateLimiter: newUserRateLimiter(),
+	}
+}
+
+func (me *UnmanagedUserRestrictor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := me.policyStore.Get()
+		if policy == nil || policy.UnmanagedUserDefaults == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if policy.UnmanagedUserDefaults.AllowedRoutes == nil && policy.UnmanagedUserDefaults.RateLimit == nil {
+			// Nothing to restrict, so no need to figure out who the user is
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accessToken := httphelp.GetAccessTokenFromRequest(r)
+		if accessToken == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userId, err := me.userMappingResolver.ResolveByAccessToken(accessToken)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logger := me.logger.WithField("method", r.Method)
+		logger = logger.WithField("uri", r.RequestURI)
+		logger = logger.WithField("userId", userId)
+
+		if !me.policyChecker.CanUserAccessRoute(*policy, userId, r.URL.Path) {
+			logger.Infof("HTTP gateway: denying (route not allowed for unmanaged users)")
+
+			httphelp.RespondWithMatrixError(
+				w,
+				http.StatusForbidden,
+				matrix.ErrorForbidden,
+				"Denied by policy (route not allowed)",
+			)
+			return
+		}
+
+		rateLimit := me.policyChecker.GetUserRateLimit(*policy, userId)
+		if rateLimit != nil {
+			allowed, retryAfter := me.rateLimiter.Allow(userId, *rateLimit)
+			if !allowed {
+				logger.Infof("HTTP gateway: denying (rate limit for unmanaged users exceeded)")
+
+				httphelp.RespondWithMatrixRatelimitError(
+					w,
+					matrix.ErrorLimitExceeded,
+					"Too many requests",
+					retryAfter,
+				)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,190 @@
+package httpgateway
+
+import (
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/sirupsen/logrus"
+)
+
+// createTestUnmanagedUserRestrictor creates a restrictor for the given policy, whose clock only moves when told to (by changing the returned time).
+// Access tokens resolve to the user id they're named after (`@<token>:example.com`), except for `invalid`.
+func createTestUnmanagedUserRestrictor(t *testing.T, policyJson string) (*UnmanagedUserRestrictor, *time.Time) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accessToken := httphelp.GetAccessTokenFromRequest(r)
+		if accessToken == "" || accessToken == "invalid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "Unknown token"}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(matrix.ApiWhoAmIResponse{UserId: "@" + accessToken + ":example.com"})
+	}))
+	t.Cleanup(homeserver.Close)
+
+	cache, err := lru.New2Q(10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	userMappingResolver := matrix.NewUserMappingResolver(logger, homeserver.URL, cache, 60000)
+
+	signatureVerifier, err := policy.NewSignatureVerifier(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	currentPolicy, err := policy.NewParser(signatureVerifier).Parse([]byte(policyJson))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	history, err := policy.NewHistory(logger, 0, "", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store := policy.NewStore(logger, policy.NewValidator("example.com"), history)
+	err = store.Set(currentPolicy, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	restrictor := NewUnmanagedUserRestrictor(logger, store, policy.NewChecker(), userMappingResolver)
+
+	now := time.Unix(1600000000, 0)
+	restrictor.rateLimiter.now = func() time.Time {
+		return now
+	}
+
+	return restrictor, &now
+}
+
+func serveTestRequest(restrictor *UnmanagedUserRestrictor, path string, accessToken string) *httptest.ResponseRecorder {
+	handler := restrictor.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", path, nil)
+	if accessToken != "" {
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestUnmanagedUserRestrictorRestrictsRoutes(t *testing.T) {
+	restrictor, _ := createTestUnmanagedUserRestrictor(t, `{
+		"schemaVersion": 1,
+		"unmanagedUserDefaults": {"allowedRoutes": ["^/_matrix/client/v3/sync$"]},
+		"users": [{"id": "@managed:example.com", "active": true, "authType": "plain", "authCredential": "secret"}]
+	}`)
+
+	type testData struct {
+		name               string
+		path               string
+		accessToken        string
+		expectedStatusCode int
+	}
+
+	tests := []testData{
+		{"unmanaged user, allowed route", "/_matrix/client/v3/sync", "unmanaged", http.StatusOK},
+		{"unmanaged user, other route", "/_matrix/client/v3/createRoom", "unmanaged", http.StatusForbidden},
+		{"managed user, other route", "/_matrix/client/v3/createRoom", "managed", http.StatusOK},
+		{"unauthenticated request", "/_matrix/client/v3/login", "", http.StatusOK},
+		{"invalid access token", "/_matrix/client/v3/createRoom", "invalid", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serveTestRequest(restrictor, test.path, test.accessToken)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status %d, got %d (%s)", test.expectedStatusCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUnmanagedUserRestrictorRateLimitsUnmanagedUsers(t *testing.T) {
+	restrictor, now := createTestUnmanagedUserRestrictor(t, `{
+		"schemaVersion": 1,
+		"unmanagedUserDefaults": {"rateLimit": {"requestsPerSecond": 0.5, "burst": 2}},
+		"users": [{"id": "@managed:example.com", "active": true, "authType": "plain", "authCredential": "secret"}]
+	}`)
+
+	// The burst gets used up right away
+	for i := 0; i < 2; i++ {
+		if w := serveTestRequest(restrictor, "/_matrix/client/v3/sync", "unmanaged"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status %d, got %d", i, http.StatusOK, w.Code)
+		}
+	}
+
+	w := serveTestRequest(restrictor, "/_matrix/client/v3/sync", "unmanaged")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") != "2" {
+		t.Errorf("expected to be told to retry after 2 seconds, got: %s", w.Header().Get("Retry-After"))
+	}
+
+	// Other users (unmanaged or not) have nothing to do with this user's limit
+	if w := serveTestRequest(restrictor, "/_matrix/client/v3/sync", "another-unmanaged"); w.Code != http.StatusOK {
+		t.Errorf("expected status %d for another unmanaged user, got %d", http.StatusOK, w.Code)
+	}
+	for i := 0; i < 5; i++ {
+		if w := serveTestRequest(restrictor, "/_matrix/client/v3/sync", "managed"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status %d for a managed user, got %d", i, http.StatusOK, w.Code)
+		}
+	}
+
+	// Tokens get refilled at the given rate
+	*now = now.Add(1 * time.Second)
+	if w := serveTestRequest(restrictor, "/_matrix/client/v3/sync", "unmanaged"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d before a token is refilled, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	*now = now.Add(1 * time.Second)
+	if w := serveTestRequest(restrictor, "/_matrix/client/v3/sync", "unmanaged"); w.Code != http.StatusOK {
+		t.Errorf("expected status %d once a token is refilled, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestUserRateLimiterPrunesRefilledBuckets(t *testing.T) {
+	rateLimiter := newUserRateLimiter()
+	now := time.Unix(1600000000, 0)
+	rateLimiter.now = func() time.Time {
+		return now
+	}
+
+	rateLimit := policy.UnmanagedUserRateLimit{RequestsPerSecond: 1, Burst: 100}
+
+	rateLimiter.Allow("@a:example.com", rateLimit)
+	for i := 0; i < 100; i++ {
+		rateLimiter.Allow("@b:example.com", rateLimit)
+	}
+
+	// @a's bucket is full again after a second, while @b's takes 100 seconds
+	now = now.Add(rateLimiterPruneInterval)
+	rateLimiter.Allow("@c:example.com", rateLimit)
+
+	if _, exists := rateLimiter.buckets["@a:example.com"]; exists {
+		t.Errorf("expected the refilled bucket to be pruned")
+	}
+	if _, exists := rateLimiter.buckets["@b:example.com"]; !exists {
+		t.Errorf("expected the bucket which is not yet refilled to be kept")
+	}
+	if _, exists := rateLimiter.buckets["@c:example.com"]; !exists {
+		t.Errorf("expected the bucket in use to be kept")
+	}
+}
@@ -0,0 +1,126 @@
+package httphelp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyBypassRule matches destinations which are to be reached directly (as opposed to through the proxy).
+type proxyBypassRule struct {
+	// matchesAll is for the `*` rule
+	matchesAll bool
+
+	// host is for exact host name or IP address matches (e.g. `example.com`, `10.0.0.1`)
+	host string
+
+	// domainSuffix is for matching a domain and all its subdomains (e.g. `.example.com` or `*.example.com`)
+	domainSuffix string
+
+	// network is for matching IP addresses in a range (e.g. `10.0.0.0/8`)
+	network *net.IPNet
+
+	// port (if not empty) additionally restricts the rule to a given port (e.g. `example.com:8443`)
+	port string
+}
+
+// NewProxyFunc creates a function (to be used as http.Transport.Proxy), which routes requests through the proxy at proxyUrl
+// (`http://`, `https://` or `socks5://`), except for requests to destinations matching one of the bypass rules.
+//
+// Bypass rules are host names (`example.com`), domain suffixes (`.example.com` or `*.example.com`), IP addresses,
+// CIDR ranges (`10.0.0.0/8`) or `*` (everything). All but the last two can be suffixed with a port (`example.com:8443`).
+func NewProxyFunc(proxyUrl string, bypassRules []string) (func(*http.Request) (*url.URL, error), error) {
+	parsedProxyUrl, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy URL: %s", err)
+	}
+
+	if parsedProxyUrl.Scheme != "http" && parsedProxyUrl.Scheme != "https" && parsedProxyUrl.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported proxy URL scheme: %s", parsedProxyUrl.Scheme)
+	}
+
+	rules := make([]proxyBypassRule, 0, len(bypassRules))
+	for _, bypassRule := range bypassRules {
+		rule, err := parseProxyBypassRule(bypassRule)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return func(r *http.Request) (*url.URL, error) {
+		host := strings.ToLower(r.URL.Hostname())
+		port := r.URL.Port()
+		if port == "" {
+			port = "80"
+			if r.URL.Scheme == "https" {
+				port = "443"
+			}
+		}
+
+		for _, rule := range rules {
+			if rule.matches(host, port) {
+				return nil, nil
+			}
+		}
+
+		return parsedProxyUrl, nil
+	}, nil
+}
+
+func parseProxyBypassRule(bypassRule string) (proxyBypassRule, error) {
+	bypassRule = strings.ToLower(strings.TrimSpace(bypassRule))
+
+	if bypassRule == "" {
+		return proxyBypassRule{}, fmt.Errorf("empty proxy bypass rule")
+	}
+
+	if bypassRule == "*" {
+		return proxyBypassRule{matchesAll: true}, nil
+	}
+
+	if strings.Contains(bypassRule, "/") {
+		_, network, err := net.ParseCIDR(bypassRule)
+		if err != nil {
+			return proxyBypassRule{}, fmt.Errorf("bad proxy bypass rule `%s`: %s", bypassRule, err)
+		}
+		return proxyBypassRule{network: network}, nil
+	}
+
+	host, port := bypassRule, ""
+	if splitHost, splitPort, err := net.SplitHostPort(bypassRule); err == nil {
+		host, port = splitHost, splitPort
+	}
+
+	if strings.HasPrefix(host, "*.") {
+		return proxyBypassRule{domainSuffix: host[1:], port: port}, nil
+	}
+	if strings.HasPrefix(host, ".") {
+		return proxyBypassRule{domainSuffix: host, port: port}, nil
+	}
+
+	return proxyBypassRule{host: host, port: port}, nil
+}
+
+func (me proxyBypassRule) matches(host string, port string) bool {
+	if me.matchesAll {
+		return true
+	}
+
+	if me.port != "" && me.port != port {
+		return false
+	}
+
+	if me.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && me.network.Contains(ip)
+	}
+
+	if me.domainSuffix != "" {
+		return host == me.domainSuffix[1:] || strings.HasSuffix(host, me.domainSuffix)
+	}
+
+	return host == me.host
+}
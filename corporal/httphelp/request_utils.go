@@ -3,6 +3,7 @@ package httphelp
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -67,3 +68,66 @@ func GetJsonFromRequestBody(r *http.Request, out interface{}) error {
 
 	return nil
 }
+
+// GetClientIp returns the IP address that the request came from.
+//
+// The `X-Forwarded-For` header is only trusted when the request comes from one of the given (reverse-proxy) networks,
+// and only as far as it's been appended to by such trusted proxies (the first untrusted address from the right is the client's).
+// An empty string is returned if the address cannot be determined.
+func GetClientIp(request *http.Request, trustedProxyNetworks []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	if !isIpInNetworks(ip, trustedProxyNetworks) {
+		return ip.String()
+	}
+
+	var forwardedFor []string
+	for _, headerValue := range request.Header["X-Forwarded-For"] {
+		forwardedFor = append(forwardedFor, strings.Split(headerValue, ",")...)
+	}
+
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwardedIp := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if forwardedIp == nil {
+			// Whatever's further left cannot be trusted anymore
+			break
+		}
+
+		ip = forwardedIp
+		if !isIpInNetworks(ip, trustedProxyNetworks) {
+			break
+		}
+	}
+
+	return ip.String()
+}
+
+func isIpInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseIpNetworks parses a list of networks in CIDR notation (e.g. `10.0.0.0/8`)
+func ParseIpNetworks(cidrList []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrList {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing %q: %s", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
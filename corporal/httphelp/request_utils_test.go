@@ -0,0 +1,80 @@
+package httphelp
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetClientIp(t *testing.T) {
+	trustedProxyNetworks, err := ParseIpNetworks([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	type testData struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  []string
+		expectedIp    string
+		trustsProxies bool
+	}
+
+	tests := []testData{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1", true},
+		{"direct (IPv6)", "[2001:db9::1]:1234", nil, "2001:db9::1", true},
+		{"direct, without a port", "192.0.2.1", nil, "192.0.2.1", true},
+		{"invalid remote address", "somewhere:1234", nil, "", true},
+
+		// A client talking to us directly cannot pretend to be someone else
+		{"spoofed header from an untrusted address", "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1", true},
+		{"spoofed header without trusted proxies", "10.0.0.1:1234", []string{"198.51.100.1"}, "10.0.0.1", false},
+
+		{"via a trusted proxy", "10.0.0.1:1234", []string{"192.0.2.1"}, "192.0.2.1", true},
+		{"via a trusted proxy (IPv6)", "[2001:db8::1]:1234", []string{"2001:db9::1"}, "2001:db9::1", true},
+		{"via a trusted proxy, without a header", "10.0.0.1:1234", nil, "10.0.0.1", true},
+		{"via a chain of trusted proxies", "10.0.0.1:1234", []string{"192.0.2.1, 10.0.0.2", "10.0.0.3"}, "192.0.2.1", true},
+
+		// Whatever the client itself put in the header (left of the address the trusted proxy appended) is ignored
+		{"spoofed header via a trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1, 192.0.2.1"}, "192.0.2.1", true},
+		{"spoofed trusted address via a trusted proxy", "10.0.0.1:1234", []string{"10.0.0.5, 192.0.2.1"}, "192.0.2.1", true},
+		{"garbage via a trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.2", true},
+		{"garbage only via a trusted proxy", "10.0.0.1:1234", []string{"garbage"}, "10.0.0.1", true},
+		{"all trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+			for _, value := range test.forwardedFor {
+				request.Header.Add("X-Forwarded-For", value)
+			}
+
+			networks := trustedProxyNetworks
+			if !test.trustsProxies {
+				networks = nil
+			}
+
+			ip := GetClientIp(request, networks)
+			if ip != test.expectedIp {
+				t.Errorf("expected `%s`, got `%s`", test.expectedIp, ip)
+			}
+		})
+	}
+}
+
+func TestParseIpNetworks(t *testing.T) {
+	networks, err := ParseIpNetworks([]string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(networks) != 3 {
+		t.Errorf("expected 3 networks, got %d", len(networks))
+	}
+
+	for _, invalid := range []string{"10.0.0.1", "10.0.0.0/33", "example.com/8", ""} {
+		_, err := ParseIpNetworks([]string{invalid})
+		if err == nil {
+			t.Errorf("`%s`: expected an error", invalid)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/matrix-org/gomatrix"
 )
@@ -51,6 +53,20 @@ func RespondWithMatrixError(w http.ResponseWriter, httpStatusCode int, errorCode
 	RespondWithBytes(w, httpStatusCode, "application/json", respBytes)
 }
 
+// RespondWithMatrixRatelimitError responds like the Matrix APIs do to ratelimited requests,
+// telling the client how long to wait before retrying (via `retry_after_ms` and the `Retry-After` header).
+func RespondWithMatrixRatelimitError(w http.ResponseWriter, errorCode string, errorMessage string, retryAfter time.Duration) {
+	// Rounding up, so that clients don't retry a little too early
+	retryAfterSeconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds, 10))
+
+	RespondWithJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"errcode":        errorCode,
+		"error":          errorMessage,
+		"retry_after_ms": int64(retryAfter / time.Millisecond),
+	})
+}
+
 func RespondWithJSON(w http.ResponseWriter, httpStatusCode int, responsePayload interface{}) {
 	responsePayloadBytes, err := json.Marshal(responsePayload)
 	if err != nil {
@@ -0,0 +1,54 @@
+package httphelp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewTlsConfig builds a TLS client configuration, which trusts the CA certificates in caPath (if specified, instead of the system ones)
+// and presents the client certificate at certificatePath/keyPath (if specified).
+// A nil configuration (meaning "use the defaults") is returned if none are specified.
+func NewTlsConfig(certificatePath string, keyPath string, caPath string) (*tls.Config, error) {
+	if certificatePath == "" && keyPath == "" && caPath == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if certificatePath != "" || keyPath != "" {
+		if certificatePath == "" || keyPath == "" {
+			return nil, fmt.Errorf("the TLS client certificate and key need to be specified together")
+		}
+
+		// Loading the certificate for each handshake (as opposed to once) lets certificates be rotated without restarting.
+		_, err := tls.LoadX509KeyPair(certificatePath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading TLS client certificate: %s", err)
+		}
+
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, err := tls.LoadX509KeyPair(certificatePath, keyPath)
+			if err != nil {
+				return nil, err
+			}
+			return &certificate, nil
+		}
+	}
+
+	if caPath != "" {
+		caBytes, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading TLS CA: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificates found in TLS CA file (%s)", caPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
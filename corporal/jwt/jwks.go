@@ -0,0 +1,253 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// minRefetchInterval prevents tokens with unknown key ids from making us hammer the JWKS URL
+const minRefetchInterval = 1 * time.Minute
+
+// KeySet is a JSON Web Key Set (RFC 7517), fetched from a URL (and cached for a while).
+//
+// Keys get refetched when they're older than the refresh interval,
+// or (no more often than minRefetchInterval) when a key that we don't know of is asked for (e.g. after the IdP rotated its keys).
+// If refetching fails, previously fetched keys remain in use.
+type KeySet struct {
+	logger          *logrus.Logger
+	url             string
+	refreshInterval time.Duration
+	httpClient      *http.Client
+
+	keys          []key
+	lastFetchedAt time.Time
+	lock          sync.Mutex
+}
+
+// key is a public key found in the key set
+type key struct {
+	id string
+
+	// algorithm is the algorithm that the key is meant to be used with (may be empty, if unspecified)
+	algorithm string
+
+	publicKey interface{}
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+func NewKeySet(logger *logrus.Logger, url string, refreshInterval time.Duration, timeout time.Duration) *KeySet {
+	return &KeySet{
+		logger:          logger,
+		url:             url,
+		refreshInterval: refreshInterval,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// findKeys returns the keys which may have been used for signing with the given algorithm and key id (any key id, if empty)
+func (me *KeySet) findKeys(keyId string, algorithm string) ([]key, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if me.lastFetchedAt.IsZero() || time.Since(me.lastFetchedAt) > me.refreshInterval {
+		err := me.fetch()
+		if err != nil {
+			if me.lastFetchedAt.IsZero() {
+				return nil, err
+			}
+			me.logger.Warnf("JWT: failed refreshing keys from %s (will keep using the previous ones): %s", me.url, err)
+		}
+	}
+
+	keys := me.matchingKeys(keyId, algorithm)
+	if len(keys) == 0 && time.Since(me.lastFetchedAt) > minRefetchInterval {
+		err := me.fetch()
+		if err != nil {
+			return nil, err
+		}
+		keys = me.matchingKeys(keyId, algorithm)
+	}
+
+	return keys, nil
+}
+
+func (me *KeySet) matchingKeys(keyId string, algorithm string) []key {
+	var keys []key
+	for _, k := range me.keys {
+		if keyId != "" && k.id != keyId {
+			continue
+		}
+		if k.algorithm != "" && k.algorithm != algorithm {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (me *KeySet) fetch() error {
+	// Even failed attempts count, so that an unreachable JWKS URL doesn't get hit on every single authentication attempt
+	fetchedAt := time.Now()
+
+	keys, err := me.download()
+	if err != nil {
+		if !me.lastFetchedAt.IsZero() {
+			me.lastFetchedAt = fetchedAt
+		}
+		return fmt.Errorf("failed fetching keys from %s: %s", me.url, err)
+	}
+
+	me.keys = keys
+	me.lastFetchedAt = fetchedAt
+
+	me.logger.Debugf("JWT: fetched %d keys from %s", len(keys), me.url)
+
+	return nil
+}
+
+func (me *KeySet) download() ([]key, error) {
+	response, err := me.httpClient.Get(me.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("non-OK HTTP response: %d", response.StatusCode)
+	}
+
+	responseBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var keySet jsonWebKeySet
+	err = json.Unmarshal(responseBytes, &keySet)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding JSON: %s", err)
+	}
+
+	var keys []key
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			// Encryption keys are of no use to us
+			continue
+		}
+
+		publicKey, err := parsePublicKey(jwk)
+		if err != nil {
+			// Keys of unsupported types should not prevent us from using the rest
+			me.logger.Debugf("JWT: ignoring key %s from %s: %s", jwk.KeyId, me.url, err)
+			continue
+		}
+
+		keys = append(keys, key{
+			id:        jwk.KeyId,
+			algorithm: jwk.Algorithm,
+			publicKey: publicKey,
+		})
+	}
+
+	return keys, nil
+}
+
+func parsePublicKey(jwk jsonWebKey) (interface{}, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %s", err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %s", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Curve)
+		}
+
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %s", err)
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %s", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", jwk.Curve)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %s", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key size %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", jwk.KeyType)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
@@ -0,0 +1,174 @@
+package jwt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeySetSelectsKeysByKeyIdAndAlgorithm(t *testing.T) {
+	keys := getTestKeys(t)
+	server := newTestJwksServer(createTestJwks(keys))
+	defer server.server.Close()
+	_, keySet := createTestVerifier(server)
+
+	type testData struct {
+		keyId          string
+		algorithm      string
+		expectedKeyIds []string
+	}
+
+	tests := []testData{
+		{"rsa", "RS256", []string{"rsa"}},
+		{"rsa-rs256-only", "RS256", []string{"rsa-rs256-only"}},
+		{"rsa-rs256-only", "PS256", nil},
+		{"p256", "ES256", []string{"p256"}},
+		{"unknown", "RS256", nil},
+		// Encryption keys and keys of unsupported types are left out
+		{"encryption", "RS256", nil},
+		{"symmetric", "HS256", nil},
+		// Without a key id, all keys are candidates (except for those restricted to other algorithms)
+		{"", "PS256", []string{"rsa", "p256", "p384", "p521", "ed"}},
+	}
+
+	for _, test := range tests {
+		foundKeys, err := keySet.findKeys(test.keyId, test.algorithm)
+		if err != nil {
+			t.Errorf("%s/%s: unexpected error: %s", test.keyId, test.algorithm, err)
+			continue
+		}
+
+		var foundKeyIds []string
+		for _, k := range foundKeys {
+			foundKeyIds = append(foundKeyIds, k.id)
+		}
+		if len(foundKeyIds) != len(test.expectedKeyIds) {
+			t.Errorf("%s/%s: expected keys %v, got %v", test.keyId, test.algorithm, test.expectedKeyIds, foundKeyIds)
+			continue
+		}
+		for idx := range foundKeyIds {
+			if foundKeyIds[idx] != test.expectedKeyIds[idx] {
+				t.Errorf("%s/%s: expected keys %v, got %v", test.keyId, test.algorithm, test.expectedKeyIds, foundKeyIds)
+				break
+			}
+		}
+	}
+
+	if server.fetchCount != 1 {
+		t.Errorf("expected the keys to be fetched once, but they were fetched %d times", server.fetchCount)
+	}
+}
+
+func TestKeySetRefetchesForUnknownKeyIds(t *testing.T) {
+	keys := getTestKeys(t)
+	server := newTestJwksServer([]map[string]string{createTestEcJwk("old", "P-256", keys.p256)})
+	defer server.server.Close()
+	verifier, keySet := createTestVerifier(server)
+
+	_, err := verifier.Verify(signTestToken("ES256", map[string]interface{}{"kid": "old"}, createTestClaims(), keys.p256))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The identity provider rotates its keys
+	server.lock.Lock()
+	server.keys = []map[string]string{createTestEcJwk("new", "P-384", keys.p384)}
+	server.lock.Unlock()
+
+	// Having just fetched the keys, no refetching happens
+	_, err = verifier.Verify(signTestToken("ES384", map[string]interface{}{"kid": "new"}, createTestClaims(), keys.p384))
+	assertValidationError(t, err, "signature could not be verified")
+	if server.fetchCount != 1 {
+		t.Fatalf("expected the keys to be fetched once, but they were fetched %d times", server.fetchCount)
+	}
+
+	// Once minRefetchInterval passes, unknown key ids lead to refetching
+	keySet.lastFetchedAt = keySet.lastFetchedAt.Add(-2 * minRefetchInterval)
+
+	_, err = verifier.Verify(signTestToken("ES384", map[string]interface{}{"kid": "new"}, createTestClaims(), keys.p384))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if server.fetchCount != 2 {
+		t.Errorf("expected the keys to be fetched twice, but they were fetched %d times", server.fetchCount)
+	}
+
+	// The old key is gone
+	_, err = verifier.Verify(signTestToken("ES256", map[string]interface{}{"kid": "old"}, createTestClaims(), keys.p256))
+	assertValidationError(t, err, "signature could not be verified")
+}
+
+func TestKeySetKeepsKeysWhenRefreshingFails(t *testing.T) {
+	keys := getTestKeys(t)
+	server := newTestJwksServer(createTestJwks(keys))
+	defer server.server.Close()
+	verifier, keySet := createTestVerifier(server)
+
+	token := signTestToken("EdDSA", map[string]interface{}{"kid": "ed"}, createTestClaims(), keys.ed)
+
+	_, err := verifier.Verify(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	server.lock.Lock()
+	server.failFetches = true
+	server.lock.Unlock()
+
+	keySet.lastFetchedAt = time.Now().Add(-2 * time.Hour)
+
+	_, err = verifier.Verify(token)
+	if err != nil {
+		t.Fatalf("expected the previous keys to remain in use, got: %s", err)
+	}
+	if server.fetchCount != 2 {
+		t.Errorf("expected the keys to be fetched twice, but they were fetched %d times", server.fetchCount)
+	}
+}
+
+func TestKeySetFailsWithoutKeys(t *testing.T) {
+	server := newTestJwksServer(nil)
+	server.failFetches = true
+	defer server.server.Close()
+	verifier, _ := createTestVerifier(server)
+
+	_, err := verifier.Verify(signTestToken("EdDSA", map[string]interface{}{"kid": "ed"}, createTestClaims(), getTestKeys(t).ed))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if _, ok := err.(ValidationError); ok {
+		t.Errorf("expected failing to fetch keys not to be considered a validation error, got: %s", err)
+	}
+}
+
+func TestParsePublicKeyRejectsInvalidKeys(t *testing.T) {
+	keys := getTestKeys(t)
+
+	offCurve := createTestEcJwk("p256", "P-256", keys.p256)
+	offCurve["y"] = offCurve["x"]
+
+	wrongCurve := createTestEcJwk("p256", "P-384", keys.p256)
+
+	type testData struct {
+		name string
+		jwk  jsonWebKey
+	}
+
+	tests := []testData{
+		{"unsupported key type", jsonWebKey{KeyType: "oct"}},
+		{"RSA without modulus", jsonWebKey{KeyType: "RSA", E: "AQAB"}},
+		{"RSA with bad exponent", jsonWebKey{KeyType: "RSA", N: encodeTestBigInt(keys.rsa.N), E: "!!!"}},
+		{"RSA with huge exponent", jsonWebKey{KeyType: "RSA", N: encodeTestBigInt(keys.rsa.N), E: "AQAAAAAB"}},
+		{"EC on unsupported curve", jsonWebKey{KeyType: "EC", Curve: "secp256k1", X: offCurve["x"], Y: offCurve["x"]}},
+		{"EC point not on curve", jsonWebKey{KeyType: "EC", Curve: "P-256", X: offCurve["x"], Y: offCurve["y"]}},
+		{"EC point on another curve", jsonWebKey{KeyType: "EC", Curve: "P-384", X: wrongCurve["x"], Y: wrongCurve["y"]}},
+		{"OKP on unsupported curve", jsonWebKey{KeyType: "OKP", Curve: "X25519", X: "AAAA"}},
+		{"OKP with short key", jsonWebKey{KeyType: "OKP", Curve: "Ed25519", X: "AAAA"}},
+	}
+
+	for _, test := range tests {
+		_, err := parsePublicKey(test.jwk)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
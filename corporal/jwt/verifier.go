@@ -0,0 +1,249 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	// Registering the hash functions used by the supported algorithms (see crypto.Hash.Available)
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Claims are the (decoded) claims of a token's payload
+type Claims map[string]interface{}
+
+// ValidationError is returned by Verifier.Verify for tokens which are invalid (as opposed to failures to validate them, like JWKS fetching failures)
+type ValidationError struct {
+	reason string
+}
+
+func (me ValidationError) Error() string {
+	return fmt.Sprintf("invalid token: %s", me.reason)
+}
+
+func newValidationError(format string, args ...interface{}) ValidationError {
+	return ValidationError{reason: fmt.Sprintf(format, args...)}
+}
+
+// Verifier validates JSON Web Tokens (RFC 7519) issued by an issuer, whose signing keys are found in a key set.
+//
+// Only asymmetric signing algorithms (RS*, PS*, ES* and EdDSA) are supported.
+type Verifier struct {
+	keySet    *KeySet
+	issuer    string
+	audience  string
+	clockSkew time.Duration
+}
+
+func NewVerifier(keySet *KeySet, issuer string, audience string, clockSkew time.Duration) *Verifier {
+	return &Verifier{
+		keySet:    keySet,
+		issuer:    issuer,
+		audience:  audience,
+		clockSkew: clockSkew,
+	}
+}
+
+type header struct {
+	Algorithm string   `json:"alg"`
+	KeyId     string   `json:"kid"`
+	Critical  []string `json:"crit"`
+}
+
+// Verify checks the token's signature and its registered claims (`iss`, `aud`, `exp`, `nbf` and `iat`), returning its claims if it's valid.
+//
+// A ValidationError is returned for invalid tokens. Other errors mean that validation could not happen.
+func (me *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, newValidationError("expected 3 parts, found %d", len(parts))
+	}
+
+	var tokenHeader header
+	err := decodeSegment(parts[0], &tokenHeader)
+	if err != nil {
+		return nil, newValidationError("bad header: %s", err)
+	}
+	if len(tokenHeader.Critical) != 0 {
+		return nil, newValidationError("unsupported critical header parameters: %s", strings.Join(tokenHeader.Critical, ", "))
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, newValidationError("bad signature encoding: %s", err)
+	}
+
+	if !isSupportedAlgorithm(tokenHeader.Algorithm) {
+		return nil, newValidationError("unsupported algorithm `%s`", tokenHeader.Algorithm)
+	}
+
+	keys, err := me.keySet.findKeys(tokenHeader.KeyId, tokenHeader.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	signedData := []byte(parts[0] + "." + parts[1])
+
+	isSignatureValid := false
+	for _, k := range keys {
+		if verifySignature(tokenHeader.Algorithm, k.publicKey, signedData, signature) {
+			isSignatureValid = true
+			break
+		}
+	}
+	if !isSignatureValid {
+		return nil, newValidationError("signature could not be verified (algorithm %s, key id `%s`)", tokenHeader.Algorithm, tokenHeader.KeyId)
+	}
+
+	var claims Claims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, newValidationError("bad payload: %s", err)
+	}
+
+	err = me.checkClaims(claims, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (me *Verifier) checkClaims(claims Claims, now time.Time) error {
+	issuer, _ := claims["iss"].(string)
+	if issuer != me.issuer {
+		return newValidationError("unexpected issuer `%s`", issuer)
+	}
+
+	if !claims.hasAudience(me.audience) {
+		return newValidationError("not meant for audience `%s`", me.audience)
+	}
+
+	expiresAt, ok := claims.time("exp")
+	if !ok {
+		return newValidationError("missing expiration time")
+	}
+	if !now.Before(expiresAt.Add(me.clockSkew)) {
+		return newValidationError("expired at %s", expiresAt)
+	}
+
+	if notBefore, ok := claims.time("nbf"); ok && now.Add(me.clockSkew).Before(notBefore) {
+		return newValidationError("not valid before %s", notBefore)
+	}
+
+	if issuedAt, ok := claims.time("iat"); ok && now.Add(me.clockSkew).Before(issuedAt) {
+		return newValidationError("issued in the future (at %s)", issuedAt)
+	}
+
+	return nil
+}
+
+// hasAudience tells whether the `aud` claim (a string or a list of strings) contains the given audience
+func (me Claims) hasAudience(audience string) bool {
+	switch value := me["aud"].(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, item := range value {
+			if itemString, ok := item.(string); ok && itemString == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// time returns the value of a NumericDate claim (seconds since the epoch), like `exp`
+func (me Claims) time(name string) (time.Time, bool) {
+	value, ok := me[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// String returns the value of the given claim, if it's a string (an empty string otherwise)
+func (me Claims) String(name string) string {
+	value, _ := me[name].(string)
+	return value
+}
+
+func decodeSegment(segment string, target interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, target)
+}
+
+var algorithmHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+func isSupportedAlgorithm(algorithm string) bool {
+	if algorithm == "EdDSA" {
+		return true
+	}
+	_, ok := algorithmHashes[algorithm]
+	return ok
+}
+
+func verifySignature(algorithm string, publicKey interface{}, signedData []byte, signature []byte) bool {
+	if algorithm == "EdDSA" {
+		edPublicKey, ok := publicKey.(ed25519.PublicKey)
+		return ok && ed25519.Verify(edPublicKey, signedData, signature)
+	}
+
+	hash := algorithmHashes[algorithm]
+	hasher := hash.New()
+	hasher.Write(signedData)
+	digest := hasher.Sum(nil)
+
+	switch algorithm[:2] {
+	case "RS":
+		rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaPublicKey, hash, digest, signature) == nil
+	case "PS":
+		rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(rsaPublicKey, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		ecPublicKey, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		// Each algorithm goes with a specific curve (e.g. ES256 with P-256)
+		expectedCurveBits := map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[algorithm]
+		curveBits := ecPublicKey.Curve.Params().BitSize
+		if curveBits != expectedCurveBits {
+			return false
+		}
+
+		// The signature is the concatenation of R and S, each taking up the curve's size (see RFC 7518, section 3.4)
+		size := (curveBits + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(ecPublicKey, digest, r, s)
+	}
+
+	return false
+}
@@ -0,0 +1,474 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testAudience = "matrix-corporal"
+)
+
+// testKeys holds a private key of each supported type, along with the JWKS (served by a testJwksServer) describing their public keys
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	p256  *ecdsa.PrivateKey
+	p384  *ecdsa.PrivateKey
+	p521  *ecdsa.PrivateKey
+	ed    ed25519.PrivateKey
+	other *rsa.PrivateKey
+}
+
+var (
+	sharedTestKeys     *testKeys
+	sharedTestKeysOnce sync.Once
+)
+
+// getTestKeys returns keys for testing, which get generated once (as generating RSA keys is slow)
+func getTestKeys(t *testing.T) *testKeys {
+	sharedTestKeysOnce.Do(func() {
+		keys := &testKeys{}
+		var err error
+
+		keys.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err == nil {
+			keys.other, err = rsa.GenerateKey(rand.Reader, 2048)
+		}
+		if err == nil {
+			keys.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}
+		if err == nil {
+			keys.p384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		}
+		if err == nil {
+			keys.p521, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		}
+		if err == nil {
+			_, keys.ed, err = ed25519.GenerateKey(rand.Reader)
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		sharedTestKeys = keys
+	})
+
+	return sharedTestKeys
+}
+
+func encodeTestBigInt(value *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(value.Bytes())
+}
+
+func createTestRsaJwk(keyId string, algorithm string, privateKey *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": keyId,
+		"alg": algorithm,
+		"n":   encodeTestBigInt(privateKey.N),
+		"e":   encodeTestBigInt(big.NewInt(int64(privateKey.E))),
+	}
+}
+
+func createTestEcJwk(keyId string, curve string, privateKey *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": keyId,
+		"crv": curve,
+		"x":   encodeTestBigInt(privateKey.X),
+		"y":   encodeTestBigInt(privateKey.Y),
+	}
+}
+
+func createTestJwks(keys *testKeys) []map[string]string {
+	return []map[string]string{
+		createTestRsaJwk("rsa", "", keys.rsa),
+		createTestRsaJwk("rsa-rs256-only", "RS256", keys.other),
+		createTestEcJwk("p256", "P-256", keys.p256),
+		createTestEcJwk("p384", "P-384", keys.p384),
+		createTestEcJwk("p521", "P-521", keys.p521),
+		{
+			"kty": "OKP",
+			"kid": "ed",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(keys.ed.Public().(ed25519.PublicKey)),
+		},
+		{
+			"kty": "RSA",
+			"kid": "encryption",
+			"use": "enc",
+			"n":   encodeTestBigInt(keys.other.N),
+			"e":   "AQAB",
+		},
+		{
+			"kty": "oct",
+			"kid": "symmetric",
+			"k":   "c2VjcmV0",
+		},
+	}
+}
+
+// testJwksServer serves a JWKS, counting how many times it got fetched
+type testJwksServer struct {
+	server *httptest.Server
+
+	lock        sync.Mutex
+	keys        []map[string]string
+	fetchCount  int
+	failFetches bool
+}
+
+func newTestJwksServer(keys []map[string]string) *testJwksServer {
+	me := &testJwksServer{keys: keys}
+
+	me.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		me.lock.Lock()
+		defer me.lock.Unlock()
+
+		me.fetchCount++
+
+		if me.failFetches {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": me.keys})
+	}))
+
+	return me
+}
+
+func createTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+func createTestVerifier(server *testJwksServer) (*Verifier, *KeySet) {
+	keySet := NewKeySet(createTestLogger(), server.server.URL, 1*time.Hour, 5*time.Second)
+	return NewVerifier(keySet, testIssuer, testAudience, 30*time.Second), keySet
+}
+
+// createTestClaims creates valid claims, which expire in an hour
+func createTestClaims() Claims {
+	now := time.Now()
+	return Claims{
+		"iss": testIssuer,
+		"aud": testAudience,
+		"sub": "john",
+		"iat": float64(now.Unix()),
+		"exp": float64(now.Add(1 * time.Hour).Unix()),
+	}
+}
+
+func encodeTestSegment(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// signTestToken creates a token with the given header and claims, signed with the given key (or unsigned, if nil) using the given algorithm
+func signTestToken(algorithm string, headerFields map[string]interface{}, claims Claims, privateKey interface{}) string {
+	tokenHeader := map[string]interface{}{"alg": algorithm, "typ": "JWT"}
+	for name, value := range headerFields {
+		tokenHeader[name] = value
+	}
+
+	signedData := encodeTestSegment(tokenHeader) + "." + encodeTestSegment(claims)
+
+	var signature []byte
+	var err error
+	switch privateKey := privateKey.(type) {
+	case nil:
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(privateKey, []byte(signedData))
+	case []byte:
+		mac := hmac.New(sha256.New, privateKey)
+		mac.Write([]byte(signedData))
+		signature = mac.Sum(nil)
+	default:
+		hash := algorithmHashes[strings.ToUpper(algorithm)]
+		hasher := hash.New()
+		hasher.Write([]byte(signedData))
+		digest := hasher.Sum(nil)
+
+		switch privateKey := privateKey.(type) {
+		case *rsa.PrivateKey:
+			if strings.HasPrefix(algorithm, "PS") {
+				signature, err = rsa.SignPSS(rand.Reader, privateKey, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+			} else {
+				signature, err = rsa.SignPKCS1v15(rand.Reader, privateKey, hash, digest)
+			}
+		case *ecdsa.PrivateKey:
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(rand.Reader, privateKey, digest)
+			size := (privateKey.Curve.Params().BitSize + 7) / 8
+			signature = make([]byte, 2*size)
+			rBytes, sBytes := r.Bytes(), s.Bytes()
+			copy(signature[size-len(rBytes):size], rBytes)
+			copy(signature[2*size-len(sBytes):], sBytes)
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return signedData + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func assertValidationError(t *testing.T, err error, expectedReason string) {
+	t.Helper()
+
+	validationError, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %#v", err)
+	}
+	if !strings.Contains(validationError.reason, expectedReason) {
+		t.Errorf("expected the reason to contain `%s`, got `%s`", expectedReason, validationError.reason)
+	}
+}
+
+func TestVerifyAcceptsSupportedAlgorithms(t *testing.T) {
+	keys := getTestKeys(t)
+	server := newTestJwksServer(createTestJwks(keys))
+	defer server.server.Close()
+	verifier, _ := createTestVerifier(server)
+
+	type testData struct {
+		algorithm  string
+		keyId      string
+		privateKey interface{}
+	}
+
+	tests := []testData{
+		{"RS256", "rsa", keys.rsa},
+		{"RS384", "rsa", keys.rsa},
+		{"RS512", "rsa", keys.rsa},
+		{"PS256", "rsa", keys.rsa},
+		{"PS384", "rsa", keys.rsa},
+		{"PS512", "rsa", keys.rsa},
+		{"ES256", "p256", keys.p256},
+		{"ES384", "p384", keys.p384},
+		{"ES512", "p521", keys.p521},
+		{"EdDSA", "ed", keys.ed},
+		// Without a key id, all keys (which may be used for the algorithm) are tried
+		{"ES256", "", keys.p256},
+		{"RS256", "", keys.other},
+	}
+
+	for _, test := range tests {
+		t.Run(test.algorithm+"/"+test.keyId, func(t *testing.T) {
+			headerFields := map[string]interface{}{}
+			if test.keyId != "" {
+				headerFields["kid"] = test.keyId
+			}
+
+			claims, err := verifier.Verify(signTestToken(test.algorithm, headerFields, createTestClaims(), test.privateKey))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if claims.String("sub") != "john" {
+				t.Errorf("unexpected claims: %v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsUnsupportedAlgorithms(t *testing.T) {
+	keys := getTestKeys(t)
+	server := newTestJwksServer(createTestJwks(keys))
+	defer server.server.Close()
+	verifier, _ := createTestVerifier(server)
+
+	rsaPublicKeyBytes, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	type testData struct {
+		name  string
+		token string
+	}
+
+	tests := []testData{
+		{"none", signTestToken("none", nil, createTestClaims(), nil)},
+		{"none (uppercase)", signTestToken("NONE", nil, createTestClaims(), nil)},
+		{"missing", signTestToken("", nil, createTestClaims(), nil)},
+		// A token signed with HMAC, using the RSA public key as the secret, must not be verified using the RSA key
+		{"HS256 with RSA key", signTestToken("HS256", map[string]interface{}{"kid": "rsa"}, createTestClaims(), rsaPublicKeyBytes)},
+		{"HS256 with symmetric key", signTestToken("HS256", map[string]interface{}{"kid": "symmetric"}, createTestClaims(), []byte("secret"))},
+		{"rs256 (lowercase)", signTestToken("rs256", map[string]interface{}{"kid": "rsa"}, createTestClaims(), keys.rsa)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := verifier.Verify(test.token)
+			assertValidationError(t, err, "unsupported algorithm")
+		})
+	}
+}
+
+func TestVerifyRejectsMismatchingKeys(t *testing.T) {
+	keys := getTestKeys(t)
+	server := newTestJwksServer(createTestJwks(keys))
+	defer server.server.Close()
+	verifier, _ := createTestVerifier(server)
+
+	type testData struct {
+		name       string
+		algorithm  string
+		keyId      string
+		privateKey interface{}
+	}
+
+	tests := []testData{
+		{"signed by another key", "RS256", "rsa", keys.other},
+		{"key restricted to another algorithm", "PS256", "rsa-rs256-only", keys.other},
+		{"encryption key", "RS256", "encryption", keys.other},
+		{"ES256 with a P-384 key", "ES256", "p384", keys.p384},
+		{"ES384 with a P-256 key", "ES384", "p256", keys.p256},
+		{"ES512 with a P-384 key", "ES512", "p384", keys.p384},
+		{"RSA algorithm with an EC key", "RS256", "p256", keys.rsa},
+		{"EC algorithm with an RSA key", "ES256", "rsa", keys.p256},
+		{"EdDSA with an RSA key", "EdDSA", "rsa", keys.ed},
+		{"unknown key id", "RS256", "unknown", keys.rsa},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := signTestToken(test.algorithm, map[string]interface{}{"kid": test.keyId}, createTestClaims(), test.privateKey)
+
+			_, err := verifier.Verify(token)
+			assertValidationError(t, err, "signature could not be verified")
+		})
+	}
+}
+
+func TestVerifyRejectsMalformedTokens(t *testing.T) {
+	keys := getTestKeys(t)
+	server := newTestJwksServer(createTestJwks(keys))
+	defer server.server.Close()
+	verifier, _ := createTestVerifier(server)
+
+	valid := signTestToken("RS256", map[string]interface{}{"kid": "rsa"}, createTestClaims(), keys.rsa)
+	parts := strings.Split(valid, ".")
+
+	tamperedClaims := createTestClaims()
+	tamperedClaims["sub"] = "admin"
+
+	type testData struct {
+		name           string
+		token          string
+		expectedReason string
+	}
+
+	tests := []testData{
+		{"too few parts", parts[0] + "." + parts[1], "expected 3 parts"},
+		{"too many parts", valid + ".extra", "expected 3 parts"},
+		{"bad header", "!!!." + parts[1] + "." + parts[2], "bad header"},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!!", "bad signature encoding"},
+		{"tampered payload", parts[0] + "." + encodeTestSegment(tamperedClaims) + "." + parts[2], "signature could not be verified"},
+		{"critical header", signTestToken("RS256", map[string]interface{}{"kid": "rsa", "crit": []string{"exp"}}, createTestClaims(), keys.rsa), "critical"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := verifier.Verify(test.token)
+			assertValidationError(t, err, test.expectedReason)
+		})
+	}
+}
+
+func TestCheckClaims(t *testing.T) {
+	verifier := NewVerifier(nil, testIssuer, testAudience, 30*time.Second)
+
+	now := time.Unix(1600000000, 0)
+
+	createClaims := func(modify func(claims Claims)) Claims {
+		claims := Claims{
+			"iss": testIssuer,
+			"aud": testAudience,
+			"exp": float64(now.Add(1 * time.Hour).Unix()),
+		}
+		modify(claims)
+		return claims
+	}
+
+	type testData struct {
+		name           string
+		claims         Claims
+		expectedReason string
+	}
+
+	tests := []testData{
+		{"valid", createClaims(func(claims Claims) {}), ""},
+		{"audience in a list", createClaims(func(claims Claims) { claims["aud"] = []interface{}{"other", testAudience} }), ""},
+		{"expired within the clock skew", createClaims(func(claims Claims) { claims["exp"] = float64(now.Add(-10 * time.Second).Unix()) }), ""},
+		{"not yet valid within the clock skew", createClaims(func(claims Claims) { claims["nbf"] = float64(now.Add(10 * time.Second).Unix()) }), ""},
+		{"issued within the clock skew", createClaims(func(claims Claims) { claims["iat"] = float64(now.Add(10 * time.Second).Unix()) }), ""},
+
+		{"missing issuer", createClaims(func(claims Claims) { delete(claims, "iss") }), "unexpected issuer"},
+		{"other issuer", createClaims(func(claims Claims) { claims["iss"] = "https://evil.example.com" }), "unexpected issuer"},
+		{"missing audience", createClaims(func(claims Claims) { delete(claims, "aud") }), "not meant for audience"},
+		{"other audience", createClaims(func(claims Claims) { claims["aud"] = "other" }), "not meant for audience"},
+		{"other audiences", createClaims(func(claims Claims) { claims["aud"] = []interface{}{"other", 5} }), "not meant for audience"},
+		{"missing expiration", createClaims(func(claims Claims) { delete(claims, "exp") }), "missing expiration time"},
+		{"non-numeric expiration", createClaims(func(claims Claims) { claims["exp"] = "tomorrow" }), "missing expiration time"},
+		{"expired", createClaims(func(claims Claims) { claims["exp"] = float64(now.Add(-1 * time.Minute).Unix()) }), "expired"},
+		{"not yet valid", createClaims(func(claims Claims) { claims["nbf"] = float64(now.Add(1 * time.Minute).Unix()) }), "not valid before"},
+		{"issued in the future", createClaims(func(claims Claims) { claims["iat"] = float64(now.Add(1 * time.Minute).Unix()) }), "issued in the future"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifier.checkClaims(test.claims, now)
+			if test.expectedReason == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			assertValidationError(t, err, test.expectedReason)
+		})
+	}
+}
+
+func TestVerifyChecksClaims(t *testing.T) {
+	keys := getTestKeys(t)
+	server := newTestJwksServer(createTestJwks(keys))
+	defer server.server.Close()
+	verifier, _ := createTestVerifier(server)
+
+	claims := createTestClaims()
+	claims["exp"] = float64(time.Now().Add(-1 * time.Hour).Unix())
+
+	_, err := verifier.Verify(signTestToken("ES256", map[string]interface{}{"kid": "p256"}, claims, keys.p256))
+	assertValidationError(t, err, "expired")
+
+	claims = createTestClaims()
+	delete(claims, "exp")
+
+	_, err = verifier.Verify(signTestToken("ES256", map[string]interface{}{"kid": "p256"}, claims, keys.p256))
+	assertValidationError(t, err, "missing expiration time")
+}
@@ -0,0 +1,193 @@
+package ldap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// This is a minimal implementation of BER (Basic Encoding Rules), limited to what LDAP messages need (see RFC 4511, section 5.1):
+// single-byte tags and definite lengths.
+
+const (
+	classApplication = 0x40
+	classContext     = 0x80
+
+	constructed = 0x20
+
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	// maxMessageSize caps the size of messages we receive, so that a misbehaving server can't make us allocate arbitrary amounts of memory
+	maxMessageSize = 16 * 1024 * 1024
+)
+
+// element is a decoded BER element (its tag and its contents)
+type element struct {
+	tag      byte
+	contents []byte
+}
+
+// encode builds an element with the given tag, whose contents are the given (already encoded) parts
+func encode(tag byte, parts ...[]byte) []byte {
+	length := 0
+	for _, part := range parts {
+		length += len(part)
+	}
+
+	result := append([]byte{tag}, encodeLength(length)...)
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+func encodeLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+
+	var lengthBytes []byte
+	for ; length > 0; length >>= 8 {
+		lengthBytes = append([]byte{byte(length)}, lengthBytes...)
+	}
+	return append([]byte{0x80 | byte(len(lengthBytes))}, lengthBytes...)
+}
+
+// encodeInteger encodes the value as an integer (or enumerated) element, in minimal two's complement form
+func encodeInteger(tag byte, value int64) []byte {
+	size := 1
+	for remaining := value; remaining > 127 || remaining < -128; remaining >>= 8 {
+		size++
+	}
+
+	contents := make([]byte, size)
+	for idx := size - 1; idx >= 0; idx-- {
+		contents[idx] = byte(value)
+		value >>= 8
+	}
+	return encode(tag, contents)
+}
+
+func encodeString(tag byte, value string) []byte {
+	return encode(tag, []byte(value))
+}
+
+func encodeBoolean(tag byte, value bool) []byte {
+	if value {
+		return encode(tag, []byte{0xff})
+	}
+	return encode(tag, []byte{0x00})
+}
+
+// decodeElements decodes all elements found one after another in the given data (e.g. the contents of a sequence)
+func decodeElements(data []byte) ([]element, error) {
+	var elements []element
+	for len(data) != 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated element")
+		}
+
+		tag := data[0]
+		length, lengthSize, err := decodeLength(data[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		start := 1 + lengthSize
+		if length > len(data)-start {
+			return nil, fmt.Errorf("truncated element (expected %d bytes of contents, found %d)", length, len(data)-start)
+		}
+
+		elements = append(elements, element{tag: tag, contents: data[start : start+length]})
+		data = data[start+length:]
+	}
+	return elements, nil
+}
+
+// decodeLength decodes the length found at the start of the given data, telling how many bytes it took up
+func decodeLength(data []byte) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, fmt.Errorf("missing length")
+	}
+
+	if data[0] < 0x80 {
+		return int(data[0]), 1, nil
+	}
+
+	size := int(data[0] & 0x7f)
+	if size == 0 {
+		return 0, 0, fmt.Errorf("indefinite lengths are not supported")
+	}
+	if size > 4 {
+		return 0, 0, fmt.Errorf("length of %d bytes is too large", size)
+	}
+	if len(data) < 1+size {
+		return 0, 0, fmt.Errorf("truncated length")
+	}
+
+	length := 0
+	for _, b := range data[1 : 1+size] {
+		length = length<<8 | int(b)
+	}
+	if length < 0 {
+		return 0, 0, fmt.Errorf("invalid length")
+	}
+	return length, 1 + size, nil
+}
+
+// readElement reads a whole element (e.g. an LDAP message) from the given reader
+func readElement(reader *bufio.Reader) (element, error) {
+	tag, err := reader.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+
+	firstLengthByte, err := reader.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+
+	lengthData := []byte{firstLengthByte}
+	if firstLengthByte >= 0x80 {
+		extra := make([]byte, int(firstLengthByte&0x7f))
+		_, err = io.ReadFull(reader, extra)
+		if err != nil {
+			return element{}, err
+		}
+		lengthData = append(lengthData, extra...)
+	}
+
+	length, _, err := decodeLength(lengthData)
+	if err != nil {
+		return element{}, err
+	}
+	if length > maxMessageSize {
+		return element{}, fmt.Errorf("message of %d bytes is too large", length)
+	}
+
+	contents := make([]byte, length)
+	_, err = io.ReadFull(reader, contents)
+	if err != nil {
+		return element{}, err
+	}
+
+	return element{tag: tag, contents: contents}, nil
+}
+
+// integer decodes the element's contents as a (two's complement) integer
+func (me element) integer() (int64, error) {
+	if len(me.contents) == 0 || len(me.contents) > 8 {
+		return 0, fmt.Errorf("invalid integer of %d bytes", len(me.contents))
+	}
+
+	value := int64(int8(me.contents[0]))
+	for _, b := range me.contents[1:] {
+		value = value<<8 | int64(b)
+	}
+	return value, nil
+}
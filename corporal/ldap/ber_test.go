@@ -0,0 +1,182 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEncodeLength(t *testing.T) {
+	type testData struct {
+		length   int
+		expected []byte
+	}
+
+	tests := []testData{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x81, 0x80}},
+		{255, []byte{0x81, 0xff}},
+		{256, []byte{0x82, 0x01, 0x00}},
+		{65535, []byte{0x82, 0xff, 0xff}},
+		{65536, []byte{0x83, 0x01, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		encoded := encodeLength(test.length)
+		if !bytes.Equal(encoded, test.expected) {
+			t.Errorf("%d: expected %x, got %x", test.length, test.expected, encoded)
+			continue
+		}
+
+		length, size, err := decodeLength(encoded)
+		if err != nil {
+			t.Errorf("%d: unexpected decoding error: %s", test.length, err)
+			continue
+		}
+		if length != test.length || size != len(encoded) {
+			t.Errorf("%d: decoded as %d (taking up %d bytes)", test.length, length, size)
+		}
+	}
+}
+
+func TestEncodeDecodeElementsRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 127, 128, 300, 70000} {
+		value := strings.Repeat("x", size)
+
+		encoded := encode(tagSequence, encodeString(tagOctetString, value), encodeInteger(tagInteger, 7))
+
+		sequences, err := decodeElements(encoded)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", size, err)
+			continue
+		}
+		if len(sequences) != 1 || sequences[0].tag != tagSequence {
+			t.Errorf("%d: expected a single sequence, got %#v", size, sequences)
+			continue
+		}
+
+		parts, err := decodeElements(sequences[0].contents)
+		if err != nil {
+			t.Errorf("%d: unexpected error decoding the sequence's contents: %s", size, err)
+			continue
+		}
+		if len(parts) != 2 || parts[0].tag != tagOctetString || string(parts[0].contents) != value {
+			t.Errorf("%d: unexpected sequence contents", size)
+			continue
+		}
+		if integer, err := parts[1].integer(); err != nil || integer != 7 {
+			t.Errorf("%d: expected integer 7, got %d (error: %v)", size, integer, err)
+		}
+	}
+}
+
+func TestEncodeInteger(t *testing.T) {
+	type testData struct {
+		value    int64
+		expected []byte
+	}
+
+	tests := []testData{
+		{0, []byte{0x02, 0x01, 0x00}},
+		{127, []byte{0x02, 0x01, 0x7f}},
+		{128, []byte{0x02, 0x02, 0x00, 0x80}},
+		{256, []byte{0x02, 0x02, 0x01, 0x00}},
+		{-1, []byte{0x02, 0x01, 0xff}},
+		{-128, []byte{0x02, 0x01, 0x80}},
+		{-129, []byte{0x02, 0x02, 0xff, 0x7f}},
+		{2147483647, []byte{0x02, 0x04, 0x7f, 0xff, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		encoded := encodeInteger(tagInteger, test.value)
+		if !bytes.Equal(encoded, test.expected) {
+			t.Errorf("%d: expected %x, got %x", test.value, test.expected, encoded)
+			continue
+		}
+
+		decoded, err := element{tag: tagInteger, contents: encoded[2:]}.integer()
+		if err != nil || decoded != test.value {
+			t.Errorf("%d: decoded as %d (error: %v)", test.value, decoded, err)
+		}
+	}
+}
+
+func TestDecodeMalformedData(t *testing.T) {
+	type testData struct {
+		name string
+		data []byte
+	}
+
+	tests := []testData{
+		{"lone tag", []byte{0x04}},
+		{"truncated contents", []byte{0x04, 0x05, 'a', 'b'}},
+		{"truncated long-form length", []byte{0x04, 0x82, 0x01}},
+		{"indefinite length", []byte{0x30, 0x80, 0x00, 0x00}},
+		{"oversized length", []byte{0x04, 0x85, 0x01, 0x00, 0x00, 0x00, 0x00}},
+		{"truncated second element", []byte{0x04, 0x01, 'a', 0x04, 0x03, 'b'}},
+	}
+
+	for _, test := range tests {
+		_, err := decodeElements(test.data)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestDecodeInvalidIntegers(t *testing.T) {
+	for _, contents := range [][]byte{{}, bytes.Repeat([]byte{0x01}, 9)} {
+		_, err := element{tag: tagInteger, contents: contents}.integer()
+		if err == nil {
+			t.Errorf("expected an error for an integer of %d bytes", len(contents))
+		}
+	}
+}
+
+func TestReadElement(t *testing.T) {
+	value := strings.Repeat("y", 1000)
+	encoded := encode(tagSequence, encodeString(tagOctetString, value))
+
+	// Two messages one after another, as they would arrive on a connection
+	reader := bufio.NewReader(bytes.NewReader(append(append([]byte{}, encoded...), encoded...)))
+
+	for i := 0; i < 2; i++ {
+		message, err := readElement(reader)
+		if err != nil {
+			t.Fatalf("message %d: unexpected error: %s", i, err)
+		}
+		if message.tag != tagSequence || len(message.contents) != len(encoded)-4 {
+			t.Fatalf("message %d: unexpected element (tag 0x%x, %d bytes)", i, message.tag, len(message.contents))
+		}
+	}
+
+	if _, err := readElement(reader); err != io.EOF {
+		t.Errorf("expected EOF after the last message, got %v", err)
+	}
+}
+
+func TestReadElementRejectsMalformedMessages(t *testing.T) {
+	type testData struct {
+		name string
+		data []byte
+	}
+
+	tests := []testData{
+		{"missing length", []byte{0x30}},
+		{"truncated long-form length", []byte{0x30, 0x84, 0x00}},
+		{"truncated contents", []byte{0x30, 0x82, 0x01, 0x00, 0x02}},
+		{"indefinite length", []byte{0x30, 0x80}},
+		{"too large", []byte{0x30, 0x84, 0x7f, 0xff, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		_, err := readElement(bufio.NewReader(bytes.NewReader(test.data)))
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
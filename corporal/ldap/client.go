@@ -0,0 +1,256 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UsernamePlaceholder is what gets replaced with the (escaped) username in BindDnTemplate and SearchFilter
+const UsernamePlaceholder = "{username}"
+
+type Options struct {
+	// Url is the LDAP server's URL, e.g. `ldaps://ldap.example.com` or `ldap://ldap.example.com:389`
+	Url string
+
+	// StartTls makes `ldap://` connections get upgraded to TLS (with the StartTLS extended operation), before anything else happens on them
+	StartTls bool
+
+	// TlsConfig (if set) is used for TLS connections (e.g. for trusting a private certificate authority)
+	TlsConfig *tls.Config
+
+	// Timeout applies to connecting and to each operation
+	Timeout time.Duration
+
+	// PoolSize specifies how many idle connections are kept around for reuse
+	PoolSize int
+
+	// BindDnTemplate is the DN that users get bound as, e.g. `uid={username},ou=people,dc=example,dc=com` (or `{username}@example.com`, for Active Directory).
+	// When empty, the user's DN gets searched for instead (see SearchFilter).
+	BindDnTemplate string
+
+	// SearchBaseDn and SearchFilter (e.g. `(&(objectClass=person)(uid={username}))`) are for searching for the user's DN, which is then bound as.
+	// The search happens after binding as SearchBindDn (anonymously, if empty).
+	SearchBaseDn       string
+	SearchFilter       string
+	SearchBindDn       string
+	SearchBindPassword string
+}
+
+// Client verifies users' credentials by binding to an LDAP server as them (see Authenticate).
+// Connections are pooled and safe to use from multiple goroutines.
+type Client struct {
+	options Options
+
+	address  string
+	useTls   bool
+	startTls bool
+
+	pool chan *conn
+}
+
+func NewClient(options Options) (*Client, error) {
+	serverUrl, err := url.Parse(options.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", err)
+	}
+
+	var useTls bool
+	var defaultPort string
+	switch serverUrl.Scheme {
+	case "ldap":
+		defaultPort = "389"
+	case "ldaps":
+		useTls = true
+		defaultPort = "636"
+	default:
+		return nil, fmt.Errorf("the URL needs to start with ldap:// or ldaps://")
+	}
+
+	if serverUrl.Hostname() == "" {
+		return nil, fmt.Errorf("the URL needs to contain a host")
+	}
+	if options.StartTls && useTls {
+		return nil, fmt.Errorf("StartTLS cannot be used with ldaps://")
+	}
+
+	port := serverUrl.Port()
+	if port == "" {
+		port = defaultPort
+	}
+
+	if options.BindDnTemplate == "" {
+		if options.SearchBaseDn == "" || options.SearchFilter == "" {
+			return nil, fmt.Errorf("either a bind DN template or a search base DN and filter need to be specified")
+		}
+		if !strings.Contains(options.SearchFilter, UsernamePlaceholder) {
+			return nil, fmt.Errorf("the search filter needs to contain %s", UsernamePlaceholder)
+		}
+		_, err = compileFilter(strings.Replace(options.SearchFilter, UsernamePlaceholder, "test", -1))
+		if err != nil {
+			return nil, err
+		}
+	} else if !strings.Contains(options.BindDnTemplate, UsernamePlaceholder) {
+		return nil, fmt.Errorf("the bind DN template needs to contain %s", UsernamePlaceholder)
+	}
+
+	tlsConfig := &tls.Config{}
+	if options.TlsConfig != nil {
+		tlsConfig = options.TlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverUrl.Hostname()
+	}
+	options.TlsConfig = tlsConfig
+
+	if options.PoolSize < 0 {
+		options.PoolSize = 0
+	}
+
+	return &Client{
+		options: options,
+
+		address:  net.JoinHostPort(serverUrl.Hostname(), port),
+		useTls:   useTls,
+		startTls: options.StartTls,
+
+		pool: make(chan *conn, options.PoolSize),
+	}, nil
+}
+
+// Authenticate tells whether the given password is the right one for the user with the given username,
+// by binding as the user's DN (see Options.BindDnTemplate and Options.SearchFilter).
+//
+// Empty passwords are always rejected, as binding with them counts as an anonymous ("unauthenticated") bind, which servers may allow.
+func (me *Client) Authenticate(username string, password string) (bool, error) {
+	if username == "" || password == "" {
+		return false, nil
+	}
+
+	var isAuthenticated bool
+	err := me.withConnection(func(c *conn) error {
+		dn, err := me.determineUserDn(c, username)
+		if err != nil || dn == "" {
+			isAuthenticated = false
+			return err
+		}
+
+		isAuthenticated, err = c.bind(dn, password)
+		return err
+	})
+
+	return isAuthenticated, err
+}
+
+// determineUserDn returns the DN of the user with the given username, or an empty string if there's no such user
+func (me *Client) determineUserDn(c *conn, username string) (string, error) {
+	if me.options.BindDnTemplate != "" {
+		return strings.Replace(me.options.BindDnTemplate, UsernamePlaceholder, EscapeDnValue(username), -1), nil
+	}
+
+	isBound, err := c.bind(me.options.SearchBindDn, me.options.SearchBindPassword)
+	if err != nil {
+		return "", fmt.Errorf("failed binding as %s for searching: %s", me.options.SearchBindDn, err)
+	}
+	if !isBound {
+		return "", fmt.Errorf("the credentials for %s (used for searching) were rejected", me.options.SearchBindDn)
+	}
+
+	filter, err := compileFilter(strings.Replace(me.options.SearchFilter, UsernamePlaceholder, EscapeFilterValue(username), -1))
+	if err != nil {
+		return "", err
+	}
+
+	// Asking for 2 results, so that we can tell if there's more than one match
+	dns, err := c.search(me.options.SearchBaseDn, filter, 2)
+	if err != nil {
+		return "", err
+	}
+
+	if len(dns) == 0 {
+		return "", nil
+	}
+	if len(dns) > 1 {
+		return "", fmt.Errorf("more than one entry matches the search filter for %s", username)
+	}
+	return dns[0], nil
+}
+
+// withConnection calls the callback with a pooled (or a new) connection, which is returned to the pool afterwards (unless anything failed).
+// Pooled connections may have been closed by the server in the meantime, so failures on them are retried with another connection
+// (up until a new connection fails as well).
+func (me *Client) withConnection(callback func(c *conn) error) error {
+	for {
+		c, isReused, err := me.getConnection()
+		if err != nil {
+			return fmt.Errorf("failed connecting to %s: %s", me.address, err)
+		}
+
+		err = callback(c)
+		if err == nil {
+			me.putConnection(c)
+			return nil
+		}
+
+		c.close()
+
+		if !isReused {
+			return err
+		}
+	}
+}
+
+func (me *Client) getConnection() (*conn, bool, error) {
+	select {
+	case c := <-me.pool:
+		return c, true, nil
+	default:
+	}
+
+	c, err := dial("tcp", me.address, me.useTls, me.startTls, me.options.TlsConfig, me.options.Timeout)
+	return c, false, err
+}
+
+func (me *Client) putConnection(c *conn) {
+	select {
+	case me.pool <- c:
+	default:
+		c.close()
+	}
+}
+
+// Close closes all pooled connections
+func (me *Client) Close() {
+	for {
+		select {
+		case c := <-me.pool:
+			c.close()
+		default:
+			return
+		}
+	}
+}
+
+// EscapeDnValue escapes the given value, so that it can be made part of a DN (see RFC 4514, section 2.4)
+// without any of its characters having a special meaning
+func EscapeDnValue(value string) string {
+	var result strings.Builder
+	for idx := 0; idx < len(value); idx++ {
+		b := value[idx]
+
+		switch {
+		case b == 0:
+			result.WriteString(`\00`)
+			continue
+		case strings.IndexByte(`"+,;<>\=`, b) != -1,
+			(b == ' ' || b == '#') && idx == 0,
+			b == ' ' && idx == len(value)-1:
+			result.WriteByte('\\')
+		}
+		result.WriteByte(b)
+	}
+	return result.String()
+}
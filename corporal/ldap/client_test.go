@@ -0,0 +1,291 @@
+package ldap
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDirectory is an LDAP server (see serveTestConnection) holding users' passwords by DN,
+// which also supports searching for DNs by the `uid` attribute (with filters like `(uid=...)`)
+type testDirectory struct {
+	listener net.Listener
+
+	passwords map[string]string
+	uids      map[string][]string
+
+	lock            sync.Mutex
+	boundDns        []string
+	searchedUids    []string
+	connectionCount int
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %s", err)
+	}
+
+	me := &testDirectory{
+		listener: listener,
+		passwords: map[string]string{
+			"cn=reader,dc=example,dc=com":                "reader-password",
+			"uid=john,ou=people,dc=example,dc=com":       "john-password",
+			`uid=doe\, jane,ou=people,dc=example,dc=com`: "jane-password",
+		},
+		uids: map[string][]string{
+			"john":  {"uid=john,ou=people,dc=example,dc=com"},
+			"twins": {"uid=twins,ou=people,dc=example,dc=com", "uid=twins,ou=staff,dc=example,dc=com"},
+		},
+	}
+
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			me.lock.Lock()
+			me.connectionCount++
+			me.lock.Unlock()
+
+			go serveTestConnection(netConn, me.handle)
+		}
+	}()
+
+	return me
+}
+
+func (me *testDirectory) handle(messageId int64, operation element) [][]byte {
+	switch operation.tag {
+	case opTagBindRequest:
+		dn, password := parseTestBindRequest(operation)
+
+		me.lock.Lock()
+		me.boundDns = append(me.boundDns, dn)
+		me.lock.Unlock()
+
+		expectedPassword, exists := me.passwords[dn]
+		if !exists || password != expectedPassword {
+			return [][]byte{encodeTestMessage(messageId, encodeTestResult(opTagBindResponse, resultCodeInvalidCredentials, ""))}
+		}
+		return [][]byte{encodeTestMessage(messageId, encodeTestResult(opTagBindResponse, resultCodeSuccess, ""))}
+	case opTagSearchRequest:
+		parts, _ := decodeElements(operation.contents)
+		filterParts, _ := decodeElements(parts[6].contents)
+		uid := string(filterParts[1].contents)
+
+		me.lock.Lock()
+		me.searchedUids = append(me.searchedUids, uid)
+		me.lock.Unlock()
+
+		var responses [][]byte
+		for _, dn := range me.uids[uid] {
+			responses = append(responses, encodeTestMessage(messageId, encodeTestSearchResultEntry(dn)))
+		}
+		return append(responses, encodeTestMessage(messageId, encodeTestResult(opTagSearchResultDone, resultCodeSuccess, "")))
+	}
+
+	return nil
+}
+
+func (me *testDirectory) url() string {
+	return "ldap://" + me.listener.Addr().String()
+}
+
+func (me *testDirectory) close() {
+	me.listener.Close()
+}
+
+func TestNewClientValidatesOptions(t *testing.T) {
+	type testData struct {
+		name    string
+		options Options
+	}
+
+	tests := []testData{
+		{"invalid scheme", Options{Url: "http://ldap.example.com", BindDnTemplate: "uid={username}"}},
+		{"missing host", Options{Url: "ldap://", BindDnTemplate: "uid={username}"}},
+		{"StartTLS with ldaps", Options{Url: "ldaps://ldap.example.com", StartTls: true, BindDnTemplate: "uid={username}"}},
+		{"bind DN template without placeholder", Options{Url: "ldap://ldap.example.com", BindDnTemplate: "uid=john"}},
+		{"neither bind DN template nor search", Options{Url: "ldap://ldap.example.com"}},
+		{"search without filter", Options{Url: "ldap://ldap.example.com", SearchBaseDn: "dc=example,dc=com"}},
+		{"search filter without placeholder", Options{Url: "ldap://ldap.example.com", SearchBaseDn: "dc=example,dc=com", SearchFilter: "(uid=john)"}},
+		{"invalid search filter", Options{Url: "ldap://ldap.example.com", SearchBaseDn: "dc=example,dc=com", SearchFilter: "(uid={username}"}},
+	}
+
+	for _, test := range tests {
+		_, err := NewClient(test.options)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestNewClientUsesDefaultPorts(t *testing.T) {
+	for url, expectedAddress := range map[string]string{
+		"ldap://ldap.example.com":       "ldap.example.com:389",
+		"ldaps://ldap.example.com":      "ldap.example.com:636",
+		"ldap://ldap.example.com:10389": "ldap.example.com:10389",
+	} {
+		client, err := NewClient(Options{Url: url, BindDnTemplate: "uid={username}"})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", url, err)
+			continue
+		}
+		if client.address != expectedAddress {
+			t.Errorf("%s: expected address %s, got %s", url, expectedAddress, client.address)
+		}
+	}
+}
+
+func TestAuthenticateWithBindDnTemplate(t *testing.T) {
+	directory := newTestDirectory(t)
+	defer directory.close()
+
+	client, err := NewClient(Options{
+		Url:            directory.url(),
+		Timeout:        5 * time.Second,
+		PoolSize:       1,
+		BindDnTemplate: "uid={username},ou=people,dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer client.Close()
+
+	type testData struct {
+		username      string
+		password      string
+		expectedValid bool
+	}
+
+	tests := []testData{
+		{"john", "john-password", true},
+		{"john", "wrong", false},
+		{"john", "", false},
+		{"", "john-password", false},
+		{"nobody", "john-password", false},
+		{"doe, jane", "jane-password", true},
+	}
+
+	for _, test := range tests {
+		isValid, err := client.Authenticate(test.username, test.password)
+		if err != nil {
+			t.Errorf("%s/%s: unexpected error: %s", test.username, test.password, err)
+			continue
+		}
+		if isValid != test.expectedValid {
+			t.Errorf("%s/%s: expected %t, got %t", test.username, test.password, test.expectedValid, isValid)
+		}
+	}
+
+	directory.lock.Lock()
+	defer directory.lock.Unlock()
+
+	// Empty usernames and passwords never make it to the server
+	if len(directory.boundDns) != 4 {
+		t.Errorf("expected 4 binds, got %d: %v", len(directory.boundDns), directory.boundDns)
+	}
+	if directory.connectionCount != 1 {
+		t.Errorf("expected the connection to be reused, but %d were made", directory.connectionCount)
+	}
+}
+
+func TestAuthenticateWithSearch(t *testing.T) {
+	directory := newTestDirectory(t)
+	defer directory.close()
+
+	client, err := NewClient(Options{
+		Url:                directory.url(),
+		Timeout:            5 * time.Second,
+		SearchBaseDn:       "dc=example,dc=com",
+		SearchFilter:       "(uid={username})",
+		SearchBindDn:       "cn=reader,dc=example,dc=com",
+		SearchBindPassword: "reader-password",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer client.Close()
+
+	isValid, err := client.Authenticate("john", "john-password")
+	if err != nil || !isValid {
+		t.Errorf("expected john to be authenticated, got %t (error: %v)", isValid, err)
+	}
+
+	isValid, err = client.Authenticate("john", "wrong")
+	if err != nil || isValid {
+		t.Errorf("expected john not to be authenticated with the wrong password, got %t (error: %v)", isValid, err)
+	}
+
+	// Searching for wildcards (or anything else with a special meaning in filters) looks for them literally
+	isValid, err = client.Authenticate("*", "john-password")
+	if err != nil || isValid {
+		t.Errorf("expected `*` not to be authenticated, got %t (error: %v)", isValid, err)
+	}
+
+	_, err = client.Authenticate("twins", "whatever")
+	if err == nil {
+		t.Errorf("expected an error, as more than one entry matches")
+	}
+
+	directory.lock.Lock()
+	searchedUids := directory.searchedUids
+	directory.lock.Unlock()
+	if len(searchedUids) != 4 || searchedUids[2] != "*" {
+		t.Errorf("unexpected searches: %v", searchedUids)
+	}
+}
+
+func TestAuthenticateWithRejectedSearchCredentials(t *testing.T) {
+	directory := newTestDirectory(t)
+	defer directory.close()
+
+	client, err := NewClient(Options{
+		Url:                directory.url(),
+		Timeout:            5 * time.Second,
+		SearchBaseDn:       "dc=example,dc=com",
+		SearchFilter:       "(uid={username})",
+		SearchBindDn:       "cn=reader,dc=example,dc=com",
+		SearchBindPassword: "wrong",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer client.Close()
+
+	_, err = client.Authenticate("john", "john-password")
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestEscapeDnValue(t *testing.T) {
+	type testData struct {
+		value    string
+		expected string
+	}
+
+	tests := []testData{
+		{"john", "john"},
+		{"*()", "*()"},
+		{`\`, `\\`},
+		{"\x00", `\00`},
+		{"doe, jane", `doe\, jane`},
+		{`a+b"c;d<e>f=g`, `a\+b\"c\;d\<e\>f\=g`},
+		{" john ", `\ john\ `},
+		{"#john#", `\#john#`},
+		{"jo hn", "jo hn"},
+		{`uid=admin,dc=example,dc=com\00`, `uid\=admin\,dc\=example\,dc\=com\\00`},
+	}
+
+	for _, test := range tests {
+		escaped := EscapeDnValue(test.value)
+		if escaped != test.expected {
+			t.Errorf("%q: expected `%s`, got `%s`", test.value, test.expected, escaped)
+		}
+	}
+}
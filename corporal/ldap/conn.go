@@ -0,0 +1,286 @@
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Protocol operation tags (see RFC 4511, section 4.2 onwards)
+const (
+	opTagBindRequest           = classApplication | constructed | 0
+	opTagBindResponse          = classApplication | constructed | 1
+	opTagUnbindRequest         = classApplication | 2
+	opTagSearchRequest         = classApplication | constructed | 3
+	opTagSearchResultEntry     = classApplication | constructed | 4
+	opTagSearchResultDone      = classApplication | constructed | 5
+	opTagSearchResultReference = classApplication | constructed | 19
+	opTagExtendedRequest       = classApplication | constructed | 23
+	opTagExtendedResponse      = classApplication | constructed | 24
+)
+
+const (
+	resultCodeSuccess            = 0
+	resultCodeInvalidCredentials = 49
+
+	// startTlsOid is the name of the StartTLS extended operation (see RFC 4511, section 4.14)
+	startTlsOid = "1.3.6.1.4.1.1466.20037"
+
+	protocolVersion = 3
+
+	searchScopeWholeSubtree = 2
+	derefAliasesAlways      = 3
+)
+
+// resultError is an operation's result, which is neither success nor something we handle otherwise (like invalid credentials)
+type resultError struct {
+	operation string
+	code      int64
+	message   string
+}
+
+func (me resultError) Error() string {
+	if me.message == "" {
+		return fmt.Sprintf("%s failed with result code %d", me.operation, me.code)
+	}
+	return fmt.Sprintf("%s failed with result code %d: %s", me.operation, me.code, me.message)
+}
+
+// conn is a connection to an LDAP server, on which operations happen one at a time
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	lastMessageId int64
+}
+
+func dial(network string, address string, useTls bool, startTls bool, tlsConfig *tls.Config, timeout time.Duration) (*conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var netConn net.Conn
+	var err error
+	if useTls {
+		netConn, err = tls.DialWithDialer(dialer, network, address, tlsConfig)
+	} else {
+		netConn, err = dialer.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	me := &conn{
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		timeout: timeout,
+	}
+
+	if startTls {
+		err = me.startTls(tlsConfig)
+		if err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("StartTLS failed: %s", err)
+		}
+	}
+
+	return me, nil
+}
+
+// bind authenticates the connection with the given DN and password (simple authentication),
+// telling whether the credentials were accepted
+func (me *conn) bind(dn string, password string) (bool, error) {
+	messageId, err := me.send(encode(
+		opTagBindRequest,
+		encodeInteger(tagInteger, protocolVersion),
+		encodeString(tagOctetString, dn),
+		encodeString(classContext|0, password),
+	))
+	if err != nil {
+		return false, err
+	}
+
+	response, err := me.receive(messageId, opTagBindResponse)
+	if err != nil {
+		return false, err
+	}
+
+	code, message, err := parseResult(response)
+	if err != nil {
+		return false, err
+	}
+
+	if code == resultCodeInvalidCredentials {
+		return false, nil
+	}
+	if code != resultCodeSuccess {
+		return false, resultError{operation: "bind", code: code, message: message}
+	}
+	return true, nil
+}
+
+// search returns the DNs of the entries below baseDn which match the given (encoded, see compileFilter) filter.
+// No attributes are requested, as only DNs are of interest.
+func (me *conn) search(baseDn string, filter []byte, sizeLimit int64) ([]string, error) {
+	messageId, err := me.send(encode(
+		opTagSearchRequest,
+		encodeString(tagOctetString, baseDn),
+		encodeInteger(tagEnumerated, searchScopeWholeSubtree),
+		encodeInteger(tagEnumerated, derefAliasesAlways),
+		encodeInteger(tagInteger, sizeLimit),
+		encodeInteger(tagInteger, int64(me.timeout/time.Second)),
+		encodeBoolean(tagBoolean, false),
+		filter,
+		// `1.1` stands for "no attributes" (see RFC 4511, section 4.5.1.8)
+		encode(tagSequence, encodeString(tagOctetString, "1.1")),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var dns []string
+	for {
+		response, err := me.receive(messageId, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		switch response.tag {
+		case opTagSearchResultEntry:
+			parts, err := decodeElements(response.contents)
+			if err != nil || len(parts) == 0 {
+				return nil, fmt.Errorf("invalid search result entry")
+			}
+			dns = append(dns, string(parts[0].contents))
+		case opTagSearchResultReference:
+			// We don't follow referrals
+		case opTagSearchResultDone:
+			code, message, err := parseResult(response)
+			if err != nil {
+				return nil, err
+			}
+			if code != resultCodeSuccess {
+				return nil, resultError{operation: "search", code: code, message: message}
+			}
+			return dns, nil
+		default:
+			return nil, fmt.Errorf("unexpected response (tag 0x%x) to search", response.tag)
+		}
+	}
+}
+
+func (me *conn) startTls(tlsConfig *tls.Config) error {
+	messageId, err := me.send(encode(
+		opTagExtendedRequest,
+		encodeString(classContext|0, startTlsOid),
+	))
+	if err != nil {
+		return err
+	}
+
+	response, err := me.receive(messageId, opTagExtendedResponse)
+	if err != nil {
+		return err
+	}
+
+	code, message, err := parseResult(response)
+	if err != nil {
+		return err
+	}
+	if code != resultCodeSuccess {
+		return resultError{operation: "StartTLS", code: code, message: message}
+	}
+
+	tlsConn := tls.Client(me.netConn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(me.timeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+
+	me.netConn = tlsConn
+	me.reader = bufio.NewReader(tlsConn)
+
+	return nil
+}
+
+// close unbinds (as a courtesy to the server) and closes the connection
+func (me *conn) close() {
+	me.send(encode(opTagUnbindRequest))
+	me.netConn.Close()
+}
+
+// send sends a message containing the given (encoded) protocol operation, returning the message's id
+func (me *conn) send(operation []byte) (int64, error) {
+	me.lastMessageId++
+	messageId := me.lastMessageId
+
+	err := me.netConn.SetDeadline(time.Now().Add(me.timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = me.netConn.Write(encode(tagSequence, encodeInteger(tagInteger, messageId), operation))
+	if err != nil {
+		return 0, err
+	}
+
+	return messageId, nil
+}
+
+// receive reads the next message, which is expected to be a response to the given message and (unless 0) to have the given operation tag
+func (me *conn) receive(messageId int64, expectedTag byte) (element, error) {
+	message, err := readElement(me.reader)
+	if err != nil {
+		return element{}, err
+	}
+	if message.tag != tagSequence {
+		return element{}, fmt.Errorf("unexpected message (tag 0x%x)", message.tag)
+	}
+
+	parts, err := decodeElements(message.contents)
+	if err != nil {
+		return element{}, err
+	}
+	if len(parts) < 2 {
+		return element{}, fmt.Errorf("invalid message")
+	}
+
+	responseMessageId, err := parts[0].integer()
+	if err != nil {
+		return element{}, err
+	}
+	if responseMessageId == 0 {
+		// An unsolicited notification (see RFC 4511, section 4.4), most likely about the server disconnecting us
+		_, notificationMessage, _ := parseResult(parts[1])
+		return element{}, fmt.Errorf("the server sent a notice of disconnection: %s", notificationMessage)
+	}
+	if responseMessageId != messageId {
+		return element{}, fmt.Errorf("unexpected response to message %d, while expecting one to message %d", responseMessageId, messageId)
+	}
+
+	if expectedTag != 0 && parts[1].tag != expectedTag {
+		return element{}, fmt.Errorf("unexpected response (tag 0x%x), while expecting tag 0x%x", parts[1].tag, expectedTag)
+	}
+
+	return parts[1], nil
+}
+
+// parseResult extracts the result code and diagnostic message from an LDAPResult-based response (see RFC 4511, section 4.1.9)
+func parseResult(response element) (int64, string, error) {
+	parts, err := decodeElements(response.contents)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(parts) < 3 || parts[0].tag != tagEnumerated {
+		return 0, "", fmt.Errorf("invalid result")
+	}
+
+	code, err := parts[0].integer()
+	if err != nil {
+		return 0, "", err
+	}
+
+	return code, string(parts[2].contents), nil
+}
@@ -0,0 +1,305 @@
+package ldap
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHandler produces the (raw, see encodeTestMessage) messages to send back in response to a request.
+// Returning nil makes the connection get closed (without responding), as does a nil message (after the ones before it got sent).
+type testHandler func(messageId int64, operation element) [][]byte
+
+func encodeTestMessage(messageId int64, operation []byte) []byte {
+	return encode(tagSequence, encodeInteger(tagInteger, messageId), operation)
+}
+
+func encodeTestResult(tag byte, code int64, message string) []byte {
+	return encode(
+		tag,
+		encodeInteger(tagEnumerated, code),
+		encodeString(tagOctetString, ""),
+		encodeString(tagOctetString, message),
+	)
+}
+
+func encodeTestSearchResultEntry(dn string) []byte {
+	return encode(opTagSearchResultEntry, encodeString(tagOctetString, dn), encode(tagSequence))
+}
+
+// serveTestConnection plays the part of an LDAP server on the given connection, until it gets closed or an unbind request arrives
+func serveTestConnection(netConn net.Conn, handler testHandler) {
+	defer netConn.Close()
+
+	reader := bufio.NewReader(netConn)
+	for {
+		message, err := readElement(reader)
+		if err != nil {
+			return
+		}
+
+		parts, err := decodeElements(message.contents)
+		if err != nil || len(parts) < 2 {
+			return
+		}
+		messageId, _ := parts[0].integer()
+
+		if parts[1].tag == opTagUnbindRequest {
+			return
+		}
+
+		responses := handler(messageId, parts[1])
+		if responses == nil {
+			return
+		}
+		for _, response := range responses {
+			if response == nil {
+				return
+			}
+			_, err = netConn.Write(response)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// createTestConn creates a connection to a server (see serveTestConnection) handling requests with the given handler
+func createTestConn(handler testHandler) *conn {
+	clientConn, serverConn := net.Pipe()
+
+	go serveTestConnection(serverConn, handler)
+
+	return &conn{
+		netConn: clientConn,
+		reader:  bufio.NewReader(clientConn),
+		timeout: 5 * time.Second,
+	}
+}
+
+// parseTestBindRequest returns the DN and password of a bind request
+func parseTestBindRequest(operation element) (string, string) {
+	parts, err := decodeElements(operation.contents)
+	if err != nil || len(parts) != 3 {
+		return "", ""
+	}
+	return string(parts[1].contents), string(parts[2].contents)
+}
+
+func TestBind(t *testing.T) {
+	type testData struct {
+		name          string
+		resultCode    int64
+		expectedBound bool
+		expectedError string
+	}
+
+	tests := []testData{
+		{"success", resultCodeSuccess, true, ""},
+		{"invalid credentials", resultCodeInvalidCredentials, false, ""},
+		{"other failure", 53, false, "bind failed with result code 53: unwilling"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var request element
+			c := createTestConn(func(messageId int64, operation element) [][]byte {
+				request = operation
+				return [][]byte{encodeTestMessage(messageId, encodeTestResult(opTagBindResponse, test.resultCode, "unwilling"))}
+			})
+			defer c.close()
+
+			isBound, err := c.bind("uid=john,dc=example,dc=com", "secret")
+			if test.expectedError == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.expectedError != "" && (err == nil || err.Error() != test.expectedError) {
+				t.Fatalf("expected error `%s`, got %v", test.expectedError, err)
+			}
+			if isBound != test.expectedBound {
+				t.Errorf("expected bound to be %t, got %t", test.expectedBound, isBound)
+			}
+
+			parts, err := decodeElements(request.contents)
+			if err != nil || len(parts) != 3 {
+				t.Fatalf("unexpected bind request: %x", request.contents)
+			}
+			if version, _ := parts[0].integer(); version != protocolVersion {
+				t.Errorf("unexpected protocol version %d", version)
+			}
+			if dn, password := parseTestBindRequest(request); dn != "uid=john,dc=example,dc=com" || password != "secret" {
+				t.Errorf("unexpected credentials in bind request: %s / %s", dn, password)
+			}
+			if parts[2].tag != classContext|0 {
+				t.Errorf("expected simple authentication, got tag 0x%x", parts[2].tag)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	filter, err := compileFilter("(uid=john)")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var request element
+	c := createTestConn(func(messageId int64, operation element) [][]byte {
+		request = operation
+		return [][]byte{
+			encodeTestMessage(messageId, encodeTestSearchResultEntry("uid=john,ou=people,dc=example,dc=com")),
+			encodeTestMessage(messageId, encode(opTagSearchResultReference, encodeString(tagOctetString, "ldap://elsewhere.example.com"))),
+			encodeTestMessage(messageId, encodeTestSearchResultEntry("uid=john,ou=staff,dc=example,dc=com")),
+			encodeTestMessage(messageId, encodeTestResult(opTagSearchResultDone, resultCodeSuccess, "")),
+		}
+	})
+	defer c.close()
+
+	dns, err := c.search("dc=example,dc=com", filter, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Join(dns, ";") != "uid=john,ou=people,dc=example,dc=com;uid=john,ou=staff,dc=example,dc=com" {
+		t.Errorf("unexpected DNs: %v", dns)
+	}
+
+	parts, err := decodeElements(request.contents)
+	if err != nil || len(parts) != 8 {
+		t.Fatalf("unexpected search request: %x", request.contents)
+	}
+	if string(parts[0].contents) != "dc=example,dc=com" {
+		t.Errorf("unexpected base DN `%s`", parts[0].contents)
+	}
+	if sizeLimit, _ := parts[3].integer(); sizeLimit != 2 {
+		t.Errorf("unexpected size limit %d", sizeLimit)
+	}
+	if encoded := encode(parts[6].tag, parts[6].contents); string(encoded) != string(filter) {
+		t.Errorf("unexpected filter %x", encoded)
+	}
+}
+
+func TestSearchFailure(t *testing.T) {
+	c := createTestConn(func(messageId int64, operation element) [][]byte {
+		return [][]byte{encodeTestMessage(messageId, encodeTestResult(opTagSearchResultDone, 32, "no such object"))}
+	})
+	defer c.close()
+
+	filter, _ := compileFilter("(uid=john)")
+	_, err := c.search("dc=example,dc=com", filter, 2)
+	if err == nil || err.Error() != "search failed with result code 32: no such object" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMalformedResponses(t *testing.T) {
+	type testData struct {
+		name     string
+		response func(messageId int64) [][]byte
+	}
+
+	tests := []testData{
+		{
+			"not a sequence",
+			func(messageId int64) [][]byte {
+				return [][]byte{encode(tagSet, encodeInteger(tagInteger, messageId), encodeTestResult(opTagBindResponse, 0, ""))}
+			},
+		},
+		{
+			"missing protocol operation",
+			func(messageId int64) [][]byte {
+				return [][]byte{encode(tagSequence, encodeInteger(tagInteger, messageId))}
+			},
+		},
+		{
+			"invalid message id",
+			func(messageId int64) [][]byte {
+				return [][]byte{encode(tagSequence, encode(tagInteger), encodeTestResult(opTagBindResponse, 0, ""))}
+			},
+		},
+		{
+			"response to another message",
+			func(messageId int64) [][]byte {
+				return [][]byte{encodeTestMessage(messageId+1, encodeTestResult(opTagBindResponse, 0, ""))}
+			},
+		},
+		{
+			"unexpected protocol operation",
+			func(messageId int64) [][]byte {
+				return [][]byte{encodeTestMessage(messageId, encodeTestResult(opTagSearchResultDone, 0, ""))}
+			},
+		},
+		{
+			"notice of disconnection",
+			func(messageId int64) [][]byte {
+				return [][]byte{encodeTestMessage(0, encodeTestResult(opTagExtendedResponse, 52, "going away"))}
+			},
+		},
+		{
+			"incomplete result",
+			func(messageId int64) [][]byte {
+				return [][]byte{encodeTestMessage(messageId, encode(opTagBindResponse, encodeInteger(tagEnumerated, 0)))}
+			},
+		},
+		{
+			"result code which is not an enumeration",
+			func(messageId int64) [][]byte {
+				return [][]byte{encodeTestMessage(messageId, encode(
+					opTagBindResponse,
+					encodeString(tagOctetString, "0"),
+					encodeString(tagOctetString, ""),
+					encodeString(tagOctetString, ""),
+				))}
+			},
+		},
+		{
+			"truncated element within the message",
+			func(messageId int64) [][]byte {
+				return [][]byte{encode(tagSequence, encodeInteger(tagInteger, messageId), []byte{opTagBindResponse, 0x10, 0x0a})}
+			},
+		},
+		{
+			"truncated message",
+			func(messageId int64) [][]byte {
+				return [][]byte{encodeTestMessage(messageId, encodeTestResult(opTagBindResponse, 0, ""))[:6], nil}
+			},
+		},
+		{
+			"no response",
+			func(messageId int64) [][]byte {
+				return nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := createTestConn(func(messageId int64, operation element) [][]byte {
+				return test.response(messageId)
+			})
+			defer c.close()
+
+			isBound, err := c.bind("uid=john,dc=example,dc=com", "secret")
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+			if isBound {
+				t.Errorf("expected not to be bound")
+			}
+		})
+	}
+}
+
+func TestInvalidSearchResultEntry(t *testing.T) {
+	c := createTestConn(func(messageId int64, operation element) [][]byte {
+		return [][]byte{encodeTestMessage(messageId, encode(opTagSearchResultEntry))}
+	})
+	defer c.close()
+
+	filter, _ := compileFilter("(uid=john)")
+	_, err := c.search("dc=example,dc=com", filter, 2)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
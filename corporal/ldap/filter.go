@@ -0,0 +1,253 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choice tags (see RFC 4511, section 4.5.1)
+const (
+	filterTagAnd             = classContext | constructed | 0
+	filterTagOr              = classContext | constructed | 1
+	filterTagNot             = classContext | constructed | 2
+	filterTagEqualityMatch   = classContext | constructed | 3
+	filterTagSubstrings      = classContext | constructed | 4
+	filterTagGreaterOrEqual  = classContext | constructed | 5
+	filterTagLessOrEqual     = classContext | constructed | 6
+	filterTagPresent         = classContext | 7
+	filterTagApproxMatch     = classContext | constructed | 8
+	filterTagExtensibleMatch = classContext | constructed | 9
+)
+
+var filterValueEscaper = strings.NewReplacer(`\`, `\5c`, `*`, `\2a`, `(`, `\28`, `)`, `\29`, "\x00", `\00`)
+
+// EscapeFilterValue escapes the given value, so that it can be made part of a search filter (see RFC 4515, section 3)
+// without any of its characters having a special meaning
+func EscapeFilterValue(value string) string {
+	return filterValueEscaper.Replace(value)
+}
+
+// compileFilter encodes the given string representation of a search filter (see RFC 4515), e.g. `(&(objectClass=person)(uid=john))`
+func compileFilter(filter string) ([]byte, error) {
+	parser := &filterParser{filter: filter}
+
+	encoded, err := parser.parseFilter()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter `%s`: %s", filter, err)
+	}
+	if parser.position != len(filter) {
+		return nil, fmt.Errorf("invalid filter `%s`: unexpected data at position %d", filter, parser.position)
+	}
+	return encoded, nil
+}
+
+type filterParser struct {
+	filter   string
+	position int
+}
+
+func (me *filterParser) parseFilter() ([]byte, error) {
+	if me.position >= len(me.filter) || me.filter[me.position] != '(' {
+		return nil, fmt.Errorf("expected `(` at position %d", me.position)
+	}
+	me.position++
+
+	if me.position >= len(me.filter) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+
+	var encoded []byte
+	var err error
+
+	switch me.filter[me.position] {
+	case '&':
+		me.position++
+		encoded, err = me.parseFilterList(filterTagAnd)
+	case '|':
+		me.position++
+		encoded, err = me.parseFilterList(filterTagOr)
+	case '!':
+		me.position++
+		var inner []byte
+		inner, err = me.parseFilter()
+		encoded = encode(filterTagNot, inner)
+	default:
+		end := strings.IndexByte(me.filter[me.position:], ')')
+		if end == -1 {
+			return nil, fmt.Errorf("expected `)` after position %d", me.position)
+		}
+		encoded, err = parseFilterItem(me.filter[me.position : me.position+end])
+		me.position += end
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if me.position >= len(me.filter) || me.filter[me.position] != ')' {
+		return nil, fmt.Errorf("expected `)` at position %d", me.position)
+	}
+	me.position++
+
+	return encoded, nil
+}
+
+func (me *filterParser) parseFilterList(tag byte) ([]byte, error) {
+	var filters [][]byte
+	for me.position < len(me.filter) && me.filter[me.position] == '(' {
+		filter, err := me.parseFilter()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("expected at least one filter at position %d", me.position)
+	}
+	return encode(tag, filters...), nil
+}
+
+// parseFilterItem encodes a (non-composite) filter item, like `uid=john`, `uid=*`, `cn=Jo*n` or `memberOf:1.2.840.113556.1.4.1941:=cn=staff,dc=example,dc=com`
+func parseFilterItem(item string) ([]byte, error) {
+	idx := strings.IndexByte(item, '=')
+	if idx < 1 {
+		return nil, fmt.Errorf("invalid item `%s`", item)
+	}
+
+	attribute, rawValue := item[:idx], item[idx+1:]
+
+	switch attribute[len(attribute)-1] {
+	case '~':
+		return encodeAttributeValueAssertion(filterTagApproxMatch, attribute[:len(attribute)-1], rawValue)
+	case '>':
+		return encodeAttributeValueAssertion(filterTagGreaterOrEqual, attribute[:len(attribute)-1], rawValue)
+	case '<':
+		return encodeAttributeValueAssertion(filterTagLessOrEqual, attribute[:len(attribute)-1], rawValue)
+	case ':':
+		return encodeExtensibleMatch(attribute[:len(attribute)-1], rawValue)
+	}
+
+	if rawValue == "*" {
+		return encodeString(filterTagPresent, attribute), nil
+	}
+
+	if strings.Contains(rawValue, "*") {
+		return encodeSubstrings(attribute, rawValue)
+	}
+
+	return encodeAttributeValueAssertion(filterTagEqualityMatch, attribute, rawValue)
+}
+
+func encodeAttributeValueAssertion(tag byte, attribute string, rawValue string) ([]byte, error) {
+	if attribute == "" {
+		return nil, fmt.Errorf("missing attribute")
+	}
+
+	value, err := unescapeFilterValue(rawValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return encode(tag, encodeString(tagOctetString, attribute), encodeString(tagOctetString, value)), nil
+}
+
+func encodeSubstrings(attribute string, rawValue string) ([]byte, error) {
+	rawParts := strings.Split(rawValue, "*")
+
+	var substrings [][]byte
+	for idx, rawPart := range rawParts {
+		if rawPart == "" {
+			continue
+		}
+
+		part, err := unescapeFilterValue(rawPart)
+		if err != nil {
+			return nil, err
+		}
+
+		// initial [0], any [1] or final [2]
+		var tag byte = classContext | 1
+		if idx == 0 {
+			tag = classContext | 0
+		} else if idx == len(rawParts)-1 {
+			tag = classContext | 2
+		}
+		substrings = append(substrings, encodeString(tag, part))
+	}
+
+	return encode(
+		filterTagSubstrings,
+		encodeString(tagOctetString, attribute),
+		encode(tagSequence, substrings...),
+	), nil
+}
+
+// encodeExtensibleMatch encodes an extensible match item, whose left-hand side (`attr[:dn][:matchingRule]`) is given without the trailing `:`
+func encodeExtensibleMatch(leftHandSide string, rawValue string) ([]byte, error) {
+	segments := strings.Split(leftHandSide, ":")
+
+	attribute := segments[0]
+	matchingRule := ""
+	dnAttributes := false
+	for _, segment := range segments[1:] {
+		if strings.EqualFold(segment, "dn") {
+			dnAttributes = true
+			continue
+		}
+		if segment == "" || matchingRule != "" {
+			return nil, fmt.Errorf("invalid extensible match `%s:=`", leftHandSide)
+		}
+		matchingRule = segment
+	}
+
+	if attribute == "" && matchingRule == "" {
+		return nil, fmt.Errorf("extensible match `%s:=` needs an attribute or a matching rule", leftHandSide)
+	}
+
+	value, err := unescapeFilterValue(rawValue)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts [][]byte
+	if matchingRule != "" {
+		parts = append(parts, encodeString(classContext|1, matchingRule))
+	}
+	if attribute != "" {
+		parts = append(parts, encodeString(classContext|2, attribute))
+	}
+	parts = append(parts, encodeString(classContext|3, value))
+	if dnAttributes {
+		parts = append(parts, encodeBoolean(classContext|4, true))
+	}
+
+	return encode(filterTagExtensibleMatch, parts...), nil
+}
+
+// unescapeFilterValue turns `\XX` escape sequences (see EscapeFilterValue) back into the characters they stand for
+func unescapeFilterValue(rawValue string) (string, error) {
+	if !strings.Contains(rawValue, `\`) {
+		return rawValue, nil
+	}
+
+	var result []byte
+	for idx := 0; idx < len(rawValue); idx++ {
+		if rawValue[idx] != '\\' {
+			result = append(result, rawValue[idx])
+			continue
+		}
+
+		if idx+3 > len(rawValue) {
+			return "", fmt.Errorf("truncated escape sequence in `%s`", rawValue)
+		}
+
+		decoded, err := hex.DecodeString(rawValue[idx+1 : idx+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in `%s`", rawValue)
+		}
+		result = append(result, decoded[0])
+		idx += 2
+	}
+	return string(result), nil
+}
@@ -0,0 +1,168 @@
+package ldap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompileFilter(t *testing.T) {
+	type testData struct {
+		filter   string
+		expected []byte
+	}
+
+	attributeValueAssertion := func(tag byte, attribute string, value string) []byte {
+		return encode(tag, encodeString(tagOctetString, attribute), encodeString(tagOctetString, value))
+	}
+
+	tests := []testData{
+		{
+			"(uid=john)",
+			attributeValueAssertion(filterTagEqualityMatch, "uid", "john"),
+		},
+		{
+			"(uid=*)",
+			encodeString(filterTagPresent, "uid"),
+		},
+		{
+			"(uidNumber>=1000)",
+			attributeValueAssertion(filterTagGreaterOrEqual, "uidNumber", "1000"),
+		},
+		{
+			"(uidNumber<=1000)",
+			attributeValueAssertion(filterTagLessOrEqual, "uidNumber", "1000"),
+		},
+		{
+			"(cn~=john)",
+			attributeValueAssertion(filterTagApproxMatch, "cn", "john"),
+		},
+		{
+			"(cn=Jo*h*n)",
+			encode(
+				filterTagSubstrings,
+				encodeString(tagOctetString, "cn"),
+				encode(tagSequence, encodeString(classContext|0, "Jo"), encodeString(classContext|1, "h"), encodeString(classContext|2, "n")),
+			),
+		},
+		{
+			"(cn=*oh*)",
+			encode(
+				filterTagSubstrings,
+				encodeString(tagOctetString, "cn"),
+				encode(tagSequence, encodeString(classContext|1, "oh")),
+			),
+		},
+		{
+			`(cn=a\2ab\29)`,
+			attributeValueAssertion(filterTagEqualityMatch, "cn", "a*b)"),
+		},
+		{
+			"(&(objectClass=person)(uid=john))",
+			encode(
+				filterTagAnd,
+				attributeValueAssertion(filterTagEqualityMatch, "objectClass", "person"),
+				attributeValueAssertion(filterTagEqualityMatch, "uid", "john"),
+			),
+		},
+		{
+			"(|(uid=john)(!(mail=*)))",
+			encode(
+				filterTagOr,
+				attributeValueAssertion(filterTagEqualityMatch, "uid", "john"),
+				encode(filterTagNot, encodeString(filterTagPresent, "mail")),
+			),
+		},
+		{
+			"(memberOf:1.2.840.113556.1.4.1941:=cn=staff,dc=example,dc=com)",
+			encode(
+				filterTagExtensibleMatch,
+				encodeString(classContext|1, "1.2.840.113556.1.4.1941"),
+				encodeString(classContext|2, "memberOf"),
+				encodeString(classContext|3, "cn=staff,dc=example,dc=com"),
+			),
+		},
+		{
+			"(ou:dn:=people)",
+			encode(
+				filterTagExtensibleMatch,
+				encodeString(classContext|2, "ou"),
+				encodeString(classContext|3, "people"),
+				encodeBoolean(classContext|4, true),
+			),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			compiled, err := compileFilter(test.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(compiled, test.expected) {
+				t.Errorf("expected %x, got %x", test.expected, compiled)
+			}
+		})
+	}
+}
+
+func TestCompileFilterRejectsInvalidFilters(t *testing.T) {
+	filters := []string{
+		"",
+		"uid=john",
+		"(uid=john",
+		"(uid=john))",
+		"(=john)",
+		"(uid)",
+		"(&)",
+		"(&(uid=john)",
+		"(!uid=john)",
+		`(uid=jo\2)`,
+		`(uid=jo\zzhn)`,
+		"(:=john)",
+		"(uid:rule1:rule2:=john)",
+	}
+
+	for _, filter := range filters {
+		_, err := compileFilter(filter)
+		if err == nil {
+			t.Errorf("`%s`: expected an error", filter)
+		}
+	}
+}
+
+func TestEscapeFilterValue(t *testing.T) {
+	type testData struct {
+		value    string
+		expected string
+	}
+
+	tests := []testData{
+		{"john", "john"},
+		{"*", `\2a`},
+		{"(", `\28`},
+		{")", `\29`},
+		{`\`, `\5c`},
+		{"\x00", `\00`},
+		{"*)(uid=*", `\2a\29\28uid=\2a`},
+		{`a\2ab`, `a\5c2ab`},
+	}
+
+	for _, test := range tests {
+		escaped := EscapeFilterValue(test.value)
+		if escaped != test.expected {
+			t.Errorf("%q: expected `%s`, got `%s`", test.value, test.expected, escaped)
+			continue
+		}
+
+		// Escaped values make it into filters as-is, getting matched literally
+		compiled, err := compileFilter("(uid=" + escaped + ")")
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.value, err)
+			continue
+		}
+		expected := encode(filterTagEqualityMatch, encodeString(tagOctetString, "uid"), encodeString(tagOctetString, test.value))
+		if !bytes.Equal(compiled, expected) {
+			t.Errorf("%q: compiled to %x instead of an equality match", test.value, compiled)
+		}
+	}
+}
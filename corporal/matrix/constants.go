@@ -24,6 +24,10 @@ const (
 	LoginTypePassword = "m.login.password"
 	LoginTypeToken    = "m.login.token"
 
+	// LoginTypeApplicationService is for logging in (and registering) as users in an application service's namespace.
+	// See https://spec.matrix.org/v1.1/application-service-api/#server-admin-style-permissions
+	LoginTypeApplicationService = "m.login.application_service"
+
 	// See https://spec.matrix.org/v1.1/client-server-api/#identifier-types
 	LoginIdentifierTypeUser       = "m.id.user"
 	LoginIdentifierTypeThirdParty = "m.id.thirdparty"
@@ -31,3 +35,11 @@ const (
 
 	RegistrationTypeSharedSecret = "org.matrix.login.shared_secret"
 )
+
+const (
+	// See: https://element-hq.github.io/synapse/latest/admin_api/rooms.html#status-of-deleting-rooms
+	RoomDeletionStatusScheduled = "scheduled"
+	RoomDeletionStatusActive    = "active"
+	RoomDeletionStatusComplete  = "complete"
+	RoomDeletionStatusFailed    = "failed"
+)
@@ -17,6 +17,36 @@ type ApiLoginRequestPayload struct {
 	InitialDeviceDisplayName string `json:"initial_device_display_name,omitempty"`
 
 	Identifier ApiLoginRequestIdentifier `json:"identifier"`
+
+	// Auth completes a second-factor stage that matrix-corporal has asked for (see ApiUserInteractiveAuthResponse).
+	// It's a matrix-corporal extension, which homeservers don't know about.
+	Auth *ApiLoginRequestAuth `json:"auth,omitempty"`
+}
+
+// ApiLoginRequestAuth is the `auth` object of login requests, which complete a second-factor stage
+type ApiLoginRequestAuth struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+
+	// Code is the TOTP code or backup code
+	Code string `json:"code"`
+}
+
+// ApiUserInteractiveAuthResponse is a User-Interactive Authentication response (sent with a 401 status code), telling clients which stages remain.
+// See https://spec.matrix.org/v1.1/client-server-api/#user-interactive-authentication-api
+type ApiUserInteractiveAuthResponse struct {
+	Flows     []ApiUserInteractiveAuthFlow      `json:"flows"`
+	Completed []string                          `json:"completed"`
+	Params    map[string]map[string]interface{} `json:"params"`
+	Session   string                            `json:"session"`
+
+	// ErrorCode and ErrorMessage describe why the previous attempt at completing a stage failed (if it did)
+	ErrorCode    string `json:"errcode,omitempty"`
+	ErrorMessage string `json:"error,omitempty"`
+}
+
+type ApiUserInteractiveAuthFlow struct {
+	Stages []string `json:"stages"`
 }
 
 type ApiLoginRequestIdentifier struct {
@@ -26,6 +56,10 @@ type ApiLoginRequestIdentifier struct {
 
 	// User contains the username of the user logging in, when Type = matrix.LoginIdentifierTypeUser.
 	User string `json:"user"`
+
+	// Medium (e.g. `email`) and Address contain the third-party identifier of the user logging in, when Type = matrix.LoginIdentifierTypeThirdParty.
+	Medium  string `json:"medium,omitempty"`
+	Address string `json:"address,omitempty"`
 }
 
 // ApiAdminResponseUserLogin represents a login response payload
@@ -34,10 +68,238 @@ type ApiAdminResponseUserLogin struct {
 	AccessToken string `json:"access_token"`
 }
 
-// ApiAdminEntityUser represents a user entity that is part of the list response
+// ApiLoginTokenResponse represents a login token response payload
+// at: POST /_matrix/client/v1/login/get_token
+type ApiLoginTokenResponse struct {
+	LoginToken  string `json:"login_token"`
+	ExpiresInMs int64  `json:"expires_in_ms"`
+}
+
+// ApiAdminResponseUser represents a user entity response payload
+// at: GET /_synapse/admin/v2/users/<user_id>
+type ApiAdminResponseUser struct {
+	ThreePids []ApiThreePid `json:"threepids"`
+
+	// AppServiceId is the id of the application service which registered the user (if any)
+	AppServiceId *string `json:"appservice_id"`
+}
+
+// ApiAdminRequestUserType represents a request payload for changing a user's type (nil meaning a regular user)
+// at: PUT /_synapse/admin/v2/users/<user_id>
+type ApiAdminRequestUserType struct {
+	UserType *string `json:"user_type"`
+}
+
+// ApiAdminRequestUserThreePids represents a request payload for replacing a user's 3pids
+// at: PUT /_synapse/admin/v2/users/<user_id>
+type ApiAdminRequestUserThreePids struct {
+	ThreePids []ApiThreePid `json:"threepids"`
+}
+
+// ApiAccountThreePidsResponse represents a response payload
+// at: GET /_matrix/client/{apiVersion:(r0|v3)}/account/3pid
+type ApiAccountThreePidsResponse struct {
+	ThreePids []ApiThreePid `json:"threepids"`
+}
+
+// ApiAccountThreePidDeleteRequest represents a request payload
+// at: POST /_matrix/client/{apiVersion:(r0|v3)}/account/3pid/delete
+type ApiAccountThreePidDeleteRequest struct {
+	Medium  string `json:"medium"`
+	Address string `json:"address"`
+}
+
+// ApiThreePid represents a third-party identifier associated with a user account
+type ApiThreePid struct {
+	Medium  string `json:"medium"`
+	Address string `json:"address"`
+}
+
+// ApiPushRulesResponse represents a response payload
+// at: GET /_matrix/client/{apiVersion:(r0|v3)}/pushrules/
+type ApiPushRulesResponse struct {
+	// Global maps push rule kinds (`override`, `content`, etc.) to the push rules of that kind
+	Global map[string][]ApiPushRule `json:"global"`
+}
+
+// ApiPushRule represents a push rule, as found in ApiPushRulesResponse
+type ApiPushRule struct {
+	RuleId     string                   `json:"rule_id"`
+	Default    bool                     `json:"default"`
+	Enabled    bool                     `json:"enabled"`
+	Actions    []interface{}            `json:"actions"`
+	Conditions []map[string]interface{} `json:"conditions,omitempty"`
+	Pattern    string                   `json:"pattern,omitempty"`
+}
+
+// ApiPushRuleRequest represents a request payload
+// at: PUT /_matrix/client/{apiVersion:(r0|v3)}/pushrules/global/{kind}/{ruleId}
+type ApiPushRuleRequest struct {
+	Actions    []interface{}            `json:"actions"`
+	Conditions []map[string]interface{} `json:"conditions,omitempty"`
+	Pattern    string                   `json:"pattern,omitempty"`
+}
+
+// ApiAdminRequestSendServerNotice represents a request payload
+// at: PUT /_synapse/admin/v1/send_server_notice/{txnId}
+type ApiAdminRequestSendServerNotice struct {
+	UserId  string                      `json:"user_id"`
+	Content ApiAdminServerNoticeContent `json:"content"`
+}
+
+// ApiAdminServerNoticeContent represents the content of a server notice message
+type ApiAdminServerNoticeContent struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+}
+
+// ApiAdminRequestUserAdmin represents a request payload
+// at: PUT /_synapse/admin/v1/users/{userId}/admin
+type ApiAdminRequestUserAdmin struct {
+	Admin bool `json:"admin"`
+}
+
+// ApiAdminRequestDeactivateUser represents a request payload
+// at: POST /_synapse/admin/v1/deactivate/{userId}
+type ApiAdminRequestDeactivateUser struct {
+	Erase bool `json:"erase"`
+}
+
+// ApiAdminRequestJoinRoom represents a request payload
+// at: POST /_synapse/admin/v1/join/{roomIdOrAlias}
+type ApiAdminRequestJoinRoom struct {
+	UserId string `json:"user_id"`
+}
+
+// ApiAdminResponseQuarantineMedia represents a response payload
+// at: POST /_synapse/admin/v1/room/{roomId}/media/quarantine and POST /_synapse/admin/v1/user/{userId}/media/quarantine
+type ApiAdminResponseQuarantineMedia struct {
+	NumQuarantined int `json:"num_quarantined"`
+}
+
+// ApiAdminResponseUserJoinedRooms represents a response payload
+// at: GET /_synapse/admin/v1/users/{userId}/joined_rooms
+type ApiAdminResponseUserJoinedRooms struct {
+	JoinedRooms []string `json:"joined_rooms"`
+	Total       int      `json:"total"`
+}
+
+// ApiAdminResponseUserAccountData represents a response payload
+// at: GET /_synapse/admin/v1/users/{userId}/accountdata
+type ApiAdminResponseUserAccountData struct {
+	AccountData struct {
+		Global map[string]map[string]interface{}            `json:"global"`
+		Rooms  map[string]map[string]map[string]interface{} `json:"rooms"`
+	} `json:"account_data"`
+}
+
+// ApiAdminResponseDeleteUserMedia represents a response payload
+// at: DELETE /_synapse/admin/v1/users/{userId}/media
+type ApiAdminResponseDeleteUserMedia struct {
+	DeletedMedia []string `json:"deleted_media"`
+	Total        int      `json:"total"`
+}
+
+// ApiDevicesResponse is a response as found at: GET /_matrix/client/{apiVersion:(r0|v3)}/devices
+// and at: GET /_synapse/admin/v2/users/{userId}/devices
+type ApiDevicesResponse struct {
+	Devices []ApiDevice `json:"devices"`
+}
+
+// ApiDevice represents a device that is part of ApiDevicesResponse.
+// LastSeenTs is nil for devices which have not been seen yet.
+type ApiDevice struct {
+	DeviceId    string `json:"device_id"`
+	DisplayName string `json:"display_name"`
+	LastSeenTs  *int64 `json:"last_seen_ts"`
+}
+
+// ApiAdminRequestDeleteDevices represents a request payload
+// at: POST /_synapse/admin/v2/users/{userId}/delete_devices
+type ApiAdminRequestDeleteDevices struct {
+	Devices []string `json:"devices"`
+}
+
+// ApiAdminRequestDeleteRoom is a request payload for: DELETE /_synapse/admin/v2/rooms/{roomId}
+type ApiAdminRequestDeleteRoom struct {
+	// Purge makes the room's history get removed from the database
+	Purge bool `json:"purge"`
+}
+
+// ApiAdminResponseDeleteRoom is a response as found at: DELETE /_synapse/admin/v2/rooms/{roomId}
+// Deletion happens in the background, with its status being available via the returned id.
+type ApiAdminResponseDeleteRoom struct {
+	DeleteId string `json:"delete_id"`
+}
+
+// ApiAdminResponseRoomDeletionStatuses is a response as found at: GET /_synapse/admin/v2/rooms/{roomId}/delete_status
+type ApiAdminResponseRoomDeletionStatuses struct {
+	Results []ApiAdminRoomDeletionStatus `json:"results"`
+}
+
+// ApiAdminRoomDeletionStatus is a response as found at: GET /_synapse/admin/v2/rooms/delete_status/{deleteId}
+// (and part of the list at: GET /_synapse/admin/v2/rooms/{roomId}/delete_status)
+type ApiAdminRoomDeletionStatus struct {
+	// DeleteId is only part of list responses
+	DeleteId string `json:"delete_id"`
+
+	// Status is one of the matrix.RoomDeletionStatus* constants
+	Status string `json:"status"`
+
+	// Error describes why deletion failed (for matrix.RoomDeletionStatusFailed)
+	Error string `json:"error"`
+}
+
+// ApiApplicationServiceRegisterRequestPayload is a request payload for: POST /_matrix/client/{apiVersion:(r0|v3)}/register
+// which is made by an application service (authenticated with its `as_token`), for a user in its namespace.
+type ApiApplicationServiceRegisterRequestPayload struct {
+	// Type is matrix.LoginTypeApplicationService
+	Type         string `json:"type"`
+	Username     string `json:"username"`
+	InhibitLogin bool   `json:"inhibit_login"`
+}
+
+// ApiDendriteAdminRequestResetPassword represents a request payload
+// at: POST /_dendrite/admin/resetPassword/{userId}
+type ApiDendriteAdminRequestResetPassword struct {
+	Password      string `json:"password"`
+	LogoutDevices bool   `json:"logout_devices"`
+}
+
+// ApiAdminWhoisResponse is a response as found at: GET /_matrix/client/{apiVersion:(r0|v3)}/admin/whois/{userId}
+type ApiAdminWhoisResponse struct {
+	UserId  string                         `json:"user_id"`
+	Devices map[string]ApiAdminWhoisDevice `json:"devices"`
+}
+
+// ApiAdminWhoisDevice represents a device that is part of ApiAdminWhoisResponse
+type ApiAdminWhoisDevice struct {
+	Sessions []ApiAdminWhoisSession `json:"sessions"`
+}
+
+// ApiAdminWhoisSession represents a session that is part of ApiAdminWhoisDevice
+type ApiAdminWhoisSession struct {
+	Connections []ApiAdminWhoisConnection `json:"connections"`
+}
+
+// ApiAdminWhoisConnection represents a connection that is part of ApiAdminWhoisSession.
+// LastSeen is in milliseconds since the epoch.
+type ApiAdminWhoisConnection struct {
+	Ip        string `json:"ip"`
+	LastSeen  int64  `json:"last_seen"`
+	UserAgent string `json:"user_agent"`
+}
+
+// ApiAdminResponseUsers represents a (single page of the) list response
 // at: GET /_synapse/admin/v2/users
 type ApiAdminResponseUsers struct {
 	Users []ApiAdminEntityUser `json:"users"`
+
+	// NextToken is the `from` value to use for fetching the next page. It's empty when there are no more pages.
+	NextToken string `json:"next_token"`
+
+	// Total is how many users match the filters (across all pages)
+	Total int `json:"total"`
 }
 
 // ApiAdminEntityUser represents a user entity that is part of the list response
@@ -49,6 +311,15 @@ type ApiAdminEntityUser struct {
 	PasswordHash string `json:"password_hash"`
 	DisplayName  string `json:"displayname"`
 	AvatarURL    string `json:"avatar_url"`
+	Deactivated  bool   `json:"deactivated"`
+
+	// UserType is the user's type (e.g. `bot`). It's nil for regular users.
+	UserType *string `json:"user_type"`
+
+	ShadowBanned bool `json:"shadow_banned"`
+
+	// CreationTs is when the account got created (in milliseconds since the epoch)
+	CreationTs int64 `json:"creation_ts"`
 }
 
 // ApiWhoAmIResponse is a response as found at: GET /_matrix/client/{apiVersion:(r0|v3)}/account/whoami
@@ -80,6 +351,9 @@ type ApiUserAccountRegisterRequestPayload struct {
 	Mac      string `json:"mac"`
 	Type     string `json:"type"`
 	Admin    bool   `json:"admin"`
+
+	// UserType is the type (e.g. `bot`) to create the user with. It's omitted for regular users.
+	UserType string `json:"user_type,omitempty"`
 }
 
 // ApiUserAccountRegisterResponse is a response as found at: POST /_matrix/client/{apiVersion:(r0|v3)}/admin/register
@@ -88,3 +362,64 @@ type ApiUserAccountRegisterResponse struct {
 	HomeServer  string `json:"home_server"`
 	UserId      string `json:"user_id"`
 }
+
+// ApiRoomDirectoryVisibility is a request payload (and response) for: PUT (and GET) /_matrix/client/{apiVersion:(r0|v3)}/directory/list/room/{roomId}
+type ApiRoomDirectoryVisibility struct {
+	Visibility string `json:"visibility"`
+}
+
+// ApiRoomAliases is a response for: GET /_matrix/client/{apiVersion:(r0|v3)}/rooms/{roomId}/aliases
+type ApiRoomAliases struct {
+	Aliases []string `json:"aliases"`
+}
+
+// ApiRoomAliasCreateRequest is a request payload for: PUT /_matrix/client/{apiVersion:(r0|v3)}/directory/room/{roomAlias}
+type ApiRoomAliasCreateRequest struct {
+	RoomId string `json:"room_id"`
+}
+
+// ApiRoomAliasResolveResponse is a response for: GET /_matrix/client/{apiVersion:(r0|v3)}/directory/room/{roomAlias}
+type ApiRoomAliasResolveResponse struct {
+	RoomId string `json:"room_id"`
+}
+
+// ApiOAuthTokenResponse is a response as found at an OAuth 2.0 token endpoint (e.g. POST {masEndpoint}/oauth2/token),
+// for the `client_credentials` grant (see connector.ClientCredentialsTokenSource).
+type ApiOAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// ApiMasAdminRequestAddUser represents a request payload
+// at: POST {masEndpoint}/api/admin/v1/users
+type ApiMasAdminRequestAddUser struct {
+	Username string `json:"username"`
+}
+
+// ApiMasAdminResponseUser is a response as found at: GET {masEndpoint}/api/admin/v1/users/by-username/{username}
+type ApiMasAdminResponseUser struct {
+	Data ApiMasAdminResource `json:"data"`
+}
+
+// ApiMasAdminResponseResources is a (paginated) response as found at: GET {masEndpoint}/api/admin/v1/compat-sessions (and others)
+type ApiMasAdminResponseResources struct {
+	Data []ApiMasAdminResource `json:"data"`
+}
+
+type ApiMasAdminResource struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+// ApiMasAdminRequestSetPassword represents a request payload
+// at: POST {masEndpoint}/api/admin/v1/users/{id}/set-password
+type ApiMasAdminRequestSetPassword struct {
+	Password          string `json:"password"`
+	SkipPasswordCheck bool   `json:"skip_password_check"`
+}
+
+// ApiMasAdminRequestDeactivateUser represents a request payload
+// at: POST {masEndpoint}/api/admin/v1/users/{id}/deactivate
+type ApiMasAdminRequestDeactivateUser struct {
+	SkipErase bool `json:"skip_erase"`
+}
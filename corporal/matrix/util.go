@@ -1,12 +1,12 @@
 package matrix
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/matrix-org/gomatrix"
-	"github.com/sirupsen/logrus"
 )
 
 func IsErrorWithCode(err error, errorCode string) bool {
@@ -18,47 +18,16 @@ func IsErrorWithCode(err error, errorCode string) bool {
 	return false
 }
 
-// ExecuteWithRateLimitRetries executes callback and retries it after some backoff (if it hits a Matrix rate-limit).
-//
-// If the callback returns an `M_LIMIT_EXCEEDED` error, a few retries (with expontential backoff) are attempted.
-// If the callback returns no error or returns another type of error, no retries are attempted.
-//
-// It seems like Matrix Synapse only rate-limits certain PUT/POST requests (and not GET),
-// so those are the ones that would benefit by being wrapped in this.
-func ExecuteWithRateLimitRetries(logger *logrus.Logger, requestName string, callback func() error) error {
-	var lastCallbackErr error
-	maxRetries := 5
-
-	for retry := 0; retry < maxRetries; retry++ {
-		lastCallbackErr = callback()
-		if lastCallbackErr == nil {
-			return nil
-		}
-
-		if !IsErrorWithCode(lastCallbackErr, ErrorLimitExceeded) {
-			return lastCallbackErr
-		}
-
-		retryAfterSeconds := (retry + 1) * 5
-
-		logger.Infof(
-			"Request %s hit a rate limit, will retry in %d seconds",
-			requestName,
-			retryAfterSeconds,
-		)
-
-		time.Sleep(time.Duration(retryAfterSeconds) * time.Second)
+// GetRetryAfterFromResponseBody returns the `retry_after_ms` duration that rate-limited (`M_LIMIT_EXCEEDED`) responses may contain.
+// A zero duration is returned when there's no such duration in the response body.
+func GetRetryAfterFromResponseBody(body []byte) time.Duration {
+	var payload struct {
+		RetryAfterMs int64 `json:"retry_after_ms"`
 	}
-
-	logger.Errorf("Request %s failed after %d retries: %s", requestName, maxRetries, lastCallbackErr)
-
-	// Let's preserve the original error instead of wrapping it.
-	// Certain callers might want to inspect it.
-	//
-	// It's not like there's something interesting they would find there though,
-	// since this is obviously a rate-limit error and none of our callers handle such errors
-	// by themselves (hence them calling us).
-	return lastCallbackErr
+	if err := json.Unmarshal(body, &payload); err != nil || payload.RetryAfterMs <= 0 {
+		return 0
+	}
+	return time.Duration(payload.RetryAfterMs) * time.Millisecond
 }
 
 // IsUserDeactivatedAccordingToDisplayName tells if the user account appears to be disabled, judging by the display name.
@@ -91,3 +60,31 @@ func DetermineFullUserId(userIdLocalOrFull, homeserverDomainName string) (string
 func IsFullUserIdOfDomain(userIdFull string, homeserverDomainName string) bool {
 	return strings.HasSuffix(userIdFull, fmt.Sprintf(":%s", homeserverDomainName))
 }
+
+// IsFullRoomAliasOfDomain tells if the given full room alias (e.g. `#room:example.com`) is hosted on the given domain
+func IsFullRoomAliasOfDomain(alias string, homeserverDomainName string) bool {
+	return strings.HasPrefix(alias, "#") && strings.HasSuffix(alias, fmt.Sprintf(":%s", homeserverDomainName))
+}
+
+// DetermineServerNameFromId returns the server name part of a user id, room id, etc. (e.g. `example.com` for `@john:example.com`)
+func DetermineServerNameFromId(id string) string {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// ParseMxcUri splits a content repository URI (e.g. `mxc://example.com/abcdef`) into its server name and media id parts
+func ParseMxcUri(mxcUri string) (string, string, error) {
+	if !strings.HasPrefix(mxcUri, "mxc://") {
+		return "", "", fmt.Errorf("%s is not an mxc:// URI", mxcUri)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(mxcUri, "mxc://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return "", "", fmt.Errorf("%s is not a valid mxc:// URI", mxcUri)
+	}
+
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,277 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of what Registry.Render produces (the Prometheus text exposition format)
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultDurationBuckets are histogram buckets (upper bounds, in seconds) suitable for the duration of HTTP requests
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// labelValueEscaper escapes label values, as required by the text exposition format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metric interface {
+	render(w io.Writer) error
+}
+
+// Registry holds metrics, so that all of them can be rendered (in the Prometheus text exposition format) at once (see Render).
+// Metrics are safe to use from multiple goroutines.
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounter creates a counter (keeping one value per combination of label values) and registers it
+func (me *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{
+		metricFamily: newMetricFamily(name, help, labelNames),
+		values:       map[string]float64{},
+	}
+	me.register(counter)
+	return counter
+}
+
+// NewHistogram creates a histogram (keeping one distribution per combination of label values) with the given bucket upper bounds and registers it
+func (me *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	sortedBuckets := append([]float64{}, buckets...)
+	sort.Float64s(sortedBuckets)
+
+	histogram := &Histogram{
+		metricFamily:  newMetricFamily(name, help, labelNames),
+		buckets:       sortedBuckets,
+		distributions: map[string]*distribution{},
+	}
+	me.register(histogram)
+	return histogram
+}
+
+func (me *Registry) register(metric metric) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.metrics = append(me.metrics, metric)
+}
+
+// Render writes out all metrics, in the Prometheus text exposition format
+func (me *Registry) Render(w io.Writer) error {
+	me.lock.Lock()
+	metrics := append([]metric{}, me.metrics...)
+	me.lock.Unlock()
+
+	for _, metric := range metrics {
+		err := metric.render(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricFamily contains what all kinds of metrics have in common.
+// Values are kept by key (see key), which is made of the label values.
+type metricFamily struct {
+	name       string
+	help       string
+	labelNames []string
+
+	lock sync.Mutex
+}
+
+func newMetricFamily(name string, help string, labelNames []string) metricFamily {
+	return metricFamily{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+	}
+}
+
+func (me *metricFamily) key(labelValues []string) string {
+	if len(labelValues) != len(me.labelNames) {
+		panic(fmt.Errorf("metric %s expects %d label values, got %d", me.name, len(me.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\x00")
+}
+
+// renderLabels renders the labels corresponding to the given key (see key), along with the extra ones (if any)
+func (me *metricFamily) renderLabels(key string, extraLabels ...string) string {
+	var pairs []string
+	if len(me.labelNames) != 0 {
+		for idx, labelValue := range strings.Split(key, "\x00") {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", me.labelNames[idx], labelValueEscaper.Replace(labelValue)))
+		}
+	}
+	for idx := 0; idx+1 < len(extraLabels); idx += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraLabels[idx], labelValueEscaper.Replace(extraLabels[idx+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+func (me *metricFamily) renderHeader(w io.Writer, metricType string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", me.name, me.help, me.name, metricType)
+	return err
+}
+
+// Counter is a metric whose values only go up (e.g. the number of requests made)
+type Counter struct {
+	metricFamily
+
+	values map[string]float64
+}
+
+// Inc increments the value for the given label values (given in the order of the counter's label names)
+func (me *Counter) Inc(labelValues ...string) {
+	key := me.key(labelValues)
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.values[key]++
+}
+
+// Add increases the value for the given label values (given in the order of the counter's label names) by the given (non-negative) amount
+func (me *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Errorf("counter %s cannot be decreased", me.name))
+	}
+
+	key := me.key(labelValues)
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.values[key] += value
+}
+
+func (me *Counter) render(w io.Writer) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	err := me.renderHeader(w, "counter")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range sortedKeys(me.values) {
+		_, err = fmt.Fprintf(w, "%s%s %s\n", me.name, me.renderLabels(key), formatFloat(me.values[key]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram is a metric which tracks the distribution of observed values (e.g. request durations) across buckets
+type Histogram struct {
+	metricFamily
+
+	buckets []float64
+
+	distributions map[string]*distribution
+}
+
+type distribution struct {
+	// bucketCounts contains how many observed values were no larger than the bucket's upper bound (non-cumulatively)
+	bucketCounts []uint64
+
+	count uint64
+	sum   float64
+}
+
+// Observe records the given value for the given label values (given in the order of the histogram's label names)
+func (me *Histogram) Observe(value float64, labelValues ...string) {
+	key := me.key(labelValues)
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	dist, exists := me.distributions[key]
+	if !exists {
+		dist = &distribution{
+			bucketCounts: make([]uint64, len(me.buckets)),
+		}
+		me.distributions[key] = dist
+	}
+
+	for idx, upperBound := range me.buckets {
+		if value <= upperBound {
+			dist.bucketCounts[idx]++
+			break
+		}
+	}
+	dist.count++
+	dist.sum += value
+}
+
+func (me *Histogram) render(w io.Writer) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	err := me.renderHeader(w, "histogram")
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(me.distributions))
+	for key := range me.distributions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		dist := me.distributions[key]
+
+		var cumulativeCount uint64
+		for idx, upperBound := range me.buckets {
+			cumulativeCount += dist.bucketCounts[idx]
+			_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", me.name, me.renderLabels(key, "le", formatFloat(upperBound)), cumulativeCount)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = fmt.Fprintf(
+			w,
+			"%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			me.name, me.renderLabels(key, "le", "+Inf"), dist.count,
+			me.name, me.renderLabels(key), formatFloat(dist.sum),
+			me.name, me.renderLabels(key), dist.count,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,81 @@
+package policy
+
+import (
+	"fmt"
+	"time"
+)
+
+// AccountCleanup controls the deactivation of accounts which are not part of the policy,
+// for homeservers which are only supposed to contain provisioned users.
+//
+// The matrix-corporal user, the server notices user (see configuration.Matrix.ServerNoticesUserId), room stewards (see RoomPolicy.StewardUserId)
+// and the old users of user id migrations (see UserIdMigration) are never cleaned up, in addition to the users listed in ExemptUserIds.
+// Server admins, application service users and users having a user type (e.g. bots) are only cleaned up when asked to.
+type AccountCleanup struct {
+	// DeactivateGuests makes guest accounts get deactivated
+	DeactivateGuests bool `json:"deactivateGuests"`
+
+	// DeactivateUnmanagedUsers makes (non-guest) accounts which are not part of the policy get deactivated
+	DeactivateUnmanagedUsers bool `json:"deactivateUnmanagedUsers"`
+
+	// MinAgeSeconds specifies how old (since their creation) accounts need to be, before they get deactivated.
+	// This gives accounts created by other means (e.g. registration) a chance to make it to the policy.
+	MinAgeSeconds int64 `json:"minAgeSeconds"`
+
+	// Erase makes deactivation happen with GDPR erasure (see DeprovisioningModeErase)
+	Erase bool `json:"erase"`
+
+	// ExemptUserIds contains the ids of (unmanaged) users, which are not to be deactivated
+	ExemptUserIds []string `json:"exemptUserIds"`
+
+	// DeactivateServerAdmins makes server admins get deactivated too (if they are otherwise to be).
+	// By default, they are left alone.
+	DeactivateServerAdmins bool `json:"deactivateServerAdmins"`
+
+	// DeactivateAppServiceUsers makes users registered by application services (e.g. bridged users) get deactivated too (if they are otherwise to be).
+	// By default, they are left alone.
+	DeactivateAppServiceUsers bool `json:"deactivateAppServiceUsers"`
+
+	// DeactivateUsersWithType makes users having a user type (e.g. `bot` or `support`) get deactivated too (if they are otherwise to be).
+	// By default, they are left alone.
+	DeactivateUsersWithType bool `json:"deactivateUsersWithType"`
+}
+
+func (me AccountCleanup) Validate() error {
+	if me.MinAgeSeconds < 0 {
+		return fmt.Errorf("`minAgeSeconds` cannot be negative")
+	}
+
+	return nil
+}
+
+func (me AccountCleanup) GetMinAge() time.Duration {
+	return time.Duration(me.MinAgeSeconds) * time.Second
+}
+
+// IsAccountCleanupEnabled tells whether any accounts (guests or unmanaged users) are to be cleaned up (see AccountCleanup)
+func (me *Policy) IsAccountCleanupEnabled() bool {
+	return me.AccountCleanup != nil && (me.AccountCleanup.DeactivateGuests || me.AccountCleanup.DeactivateUnmanagedUsers)
+}
+
+// GetAccountCleanupExemptUserIds returns the ids of the users which are never cleaned up (see AccountCleanup),
+// besides the matrix-corporal user and the users which are part of the policy.
+func (me *Policy) GetAccountCleanupExemptUserIds() []string {
+	var userIds []string
+
+	if me.AccountCleanup != nil {
+		userIds = append(userIds, me.AccountCleanup.ExemptUserIds...)
+	}
+
+	for _, roomPolicy := range me.Rooms {
+		if roomPolicy.StewardUserId != "" {
+			userIds = append(userIds, roomPolicy.StewardUserId)
+		}
+	}
+
+	for _, migration := range me.UserIdMigrations {
+		userIds = append(userIds, migration.OldUserId)
+	}
+
+	return userIds
+}
@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Account data modes control how a UserAccountData entry's content is applied to the user's existing account data
+const (
+	// AccountDataModeMerge sets the keys found in the entry's content, leaving other (top-level) keys in place.
+	// This is what happens when no mode is specified.
+	AccountDataModeMerge = "merge"
+
+	// AccountDataModeOverwrite makes the account data match the entry's content exactly, dropping any other keys.
+	AccountDataModeOverwrite = "overwrite"
+)
+
+// forbiddenAccountDataTypes lists account data types that the Client-Server API doesn't let us set
+var forbiddenAccountDataTypes = []string{"m.fully_read", "m.push_rules"}
+
+// internalAccountDataTypePrefix is what the account data types used by matrix-corporal itself start with
+const internalAccountDataTypePrefix = "com.devture.matrix.corporal."
+
+// UserAccountData is an account data entry (see https://spec.matrix.org/latest/client-server-api/#client-config), which a user is to have.
+// Entries are either global or for a specific room (see RoomId).
+type UserAccountData struct {
+	// Type is the account data type (e.g. `m.direct`, `im.vector.setting.breadcrumbs`)
+	Type string `json:"type"`
+
+	// RoomId is the room that the account data is for. Global account data has no room id.
+	RoomId string `json:"roomId"`
+
+	// Mode is one of the account data modes (see AccountDataModeMerge, etc.)
+	Mode string `json:"mode"`
+
+	// Content is the account data to set
+	Content map[string]interface{} `json:"content"`
+}
+
+func (me UserAccountData) Validate() error {
+	if me.Type == "" {
+		return fmt.Errorf("account data entry has no type")
+	}
+
+	for _, accountDataType := range forbiddenAccountDataTypes {
+		if me.Type == accountDataType {
+			return fmt.Errorf("account data of type `%s` cannot be set", me.Type)
+		}
+	}
+
+	if strings.HasPrefix(me.Type, internalAccountDataTypePrefix) {
+		return fmt.Errorf("account data of type `%s` is reserved for matrix-corporal's own use", me.Type)
+	}
+
+	if me.RoomId != "" && !strings.HasPrefix(me.RoomId, "!") {
+		return fmt.Errorf("account data of type `%s` is for an invalid room id (%s)", me.Type, me.RoomId)
+	}
+
+	if me.Mode != "" && me.Mode != AccountDataModeMerge && me.Mode != AccountDataModeOverwrite {
+		return fmt.Errorf("account data of type `%s` has an invalid mode (%s)", me.Type, me.Mode)
+	}
+
+	if me.Content == nil {
+		return fmt.Errorf("account data of type `%s` has no content", me.Type)
+	}
+
+	return nil
+}
+
+// IsOverwritten tells whether the entry's content replaces the user's existing account data (see AccountDataModeOverwrite)
+func (me UserAccountData) IsOverwritten() bool {
+	return me.Mode == AccountDataModeOverwrite
+}
+
+// Key returns a string uniquely identifying the (type, room) combination of the entry
+func (me UserAccountData) Key() string {
+	return me.RoomId + "/" + me.Type
+}
@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+)
+
+const (
+	// assetFileReferenceKey is the key of objects referencing (text) assets, to be inlined as strings.
+	// Example: `"responsePayload": {"$bundleFile": "templates/maintenance.html"}`
+	assetFileReferenceKey = "$bundleFile"
+
+	// assetDataUriReferenceKey is the key of objects referencing (binary) assets, to be inlined as `data:` URIs.
+	// Example: `"avatarUri": {"$bundleDataUri": "avatars/john.png"}`
+	assetDataUriReferenceKey = "$bundleDataUri"
+)
+
+// AssetReader reads assets (avatar images, HTML templates, etc.) which ship along with a policy document (see resolveAssets)
+type AssetReader interface {
+	// ReadAsset reads the asset at the given (slash-separated, relative) path
+	ReadAsset(path string) ([]byte, error)
+}
+
+// resolveAssets replaces all asset references (`{"$bundleFile": "path"}` and `{"$bundleDataUri": "path"}` objects)
+// in the policy document with the contents of the assets they point to.
+//
+// Inlining assets into the policy means that a policy and the assets it was shipped with always get applied together.
+func resolveAssets(data []byte, assetReader AssetReader) ([]byte, error) {
+	// Most policies don't make use of assets. Let's not pay the cost of decoding and re-encoding those.
+	if !bytes.Contains(data, []byte(`"`+assetFileReferenceKey+`"`)) && !bytes.Contains(data, []byte(`"`+assetDataUriReferenceKey+`"`)) {
+		return data, nil
+	}
+
+	if assetReader == nil {
+		return nil, fmt.Errorf(
+			"policy references bundled assets (`%s` or `%s`), but is not loaded from a bundle",
+			assetFileReferenceKey,
+			assetDataUriReferenceKey,
+		)
+	}
+
+	document, err := decodeDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := resolveAssetsInValue(document, assetReader)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(resolved)
+}
+
+func resolveAssetsInValue(value interface{}, assetReader AssetReader) (interface{}, error) {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		if reference, isReference := typedValue[assetFileReferenceKey]; isReference {
+			return resolveAssetReference(assetFileReferenceKey, reference, len(typedValue), assetReader)
+		}
+		if reference, isReference := typedValue[assetDataUriReferenceKey]; isReference {
+			return resolveAssetReference(assetDataUriReferenceKey, reference, len(typedValue), assetReader)
+		}
+
+		for key, subValue := range typedValue {
+			resolved, err := resolveAssetsInValue(subValue, assetReader)
+			if err != nil {
+				return nil, err
+			}
+			typedValue[key] = resolved
+		}
+	case []interface{}:
+		for idx, subValue := range typedValue {
+			resolved, err := resolveAssetsInValue(subValue, assetReader)
+			if err != nil {
+				return nil, err
+			}
+			typedValue[idx] = resolved
+		}
+	}
+
+	return value, nil
+}
+
+func resolveAssetReference(
+	referenceKey string,
+	reference interface{},
+	referenceObjectKeysCount int,
+	assetReader AssetReader,
+) (string, error) {
+	assetPath, ok := reference.(string)
+	if !ok || assetPath == "" || referenceObjectKeysCount != 1 {
+		return "", fmt.Errorf("asset references are expected to look like this: `{\"%s\": \"path/to/asset\"}`", referenceKey)
+	}
+
+	assetBytes, err := assetReader.ReadAsset(assetPath)
+	if err != nil {
+		return "", fmt.Errorf("failed resolving asset reference `%s`: %s", assetPath, err)
+	}
+
+	if referenceKey == assetFileReferenceKey {
+		return string(assetBytes), nil
+	}
+
+	// We prefer going by the file extension, as content sniffing can't tell apart some common image types (e.g. SVG).
+	contentType := mime.TypeByExtension(path.Ext(assetPath))
+	if contentType == "" {
+		contentType = http.DetectContentType(assetBytes)
+	}
+	// Parameters (e.g. `; charset=utf-8`) would get in the way of parsing the data URI later on (see avatar.AvatarReader).
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+
+	return fmt.Sprintf("data:%s;base64,%s", contentType, base64.StdEncoding.EncodeToString(assetBytes)), nil
+}
@@ -17,6 +17,10 @@ func (me *Checker) CanUserCreateRoom(policy Policy, userId string) bool {
 		if userPolicy.ForbidRoomCreation != nil {
 			return !*userPolicy.ForbidRoomCreation
 		}
+	} else if policy.UnmanagedUserDefaults != nil {
+		if policy.UnmanagedUserDefaults.ForbidRoomCreation != nil {
+			return !*policy.UnmanagedUserDefaults.ForbidRoomCreation
+		}
 	}
 
 	// No dedicated policy for this user (likely an unmanaged user) or undefined ForbidRoomCreation policy field.
@@ -30,6 +34,10 @@ func (me *Checker) CanUserCreateEncryptedRoom(policy Policy, userId string) bool
 		if userPolicy.ForbidEncryptedRoomCreation != nil {
 			return !*userPolicy.ForbidEncryptedRoomCreation
 		}
+	} else if policy.UnmanagedUserDefaults != nil {
+		if policy.UnmanagedUserDefaults.ForbidEncryptedRoomCreation != nil {
+			return !*policy.UnmanagedUserDefaults.ForbidEncryptedRoomCreation
+		}
 	}
 
 	// No dedicated policy for this user (likely an unmanaged user) or undefined ForbidEncryptedRoomCreation policy field.
@@ -43,6 +51,10 @@ func (me *Checker) CanUserCreateUnencryptedRoom(policy Policy, userId string) bo
 		if userPolicy.ForbidUnencryptedRoomCreation != nil {
 			return !*userPolicy.ForbidUnencryptedRoomCreation
 		}
+	} else if policy.UnmanagedUserDefaults != nil {
+		if policy.UnmanagedUserDefaults.ForbidUnencryptedRoomCreation != nil {
+			return !*policy.UnmanagedUserDefaults.ForbidUnencryptedRoomCreation
+		}
 	}
 
 	// No dedicated policy for this user (likely an unmanaged user) or undefined ForbidUnencryptedRoomCreation policy field.
@@ -50,12 +62,127 @@ func (me *Checker) CanUserCreateUnencryptedRoom(policy Policy, userId string) bo
 	return !policy.Flags.ForbidUnencryptedRoomCreation
 }
 
+func (me *Checker) CanUserChange3pids(policy Policy, userId string) bool {
+	userPolicy := policy.GetUserPolicyByUserId(userId)
+	if userPolicy == nil {
+		if policy.UnmanagedUserDefaults != nil {
+			if policy.UnmanagedUserDefaults.Forbid3pidChanges != nil {
+				return !*policy.UnmanagedUserDefaults.Forbid3pidChanges
+			}
+		}
+
+		// Not a user we manage. Unless asked otherwise, 3pids are only locked down for managed users.
+		return true
+	}
+
+	if userPolicy.Forbid3pidChanges != nil {
+		return !*userPolicy.Forbid3pidChanges
+	}
+
+	// Undefined Forbid3pidChanges policy field. Stick to the global defaults.
+	return !policy.Flags.Forbid3pidChanges
+}
+
+// CanUserSendEvents tells whether the user can send events (messages, state, redactions, etc.) at all (see ReadOnly).
+func (me *Checker) CanUserSendEvents(policy Policy, userId string) bool {
+	userPolicy := policy.GetUserPolicyByUserId(userId)
+	if userPolicy == nil {
+		if policy.UnmanagedUserDefaults != nil {
+			if policy.UnmanagedUserDefaults.ReadOnly != nil {
+				return !*policy.UnmanagedUserDefaults.ReadOnly
+			}
+		}
+
+		// Not a user we manage. Unless asked otherwise, only managed users can be made read-only.
+		return true
+	}
+
+	if policy.readOnlyEnforced {
+		return false
+	}
+
+	if userPolicy.ReadOnly != nil {
+		return !*userPolicy.ReadOnly
+	}
+
+	// Undefined ReadOnly policy field. Stick to the global defaults.
+	return !policy.Flags.ReadOnly
+}
+
+// CanUserUseRoomVersion tells whether the user can create a room with (or upgrade a room to) the given room version.
+func (me *Checker) CanUserUseRoomVersion(policy Policy, userId string, roomVersion string) bool {
+	var allowedRoomVersions []string
+
+	userPolicy := policy.GetUserPolicyByUserId(userId)
+	if userPolicy == nil {
+		// Not a user we manage. Unless asked otherwise, room versions are only restricted for managed users.
+		if policy.UnmanagedUserDefaults != nil {
+			allowedRoomVersions = policy.UnmanagedUserDefaults.AllowedRoomVersions
+		}
+	} else {
+		allowedRoomVersions = policy.Flags.AllowedRoomVersions
+		if userPolicy.AllowedRoomVersions != nil {
+			allowedRoomVersions = userPolicy.AllowedRoomVersions
+		}
+	}
+
+	if len(allowedRoomVersions) == 0 {
+		// No restrictions
+		return true
+	}
+
+	return util.IsStringInArray(roomVersion, allowedRoomVersions)
+}
+
+// CanUserAccessRoute tells whether the user can make requests to the given path (see UnmanagedUserDefaults.AllowedRoutes).
+func (me *Checker) CanUserAccessRoute(policy Policy, userId string, path string) bool {
+	if policy.UnmanagedUserDefaults == nil {
+		return true
+	}
+
+	if policy.GetUserPolicyByUserId(userId) != nil {
+		// Routes are only restricted for unmanaged users.
+		return true
+	}
+
+	return policy.UnmanagedUserDefaults.IsRouteAllowed(path)
+}
+
+// GetUserRateLimit returns the rate limit which applies to the user's requests (see UnmanagedUserDefaults.RateLimit).
+// A nil value means that there are no limits.
+func (me *Checker) GetUserRateLimit(policy Policy, userId string) *UnmanagedUserRateLimit {
+	if policy.UnmanagedUserDefaults == nil {
+		return nil
+	}
+
+	if policy.GetUserPolicyByUserId(userId) != nil {
+		// Only unmanaged users are rate-limited.
+		return nil
+	}
+
+	return policy.UnmanagedUserDefaults.RateLimit
+}
+
 func (me *Checker) CanUserSendEventToRoom(policy Policy, userId string, eventType string, roomId string) bool {
-	// Everyone can send everything wherywhere now.
-	// We don't have policy rules that affect this.
+	// Besides read-only users, everyone can send everything wherywhere now.
+	// We don't have other policy rules that affect this.
 	//
 	// However, people can intercept and control this via hooks.
-	return true
+	return me.CanUserSendEvents(policy, userId)
+}
+
+// CanUserJoinRoom tells whether the user can join (or knock on, or accept an invite to) the given room.
+func (me *Checker) CanUserJoinRoom(policy Policy, userId string, roomId string) bool {
+	userPolicy := policy.GetUserPolicyByUserId(userId)
+	if userPolicy == nil {
+		return true
+	}
+
+	if !userPolicy.RestrictToManagedRooms {
+		return true
+	}
+
+	return util.IsStringInArray(roomId, policy.GetEffectiveJoinedRoomIds(userPolicy))
 }
 
 func (me *Checker) CanUserLeaveRoom(policy Policy, userId string, roomId string) bool {
@@ -68,13 +195,24 @@ func (me *Checker) CanUserChangeOwnMembershipStateInRoom(policy Policy, userId s
 		return true
 	}
 
-	if util.IsStringInArray(roomId, userPolicy.JoinedRoomIds) {
+	if util.IsStringInArray(roomId, policy.GetEffectiveJoinedRoomIds(userPolicy)) {
 		return false
 	}
 
 	return true
 }
 
+// CanUserSetRoomState tells whether the user can set the given (empty state key) state event in the given room.
+// A nil content means that the state event is being removed.
+func (me *Checker) CanUserSetRoomState(policy Policy, userId string, roomId string, eventType string, content map[string]interface{}) bool {
+	roomPolicy := policy.GetEffectiveRoomPolicy(roomId)
+	if roomPolicy == nil {
+		return true
+	}
+
+	return roomPolicy.IsStateEventContentAllowed(eventType, content)
+}
+
 func (me *Checker) CanUserUseCustomDisplayName(policy Policy, userId string) bool {
 	return policy.Flags.AllowCustomUserDisplayNames
 }
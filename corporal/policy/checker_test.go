@@ -18,7 +18,8 @@ type PermissionAssertment struct {
 }
 
 type TestData struct {
-	Policy                Policy                 `json:"policy"`
+	// Policy is decoded via the Parser (see below), so that things like computed flags get evaluated
+	Policy                json.RawMessage        `json:"policy"`
 	PermissionAssertments []PermissionAssertment `json:"permissionAssertments"`
 }
 
@@ -30,6 +31,12 @@ func TestPolicyPermissionAssertment(t *testing.T) {
 
 	checker := NewChecker()
 
+	signatureVerifier, err := NewSignatureVerifier(nil)
+	if err != nil {
+		panic(err)
+	}
+	parser := NewParser(signatureVerifier)
+
 	for _, testPath := range matches {
 		testPath := testPath //make local
 		fileName := filepath.Base(testPath)
@@ -58,7 +65,13 @@ func TestPolicyPermissionAssertment(t *testing.T) {
 				return
 			}
 
-			err = determinePolicyPermissionError(testData.Policy, checker, testData.PermissionAssertments)
+			policy, err := parser.ParseWithoutSignatureVerification(testData.Policy)
+			if err != nil {
+				t.Errorf("Failed to parse policy from file: %s: %s", testPath, err)
+				return
+			}
+
+			err = determinePolicyPermissionError(*policy, checker, testData.PermissionAssertments)
 			if err != nil {
 				t.Errorf(
 					"Policy permission failure in %s: %s",
@@ -95,5 +108,95 @@ func checkAssertment(policy Policy, checker *Checker, assertment PermissionAsser
 		return fmt.Errorf("Expected %t status for user %s being able to leave room %s", assertment.Allowed, userId, roomId)
 	}
 
+	if assertment.Type == "joinRoom" {
+		userId := assertment.Payload["userId"].(string)
+		roomId := assertment.Payload["roomId"].(string)
+
+		allowed := checker.CanUserJoinRoom(policy, userId, roomId)
+
+		if allowed == assertment.Allowed {
+			return nil
+		}
+
+		return fmt.Errorf("Expected %t status for user %s being able to join room %s", assertment.Allowed, userId, roomId)
+	}
+
+	if assertment.Type == "setRoomState" {
+		userId := assertment.Payload["userId"].(string)
+		roomId := assertment.Payload["roomId"].(string)
+		eventType := assertment.Payload["eventType"].(string)
+		content, _ := assertment.Payload["content"].(map[string]interface{})
+
+		allowed := checker.CanUserSetRoomState(policy, userId, roomId, eventType, content)
+
+		if allowed == assertment.Allowed {
+			return nil
+		}
+
+		return fmt.Errorf("Expected %t status for user %s being able to set %s state in room %s", assertment.Allowed, userId, eventType, roomId)
+	}
+
+	if assertment.Type == "createRoom" {
+		userId := assertment.Payload["userId"].(string)
+
+		allowed := checker.CanUserCreateRoom(policy, userId)
+
+		if allowed == assertment.Allowed {
+			return nil
+		}
+
+		return fmt.Errorf("Expected %t status for user %s being able to create rooms", assertment.Allowed, userId)
+	}
+
+	if assertment.Type == "change3pids" {
+		userId := assertment.Payload["userId"].(string)
+
+		allowed := checker.CanUserChange3pids(policy, userId)
+
+		if allowed == assertment.Allowed {
+			return nil
+		}
+
+		return fmt.Errorf("Expected %t status for user %s being able to change 3pids", assertment.Allowed, userId)
+	}
+
+	if assertment.Type == "useRoomVersion" {
+		userId := assertment.Payload["userId"].(string)
+		roomVersion := assertment.Payload["roomVersion"].(string)
+
+		allowed := checker.CanUserUseRoomVersion(policy, userId, roomVersion)
+
+		if allowed == assertment.Allowed {
+			return nil
+		}
+
+		return fmt.Errorf("Expected %t status for user %s being able to use room version %s", assertment.Allowed, userId, roomVersion)
+	}
+
+	if assertment.Type == "sendEvents" {
+		userId := assertment.Payload["userId"].(string)
+
+		allowed := checker.CanUserSendEvents(policy, userId)
+
+		if allowed == assertment.Allowed {
+			return nil
+		}
+
+		return fmt.Errorf("Expected %t status for user %s being able to send events", assertment.Allowed, userId)
+	}
+
+	if assertment.Type == "accessRoute" {
+		userId := assertment.Payload["userId"].(string)
+		path := assertment.Payload["path"].(string)
+
+		allowed := checker.CanUserAccessRoute(policy, userId, path)
+
+		if allowed == assertment.Allowed {
+			return nil
+		}
+
+		return fmt.Errorf("Expected %t status for user %s being able to access %s", assertment.Allowed, userId, path)
+	}
+
 	return fmt.Errorf("Unknown policy assertment type: %s", assertment.Type)
 }
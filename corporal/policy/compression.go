@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// gzipMagicBytes is what all gzip streams start with.
+var gzipMagicBytes = []byte{0x1f, 0x8b}
+
+// zstdMagicBytes is what all zstd frames start with.
+var zstdMagicBytes = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// DefaultMaxDocumentSizeBytes is how large (decompressed) documents ReadDocument reads may be, unless changed via SetMaxDocumentSize
+const DefaultMaxDocumentSizeBytes = 64 * 1024 * 1024
+
+// maxDocumentSizeBytes is how large (decompressed) documents ReadDocument reads may be (see SetMaxDocumentSize)
+var maxDocumentSizeBytes int64 = DefaultMaxDocumentSizeBytes
+
+// SetMaxDocumentSize changes how large (decompressed) documents ReadDocument reads may be,
+// so that a small compressed document (a "zip bomb") can't make us run out of memory.
+// This is to be called before any documents are read.
+func SetMaxDocumentSize(maxSizeBytes int64) {
+	maxDocumentSizeBytes = maxSizeBytes
+}
+
+// ReadDocument reads a (possibly gzip- or zstd-compressed) policy document out of the given reader.
+//
+// contentEncoding is the value of the `Content-Encoding` header the document came with (if any).
+// When it's empty, we still detect compressed documents by their magic bytes,
+// so that pre-compressed files (e.g. `policy.json.gz` or `policy.json.zst` served as-is) work as well.
+//
+// Decompression happens while reading, so the compressed document is never held in memory in full.
+// Documents larger than the maximum size (see SetMaxDocumentSize), after decompression, are rejected as soon as we've read past it.
+func ReadDocument(reader io.Reader, contentEncoding string) ([]byte, error) {
+	contentEncoding = strings.ToLower(strings.TrimSpace(contentEncoding))
+
+	bufferedReader := bufio.NewReader(reader)
+
+	switch contentEncoding {
+	case "", "identity":
+		// Peeking may fail for very short documents. That's OK, those are surely not compressed.
+		magicBytes, _ := bufferedReader.Peek(len(zstdMagicBytes))
+		if bytes.HasPrefix(magicBytes, gzipMagicBytes) {
+			return readGzipDocument(bufferedReader)
+		}
+		if bytes.HasPrefix(magicBytes, zstdMagicBytes) {
+			return readZstdDocument(bufferedReader)
+		}
+		return readLimited(bufferedReader)
+	case "gzip", "x-gzip":
+		return readGzipDocument(bufferedReader)
+	case "zstd":
+		return readZstdDocument(bufferedReader)
+	}
+
+	return nil, fmt.Errorf("unsupported content encoding: %s", contentEncoding)
+}
+
+func readGzipDocument(reader io.Reader) ([]byte, error) {
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize gzip decompression: %s", err)
+	}
+	defer gzipReader.Close()
+
+	data, err := readLimited(gzipReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress gzip data: %s", err)
+	}
+
+	return data, nil
+}
+
+func readZstdDocument(reader io.Reader) ([]byte, error) {
+	zstdReader, err := zstd.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize zstd decompression: %s", err)
+	}
+	defer zstdReader.Close()
+
+	data, err := readLimited(zstdReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress zstd data: %s", err)
+	}
+
+	return data, nil
+}
+
+// readLimited reads everything out of the reader, failing once there's more than the maximum document size to read
+func readLimited(reader io.Reader) ([]byte, error) {
+	maxSizeBytes := maxDocumentSizeBytes
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxSizeBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > maxSizeBytes {
+		return nil, fmt.Errorf("the document is larger than the maximum of %d bytes", maxSizeBytes)
+	}
+
+	return data, nil
+}
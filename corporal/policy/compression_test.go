@@ -0,0 +1,70 @@
+package policy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipTestDocument(t *testing.T, document []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(document)
+	err := writer.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return buffer.Bytes()
+}
+
+func zstdTestDocument(t *testing.T, document []byte) []byte {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(document, nil)
+}
+
+func TestReadDocumentRejectsOversizedDocuments(t *testing.T) {
+	defer SetMaxDocumentSize(DefaultMaxDocumentSizeBytes)
+	SetMaxDocumentSize(1024)
+
+	withinLimit := []byte(`{"schemaVersion": 1, "users": [` + strings.Repeat(" ", 1024-33) + `]}`)
+	// Highly compressible, so that the compressed documents themselves are well within the limit
+	oversized := []byte(`{"schemaVersion": 1, "users": [` + strings.Repeat(" ", 1024*1024) + `]}`)
+
+	type testData struct {
+		name            string
+		contentEncoding string
+		encode          func(t *testing.T, document []byte) []byte
+	}
+
+	tests := []testData{
+		{"identity", "", func(t *testing.T, document []byte) []byte { return document }},
+		{"gzip", "gzip", gzipTestDocument},
+		{"gzip (detected)", "", gzipTestDocument},
+		{"zstd", "zstd", zstdTestDocument},
+		{"zstd (detected)", "", zstdTestDocument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document, err := ReadDocument(bytes.NewReader(test.encode(t, withinLimit)), test.contentEncoding)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(document, withinLimit) {
+				t.Errorf("expected the document to be read as is, got %d bytes", len(document))
+			}
+
+			_, err = ReadDocument(bytes.NewReader(test.encode(t, oversized)), test.contentEncoding)
+			if err == nil {
+				t.Errorf("expected a document larger than the limit to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package policy
+
+import (
+	"bytes"
+	"devture-matrix-corporal/corporal/util"
+	"encoding/json"
+	"fmt"
+)
+
+// computableFlags lists policy flags which can be specified as expressions (see compileExpression).
+//
+// These are the flags having a same-named user policy field, so that they can be turned into concrete per-user values.
+var computableFlags = []string{
+	"forbidRoomCreation",
+	"forbidEncryptedRoomCreation",
+	"forbidUnencryptedRoomCreation",
+	"forbid3pidChanges",
+	"readOnly",
+}
+
+// computableUserFields lists user policy fields which can be specified as expressions (see compileExpression).
+var computableUserFields = append([]string{"active", "restrictToManagedRooms"}, computableFlags...)
+
+// evaluatePolicyExpressions turns computed flags (e.g. `"forbidRoomCreation": "${not user.inRoom('!staff:example.com')}"`)
+// found in the policy document into concrete values.
+//
+// Expressions in user policy fields are evaluated against that user.
+//
+// Expressions in global flags are evaluated against each user (which doesn't define the same field itself),
+// with the result stored in the user's policy. The global flag itself becomes the result of evaluating the expression
+// against an empty user, which is what unmanaged users get.
+func evaluatePolicyExpressions(data []byte) ([]byte, error) {
+	// Most policies don't make use of expressions. Let's not pay the cost of decoding and re-encoding those.
+	if !bytes.Contains(data, []byte("${")) {
+		return data, nil
+	}
+
+	document, err := decodeDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each flag expression is compiled once, but evaluated against every user
+	flagExpressions := map[string]expressionFunc{}
+
+	if flags, ok := document["flags"].(map[string]interface{}); ok {
+		for name, value := range flags {
+			expression, isExpression := extractExpression(value)
+			if !isExpression {
+				continue
+			}
+
+			if !util.IsStringInArray(name, computableFlags) {
+				return nil, fmt.Errorf("flag `%s` cannot be specified as an expression", name)
+			}
+
+			compiledExpression, err := compileExpression(expression)
+			if err != nil {
+				return nil, fmt.Errorf("failed compiling expression for flag `%s`: %s", name, err)
+			}
+
+			flags[name] = compiledExpression(expressionUserContext{})
+			flagExpressions[name] = compiledExpression
+		}
+	}
+
+	if users, ok := document["users"].([]interface{}); ok {
+		for idx, userInterface := range users {
+			user, ok := userInterface.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			userContext := createExpressionUserContext(user)
+
+			for _, name := range computableUserFields {
+				value, exists := user[name]
+				if !exists {
+					continue
+				}
+
+				expression, isExpression := extractExpression(value)
+				if !isExpression {
+					continue
+				}
+
+				compiledExpression, err := compileExpression(expression)
+				if err != nil {
+					return nil, fmt.Errorf("failed compiling expression for field `%s` of user `%s` (index %d): %s", name, userContext.id, idx, err)
+				}
+
+				user[name] = compiledExpression(userContext)
+			}
+
+			for name, compiledExpression := range flagExpressions {
+				if _, exists := user[name]; exists {
+					// The user policy takes precedence over the global flag
+					continue
+				}
+
+				user[name] = compiledExpression(userContext)
+			}
+		}
+	}
+
+	return json.Marshal(document)
+}
+
+func extractExpression(value interface{}) (string, bool) {
+	valueString, ok := value.(string)
+	if !ok {
+		return "", false
+	}
+
+	matches := expressionRegex.FindStringSubmatch(valueString)
+	if matches == nil {
+		return "", false
+	}
+
+	return matches[1], true
+}
+
+func createExpressionUserContext(user map[string]interface{}) expressionUserContext {
+	userContext := expressionUserContext{
+		externalIds: map[string]string{},
+	}
+
+	userContext.id, _ = user["id"].(string)
+
+	// `active` may be an expression itself. Expressions can only see concrete values.
+	userContext.active, _ = user["active"].(bool)
+
+	if joinedRoomIds, ok := user["joinedRoomIds"].([]interface{}); ok {
+		for _, roomId := range joinedRoomIds {
+			if roomIdString, ok := roomId.(string); ok {
+				userContext.joinedRoomIds = append(userContext.joinedRoomIds, roomIdString)
+			}
+		}
+	}
+
+	if externalIds, ok := user["externalIds"].(map[string]interface{}); ok {
+		for idType, id := range externalIds {
+			if idString, ok := id.(string); ok {
+				userContext.externalIds[idType] = idString
+			}
+		}
+	}
+
+	return userContext
+}
@@ -0,0 +1,107 @@
+package policy
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+	"strings"
+)
+
+// DeclaredRoomReferencePrefix is what declared rooms are referenced by (followed by their key, e.g. `declared:engineering`),
+// wherever the policy expects a room id (managedRoomIds, room policies, joinedRoomIds, etc.).
+const DeclaredRoomReferencePrefix = "declared:"
+
+var knownRoomPresets = []string{"private_chat", "public_chat", "trusted_private_chat"}
+
+// DeclaredRoom is a room, which the reconciler creates (if it doesn't exist yet).
+//
+// As room ids are not known before rooms get created, declared rooms are referenced by key (see DeclaredRoomReferencePrefix).
+// Once a room is created, its id is recorded (see Store.SetDeclaredRoomIds) and references to it get resolved.
+// Until then, references are ignored.
+//
+// Rooms are created by the steward of their room policy (see RoomPolicy.StewardUserId), or by the matrix-corporal user.
+type DeclaredRoom struct {
+	Key string `json:"key"`
+
+	// Alias is the local part of the room's canonical alias (e.g. `engineering` for `#engineering:example.com`)
+	Alias string `json:"alias"`
+
+	Name      string `json:"name"`
+	Topic     string `json:"topic"`
+	AvatarUri string `json:"avatarUri"`
+
+	// Preset is a room creation preset (`private_chat`, `public_chat` or `trusted_private_chat`)
+	Preset string `json:"preset"`
+
+	RoomVersion string `json:"roomVersion"`
+
+	// Space makes the room get created as a space
+	Space bool `json:"space"`
+
+	InitialState []*DeclaredRoomStateEvent `json:"initialState"`
+}
+
+type DeclaredRoomStateEvent struct {
+	Type     string                 `json:"type"`
+	StateKey string                 `json:"stateKey"`
+	Content  map[string]interface{} `json:"content"`
+}
+
+func (me DeclaredRoom) Validate() error {
+	if me.Key == "" {
+		return fmt.Errorf("declared room has no key")
+	}
+
+	if strings.ContainsAny(me.Alias, "#:") {
+		return fmt.Errorf("alias `%s` needs to be a local part only (e.g. `engineering`)", me.Alias)
+	}
+
+	if me.Preset != "" && !util.IsStringInArray(me.Preset, knownRoomPresets) {
+		return fmt.Errorf("`%s` is an invalid preset", me.Preset)
+	}
+
+	for idx, event := range me.InitialState {
+		if event.Type == "" {
+			return fmt.Errorf("initial state event at index %d has no type", idx)
+		}
+	}
+
+	return nil
+}
+
+// GetReference returns the room id placeholder, which this room is referenced by (e.g. `declared:engineering`)
+func (me DeclaredRoom) GetReference() string {
+	return DeclaredRoomReferencePrefix + me.Key
+}
+
+func IsDeclaredRoomReference(roomId string) bool {
+	return strings.HasPrefix(roomId, DeclaredRoomReferencePrefix)
+}
+
+func (me *Policy) GetDeclaredRoomByKey(key string) *DeclaredRoom {
+	for _, declaredRoom := range me.DeclaredRooms {
+		if declaredRoom.Key == key {
+			return declaredRoom
+		}
+	}
+	return nil
+}
+
+// WithDeclaredRoomsResolved returns a copy of the policy, with references to declared rooms replaced by the ids of the created rooms.
+// The given map contains the ids of the rooms created so far (by declared room key).
+//
+// References to rooms which haven't been created yet are dropped, as there's nothing to manage yet.
+// Room policies for such rooms are kept as they are (still having the reference as their id), so that they can be consulted
+// when creating the rooms (e.g. for finding the room's steward), but they don't apply to anything.
+func (me Policy) WithDeclaredRoomsResolved(declaredRoomIds map[string]string) Policy {
+	if len(me.DeclaredRooms) == 0 {
+		return me
+	}
+
+	return me.withRoomIdsResolved(func(roomId string) (string, bool) {
+		if !IsDeclaredRoomReference(roomId) {
+			return roomId, true
+		}
+		resolvedRoomId, exists := declaredRoomIds[strings.TrimPrefix(roomId, DeclaredRoomReferencePrefix)]
+		return resolvedRoomId, exists
+	})
+}
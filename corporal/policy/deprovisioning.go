@@ -0,0 +1,125 @@
+package policy
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+	"time"
+)
+
+// Deprovisioning modes control what happens to users who become inactive (see UserPolicy.IsActive),
+// or who are removed from the policy (see Deprovisioning.IncludeRemovedUsers).
+const (
+	// DeprovisioningModeLogout only logs the user out of all their sessions (logging in again is prevented).
+	// The user stays in their rooms and keeps their profile.
+	DeprovisioningModeLogout = "logout"
+
+	// DeprovisioningModeDeactivate makes the user leave all rooms, logs them out and marks their display name as deactivated.
+	// This is what happens when no deprovisioning mode is specified. It can be undone by making the user active again.
+	DeprovisioningModeDeactivate = "deactivate"
+
+	// DeprovisioningModeErase is like DeprovisioningModeDeactivate, but once the grace period passes,
+	// the account gets deactivated on the homeserver with GDPR erasure (which cannot be undone).
+	DeprovisioningModeErase = "erase"
+
+	// DeprovisioningModePurge is like DeprovisioningModeErase, but the media uploaded by the user gets deleted as well.
+	DeprovisioningModePurge = "purge"
+)
+
+var knownDeprovisioningModes = []string{
+	DeprovisioningModeLogout,
+	DeprovisioningModeDeactivate,
+	DeprovisioningModeErase,
+	DeprovisioningModePurge,
+}
+
+// Deprovisioning controls what happens to users who are no longer supposed to be using the homeserver
+type Deprovisioning struct {
+	// Mode is one of the deprovisioning modes (see DeprovisioningModeDeactivate, etc.)
+	Mode string `json:"mode"`
+
+	// GracePeriodSeconds specifies how long after deactivation the destructive part (erasing or purging) happens.
+	// Making the user active again during the grace period cancels it.
+	GracePeriodSeconds int64 `json:"gracePeriodSeconds"`
+
+	// IncludeRemovedUsers makes users who disappear from the policy get deprovisioned too (as if they were still there, but inactive).
+	// Otherwise, such users become unmanaged and are left alone.
+	IncludeRemovedUsers bool `json:"includeRemovedUsers"`
+}
+
+func (me Deprovisioning) Validate() error {
+	if me.Mode != "" && !util.IsStringInArray(me.Mode, knownDeprovisioningModes) {
+		return fmt.Errorf("`%s` is an invalid deprovisioning mode", me.Mode)
+	}
+
+	if me.GracePeriodSeconds < 0 {
+		return fmt.Errorf("`gracePeriodSeconds` cannot be negative")
+	}
+
+	return nil
+}
+
+// IsLogoutOnly tells whether deprovisioning only involves logging the user out (see DeprovisioningModeLogout)
+func (me Deprovisioning) IsLogoutOnly() bool {
+	return me.Mode == DeprovisioningModeLogout
+}
+
+// IsDestructive tells whether deprovisioning (eventually) gets rid of the account's data, which cannot be undone
+func (me Deprovisioning) IsDestructive() bool {
+	return me.Mode == DeprovisioningModeErase || me.Mode == DeprovisioningModePurge
+}
+
+// IsMediaPurged tells whether deprovisioning deletes the user's media (see DeprovisioningModePurge)
+func (me Deprovisioning) IsMediaPurged() bool {
+	return me.Mode == DeprovisioningModePurge
+}
+
+func (me Deprovisioning) GetGracePeriod() time.Duration {
+	return time.Duration(me.GracePeriodSeconds) * time.Second
+}
+
+// GetDeprovisioning returns the deprovisioning settings (see Deprovisioning), with the mode defaulting to DeprovisioningModeDeactivate
+func (me *Policy) GetDeprovisioning() Deprovisioning {
+	deprovisioning := Deprovisioning{}
+	if me.Deprovisioning != nil {
+		deprovisioning = *me.Deprovisioning
+	}
+	if deprovisioning.Mode == "" {
+		deprovisioning.Mode = DeprovisioningModeDeactivate
+	}
+	return deprovisioning
+}
+
+// IsDeprovisioningTracked tells whether users' deprovisioning needs to be kept track of (when it started, who's been removed from the policy, etc.)
+func (me *Policy) IsDeprovisioningTracked() bool {
+	return me.Deprovisioning != nil
+}
+
+// AreRemovedUsersDeprovisioned tells whether users who disappear from the policy are to be deprovisioned (see Deprovisioning.IncludeRemovedUsers)
+func (me *Policy) AreRemovedUsersDeprovisioned() bool {
+	return me.Deprovisioning != nil && me.Deprovisioning.IncludeRemovedUsers
+}
+
+// WithRemovedUsersRetained returns a copy of the policy, in which the given users (which have been removed from the policy)
+// are retained as inactive users, so that they'd get deprovisioned (see Deprovisioning.IncludeRemovedUsers).
+//
+// Users which are (still or again) part of the policy are not affected.
+func (me Policy) WithRemovedUsersRetained(removedUserIds []string) Policy {
+	if !me.AreRemovedUsersDeprovisioned() {
+		return me
+	}
+
+	users := make([]*UserPolicy, 0, len(me.User)+len(removedUserIds))
+	users = append(users, me.User...)
+	for _, userId := range removedUserIds {
+		if me.GetUserPolicyByUserId(userId) != nil {
+			continue
+		}
+		users = append(users, &UserPolicy{
+			Id:     userId,
+			Active: false,
+		})
+	}
+	me.User = users
+
+	return me
+}
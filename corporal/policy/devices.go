@@ -0,0 +1,15 @@
+package policy
+
+import (
+	"time"
+)
+
+// GetMaxDeviceIdleDuration returns for how long the given user's devices may go unseen, before they get deleted during reconciliation.
+// The user policy's MaxDeviceIdleDays takes precedence over the global flag. Zero means that idle devices are left alone.
+func (me *Policy) GetMaxDeviceIdleDuration(userPolicy *UserPolicy) time.Duration {
+	days := me.Flags.MaxDeviceIdleDays
+	if userPolicy != nil && userPolicy.MaxDeviceIdleDays != nil {
+		days = *userPolicy.MaxDeviceIdleDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
@@ -0,0 +1,313 @@
+package policy
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// expressionRegex matches policy values which are expressions (e.g. `${not user.inRoom('!staff:example.com')}`).
+var expressionRegex = regexp.MustCompile(`^\$\{(.*)\}$`)
+
+// expressionUserContext is what `user.*` refers to in expressions.
+// It's built out of the (raw) user policy, before any expressions in it have been evaluated.
+type expressionUserContext struct {
+	id            string
+	active        bool
+	joinedRoomIds []string
+	externalIds   map[string]string
+}
+
+// expressionFunc is a compiled expression (see compileExpression), which can be evaluated against any number of users.
+type expressionFunc func(user expressionUserContext) bool
+
+// compileExpression compiles a lightweight boolean expression, which can then be evaluated against users.
+// Everything that can go wrong (syntax errors, bad regular expressions, etc.) does so here, so evaluation never fails.
+//
+// Supported syntax:
+//   - literals: `true`, `false`
+//   - operators: `not`, `and`, `or` (in order of precedence) and parentheses
+//   - `user.active`
+//   - `user.inRoom('!room:example.com')` - whether the room is in the user's `joinedRoomIds`
+//   - `user.idMatches('^@bot-.+:example.com$')` - whether the user's id matches the regular expression
+//   - `user.hasExternalId('ldapDn')` - whether the user has an external id of the given type
+//
+// `user.inCommunity(..)` is rejected, as communities (groups) no longer exist in Matrix.
+func compileExpression(expression string) (expressionFunc, error) {
+	tokens, err := tokenizeExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &expressionParser{
+		tokens: tokens,
+	}
+
+	result, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.position != len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected `%s` at the end of the expression", parser.tokens[parser.position].value)
+	}
+
+	return result, nil
+}
+
+const (
+	expressionTokenIdentifier = "identifier"
+	expressionTokenString     = "string"
+	expressionTokenPunctuator = "punctuator"
+)
+
+type expressionToken struct {
+	kind  string
+	value string
+}
+
+func tokenizeExpression(expression string) ([]expressionToken, error) {
+	tokens := make([]expressionToken, 0)
+
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		if unicode.IsSpace(r) {
+			i++
+			continue
+		}
+
+		if r == '(' || r == ')' {
+			tokens = append(tokens, expressionToken{kind: expressionTokenPunctuator, value: string(r)})
+			i++
+			continue
+		}
+
+		if r == '\'' || r == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string literal")
+			}
+
+			tokens = append(tokens, expressionToken{kind: expressionTokenString, value: string(runes[i+1 : end])})
+			i = end + 1
+			continue
+		}
+
+		if unicode.IsLetter(r) {
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+
+			tokens = append(tokens, expressionToken{kind: expressionTokenIdentifier, value: string(runes[i:end])})
+			i = end
+			continue
+		}
+
+		return nil, fmt.Errorf("unexpected character `%s`", string(r))
+	}
+
+	return tokens, nil
+}
+
+// expressionParser is a recursive-descent parser, which compiles the expression into an expressionFunc as it goes.
+type expressionParser struct {
+	tokens   []expressionToken
+	position int
+}
+
+func (me *expressionParser) peek() *expressionToken {
+	if me.position >= len(me.tokens) {
+		return nil
+	}
+	return &me.tokens[me.position]
+}
+
+func (me *expressionParser) next() (*expressionToken, error) {
+	token := me.peek()
+	if token == nil {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	me.position++
+	return token, nil
+}
+
+func (me *expressionParser) expectPunctuator(value string) error {
+	token, err := me.next()
+	if err != nil {
+		return err
+	}
+
+	if token.kind != expressionTokenPunctuator || token.value != value {
+		return fmt.Errorf("expected `%s`, found `%s`", value, token.value)
+	}
+
+	return nil
+}
+
+func (me *expressionParser) isNextIdentifier(value string) bool {
+	token := me.peek()
+	return token != nil && token.kind == expressionTokenIdentifier && token.value == value
+}
+
+func (me *expressionParser) parseOr() (expressionFunc, error) {
+	result, err := me.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for me.isNextIdentifier("or") {
+		me.position++
+
+		operand, err := me.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left := result
+		result = func(user expressionUserContext) bool {
+			return left(user) || operand(user)
+		}
+	}
+
+	return result, nil
+}
+
+func (me *expressionParser) parseAnd() (expressionFunc, error) {
+	result, err := me.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for me.isNextIdentifier("and") {
+		me.position++
+
+		operand, err := me.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left := result
+		result = func(user expressionUserContext) bool {
+			return left(user) && operand(user)
+		}
+	}
+
+	return result, nil
+}
+
+func (me *expressionParser) parseUnary() (expressionFunc, error) {
+	if me.isNextIdentifier("not") {
+		me.position++
+
+		operand, err := me.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(user expressionUserContext) bool {
+			return !operand(user)
+		}, nil
+	}
+
+	return me.parsePrimary()
+}
+
+func (me *expressionParser) parsePrimary() (expressionFunc, error) {
+	token, err := me.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if token.kind == expressionTokenPunctuator && token.value == "(" {
+		result, err := me.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		err = me.expectPunctuator(")")
+		if err != nil {
+			return nil, err
+		}
+
+		return result, nil
+	}
+
+	if token.kind != expressionTokenIdentifier {
+		return nil, fmt.Errorf("unexpected `%s`", token.value)
+	}
+
+	switch token.value {
+	case "true":
+		return func(user expressionUserContext) bool { return true }, nil
+	case "false":
+		return func(user expressionUserContext) bool { return false }, nil
+	case "user.active":
+		return func(user expressionUserContext) bool { return user.active }, nil
+	case "user.inCommunity":
+		// Communities (also known as groups, with ids like `+staff:example.com`) were removed from Matrix in favor of spaces,
+		// so there's nothing we could check membership against.
+		return nil, fmt.Errorf("`%s` is not supported, as communities no longer exist in Matrix (use `user.inRoom` with a space's room id instead)", token.value)
+	}
+
+	if !strings.HasPrefix(token.value, "user.") {
+		return nil, fmt.Errorf("unknown identifier `%s`", token.value)
+	}
+
+	argument, err := me.parseFunctionArgument()
+	if err != nil {
+		return nil, fmt.Errorf("bad `%s` call: %s", token.value, err)
+	}
+
+	switch token.value {
+	case "user.inRoom":
+		return func(user expressionUserContext) bool {
+			return util.IsStringInArray(argument, user.joinedRoomIds)
+		}, nil
+	case "user.idMatches":
+		regex, err := regexp.Compile(argument)
+		if err != nil {
+			return nil, fmt.Errorf("bad regular expression (%s) for `%s`: %s", argument, token.value, err)
+		}
+		return func(user expressionUserContext) bool {
+			return regex.MatchString(user.id)
+		}, nil
+	case "user.hasExternalId":
+		return func(user expressionUserContext) bool {
+			_, exists := user.externalIds[argument]
+			return exists
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown function `%s`", token.value)
+}
+
+// parseFunctionArgument parses a single string argument in parentheses: `('value')`
+func (me *expressionParser) parseFunctionArgument() (string, error) {
+	err := me.expectPunctuator("(")
+	if err != nil {
+		return "", err
+	}
+
+	token, err := me.next()
+	if err != nil {
+		return "", err
+	}
+	if token.kind != expressionTokenString {
+		return "", fmt.Errorf("expected a string argument, found `%s`", token.value)
+	}
+
+	err = me.expectPunctuator(")")
+	if err != nil {
+		return "", err
+	}
+
+	return token.value, nil
+}
@@ -0,0 +1,91 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileExpression(t *testing.T) {
+	user := expressionUserContext{
+		id:            "@bot-1:example.com",
+		active:        true,
+		joinedRoomIds: []string{"!staff:example.com"},
+		externalIds:   map[string]string{"ldapDn": "uid=bot-1,ou=people,dc=example,dc=com"},
+	}
+
+	type testData struct {
+		expression     string
+		expectedResult bool
+	}
+
+	tests := []testData{
+		{"true", true},
+		{"not true", false},
+		{"user.active", true},
+		{"user.inRoom('!staff:example.com')", true},
+		{"user.inRoom(\"!other:example.com\")", false},
+		{"user.idMatches('^@bot-.+:example.com$')", true},
+		{"user.idMatches('^@admin-')", false},
+		{"user.hasExternalId('ldapDn')", true},
+		{"user.hasExternalId('samlId')", false},
+		{"false or user.active and not user.inRoom('!other:example.com')", true},
+		{"(false or user.active) and false", false},
+		{"not not (true)", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			compiledExpression, err := compileExpression(test.expression)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if result := compiledExpression(user); result != test.expectedResult {
+				t.Errorf("expected %t, got %t", test.expectedResult, result)
+			}
+
+			// Compiled expressions don't hold on to anything user-specific, so they can be evaluated against anyone
+			if result := compiledExpression(user); result != test.expectedResult {
+				t.Errorf("expected %t when evaluated again, got %t", test.expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestCompileExpressionRejectsInvalidExpressions(t *testing.T) {
+	type testData struct {
+		expression            string
+		expectedErrorContains string
+	}
+
+	tests := []testData{
+		{"user.inCommunity('+staff:example.com')", "communities no longer exist"},
+		{"user.idMatches('([')", "bad regular expression"},
+		{"user.inRoom(!room)", "unexpected character"},
+		{"user.inRoom('!room:example.com'", "unexpected end of expression"},
+		{"user.unknown('value')", "unknown function"},
+		{"something", "unknown identifier"},
+		{"true false", "at the end of the expression"},
+		{"'unterminated", "unterminated string literal"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			_, err := compileExpression(test.expression)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !strings.Contains(err.Error(), test.expectedErrorContains) {
+				t.Errorf("expected the error to mention `%s`, got: %s", test.expectedErrorContains, err)
+			}
+		})
+	}
+}
+
+func TestInvalidFlagExpressionsAreRejectedWithoutUsers(t *testing.T) {
+	// Flag expressions get compiled even if there are no users to evaluate them against
+	_, err := evaluatePolicyExpressions([]byte(`{"flags": {"forbidRoomCreation": "${user.idMatches('([')}"}}`))
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
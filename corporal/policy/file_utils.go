@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// writeFileAtomically writes the data to a temporary file (readable by us only) and renames it into place,
+// so that a crash midway doesn't leave us with a broken file
+func writeFileAtomically(path string, data []byte) error {
+	temporaryPath := path + ".tmp"
+	err := ioutil.WriteFile(temporaryPath, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, path)
+}
+
+// encrypt encrypts using AES-256-GCM, prepending the (random) nonce to the result
+func encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := createAead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := createAead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("data is too short")
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+func createAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
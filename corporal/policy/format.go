@@ -0,0 +1,123 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/titanous/json5"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatJSON  = "json"
+	FormatYAML  = "yaml"
+	FormatJSON5 = "json5"
+)
+
+// DetectFormat figures out the format (one of the `Format*` constants) of a policy document,
+// based on its content type (if known) or file path (if known).
+//
+// We default to FormatJSON when neither of these tell us anything.
+func DetectFormat(contentType string, path string) string {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil {
+			switch mediaType {
+			case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+				return FormatYAML
+			case "application/json5":
+				return FormatJSON5
+			}
+		}
+	}
+
+	if path != "" {
+		// Compressed documents (see ReadDocument) may carry an additional extension (e.g. `policy.yaml.gz`)
+		path = strings.TrimSuffix(strings.TrimSuffix(path, ".gz"), ".zst")
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			return FormatYAML
+		case ".json5":
+			return FormatJSON5
+		}
+	}
+
+	return FormatJSON
+}
+
+// convertToJSON converts a policy document of the given format to the canonical (JSON) format.
+func convertToJSON(data []byte, format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return data, nil
+	case FormatYAML:
+		var document interface{}
+		err := yaml.Unmarshal(data, &document)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode YAML: %s", err)
+		}
+
+		document, err = normalizeYAMLValue(document)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(document)
+	case FormatJSON5:
+		var document interface{}
+		err := json5.Unmarshal(data, &document)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JSON5: %s", err)
+		}
+
+		return json.Marshal(document)
+	}
+
+	return nil, fmt.Errorf("unknown policy format: %s", format)
+}
+
+// normalizeYAMLValue turns the maps produced by the YAML decoder into something which can be JSON-encoded.
+// YAML mappings may have non-string keys, which JSON objects don't support.
+func normalizeYAMLValue(value interface{}) (interface{}, error) {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		for key, item := range typedValue {
+			normalizedItem, err := normalizeYAMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			typedValue[key] = normalizedItem
+		}
+		return typedValue, nil
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("YAML mapping keys need to be strings, found: %v", key)
+			}
+
+			normalizedItem, err := normalizeYAMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result[keyString] = normalizedItem
+		}
+		return result, nil
+	case []interface{}:
+		for idx, item := range typedValue {
+			normalizedItem, err := normalizeYAMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			typedValue[idx] = normalizedItem
+		}
+		return typedValue, nil
+	}
+
+	return value, nil
+}
@@ -0,0 +1,138 @@
+package policy
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DegradedModeWarn only logs warnings while the policy is expired
+	DegradedModeWarn = "warn"
+
+	// DegradedModeReadOnly makes all managed users read-only (see Checker.CanUserSendEvents) while the policy is expired
+	DegradedModeReadOnly = "readOnly"
+
+	// DegradedModeRejectLogins rejects all login requests while the policy is expired
+	DegradedModeRejectLogins = "rejectLogins"
+)
+
+var knownDegradedModes = []string{
+	DegradedModeWarn,
+	DegradedModeReadOnly,
+	DegradedModeRejectLogins,
+}
+
+// FreshnessGuard keeps an eye on the freshness of the policy in the store (see Policy.ExpiresAt and Policy.MaxAgeSeconds).
+//
+// When the policy expires and no newer policy gets loaded, we're likely dealing with a silently dead policy pipeline.
+// While that's the case, the guard reports to be degraded, and other components (the HTTP gateway, etc.)
+// apply the configured degraded mode.
+//
+// Regardless of the degraded mode, the guard also refuses to serve a policy restored from the last-known-good cache,
+// once it has gotten too stale (see LastKnownGoodCache).
+type FreshnessGuard struct {
+	logger             *logrus.Logger
+	store              *Store
+	lastKnownGoodCache *LastKnownGoodCache
+	degradedMode       string
+	checkInterval      time.Duration
+
+	checkTicker *time.Ticker
+	wasDegraded bool
+	lockCheck   sync.Mutex
+}
+
+func NewFreshnessGuard(
+	logger *logrus.Logger,
+	store *Store,
+	lastKnownGoodCache *LastKnownGoodCache,
+	degradedMode string,
+	checkInterval time.Duration,
+) (*FreshnessGuard, error) {
+	if !util.IsStringInArray(degradedMode, knownDegradedModes) {
+		return nil, fmt.Errorf("unknown degraded mode `%s` (expected one of: %s)", degradedMode, strings.Join(knownDegradedModes, ", "))
+	}
+
+	return &FreshnessGuard{
+		logger:             logger,
+		store:              store,
+		lastKnownGoodCache: lastKnownGoodCache,
+		degradedMode:       degradedMode,
+		checkInterval:      checkInterval,
+	}, nil
+}
+
+func (me *FreshnessGuard) Start() error {
+	me.checkTicker = time.NewTicker(me.checkInterval)
+
+	go func() {
+		for range me.checkTicker.C {
+			me.check()
+		}
+	}()
+
+	return nil
+}
+
+func (me *FreshnessGuard) Stop() {
+	if me.checkTicker != nil {
+		me.checkTicker.Stop()
+	}
+}
+
+// IsDegraded tells whether the current policy has expired
+func (me *FreshnessGuard) IsDegraded() bool {
+	return isExpirationTimeReached(me.store.GetExpirationTime())
+}
+
+// IsEnforcingReadOnly tells whether managed users are to be treated as read-only, due to the policy having expired
+func (me *FreshnessGuard) IsEnforcingReadOnly() bool {
+	return me.degradedMode == DegradedModeReadOnly && me.IsDegraded()
+}
+
+// IsRejectingLogins tells whether logins are to be rejected, due to the policy having expired
+func (me *FreshnessGuard) IsRejectingLogins() bool {
+	return me.degradedMode == DegradedModeRejectLogins && me.IsDegraded()
+}
+
+// IsRefusingToServe tells whether all requests are to be refused, due to the policy being a restored one that is too stale
+func (me *FreshnessGuard) IsRefusingToServe() bool {
+	return me.lastKnownGoodCache.IsServingTooStalePolicy()
+}
+
+func (me *FreshnessGuard) check() {
+	me.lockCheck.Lock()
+	defer me.lockCheck.Unlock()
+
+	expirationTime := me.store.GetExpirationTime()
+	isDegraded := isExpirationTimeReached(expirationTime)
+
+	if isDegraded {
+		me.logger.Warnf(
+			"Policy expired at %s and no newer policy has been loaded since. Is the policy provider working? Degraded mode in effect: %s",
+			expirationTime.UTC().Format(time.RFC3339),
+			me.degradedMode,
+		)
+	} else if me.wasDegraded {
+		me.logger.Infof("A fresh policy has been loaded. Leaving degraded mode: %s", me.degradedMode)
+	}
+
+	me.wasDegraded = isDegraded
+
+	if me.IsRefusingToServe() {
+		me.logger.Errorf("The policy restored from the last-known-good cache is too stale to be served and no newer policy has been loaded since. Refusing to serve requests")
+	}
+}
+
+func isExpirationTimeReached(expirationTime *time.Time) bool {
+	if expirationTime == nil {
+		// Policies which don't specify an expiration time never expire
+		return false
+	}
+	return time.Now().After(*expirationTime)
+}
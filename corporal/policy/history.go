@@ -0,0 +1,337 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PolicySourceRollback = "rollback"
+	PolicySourceHttpApi  = "httpapi"
+
+	// PolicySourceHttpApiUser is for policies which resulted from a single user policy being pushed via the HTTP API
+	PolicySourceHttpApiUser = "httpapi-user"
+)
+
+// HistoryEntry represents a policy which had been loaded into the store at some point in time.
+type HistoryEntry struct {
+	ID int `json:"id"`
+
+	LoadedAt time.Time `json:"loadedAt"`
+
+	// Source tells where the policy came from (a policy provider type, PolicySourceHttpApi, PolicySourceRollback, etc.)
+	Source string `json:"source"`
+
+	IdentificationStamp *string `json:"identificationStamp"`
+
+	Policy *Policy `json:"policy"`
+}
+
+// historyFileEntry is how a HistoryEntry is stored in the file.
+// The policy in it references secrets instead of containing them (see Policy.MarshalWithSecretReferences).
+type historyFileEntry struct {
+	ID                  int             `json:"id"`
+	LoadedAt            time.Time       `json:"loadedAt"`
+	Source              string          `json:"source"`
+	IdentificationStamp *string         `json:"identificationStamp"`
+	Policy              json.RawMessage `json:"policy"`
+}
+
+// History keeps track of the last N policies that were loaded into the store.
+//
+// If a path is specified, the history is persisted to a local file (optionally encrypted), so that it survives restarts.
+// The file contains one (JSON-encoded, or encrypted and base64-encoded) entry per line.
+// New entries are appended to it, with the file only getting rewritten (compacted to the last N entries) once it has grown to twice that.
+type History struct {
+	logger        *logrus.Logger
+	size          int
+	path          string
+	encryptionKey []byte
+	parser        *Parser
+	entries       []*HistoryEntry
+	lastID        int
+
+	// fileEntriesCount is how many entries the file contains (some of which may have been trimmed from entries already).
+	// It's 0 when the file needs to be (re)written from scratch (it doesn't exist yet or it couldn't be restored).
+	fileEntriesCount int
+
+	lock sync.RWMutex
+}
+
+// NewHistory creates a new history.
+// A nil encryptionKey means no encryption, otherwise it needs to be a 32-byte AES-256 key.
+// The parser is used for parsing the policies restored from the file, so it's only needed when a path is specified.
+func NewHistory(logger *logrus.Logger, size int, path string, encryptionKey []byte, parser *Parser) (*History, error) {
+	if encryptionKey != nil && len(encryptionKey) != 32 {
+		return nil, fmt.Errorf("the encryption key needs to be 32 bytes long, not %d", len(encryptionKey))
+	}
+
+	me := &History{
+		logger:        logger,
+		size:          size,
+		path:          path,
+		encryptionKey: encryptionKey,
+		parser:        parser,
+		entries:       make([]*HistoryEntry, 0),
+	}
+
+	err := me.restore()
+	if err != nil {
+		logger.Warnf("Failed restoring policy history from %s: %s", path, err)
+	}
+
+	return me, nil
+}
+
+func (me *History) Add(policy *Policy, source string) {
+	if me.size <= 0 {
+		return
+	}
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.lastID++
+
+	entry := &HistoryEntry{
+		ID:                  me.lastID,
+		LoadedAt:            time.Now().UTC(),
+		Source:              source,
+		IdentificationStamp: policy.IdentificationStamp,
+		Policy:              policy,
+	}
+
+	me.entries = append(me.entries, entry)
+
+	if len(me.entries) > me.size {
+		me.entries = me.entries[len(me.entries)-me.size:]
+	}
+
+	err := me.persist(entry)
+	if err != nil {
+		me.logger.Warnf("Failed persisting policy history to %s: %s", me.path, err)
+
+		// We can't be sure what the file contains now, so it gets rewritten next time
+		me.fileEntriesCount = 0
+	}
+}
+
+// List returns all history entries, the most recent one being last.
+func (me *History) List() []*HistoryEntry {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	entries := make([]*HistoryEntry, len(me.entries))
+	copy(entries, me.entries)
+
+	return entries
+}
+
+func (me *History) GetByID(id int) *HistoryEntry {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	for _, entry := range me.entries {
+		if entry.ID == id {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// persist appends the given (newly added) entry to the file, or rewrites the file with all current entries, if it's due for compacting
+func (me *History) persist(entry *HistoryEntry) error {
+	if me.path == "" {
+		return nil
+	}
+
+	if me.fileEntriesCount == 0 || me.fileEntriesCount >= 2*me.size {
+		return me.compact()
+	}
+
+	line, err := me.encodeEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	// Policies contain sensitive data (password hashes, etc.), so the file is only readable by us
+	file, err := os.OpenFile(me.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(line)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	me.fileEntriesCount++
+
+	return nil
+}
+
+// compact rewrites the file, so that it only contains the current entries
+func (me *History) compact() error {
+	var data []byte
+	for _, entry := range me.entries {
+		line, err := me.encodeEntry(entry)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+	}
+
+	err := writeFileAtomically(me.path, data)
+	if err != nil {
+		return err
+	}
+
+	me.fileEntriesCount = len(me.entries)
+
+	return nil
+}
+
+// encodeEntry turns an entry into a (newline-terminated) line for the file
+func (me *History) encodeEntry(entry *HistoryEntry) ([]byte, error) {
+	policyBytes, err := entry.Policy.MarshalWithSecretReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	line, err := json.Marshal(historyFileEntry{
+		ID:                  entry.ID,
+		LoadedAt:            entry.LoadedAt,
+		Source:              entry.Source,
+		IdentificationStamp: entry.IdentificationStamp,
+		Policy:              policyBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if me.encryptionKey != nil {
+		encrypted, err := encrypt(me.encryptionKey, line)
+		if err != nil {
+			return nil, fmt.Errorf("failed encrypting: %s", err)
+		}
+		line = []byte(base64.StdEncoding.EncodeToString(encrypted))
+	}
+
+	return append(line, '\n'), nil
+}
+
+// decodeEntry does the opposite of encodeEntry (for a line without the newline)
+func (me *History) decodeEntry(line []byte) (*historyFileEntry, error) {
+	if me.encryptionKey != nil {
+		encrypted, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 (is it not encrypted?): %s", err)
+		}
+
+		line, err = decrypt(me.encryptionKey, encrypted)
+		if err != nil {
+			return nil, fmt.Errorf("failed decrypting (is the encryption key right?): %s", err)
+		}
+	}
+
+	var fileEntry historyFileEntry
+	err := json.Unmarshal(line, &fileEntry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JSON (is it encrypted?): %s", err)
+	}
+
+	return &fileEntry, nil
+}
+
+func (me *History) restore() error {
+	if me.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(me.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// No history yet. That's OK.
+			return nil
+		}
+
+		return err
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+
+	// Each line is newline-terminated, so whatever follows the last newline is either nothing,
+	// or what's left of an entry that failed to be appended fully (e.g. due to a crash), which we ignore.
+	lines = lines[:len(lines)-1]
+	isComplete := len(data) == 0 || data[len(data)-1] == '\n'
+
+	var fileEntries []*historyFileEntry
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		fileEntry, err := me.decodeEntry(line)
+		if err != nil {
+			return err
+		}
+
+		fileEntries = append(fileEntries, fileEntry)
+	}
+
+	fileEntriesCount := len(fileEntries)
+
+	if me.size > 0 && len(fileEntries) > me.size {
+		fileEntries = fileEntries[len(fileEntries)-me.size:]
+	}
+
+	var entries []*HistoryEntry
+	for _, fileEntry := range fileEntries {
+		// Policies may reference secrets, which need to be resolved again.
+		// If that fails (e.g. Vault being unreachable), we'd rather lose this entry than the whole history.
+		policy, err := me.parser.ParseWithoutSignatureVerification(fileEntry.Policy)
+		if err != nil {
+			me.logger.Warnf("Failed restoring policy history entry #%d from %s (dropping it): %s", fileEntry.ID, me.path, err)
+			continue
+		}
+
+		entries = append(entries, &HistoryEntry{
+			ID:                  fileEntry.ID,
+			LoadedAt:            fileEntry.LoadedAt,
+			Source:              fileEntry.Source,
+			IdentificationStamp: fileEntry.IdentificationStamp,
+			Policy:              policy,
+		})
+	}
+
+	if !isComplete {
+		// Rewriting the file gets rid of the partial entry, so that it doesn't get in the way of entries appended after it
+		fileEntriesCount = 0
+	}
+
+	me.entries = entries
+	me.fileEntriesCount = fileEntriesCount
+	for _, fileEntry := range fileEntries {
+		// Dropped entries count too, so that their ids don't get reused
+		if fileEntry.ID > me.lastID {
+			me.lastID = fileEntry.ID
+		}
+	}
+
+	return nil
+}
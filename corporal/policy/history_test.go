@@ -0,0 +1,259 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+type testSecretResolver map[string]map[string]interface{}
+
+func (me testSecretResolver) ReadSecret(path string) (map[string]interface{}, error) {
+	secret, exists := me[path]
+	if !exists {
+		return nil, fmt.Errorf("no secret at %s", path)
+	}
+	return secret, nil
+}
+
+func createTestParser(t *testing.T, secretResolver SecretResolver) *Parser {
+	signatureVerifier, err := NewSignatureVerifier(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	parser := NewParser(signatureVerifier)
+	if secretResolver != nil {
+		parser.SetSecretResolver(secretResolver)
+	}
+	return parser
+}
+
+func createTestHistory(t *testing.T, path string, encryptionKey []byte) *History {
+	return createTestHistoryWithParser(t, path, encryptionKey, createTestParser(t, nil))
+}
+
+func createTestHistoryWithParser(t *testing.T, path string, encryptionKey []byte, parser *Parser) *History {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	history, err := NewHistory(logger, 2, path, encryptionKey, parser)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return history
+}
+
+func TestHistoryPersistsAndRestores(t *testing.T) {
+	directory, err := ioutil.TempDir("", "policy-history")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	for name, encryptionKey := range map[string][]byte{"plain": nil, "encrypted": bytes.Repeat([]byte{0x01}, 32)} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(directory, name+".json")
+
+			history := createTestHistory(t, path, encryptionKey)
+			for _, userId := range []string{"@a:example.com", "@b:example.com", "@c:example.com"} {
+				history.Add(&Policy{User: []*UserPolicy{{Id: userId}}}, PolicySourceHttpApi)
+			}
+
+			stat, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if stat.Mode().Perm() != 0600 {
+				t.Errorf("expected the file to only be readable by us, got mode %s", stat.Mode().Perm())
+			}
+
+			fileBytes, _ := ioutil.ReadFile(path)
+			if isPlain := bytes.Contains(fileBytes, []byte("@c:example.com")); isPlain != (encryptionKey == nil) {
+				t.Errorf("expected the file to be in plain text only without an encryption key")
+			}
+
+			entries := createTestHistory(t, path, encryptionKey).List()
+			if len(entries) != 2 || entries[0].ID != 2 || entries[1].Policy.User[0].Id != "@c:example.com" {
+				t.Errorf("unexpected restored entries: %#v", entries)
+			}
+		})
+	}
+}
+
+func TestHistoryDoesNotPersistResolvedSecrets(t *testing.T) {
+	directory, err := ioutil.TempDir("", "policy-history")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "history.json")
+
+	secretResolver := testSecretResolver{
+		"secret/data/matrix-corporal": {"john-password": "john-secret", "jane-password": "jane-secret"},
+	}
+	parser := createTestParser(t, secretResolver)
+
+	policy, err := parser.Parse([]byte(`{
+		"schemaVersion": 1,
+		"users": [{"id": "@john:example.com", "active": true, "authType": "plain", "authCredential": {"$vault": "secret/data/matrix-corporal#john-password"}}]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// User policies bring their own secret references along
+	userPolicy, err := parser.ParseUserPolicy([]byte(`{
+		"id": "@jane:example.com", "active": true, "authType": "plain", "authCredential": {"$vault": "secret/data/matrix-corporal#jane-password"}
+	}`), FormatJSON)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	modified := policy.WithUserPolicy(userPolicy)
+
+	history := createTestHistoryWithParser(t, path, nil, parser)
+	history.Add(&modified, PolicySourceHttpApiUser)
+
+	// What's in memory is resolved, but what's on disk only references the secrets
+	if modified.User[0].AuthCredential != "john-secret" || modified.User[1].AuthCredential != "jane-secret" {
+		t.Errorf("expected the secrets to be resolved, got: %#v, %#v", modified.User[0], modified.User[1])
+	}
+
+	fileBytes, _ := ioutil.ReadFile(path)
+	if bytes.Contains(fileBytes, []byte("john-secret")) || bytes.Contains(fileBytes, []byte("jane-secret")) {
+		t.Errorf("expected the file to not contain resolved secrets: %s", fileBytes)
+	}
+	if !bytes.Contains(fileBytes, []byte("secret/data/matrix-corporal#jane-password")) {
+		t.Errorf("expected the file to reference the secrets: %s", fileBytes)
+	}
+
+	// Restoring resolves the references again, picking up changed secrets
+	secretResolver["secret/data/matrix-corporal"]["john-password"] = "john-rotated-secret"
+
+	entries := createTestHistoryWithParser(t, path, nil, parser).List()
+	if len(entries) != 1 {
+		t.Fatalf("unexpected restored entries: %#v", entries)
+	}
+	if entries[0].Policy.User[0].AuthCredential != "john-rotated-secret" || entries[0].Policy.User[1].AuthCredential != "jane-secret" {
+		t.Errorf("expected the secrets to be resolved again, got: %#v, %#v", entries[0].Policy.User[0], entries[0].Policy.User[1])
+	}
+
+	// Entries which cannot be resolved (e.g. when Vault is unreachable) are dropped, without their ids getting reused
+	history = createTestHistoryWithParser(t, path, nil, createTestParser(t, testSecretResolver{}))
+	if len(history.List()) != 0 {
+		t.Errorf("expected the unresolvable entry to be dropped")
+	}
+	history.Add(&Policy{}, PolicySourceHttpApi)
+	if entries := history.List(); len(entries) != 1 || entries[0].ID != 2 {
+		t.Errorf("unexpected entries: %#v", entries)
+	}
+}
+
+func TestHistoryRejectsInvalidEncryptionKeys(t *testing.T) {
+	_, err := NewHistory(logrus.New(), 2, "", []byte("short"), nil)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestHistoryAppendsToTheFileAndCompactsIt(t *testing.T) {
+	directory, err := ioutil.TempDir("", "policy-history")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "history.json")
+
+	countLines := func() int {
+		fileBytes, _ := ioutil.ReadFile(path)
+		return bytes.Count(fileBytes, []byte("\n"))
+	}
+
+	// The history keeps 2 entries, so the file is compacted once it contains 4
+	history := createTestHistory(t, path, nil)
+	expectedLineCounts := []int{1, 2, 3, 4, 2, 3, 4, 2}
+	for i, expectedLineCount := range expectedLineCounts {
+		history.Add(&Policy{User: []*UserPolicy{{Id: fmt.Sprintf("@%d:example.com", i)}}}, PolicySourceHttpApi)
+
+		if lineCount := countLines(); lineCount != expectedLineCount {
+			t.Errorf("expected %d entries in the file after adding entry #%d, got %d", expectedLineCount, i+1, lineCount)
+		}
+	}
+
+	// A partially-appended entry (e.g. due to a crash) is ignored, with the file getting rewritten without it on the next write
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write([]byte(`{"id": 9, "polic`))
+	file.Close()
+
+	history = createTestHistory(t, path, nil)
+	entries := history.List()
+	if len(entries) != 2 || entries[1].ID != len(expectedLineCounts) {
+		t.Fatalf("unexpected restored entries: %#v", entries)
+	}
+
+	history.Add(&Policy{}, PolicySourceHttpApi)
+	if lineCount := countLines(); lineCount != 2 {
+		t.Errorf("expected the file to be rewritten with 2 entries, got %d", lineCount)
+	}
+
+	entries = createTestHistory(t, path, nil).List()
+	if len(entries) != 2 || entries[0].ID != len(expectedLineCounts) || entries[1].ID != len(expectedLineCounts)+1 {
+		t.Errorf("unexpected restored entries: %#v", entries)
+	}
+}
+
+func TestStoreRecordsConcurrentChangesInOrder(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	history, err := NewHistory(logger, 100, "", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store := NewStore(logger, NewValidator("example.com"), history)
+
+	createPolicy := func(i int) *Policy {
+		return &Policy{SchemaVerson: 1, User: []*UserPolicy{{Id: fmt.Sprintf("@%d:example.com", i), Active: true, AuthType: "plain", AuthCredential: "secret"}}}
+	}
+
+	// Modifying needs a policy to be there already
+	err = store.Set(createPolicy(0), PolicySourceHttpApi)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var waitGroup sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+
+			var err error
+			if i%2 == 0 {
+				err = store.Set(createPolicy(i), PolicySourceHttpApi)
+			} else {
+				err = store.Modify(func(current Policy) (*Policy, error) {
+					return createPolicy(i), nil
+				}, PolicySourceHttpApiUser, false)
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+
+	// Whatever order the changes happened in, the most recent history entry needs to be what's in the store
+	entries := history.List()
+	if entries[len(entries)-1].Policy.User[0].Id != store.Get().User[0].Id {
+		t.Errorf("expected the last history entry (%s) to be the current policy (%s)", entries[len(entries)-1].Policy.User[0].Id, store.Get().User[0].Id)
+	}
+}
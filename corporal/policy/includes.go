@@ -0,0 +1,383 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// includeFetchTimeout is how long fetching a single included document (over HTTP) is allowed to take
+	includeFetchTimeout = 30 * time.Second
+
+	// includeMaxRedirects is how many redirects are followed when fetching an included document (like net/http does by default)
+	includeMaxRedirects = 10
+)
+
+// SetIncludeRestrictions limits what policies may include (see resolveIncludes) to files within the given directories
+// and to URLs starting with the given prefixes (same scheme and host, with the path within the prefix's path).
+//
+// Without restrictions, policies loaded from providers may include anything, while pushed policies (see ParsePushedFormat) may include nothing.
+// Once restrictions are set, they apply to all policies.
+func (me *Parser) SetIncludeRestrictions(allowedDirectories []string, allowedUrlPrefixes []string) error {
+	directories := make([]string, 0, len(allowedDirectories))
+	for _, directory := range allowedDirectories {
+		resolvedDirectory, err := resolvePath(directory)
+		if err != nil {
+			return fmt.Errorf("failed resolving allowed include directory `%s`: %s", directory, err)
+		}
+		directories = append(directories, resolvedDirectory)
+	}
+
+	urlPrefixes := make([]*url.URL, 0, len(allowedUrlPrefixes))
+	for _, urlPrefix := range allowedUrlPrefixes {
+		parsedUrlPrefix, err := url.Parse(urlPrefix)
+		if err != nil {
+			return fmt.Errorf("failed parsing allowed include URL prefix `%s`: %s", urlPrefix, err)
+		}
+		if (parsedUrlPrefix.Scheme != "http" && parsedUrlPrefix.Scheme != "https") || parsedUrlPrefix.Host == "" {
+			return fmt.Errorf("allowed include URL prefix `%s` is not an absolute http:// or https:// URL", urlPrefix)
+		}
+		urlPrefixes = append(urlPrefixes, parsedUrlPrefix)
+	}
+
+	me.includeAllowedDirectories = directories
+	me.includeAllowedUrlPrefixes = urlPrefixes
+
+	// Allowed URLs could redirect elsewhere, so redirects need to stay within the allowed URL prefixes too.
+	me.httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= includeMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", includeMaxRedirects)
+		}
+		if !me.isIncludeUrlAllowed(req.URL) {
+			return fmt.Errorf("redirect to `%s` is not within any of the allowed include URL prefixes", req.URL)
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// WithIncludesForbidden returns a copy of the parser, which rejects policies making use of includes for the given reason
+func (me *Parser) WithIncludesForbidden(reason string) *Parser {
+	parser := *me
+	parser.includesForbiddenReason = reason
+	return &parser
+}
+
+func (me *Parser) hasIncludeRestrictions() bool {
+	return len(me.includeAllowedDirectories) != 0 || len(me.includeAllowedUrlPrefixes) != 0
+}
+
+// resolveIncludes fetches all documents referenced in the policy's `includes` field and merges them into the policy.
+//
+// Includes are merged in order, with the including (main) document merged last.
+// That is, later documents take precedence over earlier ones and the main document takes precedence over all includes.
+//
+// Merging works like this:
+//   - `users`, `hooks`, `rooms` and `powerLevelTemplates` are combined. Entries with the same `id` replace earlier ones.
+//   - `declaredRooms` are combined. Entries with the same `key` replace earlier ones.
+//   - `managedRoomIds` are combined.
+//   - objects (like `flags`) are merged key by key
+//   - anything else is replaced
+//
+// Included documents cannot include other documents.
+//
+// What may be included is subject to restrictions (see SetIncludeRestrictions).
+func (me *Parser) resolveIncludes(data []byte, isPushed bool) ([]byte, error) {
+	// Most policies don't make use of includes. Let's not pay the cost of decoding and re-encoding those.
+	if !bytes.Contains(data, []byte(`"includes"`)) {
+		return data, nil
+	}
+
+	document, err := decodeDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	includesInterface, exists := document["includes"]
+	if !exists {
+		return data, nil
+	}
+	delete(document, "includes")
+
+	includes, ok := includesInterface.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("`includes` is expected to be a list of paths or URLs")
+	}
+
+	if len(includes) != 0 && me.includesForbiddenReason != "" {
+		return nil, fmt.Errorf("`includes` cannot be used: %s", me.includesForbiddenReason)
+	}
+
+	merged := map[string]interface{}{}
+
+	for _, includeInterface := range includes {
+		include, ok := includeInterface.(string)
+		if !ok || include == "" {
+			return nil, fmt.Errorf("`includes` is expected to be a list of paths or URLs")
+		}
+
+		includedDocument, err := me.loadIncludedDocument(include, isPushed)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading included policy document `%s`: %s", include, err)
+		}
+
+		if _, exists := includedDocument["includes"]; exists {
+			return nil, fmt.Errorf("included policy document `%s` cannot include other documents", include)
+		}
+
+		mergeDocuments(merged, includedDocument)
+	}
+
+	mergeDocuments(merged, document)
+
+	return json.Marshal(merged)
+}
+
+func (me *Parser) loadIncludedDocument(include string, isPushed bool) (map[string]interface{}, error) {
+	if isPushed && !me.hasIncludeRestrictions() {
+		return nil, fmt.Errorf("policies pushed via the HTTP API can only include what the include restrictions allow, and none are configured")
+	}
+
+	var data []byte
+	var err error
+	var contentType string
+
+	if strings.HasPrefix(include, "http://") || strings.HasPrefix(include, "https://") {
+		data, contentType, err = me.fetchIncludedDocument(include)
+	} else {
+		data, err = me.readIncludedFile(include)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	format := DetectFormat(contentType, include)
+
+	documentBytes, err := convertToJSON(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	// Included documents are not any less important than the main one, so they need to be signed too (if signing is enabled).
+	payload, err := me.signatureVerifier.Verify(documentBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if format != FormatJSON && !bytes.Equal(payload, documentBytes) {
+		payload, err = convertToJSON(payload, format)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return decodeDocument(payload)
+}
+
+func (me *Parser) fetchIncludedDocument(uri string) ([]byte, string, error) {
+	if me.hasIncludeRestrictions() {
+		parsedUri, err := url.Parse(uri)
+		if err != nil {
+			return nil, "", err
+		}
+		if !me.isIncludeUrlAllowed(parsedUri) {
+			return nil, "", fmt.Errorf("URL is not within any of the allowed include URL prefixes")
+		}
+	}
+
+	resp, err := me.httpClient.Get(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("non-200 response fetching from URL: %d", resp.StatusCode)
+	}
+
+	data, err := ReadDocument(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed reading HTTP response body: %s", err)
+	}
+
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+func (me *Parser) readIncludedFile(path string) ([]byte, error) {
+	if me.hasIncludeRestrictions() {
+		// We check (and read) where symlinks lead to, so that they cannot be used for escaping the allowed directories.
+		resolvedPath, err := resolvePath(path)
+		if err != nil {
+			return nil, err
+		}
+		if !me.isIncludePathAllowed(resolvedPath) {
+			return nil, fmt.Errorf("file is not within any of the allowed include directories")
+		}
+		path = resolvedPath
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadDocument(file, "")
+}
+
+// isIncludePathAllowed tells whether the given (resolved, see resolvePath) path is within any of the allowed include directories
+func (me *Parser) isIncludePathAllowed(resolvedPath string) bool {
+	for _, directory := range me.includeAllowedDirectories {
+		relativePath, err := filepath.Rel(directory, resolvedPath)
+		if err != nil {
+			continue
+		}
+		if relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIncludeUrlAllowed tells whether the given URL starts with any of the allowed include URL prefixes.
+//
+// Prefixes are matched by scheme and host (which need to be the same) and by path segments,
+// so that `https://example.com/policies` allows neither `https://example.com.evil.com/policies/..`, nor `https://example.com/policies-other/..`.
+func (me *Parser) isIncludeUrlAllowed(uri *url.URL) bool {
+	// This also takes care of `..` segments (even percent-encoded ones, as those are decoded in uri.Path).
+	uriPath := path.Clean("/" + uri.Path)
+
+	for _, urlPrefix := range me.includeAllowedUrlPrefixes {
+		if uri.Scheme != urlPrefix.Scheme || !strings.EqualFold(uri.Host, urlPrefix.Host) {
+			continue
+		}
+
+		prefixPath := path.Clean("/" + urlPrefix.Path)
+		if prefixPath == "/" || uriPath == prefixPath || strings.HasPrefix(uriPath, prefixPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath turns the given path into an absolute one, with all symlinks resolved
+func resolvePath(path string) (string, error) {
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(absolutePath)
+}
+
+func decodeDocument(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Preserve numbers (schemaVersion, etc.) as they are
+	decoder.UseNumber()
+
+	var document map[string]interface{}
+	err := decoder.Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+// mergeDocuments merges the overlay policy document into the base one (see resolveIncludes).
+func mergeDocuments(base map[string]interface{}, overlay map[string]interface{}) {
+	for key, overlayValue := range overlay {
+		baseValue, exists := base[key]
+		if !exists {
+			base[key] = overlayValue
+			continue
+		}
+
+		switch key {
+		case "users", "hooks", "rooms", "powerLevelTemplates":
+			base[key] = mergeListsById(baseValue, overlayValue, "id")
+			continue
+		case "declaredRooms":
+			base[key] = mergeListsById(baseValue, overlayValue, "key")
+			continue
+		case "managedRoomIds":
+			base[key] = mergeListsByValue(baseValue, overlayValue)
+			continue
+		}
+
+		baseMap, baseIsMap := baseValue.(map[string]interface{})
+		overlayMap, overlayIsMap := overlayValue.(map[string]interface{})
+		if baseIsMap && overlayIsMap {
+			for subKey, subValue := range overlayMap {
+				baseMap[subKey] = subValue
+			}
+			continue
+		}
+
+		base[key] = overlayValue
+	}
+}
+
+func mergeListsById(base interface{}, overlay interface{}, idField string) interface{} {
+	baseList, baseIsList := base.([]interface{})
+	overlayList, overlayIsList := overlay.([]interface{})
+	if !baseIsList || !overlayIsList {
+		return overlay
+	}
+
+	result := make([]interface{}, 0, len(baseList)+len(overlayList))
+	idToIndexMap := make(map[string]int)
+
+	for _, list := range [][]interface{}{baseList, overlayList} {
+		for _, item := range list {
+			itemMap, _ := item.(map[string]interface{})
+			id, _ := itemMap[idField].(string)
+
+			if id != "" {
+				if existingIndex, exists := idToIndexMap[id]; exists {
+					result[existingIndex] = item
+					continue
+				}
+				idToIndexMap[id] = len(result)
+			}
+
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+func mergeListsByValue(base interface{}, overlay interface{}) interface{} {
+	baseList, baseIsList := base.([]interface{})
+	overlayList, overlayIsList := overlay.([]interface{})
+	if !baseIsList || !overlayIsList {
+		return overlay
+	}
+
+	result := make([]interface{}, 0, len(baseList)+len(overlayList))
+	seen := make(map[string]bool)
+
+	for _, list := range [][]interface{}{baseList, overlayList} {
+		for _, item := range list {
+			if itemString, ok := item.(string); ok {
+				if seen[itemString] {
+					continue
+				}
+				seen[itemString] = true
+			}
+
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
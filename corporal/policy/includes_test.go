@@ -0,0 +1,223 @@
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testIncludedDocument = `{"users": [{"id": "@included:example.com", "active": true}]}`
+
+func createTestIncludeParser(t *testing.T) *Parser {
+	signatureVerifier, err := NewSignatureVerifier(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return NewParser(signatureVerifier)
+}
+
+func createTestIncludingPolicy(include string) []byte {
+	return []byte(fmt.Sprintf(`{"schemaVersion": 1, "includes": [%q]}`, include))
+}
+
+func assertIncludedPolicy(t *testing.T, policy *Policy, err error) {
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(policy.User) != 1 || policy.User[0].Id != "@included:example.com" {
+		t.Errorf("expected the included document to be merged, got users: %#v", policy.User)
+	}
+}
+
+func TestIncludesOfProviderLoadedPoliciesAreUnrestrictedByDefault(t *testing.T) {
+	directory, err := ioutil.TempDir("", "policy-includes")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	includedPath := filepath.Join(directory, "users.json")
+	ioutil.WriteFile(includedPath, []byte(testIncludedDocument), 0600)
+
+	parser := createTestIncludeParser(t)
+
+	policy, err := parser.Parse(createTestIncludingPolicy(includedPath))
+	assertIncludedPolicy(t, policy, err)
+}
+
+func TestIncludesOfPushedPoliciesAreRejectedByDefault(t *testing.T) {
+	directory, err := ioutil.TempDir("", "policy-includes")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	includedPath := filepath.Join(directory, "users.json")
+	ioutil.WriteFile(includedPath, []byte(testIncludedDocument), 0600)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("did not expect a request for %s", r.URL)
+	}))
+	defer server.Close()
+
+	parser := createTestIncludeParser(t)
+
+	for _, include := range []string{includedPath, server.URL + "/users.json"} {
+		_, err := parser.ParsePushedFormat(createTestIncludingPolicy(include), FormatJSON)
+		if err == nil {
+			t.Errorf("expected including `%s` to be rejected", include)
+		}
+	}
+
+	// Pushed policies without includes are not affected
+	_, err = parser.ParsePushedFormat([]byte(`{"schemaVersion": 1}`), FormatJSON)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestIncludesAreRestrictedToAllowedDirectories(t *testing.T) {
+	directory, err := ioutil.TempDir("", "policy-includes")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	allowedDirectory := filepath.Join(directory, "allowed")
+	os.Mkdir(allowedDirectory, 0700)
+	os.Mkdir(filepath.Join(allowedDirectory, "team"), 0700)
+	os.Mkdir(filepath.Join(directory, "allowed-other"), 0700)
+
+	for _, path := range []string{"allowed/team/users.json", "allowed-other/users.json", "secret.json"} {
+		ioutil.WriteFile(filepath.Join(directory, path), []byte(testIncludedDocument), 0600)
+	}
+	os.Symlink(filepath.Join(directory, "secret.json"), filepath.Join(allowedDirectory, "link.json"))
+
+	parser := createTestIncludeParser(t)
+	err = parser.SetIncludeRestrictions([]string{allowedDirectory}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, isPushed := range []bool{false, true} {
+		policy, err := parser.parseFormat(createTestIncludingPolicy(filepath.Join(allowedDirectory, "team", "users.json")), FormatJSON, nil, isPushed)
+		assertIncludedPolicy(t, policy, err)
+
+		for _, include := range []string{
+			filepath.Join(directory, "secret.json"),
+			filepath.Join(allowedDirectory, "..", "secret.json"),
+			filepath.Join(directory, "allowed-other", "users.json"),
+			filepath.Join(allowedDirectory, "link.json"),
+		} {
+			_, err := parser.parseFormat(createTestIncludingPolicy(include), FormatJSON, nil, isPushed)
+			if err == nil {
+				t.Errorf("expected including `%s` to be rejected (pushed: %t)", include, isPushed)
+			}
+		}
+	}
+}
+
+func TestIncludesAreRestrictedToAllowedUrlPrefixes(t *testing.T) {
+	parser := createTestIncludeParser(t)
+	err := parser.SetIncludeRestrictions(nil, []string{"https://policies.example.com/matrix", "http://other.example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	type testData struct {
+		uri       string
+		isAllowed bool
+	}
+
+	tests := []testData{
+		{"https://policies.example.com/matrix", true},
+		{"https://policies.example.com/matrix/users.json", true},
+		{"https://POLICIES.example.com/matrix/team/users.json", true},
+		{"http://other.example.com/anything.json", true},
+
+		{"http://policies.example.com/matrix/users.json", false},
+		{"https://policies.example.com/matrix-other/users.json", false},
+		{"https://policies.example.com/matrix/../secret.json", false},
+		{"https://policies.example.com/matrix/%2e%2e/secret.json", false},
+		{"https://policies.example.com.evil.com/matrix/users.json", false},
+		{"https://policies.example.com@evil.com/matrix/users.json", false},
+		{"https://policies.example.com:8443/matrix/users.json", false},
+		{"https://other.example.com/anything.json", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.uri, func(t *testing.T) {
+			uri, err := url.Parse(test.uri)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			isAllowed := parser.isIncludeUrlAllowed(uri)
+			if isAllowed != test.isAllowed {
+				t.Errorf("expected allowed to be %t, got %t", test.isAllowed, isAllowed)
+			}
+		})
+	}
+}
+
+func TestIncludeRedirectsAreRestrictedToAllowedUrlPrefixes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/allowed/users.json":
+			w.Write([]byte(testIncludedDocument))
+		case "/allowed/moved.json":
+			http.Redirect(w, r, "/allowed/users.json", http.StatusFound)
+		case "/allowed/escape.json":
+			http.Redirect(w, r, "/internal/secret.json", http.StatusFound)
+		default:
+			t.Errorf("did not expect a request for %s", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	parser := createTestIncludeParser(t)
+	err := parser.SetIncludeRestrictions(nil, []string{server.URL + "/allowed/"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	policy, err := parser.ParsePushedFormat(createTestIncludingPolicy(server.URL+"/allowed/moved.json"), FormatJSON)
+	assertIncludedPolicy(t, policy, err)
+
+	for _, include := range []string{server.URL + "/allowed/escape.json", server.URL + "/internal/secret.json"} {
+		_, err := parser.ParsePushedFormat(createTestIncludingPolicy(include), FormatJSON)
+		if err == nil {
+			t.Errorf("expected including `%s` to be rejected", include)
+		}
+	}
+}
+
+func TestSetIncludeRestrictionsRejectsInvalidValues(t *testing.T) {
+	type testData struct {
+		name               string
+		allowedDirectories []string
+		allowedUrlPrefixes []string
+	}
+
+	tests := []testData{
+		{"missing directory", []string{"/non-existent/matrix-corporal/policies"}, nil},
+		{"relative URL", nil, []string{"/policies/"}},
+		{"non-HTTP URL", nil, []string{"file:///etc/"}},
+		{"URL without a host", nil, []string{"https:///policies/"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := createTestIncludeParser(t).SetIncludeRestrictions(test.allowedDirectories, test.allowedUrlPrefixes)
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PolicySourceLastKnownGoodCache is for policies which were restored from the last-known-good policy cache
+const PolicySourceLastKnownGoodCache = "last-known-good-cache"
+
+// LastKnownGoodCache persists the last policy that got loaded into the store to a local file (optionally encrypted),
+// so that it can be restored on startup, when the policy provider is unreachable.
+//
+// A restored policy is only served for up to maxStaleness (counted from when it was originally loaded).
+// After that, we'd rather refuse to serve than keep enforcing a policy that may be severely outdated (see IsServingTooStalePolicy).
+type LastKnownGoodCache struct {
+	logger        *logrus.Logger
+	store         *Store
+	parser        *Parser
+	path          string
+	encryptionKey []byte
+	maxStaleness  time.Duration
+
+	channel  chan *Policy
+	lockSave sync.Mutex
+
+	// restoredPolicy and restoredPolicySavedAt describe the policy we've restored (if any).
+	// We're serving it for as long as it's the one in the store.
+	restoredPolicy        *Policy
+	restoredPolicySavedAt time.Time
+	lockRestored          sync.RWMutex
+}
+
+type lastKnownGoodCacheEntry struct {
+	SavedAt time.Time       `json:"savedAt"`
+	Policy  json.RawMessage `json:"policy"`
+}
+
+// NewLastKnownGoodCache creates a new cache.
+// An empty path disables it. A nil encryptionKey means no encryption, otherwise it needs to be a 32-byte AES-256 key.
+// A maxStaleness of 0 means that restored policies are served regardless of their age.
+func NewLastKnownGoodCache(
+	logger *logrus.Logger,
+	store *Store,
+	parser *Parser,
+	path string,
+	encryptionKey []byte,
+	maxStaleness time.Duration,
+) (*LastKnownGoodCache, error) {
+	if encryptionKey != nil && len(encryptionKey) != 32 {
+		return nil, fmt.Errorf("the encryption key needs to be 32 bytes long, not %d", len(encryptionKey))
+	}
+
+	return &LastKnownGoodCache{
+		logger:        logger,
+		store:         store,
+		parser:        parser,
+		path:          path,
+		encryptionKey: encryptionKey,
+		maxStaleness:  maxStaleness,
+	}, nil
+}
+
+func (me *LastKnownGoodCache) IsEnabled() bool {
+	return me.path != ""
+}
+
+// Start makes the cache listen for new policies arriving to the store and persist them
+func (me *LastKnownGoodCache) Start() error {
+	if !me.IsEnabled() {
+		return nil
+	}
+
+	me.channel = me.store.GetNotificationChannel()
+	go me.listenOnChannel(me.channel)
+
+	return nil
+}
+
+func (me *LastKnownGoodCache) Stop() {
+	if me.channel != nil {
+		me.store.DestroyNotificationChannel(me.channel)
+	}
+}
+
+// Restore loads the cached policy into the store, unless it's more stale than allowed
+func (me *LastKnownGoodCache) Restore() error {
+	if !me.IsEnabled() {
+		return fmt.Errorf("the last-known-good policy cache is disabled")
+	}
+
+	entry, err := me.read()
+	if err != nil {
+		return err
+	}
+
+	if me.isTooStale(entry.SavedAt) {
+		return fmt.Errorf(
+			"the cached policy (saved at %s) is older than the maximum allowed staleness (%s)",
+			entry.SavedAt.UTC().Format(time.RFC3339),
+			me.maxStaleness,
+		)
+	}
+
+	// What we've cached is a re-serialized copy of a policy which had already been verified when it arrived,
+	// so there's no signature to verify here.
+	policy, err := me.parser.ParseWithoutSignatureVerification(entry.Policy)
+	if err != nil {
+		return fmt.Errorf("failed parsing cached policy: %s", err)
+	}
+
+	// Remembering it before it goes into the store, so that we don't persist it again (with a new timestamp) when notified about it.
+	me.lockRestored.Lock()
+	me.restoredPolicy = policy
+	me.restoredPolicySavedAt = entry.SavedAt
+	me.lockRestored.Unlock()
+
+	err = me.store.Set(policy, PolicySourceLastKnownGoodCache)
+	if err != nil {
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	me.logger.Warnf(
+		"Serving the last-known-good policy (saved at %s) until the policy provider manages to provide a newer one",
+		entry.SavedAt.UTC().Format(time.RFC3339),
+	)
+
+	return nil
+}
+
+// IsServingTooStalePolicy tells whether the policy in the store is a restored one, which has gotten too stale to be served
+func (me *LastKnownGoodCache) IsServingTooStalePolicy() bool {
+	if me == nil {
+		return false
+	}
+
+	me.lockRestored.RLock()
+	defer me.lockRestored.RUnlock()
+
+	if me.restoredPolicy == nil || me.store.Get() != me.restoredPolicy {
+		return false
+	}
+
+	return me.isTooStale(me.restoredPolicySavedAt)
+}
+
+func (me *LastKnownGoodCache) isTooStale(savedAt time.Time) bool {
+	if me.maxStaleness == 0 {
+		return false
+	}
+	return time.Since(savedAt) > me.maxStaleness
+}
+
+func (me *LastKnownGoodCache) listenOnChannel(channel chan *Policy) {
+	for {
+		policy, more := <-channel
+
+		if !more {
+			return
+		}
+
+		me.lockRestored.RLock()
+		isRestoredPolicy := policy == me.restoredPolicy
+		me.lockRestored.RUnlock()
+
+		if isRestoredPolicy {
+			continue
+		}
+
+		me.lockSave.Lock()
+
+		err := me.write(policy)
+		if err != nil {
+			me.logger.Warnf("Failed persisting policy to the last-known-good policy cache (%s): %s", me.path, err)
+		}
+
+		me.lockSave.Unlock()
+	}
+}
+
+func (me *LastKnownGoodCache) write(policy *Policy) error {
+	policyBytes, err := policy.MarshalWithSecretReferences()
+	if err != nil {
+		return err
+	}
+
+	entryBytes, err := json.Marshal(lastKnownGoodCacheEntry{
+		SavedAt: time.Now().UTC(),
+		Policy:  policyBytes,
+	})
+	if err != nil {
+		return err
+	}
+
+	if me.encryptionKey != nil {
+		entryBytes, err = encrypt(me.encryptionKey, entryBytes)
+		if err != nil {
+			return fmt.Errorf("failed encrypting: %s", err)
+		}
+	}
+
+	return writeFileAtomically(me.path, entryBytes)
+}
+
+func (me *LastKnownGoodCache) read() (*lastKnownGoodCacheEntry, error) {
+	entryBytes, err := ioutil.ReadFile(me.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if me.encryptionKey != nil {
+		entryBytes, err = decrypt(me.encryptionKey, entryBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed decrypting (is the encryption key right?): %s", err)
+		}
+	}
+
+	var entry lastKnownGoodCacheEntry
+	err = json.Unmarshal(entryBytes, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding (is it encrypted?): %s", err)
+	}
+
+	return &entry, nil
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LifecycleNotices contains server notices, which get sent to users (during reconciliation) when something happens to their account.
+// Unlike with ServerNotice, messages may contain placeholders (see LifecycleNotice.Render).
+type LifecycleNotices struct {
+	// AccountExpiring is sent once, when the user's account is about to expire (see UserPolicy.ExpiresAt and LifecycleNotice.SecondsBefore)
+	AccountExpiring *LifecycleNotice `json:"accountExpiring"`
+
+	// RoomRemoval is sent when an active user is made to leave a managed room, which they're no longer supposed to be in
+	RoomRemoval *LifecycleNotice `json:"roomRemoval"`
+
+	// Deprovisioning is sent right before the user gets deprovisioned (see Deprovisioning)
+	Deprovisioning *LifecycleNotice `json:"deprovisioning"`
+
+	// Welcome is sent once, after the user's account gets created (e.g. with onboarding instructions).
+	// It can be sent as a direct message instead of as a server notice (see LifecycleNotice.SenderUserId).
+	Welcome *LifecycleNotice `json:"welcome"`
+}
+
+func (me LifecycleNotices) Validate() error {
+	if me.AccountExpiring != nil {
+		err := me.AccountExpiring.Validate()
+		if err != nil {
+			return fmt.Errorf("`accountExpiring` is invalid: %s", err)
+		}
+
+		if me.AccountExpiring.SecondsBefore <= 0 {
+			return fmt.Errorf("`accountExpiring` needs a positive `secondsBefore` value")
+		}
+	}
+
+	if me.RoomRemoval != nil {
+		err := me.RoomRemoval.Validate()
+		if err != nil {
+			return fmt.Errorf("`roomRemoval` is invalid: %s", err)
+		}
+	}
+
+	if me.Deprovisioning != nil {
+		err := me.Deprovisioning.Validate()
+		if err != nil {
+			return fmt.Errorf("`deprovisioning` is invalid: %s", err)
+		}
+	}
+
+	if me.Welcome != nil {
+		err := me.Welcome.Validate()
+		if err != nil {
+			return fmt.Errorf("`welcome` is invalid: %s", err)
+		}
+	}
+
+	for name, notice := range map[string]*LifecycleNotice{"accountExpiring": me.AccountExpiring, "roomRemoval": me.RoomRemoval, "deprovisioning": me.Deprovisioning} {
+		if notice != nil && notice.SenderUserId != "" {
+			return fmt.Errorf("`%s` cannot have a `senderUserId` (only `welcome` can)", name)
+		}
+	}
+
+	return nil
+}
+
+// LifecycleNotice is a templated server notice (see LifecycleNotices)
+type LifecycleNotice struct {
+	// Message is the plain-text message to deliver. It may contain placeholders (see Render).
+	Message string `json:"message"`
+
+	// SecondsBefore specifies how long before the event the notice is sent (only for LifecycleNotices.AccountExpiring)
+	SecondsBefore int64 `json:"secondsBefore"`
+
+	// SenderUserId (if set) is a user (e.g. a bot) on the managed homeserver, who sends the notice as a direct message,
+	// instead of it being sent as a server notice (only for LifecycleNotices.Welcome).
+	SenderUserId string `json:"senderUserId"`
+}
+
+func (me LifecycleNotice) Validate() error {
+	if me.Message == "" {
+		return fmt.Errorf("no message")
+	}
+
+	if me.SecondsBefore < 0 {
+		return fmt.Errorf("`secondsBefore` cannot be negative")
+	}
+
+	return nil
+}
+
+func (me LifecycleNotice) GetTimeBefore() time.Duration {
+	return time.Duration(me.SecondsBefore) * time.Second
+}
+
+// Render returns the message with placeholders (e.g. `{userId}`) replaced by the given values (e.g. `"userId": "@john:example.com"`)
+func (me LifecycleNotice) Render(values map[string]string) string {
+	replacements := make([]string, 0, 2*len(values))
+	for key, value := range values {
+		replacements = append(replacements, "{"+key+"}", value)
+	}
+	return strings.NewReplacer(replacements...).Replace(me.Message)
+}
+
+// GetLifecycleNotices returns the lifecycle notices (see LifecycleNotices), which are all disabled by default
+func (me *Policy) GetLifecycleNotices() LifecycleNotices {
+	if me.LifecycleNotices == nil {
+		return LifecycleNotices{}
+	}
+	return *me.LifecycleNotices
+}
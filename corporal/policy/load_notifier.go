@@ -0,0 +1,265 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// loadNotifierQueueSize specifies how many reports may be waiting to be delivered, before we start dropping new ones
+const loadNotifierQueueSize = 100
+
+// LoadReporter gets told about policy loads (successful or not)
+type LoadReporter interface {
+	ReportLoadSuccess(source string, previous *Policy, current *Policy)
+	ReportLoadFailure(source string, err error)
+	ReportLoadFailureAlert(source string, err error, consecutiveFailures int)
+}
+
+// LoadReport is a summary of a policy load attempt, as delivered to webhooks
+type LoadReport struct {
+	Source     string    `json:"source"`
+	Success    bool      `json:"success"`
+	Error      *string   `json:"error"`
+	OccurredAt time.Time `json:"occurredAt"`
+
+	// Alert is only populated for failures which have reached a policy provider's alert threshold
+	Alert *LoadFailureAlert `json:"alert"`
+
+	// The fields below are only populated for successful loads
+
+	IdentificationStamp *string          `json:"identificationStamp"`
+	SizeBytes           int              `json:"sizeBytes"`
+	UserCount           int              `json:"userCount"`
+	Diff                *PolicyDiffStats `json:"diff"`
+}
+
+type LoadFailureAlert struct {
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+}
+
+// PolicyDiffStats tells how a newly-loaded policy differs from the previous one
+type PolicyDiffStats struct {
+	UsersAdded            int `json:"usersAdded"`
+	UsersRemoved          int `json:"usersRemoved"`
+	UsersChanged          int `json:"usersChanged"`
+	ManagedRoomIdsAdded   int `json:"managedRoomIdsAdded"`
+	ManagedRoomIdsRemoved int `json:"managedRoomIdsRemoved"`
+}
+
+type loadNotifierItem struct {
+	source     string
+	previous   *Policy
+	current    *Policy
+	err        error
+	occurredAt time.Time
+
+	consecutiveFailures int
+}
+
+// LoadNotifier is a LoadReporter, which POSTs a LoadReport to each of the configured webhook URLs.
+//
+// Reports are delivered in order, from a single goroutine, so that reporting never slows down policy loading.
+type LoadNotifier struct {
+	logger                   *logrus.Logger
+	webhookUrls              []string
+	authorizationBearerToken string
+	httpClient               *http.Client
+
+	queue       chan loadNotifierItem
+	stopChannel chan struct{}
+}
+
+func NewLoadNotifier(
+	logger *logrus.Logger,
+	webhookUrls []string,
+	authorizationBearerToken string,
+	timeout time.Duration,
+) *LoadNotifier {
+	return &LoadNotifier{
+		logger:                   logger,
+		webhookUrls:              webhookUrls,
+		authorizationBearerToken: authorizationBearerToken,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+
+		queue:       make(chan loadNotifierItem, loadNotifierQueueSize),
+		stopChannel: make(chan struct{}),
+	}
+}
+
+func (me *LoadNotifier) Start() error {
+	go me.deliver()
+	return nil
+}
+
+func (me *LoadNotifier) Stop() {
+	close(me.stopChannel)
+}
+
+func (me *LoadNotifier) ReportLoadSuccess(source string, previous *Policy, current *Policy) {
+	me.enqueue(loadNotifierItem{
+		source:     source,
+		previous:   previous,
+		current:    current,
+		occurredAt: time.Now().UTC(),
+	})
+}
+
+func (me *LoadNotifier) ReportLoadFailure(source string, err error) {
+	me.enqueue(loadNotifierItem{
+		source:     source,
+		err:        err,
+		occurredAt: time.Now().UTC(),
+	})
+}
+
+func (me *LoadNotifier) ReportLoadFailureAlert(source string, err error, consecutiveFailures int) {
+	me.enqueue(loadNotifierItem{
+		source:     source,
+		err:        err,
+		occurredAt: time.Now().UTC(),
+
+		consecutiveFailures: consecutiveFailures,
+	})
+}
+
+func (me *LoadNotifier) enqueue(item loadNotifierItem) {
+	select {
+	case me.queue <- item:
+	default:
+		me.logger.Warnf("Dropping policy load report (source: %s), as too many are waiting to be delivered", item.source)
+	}
+}
+
+func (me *LoadNotifier) deliver() {
+	for {
+		select {
+		case <-me.stopChannel:
+			return
+		case item := <-me.queue:
+			report := buildLoadReport(item)
+
+			for _, webhookUrl := range me.webhookUrls {
+				err := me.send(webhookUrl, report)
+				if err != nil {
+					me.logger.Warnf("Failed delivering policy load report to %s: %s", webhookUrl, err)
+				}
+			}
+		}
+	}
+}
+
+func (me *LoadNotifier) send(webhookUrl string, report LoadReport) error {
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", webhookUrl, bytes.NewReader(reportBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if me.authorizationBearerToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", me.authorizationBearerToken))
+	}
+
+	resp, err := me.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("non-2xx response: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func buildLoadReport(item loadNotifierItem) LoadReport {
+	report := LoadReport{
+		Source:     item.source,
+		Success:    item.err == nil,
+		OccurredAt: item.occurredAt,
+	}
+
+	if item.err != nil {
+		errorMessage := item.err.Error()
+		report.Error = &errorMessage
+
+		if item.consecutiveFailures > 0 {
+			report.Alert = &LoadFailureAlert{
+				ConsecutiveFailures: item.consecutiveFailures,
+			}
+		}
+
+		return report
+	}
+
+	report.IdentificationStamp = item.current.IdentificationStamp
+	report.UserCount = len(item.current.User)
+	report.Diff = computePolicyDiffStats(item.previous, item.current)
+
+	policyBytes, err := json.Marshal(item.current)
+	if err == nil {
+		report.SizeBytes = len(policyBytes)
+	}
+
+	return report
+}
+
+// computePolicyDiffStats compares two policies. A nil previous policy means that everything is new.
+func computePolicyDiffStats(previous *Policy, current *Policy) *PolicyDiffStats {
+	stats := &PolicyDiffStats{}
+
+	previousUsers := make(map[string]*UserPolicy)
+	previousManagedRoomIds := make(map[string]bool)
+	if previous != nil {
+		for _, userPolicy := range previous.User {
+			previousUsers[userPolicy.Id] = userPolicy
+		}
+		for _, roomId := range previous.ManagedRoomIds {
+			previousManagedRoomIds[roomId] = true
+		}
+	}
+
+	currentUserIds := make(map[string]bool)
+	for _, userPolicy := range current.User {
+		currentUserIds[userPolicy.Id] = true
+
+		previousUserPolicy, existed := previousUsers[userPolicy.Id]
+		if !existed {
+			stats.UsersAdded++
+		} else if !reflect.DeepEqual(previousUserPolicy, userPolicy) {
+			stats.UsersChanged++
+		}
+	}
+	for userId := range previousUsers {
+		if !currentUserIds[userId] {
+			stats.UsersRemoved++
+		}
+	}
+
+	currentManagedRoomIds := make(map[string]bool)
+	for _, roomId := range current.ManagedRoomIds {
+		currentManagedRoomIds[roomId] = true
+		if !previousManagedRoomIds[roomId] {
+			stats.ManagedRoomIdsAdded++
+		}
+	}
+	for roomId := range previousManagedRoomIds {
+		if !currentManagedRoomIds[roomId] {
+			stats.ManagedRoomIdsRemoved++
+		}
+	}
+
+	return stats
+}
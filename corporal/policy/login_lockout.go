@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"fmt"
+	"time"
+)
+
+// Defaults for LoginLockout fields that are left undefined
+const (
+	defaultLoginLockoutSeconds              = 60
+	defaultLoginLockoutMaxSeconds           = 3600
+	defaultLoginLockoutFailureWindowSeconds = 900
+)
+
+// LoginLockout controls brute-force protection for the logins of managed users, which matrix-corporal authenticates by itself
+// (and which the homeserver's own ratelimiting never sees failing).
+//
+// After too many failed attempts for a user (or from an IP address), further attempts get rejected for a while,
+// without even getting checked. Each failure after that (once the lockout is over) doubles the lockout's duration, up to MaxLockoutSeconds.
+type LoginLockout struct {
+	// MaxFailedAttemptsPerUser is how many failed attempts for the same user are tolerated, before the user gets locked out (0 disables this)
+	MaxFailedAttemptsPerUser int `json:"maxFailedAttemptsPerUser"`
+
+	// MaxFailedAttemptsPerIp is how many failed attempts from the same IP address are tolerated, before the IP address gets locked out (0 disables this)
+	MaxFailedAttemptsPerIp int `json:"maxFailedAttemptsPerIp"`
+
+	// LockoutSeconds is how long the first lockout lasts (defaults to 60)
+	LockoutSeconds int `json:"lockoutSeconds"`
+
+	// MaxLockoutSeconds is how long lockouts (which double with each subsequent failure) can last at most (defaults to 3600)
+	MaxLockoutSeconds int `json:"maxLockoutSeconds"`
+
+	// FailureWindowSeconds is how long failed attempts are remembered for (after the last failure or lockout) (defaults to 900)
+	FailureWindowSeconds int `json:"failureWindowSeconds"`
+}
+
+func (me LoginLockout) Validate() error {
+	if me.MaxFailedAttemptsPerUser < 0 {
+		return fmt.Errorf("`maxFailedAttemptsPerUser` cannot be negative")
+	}
+	if me.MaxFailedAttemptsPerIp < 0 {
+		return fmt.Errorf("`maxFailedAttemptsPerIp` cannot be negative")
+	}
+	if me.LockoutSeconds < 0 {
+		return fmt.Errorf("`lockoutSeconds` cannot be negative")
+	}
+	if me.MaxLockoutSeconds < 0 {
+		return fmt.Errorf("`maxLockoutSeconds` cannot be negative")
+	}
+	if me.FailureWindowSeconds < 0 {
+		return fmt.Errorf("`failureWindowSeconds` cannot be negative")
+	}
+
+	if me.GetMaxLockoutDuration() < me.GetLockoutDuration() {
+		return fmt.Errorf("`maxLockoutSeconds` cannot be smaller than `lockoutSeconds`")
+	}
+
+	return nil
+}
+
+func (me LoginLockout) GetLockoutDuration() time.Duration {
+	if me.LockoutSeconds == 0 {
+		return defaultLoginLockoutSeconds * time.Second
+	}
+	return time.Duration(me.LockoutSeconds) * time.Second
+}
+
+func (me LoginLockout) GetMaxLockoutDuration() time.Duration {
+	if me.MaxLockoutSeconds == 0 {
+		return defaultLoginLockoutMaxSeconds * time.Second
+	}
+	return time.Duration(me.MaxLockoutSeconds) * time.Second
+}
+
+func (me LoginLockout) GetFailureWindow() time.Duration {
+	if me.FailureWindowSeconds == 0 {
+		return defaultLoginLockoutFailureWindowSeconds * time.Second
+	}
+	return time.Duration(me.FailureWindowSeconds) * time.Second
+}
@@ -0,0 +1,77 @@
+package policy
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+)
+
+// Orphaned room modes (see OrphanedRooms.Mode)
+const (
+	// OrphanedRoomModeLeaveAlone makes orphaned rooms be forgotten about (left as they are)
+	OrphanedRoomModeLeaveAlone = "leave_alone"
+
+	// OrphanedRoomModeRemoveManagedUsers makes managed users leave orphaned rooms, while everyone else stays
+	OrphanedRoomModeRemoveManagedUsers = "remove_managed_users"
+
+	// OrphanedRoomModeArchive makes everyone (but the matrix-corporal user) get kicked out of orphaned rooms
+	// and makes their aliases get deleted. See OrphanedRooms.Delete.
+	OrphanedRoomModeArchive = "archive"
+)
+
+var knownOrphanedRoomModes = []string{
+	OrphanedRoomModeLeaveAlone,
+	OrphanedRoomModeRemoveManagedUsers,
+	OrphanedRoomModeArchive,
+}
+
+// OrphanedRooms controls what happens to rooms which are no longer managed (which have disappeared from Policy.ManagedRoomIds).
+//
+// Rooms which were managed as of the last (full) reconciliation run are recorded (in the matrix-corporal user's account data),
+// so that orphaned rooms can be told apart. Each orphaned room gets handled once (during the run which finds out about it)
+// and is forgotten about afterwards. Upgraded rooms (replaced by their successors, see Policy.WithRoomUpgradesResolved) are not considered orphaned.
+type OrphanedRooms struct {
+	// Mode is one of the OrphanedRoomMode* constants (defaults to OrphanedRoomModeLeaveAlone)
+	Mode string `json:"mode"`
+
+	// Delete makes archived rooms (see OrphanedRoomModeArchive) get deleted (purged) via the homeserver's admin API,
+	// instead of only getting emptied out. This cannot be undone.
+	Delete bool `json:"delete"`
+}
+
+func (me OrphanedRooms) Validate() error {
+	if me.Mode != "" && !util.IsStringInArray(me.Mode, knownOrphanedRoomModes) {
+		return fmt.Errorf("`%s` is an unknown mode", me.Mode)
+	}
+
+	if me.Delete && me.Mode != OrphanedRoomModeArchive {
+		return fmt.Errorf("`delete` can only be used with the `%s` mode", OrphanedRoomModeArchive)
+	}
+
+	return nil
+}
+
+// GetOrphanedRoomMode returns what happens to rooms which are no longer managed (see OrphanedRooms.Mode)
+func (me *Policy) GetOrphanedRoomMode() string {
+	if me.OrphanedRooms == nil || me.OrphanedRooms.Mode == "" {
+		return OrphanedRoomModeLeaveAlone
+	}
+	return me.OrphanedRooms.Mode
+}
+
+// IsOrphanedRoomHandlingEnabled tells whether anything is to happen to rooms which are no longer managed,
+// which requires the managed rooms to be tracked across reconciliation runs.
+func (me *Policy) IsOrphanedRoomHandlingEnabled() bool {
+	return me.GetOrphanedRoomMode() != OrphanedRoomModeLeaveAlone
+}
+
+// GetManagedRoomIdsResolved returns the ids of the managed rooms, without references to declared rooms (see DeclaredRoom),
+// which are yet to be created (or yet to be resolved, see WithDeclaredRoomsResolved).
+func (me *Policy) GetManagedRoomIdsResolved() []string {
+	roomIds := make([]string, 0, len(me.ManagedRoomIds))
+	for _, roomId := range me.ManagedRoomIds {
+		if !IsDeclaredRoomReference(roomId) {
+			roomIds = append(roomIds, roomId)
+		}
+	}
+	return roomIds
+}
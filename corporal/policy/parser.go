@@ -0,0 +1,208 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Parser turns raw policy documents (as fetched by policy providers or pushed to the HTTP API) into Policy objects.
+type Parser struct {
+	signatureVerifier *SignatureVerifier
+
+	// httpClient is used for fetching included documents (see resolveIncludes)
+	httpClient *http.Client
+
+	// secretResolver is used for resolving secret references (see resolveSecrets)
+	secretResolver SecretResolver
+
+	// includeAllowedDirectories and includeAllowedUrlPrefixes restrict what policies may include (see SetIncludeRestrictions)
+	includeAllowedDirectories []string
+	includeAllowedUrlPrefixes []*url.URL
+
+	// includesForbiddenReason, when set, makes policies making use of includes get rejected (see WithIncludesForbidden)
+	includesForbiddenReason string
+}
+
+func NewParser(signatureVerifier *SignatureVerifier) *Parser {
+	return &Parser{
+		signatureVerifier: signatureVerifier,
+
+		httpClient: &http.Client{
+			Timeout: includeFetchTimeout,
+		},
+	}
+}
+
+// VerifiesSignatures tells whether policy signing is enabled, in which case only signed policy documents get parsed
+func (me *Parser) VerifiesSignatures() bool {
+	return me.signatureVerifier.Enabled()
+}
+
+// Parse verifies the policy document's signature (if signing is enabled) and decodes it.
+func (me *Parser) Parse(data []byte) (*Policy, error) {
+	return me.ParseFormat(data, FormatJSON)
+}
+
+// ParseFormat is like Parse, but for policy documents of any of the supported formats (see the `Format*` constants).
+//
+// Signed envelopes (see SignedEnvelope) may be written in any of these formats too.
+// Their payload is expected to be in the same format as the envelope itself.
+func (me *Parser) ParseFormat(data []byte, format string) (*Policy, error) {
+	return me.parseFormat(data, format, nil, false)
+}
+
+// ParsePushedFormat is like ParseFormat, but for policy documents pushed to the HTTP API.
+//
+// Unlike policy providers (which the administrator configures), whoever pushes policies is not necessarily trusted
+// with reading local files or making requests on matrix-corporal's behalf.
+// Pushed policies can therefore only include what the include restrictions allow (see SetIncludeRestrictions) - nothing, by default.
+//
+// The resulting policy remembers the pushed document (see PushedDocuments), so that it can be parsed (and verified) again later on.
+func (me *Parser) ParsePushedFormat(data []byte, format string) (*Policy, error) {
+	policy, err := me.parseFormat(data, format, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	policy.pushedDocuments = []PushedDocument{{Data: data, Format: format}}
+
+	return policy, nil
+}
+
+// ParseBundledFormat is like ParseFormat, but for policy documents which ship along with their assets (see resolveAssets).
+func (me *Parser) ParseBundledFormat(data []byte, format string, assetReader AssetReader) (*Policy, error) {
+	return me.parseFormat(data, format, assetReader, false)
+}
+
+func (me *Parser) parseFormat(data []byte, format string, assetReader AssetReader, isPushed bool) (*Policy, error) {
+	document, err := convertToJSON(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := me.signatureVerifier.Verify(document)
+	if err != nil {
+		return nil, err
+	}
+
+	if format != FormatJSON && !bytes.Equal(payload, document) {
+		// We've unwrapped a signed envelope. Its payload is still in the original format.
+		payload, err = convertToJSON(payload, format)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err = me.resolveIncludes(payload, isPushed)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, secretReferences, err := me.resolveSecrets(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err = resolveAssets(payload, assetReader)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := me.decode(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	policy.secretReferences = secretReferences
+
+	return policy, nil
+}
+
+// ParseUserPolicy is like ParseFormat, but for a document containing a single user policy (as opposed to a whole policy).
+//
+// Signing, secret references and computed fields work the same way as for whole policies.
+// Global flag expressions are not taken into account though.
+func (me *Parser) ParseUserPolicy(data []byte, format string) (*UserPolicy, error) {
+	document, err := convertToJSON(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := me.signatureVerifier.Verify(document)
+	if err != nil {
+		return nil, err
+	}
+
+	if format != FormatJSON && !bytes.Equal(payload, document) {
+		payload, err = convertToJSON(payload, format)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payload, secretReferences, err := me.resolveSecrets(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Expressions get evaluated on whole policy documents, so we wrap the user policy in one.
+	wrapped, err := json.Marshal(map[string]interface{}{
+		"users": []json.RawMessage{payload},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := me.decode(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(policy.User) != 1 || policy.User[0] == nil {
+		return nil, fmt.Errorf("expected a single user policy")
+	}
+
+	policy.User[0].secretReferences = secretReferences
+
+	return policy.User[0], nil
+}
+
+// ParseWithoutSignatureVerification decodes a policy document which matrix-corporal itself had persisted locally.
+//
+// Policies get verified once, when they arrive through a provider or the HTTP API.
+// What we store on disk afterwards is a re-serialized (and therefore unsigned) copy, so verifying it again is impossible.
+//
+// Such copies reference secrets instead of containing them (see Policy.MarshalWithSecretReferences), so these get resolved again.
+func (me *Parser) ParseWithoutSignatureVerification(data []byte) (*Policy, error) {
+	data, secretReferences, err := me.resolveSecrets(data)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := me.decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	policy.secretReferences = secretReferences
+
+	return policy, nil
+}
+
+func (me *Parser) decode(data []byte) (*Policy, error) {
+	data, err := evaluatePolicyExpressions(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	err = json.Unmarshal(data, &policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
@@ -2,8 +2,13 @@ package policy
 
 import (
 	"devture-matrix-corporal/corporal/hook"
+	"devture-matrix-corporal/corporal/totp"
 	"devture-matrix-corporal/corporal/userauth"
+	"devture-matrix-corporal/corporal/util"
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
 )
 
 type Policy struct {
@@ -18,13 +23,216 @@ type Policy struct {
 	// matches the previous one.
 	IdentificationStamp *string `json:"identificationStamp"`
 
+	// ExpiresAt tells until when this policy is to be considered fresh.
+	// If no newer policy gets loaded by then, a degraded mode kicks in (see FreshnessGuard).
+	ExpiresAt *time.Time `json:"expiresAt"`
+
+	// MaxAgeSeconds tells for how long (after being loaded) this policy is to be considered fresh.
+	// It works like ExpiresAt, but is relative to the time the policy got loaded.
+	MaxAgeSeconds *int64 `json:"maxAgeSeconds"`
+
 	Flags PolicyFlags `json:"flags"`
 
 	Hooks []*hook.Hook `json:"hooks"`
 
 	ManagedRoomIds []string `json:"managedRoomIds"`
 
+	// Rooms contains additional settings for some (or all) of the managed rooms.
+	Rooms []*RoomPolicy `json:"rooms"`
+
+	// RoomAliasNamespace is a localpart prefix (e.g. `corporal-`) for room aliases, which are considered to be managed by the policy.
+	// Aliases in this namespace, which point to a managed room but are not listed in its policy (see RoomPolicy.Aliases), get removed.
+	// When empty, no aliases get removed.
+	RoomAliasNamespace string `json:"roomAliasNamespace"`
+
+	// OrphanedRooms controls what happens to rooms which are no longer listed in ManagedRoomIds (see OrphanedRooms).
+	// When nil, such rooms are left alone.
+	OrphanedRooms *OrphanedRooms `json:"orphanedRooms"`
+
+	// AutoJoinRooms contains rooms (ids or aliases), which users get joined to once, right after their account gets created.
+	// Unlike managed rooms (see UserPolicy.JoinedRoomIds), membership in such rooms is not enforced afterwards: users are free to leave them.
+	AutoJoinRooms []string `json:"autoJoinRooms"`
+
+	// DeclaredRooms contains rooms, which the reconciler creates (if they don't exist yet).
+	// See DeclaredRoom.
+	DeclaredRooms []*DeclaredRoom `json:"declaredRooms"`
+
+	// PowerLevelTemplates contains power levels (roles), which users can be given in the managed rooms they're joined to.
+	// See UserPolicy.PowerLevelTemplates.
+	PowerLevelTemplates []*PowerLevelTemplate `json:"powerLevelTemplates"`
+
+	// ServerAcl is a server ACL baseline, which applies to all managed rooms (unless overriden in Rooms).
+	ServerAcl *RoomServerAcl `json:"serverAcl"`
+
 	User []*UserPolicy `json:"users"`
+
+	// ServerNotices contains announcements, which are to be delivered to users via the homeserver's server notices feature.
+	ServerNotices []*ServerNotice `json:"serverNotices"`
+
+	// LifecycleNotices contains server notices, which get sent to users when something happens to their account.
+	LifecycleNotices *LifecycleNotices `json:"lifecycleNotices"`
+
+	// Deprovisioning controls what happens to inactive users (and possibly to users removed from the policy).
+	// When nil, inactive users get deactivated (see DeprovisioningModeDeactivate).
+	Deprovisioning *Deprovisioning `json:"deprovisioning"`
+
+	// AccountCleanup controls the deactivation of guest and unmanaged accounts (see AccountCleanup).
+	// When nil, accounts which are not part of the policy are left alone.
+	AccountCleanup *AccountCleanup `json:"accountCleanup"`
+
+	// LoginLockout controls brute-force protection for the logins of managed users (see LoginLockout).
+	// When nil, failed login attempts have no consequences.
+	LoginLockout *LoginLockout `json:"loginLockout"`
+
+	// UserIdMigrations contains users which are to be moved from one user id to another (see UserIdMigration).
+	UserIdMigrations []*UserIdMigration `json:"userIdMigrations"`
+
+	// UnmanagedUserDefaults controls what applies to authenticated users which are not part of the policy.
+	// When nil (or for fields left undefined), the usual rules for unmanaged users apply.
+	UnmanagedUserDefaults *UnmanagedUserDefaults `json:"unmanagedUserDefaults"`
+
+	// readOnlyEnforced tells whether all managed users are to be treated as read-only, regardless of their policy.
+	// This is never part of the policy document. See WithReadOnlyEnforced.
+	readOnlyEnforced bool
+
+	// pushedDocuments are the documents pushed to the HTTP API, which this policy was parsed from (see PushedDocuments)
+	pushedDocuments []PushedDocument
+
+	// secretReferences maps values resolved from secret references to the references themselves (see MarshalWithSecretReferences)
+	secretReferences map[string]string
+}
+
+// GetExpirationTime tells when the policy (loaded at the given time) stops being fresh,
+// based on ExpiresAt and MaxAgeSeconds (whichever comes first).
+// A nil value means that the policy never expires.
+func (me *Policy) GetExpirationTime(loadedAt time.Time) *time.Time {
+	var expirationTime *time.Time
+
+	if me.ExpiresAt != nil {
+		expiresAt := *me.ExpiresAt
+		expirationTime = &expiresAt
+	}
+
+	if me.MaxAgeSeconds != nil {
+		maxAgeExpirationTime := loadedAt.Add(time.Duration(*me.MaxAgeSeconds) * time.Second)
+		if expirationTime == nil || maxAgeExpirationTime.Before(*expirationTime) {
+			expirationTime = &maxAgeExpirationTime
+		}
+	}
+
+	return expirationTime
+}
+
+// WithReadOnlyEnforced returns a copy of the policy, which treats all managed users as read-only.
+// This is used when the policy has expired (see FreshnessGuard).
+func (me Policy) WithReadOnlyEnforced() Policy {
+	me.readOnlyEnforced = true
+	return me
+}
+
+// WithUserPolicy returns a copy of the policy, in which the given user policy replaces the one with the same id (if any).
+//
+// The copy is no longer what the policy's pushed documents (if any) parse to, so it has none (see WithPushedUserPolicy).
+func (me Policy) WithUserPolicy(userPolicy *UserPolicy) Policy {
+	users := make([]*UserPolicy, 0, len(me.User)+1)
+	for _, existingUserPolicy := range me.User {
+		if existingUserPolicy.Id != userPolicy.Id {
+			users = append(users, existingUserPolicy)
+		}
+	}
+	me.User = append(users, userPolicy)
+	me.pushedDocuments = nil
+
+	if len(userPolicy.secretReferences) != 0 {
+		secretReferences := make(map[string]string, len(me.secretReferences)+len(userPolicy.secretReferences))
+		for value, reference := range me.secretReferences {
+			secretReferences[value] = reference
+		}
+		for value, reference := range userPolicy.secretReferences {
+			secretReferences[value] = reference
+		}
+		me.secretReferences = secretReferences
+	}
+
+	return me
+}
+
+// WithSecondFactorsRedacted returns a copy of the policy, in which users' TOTP secrets and backup code hashes are blanked out,
+// so that the policy can be shown without making it possible to generate codes for users.
+func (me Policy) WithSecondFactorsRedacted() Policy {
+	users := make([]*UserPolicy, 0, len(me.User))
+	for _, userPolicy := range me.User {
+		if userPolicy.TotpSecret != "" || len(userPolicy.BackupCodeHashes) != 0 {
+			redactedUserPolicy := *userPolicy
+			redactedUserPolicy.TotpSecret = ""
+			redactedUserPolicy.BackupCodeHashes = nil
+			userPolicy = &redactedUserPolicy
+		}
+		users = append(users, userPolicy)
+	}
+	me.User = users
+	return me
+}
+
+// withRoomIdsResolved returns a copy of the policy, with all room ids (managed rooms, room policies, joined rooms, etc.)
+// replaced by what resolveRoomId returns for them.
+//
+// Room ids which don't resolve are dropped, except for room policies' ids (the room policy is kept as it is then).
+// Resolving multiple room ids to the same room id doesn't make lists contain the same room id more than once.
+func (me Policy) withRoomIdsResolved(resolveRoomId func(roomId string) (string, bool)) Policy {
+	resolveRoomIds := func(roomIds []string) []string {
+		if roomIds == nil {
+			return nil
+		}
+		resolvedRoomIds := make([]string, 0, len(roomIds))
+		for _, roomId := range roomIds {
+			resolvedRoomId, ok := resolveRoomId(roomId)
+			if !ok || util.IsStringInArray(resolvedRoomId, resolvedRoomIds) {
+				continue
+			}
+			resolvedRoomIds = append(resolvedRoomIds, resolvedRoomId)
+		}
+		return resolvedRoomIds
+	}
+
+	me.ManagedRoomIds = resolveRoomIds(me.ManagedRoomIds)
+
+	rooms := make([]*RoomPolicy, 0, len(me.Rooms))
+	for _, roomPolicy := range me.Rooms {
+		roomId, ok := resolveRoomId(roomPolicy.Id)
+		if !ok {
+			rooms = append(rooms, roomPolicy)
+			continue
+		}
+
+		roomPolicyCopy := *roomPolicy
+		roomPolicyCopy.Id = roomId
+		roomPolicyCopy.ChildRoomIds = resolveRoomIds(roomPolicy.ChildRoomIds)
+		rooms = append(rooms, &roomPolicyCopy)
+	}
+	me.Rooms = rooms
+
+	powerLevelTemplates := make([]*PowerLevelTemplate, 0, len(me.PowerLevelTemplates))
+	for _, template := range me.PowerLevelTemplates {
+		templateCopy := *template
+		templateCopy.RoomIds = resolveRoomIds(template.RoomIds)
+		if len(template.RoomIds) != 0 && len(templateCopy.RoomIds) == 0 {
+			// An empty list means "all managed rooms", which is not what a template for rooms which didn't resolve is about
+			continue
+		}
+		powerLevelTemplates = append(powerLevelTemplates, &templateCopy)
+	}
+	me.PowerLevelTemplates = powerLevelTemplates
+
+	users := make([]*UserPolicy, 0, len(me.User))
+	for _, userPolicy := range me.User {
+		userPolicyCopy := *userPolicy
+		userPolicyCopy.JoinedRoomIds = resolveRoomIds(userPolicy.JoinedRoomIds)
+		users = append(users, &userPolicyCopy)
+	}
+	me.User = users
+
+	return me
 }
 
 func (me *Policy) GetManagedUserIds() []string {
@@ -44,6 +252,105 @@ func (me *Policy) GetUserPolicyByUserId(userId string) *UserPolicy {
 	return nil
 }
 
+// GetUserPolicyByUserIdIgnoringCase finds the user policy whose id matches the given one, ignoring case differences.
+// Exact matches are preferred, in case multiple user policies only differ by case.
+func (me *Policy) GetUserPolicyByUserIdIgnoringCase(userId string) *UserPolicy {
+	var match *UserPolicy
+	for _, userPolicy := range me.User {
+		if userPolicy.Id == userId {
+			return userPolicy
+		}
+		if match == nil && strings.EqualFold(userPolicy.Id, userId) {
+			match = userPolicy
+		}
+	}
+	return match
+}
+
+func (me *Policy) GetRoomPolicyByRoomId(roomId string) *RoomPolicy {
+	for _, roomPolicy := range me.Rooms {
+		if roomPolicy.Id == roomId {
+			return roomPolicy
+		}
+	}
+	return nil
+}
+
+// GetEffectiveRoomPolicy returns the room policy that applies to a managed room,
+// taking into account policy-level settings (like ServerAcl), which apply to all managed rooms.
+// nil is returned for rooms that are not managed.
+func (me *Policy) GetEffectiveRoomPolicy(roomId string) *RoomPolicy {
+	if !util.IsStringInArray(roomId, me.ManagedRoomIds) {
+		return nil
+	}
+
+	roomPolicy := RoomPolicy{Id: roomId}
+	if explicitRoomPolicy := me.GetRoomPolicyByRoomId(roomId); explicitRoomPolicy != nil {
+		roomPolicy = *explicitRoomPolicy
+	}
+
+	if roomPolicy.ServerAcl == nil {
+		roomPolicy.ServerAcl = me.ServerAcl
+	}
+
+	templatedUserPowerLevels := me.getTemplatedUserPowerLevelsForRoomId(roomId)
+	if len(templatedUserPowerLevels) != 0 {
+		userPowerLevels := map[string]int64{}
+		for userId, powerLevel := range templatedUserPowerLevels {
+			userPowerLevels[userId] = powerLevel
+		}
+		// Explicit room policy power levels take precedence over templated ones.
+		for userId, powerLevel := range roomPolicy.UserPowerLevels {
+			userPowerLevels[userId] = powerLevel
+		}
+		if roomPolicy.PowerLevels != nil {
+			for userId := range roomPolicy.PowerLevels.Users {
+				delete(userPowerLevels, userId)
+			}
+		}
+		roomPolicy.UserPowerLevels = userPowerLevels
+	}
+
+	return &roomPolicy
+}
+
+// IsRoomAliasInNamespace tells whether the given room alias (e.g. `#corporal-room:example.com`) is in the alias namespace (see RoomAliasNamespace)
+func (me *Policy) IsRoomAliasInNamespace(alias string) bool {
+	return me.RoomAliasNamespace != "" && strings.HasPrefix(alias, fmt.Sprintf("#%s", me.RoomAliasNamespace))
+}
+
+// GetHooksForUserId returns all hooks that apply to requests authenticated as the given user.
+//
+// Hooks attached to the user's policy come first, followed by the global hooks.
+// An empty userId (unauthenticated requests) only gets the global hooks.
+func (me *Policy) GetHooksForUserId(userId string) []*hook.Hook {
+	if userId == "" {
+		return me.Hooks
+	}
+
+	userPolicy := me.GetUserPolicyByUserId(userId)
+	if userPolicy == nil || len(userPolicy.Hooks) == 0 {
+		return me.Hooks
+	}
+
+	hooks := make([]*hook.Hook, 0, len(userPolicy.Hooks)+len(me.Hooks))
+	hooks = append(hooks, userPolicy.Hooks...)
+	hooks = append(hooks, me.Hooks...)
+
+	return hooks
+}
+
+// GetUserPolicyByExternalId finds the user policy having the given external identifier (see UserPolicy.ExternalIds).
+func (me *Policy) GetUserPolicyByExternalId(idType string, id string) *UserPolicy {
+	for _, userPolicy := range me.User {
+		externalId, exists := userPolicy.ExternalIds[idType]
+		if exists && externalId == id {
+			return userPolicy
+		}
+	}
+	return nil
+}
+
 type PolicyFlags struct {
 	// AllowCustomUserDisplayNames tells whether users are allowed to have display names,
 	// which deviate from the ones in the policy.
@@ -53,6 +360,10 @@ type PolicyFlags struct {
 	// which deviate from the ones in the policy.
 	AllowCustomUserAvatars bool `json:"allowCustomUserAvatars"`
 
+	// AllowCustomUserThreePids tells whether users are allowed to have 3pids which are not listed in their policy (see UserPolicy.ThreePids).
+	// When allowed, reconciliation only adds the missing 3pids and doesn't remove the others.
+	AllowCustomUserThreePids bool `json:"allowCustomUserThreePids"`
+
 	// AllowCustomPassthroughUserPasswords tells if managed users of AuthType=UserAuthTypePassthrough can change their password.
 	// This is possible, because their password is stored and managed on the actual homeserver.
 	// We can let password-changing requests go through.
@@ -83,12 +394,192 @@ type PolicyFlags struct {
 	// Enabling this may have security implications.
 	// With this setting enabled, you're completely skipping matrix-corporal's login checks (`active` flag in the user policy, etc).
 	Allow3pidLogin bool `json:"allow3pidLogin"`
+
+	// Forbid3pidChanges tells whether managed users are forbidden from adding, removing, binding or unbinding 3pids (email addresses, phone numbers).
+	// When there's a dedicated `UserPolicy` for the user, that one takes precedence over this default.
+	// Unmanaged users are not affected by this.
+	Forbid3pidChanges bool `json:"forbid3pidChanges"`
+
+	// ReadOnly tells whether managed users are forbidden from sending events (messages, state, redactions, reactions, etc.).
+	// Reading (syncing, fetching messages, etc.) is still allowed.
+	// When there's a dedicated `UserPolicy` for the user, that one takes precedence over this default.
+	// Unmanaged users are not affected by this.
+	ReadOnly bool `json:"readOnly"`
+
+	// AllowedRoomVersions contains the list of room versions that managed users are allowed to create rooms with (or upgrade rooms to).
+	// An empty list means that there are no restrictions.
+	// When there's a dedicated `UserPolicy` for the user, that one takes precedence over this default.
+	// Unmanaged users are not affected by this.
+	AllowedRoomVersions []string `json:"allowedRoomVersions"`
+
+	// MaxDeviceIdleDays specifies after how many days of not being seen managed users' devices get deleted during reconciliation.
+	// Zero means that idle devices are left alone.
+	// When there's a dedicated `UserPolicy` for the user, that one takes precedence over this default.
+	MaxDeviceIdleDays int `json:"maxDeviceIdleDays"`
+}
+
+// ServerNotice is an announcement, which gets delivered to users (during reconciliation) via the homeserver's server notices feature.
+type ServerNotice struct {
+	// ID uniquely identifies this notice and serves as a deduplication key.
+	// Each notice is delivered to each user at most once, so changing the ID causes re-delivery.
+	ID string `json:"id"`
+
+	// Message is the plain-text message to deliver.
+	Message string `json:"message"`
+
+	// TargetUserIds contains the list of (managed) users to deliver the notice to.
+	// An empty list means all active managed users.
+	TargetUserIds []string `json:"targetUserIds"`
+}
+
+func (me ServerNotice) Validate() error {
+	if me.ID == "" {
+		return fmt.Errorf("server notice has no id")
+	}
+
+	if me.Message == "" {
+		return fmt.Errorf("server notice #%s has no message", me.ID)
+	}
+
+	return nil
+}
+
+func (me ServerNotice) IsTargetingUserId(userId string) bool {
+	if len(me.TargetUserIds) == 0 {
+		return true
+	}
+
+	for _, targetUserId := range me.TargetUserIds {
+		if targetUserId == userId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnmanagedUserDefaults holds settings that apply to authenticated users, which are not part of the policy (unmanaged users).
+//
+// Each field takes precedence over the corresponding global PolicyFlags field (for flags which apply to everyone),
+// or lifts the "unmanaged users are not affected" exemption (for flags which only apply to managed users).
+// Undefined (nil) fields keep the default behavior for unmanaged users.
+type UnmanagedUserDefaults struct {
+	// ForbidRoomCreation tells whether unmanaged users are forbidden from creating rooms.
+	ForbidRoomCreation *bool `json:"forbidRoomCreation"`
+
+	// ForbidEncryptedRoomCreation tells whether unmanaged users are forbidden from creating encrypted rooms, and from switching rooms from unencrypted to encrypted.
+	ForbidEncryptedRoomCreation *bool `json:"forbidEncryptedRoomCreation"`
+
+	// ForbidUnencryptedRoomCreation tells whether unmanaged users are forbidden from creating unencrypted rooms.
+	ForbidUnencryptedRoomCreation *bool `json:"forbidUnencryptedRoomCreation"`
+
+	// Forbid3pidChanges tells whether unmanaged users are forbidden from adding, removing, binding or unbinding 3pids (email addresses, phone numbers).
+	Forbid3pidChanges *bool `json:"forbid3pidChanges"`
+
+	// ReadOnly tells whether unmanaged users are forbidden from sending events.
+	ReadOnly *bool `json:"readOnly"`
+
+	// AllowedRoomVersions contains the list of room versions that unmanaged users are allowed to create rooms with (or upgrade rooms to).
+	// A nil value or an empty list means that there are no restrictions.
+	AllowedRoomVersions []string `json:"allowedRoomVersions"`
+
+	// AllowedRoutes contains regular expressions, at least one of which the path of each request (see hook.HookMatchRuleTypeURLPath)
+	// made by an unmanaged user needs to match. Requests to other routes are rejected.
+	// A nil value means that there are no restrictions, while an empty list forbids everything.
+	AllowedRoutes         []string `json:"allowedRoutes"`
+	allowedRoutesCompiled []*regexp.Regexp
+
+	// RateLimit limits how many requests each unmanaged user can make.
+	// A nil value means that there are no limits.
+	RateLimit *UnmanagedUserRateLimit `json:"rateLimit"`
+}
+
+func (me *UnmanagedUserDefaults) Validate() error {
+	err := me.ensureInitialized()
+	if err != nil {
+		return fmt.Errorf("an allowed route is invalid: %s", err)
+	}
+
+	if me.RateLimit != nil {
+		err := me.RateLimit.Validate()
+		if err != nil {
+			return fmt.Errorf("the rate limit is invalid: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// IsRouteAllowed tells whether unmanaged users can make requests to the given path (see AllowedRoutes)
+func (me *UnmanagedUserDefaults) IsRouteAllowed(path string) bool {
+	if me.AllowedRoutes == nil {
+		return true
+	}
+
+	err := me.ensureInitialized()
+	if err != nil {
+		// This should have been caught during policy validation.
+		// Now there's nothing we can do but fail hard.
+		panic(err)
+	}
+
+	for _, regex := range me.allowedRoutesCompiled {
+		if regex.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (me *UnmanagedUserDefaults) ensureInitialized() error {
+	if me.allowedRoutesCompiled != nil || me.AllowedRoutes == nil {
+		return nil
+	}
+
+	allowedRoutesCompiled := make([]*regexp.Regexp, 0, len(me.AllowedRoutes))
+	for _, route := range me.AllowedRoutes {
+		regex, err := regexp.Compile(route)
+		if err != nil {
+			return fmt.Errorf("%s: %s", route, err)
+		}
+		allowedRoutesCompiled = append(allowedRoutesCompiled, regex)
+	}
+	me.allowedRoutesCompiled = allowedRoutesCompiled
+
+	return nil
+}
+
+// UnmanagedUserRateLimit limits how many requests an unmanaged user can make (per user, not across all of them).
+//
+// Each user can make Burst requests in a row, after which they can make RequestsPerSecond requests per second
+// (or fewer, if they aren't spread out evenly).
+type UnmanagedUserRateLimit struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+
+	Burst int `json:"burst"`
+}
+
+func (me UnmanagedUserRateLimit) Validate() error {
+	if me.RequestsPerSecond <= 0 {
+		return fmt.Errorf("`requestsPerSecond` needs to be a positive number")
+	}
+
+	if me.Burst <= 0 {
+		return fmt.Errorf("`burst` needs to be a positive number")
+	}
+
+	return nil
 }
 
 type UserPolicy struct {
 	Id     string `json:"id"`
 	Active bool   `json:"active"`
 
+	// ExpiresAt tells when this user's account expires (making the user inactive, as if Active were false).
+	// A nil value means that the account doesn't expire.
+	ExpiresAt *time.Time `json:"expiresAt"`
+
 	// AuthType's value is supposed to be one the `UserAuthType*` constants
 	AuthType string `json:"authType"`
 
@@ -101,11 +592,68 @@ type UserPolicy struct {
 	// Subsequent changes to AuthCredential (after the user account has been created) are not reflected.
 	AuthCredential string `json:"authCredential"`
 
+	// Require2fa tells whether logging in also requires a second factor (a TOTP code or a backup code, see TotpSecret and BackupCodeHashes),
+	// once the user has been authenticated against AuthCredential. It cannot be used with UserAuthTypePassthrough.
+	Require2fa bool `json:"require2fa"`
+
+	// TotpSecret is the (base32-encoded) TOTP secret (see RFC 6238), which the user's authenticator app generates codes with
+	TotpSecret string `json:"totpSecret"`
+
+	// BackupCodeHashes contains the hashes (see totp.HashBackupCode) of this user's single-use backup codes,
+	// which can be used instead of TOTP codes
+	BackupCodeHashes []string `json:"backupCodeHashes"`
+
 	DisplayName string `json:"displayName"`
 	AvatarUri   string `json:"avatarUri"`
 
 	JoinedRoomIds []string `json:"joinedRoomIds"`
 
+	// Hooks contains hooks which only apply to requests authenticated as this user.
+	// These run before the global policy hooks (see Policy.GetHooksForUserId).
+	Hooks []*hook.Hook `json:"hooks"`
+
+	// ExternalIds maps identifier types (e.g. `ldapDn`, `scimId`, `employeeNumber`) to this user's identifier in that external system.
+	// matrix-corporal doesn't do anything with these besides letting them be resolved (in both directions) via the HTTP API.
+	ExternalIds map[string]string `json:"externalIds"`
+
+	// PowerLevelTemplates contains the ids of power level templates (see Policy.PowerLevelTemplates) that apply to this user.
+	PowerLevelTemplates []string `json:"powerLevelTemplates"`
+
+	// ThreePids contains the (verified) email addresses and phone numbers that this user's account should have.
+	// A nil value means that the user's 3pids are not managed by us and are left untouched.
+	// A non-nil value (even an empty list) causes 3pids to be added or removed during reconciliation, so that they match.
+	ThreePids []UserThreePid `json:"threePids"`
+
+	// PushRules contains the push rules that this user is to have (see PushRuleIdPrefix).
+	// A nil value means that the user's push rules are not managed by us and are left untouched.
+	// A non-nil value (even an empty list) causes managed push rules to be created, updated or deleted during reconciliation, so that they match.
+	PushRules []*UserPushRule `json:"pushRules"`
+
+	// AccountData contains account data entries (global or per-room) that this user is to have.
+	// Entries are applied during reconciliation (see AccountDataModeMerge and AccountDataModeOverwrite).
+	// Account data of other types is left untouched.
+	AccountData []*UserAccountData `json:"accountData"`
+
+	// MaxDeviceIdleDays specifies after how many days of not being seen this user's devices get deleted during reconciliation.
+	// A nil value means the global `MaxDeviceIdleDays` flag applies, while zero means that idle devices are left alone.
+	MaxDeviceIdleDays *int `json:"maxDeviceIdleDays"`
+
+	// RestrictToManagedRooms tells whether this user is only allowed to join (or knock on) the rooms listed in JoinedRoomIds.
+	RestrictToManagedRooms bool `json:"restrictToManagedRooms"`
+
+	// ServerAdmin tells whether this user is to be a homeserver administrator.
+	// A nil value means that the user's admin status is not managed by us and is left untouched.
+	ServerAdmin *bool `json:"serverAdmin"`
+
+	// UserType is the Synapse user type (one of the `UserType*` constants) that this user's account is to have.
+	// Users of special types (like bots) are not counted as monthly active users.
+	// A nil value means that the user type is not managed by us and is left untouched, while an empty one means a regular user.
+	UserType *string `json:"userType"`
+
+	// ShadowBanned tells whether this user is to be shadow-banned: their requests appear to succeed, but their events are not sent to anyone.
+	// A nil value means that the user's shadow-ban status is not managed by us and is left untouched.
+	ShadowBanned *bool `json:"shadowBanned"`
+
 	// ForbidRoomCreation tells whether this user is forbidden from creating rooms.
 	ForbidRoomCreation *bool `json:"forbidRoomCreation"`
 
@@ -114,6 +662,29 @@ type UserPolicy struct {
 
 	// ForbidUnencryptedRoomCreation tells whether this user is forbidden from creating unencrypted rooms.
 	ForbidUnencryptedRoomCreation *bool `json:"forbidUnencryptedRoomCreation"`
+
+	// Forbid3pidChanges tells whether this user is forbidden from adding, removing, binding or unbinding 3pids (email addresses, phone numbers).
+	Forbid3pidChanges *bool `json:"forbid3pidChanges"`
+
+	// ReadOnly tells whether this user is forbidden from sending events (messages, state, redactions, reactions, etc.).
+	ReadOnly *bool `json:"readOnly"`
+
+	// AllowedRoomVersions contains the list of room versions that this user is allowed to create rooms with (or upgrade rooms to).
+	// A nil value means the global `AllowedRoomVersions` flag applies, while an empty list means that there are no restrictions.
+	AllowedRoomVersions []string `json:"allowedRoomVersions"`
+
+	// secretReferences is like Policy.secretReferences, for user policies parsed on their own (see Parser.ParseUserPolicy).
+	// It gets merged into the policy's own, once the user policy becomes part of one (see Policy.WithUserPolicy).
+	secretReferences map[string]string
+}
+
+// IsActive tells whether the user is to be active right now (see Active and ExpiresAt)
+func (me UserPolicy) IsActive() bool {
+	return me.IsActiveAt(time.Now())
+}
+
+func (me UserPolicy) IsActiveAt(t time.Time) bool {
+	return me.Active && (me.ExpiresAt == nil || t.Before(*me.ExpiresAt))
 }
 
 func (me UserPolicy) Validate() error {
@@ -125,5 +696,122 @@ func (me UserPolicy) Validate() error {
 		return fmt.Errorf("`%s` is an invalid auth type", me.AuthType)
 	}
 
+	if me.Require2fa && me.AuthType == userauth.UserAuthTypePassthrough {
+		return fmt.Errorf("`require2fa` cannot be used with the `%s` auth type, as authentication happens at the homeserver", userauth.UserAuthTypePassthrough)
+	}
+
+	if me.TotpSecret != "" {
+		_, err := totp.DecodeSecret(me.TotpSecret)
+		if err != nil {
+			return fmt.Errorf("`totpSecret` is invalid: %s", err)
+		}
+	}
+
+	for idx, backupCodeHash := range me.BackupCodeHashes {
+		if !totp.IsValidBackupCodeHash(backupCodeHash) {
+			return fmt.Errorf("backup code hash at index `%d` is not a hex-encoded SHA-256 hash", idx)
+		}
+	}
+
+	for idType, id := range me.ExternalIds {
+		if idType == "" || id == "" {
+			return fmt.Errorf("external ids need to have a non-empty type and value (found `%s` = `%s`)", idType, id)
+		}
+	}
+
+	if me.MaxDeviceIdleDays != nil && *me.MaxDeviceIdleDays < 0 {
+		return fmt.Errorf("`maxDeviceIdleDays` cannot be negative")
+	}
+
+	if me.UserType != nil && *me.UserType != "" && *me.UserType != UserTypeBot && *me.UserType != UserTypeSupport {
+		return fmt.Errorf("`%s` is an invalid user type", *me.UserType)
+	}
+
+	threePidKeys := make(map[string]bool)
+	for _, threePid := range me.ThreePids {
+		err := threePid.Validate()
+		if err != nil {
+			return err
+		}
+
+		key := threePid.Key()
+		if threePidKeys[key] {
+			return fmt.Errorf("3pid `%s` (%s) is specified more than once", threePid.Address, threePid.Medium)
+		}
+		threePidKeys[key] = true
+	}
+
+	pushRuleIds := make(map[string]bool)
+	for _, pushRule := range me.PushRules {
+		err := pushRule.Validate()
+		if err != nil {
+			return err
+		}
+
+		if pushRuleIds[pushRule.Id] {
+			return fmt.Errorf("push rule `%s` is specified more than once", pushRule.Id)
+		}
+		pushRuleIds[pushRule.Id] = true
+	}
+
+	accountDataKeys := make(map[string]bool)
+	for _, accountData := range me.AccountData {
+		err := accountData.Validate()
+		if err != nil {
+			return err
+		}
+
+		key := accountData.Key()
+		if accountDataKeys[key] {
+			return fmt.Errorf("account data of type `%s` is specified more than once (for the same room)", accountData.Type)
+		}
+		accountDataKeys[key] = true
+	}
+
 	return nil
 }
+
+const (
+	UserTypeBot     = "bot"
+	UserTypeSupport = "support"
+)
+
+const (
+	ThreePidMediumEmail  = "email"
+	ThreePidMediumMsisdn = "msisdn"
+)
+
+// UserThreePid is a third-party identifier (an email address or a phone number) associated with a user account.
+type UserThreePid struct {
+	// Medium's value is supposed to be one of the `ThreePidMedium*` constants
+	Medium string `json:"medium"`
+
+	// Address is an email address (for ThreePidMediumEmail)
+	// or a phone number in international format, without a leading `+` (for ThreePidMediumMsisdn).
+	Address string `json:"address"`
+}
+
+func (me UserThreePid) Validate() error {
+	if me.Medium != ThreePidMediumEmail && me.Medium != ThreePidMediumMsisdn {
+		return fmt.Errorf("`%s` is an invalid 3pid medium", me.Medium)
+	}
+
+	if me.Address == "" {
+		return fmt.Errorf("3pid (%s) has no address", me.Medium)
+	}
+
+	return nil
+}
+
+// Key returns a value which uniquely identifies this 3pid.
+// Email addresses are compared case-insensitively (homeservers store them lowercased).
+func (me UserThreePid) Key() string {
+	return ThreePidKey(me.Medium, me.Address)
+}
+
+func ThreePidKey(medium string, address string) string {
+	if medium == ThreePidMediumEmail {
+		address = strings.ToLower(address)
+	}
+	return fmt.Sprintf("%s:%s", medium, address)
+}
@@ -0,0 +1,385 @@
+package policy
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	RoomStateEventTypePowerLevels = "m.room.power_levels"
+)
+
+// PowerLevelTemplate describes a power level (role), which users referencing the template (see UserPolicy.PowerLevelTemplates)
+// automatically get in rooms they're joined to (see UserPolicy.JoinedRoomIds).
+//
+// Example: "community leads get power level 50 in all community rooms".
+type PowerLevelTemplate struct {
+	Id string `json:"id"`
+
+	// PowerLevel is the (minimum) power level that users get.
+	PowerLevel int64 `json:"powerLevel"`
+
+	// RoomIds restricts the template to some of the managed rooms.
+	// An empty list means all managed rooms.
+	RoomIds []string `json:"roomIds"`
+}
+
+func (me PowerLevelTemplate) Validate() error {
+	if me.Id == "" {
+		return fmt.Errorf("power level template has no id")
+	}
+
+	if me.PowerLevel <= 0 {
+		return fmt.Errorf("power level template #%s needs to have a positive power level", me.Id)
+	}
+
+	return nil
+}
+
+func (me PowerLevelTemplate) IsForRoomId(roomId string) bool {
+	if len(me.RoomIds) == 0 {
+		return true
+	}
+	return util.IsStringInArray(roomId, me.RoomIds)
+}
+
+func (me *Policy) GetPowerLevelTemplateById(id string) *PowerLevelTemplate {
+	for _, template := range me.PowerLevelTemplates {
+		if template.Id == id {
+			return template
+		}
+	}
+	return nil
+}
+
+// getTemplatedUserPowerLevelsForRoomId returns the power levels that active users get in the given room, due to power level templates.
+// If multiple templates apply to the same user, the highest power level wins.
+func (me *Policy) getTemplatedUserPowerLevelsForRoomId(roomId string) map[string]int64 {
+	userPowerLevels := map[string]int64{}
+
+	for _, userPolicy := range me.User {
+		if !userPolicy.IsActive() || !util.IsStringInArray(roomId, me.GetEffectiveJoinedRoomIds(userPolicy)) {
+			continue
+		}
+
+		for _, templateId := range userPolicy.PowerLevelTemplates {
+			template := me.GetPowerLevelTemplateById(templateId)
+			if template == nil || !template.IsForRoomId(roomId) {
+				continue
+			}
+
+			if template.PowerLevel > userPowerLevels[userPolicy.Id] {
+				userPowerLevels[userPolicy.Id] = template.PowerLevel
+			}
+		}
+	}
+
+	return userPowerLevels
+}
+
+// isPowerLevelsContentSatisfying tells whether the given `m.room.power_levels` state event content
+// gives each of the given users at least the given power level.
+func isPowerLevelsContentSatisfying(content map[string]interface{}, userPowerLevels map[string]int64) bool {
+	users, _ := content["users"].(map[string]interface{})
+
+	for userId, powerLevel := range userPowerLevels {
+		currentPowerLevel, exists := getStateEventContentInt64(users, userId)
+		if !exists {
+			currentPowerLevel, _ = getStateEventContentInt64(content, "users_default")
+		}
+
+		if currentPowerLevel < powerLevel {
+			return false
+		}
+	}
+
+	return true
+}
+
+// applyUserPowerLevelsToContent raises the power levels of the given users in the given `m.room.power_levels` state event content.
+// Everything else (including users having a higher power level already) is preserved.
+func applyUserPowerLevelsToContent(currentContent map[string]interface{}, userPowerLevels map[string]int64) map[string]interface{} {
+	currentUsers, _ := currentContent["users"].(map[string]interface{})
+
+	users := map[string]interface{}{}
+	for userId, powerLevel := range currentUsers {
+		users[userId] = powerLevel
+	}
+
+	for userId, powerLevel := range userPowerLevels {
+		currentPowerLevel, exists := getStateEventContentInt64(currentUsers, userId)
+		if exists && currentPowerLevel >= powerLevel {
+			continue
+		}
+		users[userId] = powerLevel
+	}
+
+	return copyStateEventContentWith(currentContent, "users", users)
+}
+
+// powerLevelsContentLevelKeys lists the (top-level) required power levels of a `m.room.power_levels` state event content,
+// along with the values that apply when they're missing
+var powerLevelsContentLevelKeys = map[string]int64{
+	"users_default":  0,
+	"events_default": 0,
+	"state_default":  50,
+	"ban":            50,
+	"kick":           50,
+	"redact":         50,
+	"invite":         0,
+}
+
+// RoomPowerLevels holds exact power level settings (`m.room.power_levels`) for a room.
+//
+// Unlike RoomPolicy.UserPowerLevels (which are minimums), these need to match exactly,
+// so drift in either direction (e.g. a room admin promoting someone further) gets corrected.
+// Settings which are not specified are left for room admins to decide.
+type RoomPowerLevels struct {
+	// Users maps user ids to the exact power level that they need to have.
+	// These take precedence over power level templates.
+	Users map[string]int64 `json:"users"`
+
+	// Events maps event types to the power level required for sending them.
+	Events map[string]int64 `json:"events"`
+
+	UsersDefault  *int64 `json:"usersDefault"`
+	EventsDefault *int64 `json:"eventsDefault"`
+	StateDefault  *int64 `json:"stateDefault"`
+	Ban           *int64 `json:"ban"`
+	Kick          *int64 `json:"kick"`
+	Redact        *int64 `json:"redact"`
+	Invite        *int64 `json:"invite"`
+}
+
+func (me RoomPowerLevels) Validate() error {
+	for userId := range me.Users {
+		if !strings.HasPrefix(userId, "@") {
+			return fmt.Errorf("`%s` is not a valid user id", userId)
+		}
+	}
+
+	for eventType := range me.Events {
+		if eventType == "" {
+			return fmt.Errorf("event power levels cannot contain an empty event type")
+		}
+	}
+
+	return nil
+}
+
+// getLevels returns the specified (top-level) required power levels, keyed by their `m.room.power_levels` content key
+func (me RoomPowerLevels) getLevels() map[string]int64 {
+	levels := map[string]int64{}
+
+	for key, value := range map[string]*int64{
+		"users_default":  me.UsersDefault,
+		"events_default": me.EventsDefault,
+		"state_default":  me.StateDefault,
+		"ban":            me.Ban,
+		"kick":           me.Kick,
+		"redact":         me.Redact,
+		"invite":         me.Invite,
+	} {
+		if value != nil {
+			levels[key] = *value
+		}
+	}
+
+	return levels
+}
+
+// IsSatisfiedBy tells whether the given `m.room.power_levels` state event content matches these settings exactly.
+func (me RoomPowerLevels) IsSatisfiedBy(content map[string]interface{}) bool {
+	for key, level := range me.getLevels() {
+		if getPowerLevelsContentLevel(content, key) != level {
+			return false
+		}
+	}
+
+	users, _ := content["users"].(map[string]interface{})
+	for userId, level := range me.Users {
+		currentLevel, exists := getStateEventContentInt64(users, userId)
+		if !exists {
+			currentLevel = getPowerLevelsContentLevel(content, "users_default")
+		}
+
+		if currentLevel != level {
+			return false
+		}
+	}
+
+	events, _ := content["events"].(map[string]interface{})
+	for eventType, level := range me.Events {
+		currentLevel, exists := getStateEventContentInt64(events, eventType)
+		if !exists || currentLevel != level {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ApplyToStateEventContent sets these settings in the given `m.room.power_levels` state event content.
+// Everything else is preserved.
+func (me RoomPowerLevels) ApplyToStateEventContent(currentContent map[string]interface{}) map[string]interface{} {
+	content := map[string]interface{}{}
+	for key, value := range currentContent {
+		content[key] = value
+	}
+
+	for key, level := range me.getLevels() {
+		content[key] = level
+	}
+
+	if len(me.Users) != 0 {
+		users := copyPowerLevelsContentMap(currentContent, "users")
+		for userId, level := range me.Users {
+			users[userId] = level
+		}
+		content["users"] = users
+	}
+
+	if len(me.Events) != 0 {
+		events := copyPowerLevelsContentMap(currentContent, "events")
+		for eventType, level := range me.Events {
+			events[eventType] = level
+		}
+		content["events"] = events
+	}
+
+	return content
+}
+
+// ConstrainPowerLevelsContentChangesForUser reverts changes (going from the current to the new `m.room.power_levels` state event content),
+// which the given user (the one sending the new content) cannot make or which would make the user lose power:
+//
+// - the user's own power level is never lowered (or raised - the homeserver doesn't allow that anyway)
+// - the power levels of other users, which are at or above the user's own level, are not changed and others are not raised above it
+// - required power levels (for sending events, kicking, etc.), which are (or would become) higher than the user's own level, are not changed
+//
+// These mirror the homeserver's authorization rules, so that the reconciler doesn't keep sending state events that get rejected
+// (or locks itself out of the room). The constrained content is returned, along with a description of each reverted change
+// and whether any change remains.
+func ConstrainPowerLevelsContentChangesForUser(
+	currentContent map[string]interface{},
+	newContent map[string]interface{},
+	userId string,
+) (map[string]interface{}, []string, bool) {
+	content := map[string]interface{}{}
+	for key, value := range newContent {
+		content[key] = value
+	}
+
+	var revertedChanges []string
+	hasChanges := false
+
+	currentUsers, _ := currentContent["users"].(map[string]interface{})
+	ownLevel, exists := getStateEventContentInt64(currentUsers, userId)
+	if !exists {
+		ownLevel = getPowerLevelsContentLevel(currentContent, "users_default")
+	}
+
+	for key := range powerLevelsContentLevelKeys {
+		currentLevel, currentExists := getStateEventContentInt64(currentContent, key)
+		newLevel, newExists := getStateEventContentInt64(content, key)
+		if currentExists == newExists && currentLevel == newLevel {
+			continue
+		}
+
+		if (currentExists && currentLevel > ownLevel) || (newExists && newLevel > ownLevel) {
+			revertStateEventContentKey(content, currentContent, key)
+			revertedChanges = append(revertedChanges, key)
+			continue
+		}
+		hasChanges = true
+	}
+
+	users := copyPowerLevelsContentMap(content, "users")
+	for _, affectedUserId := range getChangedPowerLevelsContentMapKeys(currentUsers, users) {
+		currentLevel, currentExists := getStateEventContentInt64(currentUsers, affectedUserId)
+		newLevel, newExists := getStateEventContentInt64(users, affectedUserId)
+
+		if affectedUserId == userId || (currentExists && currentLevel >= ownLevel) || (newExists && newLevel > ownLevel) {
+			revertStateEventContentKey(users, currentUsers, affectedUserId)
+			revertedChanges = append(revertedChanges, fmt.Sprintf("users.%s", affectedUserId))
+			continue
+		}
+		hasChanges = true
+	}
+	if _, exists := content["users"]; exists || len(users) != 0 {
+		content["users"] = users
+	}
+
+	currentEvents, _ := currentContent["events"].(map[string]interface{})
+	events := copyPowerLevelsContentMap(content, "events")
+	for _, eventType := range getChangedPowerLevelsContentMapKeys(currentEvents, events) {
+		currentLevel, currentExists := getStateEventContentInt64(currentEvents, eventType)
+		newLevel, newExists := getStateEventContentInt64(events, eventType)
+
+		if (currentExists && currentLevel > ownLevel) || (newExists && newLevel > ownLevel) {
+			revertStateEventContentKey(events, currentEvents, eventType)
+			revertedChanges = append(revertedChanges, fmt.Sprintf("events.%s", eventType))
+			continue
+		}
+		hasChanges = true
+	}
+	if _, exists := content["events"]; exists || len(events) != 0 {
+		content["events"] = events
+	}
+
+	return content, revertedChanges, hasChanges
+}
+
+// getPowerLevelsContentLevel returns a (top-level) required power level of a `m.room.power_levels` state event content,
+// taking into account the value that applies when it's missing.
+func getPowerLevelsContentLevel(content map[string]interface{}, key string) int64 {
+	level, exists := getStateEventContentInt64(content, key)
+	if !exists {
+		return powerLevelsContentLevelKeys[key]
+	}
+	return level
+}
+
+func copyPowerLevelsContentMap(content map[string]interface{}, key string) map[string]interface{} {
+	currentValues, _ := content[key].(map[string]interface{})
+
+	values := map[string]interface{}{}
+	for k, v := range currentValues {
+		values[k] = v
+	}
+	return values
+}
+
+// getChangedPowerLevelsContentMapKeys returns the (sorted) keys, whose power levels differ between the two maps (including added and removed ones)
+func getChangedPowerLevelsContentMapKeys(currentValues map[string]interface{}, newValues map[string]interface{}) []string {
+	var keys []string
+
+	for key := range currentValues {
+		currentLevel, _ := getStateEventContentInt64(currentValues, key)
+		newLevel, exists := getStateEventContentInt64(newValues, key)
+		if !exists || currentLevel != newLevel {
+			keys = append(keys, key)
+		}
+	}
+
+	for key := range newValues {
+		if _, exists := currentValues[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// revertStateEventContentKey makes the key have the current value again (or be missing, if it's currently missing)
+func revertStateEventContentKey(content map[string]interface{}, currentContent map[string]interface{}, key string) {
+	currentValue, exists := currentContent[key]
+	if !exists {
+		delete(content, key)
+		return
+	}
+	content[key] = currentValue
+}
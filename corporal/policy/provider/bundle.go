@@ -0,0 +1,480 @@
+package provider
+
+import (
+	"bytes"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// bundleCurrentLinkName is the name of the symlink (within the extract directory), which points to the directory of the currently-applied bundle
+	bundleCurrentLinkName = "current"
+
+	// bundleCachedArchiveName is the name of the file (within the extract directory), which holds the currently-applied bundle archive,
+	// exactly as it had been fetched. It lets us restore the bundle (verifying its signature again) when the remote is unavailable.
+	bundleCachedArchiveName = "bundle.archive"
+
+	// bundleDirectoryPrefix prefixes the names of the directories that bundles get unpacked to (within the extract directory)
+	bundleDirectoryPrefix = "bundle-"
+)
+
+// BundleProvider loads a policy out of an archive (tar, tar.gz or zip), which ships the policy document along with its assets
+// (avatar images, HTML templates for `respond` hooks, etc.).
+//
+// Each bundle gets unpacked into a directory of its own, so that a half-unpacked or broken bundle never replaces a good one.
+// Assets referenced by the policy (see policy.AssetReader) get read out of the bundle's directory while parsing the policy,
+// so a policy is always applied together with the assets it was shipped with.
+type BundleProvider struct {
+	store                    *policy.Store
+	parser                   *policy.Parser
+	uri                      string
+	format                   string
+	policyPath               string
+	extractPath              string
+	authorizationBearerToken string
+	jwtSigner                *httpJwtSigner
+	reloadIntervalSeconds    *int
+	reloadPollingPolicy      pollingPolicy
+	logger                   *logrus.Logger
+
+	httpClient   *http.Client
+	reloadPoller *poller
+	lockLoad     sync.Mutex
+
+	// lastArchiveHash holds the SHA-256 hash of the last bundle archive we've successfully applied
+	lastArchiveHash []byte
+
+	signatureRequirement *providerSignatureRequirement
+}
+
+func NewBundleProvider(
+	config configuration.PolicyProvider,
+	store *policy.Store,
+	parser *policy.Parser,
+	logger *logrus.Logger,
+) (*BundleProvider, error) {
+	uri, err := getRequiredStringConfigValue(config, "Uri")
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+
+	extractPath, err := getRequiredStringConfigValue(config, "ExtractPath")
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+
+	format, err := getOptionalStringConfigValue(config, "Format")
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+	if format != bundleFormatDetect && format != bundleFormatTar && format != bundleFormatTarGz && format != bundleFormatZip {
+		return nil, fmt.Errorf("bundle provider: unknown format: %s", format)
+	}
+
+	policyPath, err := getOptionalStringConfigValue(config, "PolicyPath")
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+	if policyPath == "" {
+		policyPath = "policy.json"
+	}
+
+	reloadIntervalSecondsPtr, err := getOptionalIntConfigValue(config, "ReloadIntervalSeconds")
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+	if reloadIntervalSecondsPtr != nil && *reloadIntervalSecondsPtr <= 0 {
+		reloadIntervalSecondsPtr = nil
+	}
+
+	timeoutMillisecondsPtr, err := getOptionalIntConfigValue(config, "TimeoutMilliseconds")
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+	var timeoutDuration time.Duration
+	if timeoutMillisecondsPtr != nil && *timeoutMillisecondsPtr > 0 {
+		timeoutDuration = time.Duration(*timeoutMillisecondsPtr) * time.Millisecond
+	}
+
+	authorizationBearerToken, err := getOptionalStringConfigValue(config, "AuthorizationBearerToken")
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+
+	jwtSigner, err := newHttpJwtSignerFromConfig(config["Jwt"])
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+
+	httpClient := &http.Client{
+		Timeout: timeoutDuration,
+	}
+
+	tlsConfig, err := buildHttpTlsConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient.Transport = transport
+	}
+
+	reloadPollingPolicy, err := parsePollingPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+
+	signatureRequirement, err := parseProviderSignatureRequirement(config)
+	if err != nil {
+		return nil, fmt.Errorf("bundle provider: %s", err)
+	}
+	parser = restrictParserForSignatureRequirement(parser, signatureRequirement)
+	if signatureRequirement != nil && !signatureRequirement.isDetached() {
+		// A JWS can only wrap a (text) policy document, not a whole archive
+		return nil, fmt.Errorf("bundle provider: only detached signatures are supported")
+	}
+
+	return &BundleProvider{
+		store:                    store,
+		parser:                   parser,
+		uri:                      uri,
+		format:                   format,
+		policyPath:               policyPath,
+		extractPath:              extractPath,
+		authorizationBearerToken: authorizationBearerToken,
+		jwtSigner:                jwtSigner,
+		reloadIntervalSeconds:    reloadIntervalSecondsPtr,
+		reloadPollingPolicy:      reloadPollingPolicy,
+		logger:                   logger,
+
+		httpClient: httpClient,
+
+		signatureRequirement: signatureRequirement,
+	}, nil
+}
+
+func (me *BundleProvider) Type() string {
+	return "bundle"
+}
+
+func (me *BundleProvider) Start() error {
+	me.logger.Infof("Starting policy provider: %s (%s)", me.Type(), me.uri)
+
+	err := os.MkdirAll(me.extractPath, 0700)
+	if err != nil {
+		return fmt.Errorf("failed creating bundle extract directory: %s", err)
+	}
+
+	err = me.load(true, false)
+	if err != nil {
+		return err
+	}
+
+	if me.reloadIntervalSeconds != nil {
+		me.logger.Infof("Auto-reloading for policy provider %s will happen every %d seconds", me.Type(), *me.reloadIntervalSeconds)
+
+		me.reloadPoller = newPoller(
+			me.Type(),
+			time.Duration(*me.reloadIntervalSeconds)*time.Second,
+			me.reloadPollingPolicy,
+			func() error {
+				return me.load(false, true)
+			},
+			me.store,
+			me.logger,
+		)
+		me.reloadPoller.start()
+	}
+
+	return nil
+}
+
+func (me *BundleProvider) Stop() {
+	me.logger.Infof("Stopping policy provider: %s", me.Type())
+
+	if me.reloadPoller != nil {
+		me.reloadPoller.stop()
+	}
+}
+
+func (me *BundleProvider) Reload() {
+	me.logger.Infof("Reloading policy from provider: %s", me.Type())
+
+	err := me.load(false, false)
+	if err != nil {
+		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+// load fetches the bundle (or restores the cached one) and applies it.
+// When conditional is true, a bundle identical to the last applied one is not re-applied.
+func (me *BundleProvider) load(allowedToLoadFromCache bool, conditional bool) error {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	isFromCache := false
+
+	archive, detachedSignature, errRemote := me.fetchArchive()
+	if errRemote != nil {
+		me.logger.Warnf("Failed fetching policy bundle (%s): %s", me.uri, errRemote)
+
+		if !allowedToLoadFromCache {
+			return fmt.Errorf("failed fetching policy bundle (%s), while cache-loading is not allowed", errRemote)
+		}
+
+		var errCache error
+		archive, detachedSignature, errCache = me.readCachedArchive()
+		if errCache != nil {
+			return fmt.Errorf("failed fetching policy bundle (%s) and reading it from cache (%s)", errRemote, errCache)
+		}
+		isFromCache = true
+	}
+
+	archiveHash := hashPolicyBytes(archive)
+	if conditional && me.lastArchiveHash != nil && bytes.Equal(archiveHash, me.lastArchiveHash) {
+		me.logger.Debugf("Policy bundle at %s is unchanged", me.uri)
+		return nil
+	}
+
+	if me.signatureRequirement != nil {
+		_, err := me.signatureRequirement.verify(archive, detachedSignature)
+		if err != nil {
+			return fmt.Errorf("policy bundle signature error: %s", err)
+		}
+	}
+
+	bundleDirectory, err := me.unpack(archive, archiveHash)
+	if err != nil {
+		return fmt.Errorf("failed unpacking policy bundle: %s", err)
+	}
+
+	policy, err := me.parsePolicy(bundleDirectory)
+	if err != nil {
+		me.removeUnlessCurrent(bundleDirectory)
+		return err
+	}
+
+	err = me.store.Set(policy, me.Type())
+	if err != nil {
+		me.removeUnlessCurrent(bundleDirectory)
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	me.lastArchiveHash = archiveHash
+
+	err = me.activate(bundleDirectory)
+	if err != nil {
+		me.logger.Warnf("failed activating policy bundle directory: %s", err)
+	}
+
+	if !isFromCache {
+		err = me.storeCachedArchive(archive, detachedSignature)
+		if err != nil {
+			me.logger.Warnf("failed storing policy bundle in cache: %s", err)
+		}
+	}
+
+	me.cleanUp(bundleDirectory)
+
+	return nil
+}
+
+func (me *BundleProvider) fetchArchive() ([]byte, []byte /* detachedSignature */, error) {
+	signatureUri := me.uri + ".sig"
+	if me.signatureRequirement != nil && me.signatureRequirement.uri != "" {
+		signatureUri = me.signatureRequirement.uri
+	}
+
+	archive, err := me.fetch(me.uri)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var detachedSignature []byte
+	if me.signatureRequirement != nil {
+		detachedSignature, err = me.fetch(signatureUri)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed fetching detached policy bundle signature: %s", err)
+		}
+	}
+
+	return archive, detachedSignature, nil
+}
+
+// fetch reads the file at the given URI, which is either an HTTP(S) URL or a local path
+func (me *BundleProvider) fetch(uri string) ([]byte, error) {
+	if !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+		return ioutil.ReadFile(uri)
+	}
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if me.jwtSigner != nil {
+		token, err := me.jwtSigner.Mint()
+		if err != nil {
+			return nil, fmt.Errorf("failed minting JWT: %s", err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	} else if me.authorizationBearerToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", me.authorizationBearerToken))
+	}
+
+	resp, err := me.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("non-200 response fetching from URL (%s): %d", uri, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// unpack extracts the archive into a directory named after its hash, unless it's already there.
+//
+// Extraction happens in a temporary directory, which only gets renamed into place once complete.
+func (me *BundleProvider) unpack(archive []byte, archiveHash []byte) (string, error) {
+	bundleDirectoryName := bundleDirectoryPrefix + hex.EncodeToString(archiveHash)[:16]
+	bundleDirectory := filepath.Join(me.extractPath, bundleDirectoryName)
+
+	_, err := os.Stat(bundleDirectory)
+	if err == nil {
+		return bundleDirectory, nil
+	}
+
+	temporaryDirectory := filepath.Join(me.extractPath, "."+bundleDirectoryName+".tmp")
+
+	err = os.RemoveAll(temporaryDirectory)
+	if err != nil {
+		return "", err
+	}
+
+	err = extractBundle(archive, me.format, temporaryDirectory)
+	if err != nil {
+		os.RemoveAll(temporaryDirectory)
+		return "", err
+	}
+
+	err = os.Rename(temporaryDirectory, bundleDirectory)
+	if err != nil {
+		os.RemoveAll(temporaryDirectory)
+		return "", err
+	}
+
+	return bundleDirectory, nil
+}
+
+func (me *BundleProvider) parsePolicy(bundleDirectory string) (*policy.Policy, error) {
+	assetReader := bundleAssetReader{bundleDirectory: bundleDirectory}
+
+	policyBytes, err := assetReader.ReadAsset(me.policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading policy document `%s` out of the bundle: %s", me.policyPath, err)
+	}
+
+	return me.parser.ParseBundledFormat(policyBytes, policy.DetectFormat("", me.policyPath), assetReader)
+}
+
+// activate points the `current` symlink to the given bundle directory.
+//
+// The new symlink gets renamed over the old one, so anything looking at `current` sees either the old or the new bundle, never a mix.
+func (me *BundleProvider) activate(bundleDirectory string) error {
+	currentLinkPath := filepath.Join(me.extractPath, bundleCurrentLinkName)
+	temporaryLinkPath := currentLinkPath + ".tmp"
+
+	os.Remove(temporaryLinkPath)
+
+	err := os.Symlink(filepath.Base(bundleDirectory), temporaryLinkPath)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryLinkPath, currentLinkPath)
+}
+
+// cleanUp removes the directories of all bundles, other than the given (currently-applied) one
+func (me *BundleProvider) cleanUp(bundleDirectory string) {
+	entries, err := ioutil.ReadDir(me.extractPath)
+	if err != nil {
+		me.logger.Warnf("failed listing bundle extract directory: %s", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), bundleDirectoryPrefix) {
+			continue
+		}
+
+		entryPath := filepath.Join(me.extractPath, entry.Name())
+		if entryPath == bundleDirectory {
+			continue
+		}
+
+		err = os.RemoveAll(entryPath)
+		if err != nil {
+			me.logger.Warnf("failed removing old bundle directory %s: %s", entryPath, err)
+		}
+	}
+}
+
+// removeUnlessCurrent removes a bundle directory which we've failed applying, unless it's the one `current` points to
+func (me *BundleProvider) removeUnlessCurrent(bundleDirectory string) {
+	currentBundleDirectoryName, err := os.Readlink(filepath.Join(me.extractPath, bundleCurrentLinkName))
+	if err == nil && currentBundleDirectoryName == filepath.Base(bundleDirectory) {
+		return
+	}
+
+	os.RemoveAll(bundleDirectory)
+}
+
+func (me *BundleProvider) readCachedArchive() ([]byte, []byte /* detachedSignature */, error) {
+	cachedArchivePath := filepath.Join(me.extractPath, bundleCachedArchiveName)
+
+	archive, err := ioutil.ReadFile(cachedArchivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var detachedSignature []byte
+	if me.signatureRequirement != nil {
+		detachedSignature, err = readDetachedSignatureFile(*detachedSignatureCachePath(&cachedArchivePath))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed reading cached detached policy bundle signature: %s", err)
+		}
+	}
+
+	return archive, detachedSignature, nil
+}
+
+func (me *BundleProvider) storeCachedArchive(archive []byte, detachedSignature []byte) error {
+	cachedArchivePath := filepath.Join(me.extractPath, bundleCachedArchiveName)
+
+	err := storePolicyBytesInCacheFile(&cachedArchivePath, archive)
+	if err != nil {
+		return err
+	}
+
+	if me.signatureRequirement != nil {
+		return storePolicyBytesInCacheFile(detachedSignatureCachePath(&cachedArchivePath), detachedSignature)
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package provider
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	bundleFormatTar    = "tar"
+	bundleFormatTarGz  = "tar.gz"
+	bundleFormatZip    = "zip"
+	bundleFormatDetect = ""
+)
+
+// bundleMaxExtractedSizeBytes limits how much data a bundle may unpack to, so that a malicious (or broken) archive can't fill up the disk
+const bundleMaxExtractedSizeBytes = 256 * 1024 * 1024
+
+// zipMagicBytes is what (non-empty) zip archives start with
+var zipMagicBytes = []byte{'P', 'K', 0x03, 0x04}
+
+// detectBundleFormat figures out the format of a bundle archive (one of the `bundleFormat*` constants) by its magic bytes
+func detectBundleFormat(archive []byte) (string, error) {
+	if bytes.HasPrefix(archive, zipMagicBytes) {
+		return bundleFormatZip, nil
+	}
+	if bytes.HasPrefix(archive, []byte{0x1f, 0x8b}) {
+		return bundleFormatTarGz, nil
+	}
+	// The `ustar` magic lives at offset 257 of the first tar header
+	if len(archive) > 262 && bytes.Equal(archive[257:262], []byte("ustar")) {
+		return bundleFormatTar, nil
+	}
+	return "", fmt.Errorf("cannot detect the bundle archive format (expected tar, tar.gz or zip)")
+}
+
+// extractBundle unpacks the archive into the (not yet existing) target directory.
+//
+// Only regular files and directories are supported. Symlinks, hard links, device files, etc., are rejected,
+// as are entries trying to escape the target directory (e.g. `../../etc/passwd`).
+func extractBundle(archive []byte, format string, targetDirectory string) error {
+	var err error
+	if format == bundleFormatDetect {
+		format, err = detectBundleFormat(archive)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(targetDirectory, 0700)
+	if err != nil {
+		return err
+	}
+
+	extractor := &bundleExtractor{
+		targetDirectory: targetDirectory,
+		remainingBytes:  bundleMaxExtractedSizeBytes,
+	}
+
+	switch format {
+	case bundleFormatTar:
+		return extractor.extractTar(bytes.NewReader(archive))
+	case bundleFormatTarGz:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			return fmt.Errorf("failed to initialize gzip decompression: %s", err)
+		}
+		defer gzipReader.Close()
+		return extractor.extractTar(gzipReader)
+	case bundleFormatZip:
+		return extractor.extractZip(archive)
+	}
+
+	return fmt.Errorf("unknown bundle format: %s", format)
+}
+
+type bundleExtractor struct {
+	targetDirectory string
+	remainingBytes  int64
+}
+
+func (me *bundleExtractor) extractTar(reader io.Reader) error {
+	tarReader := tar.NewReader(reader)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed reading tar archive: %s", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = me.createDirectory(header.Name)
+		case tar.TypeReg:
+			err = me.createFile(header.Name, tarReader)
+		case tar.TypeXGlobalHeader:
+			// Archive-wide metadata (e.g. added by `git archive`), which is of no interest to us
+			continue
+		default:
+			err = fmt.Errorf("unsupported entry type (%c)", header.Typeflag)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed extracting `%s`: %s", header.Name, err)
+		}
+	}
+}
+
+func (me *bundleExtractor) extractZip(archive []byte) error {
+	zipReader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return fmt.Errorf("failed reading zip archive: %s", err)
+	}
+
+	for _, file := range zipReader.File {
+		err = me.extractZipFile(file)
+		if err != nil {
+			return fmt.Errorf("failed extracting `%s`: %s", file.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (me *bundleExtractor) extractZipFile(file *zip.File) error {
+	if file.FileInfo().IsDir() {
+		return me.createDirectory(file.Name)
+	}
+
+	if !file.Mode().IsRegular() {
+		return fmt.Errorf("unsupported entry type (%s)", file.Mode())
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return me.createFile(file.Name, reader)
+}
+
+func (me *bundleExtractor) createDirectory(name string) error {
+	// Archives created out of the current directory (e.g. `tar -czf bundle.tar.gz .`) contain an entry for it
+	if name == "." || name == "./" {
+		return nil
+	}
+
+	directoryPath, err := resolveBundlePath(me.targetDirectory, name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(directoryPath, 0700)
+}
+
+func (me *bundleExtractor) createFile(name string, reader io.Reader) error {
+	filePath, err := resolveBundlePath(me.targetDirectory, name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filePath), 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Reading one byte more than allowed lets us tell an archive which is exactly at the limit from one exceeding it
+	written, err := io.Copy(file, io.LimitReader(reader, me.remainingBytes+1))
+	if err != nil {
+		return err
+	}
+	if written > me.remainingBytes {
+		return fmt.Errorf("the bundle unpacks to more than %d bytes", bundleMaxExtractedSizeBytes)
+	}
+	me.remainingBytes -= written
+
+	return nil
+}
+
+// resolveBundlePath turns a (slash-separated, relative) path within a bundle into a path within the bundle's directory.
+// Paths which would escape the bundle's directory are rejected.
+func resolveBundlePath(bundleDirectory string, name string) (string, error) {
+	name = strings.TrimPrefix(name, "./")
+
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", fmt.Errorf("invalid path within bundle: %s", name)
+	}
+
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("invalid path within bundle: %s", name)
+		}
+	}
+
+	return filepath.Join(bundleDirectory, filepath.FromSlash(name)), nil
+}
+
+// bundleAssetReader is a policy.AssetReader, reading assets out of an unpacked bundle
+type bundleAssetReader struct {
+	bundleDirectory string
+}
+
+func (me bundleAssetReader) ReadAsset(path string) ([]byte, error) {
+	assetPath, err := resolveBundlePath(me.bundleDirectory, path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(assetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such file in the bundle")
+		}
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file")
+	}
+
+	return ioutil.ReadFile(assetPath)
+}
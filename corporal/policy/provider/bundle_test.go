@@ -0,0 +1,340 @@
+package provider
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testBundlePolicyDocument = `{
+	"schemaVersion": 1,
+	"users": [{"id": "@a:example.com", "active": true, "authType": "plain", "authCredential": "secret", "displayName": {"$bundleFile": "assets/display-name.txt"}}]
+}`
+
+// createTestBundle creates a bundle archive of the given format, containing the given files (path => contents)
+func createTestBundle(t *testing.T, format string, files map[string]string) []byte {
+	// Sorted, so that the same files always result in the same archive
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var buffer bytes.Buffer
+
+	if format == bundleFormatZip {
+		zipWriter := zip.NewWriter(&buffer)
+		for _, path := range paths {
+			fileWriter, err := zipWriter.Create(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			fileWriter.Write([]byte(files[path]))
+		}
+		zipWriter.Close()
+		return buffer.Bytes()
+	}
+
+	var gzipWriter *gzip.Writer
+	var tarWriter *tar.Writer
+	if format == bundleFormatTarGz {
+		gzipWriter = gzip.NewWriter(&buffer)
+		tarWriter = tar.NewWriter(gzipWriter)
+	} else {
+		tarWriter = tar.NewWriter(&buffer)
+	}
+
+	for _, path := range paths {
+		err := tarWriter.WriteHeader(&tar.Header{Name: path, Mode: 0600, Size: int64(len(files[path])), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		tarWriter.Write([]byte(files[path]))
+	}
+	tarWriter.Close()
+	if gzipWriter != nil {
+		gzipWriter.Close()
+	}
+
+	return buffer.Bytes()
+}
+
+// testBundleServer serves a (changeable) bundle archive
+type testBundleServer struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	archive []byte
+	failing bool
+}
+
+func newTestBundleServer(t *testing.T) *testBundleServer {
+	server := &testBundleServer{}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+
+		if server.failing || r.URL.Path != "/bundle" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer bundle-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Write(server.archive)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (me *testBundleServer) setArchive(archive []byte) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.archive = archive
+}
+
+func (me *testBundleServer) setFailing(failing bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.failing = failing
+}
+
+func createTestBundleProvider(t *testing.T, uri string, extractPath string) (*BundleProvider, *policy.Store) {
+	store, parser := createTestStoreAndParser(t)
+
+	provider, err := NewBundleProvider(configuration.PolicyProvider{
+		"Uri":                      uri,
+		"ExtractPath":              extractPath,
+		"AuthorizationBearerToken": "bundle-token",
+	}, store, parser, createTestLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = os.MkdirAll(extractPath, 0700)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return provider, store
+}
+
+// listTestBundleDirectories lists the bundle directories within the extract directory, along with what `current` points to
+func listTestBundleDirectories(t *testing.T, extractPath string) ([]string, string) {
+	entries, err := ioutil.ReadDir(extractPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var bundleDirectories []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			bundleDirectories = append(bundleDirectories, entry.Name())
+		}
+	}
+
+	current, _ := os.Readlink(filepath.Join(extractPath, bundleCurrentLinkName))
+
+	return bundleDirectories, current
+}
+
+func TestBundleProviderLoadsPoliciesWithTheirAssets(t *testing.T) {
+	for _, format := range []string{bundleFormatTar, bundleFormatTarGz, bundleFormatZip} {
+		t.Run(format, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "bundle-provider")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer os.RemoveAll(directory)
+
+			extractPath := filepath.Join(directory, "extract")
+
+			server := newTestBundleServer(t)
+			server.setArchive(createTestBundle(t, format, map[string]string{
+				"policy.json":             testBundlePolicyDocument,
+				"assets/display-name.txt": "Version 1",
+			}))
+
+			provider, store := createTestBundleProvider(t, server.URL+"/bundle", extractPath)
+			err = provider.load(true, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if displayName := store.Get().User[0].DisplayName; displayName != "Version 1" {
+				t.Errorf("expected the asset to be inlined, got: %s", displayName)
+			}
+
+			bundleDirectories, current := listTestBundleDirectories(t, extractPath)
+			if len(bundleDirectories) != 1 || current != bundleDirectories[0] {
+				t.Errorf("expected a single (current) bundle directory, got %v (current: %s)", bundleDirectories, current)
+			}
+
+			// An unchanged bundle is not re-applied when polling
+			loadedPolicy := store.Get()
+			err = provider.load(false, true)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if store.Get() != loadedPolicy {
+				t.Errorf("expected the unchanged bundle to not be re-applied")
+			}
+
+			// A changed asset makes for a changed bundle, which replaces (and cleans up after) the previous one
+			server.setArchive(createTestBundle(t, format, map[string]string{
+				"policy.json":             testBundlePolicyDocument,
+				"assets/display-name.txt": "Version 2",
+			}))
+			err = provider.load(false, true)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if displayName := store.Get().User[0].DisplayName; displayName != "Version 2" {
+				t.Errorf("expected the changed asset to be inlined, got: %s", displayName)
+			}
+
+			newBundleDirectories, newCurrent := listTestBundleDirectories(t, extractPath)
+			if len(newBundleDirectories) != 1 || newCurrent != newBundleDirectories[0] || newCurrent == current {
+				t.Errorf("expected a single (new) bundle directory, got %v (current: %s)", newBundleDirectories, newCurrent)
+			}
+		})
+	}
+}
+
+func TestBundleProviderKeepsTheCurrentBundleWhenFailing(t *testing.T) {
+	goodArchive := createTestBundle(t, bundleFormatTarGz, map[string]string{
+		"policy.json":             testBundlePolicyDocument,
+		"assets/display-name.txt": "Good",
+	})
+
+	type testData struct {
+		name    string
+		archive []byte
+	}
+
+	tests := []testData{
+		{"not an archive", []byte("policy")},
+		{"escaping the extract directory", createTestBundle(t, bundleFormatTar, map[string]string{"../policy.json": testBundlePolicyDocument})},
+		{"no policy document", createTestBundle(t, bundleFormatZip, map[string]string{"other.json": testBundlePolicyDocument})},
+		{"missing asset", createTestBundle(t, bundleFormatZip, map[string]string{"policy.json": testBundlePolicyDocument})},
+		{"invalid policy", createTestBundle(t, bundleFormatZip, map[string]string{"policy.json": strings.Replace(testBundlePolicyDocument, "example.com", "other.com", 1), "assets/display-name.txt": "Bad"})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "bundle-provider")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer os.RemoveAll(directory)
+
+			extractPath := filepath.Join(directory, "extract")
+
+			server := newTestBundleServer(t)
+			server.setArchive(goodArchive)
+
+			provider, store := createTestBundleProvider(t, server.URL+"/bundle", extractPath)
+			err = provider.load(true, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			loadedPolicy := store.Get()
+			bundleDirectories, current := listTestBundleDirectories(t, extractPath)
+
+			server.setArchive(test.archive)
+			err = provider.load(false, true)
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+			if store.Get() != loadedPolicy {
+				t.Errorf("expected the current policy to be kept")
+			}
+
+			newBundleDirectories, newCurrent := listTestBundleDirectories(t, extractPath)
+			if len(newBundleDirectories) != len(bundleDirectories) || newCurrent != current {
+				t.Errorf("expected the bundle directories to not change (%v, current: %s), got %v (current: %s)", bundleDirectories, current, newBundleDirectories, newCurrent)
+			}
+			if _, err := os.Stat(filepath.Join(extractPath, "policy.json")); !os.IsNotExist(err) {
+				t.Errorf("expected nothing to be extracted outside of the bundle directory")
+			}
+		})
+	}
+}
+
+func TestBundleProviderFallsBackToTheCache(t *testing.T) {
+	directory, err := ioutil.TempDir("", "bundle-provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	extractPath := filepath.Join(directory, "extract")
+
+	archive := createTestBundle(t, bundleFormatTarGz, map[string]string{
+		"policy.json":             testBundlePolicyDocument,
+		"assets/display-name.txt": "Cached",
+	})
+
+	server := newTestBundleServer(t)
+	server.setArchive(archive)
+
+	provider, _ := createTestBundleProvider(t, server.URL+"/bundle", extractPath)
+	err = provider.load(true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cachedArchive, _ := ioutil.ReadFile(filepath.Join(extractPath, bundleCachedArchiveName))
+	if !bytes.Equal(cachedArchive, archive) {
+		t.Errorf("expected the archive to be cached as it was fetched")
+	}
+
+	server.setFailing(true)
+
+	provider, store := createTestBundleProvider(t, server.URL+"/bundle", extractPath)
+	err = provider.load(false, false)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+
+	err = provider.load(true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if displayName := store.Get().User[0].DisplayName; displayName != "Cached" {
+		t.Errorf("expected the cached bundle to be applied, got: %s", displayName)
+	}
+
+	// Bundles can also be loaded from local files
+	archivePath := filepath.Join(directory, "bundle.tar.gz")
+	ioutil.WriteFile(archivePath, archive, 0600)
+
+	provider, store = createTestBundleProvider(t, archivePath, filepath.Join(directory, "extract-local"))
+	err = provider.load(false, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertTestStoreUserIds(t, store, "@a:example.com")
+}
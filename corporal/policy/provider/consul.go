@@ -0,0 +1,303 @@
+package provider
+
+import (
+	"context"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// consulBlockingQueryWaitTime is how long a single blocking query waits for the key to change
+const consulBlockingQueryWaitTime = 5 * time.Minute
+
+// consulWatchRetryInterval is how long to wait before retrying, after a blocking query fails
+const consulWatchRetryInterval = 5 * time.Second
+
+// ConsulProvider is a policy provider which reads the policy from a key in Consul's KV store.
+//
+// Instead of polling, it uses Consul's blocking queries, so that policy changes propagate almost instantly.
+// See: https://developer.hashicorp.com/consul/api-docs/features/blocking
+type ConsulProvider struct {
+	store      *policy.Store
+	parser     *policy.Parser
+	address    string
+	key        string
+	token      string
+	datacenter string
+	cachePath  *string
+	logger     *logrus.Logger
+
+	httpClient  *http.Client
+	lockLoad    sync.Mutex
+	stopChannel chan struct{}
+	stopContext context.Context
+	stopFunc    context.CancelFunc
+
+	// lastIndex holds the `X-Consul-Index` of the last policy we've loaded
+	lastIndex uint64
+}
+
+func NewConsulProvider(
+	config configuration.PolicyProvider,
+	store *policy.Store,
+	parser *policy.Parser,
+	logger *logrus.Logger,
+) (*ConsulProvider, error) {
+	address, err := getRequiredStringConfigValue(config, "Address")
+	if err != nil {
+		return nil, fmt.Errorf("Consul provider: %s", err)
+	}
+
+	key, err := getRequiredStringConfigValue(config, "Key")
+	if err != nil {
+		return nil, fmt.Errorf("Consul provider: %s", err)
+	}
+
+	token, err := getOptionalStringConfigValue(config, "Token")
+	if err != nil {
+		return nil, fmt.Errorf("Consul provider: %s", err)
+	}
+
+	datacenter, err := getOptionalStringConfigValue(config, "Datacenter")
+	if err != nil {
+		return nil, fmt.Errorf("Consul provider: %s", err)
+	}
+
+	cachePath, err := getOptionalStringConfigValue(config, "CachePath")
+	if err != nil {
+		return nil, fmt.Errorf("Consul provider: %s", err)
+	}
+	var cachePathPtr *string
+	if cachePath != "" {
+		cachePathPtr = &cachePath
+	}
+
+	stopContext, stopFunc := context.WithCancel(context.Background())
+
+	return &ConsulProvider{
+		store:      store,
+		parser:     parser,
+		address:    strings.TrimSuffix(address, "/"),
+		key:        strings.TrimPrefix(key, "/"),
+		token:      token,
+		datacenter: datacenter,
+		cachePath:  cachePathPtr,
+		logger:     logger,
+
+		// No client-level timeout, as blocking queries are long-lived by design.
+		// Consul itself adds some jitter (up to wait/16) on top of the wait time.
+		httpClient: &http.Client{},
+
+		stopChannel: make(chan struct{}),
+		stopContext: stopContext,
+		stopFunc:    stopFunc,
+	}, nil
+}
+
+func (me *ConsulProvider) Type() string {
+	return "consul"
+}
+
+func (me *ConsulProvider) Start() error {
+	me.logger.Infof("Starting policy provider: %s (%s, key: %s)", me.Type(), me.address, me.key)
+
+	err := me.load(true)
+	if err != nil {
+		return err
+	}
+
+	go me.watch()
+
+	return nil
+}
+
+func (me *ConsulProvider) Stop() {
+	me.logger.Infof("Stopping policy provider: %s", me.Type())
+
+	close(me.stopChannel)
+	me.stopFunc()
+}
+
+func (me *ConsulProvider) Reload() {
+	me.logger.Infof("Reloading policy from provider: %s", me.Type())
+
+	err := me.load(false)
+	if err != nil {
+		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+func (me *ConsulProvider) load(allowedToLoadFromCache bool) error {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	policyBytes, index, errRemote := me.fetchKey(0)
+	if errRemote != nil {
+		me.logger.Warnf("Failed loading policy from Consul (%s): %s", me.key, errRemote)
+
+		if !allowedToLoadFromCache {
+			return fmt.Errorf("failed loading policy from Consul (%s), while cache-loading is not allowed", errRemote)
+		}
+
+		policyBytes, errCache := loadPolicyBytesFromCacheFile(me.cachePath)
+		if errCache != nil {
+			return fmt.Errorf("failed loading policy from Consul (%s) and from cache (%s)", errRemote, errCache)
+		}
+
+		me.logger.Debugf("Successfully loaded policy from cache")
+
+		return me.apply(policyBytes, false)
+	}
+
+	err := me.apply(policyBytes, true)
+	if err != nil {
+		return err
+	}
+
+	me.lastIndex = index
+
+	return nil
+}
+
+func (me *ConsulProvider) watch() {
+	for {
+		select {
+		case <-me.stopChannel:
+			return
+		default:
+		}
+
+		policyBytes, index, err := me.fetchKey(me.lastIndex)
+		if err != nil {
+			if me.stopContext.Err() != nil {
+				return
+			}
+
+			me.logger.Warnf("Failed watching Consul key (%s) for policy changes: %s", me.key, err)
+
+			if !sleepUnlessStopped(consulWatchRetryInterval, me.stopChannel) {
+				return
+			}
+			continue
+		}
+
+		me.lockLoad.Lock()
+
+		if index == me.lastIndex {
+			// The wait time elapsed without any changes.
+			me.lockLoad.Unlock()
+			continue
+		}
+
+		if index < me.lastIndex {
+			// The index went backwards (e.g. the Consul cluster was restored from a snapshot).
+			// As recommended by Consul's documentation, we reset it and start over.
+			me.lastIndex = 0
+			me.lockLoad.Unlock()
+			continue
+		}
+
+		me.logger.Infof("Policy changed in Consul (index: %d)", index)
+
+		err = me.apply(policyBytes, true)
+		if err != nil {
+			me.logger.Warnf("Failed applying policy from Consul: %s", err)
+			me.store.ReportLoadFailure(me.Type(), err)
+		}
+
+		// Even if the policy is bad, there's no point in fetching it again until it changes.
+		me.lastIndex = index
+
+		me.lockLoad.Unlock()
+	}
+}
+
+func (me *ConsulProvider) apply(policyBytes []byte, storeInCache bool) error {
+	policyObj, err := me.parser.ParseFormat(policyBytes, policy.DetectFormat("", me.key))
+	if err != nil {
+		return err
+	}
+
+	if storeInCache {
+		err := storePolicyBytesInCacheFile(me.cachePath, policyBytes)
+		if err != nil {
+			me.logger.Warnf("failed storing policy in cache: %s", err)
+		}
+	}
+
+	err = me.store.Set(policyObj, me.Type())
+	if err != nil {
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	return nil
+}
+
+// fetchKey fetches the raw value of the policy key.
+// When a non-zero index is provided, this is a blocking query, which only returns after the key changes past this index
+// (or after consulBlockingQueryWaitTime elapses).
+func (me *ConsulProvider) fetchKey(index uint64) ([]byte, uint64, error) {
+	query := url.Values{}
+	query.Set("raw", "")
+	if me.datacenter != "" {
+		query.Set("dc", me.datacenter)
+	}
+	if index != 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(consulBlockingQueryWaitTime.Seconds())))
+	}
+
+	uri := fmt.Sprintf("%s/v1/kv/%s?%s", me.address, me.key, query.Encode())
+
+	// Non-blocking queries should not take long. Blocking ones take up to the wait time (plus some jitter).
+	timeout := 30 * time.Second
+	if index != 0 {
+		timeout += consulBlockingQueryWaitTime + consulBlockingQueryWaitTime/16
+	}
+
+	ctx, cancel := context.WithTimeout(me.stopContext, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if me.token != "" {
+		req.Header.Set("X-Consul-Token", me.token)
+	}
+
+	resp, err := me.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, fmt.Errorf("key not found")
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("non-200 response fetching from Consul: %d", resp.StatusCode)
+	}
+
+	responseIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad X-Consul-Index response header: %s", err)
+	}
+
+	bodyBytes, err := policy.ReadDocument(resp.Body, "")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed reading Consul response body: %s", err)
+	}
+
+	return bodyBytes, responseIndex, nil
+}
@@ -0,0 +1,190 @@
+package provider
+
+import (
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testConsulServer serves a single (changeable) KV key, supporting blocking queries the way Consul does
+type testConsulServer struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	value   *string
+	index   uint64
+	changed chan struct{}
+	tokens  []string
+}
+
+func newTestConsulServer(t *testing.T) *testConsulServer {
+	server := &testConsulServer{changed: make(chan struct{})}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/matrix-corporal/policy.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, isRaw := r.URL.Query()["raw"]; !isRaw || r.URL.Query().Get("dc") != "dc1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+		server.lock.Lock()
+		server.tokens = append(server.tokens, r.Header.Get("X-Consul-Token"))
+		if waitIndex != 0 && waitIndex >= server.index {
+			// A blocking query. We wait until the key changes (or the client gives up), instead of timing out.
+			changed := server.changed
+			server.lock.Unlock()
+
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+
+			server.lock.Lock()
+		}
+		value, index := server.value, server.index
+		server.lock.Unlock()
+
+		if value == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		w.Write([]byte(*value))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (me *testConsulServer) setValue(value string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.value = &value
+	me.index++
+
+	close(me.changed)
+	me.changed = make(chan struct{})
+}
+
+func createTestConsulProvider(t *testing.T, server *testConsulServer, cachePath string) (*ConsulProvider, *policy.Store) {
+	store, parser := createTestStoreAndParser(t)
+
+	provider, err := NewConsulProvider(configuration.PolicyProvider{
+		"Address":    server.URL + "/",
+		"Key":        "/matrix-corporal/policy.json",
+		"Token":      "consul-token",
+		"Datacenter": "dc1",
+		"CachePath":  cachePath,
+	}, store, parser, createTestLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return provider, store
+}
+
+func TestConsulProviderWatchesForChanges(t *testing.T) {
+	server := newTestConsulServer(t)
+	server.setValue(createTestValidPolicyDocument("@a:example.com"))
+
+	provider, store := createTestConsulProvider(t, server, "")
+	loadReporter := &testLoadReporter{}
+	store.SetLoadReporter(loadReporter)
+
+	err := provider.Start()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer provider.Stop()
+
+	assertTestStoreUserIds(t, store, "@a:example.com")
+
+	server.setValue(createTestValidPolicyDocument("@b:example.com"))
+	waitForTestCondition(t, "the changed policy to be applied", func() bool {
+		return testStoreHasUserIds(store, "@b:example.com")
+	})
+
+	// Bad policies are reported and the current policy is kept, until the key changes again
+	server.setValue(`{"schemaVersion": 1, `)
+	waitForTestCondition(t, "the bad policy to be reported", func() bool {
+		return loadReporter.failuresCount() == 1
+	})
+	assertTestStoreUserIds(t, store, "@b:example.com")
+
+	server.setValue(createTestValidPolicyDocument("@c:example.com"))
+	waitForTestCondition(t, "the fixed policy to be applied", func() bool {
+		return testStoreHasUserIds(store, "@c:example.com")
+	})
+
+	server.lock.Lock()
+	for _, token := range server.tokens {
+		if token != "consul-token" {
+			t.Errorf("expected all requests to carry the token, got: %s", token)
+		}
+	}
+	server.lock.Unlock()
+}
+
+func TestConsulProviderFallsBackToTheCache(t *testing.T) {
+	directory, err := ioutil.TempDir("", "consul-provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	cachePath := filepath.Join(directory, "policy.json")
+
+	server := newTestConsulServer(t)
+
+	// The key doesn't exist yet and there's nothing cached
+	provider, store := createTestConsulProvider(t, server, cachePath)
+	err = provider.load(true)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+
+	server.setValue(createTestValidPolicyDocument("@a:example.com"))
+	err = provider.load(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if provider.lastIndex != 1 {
+		t.Errorf("expected the index to be remembered, got: %d", provider.lastIndex)
+	}
+
+	// Once Consul is unreachable, starting up falls back to what got cached, while reloading doesn't
+	server.Close()
+
+	provider, store = createTestConsulProvider(t, server, cachePath)
+	err = provider.load(false)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+
+	err = provider.load(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertTestStoreUserIds(t, store, "@a:example.com")
+}
@@ -0,0 +1,437 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// etcdWatchRetryInterval is how long to wait before re-establishing a watch, after it fails
+const etcdWatchRetryInterval = 5 * time.Second
+
+// etcdRequestTimeout is how long non-watch requests (fetching the key, authenticating) are allowed to take
+const etcdRequestTimeout = 30 * time.Second
+
+// EtcdProvider is a policy provider which reads the policy from a key in etcd (v3).
+//
+// Instead of polling, it uses etcd's watch API, so that policy changes propagate almost instantly.
+// It talks to etcd's JSON gRPC gateway (`/v3/*`), which is enabled by default.
+// See: https://etcd.io/docs/latest/dev-guide/api_grpc_gateway/
+type EtcdProvider struct {
+	store     *policy.Store
+	parser    *policy.Parser
+	endpoint  string
+	key       string
+	username  string
+	password  string
+	cachePath *string
+	logger    *logrus.Logger
+
+	httpClient  *http.Client
+	lockLoad    sync.Mutex
+	stopChannel chan struct{}
+	stopContext context.Context
+	stopFunc    context.CancelFunc
+
+	// lastRevision holds the modification revision of the last policy we've loaded
+	lastRevision int64
+}
+
+type etcdKeyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type etcdResponseHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdResponseHeader `json:"header"`
+	Kvs    []etcdKeyValue     `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result *struct {
+		Header   etcdResponseHeader `json:"header"`
+		Canceled bool               `json:"canceled"`
+		Events   []struct {
+			// Type is omitted for PUT events (the zero value)
+			Type string       `json:"type"`
+			Kv   etcdKeyValue `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewEtcdProvider(
+	config configuration.PolicyProvider,
+	store *policy.Store,
+	parser *policy.Parser,
+	logger *logrus.Logger,
+) (*EtcdProvider, error) {
+	endpoint, err := getRequiredStringConfigValue(config, "Endpoint")
+	if err != nil {
+		return nil, fmt.Errorf("etcd provider: %s", err)
+	}
+
+	key, err := getRequiredStringConfigValue(config, "Key")
+	if err != nil {
+		return nil, fmt.Errorf("etcd provider: %s", err)
+	}
+
+	username, err := getOptionalStringConfigValue(config, "Username")
+	if err != nil {
+		return nil, fmt.Errorf("etcd provider: %s", err)
+	}
+
+	password, err := getOptionalStringConfigValue(config, "Password")
+	if err != nil {
+		return nil, fmt.Errorf("etcd provider: %s", err)
+	}
+
+	cachePath, err := getOptionalStringConfigValue(config, "CachePath")
+	if err != nil {
+		return nil, fmt.Errorf("etcd provider: %s", err)
+	}
+	var cachePathPtr *string
+	if cachePath != "" {
+		cachePathPtr = &cachePath
+	}
+
+	stopContext, stopFunc := context.WithCancel(context.Background())
+
+	return &EtcdProvider{
+		store:     store,
+		parser:    parser,
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		key:       key,
+		username:  username,
+		password:  password,
+		cachePath: cachePathPtr,
+		logger:    logger,
+
+		// No client-level timeout, as watches are long-lived by design.
+		httpClient: &http.Client{},
+
+		stopChannel: make(chan struct{}),
+		stopContext: stopContext,
+		stopFunc:    stopFunc,
+	}, nil
+}
+
+func (me *EtcdProvider) Type() string {
+	return "etcd"
+}
+
+func (me *EtcdProvider) Start() error {
+	me.logger.Infof("Starting policy provider: %s (%s, key: %s)", me.Type(), me.endpoint, me.key)
+
+	err := me.load(true)
+	if err != nil {
+		return err
+	}
+
+	go me.watch()
+
+	return nil
+}
+
+func (me *EtcdProvider) Stop() {
+	me.logger.Infof("Stopping policy provider: %s", me.Type())
+
+	close(me.stopChannel)
+	me.stopFunc()
+}
+
+func (me *EtcdProvider) Reload() {
+	me.logger.Infof("Reloading policy from provider: %s", me.Type())
+
+	err := me.load(false)
+	if err != nil {
+		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+func (me *EtcdProvider) load(allowedToLoadFromCache bool) error {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	policyBytes, revision, errRemote := me.fetchKey()
+	if errRemote != nil {
+		me.logger.Warnf("Failed loading policy from etcd (%s): %s", me.key, errRemote)
+
+		if !allowedToLoadFromCache {
+			return fmt.Errorf("failed loading policy from etcd (%s), while cache-loading is not allowed", errRemote)
+		}
+
+		policyBytes, errCache := loadPolicyBytesFromCacheFile(me.cachePath)
+		if errCache != nil {
+			return fmt.Errorf("failed loading policy from etcd (%s) and from cache (%s)", errRemote, errCache)
+		}
+
+		me.logger.Debugf("Successfully loaded policy from cache")
+
+		return me.apply(policyBytes, false)
+	}
+
+	err := me.apply(policyBytes, true)
+	if err != nil {
+		return err
+	}
+
+	me.lastRevision = revision
+
+	return nil
+}
+
+func (me *EtcdProvider) watch() {
+	for {
+		err := me.watchOnce()
+		if err == nil || me.stopContext.Err() != nil {
+			return
+		}
+
+		me.logger.Warnf("Failed watching etcd key (%s) for policy changes: %s", me.key, err)
+
+		if !sleepUnlessStopped(etcdWatchRetryInterval, me.stopChannel) {
+			return
+		}
+	}
+}
+
+// watchOnce establishes a watch (starting after the last-loaded revision) and applies policies as they arrive.
+// It only returns when the watch breaks (with an error) or when the provider is stopped (with a nil error).
+func (me *EtcdProvider) watchOnce() error {
+	me.lockLoad.Lock()
+	startRevision := me.lastRevision + 1
+	me.lockLoad.Unlock()
+
+	authToken, err := me.authenticate()
+	if err != nil {
+		return fmt.Errorf("failed authenticating: %s", err)
+	}
+
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            base64.StdEncoding.EncodeToString([]byte(me.key)),
+			"start_revision": strconv.FormatInt(startRevision, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := me.doRequest(me.stopContext, "/v3/watch", requestBody, authToken)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The response is an endless stream of JSON objects, one per watch response.
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var watchResponse etcdWatchResponse
+		err := decoder.Decode(&watchResponse)
+		if err != nil {
+			if me.stopContext.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("watch stream broke: %s", err)
+		}
+
+		if watchResponse.Error != nil {
+			return fmt.Errorf("watch error: %s", watchResponse.Error.Message)
+		}
+
+		if watchResponse.Result == nil {
+			continue
+		}
+
+		if watchResponse.Result.Canceled {
+			// This happens, for example, when the revision we're asking for has been compacted away.
+			// Reloading gets us the latest policy (and revision) and lets the next watch start from there.
+			me.Reload()
+			return fmt.Errorf("watch canceled by etcd")
+		}
+
+		for _, event := range watchResponse.Result.Events {
+			if event.Type == "DELETE" {
+				me.logger.Warnf("Policy key (%s) got deleted from etcd. Keeping the current policy", me.key)
+				continue
+			}
+
+			me.applyWatchedKeyValue(event.Kv)
+		}
+	}
+}
+
+func (me *EtcdProvider) applyWatchedKeyValue(kv etcdKeyValue) {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	revision, err := strconv.ParseInt(kv.ModRevision, 10, 64)
+	if err != nil || revision <= me.lastRevision {
+		return
+	}
+
+	me.logger.Infof("Policy changed in etcd (revision: %d)", revision)
+
+	policyBytes, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		me.logger.Warnf("Failed decoding policy value from etcd: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+		return
+	}
+
+	err = me.apply(policyBytes, true)
+	if err != nil {
+		me.logger.Warnf("Failed applying policy from etcd: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+
+	// Even if the policy is bad, there's no point in applying it again.
+	me.lastRevision = revision
+}
+
+func (me *EtcdProvider) apply(policyBytes []byte, storeInCache bool) error {
+	policyObj, err := me.parser.ParseFormat(policyBytes, policy.DetectFormat("", me.key))
+	if err != nil {
+		return err
+	}
+
+	if storeInCache {
+		err := storePolicyBytesInCacheFile(me.cachePath, policyBytes)
+		if err != nil {
+			me.logger.Warnf("failed storing policy in cache: %s", err)
+		}
+	}
+
+	err = me.store.Set(policyObj, me.Type())
+	if err != nil {
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	return nil
+}
+
+// fetchKey fetches the value of the policy key, along with its modification revision.
+func (me *EtcdProvider) fetchKey() ([]byte, int64, error) {
+	authToken, err := me.authenticate()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed authenticating: %s", err)
+	}
+
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"key": base64.StdEncoding.EncodeToString([]byte(me.key)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(me.stopContext, etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := me.doRequest(ctx, "/v3/kv/range", requestBody, authToken)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var rangeResponse etcdRangeResponse
+	err = json.NewDecoder(resp.Body).Decode(&rangeResponse)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed decoding etcd response: %s", err)
+	}
+
+	if len(rangeResponse.Kvs) == 0 {
+		return nil, 0, fmt.Errorf("key not found")
+	}
+
+	kv := rangeResponse.Kvs[0]
+
+	revision, err := strconv.ParseInt(kv.ModRevision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad modification revision (%s): %s", kv.ModRevision, err)
+	}
+
+	policyBytes, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed decoding value: %s", err)
+	}
+
+	return policyBytes, revision, nil
+}
+
+// authenticate obtains an auth token, if a username and password are configured.
+// Tokens may expire, so we obtain a new one for each request (watches are long-lived, so this doesn't happen often).
+func (me *EtcdProvider) authenticate() (string, error) {
+	if me.username == "" {
+		return "", nil
+	}
+
+	requestBody, err := json.Marshal(map[string]string{
+		"name":     me.username,
+		"password": me.password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(me.stopContext, etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := me.doRequest(ctx, "/v3/auth/authenticate", requestBody, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var authResponse struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&authResponse)
+	if err != nil {
+		return "", fmt.Errorf("failed decoding etcd response: %s", err)
+	}
+
+	return authResponse.Token, nil
+}
+
+func (me *EtcdProvider) doRequest(ctx context.Context, path string, requestBody []byte, authToken string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", me.endpoint+path, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authToken != "" {
+		req.Header.Set("Authorization", authToken)
+	}
+
+	resp, err := me.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("non-200 response from etcd (%s): %d", path, resp.StatusCode)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,271 @@
+package provider
+
+import (
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+type testEtcdEvent struct {
+	eventType string
+	value     string
+	revision  int64
+}
+
+// testEtcdServer serves a single (changeable) key through a JSON gRPC gateway, supporting watches the way etcd does
+type testEtcdServer struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	events  []testEtcdEvent
+	changed chan struct{}
+
+	// unauthorizedRequests counts requests which didn't carry the token we hand out
+	unauthorizedRequests int
+}
+
+func newTestEtcdServer(t *testing.T) *testEtcdServer {
+	server := &testEtcdServer{changed: make(chan struct{})}
+
+	encodedKey := base64.StdEncoding.EncodeToString([]byte("matrix-corporal/policy.json"))
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestBody struct {
+			Name          string `json:"name"`
+			Password      string `json:"password"`
+			Key           string `json:"key"`
+			CreateRequest struct {
+				Key           string `json:"key"`
+				StartRevision string `json:"start_revision"`
+			} `json:"create_request"`
+		}
+		json.NewDecoder(r.Body).Decode(&requestBody)
+
+		if r.URL.Path == "/v3/auth/authenticate" {
+			if requestBody.Name != "corporal" || requestBody.Password != "etcd-password" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token": "etcd-token"}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "etcd-token" {
+			server.lock.Lock()
+			server.unauthorizedRequests++
+			server.lock.Unlock()
+
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			if requestBody.Key != encodedKey {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			response := map[string]interface{}{"kvs": []interface{}{}}
+			if latest := server.getLatestEvent(); latest != nil && latest.eventType != "DELETE" {
+				response["kvs"] = []interface{}{createTestEtcdKeyValue(encodedKey, *latest)}
+			}
+			json.NewEncoder(w).Encode(response)
+		case "/v3/watch":
+			if requestBody.CreateRequest.Key != encodedKey {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			startRevision, _ := strconv.ParseInt(requestBody.CreateRequest.StartRevision, 10, 64)
+
+			encoder := json.NewEncoder(w)
+			encoder.Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+			w.(http.Flusher).Flush()
+
+			for {
+				server.lock.Lock()
+				var events []interface{}
+				for _, event := range server.events {
+					if event.revision >= startRevision {
+						events = append(events, map[string]interface{}{
+							"type": event.eventType,
+							"kv":   createTestEtcdKeyValue(encodedKey, event),
+						})
+						startRevision = event.revision + 1
+					}
+				}
+				changed := server.changed
+				server.lock.Unlock()
+
+				if len(events) != 0 {
+					encoder.Encode(map[string]interface{}{"result": map[string]interface{}{"events": events}})
+					w.(http.Flusher).Flush()
+				}
+
+				select {
+				case <-changed:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func createTestEtcdKeyValue(encodedKey string, event testEtcdEvent) map[string]interface{} {
+	keyValue := map[string]interface{}{
+		"key":          encodedKey,
+		"mod_revision": strconv.FormatInt(event.revision, 10),
+	}
+	if event.eventType != "DELETE" {
+		keyValue["value"] = base64.StdEncoding.EncodeToString([]byte(event.value))
+	}
+	return keyValue
+}
+
+func (me *testEtcdServer) getLatestEvent() *testEtcdEvent {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if len(me.events) == 0 {
+		return nil
+	}
+	latest := me.events[len(me.events)-1]
+	return &latest
+}
+
+func (me *testEtcdServer) addEvent(eventType string, value string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	// Revisions are cluster-wide, so they don't necessarily go up by one for a given key
+	me.events = append(me.events, testEtcdEvent{eventType: eventType, value: value, revision: int64(len(me.events)*10 + 5)})
+
+	close(me.changed)
+	me.changed = make(chan struct{})
+}
+
+func createTestEtcdProvider(t *testing.T, server *testEtcdServer, cachePath string) (*EtcdProvider, *policy.Store) {
+	store, parser := createTestStoreAndParser(t)
+
+	provider, err := NewEtcdProvider(configuration.PolicyProvider{
+		"Endpoint":  server.URL + "/",
+		"Key":       "matrix-corporal/policy.json",
+		"Username":  "corporal",
+		"Password":  "etcd-password",
+		"CachePath": cachePath,
+	}, store, parser, createTestLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return provider, store
+}
+
+func TestEtcdProviderWatchesForChanges(t *testing.T) {
+	server := newTestEtcdServer(t)
+	server.addEvent("", createTestValidPolicyDocument("@a:example.com"))
+
+	provider, store := createTestEtcdProvider(t, server, "")
+	loadReporter := &testLoadReporter{}
+	store.SetLoadReporter(loadReporter)
+
+	err := provider.Start()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer provider.Stop()
+
+	assertTestStoreUserIds(t, store, "@a:example.com")
+	loadedPolicy := store.Get()
+
+	server.addEvent("", createTestValidPolicyDocument("@b:example.com"))
+	waitForTestCondition(t, "the changed policy to be applied", func() bool {
+		return testStoreHasUserIds(store, "@b:example.com")
+	})
+	if loadedPolicy == store.Get() {
+		t.Errorf("expected a new policy")
+	}
+
+	// Deleting the key keeps the current policy, while bad policies are reported (and not applied)
+	server.addEvent("DELETE", "")
+	server.addEvent("", `{"schemaVersion": 1, `)
+	waitForTestCondition(t, "the bad policy to be reported", func() bool {
+		return loadReporter.failuresCount() == 1
+	})
+	assertTestStoreUserIds(t, store, "@b:example.com")
+
+	server.addEvent("", createTestValidPolicyDocument("@c:example.com"))
+	waitForTestCondition(t, "the fixed policy to be applied", func() bool {
+		return testStoreHasUserIds(store, "@c:example.com")
+	})
+
+	server.lock.Lock()
+	if server.unauthorizedRequests != 0 {
+		t.Errorf("expected all requests to be authenticated, got %d which weren't", server.unauthorizedRequests)
+	}
+	server.lock.Unlock()
+}
+
+func TestEtcdProviderFallsBackToTheCache(t *testing.T) {
+	directory, err := ioutil.TempDir("", "etcd-provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	cachePath := filepath.Join(directory, "policy.json")
+
+	server := newTestEtcdServer(t)
+
+	// The key doesn't exist yet and there's nothing cached
+	provider, store := createTestEtcdProvider(t, server, cachePath)
+	err = provider.load(true)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+
+	server.addEvent("", createTestValidPolicyDocument("@a:example.com"))
+	err = provider.load(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if provider.lastRevision != 5 {
+		t.Errorf("expected the revision to be remembered, got: %d", provider.lastRevision)
+	}
+
+	// Once etcd is unreachable, starting up falls back to what got cached, while reloading doesn't
+	server.Close()
+
+	provider, store = createTestEtcdProvider(t, server, cachePath)
+	err = provider.load(false)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+
+	err = provider.load(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertTestStoreUserIds(t, store, "@a:example.com")
+}
@@ -3,6 +3,7 @@ package provider
 import (
 	"devture-matrix-corporal/corporal/configuration"
 	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/vault"
 	"fmt"
 
 	"github.com/sirupsen/logrus"
@@ -11,6 +12,8 @@ import (
 func CreateProviderByConfig(
 	config configuration.PolicyProvider,
 	store *policy.Store,
+	parser *policy.Parser,
+	vaultClient *vault.Client,
 	logger *logrus.Logger,
 ) (Provider, error) {
 	providerType, exists := config["Type"]
@@ -19,15 +22,47 @@ func CreateProviderByConfig(
 	}
 
 	if providerType == "static_file" {
-		return NewStaticFileProvider(config, store, logger)
+		return NewStaticFileProvider(config, store, parser, logger)
 	}
 
 	if providerType == "http" {
-		return NewHttpProvider(config, store, logger)
+		return NewHttpProvider(config, store, parser, logger)
+	}
+
+	if providerType == "bundle" {
+		return NewBundleProvider(config, store, parser, logger)
+	}
+
+	if providerType == "graphql" {
+		return NewGraphqlProvider(config, store, parser, logger)
+	}
+
+	if providerType == "s3" {
+		return NewS3Provider(config, store, parser, logger)
+	}
+
+	if providerType == "consul" {
+		return NewConsulProvider(config, store, parser, logger)
+	}
+
+	if providerType == "etcd" {
+		return NewEtcdProvider(config, store, parser, logger)
+	}
+
+	if providerType == "nats" {
+		return NewNatsProvider(config, store, parser, logger)
+	}
+
+	if providerType == "kubernetes" {
+		return NewKubernetesProvider(config, store, parser, logger)
+	}
+
+	if providerType == "vault" {
+		return NewVaultProvider(config, store, parser, vaultClient, logger)
 	}
 
 	if providerType == "last_seen_store_policy" {
-		return NewLastSeenStorePolicyProvider(config, store, logger)
+		return NewLastSeenStorePolicyProvider(config, store, parser, logger)
 	}
 
 	return nil, fmt.Errorf("Unknown provider type: %s", providerType)
@@ -0,0 +1,293 @@
+package provider
+
+import (
+	"bytes"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GraphqlProvider is a policy provider which executes a GraphQL query against some endpoint (e.g. an identity provider's API)
+// and maps the result into a policy document, according to a mapping specification (see graphqlMapping).
+type GraphqlProvider struct {
+	store                    *policy.Store
+	parser                   *policy.Parser
+	uri                      string
+	query                    string
+	variables                map[string]interface{}
+	authorizationBearerToken string
+	mapping                  *graphqlMapping
+	cachePath                *string
+	reloadIntervalSeconds    *int
+	reloadPollingPolicy      pollingPolicy
+	logger                   *logrus.Logger
+
+	httpClient   *http.Client
+	reloadPoller *poller
+	lockLoad     sync.Mutex
+}
+
+type graphqlRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphqlResponse struct {
+	Data   interface{} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func NewGraphqlProvider(
+	config configuration.PolicyProvider,
+	store *policy.Store,
+	parser *policy.Parser,
+	logger *logrus.Logger,
+) (*GraphqlProvider, error) {
+	uri, err := getRequiredStringConfigValue(config, "Uri")
+	if err != nil {
+		return nil, fmt.Errorf("GraphQL provider: %s", err)
+	}
+
+	query, err := getRequiredStringConfigValue(config, "Query")
+	if err != nil {
+		return nil, fmt.Errorf("GraphQL provider: %s", err)
+	}
+
+	var variables map[string]interface{}
+	if config["Variables"] != nil {
+		var ok bool
+		variables, ok = config["Variables"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("GraphQL provider: Variables is expected to be an object or NULL")
+		}
+	}
+
+	authorizationBearerToken, err := getOptionalStringConfigValue(config, "AuthorizationBearerToken")
+	if err != nil {
+		return nil, fmt.Errorf("GraphQL provider: %s", err)
+	}
+
+	mapping, err := parseGraphqlMapping(config["Mapping"])
+	if err != nil {
+		return nil, fmt.Errorf("GraphQL provider: %s", err)
+	}
+
+	cachePath, err := getOptionalStringConfigValue(config, "CachePath")
+	if err != nil {
+		return nil, fmt.Errorf("GraphQL provider: %s", err)
+	}
+	var cachePathPtr *string
+	if cachePath != "" {
+		cachePathPtr = &cachePath
+	}
+
+	reloadIntervalSecondsPtr, err := getOptionalIntConfigValue(config, "ReloadIntervalSeconds")
+	if err != nil {
+		return nil, fmt.Errorf("GraphQL provider: %s", err)
+	}
+	if reloadIntervalSecondsPtr != nil && *reloadIntervalSecondsPtr <= 0 {
+		reloadIntervalSecondsPtr = nil
+	}
+
+	var timeoutDuration time.Duration
+	timeoutMillisecondsPtr, err := getOptionalIntConfigValue(config, "TimeoutMilliseconds")
+	if err != nil {
+		return nil, fmt.Errorf("GraphQL provider: %s", err)
+	}
+	if timeoutMillisecondsPtr != nil && *timeoutMillisecondsPtr > 0 {
+		timeoutDuration = time.Duration(*timeoutMillisecondsPtr) * time.Millisecond
+	}
+
+	reloadPollingPolicy, err := parsePollingPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("GraphQL provider: %s", err)
+	}
+
+	return &GraphqlProvider{
+		store:                    store,
+		parser:                   parser,
+		uri:                      uri,
+		query:                    query,
+		variables:                variables,
+		authorizationBearerToken: authorizationBearerToken,
+		mapping:                  mapping,
+		cachePath:                cachePathPtr,
+		reloadIntervalSeconds:    reloadIntervalSecondsPtr,
+		reloadPollingPolicy:      reloadPollingPolicy,
+		logger:                   logger,
+
+		httpClient: &http.Client{
+			Timeout: timeoutDuration,
+		},
+	}, nil
+}
+
+func (me *GraphqlProvider) Type() string {
+	return "graphql"
+}
+
+func (me *GraphqlProvider) Start() error {
+	me.logger.Infof("Starting policy provider: %s (%s)", me.Type(), me.uri)
+
+	err := me.load(true)
+
+	if err != nil {
+		return err
+	}
+
+	if me.reloadIntervalSeconds != nil {
+		me.logger.Infof("Auto-reloading for policy provider %s will happen every %d seconds", me.Type(), *me.reloadIntervalSeconds)
+
+		me.reloadPoller = newPoller(
+			me.Type(),
+			time.Duration(*me.reloadIntervalSeconds)*time.Second,
+			me.reloadPollingPolicy,
+			func() error {
+				return me.load(false)
+			},
+			me.store,
+			me.logger,
+		)
+		me.reloadPoller.start()
+	}
+
+	return nil
+}
+
+func (me *GraphqlProvider) Stop() {
+	me.logger.Infof("Stopping policy provider: %s", me.Type())
+
+	if me.reloadPoller != nil {
+		me.reloadPoller.stop()
+	}
+}
+
+func (me *GraphqlProvider) Reload() {
+	me.logger.Infof("Reloading policy from provider: %s", me.Type())
+
+	err := me.load(false)
+	if err != nil {
+		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+func (me *GraphqlProvider) load(allowedToLoadFromCache bool) error {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	isFromCache := false
+
+	responseBytes, errRemote := me.executeQuery()
+	if errRemote != nil {
+		me.logger.Warnf("Failed loading policy from GraphQL endpoint (%s): %s", me.uri, errRemote)
+
+		if !allowedToLoadFromCache {
+			return fmt.Errorf("failed loading policy from GraphQL endpoint (%s), while cache-loading is not allowed", errRemote)
+		}
+
+		var errCache error
+		responseBytes, errCache = loadPolicyBytesFromCacheFile(me.cachePath)
+		if errCache != nil {
+			return fmt.Errorf("failed loading policy from GraphQL endpoint (%s) and from cache (%s)", errRemote, errCache)
+		}
+
+		me.logger.Debugf("Successfully loaded policy from cache")
+		isFromCache = true
+	}
+
+	// We cache the query result (not the policy we've built out of it),
+	// so that a mapping change is also applied to cache-restored policies.
+	policyObj, err := me.buildPolicy(responseBytes)
+	if err != nil {
+		return err
+	}
+
+	if !isFromCache {
+		err := storePolicyBytesInCacheFile(me.cachePath, responseBytes)
+		if err != nil {
+			me.logger.Warnf("failed storing policy in cache: %s", err)
+		}
+	}
+
+	err = me.store.Set(policyObj, me.Type())
+	if err != nil {
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	return nil
+}
+
+func (me *GraphqlProvider) buildPolicy(responseBytes []byte) (*policy.Policy, error) {
+	var response graphqlResponse
+	err := json.Unmarshal(responseBytes, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding GraphQL response: %s", err)
+	}
+
+	// A GraphQL endpoint may return partial data along with errors. We don't want to build a policy out of partial data.
+	if len(response.Errors) > 0 {
+		return nil, fmt.Errorf("GraphQL query failed with %d error(s), the first one being: %s", len(response.Errors), response.Errors[0].Message)
+	}
+
+	if response.Data == nil {
+		return nil, fmt.Errorf("GraphQL response does not contain any data")
+	}
+
+	document, err := me.mapping.buildPolicyDocument(response.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed mapping GraphQL response to a policy: %s", err)
+	}
+
+	documentBytes, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return me.parser.ParseFormat(documentBytes, policy.FormatJSON)
+}
+
+func (me *GraphqlProvider) executeQuery() ([]byte, error) {
+	requestBytes, err := json.Marshal(graphqlRequest{
+		Query:     me.query,
+		Variables: me.variables,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", me.uri, bytes.NewReader(requestBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if me.authorizationBearerToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", me.authorizationBearerToken))
+	}
+
+	resp, err := me.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("non-200 response from GraphQL endpoint: %d", resp.StatusCode)
+	}
+
+	bodyBytes, err := policy.ReadDocument(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading GraphQL response body: %s", err)
+	}
+
+	return bodyBytes, nil
+}
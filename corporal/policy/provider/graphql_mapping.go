@@ -0,0 +1,172 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// graphqlMapping describes how a GraphQL query result gets turned into a policy document.
+//
+// Paths are dot-separated (e.g. `organization.members.nodes`) and are relative to the result's `data` object
+// (or to the current node, for user fields). Whenever a path goes through a list, it applies to each list item
+// and the results get collected into a (flattened) list.
+type graphqlMapping struct {
+	// Policy holds static policy fields (e.g. `schemaVersion`, `flags`, `hooks`), which the mapped values get added to.
+	Policy map[string]interface{}
+
+	Users *graphqlUsersMapping
+
+	// ManagedRoomIds is a path pointing to the room ids (strings) that matrix-corporal is to manage.
+	ManagedRoomIds string
+}
+
+type graphqlUsersMapping struct {
+	// Path points to the list of nodes, each of which becomes a user policy.
+	Path string
+
+	// Fields maps user policy fields (e.g. `id`, `displayName`, `joinedRoomIds`) to paths relative to each node.
+	Fields map[string]string
+
+	// Defaults holds user policy fields applied to all users, unless mapped to a (non-null) value.
+	Defaults map[string]interface{}
+}
+
+func parseGraphqlMapping(mappingInterface interface{}) (*graphqlMapping, error) {
+	if mappingInterface == nil {
+		return nil, fmt.Errorf("missing a required configuration key: Mapping")
+	}
+
+	// The mapping is a nested configuration object, so it's easiest to go through JSON to get it into shape.
+	mappingBytes, err := json.Marshal(mappingInterface)
+	if err != nil {
+		return nil, fmt.Errorf("bad Mapping: %s", err)
+	}
+
+	var mapping graphqlMapping
+	err = json.Unmarshal(mappingBytes, &mapping)
+	if err != nil {
+		return nil, fmt.Errorf("bad Mapping: %s", err)
+	}
+
+	if mapping.Users != nil {
+		if mapping.Users.Path == "" {
+			return nil, fmt.Errorf("bad Mapping: Users.Path needs to be specified")
+		}
+
+		if _, exists := mapping.Users.Fields["id"]; !exists {
+			return nil, fmt.Errorf("bad Mapping: Users.Fields needs to map the `id` field")
+		}
+	}
+
+	return &mapping, nil
+}
+
+// buildPolicyDocument builds a policy document out of the `data` of a GraphQL query result.
+func (me *graphqlMapping) buildPolicyDocument(data interface{}) (map[string]interface{}, error) {
+	document := make(map[string]interface{})
+	for key, value := range me.Policy {
+		document[key] = value
+	}
+
+	if me.Users != nil {
+		nodes, ok := resolveGraphqlListPath(data, me.Users.Path)
+		if !ok {
+			return nil, fmt.Errorf("users path `%s` does not point to anything", me.Users.Path)
+		}
+
+		// Copying, so that appending doesn't touch the static policy's list
+		staticUsers, _ := document["users"].([]interface{})
+		users := append([]interface{}{}, staticUsers...)
+		for _, node := range nodes {
+			user := make(map[string]interface{})
+			for key, value := range me.Users.Defaults {
+				user[key] = value
+			}
+
+			for field, path := range me.Users.Fields {
+				value := resolveGraphqlPath(node, path)
+				if value != nil {
+					user[field] = value
+				}
+			}
+
+			if _, ok := user["id"].(string); !ok {
+				return nil, fmt.Errorf("a user node does not have a string value at `%s` (to be used as `id`)", me.Users.Fields["id"])
+			}
+
+			users = append(users, user)
+		}
+		document["users"] = users
+	}
+
+	if me.ManagedRoomIds != "" {
+		roomIds, ok := resolveGraphqlListPath(data, me.ManagedRoomIds)
+		if !ok {
+			return nil, fmt.Errorf("managed room ids path `%s` does not point to anything", me.ManagedRoomIds)
+		}
+
+		staticManagedRoomIds, _ := document["managedRoomIds"].([]interface{})
+		managedRoomIds := append([]interface{}{}, staticManagedRoomIds...)
+		document["managedRoomIds"] = append(managedRoomIds, roomIds...)
+	}
+
+	return document, nil
+}
+
+// resolveGraphqlPath resolves a dot-separated path against the given value, returning nil if it doesn't point to anything.
+func resolveGraphqlPath(value interface{}, path string) interface{} {
+	if path == "" {
+		return value
+	}
+	return resolveGraphqlPathSegments(value, strings.Split(path, "."))
+}
+
+// resolveGraphqlListPath is like resolveGraphqlPath, but always returns a list (wrapping single values).
+func resolveGraphqlListPath(value interface{}, path string) ([]interface{}, bool) {
+	resolved := resolveGraphqlPath(value, path)
+	if resolved == nil {
+		return nil, false
+	}
+
+	if list, ok := resolved.([]interface{}); ok {
+		return list, true
+	}
+
+	return []interface{}{resolved}, true
+}
+
+func resolveGraphqlPathSegments(value interface{}, segments []string) interface{} {
+	switch typedValue := value.(type) {
+	case []interface{}:
+		result := make([]interface{}, 0, len(typedValue))
+		for _, item := range typedValue {
+			resolved := resolveGraphqlPathSegments(item, segments)
+			if resolved == nil {
+				continue
+			}
+
+			if list, ok := resolved.([]interface{}); ok {
+				result = append(result, list...)
+			} else {
+				result = append(result, resolved)
+			}
+		}
+		return result
+	case map[string]interface{}:
+		if len(segments) == 0 {
+			return typedValue
+		}
+
+		child, exists := typedValue[segments[0]]
+		if !exists {
+			return nil
+		}
+		return resolveGraphqlPathSegments(child, segments[1:])
+	default:
+		if len(segments) == 0 {
+			return value
+		}
+		return nil
+	}
+}
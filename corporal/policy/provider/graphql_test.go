@@ -0,0 +1,228 @@
+package provider
+
+import (
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+const testGraphqlProviderConfig = `{
+	"Query": "query($org: String!) { organization(login: $org) { members { nodes { matrixId name teams { nodes { roomId } } } } rooms { roomId } } }",
+	"Variables": {"org": "example"},
+	"AuthorizationBearerToken": "graphql-token",
+	"Mapping": {
+		"Policy": {"schemaVersion": 1, "managedRoomIds": ["!static:example.com"]},
+		"Users": {
+			"Path": "organization.members.nodes",
+			"Fields": {"id": "matrixId", "displayName": "name", "joinedRoomIds": "teams.nodes.roomId"},
+			"Defaults": {"active": true, "authType": "plain", "authCredential": "secret", "displayName": "Unnamed"}
+		},
+		"ManagedRoomIds": "organization.rooms.roomId"
+	}
+}`
+
+const testGraphqlResponse = `{"data": {"organization": {
+	"members": {"nodes": [
+		{"matrixId": "@a:example.com", "name": "A", "teams": {"nodes": [{"roomId": "!one:example.com"}, {"roomId": "!two:example.com"}]}},
+		{"matrixId": "@b:example.com", "name": null, "teams": {"nodes": []}}
+	]},
+	"rooms": [{"roomId": "!one:example.com"}, {"roomId": "!two:example.com"}]
+}}}`
+
+// testGraphqlServer responds to queries with a (changeable) response, after checking that the request is what the test config asks for
+type testGraphqlServer struct {
+	*httptest.Server
+
+	lock       sync.Mutex
+	response   string
+	statusCode int
+}
+
+func newTestGraphqlServer(t *testing.T) *testGraphqlServer {
+	server := &testGraphqlServer{response: testGraphqlResponse, statusCode: http.StatusOK}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request graphqlRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || r.Method != "POST" || request.Variables["org"] != "example" || r.Header.Get("Authorization") != "Bearer graphql-token" {
+			t.Errorf("unexpected request: %s %#v (authorization: %s)", r.Method, request, r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		server.lock.Lock()
+		defer server.lock.Unlock()
+
+		w.WriteHeader(server.statusCode)
+		w.Write([]byte(server.response))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (me *testGraphqlServer) respondWith(statusCode int, response string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.statusCode = statusCode
+	me.response = response
+}
+
+func createTestGraphqlProvider(t *testing.T, server *testGraphqlServer, cachePath string) (*GraphqlProvider, *policy.Store) {
+	store, parser := createTestStoreAndParser(t)
+
+	var config configuration.PolicyProvider
+	err := json.Unmarshal([]byte(testGraphqlProviderConfig), &config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	config["Uri"] = server.URL
+	config["CachePath"] = cachePath
+
+	provider, err := NewGraphqlProvider(config, store, parser, createTestLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return provider, store
+}
+
+func TestGraphqlProviderMapsQueryResults(t *testing.T) {
+	server := newTestGraphqlServer(t)
+
+	provider, store := createTestGraphqlProvider(t, server, "")
+	err := provider.load(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	assertTestStoreUserIds(t, store, "@a:example.com", "@b:example.com")
+
+	currentPolicy := store.Get()
+
+	expectedManagedRoomIds := []string{"!static:example.com", "!one:example.com", "!two:example.com"}
+	if !reflect.DeepEqual(currentPolicy.ManagedRoomIds, expectedManagedRoomIds) {
+		t.Errorf("expected managed room ids %v, got %v", expectedManagedRoomIds, currentPolicy.ManagedRoomIds)
+	}
+
+	userA := currentPolicy.GetUserPolicyByUserId("@a:example.com")
+	if userA.DisplayName != "A" || !userA.Active || !reflect.DeepEqual(userA.JoinedRoomIds, []string{"!one:example.com", "!two:example.com"}) {
+		t.Errorf("unexpected user policy: %#v", userA)
+	}
+
+	// Null values leave the defaults in place
+	userB := currentPolicy.GetUserPolicyByUserId("@b:example.com")
+	if userB.DisplayName != "Unnamed" || len(userB.JoinedRoomIds) != 0 {
+		t.Errorf("unexpected user policy: %#v", userB)
+	}
+
+	// Reloading picks up changes
+	server.respondWith(http.StatusOK, `{"data": {"organization": {"members": {"nodes": [{"matrixId": "@c:example.com"}]}, "rooms": []}}}`)
+	err = provider.load(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertTestStoreUserIds(t, store, "@c:example.com")
+}
+
+func TestGraphqlProviderRejectsFailedQueries(t *testing.T) {
+	type testData struct {
+		name       string
+		statusCode int
+		response   string
+	}
+
+	tests := []testData{
+		{"non-200 response", http.StatusInternalServerError, testGraphqlResponse},
+		{"not JSON", http.StatusOK, `{"data": `},
+		{"errors along with partial data", http.StatusOK, `{"data": {"organization": null}, "errors": [{"message": "Could not resolve to an Organization"}]}`},
+		{"no data", http.StatusOK, `{"data": null}`},
+		{"missing users path", http.StatusOK, `{"data": {"organization": {"rooms": []}}}`},
+		{"user without an id", http.StatusOK, `{"data": {"organization": {"members": {"nodes": [{"name": "A"}]}, "rooms": []}}}`},
+		{"invalid policy", http.StatusOK, `{"data": {"organization": {"members": {"nodes": [{"matrixId": "@a:other.com"}]}, "rooms": []}}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestGraphqlServer(t)
+			server.respondWith(test.statusCode, test.response)
+
+			provider, store := createTestGraphqlProvider(t, server, "")
+			err := provider.load(false)
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+			if store.Get() != nil {
+				t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+			}
+		})
+	}
+}
+
+func TestGraphqlProviderFallsBackToTheCache(t *testing.T) {
+	directory, err := ioutil.TempDir("", "graphql-provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	cachePath := filepath.Join(directory, "response.json")
+
+	server := newTestGraphqlServer(t)
+
+	provider, _ := createTestGraphqlProvider(t, server, cachePath)
+	err = provider.load(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The query result is cached, not the policy built out of it
+	cachedBytes, _ := ioutil.ReadFile(cachePath)
+	if string(cachedBytes) != testGraphqlResponse {
+		t.Errorf("expected the query result to be cached, got: %s", cachedBytes)
+	}
+
+	server.respondWith(http.StatusBadGateway, "")
+
+	provider, store := createTestGraphqlProvider(t, server, cachePath)
+	err = provider.load(false)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+
+	err = provider.load(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertTestStoreUserIds(t, store, "@a:example.com", "@b:example.com")
+}
+
+func TestParseGraphqlMappingRejectsInvalidMappings(t *testing.T) {
+	tests := map[string]interface{}{
+		"missing mapping":  nil,
+		"not an object":    "users",
+		"no users path":    map[string]interface{}{"Users": map[string]interface{}{"Fields": map[string]interface{}{"id": "matrixId"}}},
+		"no users id path": map[string]interface{}{"Users": map[string]interface{}{"Path": "users", "Fields": map[string]interface{}{"displayName": "name"}}},
+	}
+
+	for name, mapping := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseGraphqlMapping(mapping)
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -1,9 +1,10 @@
 package provider
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"devture-matrix-corporal/corporal/configuration"
 	"devture-matrix-corporal/corporal/policy"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -16,25 +17,46 @@ import (
 
 type HttpProvider struct {
 	store                    *policy.Store
+	parser                   *policy.Parser
 	uri                      string
 	authorizationBearerToken string
+	jwtSigner                *httpJwtSigner
 	cachePath                *string
 	reloadIntervalSeconds    *int
+	reloadPollingPolicy      pollingPolicy
 	logger                   *logrus.Logger
 
 	httpClient   *http.Client
-	reloadTicker *time.Ticker
+	reloadPoller *poller
 	lockLoad     sync.Mutex
+
+	// lastValidators holds the validators (ETag, Last-Modified) of the last policy we've successfully loaded from the remote
+	lastValidators httpResponseValidators
+
+	// lastContentHash holds the SHA-256 hash of the last policy document we've successfully loaded from the remote
+	lastContentHash []byte
+
+	signatureRequirement *providerSignatureRequirement
+
+	// fetchedDetachedSignature holds the detached signature fetched (and verified) along with the policy during the current load,
+	// so that it can be cached along with it. It's guarded by lockLoad.
+	fetchedDetachedSignature []byte
+}
+
+// httpResponseValidators holds response headers which let us make conditional requests later on
+type httpResponseValidators struct {
+	eTag         string
+	lastModified string
 }
 
 func NewHttpProvider(
 	config configuration.PolicyProvider,
 	store *policy.Store,
+	parser *policy.Parser,
 	logger *logrus.Logger,
 ) (*HttpProvider, error) {
 	configKeys := []string{
 		"Uri",
-		"AuthorizationBearerToken",
 		"CachePath",
 		"ReloadIntervalSeconds",
 		"TimeoutMilliseconds",
@@ -76,17 +98,55 @@ func NewHttpProvider(
 		}
 	}
 
+	authorizationBearerToken, err := getOptionalStringConfigValue(config, "AuthorizationBearerToken")
+	if err != nil {
+		return nil, fmt.Errorf("HTTP provider: %s", err)
+	}
+
+	jwtSigner, err := newHttpJwtSignerFromConfig(config["Jwt"])
+	if err != nil {
+		return nil, fmt.Errorf("HTTP provider: %s", err)
+	}
+
+	httpClient := &http.Client{
+		Timeout: timeoutDuration,
+	}
+
+	tlsConfig, err := buildHttpTlsConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP provider: %s", err)
+	}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient.Transport = transport
+	}
+
+	reloadPollingPolicy, err := parsePollingPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP provider: %s", err)
+	}
+
+	signatureRequirement, err := parseProviderSignatureRequirement(config)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP provider: %s", err)
+	}
+	parser = restrictParserForSignatureRequirement(parser, signatureRequirement)
+
 	return &HttpProvider{
 		store:                    store,
+		parser:                   parser,
 		uri:                      config["Uri"].(string),
-		authorizationBearerToken: config["AuthorizationBearerToken"].(string),
+		authorizationBearerToken: authorizationBearerToken,
+		jwtSigner:                jwtSigner,
 		cachePath:                cachePathPtr,
 		reloadIntervalSeconds:    reloadIntervalSecondsPtr,
+		reloadPollingPolicy:      reloadPollingPolicy,
 		logger:                   logger,
 
-		httpClient: &http.Client{
-			Timeout: timeoutDuration,
-		},
+		httpClient: httpClient,
+
+		signatureRequirement: signatureRequirement,
 	}, nil
 }
 
@@ -97,7 +157,7 @@ func (me *HttpProvider) Type() string {
 func (me *HttpProvider) Start() error {
 	me.logger.Infof("Starting policy provider: %s (%s)", me.Type(), me.uri)
 
-	err := me.load(true)
+	err := me.load(true, false)
 
 	if err != nil {
 		return err
@@ -106,14 +166,17 @@ func (me *HttpProvider) Start() error {
 	if me.reloadIntervalSeconds != nil {
 		me.logger.Infof("Auto-reloading for policy provider %s will happen every %d seconds", me.Type(), *me.reloadIntervalSeconds)
 
-		me.reloadTicker = time.NewTicker(time.Duration(*me.reloadIntervalSeconds) * time.Second)
-
-		go func() {
-			for range me.reloadTicker.C {
-				me.logger.Infof("Auto-reloading for policy provider: %s", me.Type())
-				me.Reload()
-			}
-		}()
+		me.reloadPoller = newPoller(
+			me.Type(),
+			time.Duration(*me.reloadIntervalSeconds)*time.Second,
+			me.reloadPollingPolicy,
+			func() error {
+				return me.load(false, true)
+			},
+			me.store,
+			me.logger,
+		)
+		me.reloadPoller.start()
 	}
 
 	return nil
@@ -122,118 +185,255 @@ func (me *HttpProvider) Start() error {
 func (me *HttpProvider) Stop() {
 	me.logger.Infof("Stopping policy provider: %s", me.Type())
 
-	if me.reloadTicker != nil {
-		me.reloadTicker.Stop()
+	if me.reloadPoller != nil {
+		me.reloadPoller.stop()
 	}
 }
 
 func (me *HttpProvider) Reload() {
 	me.logger.Infof("Reloading policy from provider: %s", me.Type())
 
-	err := me.load(false)
+	// An explicit reload means "fetch fresh data", so we neither make the request conditional,
+	// nor skip re-parsing an identical document (which may include other documents that have changed).
+	err := me.load(false, false)
 	if err != nil {
 		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
 	}
 }
 
-func (me *HttpProvider) load(allowedToLoadFromCache bool) error {
+// load loads the policy, either from the remote or from the cache.
+// When conditional is true, an unchanged remote policy (as determined by the server or by us) is not re-applied.
+func (me *HttpProvider) load(allowedToLoadFromCache bool, conditional bool) error {
 	me.lockLoad.Lock()
 	defer me.lockLoad.Unlock()
 
-	policy, isFromCache, err := me.doLoad(allowedToLoadFromCache)
+	policy, policyBytes, validators, isFromCache, err := me.doLoad(allowedToLoadFromCache, conditional)
 	if err != nil {
 		return err
 	}
 
+	if policy == nil {
+		// Unchanged. The server may have started sending validators for the same document though.
+		if validators != (httpResponseValidators{}) {
+			me.lastValidators = validators
+		}
+		return nil
+	}
+
 	if !isFromCache {
-		err := me.storePolicyInCache(policy)
+		err := me.storePolicyBytesInCache(policyBytes)
 		if err != nil {
 			me.logger.Warnf("failed storing policy in cache: %s", err)
 		}
 	}
 
-	err = me.store.Set(policy)
+	err = me.store.Set(policy, me.Type())
 	if err != nil {
 		return fmt.Errorf("policy set error: %s", err)
 	}
 
+	if !isFromCache {
+		me.lastValidators = validators
+		me.lastContentHash = hashPolicyBytes(policyBytes)
+	}
+
 	return nil
 }
 
-func (me *HttpProvider) doLoad(allowedToLoadFromCache bool) (*policy.Policy /* isFromCache */, bool, error) {
-	policy, errRemote := me.loadPolicyFromRemote()
+func (me *HttpProvider) doLoad(
+	allowedToLoadFromCache bool,
+	conditional bool,
+) (*policy.Policy, []byte, httpResponseValidators, bool /* isFromCache */, error) {
+	policy, policyBytes, validators, errRemote := me.loadPolicyFromRemote(conditional)
 	if errRemote == nil {
-		me.logger.Debugf("Successfully loaded policy from URL: %s", me.uri)
-		return policy, false, nil
+		if policy == nil {
+			me.logger.Debugf("Policy at URL is unchanged: %s", me.uri)
+		} else {
+			me.logger.Debugf("Successfully loaded policy from URL: %s", me.uri)
+		}
+		return policy, policyBytes, validators, false, nil
 	}
 
 	me.logger.Warnf("Failed loading policy from URL (%s): %s", me.uri, errRemote)
 
 	if !allowedToLoadFromCache {
-		return nil, false, fmt.Errorf("failed loading policy from remote (%s), while cache-loading is not allowed", errRemote)
+		return nil, nil, validators, false, fmt.Errorf("failed loading policy from remote (%s), while cache-loading is not allowed", errRemote)
 	}
 
-	policy, errCache := me.loadPolicyFromCache()
+	policy, policyBytes, errCache := me.loadPolicyFromCache()
 	if errCache == nil {
 		me.logger.Debugf("Successfully loaded policy from cache")
-		return policy, true, nil
+		return policy, policyBytes, validators, true, nil
 	}
 
-	return nil, false, fmt.Errorf("failed loading policy from remote (%s) and from cache (%s)", errRemote, errCache)
+	return nil, nil, validators, false, fmt.Errorf("failed loading policy from remote (%s) and from cache (%s)", errRemote, errCache)
 }
 
-func (me *HttpProvider) loadPolicyFromRemote() (*policy.Policy, error) {
+// loadPolicyFromRemote fetches and parses the policy.
+// When conditional is true and the policy is unchanged since the last load, a nil policy (and no error) is returned.
+func (me *HttpProvider) loadPolicyFromRemote(conditional bool) (*policy.Policy, []byte, httpResponseValidators, error) {
+	var validators httpResponseValidators
+
 	req, err := http.NewRequest("GET", me.uri, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, validators, err
+	}
+	err = me.authenticateRequest(req)
+	if err != nil {
+		return nil, nil, validators, err
+	}
+
+	if conditional {
+		if me.lastValidators.eTag != "" {
+			req.Header.Set("If-None-Match", me.lastValidators.eTag)
+		}
+		if me.lastValidators.lastModified != "" {
+			req.Header.Set("If-Modified-Since", me.lastValidators.lastModified)
+		}
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", me.authorizationBearerToken))
 
 	resp, err := me.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, validators, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		return nil, nil, me.lastValidators, nil
+	}
+
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("non-200 response fetching from URL: %d", resp.StatusCode)
+		return nil, nil, validators, fmt.Errorf("non-200 response fetching from URL: %d", resp.StatusCode)
+	}
+
+	validators.eTag = resp.Header.Get("ETag")
+	validators.lastModified = resp.Header.Get("Last-Modified")
+
+	// Go's HTTP client transparently takes care of `Content-Encoding: gzip` responses,
+	// so this mostly handles pre-compressed documents served without such a header.
+	bodyBytes, err := policy.ReadDocument(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, nil, validators, fmt.Errorf("failed reading HTTP response body: %s", err)
+	}
+
+	// Not all servers support conditional requests, so we also avoid re-parsing (and re-applying) identical documents ourselves.
+	if conditional && me.lastContentHash != nil && bytes.Equal(hashPolicyBytes(bodyBytes), me.lastContentHash) {
+		return nil, nil, validators, nil
+	}
+
+	documentBytes := bodyBytes
+	if me.signatureRequirement != nil {
+		var detachedSignature []byte
+		if me.signatureRequirement.isDetached() {
+			detachedSignature, err = me.fetchDetachedSignature()
+			if err != nil {
+				return nil, nil, validators, fmt.Errorf("failed fetching detached policy signature: %s", err)
+			}
+		}
+
+		documentBytes, err = me.signatureRequirement.verify(bodyBytes, detachedSignature)
+		if err != nil {
+			return nil, nil, validators, fmt.Errorf("policy signature error: %s", err)
+		}
+
+		me.fetchedDetachedSignature = detachedSignature
 	}
 
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	policy, err := me.parser.Parse(documentBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed reading HTTP response body: %s", err)
+		return nil, nil, validators, err
 	}
 
-	return createPolicyFromJsonBytes(bodyBytes)
+	return policy, bodyBytes, validators, nil
 }
 
-func (me *HttpProvider) loadPolicyFromCache() (*policy.Policy, error) {
-	if me.cachePath == nil {
-		return nil, fmt.Errorf("cache disabled")
+func (me *HttpProvider) fetchDetachedSignature() ([]byte, error) {
+	signatureUri := me.signatureRequirement.uri
+	if signatureUri == "" {
+		signatureUri = me.uri + ".sig"
 	}
 
-	file, err := os.Open(*me.cachePath)
+	req, err := http.NewRequest("GET", signatureUri, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = me.authenticateRequest(req)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	bytes, err := ioutil.ReadAll(file)
+	resp, err := me.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	return createPolicyFromJsonBytes(bytes)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("non-200 response fetching from URL (%s): %d", signatureUri, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
 }
 
-func (me *HttpProvider) storePolicyInCache(policy *policy.Policy) error {
+func (me *HttpProvider) authenticateRequest(req *http.Request) error {
+	if me.jwtSigner != nil {
+		token, err := me.jwtSigner.Mint()
+		if err != nil {
+			return fmt.Errorf("failed minting JWT: %s", err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	} else if me.authorizationBearerToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", me.authorizationBearerToken))
+	}
+	return nil
+}
+
+func (me *HttpProvider) loadPolicyFromCache() (*policy.Policy, []byte, error) {
 	if me.cachePath == nil {
-		return nil
+		return nil, nil, fmt.Errorf("cache disabled")
 	}
 
-	jsonBytes, err := json.Marshal(policy)
+	file, err := os.Open(*me.cachePath)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	bytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// We cache the policy document exactly as we've received it from the remote,
+	// so that signed policies can be verified again when restoring them from the cache.
+	documentBytes := bytes
+	if me.signatureRequirement != nil {
+		var detachedSignature []byte
+		if me.signatureRequirement.isDetached() {
+			detachedSignature, err = readDetachedSignatureFile(*detachedSignatureCachePath(me.cachePath))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed reading cached detached policy signature: %s", err)
+			}
+		}
+
+		documentBytes, err = me.signatureRequirement.verify(bytes, detachedSignature)
+		if err != nil {
+			return nil, nil, fmt.Errorf("policy signature error: %s", err)
+		}
+	}
+
+	policy, err := me.parser.Parse(documentBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return policy, bytes, nil
+}
+
+func (me *HttpProvider) storePolicyBytesInCache(policyBytes []byte) error {
+	if me.cachePath == nil {
+		return nil
 	}
 
 	file, err := os.Create(*me.cachePath)
@@ -242,10 +442,19 @@ func (me *HttpProvider) storePolicyInCache(policy *policy.Policy) error {
 	}
 	defer file.Close()
 
-	_, err = file.Write(jsonBytes)
+	_, err = file.Write(policyBytes)
 	if err != nil {
 		return err
 	}
 
+	if me.signatureRequirement != nil && me.signatureRequirement.isDetached() {
+		return storePolicyBytesInCacheFile(detachedSignatureCachePath(me.cachePath), me.fetchedDetachedSignature)
+	}
+
 	return nil
 }
+
+func hashPolicyBytes(policyBytes []byte) []byte {
+	hash := sha256.Sum256(policyBytes)
+	return hash[:]
+}
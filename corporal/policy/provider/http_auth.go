@@ -0,0 +1,265 @@
+package provider
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/httphelp"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+// httpJwtSigner mints short-lived JWTs, for authenticating to a policy endpoint.
+//
+// A new token is minted for each request, so tokens never outlive their usefulness by much.
+// The signing key file is re-read each time, so that keys can be rotated without restarting.
+type httpJwtSigner struct {
+	algorithm      string
+	signingKeyPath string
+	secret         []byte
+	keyId          string
+	issuer         string
+	subject        string
+	audience       string
+	lifetime       time.Duration
+}
+
+func newHttpJwtSignerFromConfig(jwtConfigInterface interface{}) (*httpJwtSigner, error) {
+	if jwtConfigInterface == nil {
+		return nil, nil
+	}
+
+	jwtConfigMap, ok := jwtConfigInterface.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Jwt is expected to be an object or NULL")
+	}
+	jwtConfig := configuration.PolicyProvider(jwtConfigMap)
+
+	algorithm, err := getRequiredStringConfigValue(jwtConfig, "Algorithm")
+	if err != nil {
+		return nil, fmt.Errorf("Jwt: %s", err)
+	}
+
+	signingKeyPath, err := getOptionalStringConfigValue(jwtConfig, "SigningKeyPath")
+	if err != nil {
+		return nil, fmt.Errorf("Jwt: %s", err)
+	}
+
+	secret, err := getOptionalStringConfigValue(jwtConfig, "Secret")
+	if err != nil {
+		return nil, fmt.Errorf("Jwt: %s", err)
+	}
+
+	switch algorithm {
+	case "HS256":
+		if secret == "" {
+			return nil, fmt.Errorf("Jwt: the HS256 algorithm requires a Secret")
+		}
+	case "RS256", "ES256", "EdDSA":
+		if signingKeyPath == "" {
+			return nil, fmt.Errorf("Jwt: the %s algorithm requires a SigningKeyPath", algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("Jwt: unsupported algorithm: %s", algorithm)
+	}
+
+	signer := &httpJwtSigner{
+		algorithm:      algorithm,
+		signingKeyPath: signingKeyPath,
+		secret:         []byte(secret),
+		lifetime:       60 * time.Second,
+	}
+
+	for key, target := range map[string]*string{
+		"KeyId":    &signer.keyId,
+		"Issuer":   &signer.issuer,
+		"Subject":  &signer.subject,
+		"Audience": &signer.audience,
+	} {
+		*target, err = getOptionalStringConfigValue(jwtConfig, key)
+		if err != nil {
+			return nil, fmt.Errorf("Jwt: %s", err)
+		}
+	}
+
+	lifetimeSecondsPtr, err := getOptionalIntConfigValue(jwtConfig, "LifetimeSeconds")
+	if err != nil {
+		return nil, fmt.Errorf("Jwt: %s", err)
+	}
+	if lifetimeSecondsPtr != nil && *lifetimeSecondsPtr > 0 {
+		signer.lifetime = time.Duration(*lifetimeSecondsPtr) * time.Second
+	}
+
+	// Let's fail early (during startup) if the key is not usable.
+	_, err = signer.Mint()
+	if err != nil {
+		return nil, fmt.Errorf("Jwt: %s", err)
+	}
+
+	return signer, nil
+}
+
+// Mint creates a new signed token
+func (me *httpJwtSigner) Mint() (string, error) {
+	header := map[string]string{
+		"alg": me.algorithm,
+		"typ": "JWT",
+	}
+	if me.keyId != "" {
+		header["kid"] = me.keyId
+	}
+
+	jtiBytes := make([]byte, 16)
+	_, err := rand.Read(jtiBytes)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iat": now.Unix(),
+		"exp": now.Add(me.lifetime).Unix(),
+		"jti": hex.EncodeToString(jtiBytes),
+	}
+	if me.issuer != "" {
+		claims["iss"] = me.issuer
+	}
+	if me.subject != "" {
+		claims["sub"] = me.subject
+	}
+	if me.audience != "" {
+		claims["aud"] = me.audience
+	}
+
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsBytes, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(claimsBytes)
+
+	signature, err := me.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (me *httpJwtSigner) sign(signingInput []byte) ([]byte, error) {
+	if me.algorithm == "HS256" {
+		mac := hmac.New(sha256.New, me.secret)
+		mac.Write(signingInput)
+		return mac.Sum(nil), nil
+	}
+
+	key, err := loadPrivateKeyFromPemFile(me.signingKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(signingInput)
+
+	switch me.algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("RS256 requires an RSA key")
+		}
+		return rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok || ecdsaKey.Curve.Params().BitSize != 256 {
+			return nil, fmt.Errorf("ES256 requires a P-256 ECDSA key")
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, ecdsaKey, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS uses the fixed-size `r || s` encoding (as opposed to ASN.1)
+		return append(padBigInt(r, 32), padBigInt(s, 32)...), nil
+	case "EdDSA":
+		ed25519Key, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("EdDSA requires an Ed25519 key")
+		}
+		return ed25519.Sign(ed25519Key, signingInput), nil
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm: %s", me.algorithm)
+}
+
+func padBigInt(value *big.Int, size int) []byte {
+	result := make([]byte, size)
+	valueBytes := value.Bytes()
+	copy(result[size-len(valueBytes):], valueBytes)
+	return result
+}
+
+// loadPrivateKeyFromPemFile loads a PKCS#8, PKCS#1 (RSA) or SEC 1 (EC) private key out of a PEM file
+func loadPrivateKeyFromPemFile(path string) (interface{}, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading signing key: %s", err)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("signing key file (%s) does not contain a PEM block", path)
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("signing key file (%s) does not contain a supported private key", path)
+}
+
+// buildHttpTlsConfig builds a TLS configuration for talking to a policy endpoint,
+// out of the (optional) `TlsClientCertificatePath`, `TlsClientKeyPath` and `TlsCaPath` configuration keys.
+// A nil configuration (meaning "use the defaults") is returned if none are specified.
+func buildHttpTlsConfig(config configuration.PolicyProvider) (*tls.Config, error) {
+	certificatePath, err := getOptionalStringConfigValue(config, "TlsClientCertificatePath")
+	if err != nil {
+		return nil, err
+	}
+
+	keyPath, err := getOptionalStringConfigValue(config, "TlsClientKeyPath")
+	if err != nil {
+		return nil, err
+	}
+
+	caPath, err := getOptionalStringConfigValue(config, "TlsCaPath")
+	if err != nil {
+		return nil, err
+	}
+
+	if (certificatePath == "") != (keyPath == "") {
+		return nil, fmt.Errorf("TlsClientCertificatePath and TlsClientKeyPath need to be specified together")
+	}
+
+	return httphelp.NewTlsConfig(certificatePath, keyPath, caPath)
+}
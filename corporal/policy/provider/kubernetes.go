@@ -0,0 +1,465 @@
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	kubernetesServiceAccountTokenPath     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubernetesServiceAccountCaPath        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	kubernetesServiceAccountNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// kubernetesWatchTimeout is how long a single watch request lasts (server-side), before we re-establish it
+const kubernetesWatchTimeout = 5 * time.Minute
+
+// kubernetesWatchRetryInterval is how long to wait before re-establishing a watch, after it fails
+const kubernetesWatchRetryInterval = 5 * time.Second
+
+// kubernetesRequestTimeout is how long non-watch requests are allowed to take
+const kubernetesRequestTimeout = 30 * time.Second
+
+// KubernetesProvider is a policy provider which reads the policy from a key in a Kubernetes ConfigMap or Secret.
+//
+// It watches the resource via the Kubernetes API, so that policy changes (e.g. made by a GitOps pipeline) propagate almost instantly.
+// It talks to the Kubernetes API directly, authenticating with the pod's service account (unless configured otherwise).
+type KubernetesProvider struct {
+	store      *policy.Store
+	parser     *policy.Parser
+	apiServer  string
+	tokenPath  string
+	kind       string
+	namespace  string
+	name       string
+	dataKey    string
+	cachePath  *string
+	logger     *logrus.Logger
+	httpClient *http.Client
+
+	lockLoad    sync.Mutex
+	stopChannel chan struct{}
+	stopContext context.Context
+	stopFunc    context.CancelFunc
+
+	// lastResourceVersion holds the resource version of the last ConfigMap/Secret we've loaded
+	lastResourceVersion string
+}
+
+// kubernetesResource contains the parts of ConfigMap and Secret resources that we care about
+type kubernetesResource struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+
+	// Data contains plain values for ConfigMaps and base64-encoded values for Secrets
+	Data map[string]string `json:"data"`
+
+	// BinaryData contains base64-encoded values (ConfigMaps only)
+	BinaryData map[string]string `json:"binaryData"`
+}
+
+type kubernetesWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubernetesStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func NewKubernetesProvider(
+	config configuration.PolicyProvider,
+	store *policy.Store,
+	parser *policy.Parser,
+	logger *logrus.Logger,
+) (*KubernetesProvider, error) {
+	kind, err := getOptionalStringConfigValue(config, "Kind")
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes provider: %s", err)
+	}
+	if kind == "" {
+		kind = "ConfigMap"
+	}
+	if kind != "ConfigMap" && kind != "Secret" {
+		return nil, fmt.Errorf("Kubernetes provider: Kind is expected to be either `ConfigMap` or `Secret`")
+	}
+
+	name, err := getRequiredStringConfigValue(config, "Name")
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes provider: %s", err)
+	}
+
+	dataKey, err := getOptionalStringConfigValue(config, "DataKey")
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes provider: %s", err)
+	}
+	if dataKey == "" {
+		dataKey = "policy.json"
+	}
+
+	namespace, err := getOptionalStringConfigValue(config, "Namespace")
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes provider: %s", err)
+	}
+	if namespace == "" {
+		namespaceBytes, err := ioutil.ReadFile(kubernetesServiceAccountNamespacePath)
+		if err != nil {
+			return nil, fmt.Errorf("Kubernetes provider: no Namespace specified and failed determining it from the service account: %s", err)
+		}
+		namespace = strings.TrimSpace(string(namespaceBytes))
+	}
+
+	apiServer, err := getOptionalStringConfigValue(config, "ApiServer")
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes provider: %s", err)
+	}
+	if apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("Kubernetes provider: no ApiServer specified and not running inside a Kubernetes cluster")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+
+	tokenPath, err := getOptionalStringConfigValue(config, "TokenPath")
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes provider: %s", err)
+	}
+	if tokenPath == "" {
+		tokenPath = kubernetesServiceAccountTokenPath
+	}
+
+	caPath, err := getOptionalStringConfigValue(config, "CaPath")
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes provider: %s", err)
+	}
+	if caPath == "" {
+		caPath = kubernetesServiceAccountCaPath
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	caBytes, err := ioutil.ReadFile(caPath)
+	if err == nil {
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("Kubernetes provider: no valid certificates found in %s", caPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: caCertPool}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Kubernetes provider: failed reading CA certificate: %s", err)
+	}
+
+	cachePath, err := getOptionalStringConfigValue(config, "CachePath")
+	if err != nil {
+		return nil, fmt.Errorf("Kubernetes provider: %s", err)
+	}
+	var cachePathPtr *string
+	if cachePath != "" {
+		cachePathPtr = &cachePath
+	}
+
+	stopContext, stopFunc := context.WithCancel(context.Background())
+
+	return &KubernetesProvider{
+		store:     store,
+		parser:    parser,
+		apiServer: strings.TrimSuffix(apiServer, "/"),
+		tokenPath: tokenPath,
+		kind:      kind,
+		namespace: namespace,
+		name:      name,
+		dataKey:   dataKey,
+		cachePath: cachePathPtr,
+		logger:    logger,
+
+		// No client-level timeout, as watches are long-lived by design.
+		httpClient: &http.Client{
+			Transport: transport,
+		},
+
+		stopChannel: make(chan struct{}),
+		stopContext: stopContext,
+		stopFunc:    stopFunc,
+	}, nil
+}
+
+func (me *KubernetesProvider) Type() string {
+	return "kubernetes"
+}
+
+func (me *KubernetesProvider) Start() error {
+	me.logger.Infof("Starting policy provider: %s (%s %s/%s, key: %s)", me.Type(), me.kind, me.namespace, me.name, me.dataKey)
+
+	err := me.load(true)
+	if err != nil {
+		return err
+	}
+
+	go me.watch()
+
+	return nil
+}
+
+func (me *KubernetesProvider) Stop() {
+	me.logger.Infof("Stopping policy provider: %s", me.Type())
+
+	close(me.stopChannel)
+	me.stopFunc()
+}
+
+func (me *KubernetesProvider) Reload() {
+	me.logger.Infof("Reloading policy from provider: %s", me.Type())
+
+	err := me.load(false)
+	if err != nil {
+		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+func (me *KubernetesProvider) load(allowedToLoadFromCache bool) error {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	resource, errRemote := me.fetchResource()
+	if errRemote != nil {
+		me.logger.Warnf("Failed loading policy from Kubernetes %s (%s/%s): %s", me.kind, me.namespace, me.name, errRemote)
+
+		if !allowedToLoadFromCache {
+			return fmt.Errorf("failed loading policy from Kubernetes (%s), while cache-loading is not allowed", errRemote)
+		}
+
+		policyBytes, errCache := loadPolicyBytesFromCacheFile(me.cachePath)
+		if errCache != nil {
+			return fmt.Errorf("failed loading policy from Kubernetes (%s) and from cache (%s)", errRemote, errCache)
+		}
+
+		me.logger.Debugf("Successfully loaded policy from cache")
+
+		return me.apply(policyBytes, false)
+	}
+
+	return me.applyResource(resource)
+}
+
+func (me *KubernetesProvider) watch() {
+	for {
+		err := me.watchOnce()
+		if me.stopContext.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			// The watch timed out (as it regularly does). Let's re-establish it right away.
+			continue
+		}
+
+		me.logger.Warnf("Failed watching Kubernetes %s (%s/%s) for policy changes: %s", me.kind, me.namespace, me.name, err)
+
+		if !sleepUnlessStopped(kubernetesWatchRetryInterval, me.stopChannel) {
+			return
+		}
+	}
+}
+
+// watchOnce establishes a watch (starting after the last-loaded resource version) and applies policies as they arrive.
+// It returns a nil error when the watch ends normally (after kubernetesWatchTimeout).
+func (me *KubernetesProvider) watchOnce() error {
+	me.lockLoad.Lock()
+	resourceVersion := me.lastResourceVersion
+	me.lockLoad.Unlock()
+
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("fieldSelector", fmt.Sprintf("metadata.name=%s", me.name))
+	query.Set("timeoutSeconds", fmt.Sprintf("%d", int(kubernetesWatchTimeout.Seconds())))
+	if resourceVersion != "" {
+		query.Set("resourceVersion", resourceVersion)
+	}
+
+	ctx, cancel := context.WithTimeout(me.stopContext, kubernetesWatchTimeout+kubernetesRequestTimeout)
+	defer cancel()
+
+	resp, err := me.doRequest(ctx, fmt.Sprintf("%s?%s", me.getCollectionPath(), query.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The response is a stream of JSON objects, one per watch event.
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event kubernetesWatchEvent
+		err := decoder.Decode(&event)
+		if err != nil {
+			if me.stopContext.Err() != nil || err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("watch stream broke: %s", err)
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var resource kubernetesResource
+			err := json.Unmarshal(event.Object, &resource)
+			if err != nil {
+				return fmt.Errorf("failed decoding watched %s: %s", me.kind, err)
+			}
+
+			me.applyWatchedResource(resource)
+		case "DELETED":
+			me.logger.Warnf("Kubernetes %s (%s/%s) got deleted. Keeping the current policy", me.kind, me.namespace, me.name)
+		case "ERROR":
+			var status kubernetesStatus
+			_ = json.Unmarshal(event.Object, &status)
+
+			if status.Code == http.StatusGone {
+				// The resource version we've asked for is too old.
+				// Reloading gets us the latest policy (and resource version) and lets the next watch start from there.
+				me.Reload()
+			}
+
+			return fmt.Errorf("watch error (%d): %s", status.Code, status.Message)
+		}
+	}
+}
+
+func (me *KubernetesProvider) applyWatchedResource(resource kubernetesResource) {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	if resource.Metadata.ResourceVersion == me.lastResourceVersion {
+		return
+	}
+
+	me.logger.Infof("Policy changed in Kubernetes %s (resource version: %s)", me.kind, resource.Metadata.ResourceVersion)
+
+	err := me.applyResource(resource)
+	if err != nil {
+		me.logger.Warnf("Failed applying policy from Kubernetes: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+// applyResource applies the policy found in the given resource.
+// Even if the policy is bad, we remember the resource version, as there's no point in applying it again.
+func (me *KubernetesProvider) applyResource(resource kubernetesResource) error {
+	me.lastResourceVersion = resource.Metadata.ResourceVersion
+
+	policyBytes, err := me.extractPolicyBytes(resource)
+	if err != nil {
+		return err
+	}
+
+	return me.apply(policyBytes, true)
+}
+
+func (me *KubernetesProvider) extractPolicyBytes(resource kubernetesResource) ([]byte, error) {
+	if value, exists := resource.Data[me.dataKey]; exists {
+		if me.kind == "ConfigMap" {
+			return []byte(value), nil
+		}
+		return base64.StdEncoding.DecodeString(value)
+	}
+
+	if value, exists := resource.BinaryData[me.dataKey]; exists {
+		return base64.StdEncoding.DecodeString(value)
+	}
+
+	return nil, fmt.Errorf("%s (%s/%s) does not contain a `%s` key", me.kind, me.namespace, me.name, me.dataKey)
+}
+
+func (me *KubernetesProvider) apply(policyBytes []byte, storeInCache bool) error {
+	policyObj, err := me.parser.ParseFormat(policyBytes, policy.DetectFormat("", me.dataKey))
+	if err != nil {
+		return err
+	}
+
+	if storeInCache {
+		err := storePolicyBytesInCacheFile(me.cachePath, policyBytes)
+		if err != nil {
+			me.logger.Warnf("failed storing policy in cache: %s", err)
+		}
+	}
+
+	err = me.store.Set(policyObj, me.Type())
+	if err != nil {
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	return nil
+}
+
+func (me *KubernetesProvider) fetchResource() (kubernetesResource, error) {
+	var resource kubernetesResource
+
+	ctx, cancel := context.WithTimeout(me.stopContext, kubernetesRequestTimeout)
+	defer cancel()
+
+	resp, err := me.doRequest(ctx, fmt.Sprintf("%s/%s", me.getCollectionPath(), url.PathEscape(me.name)))
+	if err != nil {
+		return resource, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&resource)
+	if err != nil {
+		return resource, fmt.Errorf("failed decoding %s: %s", me.kind, err)
+	}
+
+	return resource, nil
+}
+
+func (me *KubernetesProvider) getCollectionPath() string {
+	collection := "configmaps"
+	if me.kind == "Secret" {
+		collection = "secrets"
+	}
+	return fmt.Sprintf("/api/v1/namespaces/%s/%s", url.PathEscape(me.namespace), collection)
+}
+
+func (me *KubernetesProvider) doRequest(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", me.apiServer+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Service account tokens get rotated, so we always read the current one.
+	tokenBytes, err := ioutil.ReadFile(me.tokenPath)
+	if err == nil {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", strings.TrimSpace(string(tokenBytes))))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed reading service account token: %s", err)
+	}
+
+	resp, err := me.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("non-200 response from the Kubernetes API: %d", resp.StatusCode)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,303 @@
+package provider
+
+import (
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testKubernetesServer serves a single (changeable) ConfigMap or Secret, supporting watches the way the Kubernetes API does
+type testKubernetesServer struct {
+	*httptest.Server
+
+	lock sync.Mutex
+
+	// versions contains the data of each version of the resource (the resource version being the index + 1).
+	// A nil entry means that the resource got deleted.
+	versions []map[string]string
+	changed  chan struct{}
+
+	// oldestWatchableVersion is the oldest resource version which can be watched from (as if everything before it got compacted away)
+	oldestWatchableVersion int
+
+	authorizationHeaders []string
+}
+
+func newTestKubernetesServer(t *testing.T, collection string) *testKubernetesServer {
+	server := &testKubernetesServer{changed: make(chan struct{})}
+
+	collectionPath := "/api/v1/namespaces/matrix/" + collection
+
+	createResource := func(version int) map[string]interface{} {
+		return map[string]interface{}{
+			"metadata": map[string]interface{}{"name": "corporal-policy", "resourceVersion": strconv.Itoa(version)},
+			"data":     server.versions[version-1],
+		}
+	}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.lock.Lock()
+		server.authorizationHeaders = append(server.authorizationHeaders, r.Header.Get("Authorization"))
+		server.lock.Unlock()
+
+		switch r.URL.Path {
+		case collectionPath + "/corporal-policy":
+			server.lock.Lock()
+			version := len(server.versions)
+			var resource map[string]interface{}
+			if version != 0 && server.versions[version-1] != nil {
+				resource = createResource(version)
+			}
+			server.lock.Unlock()
+
+			if resource == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(resource)
+		case collectionPath:
+			if r.URL.Query().Get("watch") != "1" || r.URL.Query().Get("fieldSelector") != "metadata.name=corporal-policy" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			sinceVersion, _ := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+
+			encoder := json.NewEncoder(w)
+
+			server.lock.Lock()
+			isTooOld := sinceVersion < server.oldestWatchableVersion
+			server.lock.Unlock()
+			if isTooOld {
+				encoder.Encode(map[string]interface{}{
+					"type":   "ERROR",
+					"object": map[string]interface{}{"code": http.StatusGone, "message": "too old resource version"},
+				})
+				return
+			}
+
+			w.(http.Flusher).Flush()
+
+			for {
+				server.lock.Lock()
+				var events []map[string]interface{}
+				for version := sinceVersion + 1; version <= len(server.versions); version++ {
+					eventType := "MODIFIED"
+					object := createResource(version)
+					if server.versions[version-1] == nil {
+						eventType = "DELETED"
+					}
+					events = append(events, map[string]interface{}{"type": eventType, "object": object})
+					sinceVersion = version
+				}
+				changed := server.changed
+				server.lock.Unlock()
+
+				for _, event := range events {
+					encoder.Encode(event)
+				}
+				w.(http.Flusher).Flush()
+
+				select {
+				case <-changed:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (me *testKubernetesServer) addVersion(data map[string]string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.versions = append(me.versions, data)
+
+	close(me.changed)
+	me.changed = make(chan struct{})
+}
+
+func createTestKubernetesProvider(t *testing.T, server *testKubernetesServer, kind string, directory string) (*KubernetesProvider, *policy.Store) {
+	store, parser := createTestStoreAndParser(t)
+
+	provider, err := NewKubernetesProvider(configuration.PolicyProvider{
+		"Kind":      kind,
+		"Name":      "corporal-policy",
+		"Namespace": "matrix",
+		"ApiServer": server.URL,
+		"TokenPath": filepath.Join(directory, "token"),
+		"CaPath":    filepath.Join(directory, "ca.crt"),
+		"CachePath": filepath.Join(directory, "policy.json"),
+	}, store, parser, createTestLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return provider, store
+}
+
+func TestKubernetesProviderWatchesForChanges(t *testing.T) {
+	type testData struct {
+		kind       string
+		collection string
+		encode     func(value string) string
+	}
+
+	tests := []testData{
+		{"ConfigMap", "configmaps", func(value string) string { return value }},
+		{"Secret", "secrets", func(value string) string { return base64.StdEncoding.EncodeToString([]byte(value)) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.kind, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "kubernetes-provider")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer os.RemoveAll(directory)
+
+			ioutil.WriteFile(filepath.Join(directory, "token"), []byte("token-1\n"), 0600)
+
+			server := newTestKubernetesServer(t, test.collection)
+			server.addVersion(map[string]string{"policy.json": test.encode(createTestValidPolicyDocument("@a:example.com"))})
+
+			provider, store := createTestKubernetesProvider(t, server, test.kind, directory)
+			loadReporter := &testLoadReporter{}
+			store.SetLoadReporter(loadReporter)
+
+			err = provider.Start()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer provider.Stop()
+
+			assertTestStoreUserIds(t, store, "@a:example.com")
+
+			server.addVersion(map[string]string{"policy.json": test.encode(createTestValidPolicyDocument("@b:example.com"))})
+			waitForTestCondition(t, "the changed policy to be applied", func() bool {
+				return testStoreHasUserIds(store, "@b:example.com")
+			})
+
+			// Deleting the resource keeps the current policy, while bad policies are reported (and not applied)
+			server.addVersion(nil)
+			server.addVersion(map[string]string{"other.json": test.encode(createTestValidPolicyDocument("@c:example.com"))})
+			waitForTestCondition(t, "the bad policy to be reported", func() bool {
+				return loadReporter.failuresCount() == 1
+			})
+			assertTestStoreUserIds(t, store, "@b:example.com")
+
+			server.addVersion(map[string]string{"policy.json": test.encode(createTestValidPolicyDocument("@c:example.com"))})
+			waitForTestCondition(t, "the fixed policy to be applied", func() bool {
+				return testStoreHasUserIds(store, "@c:example.com")
+			})
+		})
+	}
+}
+
+func TestKubernetesProviderStartsOverWhenFallingBehind(t *testing.T) {
+	directory, err := ioutil.TempDir("", "kubernetes-provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	ioutil.WriteFile(filepath.Join(directory, "token"), []byte("token-1\n"), 0600)
+
+	server := newTestKubernetesServer(t, "configmaps")
+	server.addVersion(map[string]string{"policy.json": createTestValidPolicyDocument("@a:example.com")})
+
+	provider, store := createTestKubernetesProvider(t, server, "ConfigMap", directory)
+	err = provider.load(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Versions watched from get compacted away, while the resource keeps changing
+	server.addVersion(map[string]string{"policy.json": createTestValidPolicyDocument("@b:example.com")})
+	server.addVersion(map[string]string{"policy.json": createTestValidPolicyDocument("@c:example.com")})
+	server.lock.Lock()
+	server.oldestWatchableVersion = 3
+	server.lock.Unlock()
+
+	// Service account tokens get rotated, with the new token getting picked up
+	ioutil.WriteFile(filepath.Join(directory, "token"), []byte("token-2\n"), 0600)
+
+	err = provider.watchOnce()
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+
+	assertTestStoreUserIds(t, store, "@c:example.com")
+	if provider.lastResourceVersion != "3" {
+		t.Errorf("expected the next watch to start from the latest resource version, got: %s", provider.lastResourceVersion)
+	}
+
+	server.lock.Lock()
+	authorizationHeaders := server.authorizationHeaders
+	server.lock.Unlock()
+	if authorizationHeaders[0] != "Bearer token-1" || authorizationHeaders[len(authorizationHeaders)-1] != "Bearer token-2" {
+		t.Errorf("expected the current service account token to be used, got: %v", authorizationHeaders)
+	}
+}
+
+func TestKubernetesProviderFallsBackToTheCache(t *testing.T) {
+	directory, err := ioutil.TempDir("", "kubernetes-provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	server := newTestKubernetesServer(t, "configmaps")
+
+	// The ConfigMap doesn't exist yet and there's nothing cached
+	provider, store := createTestKubernetesProvider(t, server, "ConfigMap", directory)
+	err = provider.load(true)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+
+	server.addVersion(map[string]string{"policy.json": createTestValidPolicyDocument("@a:example.com")})
+	err = provider.load(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if provider.lastResourceVersion != "1" {
+		t.Errorf("expected the resource version to be remembered, got: %s", provider.lastResourceVersion)
+	}
+
+	// Once the Kubernetes API is unreachable, starting up falls back to what got cached, while reloading doesn't
+	server.Close()
+
+	provider, store = createTestKubernetesProvider(t, server, "ConfigMap", directory)
+	err = provider.load(false)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+
+	err = provider.load(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertTestStoreUserIds(t, store, "@a:example.com")
+}
@@ -20,8 +20,12 @@ import (
 // That is, policies will come from an external system through the HTTP API (see the httpapi package).
 // On service restart, however, until a new push arrives to the API, we want to restore the last-seen policy,
 // which is what this policy provider does.
+//
+// Pushed policies get cached as the documents they were pushed as (see policy.Policy.PushedDocuments),
+// so that restoring them verifies their signatures (if policy signing is enabled) all over again, just like when they were pushed.
 type LastSeenStorePolicyProvider struct {
 	store     *policy.Store
+	parser    *policy.Parser
 	cachePath string
 	logger    *logrus.Logger
 
@@ -32,6 +36,7 @@ type LastSeenStorePolicyProvider struct {
 func NewLastSeenStorePolicyProvider(
 	config configuration.PolicyProvider,
 	store *policy.Store,
+	parser *policy.Parser,
 	logger *logrus.Logger,
 ) (*LastSeenStorePolicyProvider, error) {
 	cachePath, exists := config["CachePath"]
@@ -41,6 +46,7 @@ func NewLastSeenStorePolicyProvider(
 
 	return &LastSeenStorePolicyProvider{
 		store:     store,
+		parser:    parser,
 		cachePath: cachePath.(string),
 		logger:    logger,
 	}, nil
@@ -94,12 +100,33 @@ func (me *LastSeenStorePolicyProvider) load() error {
 		return err
 	}
 
-	policy, err := createPolicyFromJsonBytes(bytes)
+	var entry lastSeenStoreCacheEntry
+	err = json.Unmarshal(bytes, &entry)
+	if err != nil {
+		return fmt.Errorf("Policy load error: %s", err)
+	}
+
+	var policy *policy.Policy
+	if len(entry.PushedDocuments) != 0 {
+		// These are the documents as they were pushed, so they get verified all over again
+		policy, err = me.parser.ParsePushedDocuments(entry.PushedDocuments)
+	} else {
+		if me.parser.VerifiesSignatures() {
+			return fmt.Errorf("Policy load error: the cached policy is a re-serialized (unsigned) copy, which cannot be verified while policy signing is enabled")
+		}
+
+		if entry.Policy == nil {
+			// Older versions cached the re-serialized policy as is
+			entry.Policy = bytes
+		}
+
+		policy, err = me.parser.ParseWithoutSignatureVerification(entry.Policy)
+	}
 	if err != nil {
 		return fmt.Errorf("Policy load error: %s", err)
 	}
 
-	err = me.store.Set(policy)
+	err = me.store.Set(policy, me.Type())
 	if err != nil {
 		return fmt.Errorf("Policy set error: %s", err)
 	}
@@ -130,7 +157,28 @@ func (me *LastSeenStorePolicyProvider) listenOnChannel(channel chan *policy.Poli
 }
 
 func (me *LastSeenStorePolicyProvider) storePolicyInCache(policy *policy.Policy) error {
-	jsonBytes, err := json.Marshal(policy)
+	var entry lastSeenStoreCacheEntry
+	if pushedDocuments := policy.PushedDocuments(); pushedDocuments != nil {
+		entry.PushedDocuments = pushedDocuments
+	} else {
+		if me.parser.VerifiesSignatures() {
+			// Restoring the previously cached policy would mean going back to an outdated one, so it's better to have none
+			err := os.Remove(me.cachePath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			return fmt.Errorf("the policy did not come from the HTTP API in a way which allows it to be verified again once restored (e.g. it's a rolled back one), so it cannot be cached while policy signing is enabled")
+		}
+
+		policyBytes, err := policy.MarshalWithSecretReferences()
+		if err != nil {
+			return err
+		}
+		entry.Policy = policyBytes
+	}
+
+	jsonBytes, err := json.Marshal(entry)
 	if err != nil {
 		return err
 	}
@@ -148,3 +196,13 @@ func (me *LastSeenStorePolicyProvider) storePolicyInCache(policy *policy.Policy)
 
 	return nil
 }
+
+// lastSeenStoreCacheEntry is what LastSeenStorePolicyProvider caches
+type lastSeenStoreCacheEntry struct {
+	// PushedDocuments are the documents the policy was parsed from (see policy.Policy.PushedDocuments), if it has any
+	PushedDocuments []policy.PushedDocument `json:"pushedDocuments,omitempty"`
+
+	// Policy is a re-serialized copy of the policy, which is only cached when PushedDocuments are not available
+	// (and when policy signing is disabled, as re-serialized policies cannot be verified)
+	Policy json.RawMessage `json:"policy,omitempty"`
+}
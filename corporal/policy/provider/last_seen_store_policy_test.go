@@ -0,0 +1,175 @@
+package provider
+
+import (
+	"crypto/ed25519"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// createTestSignedEnvelope creates a signed envelope (see policy.SignedEnvelope) for the document, signed by the given key
+func createTestSignedEnvelope(document string, keyId string, privateKey ed25519.PrivateKey) []byte {
+	envelopeBytes, _ := json.Marshal(policy.SignedEnvelope{
+		Payload: base64.StdEncoding.EncodeToString([]byte(document)),
+		Signatures: []policy.SignedEnvelopeSignature{
+			{
+				KeyID:     keyId,
+				Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(document))),
+			},
+		},
+	})
+	return envelopeBytes
+}
+
+func createTestLastSeenStorePolicyProvider(t *testing.T, cachePath string, publicKeys map[string]string) (*LastSeenStorePolicyProvider, *policy.Store, *policy.Parser) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	signatureVerifier, err := policy.NewSignatureVerifier(publicKeys)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	parser := policy.NewParser(signatureVerifier)
+
+	history, err := policy.NewHistory(logger, 0, "", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store := policy.NewStore(logger, policy.NewValidator("example.com"), history)
+
+	provider, err := NewLastSeenStorePolicyProvider(configuration.PolicyProvider{"CachePath": cachePath}, store, parser, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return provider, store, parser
+}
+
+func TestLastSeenStorePolicyProviderReverifiesCachedPolicies(t *testing.T) {
+	directory, err := ioutil.TempDir("", "last-seen-store-policy")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	cachePath := filepath.Join(directory, "policy.json")
+
+	signingKey := generateTestSigningKey(t)
+	publicKeys := map[string]string{"trusted": base64.StdEncoding.EncodeToString(signingKey.publicKey)}
+
+	provider, store, parser := createTestLastSeenStorePolicyProvider(t, cachePath, publicKeys)
+
+	pushedPolicy, err := parser.ParsePushedFormat(createTestSignedEnvelope(`{"schemaVersion": 1, "users": [{"id": "@a:example.com", "active": true, "authType": "plain", "authCredential": "secret"}]}`, "trusted", signingKey.privateKey), policy.FormatJSON)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// A user policy pushed on top of the whole policy is to be restored (and verified) along with it
+	userPolicyDocument := createTestSignedEnvelope(`{"active": true, "authType": "plain", "authCredential": "other"}`, "trusted", signingKey.privateKey)
+	userPolicy, err := parser.ParseUserPolicy(userPolicyDocument, policy.FormatJSON)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	userPolicy.Id = "@b:example.com"
+	modifiedPolicy := pushedPolicy.WithPushedUserPolicy(userPolicy, policy.PushedDocument{Data: userPolicyDocument, Format: policy.FormatJSON})
+
+	err = provider.storePolicyInCache(&modifiedPolicy)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err = provider.load()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if restoredPolicy := store.Get(); restoredPolicy == nil || len(restoredPolicy.User) != 2 || restoredPolicy.GetUserPolicyByUserId("@b:example.com") == nil {
+		t.Fatalf("expected the cached policy to be restored, got: %#v", restoredPolicy)
+	}
+
+	cachedBytes, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Tampering with the policy within the (signed) cached documents, instead of caching a (re-serialized) policy of one's own
+	var entry lastSeenStoreCacheEntry
+	json.Unmarshal(cachedBytes, &entry)
+	var envelope policy.SignedEnvelope
+	json.Unmarshal(entry.PushedDocuments[0].Data, &envelope)
+	payload, _ := base64.StdEncoding.DecodeString(envelope.Payload)
+	envelope.Payload = base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(payload), "@a:example.com", "@evil:example.com", 1)))
+	entry.PushedDocuments[0].Data, _ = json.Marshal(envelope)
+	tamperedBytes, _ := json.Marshal(entry)
+
+	type testData struct {
+		name        string
+		cachedBytes []byte
+	}
+
+	tests := []testData{
+		{"tampered document", tamperedBytes},
+		{"re-serialized policy", []byte(`{"policy": {"schemaVersion": 1, "users": [{"id": "@evil:example.com", "active": true}]}}`)},
+		{"re-serialized policy (older versions)", []byte(`{"schemaVersion": 1, "users": [{"id": "@evil:example.com", "active": true}]}`)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ioutil.WriteFile(cachePath, test.cachedBytes, 0600)
+
+			provider, store, _ := createTestLastSeenStorePolicyProvider(t, cachePath, publicKeys)
+
+			err := provider.load()
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+			if store.Get() != nil {
+				t.Errorf("expected no policy to be restored, got: %#v", store.Get())
+			}
+		})
+	}
+}
+
+func TestLastSeenStorePolicyProviderDoesNotCacheUnverifiablePolicies(t *testing.T) {
+	directory, err := ioutil.TempDir("", "last-seen-store-policy")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	cachePath := filepath.Join(directory, "policy.json")
+	ioutil.WriteFile(cachePath, []byte(`{"pushedDocuments": []}`), 0600)
+
+	publicKeys := map[string]string{"trusted": base64.StdEncoding.EncodeToString(generateTestSigningKey(t).publicKey)}
+	provider, _, _ := createTestLastSeenStorePolicyProvider(t, cachePath, publicKeys)
+
+	// e.g. a rolled back policy, which only exists as a parsed policy
+	err = provider.storePolicyInCache(&policy.Policy{SchemaVerson: 1})
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Errorf("expected the outdated cached policy to be removed")
+	}
+
+	// Without policy signing, such policies are cached as they are
+	provider, store, _ := createTestLastSeenStorePolicyProvider(t, cachePath, nil)
+	err = provider.storePolicyInCache(&policy.Policy{SchemaVerson: 1, User: []*policy.UserPolicy{{Id: "@a:example.com", Active: true, AuthType: "plain", AuthCredential: "secret"}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = provider.load()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if store.Get() == nil || len(store.Get().User) != 1 {
+		t.Errorf("expected the cached policy to be restored, got: %#v", store.Get())
+	}
+}
@@ -0,0 +1,579 @@
+package provider
+
+import (
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// natsReconnectInterval is how long to wait before reconnecting, after the connection to NATS fails
+const natsReconnectInterval = 5 * time.Second
+
+const (
+	natsSidPolicyUpdates = "1"
+	natsSidSnapshot      = "2"
+)
+
+const (
+	natsMessageTypePolicy     = "policy"
+	natsMessageTypeUserUpsert = "userUpsert"
+	natsMessageTypeUserDelete = "userDelete"
+)
+
+// NatsProvider is a policy provider which subscribes to a NATS subject carrying policy updates.
+//
+// Each message (see natsPolicyMessage) either carries a full policy or a per-user delta.
+// Messages are sequence-numbered, so that we can detect missed messages and re-synchronize,
+// by requesting a full policy (a snapshot) on a separate subject (request-reply style).
+type NatsProvider struct {
+	store           *policy.Store
+	parser          *policy.Parser
+	url             string
+	token           string
+	subject         string
+	snapshotSubject string
+	timeout         time.Duration
+	cachePath       *string
+	logger          *logrus.Logger
+
+	lockLoad    sync.Mutex
+	stopChannel chan struct{}
+	stopped     bool
+
+	// connection is the current connection to NATS (nil while disconnected)
+	connection *natsConnection
+
+	// snapshotInbox is the subject that snapshot replies are received on
+	snapshotInbox string
+
+	// snapshotPending tells whether we've requested a snapshot and are still waiting for it
+	snapshotPending bool
+
+	// document holds the (JSON) policy document that the currently-applied policy was built from, for applying deltas to it
+	document map[string]interface{}
+
+	// lastSequence holds the sequence number of the last message we've applied.
+	// A value of 0 means that we don't know where we are (e.g. nothing loaded yet, or we've loaded from cache).
+	lastSequence uint64
+}
+
+type natsPolicyMessage struct {
+	Sequence uint64 `json:"sequence"`
+
+	// Type is one of the natsMessageType* constants
+	Type string `json:"type"`
+
+	// Policy holds the full policy document, for natsMessageTypePolicy messages
+	Policy json.RawMessage `json:"policy"`
+
+	// User holds a user policy, for natsMessageTypeUserUpsert messages
+	User map[string]interface{} `json:"user"`
+
+	// UserId holds the id of the user to remove from the policy, for natsMessageTypeUserDelete messages
+	UserId string `json:"userId"`
+}
+
+func NewNatsProvider(
+	config configuration.PolicyProvider,
+	store *policy.Store,
+	parser *policy.Parser,
+	logger *logrus.Logger,
+) (*NatsProvider, error) {
+	url, err := getRequiredStringConfigValue(config, "Url")
+	if err != nil {
+		return nil, fmt.Errorf("NATS provider: %s", err)
+	}
+
+	subject, err := getRequiredStringConfigValue(config, "Subject")
+	if err != nil {
+		return nil, fmt.Errorf("NATS provider: %s", err)
+	}
+
+	snapshotSubject, err := getOptionalStringConfigValue(config, "SnapshotSubject")
+	if err != nil {
+		return nil, fmt.Errorf("NATS provider: %s", err)
+	}
+
+	token, err := getOptionalStringConfigValue(config, "Token")
+	if err != nil {
+		return nil, fmt.Errorf("NATS provider: %s", err)
+	}
+
+	cachePath, err := getOptionalStringConfigValue(config, "CachePath")
+	if err != nil {
+		return nil, fmt.Errorf("NATS provider: %s", err)
+	}
+	var cachePathPtr *string
+	if cachePath != "" {
+		cachePathPtr = &cachePath
+	}
+
+	timeout := 30 * time.Second
+	timeoutMillisecondsPtr, err := getOptionalIntConfigValue(config, "TimeoutMilliseconds")
+	if err != nil {
+		return nil, fmt.Errorf("NATS provider: %s", err)
+	}
+	if timeoutMillisecondsPtr != nil && *timeoutMillisecondsPtr > 0 {
+		timeout = time.Duration(*timeoutMillisecondsPtr) * time.Millisecond
+	}
+
+	snapshotInbox, err := generateNatsInbox()
+	if err != nil {
+		return nil, fmt.Errorf("NATS provider: %s", err)
+	}
+
+	return &NatsProvider{
+		store:           store,
+		parser:          parser,
+		url:             url,
+		token:           token,
+		subject:         subject,
+		snapshotSubject: snapshotSubject,
+		timeout:         timeout,
+		cachePath:       cachePathPtr,
+		logger:          logger,
+
+		stopChannel:   make(chan struct{}),
+		snapshotInbox: snapshotInbox,
+	}, nil
+}
+
+func (me *NatsProvider) Type() string {
+	return "nats"
+}
+
+func (me *NatsProvider) Start() error {
+	me.logger.Infof("Starting policy provider: %s (subject: %s)", me.Type(), me.subject)
+
+	connection, errRemote := me.connect()
+	if errRemote != nil {
+		me.logger.Warnf("Failed connecting to NATS: %s", errRemote)
+	}
+
+	if connection != nil && me.snapshotSubject != "" {
+		errRemote = me.loadInitialSnapshot(connection)
+		if errRemote != nil {
+			me.logger.Warnf("Failed loading policy snapshot from NATS: %s", errRemote)
+
+			// The connection may have been left in the middle of reading something, so we'd better start over.
+			me.disconnect(connection)
+			connection = nil
+		}
+	}
+
+	me.lockLoad.Lock()
+	isLoaded := me.document != nil
+	me.lockLoad.Unlock()
+
+	if !isLoaded {
+		errCache := me.loadFromCache()
+		if errCache != nil {
+			if connection == nil {
+				return fmt.Errorf("failed loading policy from NATS (%s) and from cache (%s)", errRemote, errCache)
+			}
+
+			// We're connected, so a policy will eventually arrive.
+			me.logger.Warnf("Failed loading policy from cache (%s), so we're waiting for one to be published", errCache)
+		}
+	}
+
+	go me.run(connection)
+
+	return nil
+}
+
+func (me *NatsProvider) Stop() {
+	me.logger.Infof("Stopping policy provider: %s", me.Type())
+
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	me.stopped = true
+	close(me.stopChannel)
+
+	// Closing the connection unblocks the reading goroutine
+	if me.connection != nil {
+		me.connection.close()
+	}
+}
+
+func (me *NatsProvider) Reload() {
+	me.logger.Infof("Reloading policy from provider: %s", me.Type())
+
+	if me.snapshotSubject == "" {
+		me.logger.Infof("Failed reloading policy: reloading requires a SnapshotSubject to be configured")
+		return
+	}
+
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	if me.connection == nil {
+		me.logger.Infof("Failed reloading policy: not connected to NATS")
+		return
+	}
+
+	// The snapshot reply will be handled by the reading goroutine
+	err := me.requestSnapshot(me.connection)
+	if err != nil {
+		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+func (me *NatsProvider) connect() (*natsConnection, error) {
+	connection, err := dialNats(me.url, me.token, me.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	err = connection.subscribe(me.subject, natsSidPolicyUpdates)
+	if err == nil && me.snapshotSubject != "" {
+		err = connection.subscribe(me.snapshotInbox, natsSidSnapshot)
+	}
+	if err != nil {
+		connection.close()
+		return nil, err
+	}
+
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	if me.stopped {
+		connection.close()
+		return nil, fmt.Errorf("stopped")
+	}
+
+	me.connection = connection
+
+	return connection, nil
+}
+
+// loadInitialSnapshot requests a snapshot and waits for it to arrive (handling any other messages in the meantime).
+func (me *NatsProvider) loadInitialSnapshot(connection *natsConnection) error {
+	me.lockLoad.Lock()
+	err := me.requestSnapshot(connection)
+	me.lockLoad.Unlock()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(me.timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("timed out waiting for a snapshot reply")
+		}
+
+		message, err := connection.readMessage(remaining)
+		if err != nil {
+			return err
+		}
+
+		me.handleMessage(connection, message)
+
+		me.lockLoad.Lock()
+		snapshotPending := me.snapshotPending
+		me.lockLoad.Unlock()
+
+		if !snapshotPending {
+			return nil
+		}
+	}
+}
+
+func (me *NatsProvider) run(connection *natsConnection) {
+	for {
+		if connection == nil {
+			var err error
+			connection, err = me.connect()
+			if err != nil {
+				if me.isStopped() {
+					return
+				}
+
+				me.logger.Warnf("Failed connecting to NATS: %s", err)
+
+				if !sleepUnlessStopped(natsReconnectInterval, me.stopChannel) {
+					return
+				}
+				continue
+			}
+
+			me.logger.Infof("Connected to NATS")
+
+			// We may have missed some messages while we were disconnected.
+			if me.snapshotSubject != "" {
+				me.lockLoad.Lock()
+				err = me.requestSnapshot(connection)
+				me.lockLoad.Unlock()
+				if err != nil {
+					me.logger.Warnf("Failed requesting policy snapshot from NATS: %s", err)
+				}
+			}
+		}
+
+		message, err := connection.readMessage(natsReadTimeout)
+		if err != nil {
+			me.disconnect(connection)
+			connection = nil
+
+			if me.isStopped() {
+				return
+			}
+
+			me.logger.Warnf("Lost connection to NATS (%s), reconnecting..", err)
+
+			if !sleepUnlessStopped(natsReconnectInterval, me.stopChannel) {
+				return
+			}
+			continue
+		}
+
+		me.handleMessage(connection, message)
+	}
+}
+
+func (me *NatsProvider) disconnect(connection *natsConnection) {
+	connection.close()
+
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	me.connection = nil
+	me.snapshotPending = false
+}
+
+func (me *NatsProvider) isStopped() bool {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	return me.stopped
+}
+
+// requestSnapshot asks for a full policy to be sent to our snapshot inbox. It expects lockLoad to be held.
+func (me *NatsProvider) requestSnapshot(connection *natsConnection) error {
+	me.logger.Debugf("Requesting policy snapshot from NATS (%s)", me.snapshotSubject)
+
+	err := connection.publish(me.snapshotSubject, me.snapshotInbox, nil)
+	if err != nil {
+		return err
+	}
+
+	me.snapshotPending = true
+
+	return nil
+}
+
+func (me *NatsProvider) handleMessage(connection *natsConnection, message *natsMessage) {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	var policyMessage natsPolicyMessage
+	err := json.Unmarshal(message.Payload, &policyMessage)
+	if err != nil {
+		me.logger.Warnf("Ignoring malformed NATS message on %s: %s", message.Subject, err)
+		return
+	}
+
+	if message.Sid == natsSidSnapshot {
+		me.snapshotPending = false
+
+		if policyMessage.Type != natsMessageTypePolicy {
+			me.logger.Warnf("Ignoring snapshot reply of unexpected type: %s", policyMessage.Type)
+			return
+		}
+
+		// Snapshots are authoritative, so they're applied regardless of sequence numbers.
+		// This also lets publishers recover from having reset their sequence.
+		err = me.applyFullPolicy(policyMessage)
+		if err != nil {
+			me.logger.Warnf("Failed applying policy snapshot from NATS: %s", err)
+			me.store.ReportLoadFailure(me.Type(), err)
+		}
+		return
+	}
+
+	if policyMessage.Sequence == 0 {
+		me.logger.Warnf("Ignoring NATS message without a sequence number")
+		return
+	}
+
+	if me.lastSequence != 0 && policyMessage.Sequence <= me.lastSequence {
+		me.logger.Debugf("Ignoring already-seen NATS message (sequence: %d)", policyMessage.Sequence)
+		return
+	}
+
+	if policyMessage.Type == natsMessageTypePolicy {
+		err = me.applyFullPolicy(policyMessage)
+		if err != nil {
+			me.logger.Warnf("Failed applying policy from NATS (sequence: %d): %s", policyMessage.Sequence, err)
+			me.store.ReportLoadFailure(me.Type(), err)
+		}
+		return
+	}
+
+	if me.lastSequence == 0 || policyMessage.Sequence != me.lastSequence+1 {
+		// We can't apply a delta without knowing that we've seen everything before it.
+		if me.snapshotPending {
+			return
+		}
+
+		if me.snapshotSubject == "" {
+			me.logger.Warnf("Ignoring NATS delta message (sequence: %d), as previous messages were missed. Waiting for a full policy", policyMessage.Sequence)
+			return
+		}
+
+		me.logger.Warnf("Missed NATS messages before sequence %d (last applied: %d), re-synchronizing", policyMessage.Sequence, me.lastSequence)
+
+		err = me.requestSnapshot(connection)
+		if err != nil {
+			me.logger.Warnf("Failed requesting policy snapshot from NATS: %s", err)
+		}
+		return
+	}
+
+	err = me.applyDelta(policyMessage)
+	if err != nil {
+		me.logger.Warnf("Failed applying delta from NATS (sequence: %d): %s", policyMessage.Sequence, err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+func (me *NatsProvider) applyFullPolicy(policyMessage natsPolicyMessage) error {
+	if len(policyMessage.Policy) == 0 {
+		return fmt.Errorf("message does not contain a policy")
+	}
+
+	var document map[string]interface{}
+	err := json.Unmarshal(policyMessage.Policy, &document)
+	if err != nil {
+		return fmt.Errorf("policy is not a JSON object: %s", err)
+	}
+
+	err = me.apply(document, policyMessage.Policy)
+	if err != nil {
+		return err
+	}
+
+	me.lastSequence = policyMessage.Sequence
+
+	return nil
+}
+
+func (me *NatsProvider) applyDelta(policyMessage natsPolicyMessage) error {
+	if _, isSigned := me.document["payload"]; isSigned {
+		return fmt.Errorf("deltas cannot be applied to signed policies")
+	}
+
+	var userId string
+	switch policyMessage.Type {
+	case natsMessageTypeUserUpsert:
+		userId, _ = policyMessage.User["id"].(string)
+		if userId == "" {
+			return fmt.Errorf("user policy does not have an id")
+		}
+	case natsMessageTypeUserDelete:
+		userId = policyMessage.UserId
+		if userId == "" {
+			return fmt.Errorf("missing userId")
+		}
+	default:
+		return fmt.Errorf("unknown message type: %s", policyMessage.Type)
+	}
+
+	// We're building a new document (instead of modifying the current one),
+	// so that a delta which results in a bad policy leaves the current one intact.
+	document := make(map[string]interface{})
+	for key, value := range me.document {
+		document[key] = value
+	}
+
+	currentUsers, _ := me.document["users"].([]interface{})
+	users := make([]interface{}, 0, len(currentUsers)+1)
+	for _, user := range currentUsers {
+		if userMap, ok := user.(map[string]interface{}); ok && userMap["id"] == userId {
+			continue
+		}
+		users = append(users, user)
+	}
+	if policyMessage.Type == natsMessageTypeUserUpsert {
+		users = append(users, policyMessage.User)
+	}
+	document["users"] = users
+
+	documentBytes, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	err = me.apply(document, documentBytes)
+	if err != nil {
+		return err
+	}
+
+	me.lastSequence = policyMessage.Sequence
+
+	return nil
+}
+
+func (me *NatsProvider) apply(document map[string]interface{}, documentBytes []byte) error {
+	policyObj, err := me.parser.ParseFormat(documentBytes, policy.FormatJSON)
+	if err != nil {
+		return err
+	}
+
+	err = me.store.Set(policyObj, me.Type())
+	if err != nil {
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	me.document = document
+
+	err = storePolicyBytesInCacheFile(me.cachePath, documentBytes)
+	if err != nil {
+		me.logger.Warnf("failed storing policy in cache: %s", err)
+	}
+
+	return nil
+}
+
+func (me *NatsProvider) loadFromCache() error {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	documentBytes, err := loadPolicyBytesFromCacheFile(me.cachePath)
+	if err != nil {
+		return err
+	}
+
+	var document map[string]interface{}
+	err = json.Unmarshal(documentBytes, &document)
+	if err != nil {
+		return err
+	}
+
+	policyObj, err := me.parser.ParseFormat(documentBytes, policy.FormatJSON)
+	if err != nil {
+		return err
+	}
+
+	err = me.store.Set(policyObj, me.Type())
+	if err != nil {
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	me.document = document
+
+	// We don't know which messages the cached policy reflects, so deltas can't be applied until we get a full policy.
+	me.lastSequence = 0
+
+	me.logger.Debugf("Successfully loaded policy from cache")
+
+	return nil
+}
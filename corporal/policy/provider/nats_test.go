@@ -0,0 +1,303 @@
+package provider
+
+import (
+	"bufio"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testNatsServer speaks just enough of the NATS protocol for NatsProvider: it accepts subscriptions,
+// delivers what the test publishes and replies to snapshot requests with the current snapshot.
+type testNatsServer struct {
+	listener net.Listener
+
+	lock            sync.Mutex
+	connections     []*testNatsServerConnection
+	snapshot        string
+	snapshotsServed int
+	authTokens      []string
+}
+
+type testNatsServerConnection struct {
+	conn net.Conn
+
+	// subscriptions maps subjects to subscription ids
+	subscriptions map[string]string
+}
+
+func newTestNatsServer(t *testing.T) *testNatsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	server := &testNatsServer{listener: listener}
+	t.Cleanup(server.close)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (me *testNatsServer) url() string {
+	return "nats://" + me.listener.Addr().String()
+}
+
+func (me *testNatsServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	connection := &testNatsServerConnection{conn: conn, subscriptions: map[string]string{}}
+
+	me.lock.Lock()
+	me.connections = append(me.connections, connection)
+	me.lock.Unlock()
+
+	io.WriteString(conn, "INFO {\"server_id\": \"test\"}\r\n")
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			continue
+		}
+
+		switch parts[0] {
+		case "CONNECT":
+			var options natsConnectOptions
+			json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &options)
+
+			me.lock.Lock()
+			me.authTokens = append(me.authTokens, options.AuthToken)
+			me.lock.Unlock()
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "SUB":
+			me.lock.Lock()
+			connection.subscriptions[parts[1]] = parts[2]
+			me.lock.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(parts[len(parts)-1])
+			payload := make([]byte, size+2)
+			io.ReadFull(reader, payload)
+
+			if parts[1] != "corporal.policy.snapshot" || len(parts) != 4 {
+				continue
+			}
+
+			me.lock.Lock()
+			me.snapshotsServed++
+			snapshot := me.snapshot
+			sid := connection.subscriptions[parts[2]]
+			me.lock.Unlock()
+
+			io.WriteString(conn, fmt.Sprintf("MSG %s %s %d\r\n%s\r\n", parts[2], sid, len(snapshot), snapshot))
+		}
+	}
+}
+
+// publish delivers the message to all connections subscribed to the policy updates subject
+func (me *testNatsServer) publish(message string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	for _, connection := range me.connections {
+		if sid, exists := connection.subscriptions["corporal.policy"]; exists {
+			io.WriteString(connection.conn, fmt.Sprintf("MSG corporal.policy %s %d\r\n%s\r\n", sid, len(message), message))
+		}
+	}
+}
+
+func (me *testNatsServer) setSnapshot(snapshot string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.snapshot = snapshot
+}
+
+func (me *testNatsServer) getSnapshotsServed() int {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return me.snapshotsServed
+}
+
+func (me *testNatsServer) close() {
+	me.listener.Close()
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	for _, connection := range me.connections {
+		connection.conn.Close()
+	}
+}
+
+func createTestNatsPolicyMessage(sequence int, userIds ...string) string {
+	users := make([]string, 0, len(userIds))
+	for _, userId := range userIds {
+		users = append(users, createTestNatsUser(userId))
+	}
+	return fmt.Sprintf(`{"sequence": %d, "type": "policy", "policy": {"schemaVersion": 1, "users": [%s]}}`, sequence, strings.Join(users, ", "))
+}
+
+func createTestNatsUser(userId string) string {
+	return fmt.Sprintf(`{"id": "%s", "active": true, "authType": "plain", "authCredential": "secret"}`, userId)
+}
+
+func createTestNatsProvider(t *testing.T, serverUrl string, cachePath string) (*NatsProvider, *policy.Store) {
+	store, parser := createTestStoreAndParser(t)
+
+	provider, err := NewNatsProvider(configuration.PolicyProvider{
+		"Url":                 serverUrl,
+		"Subject":             "corporal.policy",
+		"SnapshotSubject":     "corporal.policy.snapshot",
+		"Token":               "nats-token",
+		"CachePath":           cachePath,
+		"TimeoutMilliseconds": float64(5000),
+	}, store, parser, createTestLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return provider, store
+}
+
+func TestNatsProviderAppliesMessagesInSequence(t *testing.T) {
+	server := newTestNatsServer(t)
+	server.setSnapshot(createTestNatsPolicyMessage(1, "@a:example.com"))
+
+	provider, store := createTestNatsProvider(t, server.url(), "")
+	loadReporter := &testLoadReporter{}
+	store.SetLoadReporter(loadReporter)
+
+	err := provider.Start()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer provider.Stop()
+
+	// The initial snapshot is waited for
+	assertTestStoreUserIds(t, store, "@a:example.com")
+
+	server.publish(fmt.Sprintf(`{"sequence": 2, "type": "userUpsert", "user": %s}`, createTestNatsUser("@b:example.com")))
+	// Already-seen messages are ignored
+	server.publish(`{"sequence": 2, "type": "userDelete", "userId": "@a:example.com"}`)
+	server.publish(fmt.Sprintf(`{"sequence": 3, "type": "userUpsert", "user": %s}`, createTestNatsUser("@c:example.com")))
+	waitForTestCondition(t, "the deltas to be applied", func() bool {
+		return testStoreHasUserIds(store, "@a:example.com", "@b:example.com", "@c:example.com")
+	})
+
+	server.publish(`{"sequence": 4, "type": "userDelete", "userId": "@a:example.com"}`)
+	waitForTestCondition(t, "the user to be removed", func() bool {
+		return testStoreHasUserIds(store, "@b:example.com", "@c:example.com")
+	})
+
+	// Deltas resulting in bad policies are reported, leaving the current policy intact
+	server.publish(fmt.Sprintf(`{"sequence": 5, "type": "userUpsert", "user": %s}`, createTestNatsUser("@d:other.com")))
+	waitForTestCondition(t, "the bad delta to be reported", func() bool {
+		return loadReporter.failuresCount() == 1
+	})
+	assertTestStoreUserIds(t, store, "@b:example.com", "@c:example.com")
+
+	// Full policies replace everything
+	server.publish(createTestNatsPolicyMessage(6, "@e:example.com"))
+	waitForTestCondition(t, "the full policy to be applied", func() bool {
+		return testStoreHasUserIds(store, "@e:example.com")
+	})
+	if server.getSnapshotsServed() != 1 {
+		t.Errorf("expected no snapshots to be requested besides the initial one, got %d", server.getSnapshotsServed())
+	}
+
+	// Missing messages makes us re-synchronize, with the delta that revealed the gap not being applied
+	server.setSnapshot(createTestNatsPolicyMessage(9, "@e:example.com", "@f:example.com"))
+	server.publish(fmt.Sprintf(`{"sequence": 9, "type": "userUpsert", "user": %s}`, createTestNatsUser("@g:example.com")))
+	waitForTestCondition(t, "the snapshot to be applied", func() bool {
+		return testStoreHasUserIds(store, "@e:example.com", "@f:example.com")
+	})
+	if server.getSnapshotsServed() != 2 {
+		t.Errorf("expected a snapshot to be requested, got %d", server.getSnapshotsServed())
+	}
+
+	server.publish(`{"sequence": 10, "type": "userDelete", "userId": "@e:example.com"}`)
+	waitForTestCondition(t, "deltas to be applied on top of the snapshot", func() bool {
+		return testStoreHasUserIds(store, "@f:example.com")
+	})
+
+	server.lock.Lock()
+	if len(server.authTokens) != 1 || server.authTokens[0] != "nats-token" {
+		t.Errorf("expected a single connection, authenticated with the token, got: %v", server.authTokens)
+	}
+	server.lock.Unlock()
+}
+
+func TestNatsProviderFallsBackToTheCache(t *testing.T) {
+	directory, err := ioutil.TempDir("", "nats-provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	cachePath := filepath.Join(directory, "policy.json")
+
+	server := newTestNatsServer(t)
+	server.setSnapshot(createTestNatsPolicyMessage(1, "@a:example.com"))
+
+	provider, _ := createTestNatsProvider(t, server.url(), cachePath)
+	err = provider.Start()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	provider.Stop()
+
+	// NATS is unreachable from now on
+	serverUrl := server.url()
+	server.close()
+
+	provider, store := createTestNatsProvider(t, serverUrl, cachePath)
+	err = provider.Start()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	provider.Stop()
+
+	assertTestStoreUserIds(t, store, "@a:example.com")
+	if provider.lastSequence != 0 {
+		t.Errorf("expected the sequence to be unknown for cached policies, got: %d", provider.lastSequence)
+	}
+
+	// Without anything cached, there's nothing to start with
+	os.Remove(cachePath)
+
+	provider, store = createTestNatsProvider(t, serverUrl, cachePath)
+	err = provider.Start()
+	if err == nil {
+		provider.Stop()
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+}
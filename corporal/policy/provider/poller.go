@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pollingPolicy controls how a poller spaces out its polls.
+// It's built out of the optional `ReloadJitterPercent`, `ReloadBackoffMaxSeconds` and `ReloadFailureAlertThreshold`
+// configuration keys of pull-style providers which reload periodically.
+type pollingPolicy struct {
+	// jitterPercent randomizes each wait by up to +/- this percentage,
+	// so that many matrix-corporal instances don't all hit the policy server at the same time.
+	jitterPercent int
+
+	// backoffMax is the longest we'd wait between polls, while doubling the wait after each consecutive failure.
+	// Backoff is disabled if this is not larger than the regular interval.
+	backoffMax time.Duration
+
+	// failureAlertThreshold specifies after how many consecutive failures to raise an alert (0 disables alerting).
+	failureAlertThreshold int
+}
+
+func parsePollingPolicy(config configuration.PolicyProvider) (pollingPolicy, error) {
+	var result pollingPolicy
+
+	jitterPercentPtr, err := getOptionalIntConfigValue(config, "ReloadJitterPercent")
+	if err != nil {
+		return result, err
+	}
+	if jitterPercentPtr != nil {
+		if *jitterPercentPtr < 0 || *jitterPercentPtr > 100 {
+			return result, fmt.Errorf("ReloadJitterPercent needs to be between 0 and 100")
+		}
+		result.jitterPercent = *jitterPercentPtr
+	}
+
+	backoffMaxSecondsPtr, err := getOptionalIntConfigValue(config, "ReloadBackoffMaxSeconds")
+	if err != nil {
+		return result, err
+	}
+	if backoffMaxSecondsPtr != nil && *backoffMaxSecondsPtr > 0 {
+		result.backoffMax = time.Duration(*backoffMaxSecondsPtr) * time.Second
+	}
+
+	failureAlertThresholdPtr, err := getOptionalIntConfigValue(config, "ReloadFailureAlertThreshold")
+	if err != nil {
+		return result, err
+	}
+	if failureAlertThresholdPtr != nil && *failureAlertThresholdPtr > 0 {
+		result.failureAlertThreshold = *failureAlertThresholdPtr
+	}
+
+	return result, nil
+}
+
+// poller periodically invokes a poll function (e.g. reloading a policy), according to a pollingPolicy.
+//
+// Failures are reported to the store (see policy.Store.ReportLoadFailure),
+// except when they reach the alert threshold, in which case an alert is raised instead.
+type poller struct {
+	providerType  string
+	interval      time.Duration
+	pollingPolicy pollingPolicy
+	poll          func() error
+	store         *policy.Store
+	logger        *logrus.Logger
+
+	stopChannel         chan struct{}
+	consecutiveFailures int
+}
+
+func newPoller(
+	providerType string,
+	interval time.Duration,
+	pollingPolicy pollingPolicy,
+	poll func() error,
+	store *policy.Store,
+	logger *logrus.Logger,
+) *poller {
+	return &poller{
+		providerType:  providerType,
+		interval:      interval,
+		pollingPolicy: pollingPolicy,
+		poll:          poll,
+		store:         store,
+		logger:        logger,
+
+		stopChannel: make(chan struct{}),
+	}
+}
+
+func (me *poller) start() {
+	go me.run()
+}
+
+func (me *poller) stop() {
+	close(me.stopChannel)
+}
+
+func (me *poller) run() {
+	for {
+		if !sleepUnlessStopped(me.nextDelay(), me.stopChannel) {
+			return
+		}
+
+		me.logger.Debugf("Auto-reloading for policy provider: %s", me.providerType)
+
+		err := me.poll()
+		if err == nil {
+			if me.isAlerting() {
+				me.logger.Infof("Policy provider %s recovered, after %d consecutive reload failures", me.providerType, me.consecutiveFailures)
+			}
+			me.consecutiveFailures = 0
+			continue
+		}
+
+		me.consecutiveFailures++
+
+		if me.consecutiveFailures == me.pollingPolicy.failureAlertThreshold {
+			me.logger.Errorf(
+				"Policy provider %s failed reloading %d consecutive times, the last error being: %s",
+				me.providerType,
+				me.consecutiveFailures,
+				err,
+			)
+			me.store.ReportLoadFailureAlert(me.providerType, err, me.consecutiveFailures)
+			continue
+		}
+
+		me.logger.Infof("Failed reloading policy (%d consecutive failures): %s", me.consecutiveFailures, err)
+		me.store.ReportLoadFailure(me.providerType, err)
+	}
+}
+
+func (me *poller) isAlerting() bool {
+	return me.pollingPolicy.failureAlertThreshold > 0 && me.consecutiveFailures >= me.pollingPolicy.failureAlertThreshold
+}
+
+func (me *poller) nextDelay() time.Duration {
+	delay := me.interval
+
+	if me.pollingPolicy.backoffMax > me.interval {
+		for i := 0; i < me.consecutiveFailures && delay < me.pollingPolicy.backoffMax; i++ {
+			delay *= 2
+		}
+		if delay > me.pollingPolicy.backoffMax {
+			delay = me.pollingPolicy.backoffMax
+		}
+	}
+
+	if me.pollingPolicy.jitterPercent > 0 {
+		// A random factor between -jitterPercent% and +jitterPercent%
+		jitterFactor := float64(me.pollingPolicy.jitterPercent) / 100 * (rand.Float64()*2 - 1)
+		delay += time.Duration(float64(delay) * jitterFactor)
+	}
+
+	return delay
+}
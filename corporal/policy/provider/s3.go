@@ -0,0 +1,407 @@
+package provider
+
+import (
+	"crypto/md5"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// S3Provider is a policy provider which fetches the policy from an object in S3-compatible storage.
+//
+// On each reload, conditional (`If-None-Match`) requests are made using the ETag of the last-loaded object,
+// so that unchanged policies are neither transferred, nor re-applied.
+type S3Provider struct {
+	store                 *policy.Store
+	parser                *policy.Parser
+	objectUrl             *url.URL
+	region                string
+	key                   string
+	credentials           s3Credentials
+	sseCustomerKey        []byte
+	cachePath             *string
+	reloadIntervalSeconds *int
+	reloadPollingPolicy   pollingPolicy
+	logger                *logrus.Logger
+
+	httpClient   *http.Client
+	reloadPoller *poller
+	lockLoad     sync.Mutex
+
+	// lastETag holds the ETag of the last object we've successfully loaded
+	lastETag string
+
+	signatureRequirement *providerSignatureRequirement
+
+	// signatureObjectUrl points to the detached signature object (`<Key>.sig`), if one is required
+	signatureObjectUrl *url.URL
+}
+
+func NewS3Provider(
+	config configuration.PolicyProvider,
+	store *policy.Store,
+	parser *policy.Parser,
+	logger *logrus.Logger,
+) (*S3Provider, error) {
+	bucket, err := getRequiredStringConfigValue(config, "Bucket")
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+
+	key, err := getRequiredStringConfigValue(config, "Key")
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+
+	region, err := getRequiredStringConfigValue(config, "Region")
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+
+	endpoint, err := getOptionalStringConfigValue(config, "Endpoint")
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	usePathStyle, err := getOptionalBoolConfigValue(config, "UsePathStyle")
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+
+	objectUrl, err := buildS3ObjectUrl(endpoint, bucket, key, usePathStyle)
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+
+	credentials, err := loadS3Credentials(config)
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+
+	var sseCustomerKey []byte
+	sseCustomerKeyBase64, err := getOptionalStringConfigValue(config, "SSECustomerKey")
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+	if sseCustomerKeyBase64 != "" {
+		sseCustomerKey, err = base64.StdEncoding.DecodeString(sseCustomerKeyBase64)
+		if err != nil || len(sseCustomerKey) != 32 {
+			return nil, fmt.Errorf("S3 provider: SSECustomerKey is expected to be a base64-encoded 256-bit key")
+		}
+	}
+
+	cachePath, err := getOptionalStringConfigValue(config, "CachePath")
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+	var cachePathPtr *string
+	if cachePath != "" {
+		cachePathPtr = &cachePath
+	}
+
+	reloadIntervalSecondsPtr, err := getOptionalIntConfigValue(config, "ReloadIntervalSeconds")
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+	if reloadIntervalSecondsPtr != nil && *reloadIntervalSecondsPtr <= 0 {
+		reloadIntervalSecondsPtr = nil
+	}
+
+	var timeoutDuration time.Duration
+	timeoutMillisecondsPtr, err := getOptionalIntConfigValue(config, "TimeoutMilliseconds")
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+	if timeoutMillisecondsPtr != nil && *timeoutMillisecondsPtr > 0 {
+		timeoutDuration = time.Duration(*timeoutMillisecondsPtr) * time.Millisecond
+	}
+
+	reloadPollingPolicy, err := parsePollingPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+
+	signatureRequirement, err := parseProviderSignatureRequirement(config)
+	if err != nil {
+		return nil, fmt.Errorf("S3 provider: %s", err)
+	}
+	parser = restrictParserForSignatureRequirement(parser, signatureRequirement)
+
+	var signatureObjectUrl *url.URL
+	if signatureRequirement != nil && signatureRequirement.isDetached() {
+		signatureObjectUrl, err = buildS3ObjectUrl(endpoint, bucket, key+".sig", usePathStyle)
+		if err != nil {
+			return nil, fmt.Errorf("S3 provider: %s", err)
+		}
+	}
+
+	return &S3Provider{
+		store:                 store,
+		parser:                parser,
+		objectUrl:             objectUrl,
+		region:                region,
+		key:                   key,
+		credentials:           credentials,
+		sseCustomerKey:        sseCustomerKey,
+		cachePath:             cachePathPtr,
+		reloadIntervalSeconds: reloadIntervalSecondsPtr,
+		reloadPollingPolicy:   reloadPollingPolicy,
+		logger:                logger,
+
+		httpClient: &http.Client{
+			Timeout: timeoutDuration,
+		},
+
+		signatureRequirement: signatureRequirement,
+		signatureObjectUrl:   signatureObjectUrl,
+	}, nil
+}
+
+func (me *S3Provider) Type() string {
+	return "s3"
+}
+
+func (me *S3Provider) Start() error {
+	me.logger.Infof("Starting policy provider: %s (%s)", me.Type(), me.objectUrl)
+
+	err := me.load(true, false)
+
+	if err != nil {
+		return err
+	}
+
+	if me.reloadIntervalSeconds != nil {
+		me.logger.Infof("Auto-reloading for policy provider %s will happen every %d seconds", me.Type(), *me.reloadIntervalSeconds)
+
+		me.reloadPoller = newPoller(
+			me.Type(),
+			time.Duration(*me.reloadIntervalSeconds)*time.Second,
+			me.reloadPollingPolicy,
+			func() error {
+				return me.load(false, true)
+			},
+			me.store,
+			me.logger,
+		)
+		me.reloadPoller.start()
+	}
+
+	return nil
+}
+
+func (me *S3Provider) Stop() {
+	me.logger.Infof("Stopping policy provider: %s", me.Type())
+
+	if me.reloadPoller != nil {
+		me.reloadPoller.stop()
+	}
+}
+
+func (me *S3Provider) Reload() {
+	me.logger.Infof("Reloading policy from provider: %s", me.Type())
+
+	// An explicit reload means "fetch fresh data", so we don't make the request conditional.
+	err := me.load(false, false)
+	if err != nil {
+		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+func (me *S3Provider) load(allowedToLoadFromCache bool, conditional bool) error {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	var ifNoneMatch string
+	if conditional {
+		ifNoneMatch = me.lastETag
+	}
+
+	policyBytes, contentType, eTag, errRemote := me.fetchObject(me.objectUrl, ifNoneMatch)
+	if errRemote == nil && policyBytes == nil {
+		me.logger.Debugf("Policy object is unchanged (ETag: %s)", ifNoneMatch)
+		return nil
+	}
+
+	isFromCache := false
+
+	if errRemote != nil {
+		me.logger.Warnf("Failed loading policy from S3 (%s): %s", me.objectUrl, errRemote)
+
+		if !allowedToLoadFromCache {
+			return fmt.Errorf("failed loading policy from S3 (%s), while cache-loading is not allowed", errRemote)
+		}
+
+		var errCache error
+		policyBytes, errCache = loadPolicyBytesFromCacheFile(me.cachePath)
+		if errCache != nil {
+			return fmt.Errorf("failed loading policy from S3 (%s) and from cache (%s)", errRemote, errCache)
+		}
+
+		me.logger.Debugf("Successfully loaded policy from cache")
+		isFromCache = true
+	}
+
+	documentBytes := policyBytes
+	var detachedSignature []byte
+	if me.signatureRequirement != nil {
+		var err error
+		if me.signatureRequirement.isDetached() {
+			if isFromCache {
+				detachedSignature, err = readDetachedSignatureFile(*detachedSignatureCachePath(me.cachePath))
+			} else {
+				detachedSignature, _, _, err = me.fetchObject(me.signatureObjectUrl, "")
+			}
+			if err != nil {
+				return fmt.Errorf("failed loading detached policy signature: %s", err)
+			}
+		}
+
+		documentBytes, err = me.signatureRequirement.verify(policyBytes, detachedSignature)
+		if err != nil {
+			return fmt.Errorf("policy signature error: %s", err)
+		}
+	}
+
+	policyObj, err := me.parser.ParseFormat(documentBytes, policy.DetectFormat(contentType, me.key))
+	if err != nil {
+		return err
+	}
+
+	if !isFromCache {
+		err := storePolicyBytesInCacheFile(me.cachePath, policyBytes)
+		if err == nil && detachedSignature != nil {
+			err = storePolicyBytesInCacheFile(detachedSignatureCachePath(me.cachePath), detachedSignature)
+		}
+		if err != nil {
+			me.logger.Warnf("failed storing policy in cache: %s", err)
+		}
+	}
+
+	err = me.store.Set(policyObj, me.Type())
+	if err != nil {
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	if !isFromCache {
+		me.lastETag = eTag
+	}
+
+	return nil
+}
+
+// fetchObject fetches an object (the policy or its detached signature) from S3.
+// When ifNoneMatch is provided and the object's ETag matches it, nil bytes (and no error) are returned.
+func (me *S3Provider) fetchObject(objectUrl *url.URL, ifNoneMatch string) ([]byte, string /* contentType */, string /* eTag */, error) {
+	req, err := http.NewRequest("GET", objectUrl.String(), nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if me.sseCustomerKey != nil {
+		keyMd5 := md5.Sum(me.sseCustomerKey)
+		req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+		req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key", base64.StdEncoding.EncodeToString(me.sseCustomerKey))
+		req.Header.Set("X-Amz-Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(keyMd5[:]))
+	}
+
+	if me.credentials.accessKeyId != "" {
+		signS3Request(req, me.credentials, me.region, time.Now())
+	}
+
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+
+	resp, err := me.httpClient.Do(req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, "", "", nil
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, "", "", fmt.Errorf("non-200 response fetching from S3: %d", resp.StatusCode)
+	}
+
+	bodyBytes, err := policy.ReadDocument(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed reading S3 response body: %s", err)
+	}
+
+	return bodyBytes, resp.Header.Get("Content-Type"), resp.Header.Get("ETag"), nil
+}
+
+func buildS3ObjectUrl(endpoint string, bucket string, key string, usePathStyle bool) (*url.URL, error) {
+	endpointUrl, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("bad Endpoint: %s", err)
+	}
+	if endpointUrl.Scheme != "http" && endpointUrl.Scheme != "https" {
+		return nil, fmt.Errorf("bad Endpoint (expected an http:// or https:// URL): %s", endpoint)
+	}
+
+	path := "/" + strings.TrimPrefix(key, "/")
+	if usePathStyle {
+		path = "/" + bucket + path
+	} else {
+		endpointUrl.Host = bucket + "." + endpointUrl.Host
+	}
+
+	endpointUrl.Path = endpointUrl.Path + path
+	endpointUrl.RawPath = s3EscapePath(endpointUrl.Path)
+
+	return endpointUrl, nil
+}
+
+// loadS3Credentials loads credentials from the configuration,
+// falling back to the standard AWS environment variables for anything that's not defined there.
+// Having no credentials at all is allowed (for public buckets).
+func loadS3Credentials(config configuration.PolicyProvider) (s3Credentials, error) {
+	var credentials s3Credentials
+	var err error
+
+	credentials.accessKeyId, err = getOptionalStringConfigValue(config, "AccessKeyId")
+	if err != nil {
+		return credentials, err
+	}
+
+	credentials.secretAccessKey, err = getOptionalStringConfigValue(config, "SecretAccessKey")
+	if err != nil {
+		return credentials, err
+	}
+
+	credentials.sessionToken, err = getOptionalStringConfigValue(config, "SessionToken")
+	if err != nil {
+		return credentials, err
+	}
+
+	if credentials.accessKeyId == "" && credentials.secretAccessKey == "" {
+		credentials.accessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+		credentials.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if credentials.sessionToken == "" {
+			credentials.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+	}
+
+	if (credentials.accessKeyId == "") != (credentials.secretAccessKey == "") {
+		return credentials, fmt.Errorf("AccessKeyId and SecretAccessKey need to be specified together")
+	}
+
+	return credentials, nil
+}
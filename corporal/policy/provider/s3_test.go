@@ -0,0 +1,240 @@
+package provider
+
+import (
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testS3Server serves a single (changeable) policy object, the way S3 does (ETags, conditional requests)
+type testS3Server struct {
+	*httptest.Server
+
+	lock         sync.Mutex
+	object       string
+	eTag         string
+	failing      bool
+	requestPaths []string
+	ifNoneMatch  []string
+	authorized   []bool
+}
+
+func newTestS3Server(t *testing.T) *testS3Server {
+	server := &testS3Server{}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+
+		server.requestPaths = append(server.requestPaths, r.URL.Path)
+		server.ifNoneMatch = append(server.ifNoneMatch, r.Header.Get("If-None-Match"))
+		server.authorized = append(server.authorized, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-access-key/"))
+
+		if server.failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if r.URL.Path != "/bucket/policy.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == server.eTag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", server.eTag)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(server.object))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func (me *testS3Server) setObject(object string, eTag string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.object = object
+	me.eTag = eTag
+}
+
+func (me *testS3Server) setFailing(failing bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.failing = failing
+}
+
+func createTestS3Provider(t *testing.T, server *testS3Server, extraConfig configuration.PolicyProvider) (*S3Provider, *policy.Store) {
+	store, parser := createTestStoreAndParser(t)
+
+	config := configuration.PolicyProvider{
+		"Bucket":       "bucket",
+		"Key":          "policy.json",
+		"Region":       "us-east-1",
+		"Endpoint":     server.URL,
+		"UsePathStyle": true,
+	}
+	for key, value := range extraConfig {
+		config[key] = value
+	}
+
+	provider, err := NewS3Provider(config, store, parser, createTestLogger())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return provider, store
+}
+
+func TestS3ProviderLoadsAndConditionallyReloads(t *testing.T) {
+	server := newTestS3Server(t)
+	server.setObject(createTestValidPolicyDocument("@a:example.com"), `"etag-1"`)
+
+	provider, store := createTestS3Provider(t, server, configuration.PolicyProvider{
+		"AccessKeyId":     "test-access-key",
+		"SecretAccessKey": "test-secret-key",
+	})
+
+	err := provider.load(true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertTestStoreUserIds(t, store, "@a:example.com")
+
+	if server.requestPaths[0] != "/bucket/policy.json" {
+		t.Errorf("expected a path-style request for the object, got: %s", server.requestPaths[0])
+	}
+	if !server.authorized[0] {
+		t.Errorf("expected the request to be signed with the configured credentials")
+	}
+
+	// Reloading an unchanged object doesn't re-apply it
+	loadedPolicy := store.Get()
+	err = provider.load(false, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if server.ifNoneMatch[1] != `"etag-1"` {
+		t.Errorf("expected a conditional request for the last-seen ETag, got: %s", server.ifNoneMatch[1])
+	}
+	if store.Get() != loadedPolicy {
+		t.Errorf("expected the unchanged policy to not be re-applied")
+	}
+
+	server.setObject(createTestValidPolicyDocument("@b:example.com"), `"etag-2"`)
+	err = provider.load(false, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertTestStoreUserIds(t, store, "@b:example.com")
+
+	// Explicit reloads are not conditional
+	err = provider.load(false, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if server.ifNoneMatch[3] != "" {
+		t.Errorf("expected an unconditional request, got one for ETag: %s", server.ifNoneMatch[3])
+	}
+	if store.Get() == loadedPolicy {
+		t.Errorf("expected the policy to be re-applied")
+	}
+}
+
+func TestS3ProviderFallsBackToTheCache(t *testing.T) {
+	directory, err := ioutil.TempDir("", "s3-provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	cachePath := filepath.Join(directory, "policy.json")
+
+	server := newTestS3Server(t)
+	server.setObject(createTestValidPolicyDocument("@a:example.com"), `"etag-1"`)
+
+	provider, _ := createTestS3Provider(t, server, configuration.PolicyProvider{"CachePath": cachePath})
+	err = provider.load(true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cachedBytes, _ := ioutil.ReadFile(cachePath)
+	if string(cachedBytes) != createTestValidPolicyDocument("@a:example.com") {
+		t.Errorf("expected the object to be cached as it is, got: %s", cachedBytes)
+	}
+
+	server.setFailing(true)
+
+	// Reloads don't fall back to the cache, as we'd rather keep the policy we have
+	provider, store := createTestS3Provider(t, server, configuration.PolicyProvider{"CachePath": cachePath})
+	err = provider.load(false, true)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if store.Get() != nil {
+		t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+	}
+
+	// Starting up does
+	err = provider.load(true, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	assertTestStoreUserIds(t, store, "@a:example.com")
+
+	// Without a cache, there's nothing to fall back to
+	provider, store = createTestS3Provider(t, server, nil)
+	err = provider.load(true, false)
+	if err == nil || !strings.Contains(err.Error(), "cache disabled") {
+		t.Errorf("expected a cache error, got: %v", err)
+	}
+}
+
+func TestS3ProviderRejectsInvalidPolicies(t *testing.T) {
+	type testData struct {
+		name   string
+		object string
+	}
+
+	tests := []testData{
+		{"not JSON", `{"schemaVersion": 1, `},
+		{"invalid policy", `{"schemaVersion": 1, "users": [{"id": "@a:other.com", "active": true, "authType": "plain", "authCredential": "secret"}]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestS3Server(t)
+			server.setObject(test.object, `"etag-1"`)
+
+			provider, store := createTestS3Provider(t, server, nil)
+			err := provider.load(true, false)
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+			if store.Get() != nil {
+				t.Errorf("expected no policy to be loaded, got: %#v", store.Get())
+			}
+
+			// A failed load doesn't count as having seen the object, so the next reload isn't conditional on its ETag
+			server.setObject(createTestValidPolicyDocument("@a:example.com"), `"etag-1"`)
+			err = provider.load(false, true)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			assertTestStoreUserIds(t, store, "@a:example.com")
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// providerSignatureFormatDetached is for signatures which are fetched separately (e.g. `policy.json.sig` alongside `policy.json`).
+	// The signature is a (raw or base64-encoded) Ed25519 signature of the policy document, exactly as fetched.
+	providerSignatureFormatDetached = "detached"
+
+	// providerSignatureFormatJws is for policy documents wrapped in a compact JWS (`header.payload.signature`, EdDSA-signed).
+	providerSignatureFormatJws = "jws"
+)
+
+// providerSignatureRequirement makes a policy provider only accept policies signed by one of a few pinned keys.
+//
+// This is independent of (and in addition to) transport security and the global policy signing configuration (see policy.SignatureVerifier),
+// so that a compromised policy server (or bucket, file share, etc.) can't feed us a policy.
+// It's built out of the provider's (optional) `Signature` configuration object.
+type providerSignatureRequirement struct {
+	format     string
+	publicKeys map[string]ed25519.PublicKey
+
+	// uri optionally specifies where to fetch detached signatures from (for providers which support it).
+	uri string
+}
+
+func parseProviderSignatureRequirement(config configuration.PolicyProvider) (*providerSignatureRequirement, error) {
+	if config["Signature"] == nil {
+		return nil, nil
+	}
+
+	signatureConfigMap, ok := config["Signature"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Signature is expected to be an object or NULL")
+	}
+	signatureConfig := configuration.PolicyProvider(signatureConfigMap)
+
+	format, err := getRequiredStringConfigValue(signatureConfig, "Format")
+	if err != nil {
+		return nil, fmt.Errorf("Signature: %s", err)
+	}
+	if format != providerSignatureFormatDetached && format != providerSignatureFormatJws {
+		return nil, fmt.Errorf("Signature: unknown format: %s", format)
+	}
+
+	uri, err := getOptionalStringConfigValue(signatureConfig, "Uri")
+	if err != nil {
+		return nil, fmt.Errorf("Signature: %s", err)
+	}
+
+	publicKeysInterface, ok := signatureConfig["PublicKeys"].(map[string]interface{})
+	if !ok || len(publicKeysInterface) == 0 {
+		return nil, fmt.Errorf("Signature: PublicKeys needs to be a non-empty object")
+	}
+
+	publicKeysBase64 := map[string]string{}
+	for keyId, publicKeyInterface := range publicKeysInterface {
+		publicKeyBase64, ok := publicKeyInterface.(string)
+		if !ok {
+			return nil, fmt.Errorf("Signature: public key `%s` is expected to be a string", keyId)
+		}
+		publicKeysBase64[keyId] = publicKeyBase64
+	}
+
+	publicKeys, err := policy.ParsePublicKeys(publicKeysBase64)
+	if err != nil {
+		return nil, fmt.Errorf("Signature: %s", err)
+	}
+
+	return &providerSignatureRequirement{
+		format:     format,
+		publicKeys: publicKeys,
+		uri:        uri,
+	}, nil
+}
+
+// restrictParserForSignatureRequirement returns the parser to use for policies verified by the given requirement (if any).
+//
+// The signature only covers the document that the provider fetches, not the documents which it could include (see the policy's `includes` field).
+// Those could come from the very place that the signature is meant to protect against, so policies making use of includes get rejected.
+func restrictParserForSignatureRequirement(parser *policy.Parser, signatureRequirement *providerSignatureRequirement) *policy.Parser {
+	if signatureRequirement == nil {
+		return parser
+	}
+	return parser.WithIncludesForbidden("included documents are not covered by the policy provider's signature requirement")
+}
+
+func (me *providerSignatureRequirement) isDetached() bool {
+	return me.format == providerSignatureFormatDetached
+}
+
+// verify checks the fetched document (and its detached signature, for the detached format)
+// and returns the policy document that it carries.
+func (me *providerSignatureRequirement) verify(document []byte, detachedSignature []byte) ([]byte, error) {
+	if me.isDetached() {
+		err := me.verifyDetached(document, detachedSignature)
+		if err != nil {
+			return nil, err
+		}
+		return document, nil
+	}
+
+	return me.verifyJws(document)
+}
+
+func (me *providerSignatureRequirement) verifyDetached(document []byte, detachedSignature []byte) error {
+	if detachedSignature == nil {
+		return fmt.Errorf("missing detached policy signature")
+	}
+
+	signature := detachedSignature
+	if len(signature) != ed25519.SignatureSize {
+		var err error
+		signature, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(detachedSignature)))
+		if err != nil {
+			return fmt.Errorf("failed base64-decoding detached policy signature: %s", err)
+		}
+	}
+
+	for _, publicKey := range me.publicKeys {
+		if ed25519.Verify(publicKey, document, signature) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("policy is not signed by any of the pinned keys")
+}
+
+func (me *providerSignatureRequirement) verifyJws(document []byte) ([]byte, error) {
+	parts := strings.Split(string(bytes.TrimSpace(document)), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("policy is not a compact JWS, while a JWS signature is required")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding JWS header: %s", err)
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyId     string `json:"kid"`
+	}
+	err = json.Unmarshal(headerBytes, &header)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing JWS header: %s", err)
+	}
+
+	// Trusting the `alg` header blindly is a classic JWS pitfall. We only ever accept the algorithm our keys are for.
+	if header.Algorithm != "EdDSA" {
+		return nil, fmt.Errorf("unsupported JWS algorithm: %s", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding JWS signature: %s", err)
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+
+	publicKeys := me.publicKeys
+	if header.KeyId != "" {
+		publicKey, exists := me.publicKeys[header.KeyId]
+		if !exists {
+			return nil, fmt.Errorf("policy is signed by a key which is not pinned: %s", header.KeyId)
+		}
+		publicKeys = map[string]ed25519.PublicKey{header.KeyId: publicKey}
+	}
+
+	for _, publicKey := range publicKeys {
+		if ed25519.Verify(publicKey, signingInput, signature) {
+			payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("failed decoding JWS payload: %s", err)
+			}
+			return payload, nil
+		}
+	}
+
+	return nil, fmt.Errorf("policy is not signed by any of the pinned keys")
+}
+
+// detachedSignatureCachePath returns the path of the file that a detached signature gets cached in, next to the cached policy
+func detachedSignatureCachePath(cachePath *string) *string {
+	if cachePath == nil {
+		return nil
+	}
+	signatureCachePath := *cachePath + ".sig"
+	return &signatureCachePath
+}
+
+// readDetachedSignatureFile reads a detached signature file, returning nil if it doesn't exist
+func readDetachedSignatureFile(path string) ([]byte, error) {
+	signature, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return signature, nil
+}
@@ -0,0 +1,263 @@
+package provider
+
+import (
+	"crypto/ed25519"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testProviderPolicyDocument = `{"schemaVersion": 1, "users": [{"id": "@a:example.com", "active": true}]}`
+
+type testSigningKey struct {
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func generateTestSigningKey(t *testing.T) testSigningKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return testSigningKey{publicKey: publicKey, privateKey: privateKey}
+}
+
+func createTestSignatureRequirement(t *testing.T, format string, publicKeys map[string]ed25519.PublicKey) *providerSignatureRequirement {
+	publicKeysConfig := map[string]interface{}{}
+	for keyId, publicKey := range publicKeys {
+		publicKeysConfig[keyId] = base64.StdEncoding.EncodeToString(publicKey)
+	}
+
+	signatureRequirement, err := parseProviderSignatureRequirement(configuration.PolicyProvider{
+		"Signature": map[string]interface{}{
+			"Format":     format,
+			"PublicKeys": publicKeysConfig,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return signatureRequirement
+}
+
+// createTestJws creates a compact JWS for the payload, with the given header and a signature (of signedPayload) by the given key
+func createTestJws(header map[string]string, payload string, signedPayload string, privateKey ed25519.PrivateKey) []byte {
+	headerBytes, _ := json.Marshal(header)
+	encodedHeader := base64.RawURLEncoding.EncodeToString(headerBytes)
+
+	signature := ed25519.Sign(privateKey, []byte(encodedHeader+"."+base64.RawURLEncoding.EncodeToString([]byte(signedPayload))))
+
+	return []byte(fmt.Sprintf(
+		"%s.%s.%s",
+		encodedHeader,
+		base64.RawURLEncoding.EncodeToString([]byte(payload)),
+		base64.RawURLEncoding.EncodeToString(signature),
+	))
+}
+
+func TestProviderSignatureRequirementVerifyDetached(t *testing.T) {
+	pinnedKey := generateTestSigningKey(t)
+	otherKey := generateTestSigningKey(t)
+
+	signatureRequirement := createTestSignatureRequirement(t, providerSignatureFormatDetached, map[string]ed25519.PublicKey{"pinned": pinnedKey.publicKey})
+
+	validSignature := ed25519.Sign(pinnedKey.privateKey, []byte(testProviderPolicyDocument))
+
+	type testData struct {
+		name              string
+		document          string
+		detachedSignature []byte
+		isValid           bool
+	}
+
+	tests := []testData{
+		{"valid raw signature", testProviderPolicyDocument, validSignature, true},
+		{"valid base64-encoded signature", testProviderPolicyDocument, []byte(base64.StdEncoding.EncodeToString(validSignature) + "\n"), true},
+		{"tampered payload", strings.Replace(testProviderPolicyDocument, "true", "false", 1), validSignature, false},
+		{"wrong key", testProviderPolicyDocument, ed25519.Sign(otherKey.privateKey, []byte(testProviderPolicyDocument)), false},
+		{"missing signature", testProviderPolicyDocument, nil, false},
+		{"signature not in base64", testProviderPolicyDocument, []byte("%%"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document, err := signatureRequirement.verify([]byte(test.document), test.detachedSignature)
+
+			if !test.isValid {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(document) != test.document {
+				t.Errorf("expected the document to be returned as is, got: %s", document)
+			}
+		})
+	}
+}
+
+func TestProviderSignatureRequirementVerifyJws(t *testing.T) {
+	pinnedKey := generateTestSigningKey(t)
+	otherPinnedKey := generateTestSigningKey(t)
+	unpinnedKey := generateTestSigningKey(t)
+
+	signatureRequirement := createTestSignatureRequirement(t, providerSignatureFormatJws, map[string]ed25519.PublicKey{
+		"pinned":       pinnedKey.publicKey,
+		"other-pinned": otherPinnedKey.publicKey,
+	})
+
+	type testData struct {
+		name     string
+		document []byte
+		isValid  bool
+	}
+
+	tests := []testData{
+		{
+			name:     "valid signature",
+			document: createTestJws(map[string]string{"alg": "EdDSA", "kid": "pinned"}, testProviderPolicyDocument, testProviderPolicyDocument, pinnedKey.privateKey),
+			isValid:  true,
+		},
+		{
+			name:     "valid signature without a key id",
+			document: createTestJws(map[string]string{"alg": "EdDSA"}, testProviderPolicyDocument, testProviderPolicyDocument, otherPinnedKey.privateKey),
+			isValid:  true,
+		},
+		{
+			name:     "tampered payload",
+			document: createTestJws(map[string]string{"alg": "EdDSA", "kid": "pinned"}, strings.Replace(testProviderPolicyDocument, "true", "false", 1), testProviderPolicyDocument, pinnedKey.privateKey),
+			isValid:  false,
+		},
+		{
+			name:     "wrong key",
+			document: createTestJws(map[string]string{"alg": "EdDSA"}, testProviderPolicyDocument, testProviderPolicyDocument, unpinnedKey.privateKey),
+			isValid:  false,
+		},
+		{
+			name:     "key id of another pinned key",
+			document: createTestJws(map[string]string{"alg": "EdDSA", "kid": "other-pinned"}, testProviderPolicyDocument, testProviderPolicyDocument, pinnedKey.privateKey),
+			isValid:  false,
+		},
+		{
+			name:     "unknown key id",
+			document: createTestJws(map[string]string{"alg": "EdDSA", "kid": "unknown"}, testProviderPolicyDocument, testProviderPolicyDocument, pinnedKey.privateKey),
+			isValid:  false,
+		},
+		{
+			name:     "unsupported algorithm",
+			document: createTestJws(map[string]string{"alg": "none", "kid": "pinned"}, testProviderPolicyDocument, testProviderPolicyDocument, pinnedKey.privateKey),
+			isValid:  false,
+		},
+		{
+			name:     "unsigned policy",
+			document: []byte(testProviderPolicyDocument),
+			isValid:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, err := signatureRequirement.verify(test.document, nil)
+
+			if !test.isValid {
+				if err == nil {
+					t.Errorf("expected an error, got payload: %s", payload)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(payload) != testProviderPolicyDocument {
+				t.Errorf("expected the JWS payload, got: %s", payload)
+			}
+		})
+	}
+}
+
+func TestParseProviderSignatureRequirement(t *testing.T) {
+	publicKeyBase64 := base64.StdEncoding.EncodeToString(generateTestSigningKey(t).publicKey)
+
+	signatureRequirement, err := parseProviderSignatureRequirement(configuration.PolicyProvider{})
+	if err != nil || signatureRequirement != nil {
+		t.Errorf("expected no signature requirement without a Signature object, got: %#v (%v)", signatureRequirement, err)
+	}
+
+	type testData struct {
+		name   string
+		config map[string]interface{}
+	}
+
+	tests := []testData{
+		{"missing format", map[string]interface{}{"PublicKeys": map[string]interface{}{"key": publicKeyBase64}}},
+		{"unknown format", map[string]interface{}{"Format": "pgp", "PublicKeys": map[string]interface{}{"key": publicKeyBase64}}},
+		{"missing public keys", map[string]interface{}{"Format": "jws"}},
+		{"empty public keys", map[string]interface{}{"Format": "jws", "PublicKeys": map[string]interface{}{}}},
+		{"public key not a string", map[string]interface{}{"Format": "jws", "PublicKeys": map[string]interface{}{"key": 5}}},
+		{"invalid public key", map[string]interface{}{"Format": "jws", "PublicKeys": map[string]interface{}{"key": "c2hvcnQ="}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseProviderSignatureRequirement(configuration.PolicyProvider{"Signature": test.config})
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestSignedProviderPoliciesCannotInclude(t *testing.T) {
+	pinnedKey := generateTestSigningKey(t)
+	signatureRequirement := createTestSignatureRequirement(t, providerSignatureFormatJws, map[string]ed25519.PublicKey{"pinned": pinnedKey.publicKey})
+
+	directory, err := ioutil.TempDir("", "provider-signature")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	// The included document is not signed, as there'd be no way to sign it anyway
+	includedPath := filepath.Join(directory, "users.json")
+	ioutil.WriteFile(includedPath, []byte(`{"users": [{"id": "@included:example.com", "active": true}]}`), 0600)
+
+	signatureVerifier, err := policy.NewSignatureVerifier(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	parser := policy.NewParser(signatureVerifier)
+
+	rootDocument := fmt.Sprintf(`{"schemaVersion": 1, "includes": [%q]}`, includedPath)
+	payload, err := signatureRequirement.verify(createTestJws(map[string]string{"alg": "EdDSA", "kid": "pinned"}, rootDocument, rootDocument, pinnedKey.privateKey), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = restrictParserForSignatureRequirement(parser, signatureRequirement).Parse(payload)
+	if err == nil {
+		t.Errorf("expected a signed policy making use of includes to be rejected")
+	}
+
+	// Policies without includes are not affected, and neither are providers without a signature requirement
+	_, err = restrictParserForSignatureRequirement(parser, signatureRequirement).Parse([]byte(testProviderPolicyDocument))
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	_, err = restrictParserForSignatureRequirement(parser, nil).Parse(payload)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
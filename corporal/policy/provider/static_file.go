@@ -16,9 +16,12 @@ import (
 
 type StaticFileProvider struct {
 	store  *policy.Store
+	parser *policy.Parser
 	path   string
 	logger *logrus.Logger
 
+	signatureRequirement *providerSignatureRequirement
+
 	lockLoad sync.Mutex
 	watcher  *fsnotify.Watcher
 }
@@ -26,6 +29,7 @@ type StaticFileProvider struct {
 func NewStaticFileProvider(
 	config configuration.PolicyProvider,
 	store *policy.Store,
+	parser *policy.Parser,
 	logger *logrus.Logger,
 ) (*StaticFileProvider, error) {
 	path, exists := config["Path"]
@@ -33,6 +37,12 @@ func NewStaticFileProvider(
 		return nil, fmt.Errorf("static file provider requires a Path")
 	}
 
+	signatureRequirement, err := parseProviderSignatureRequirement(config)
+	if err != nil {
+		return nil, fmt.Errorf("static file provider: %s", err)
+	}
+	parser = restrictParserForSignatureRequirement(parser, signatureRequirement)
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed initializing inotify watcher: %s", err)
@@ -40,9 +50,12 @@ func NewStaticFileProvider(
 
 	return &StaticFileProvider{
 		store:  store,
+		parser: parser,
 		path:   path.(string),
 		logger: logger,
 
+		signatureRequirement: signatureRequirement,
+
 		watcher: watcher,
 	}, nil
 }
@@ -78,6 +91,7 @@ func (me *StaticFileProvider) Reload() {
 
 	if err != nil {
 		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
 	}
 }
 
@@ -96,12 +110,29 @@ func (me *StaticFileProvider) load() error {
 		return err
 	}
 
-	policy, err := createPolicyFromJsonBytes(bytes)
+	if me.signatureRequirement != nil {
+		var detachedSignature []byte
+		if me.signatureRequirement.isDetached() {
+			detachedSignature, err = readDetachedSignatureFile(me.path + ".sig")
+			if err != nil {
+				return fmt.Errorf("failed reading detached policy signature: %s", err)
+			}
+		}
+
+		bytes, err = me.signatureRequirement.verify(bytes, detachedSignature)
+		if err != nil {
+			return fmt.Errorf("policy signature error: %s", err)
+		}
+	}
+
+	format := policy.DetectFormat("", me.path)
+
+	policy, err := me.parser.ParseFormat(bytes, format)
 	if err != nil {
 		return fmt.Errorf("policy load error: %s", err)
 	}
 
-	err = me.store.Set(policy)
+	err = me.store.Set(policy, me.Type())
 	if err != nil {
 		return fmt.Errorf("policy set error: %s", err)
 	}
@@ -129,6 +160,7 @@ func (me *StaticFileProvider) watch() {
 					me.logger.Infof("Reloaded policy from %s", me.path)
 				} else {
 					me.logger.Warnf("Failed to reload policy from %s: %s", me.path, err)
+					me.store.ReportLoadFailure(me.Type(), err)
 				}
 			})
 
@@ -1,16 +1,95 @@
 package provider
 
 import (
-	"devture-matrix-corporal/corporal/policy"
-	"encoding/json"
+	"devture-matrix-corporal/corporal/configuration"
+	"fmt"
+	"io/ioutil"
+	"time"
 )
 
-func createPolicyFromJsonBytes(data []byte) (*policy.Policy, error) {
-	var policy policy.Policy
-	err := json.Unmarshal(data, &policy)
+func getRequiredStringConfigValue(config configuration.PolicyProvider, key string) (string, error) {
+	value, err := getOptionalStringConfigValue(config, key)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	if value == "" {
+		return "", fmt.Errorf("missing a required configuration key: %s", key)
+	}
+	return value, nil
+}
+
+// getOptionalStringConfigValue returns a string value out of the configuration, or an empty string if it's undefined (or NULL)
+func getOptionalStringConfigValue(config configuration.PolicyProvider, key string) (string, error) {
+	valueInterface, exists := config[key]
+	if !exists || valueInterface == nil {
+		return "", nil
+	}
+
+	value, ok := valueInterface.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is expected to be a string or NULL", key)
+	}
+	return value, nil
+}
+
+// getOptionalIntConfigValue returns an integer value out of the configuration, or nil if it's undefined (or NULL)
+func getOptionalIntConfigValue(config configuration.PolicyProvider, key string) (*int, error) {
+	valueInterface, exists := config[key]
+	if !exists || valueInterface == nil {
+		return nil, nil
+	}
+
+	valueFloat, ok := valueInterface.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s is expected to be a number or NULL", key)
+	}
+	value := int(valueFloat)
+	return &value, nil
+}
+
+// getOptionalBoolConfigValue returns a boolean value out of the configuration, or false if it's undefined (or NULL)
+func getOptionalBoolConfigValue(config configuration.PolicyProvider, key string) (bool, error) {
+	valueInterface, exists := config[key]
+	if !exists || valueInterface == nil {
+		return false, nil
 	}
 
-	return &policy, nil
+	value, ok := valueInterface.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s is expected to be a boolean or NULL", key)
+	}
+	return value, nil
+}
+
+// loadPolicyBytesFromCacheFile reads a policy document (exactly as it had been received) out of the given cache file
+func loadPolicyBytesFromCacheFile(cachePath *string) ([]byte, error) {
+	if cachePath == nil {
+		return nil, fmt.Errorf("cache disabled")
+	}
+
+	return ioutil.ReadFile(*cachePath)
+}
+
+// storePolicyBytesInCacheFile stores a policy document (exactly as it had been received) in the given cache file.
+// Storing the original document (as opposed to a re-serialized policy) lets signed policies be verified again when restoring them.
+func storePolicyBytesInCacheFile(cachePath *string, policyBytes []byte) error {
+	if cachePath == nil {
+		return nil
+	}
+
+	return ioutil.WriteFile(*cachePath, policyBytes, 0600)
+}
+
+// sleepUnlessStopped waits for the given duration, unless the stop channel gets closed in the meantime.
+// It tells whether the wait completed (as opposed to being interrupted by stopping).
+func sleepUnlessStopped(duration time.Duration, stopChannel chan struct{}) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stopChannel:
+		return false
+	}
 }
@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"devture-matrix-corporal/corporal/policy"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func createTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+// createTestStoreAndParser creates an (empty) policy store for the example.com domain, along with a parser which doesn't verify signatures
+func createTestStoreAndParser(t *testing.T) (*policy.Store, *policy.Parser) {
+	logger := createTestLogger()
+
+	signatureVerifier, err := policy.NewSignatureVerifier(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	history, err := policy.NewHistory(logger, 0, "", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return policy.NewStore(logger, policy.NewValidator("example.com"), history), policy.NewParser(signatureVerifier)
+}
+
+// createTestValidPolicyDocument creates a (valid) policy document, which only contains the given user
+func createTestValidPolicyDocument(userId string) string {
+	return fmt.Sprintf(`{"schemaVersion": 1, "users": [{"id": "%s", "active": true, "authType": "plain", "authCredential": "secret"}]}`, userId)
+}
+
+// assertTestStoreUserIds fails the test, unless the policy in the store contains exactly the given users (in this order)
+func assertTestStoreUserIds(t *testing.T, store *policy.Store, expectedUserIds ...string) {
+	currentPolicy := store.Get()
+	if currentPolicy == nil {
+		t.Fatalf("expected a policy with users %v, got none", expectedUserIds)
+	}
+
+	userIds := make([]string, 0, len(currentPolicy.User))
+	for _, userPolicy := range currentPolicy.User {
+		userIds = append(userIds, userPolicy.Id)
+	}
+
+	if fmt.Sprint(userIds) != fmt.Sprint(expectedUserIds) {
+		t.Fatalf("expected a policy with users %v, got %v", expectedUserIds, userIds)
+	}
+}
+
+// waitForTestCondition waits (for a few seconds at most) for the condition to become true, failing the test otherwise.
+// It's useful for providers which apply policies in the background (watches, subscriptions, etc.)
+func waitForTestCondition(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for: %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// testStoreHasUserIds tells whether the policy in the store contains exactly the given users (in this order)
+func testStoreHasUserIds(store *policy.Store, userIds ...string) bool {
+	currentPolicy := store.Get()
+	if currentPolicy == nil || len(currentPolicy.User) != len(userIds) {
+		return false
+	}
+
+	for idx, userPolicy := range currentPolicy.User {
+		if userPolicy.Id != userIds[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// testLoadReporter is a policy.LoadReporter, which keeps track of the reported failures
+type testLoadReporter struct {
+	lock     sync.Mutex
+	failures []error
+}
+
+func (me *testLoadReporter) ReportLoadSuccess(source string, previous *policy.Policy, current *policy.Policy) {
+}
+
+func (me *testLoadReporter) ReportLoadFailure(source string, err error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.failures = append(me.failures, err)
+}
+
+func (me *testLoadReporter) ReportLoadFailureAlert(source string, err error, consecutiveFailures int) {
+}
+
+func (me *testLoadReporter) failuresCount() int {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return len(me.failures)
+}
@@ -0,0 +1,214 @@
+package provider
+
+import (
+	"bytes"
+	"devture-matrix-corporal/corporal/configuration"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/vault"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// VaultProvider is a policy provider which reads the policy document out of a field of a HashiCorp Vault secret.
+//
+// It relies on the globally-configured Vault client (see the `Vault` configuration section).
+type VaultProvider struct {
+	store                 *policy.Store
+	parser                *policy.Parser
+	vaultClient           *vault.Client
+	path                  string
+	field                 string
+	format                string
+	cachePath             *string
+	reloadIntervalSeconds *int
+	reloadPollingPolicy   pollingPolicy
+	logger                *logrus.Logger
+
+	reloadPoller *poller
+	lockLoad     sync.Mutex
+
+	// lastPolicyBytes holds the last policy document we've successfully loaded from Vault,
+	// so that we can avoid re-applying an unchanged policy on each reload.
+	lastPolicyBytes []byte
+}
+
+func NewVaultProvider(
+	config configuration.PolicyProvider,
+	store *policy.Store,
+	parser *policy.Parser,
+	vaultClient *vault.Client,
+	logger *logrus.Logger,
+) (*VaultProvider, error) {
+	if vaultClient == nil {
+		return nil, fmt.Errorf("Vault provider: Vault integration needs to be enabled (see the Vault configuration section)")
+	}
+
+	path, err := getRequiredStringConfigValue(config, "Path")
+	if err != nil {
+		return nil, fmt.Errorf("Vault provider: %s", err)
+	}
+
+	field, err := getOptionalStringConfigValue(config, "Field")
+	if err != nil {
+		return nil, fmt.Errorf("Vault provider: %s", err)
+	}
+	if field == "" {
+		field = "policy"
+	}
+
+	format, err := getOptionalStringConfigValue(config, "Format")
+	if err != nil {
+		return nil, fmt.Errorf("Vault provider: %s", err)
+	}
+	if format == "" {
+		format = policy.FormatJSON
+	}
+	if format != policy.FormatJSON && format != policy.FormatYAML && format != policy.FormatJSON5 {
+		return nil, fmt.Errorf("Vault provider: unknown format: %s", format)
+	}
+
+	cachePath, err := getOptionalStringConfigValue(config, "CachePath")
+	if err != nil {
+		return nil, fmt.Errorf("Vault provider: %s", err)
+	}
+	var cachePathPtr *string
+	if cachePath != "" {
+		cachePathPtr = &cachePath
+	}
+
+	reloadIntervalSecondsPtr, err := getOptionalIntConfigValue(config, "ReloadIntervalSeconds")
+	if err != nil {
+		return nil, fmt.Errorf("Vault provider: %s", err)
+	}
+	if reloadIntervalSecondsPtr != nil && *reloadIntervalSecondsPtr <= 0 {
+		reloadIntervalSecondsPtr = nil
+	}
+
+	reloadPollingPolicy, err := parsePollingPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("Vault provider: %s", err)
+	}
+
+	return &VaultProvider{
+		store:                 store,
+		parser:                parser,
+		vaultClient:           vaultClient,
+		path:                  path,
+		field:                 field,
+		format:                format,
+		cachePath:             cachePathPtr,
+		reloadIntervalSeconds: reloadIntervalSecondsPtr,
+		reloadPollingPolicy:   reloadPollingPolicy,
+		logger:                logger,
+	}, nil
+}
+
+func (me *VaultProvider) Type() string {
+	return "vault"
+}
+
+func (me *VaultProvider) Start() error {
+	me.logger.Infof("Starting policy provider: %s (%s#%s)", me.Type(), me.path, me.field)
+
+	err := me.load(true, false)
+
+	if err != nil {
+		return err
+	}
+
+	if me.reloadIntervalSeconds != nil {
+		me.logger.Infof("Auto-reloading for policy provider %s will happen every %d seconds", me.Type(), *me.reloadIntervalSeconds)
+
+		me.reloadPoller = newPoller(
+			me.Type(),
+			time.Duration(*me.reloadIntervalSeconds)*time.Second,
+			me.reloadPollingPolicy,
+			func() error {
+				return me.load(false, true)
+			},
+			me.store,
+			me.logger,
+		)
+		me.reloadPoller.start()
+	}
+
+	return nil
+}
+
+func (me *VaultProvider) Stop() {
+	me.logger.Infof("Stopping policy provider: %s", me.Type())
+
+	if me.reloadPoller != nil {
+		me.reloadPoller.stop()
+	}
+}
+
+func (me *VaultProvider) Reload() {
+	me.logger.Infof("Reloading policy from provider: %s", me.Type())
+
+	// An explicit reload re-applies the policy even if it's unchanged,
+	// as the secrets it references may have changed.
+	err := me.load(false, false)
+	if err != nil {
+		me.logger.Infof("Failed reloading policy: %s", err)
+		me.store.ReportLoadFailure(me.Type(), err)
+	}
+}
+
+func (me *VaultProvider) load(allowedToLoadFromCache bool, skipIfUnchanged bool) error {
+	me.lockLoad.Lock()
+	defer me.lockLoad.Unlock()
+
+	isFromCache := false
+
+	policyString, errRemote := me.vaultClient.ReadSecretField(me.path, me.field)
+	policyBytes := []byte(policyString)
+
+	if errRemote != nil {
+		me.logger.Warnf("Failed loading policy from Vault (%s): %s", me.path, errRemote)
+
+		if !allowedToLoadFromCache {
+			return fmt.Errorf("failed loading policy from Vault (%s), while cache-loading is not allowed", errRemote)
+		}
+
+		var errCache error
+		policyBytes, errCache = loadPolicyBytesFromCacheFile(me.cachePath)
+		if errCache != nil {
+			return fmt.Errorf("failed loading policy from Vault (%s) and from cache (%s)", errRemote, errCache)
+		}
+
+		me.logger.Debugf("Successfully loaded policy from cache")
+		isFromCache = true
+	}
+
+	if skipIfUnchanged && bytes.Equal(policyBytes, me.lastPolicyBytes) {
+		me.logger.Debugf("Policy in Vault is unchanged")
+		return nil
+	}
+
+	policyObj, err := me.parser.ParseFormat(policyBytes, me.format)
+	if err != nil {
+		return err
+	}
+
+	if !isFromCache {
+		err := storePolicyBytesInCacheFile(me.cachePath, policyBytes)
+		if err != nil {
+			me.logger.Warnf("failed storing policy in cache: %s", err)
+		}
+	}
+
+	err = me.store.Set(policyObj, me.Type())
+	if err != nil {
+		return fmt.Errorf("policy set error: %s", err)
+	}
+
+	if !isFromCache {
+		me.lastPolicyBytes = policyBytes
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package policy
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+	"regexp"
+)
+
+// PushRuleIdPrefix is what the ids of push rules managed by us start with (see UserPushRule.GetRuleId).
+// Push rules with other ids (e.g. ones created by users themselves) are left untouched.
+const PushRuleIdPrefix = "com.devture.matrix.corporal."
+
+// Push rule kinds, which managed push rules can be of.
+// The `room` and `sender` kinds are not supported, because their rule ids need to be room/user ids (and can't have our prefix).
+const (
+	PushRuleKindOverride  = "override"
+	PushRuleKindContent   = "content"
+	PushRuleKindUnderride = "underride"
+)
+
+var knownPushRuleKinds = []string{PushRuleKindOverride, PushRuleKindContent, PushRuleKindUnderride}
+
+var pushRuleIdRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// UserPushRule is a push rule (see https://spec.matrix.org/latest/client-server-api/#push-rules), which a user is to have
+type UserPushRule struct {
+	// Id identifies the rule among the user's managed push rules. The actual rule id is prefixed (see GetRuleId).
+	Id string `json:"id"`
+
+	// Kind is one of the supported push rule kinds (see PushRuleKindOverride, etc.)
+	Kind string `json:"kind"`
+
+	// Actions are the push rule actions (e.g. `["notify", {"set_tweak": "sound", "value": "default"}]`)
+	Actions []interface{} `json:"actions"`
+
+	// Conditions are the push rule conditions (for the `override` and `underride` kinds)
+	Conditions []map[string]interface{} `json:"conditions"`
+
+	// Pattern is the glob pattern to match against message bodies (for the `content` kind)
+	Pattern string `json:"pattern"`
+}
+
+func (me UserPushRule) Validate() error {
+	if !pushRuleIdRegex.MatchString(me.Id) {
+		return fmt.Errorf("push rule id `%s` is invalid (only letters, digits, `.`, `_` and `-` are allowed)", me.Id)
+	}
+
+	if !util.IsStringInArray(me.Kind, knownPushRuleKinds) {
+		return fmt.Errorf("push rule `%s` has an invalid kind (%s)", me.Id, me.Kind)
+	}
+
+	if me.Kind == PushRuleKindContent && me.Pattern == "" {
+		return fmt.Errorf("push rule `%s` is of the `%s` kind, but has no pattern", me.Id, me.Kind)
+	}
+
+	if me.Kind != PushRuleKindContent && me.Pattern != "" {
+		return fmt.Errorf("push rule `%s` has a pattern, which only rules of the `%s` kind can have", me.Id, PushRuleKindContent)
+	}
+
+	if me.Actions == nil {
+		return fmt.Errorf("push rule `%s` has no actions (an empty list is fine)", me.Id)
+	}
+
+	return nil
+}
+
+// GetRuleId returns the actual (prefixed) id of the push rule (see PushRuleIdPrefix)
+func (me UserPushRule) GetRuleId() string {
+	return PushRuleIdPrefix + me.Id
+}
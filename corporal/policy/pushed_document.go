@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"fmt"
+)
+
+// PushedDocument is a (possibly signed) document pushed to the HTTP API, as it was received
+type PushedDocument struct {
+	// UserId is the user whose user policy the document contains (see Parser.ParseUserPolicy).
+	// It's empty for documents containing a whole policy.
+	UserId string `json:"userId,omitempty"`
+
+	Data   []byte `json:"data"`
+	Format string `json:"format"`
+}
+
+// PushedDocuments returns the documents which this policy was parsed from, if it came from the HTTP API:
+// a whole policy (see Parser.ParsePushedFormat), followed by the user policies pushed on top of it since (see WithPushedUserPolicy).
+//
+// Unlike a re-serialized copy of the policy, these keep their signature (if any) and can be parsed again (see Parser.ParsePushedDocuments),
+// which is useful for persisting the policy without losing the ability to verify it.
+// Policies which didn't come from the HTTP API (or which were modified in some other way) have none.
+func (me *Policy) PushedDocuments() []PushedDocument {
+	return me.pushedDocuments
+}
+
+// WithPushedUserPolicy is like WithUserPolicy, but for a user policy parsed from a document pushed to the HTTP API,
+// which gets added to the policy's pushed documents (if it has any).
+func (me Policy) WithPushedUserPolicy(userPolicy *UserPolicy, document PushedDocument) Policy {
+	pushedDocuments := me.pushedDocuments
+
+	modified := me.WithUserPolicy(userPolicy)
+
+	if pushedDocuments != nil {
+		document.UserId = userPolicy.Id
+
+		modified.pushedDocuments = make([]PushedDocument, 0, len(pushedDocuments)+1)
+		modified.pushedDocuments = append(modified.pushedDocuments, pushedDocuments...)
+		modified.pushedDocuments = append(modified.pushedDocuments, document)
+	}
+
+	return modified
+}
+
+// ParsePushedDocuments parses (and verifies) the given documents, as returned by Policy.PushedDocuments, again
+func (me *Parser) ParsePushedDocuments(documents []PushedDocument) (*Policy, error) {
+	if len(documents) == 0 || documents[0].UserId != "" {
+		return nil, fmt.Errorf("expected the first document to contain a whole policy")
+	}
+
+	policy, err := me.ParsePushedFormat(documents[0].Data, documents[0].Format)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, document := range documents[1:] {
+		if document.UserId == "" {
+			return nil, fmt.Errorf("expected document #%d to contain a user policy", idx+1)
+		}
+
+		userPolicy, err := me.ParseUserPolicy(document.Data, document.Format)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing the user policy of %s: %s", document.UserId, err)
+		}
+
+		if userPolicy.Id == "" {
+			userPolicy.Id = document.UserId
+		}
+		if userPolicy.Id != document.UserId {
+			return nil, fmt.Errorf("user policy id (%s) does not match the user id it was pushed for (%s)", userPolicy.Id, document.UserId)
+		}
+
+		modified := policy.WithPushedUserPolicy(userPolicy, document)
+		policy = &modified
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,489 @@
+package policy
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	RoomStateEventTypeRetention = "m.room.retention"
+	RoomStateEventTypeServerAcl = "m.room.server_acl"
+
+	RoomStateEventTypeJoinRules         = "m.room.join_rules"
+	RoomStateEventTypeGuestAccess       = "m.room.guest_access"
+	RoomStateEventTypeHistoryVisibility = "m.room.history_visibility"
+	RoomStateEventTypeCanonicalAlias    = "m.room.canonical_alias"
+)
+
+var knownJoinRules = []string{"public", "knock", "invite", "private", "restricted", "knock_restricted"}
+var knownGuestAccessValues = []string{"can_join", "forbidden"}
+var knownHistoryVisibilityValues = []string{"invited", "joined", "shared", "world_readable"}
+
+// Room directory visibility values (see RoomPolicy.DirectoryVisibility)
+const (
+	RoomDirectoryVisibilityPublic  = "public"
+	RoomDirectoryVisibilityPrivate = "private"
+)
+
+var knownDirectoryVisibilityValues = []string{RoomDirectoryVisibilityPublic, RoomDirectoryVisibilityPrivate}
+
+// RoomPolicy contains additional settings for a managed room (see Policy.ManagedRoomIds).
+//
+// Settings defined here are enforced both proactively (the reconciler sets the relevant room state events)
+// and reactively (the HTTP gateway rejects state changes which go against the policy).
+type RoomPolicy struct {
+	Id string `json:"id"`
+
+	// Retention holds the message retention settings (`m.room.retention`) that this room needs to adhere to.
+	Retention *RoomRetention `json:"retention"`
+
+	// ServerAcl holds the server ACL baseline (`m.room.server_acl`) for this room.
+	// When nil, the policy-level ServerAcl applies (see Policy.GetEffectiveRoomPolicy).
+	ServerAcl *RoomServerAcl `json:"serverAcl"`
+
+	// JoinRule is the `join_rule` (`m.room.join_rules`) that this room needs to have (e.g. `invite`, `public`).
+	// When empty, it's left for room admins to decide.
+	JoinRule string `json:"joinRule"`
+
+	// GuestAccess is the `guest_access` (`m.room.guest_access`) that this room needs to have (`can_join` or `forbidden`).
+	// When empty, it's left for room admins to decide.
+	GuestAccess string `json:"guestAccess"`
+
+	// HistoryVisibility is the `history_visibility` (`m.room.history_visibility`) that this room needs to have (e.g. `shared`, `joined`).
+	// When empty, it's left for room admins to decide.
+	HistoryVisibility string `json:"historyVisibility"`
+
+	// DirectoryVisibility tells whether this room is to be listed in the homeserver's public room directory (`public`) or not (`private`).
+	// When empty, it's left for room admins to decide. Unlike room state, it's only enforced by the reconciler.
+	DirectoryVisibility string `json:"directoryVisibility"`
+
+	// Aliases lists the (local) aliases (e.g. `#room:example.com`), which are to point to this room.
+	// Missing ones get created by the reconciler, while other aliases of this room in the alias namespace (see Policy.RoomAliasNamespace) get removed.
+	// A nil value means that the room's aliases are not managed by the policy.
+	Aliases []string `json:"aliases"`
+
+	// CanonicalAlias is the alias (one of Aliases), which is to be advertised as the room's main address (`m.room.canonical_alias`).
+	// When empty, it's left for room admins to decide.
+	CanonicalAlias string `json:"canonicalAlias"`
+
+	// UserPowerLevels maps user ids to the (minimum) power level that they need to have in this room.
+	// Users referencing power level templates get added here (see Policy.GetEffectiveRoomPolicy).
+	UserPowerLevels map[string]int64 `json:"userPowerLevels"`
+
+	// PowerLevels holds exact power level settings for this room, which (unlike UserPowerLevels) also get lowered when exceeded.
+	PowerLevels *RoomPowerLevels `json:"powerLevels"`
+
+	// StewardUserId is a (local) user, which the reconciler acts as in this room (for inviting and kicking users, setting room state, etc.),
+	// instead of the matrix-corporal user. This is useful for invite-only or restricted rooms,
+	// which the matrix-corporal user is not part of (or doesn't have enough power in).
+	StewardUserId string `json:"stewardUserId"`
+
+	// ExclusiveMembership makes the reconciler kick members (and revoke invites) of users who are not entitled to be in this room.
+	// See IsMemberEntitled.
+	ExclusiveMembership bool `json:"exclusiveMembership"`
+
+	// AllowedMemberIds lists additional users (e.g. bots), who may be members of this room, even with ExclusiveMembership.
+	AllowedMemberIds []string `json:"allowedMemberIds"`
+
+	// ChildRoomIds makes this room a space, whose children (`m.space.child` state events) are exactly the listed (managed) rooms.
+	// A nil value means that the room's hierarchy is not managed by the policy.
+	ChildRoomIds []string `json:"childRoomIds"`
+}
+
+func (me RoomPolicy) Validate() error {
+	if me.Id == "" {
+		return fmt.Errorf("room has no id")
+	}
+
+	if me.Retention != nil {
+		err := me.Retention.Validate()
+		if err != nil {
+			return fmt.Errorf("bad retention settings: %s", err)
+		}
+	}
+
+	if me.ServerAcl != nil {
+		err := me.ServerAcl.Validate()
+		if err != nil {
+			return fmt.Errorf("bad server ACL settings: %s", err)
+		}
+	}
+
+	if me.PowerLevels != nil {
+		err := me.PowerLevels.Validate()
+		if err != nil {
+			return fmt.Errorf("bad power level settings: %s", err)
+		}
+
+		for userId := range me.PowerLevels.Users {
+			if _, exists := me.UserPowerLevels[userId]; exists {
+				return fmt.Errorf("user %s is listed both in userPowerLevels and powerLevels.users", userId)
+			}
+		}
+	}
+
+	if me.JoinRule != "" && !util.IsStringInArray(me.JoinRule, knownJoinRules) {
+		return fmt.Errorf("`%s` is an invalid join rule", me.JoinRule)
+	}
+
+	if me.GuestAccess != "" && !util.IsStringInArray(me.GuestAccess, knownGuestAccessValues) {
+		return fmt.Errorf("`%s` is an invalid guest access value", me.GuestAccess)
+	}
+
+	if me.HistoryVisibility != "" && !util.IsStringInArray(me.HistoryVisibility, knownHistoryVisibilityValues) {
+		return fmt.Errorf("`%s` is an invalid history visibility value", me.HistoryVisibility)
+	}
+
+	if me.DirectoryVisibility != "" && !util.IsStringInArray(me.DirectoryVisibility, knownDirectoryVisibilityValues) {
+		return fmt.Errorf("`%s` is an invalid directory visibility value", me.DirectoryVisibility)
+	}
+
+	if me.CanonicalAlias != "" && !util.IsStringInArray(me.CanonicalAlias, me.Aliases) {
+		return fmt.Errorf("the canonical alias (%s) is not listed in aliases", me.CanonicalAlias)
+	}
+
+	return nil
+}
+
+// GetActingUserId returns the user that the reconciler acts as in this room: the steward (if any) or the given default (matrix-corporal) user.
+func (me RoomPolicy) GetActingUserId(defaultUserId string) string {
+	if me.StewardUserId != "" {
+		return me.StewardUserId
+	}
+	return defaultUserId
+}
+
+// IsMemberEntitled tells whether the given user may be a member of this room, as far as ExclusiveMembership is concerned.
+//
+// Entitled are managed users supposed to be joined to this room (see Policy.GetEffectiveJoinedRoomIds), the acting user (see GetActingUserId)
+// and those listed in AllowedMemberIds.
+func (me RoomPolicy) IsMemberEntitled(userId string, actingUserId string, policy *Policy) bool {
+	if userId == actingUserId || util.IsStringInArray(userId, me.AllowedMemberIds) {
+		return true
+	}
+
+	userPolicy := policy.GetUserPolicyByUserId(userId)
+	return userPolicy != nil && util.IsStringInArray(me.Id, policy.GetEffectiveJoinedRoomIds(userPolicy))
+}
+
+// GetEnforcedStateEventTypes returns the (empty state key) state event types that this room policy enforces.
+func (me RoomPolicy) GetEnforcedStateEventTypes() []string {
+	var eventTypes []string
+
+	if me.Retention != nil {
+		eventTypes = append(eventTypes, RoomStateEventTypeRetention)
+	}
+
+	if me.ServerAcl != nil {
+		eventTypes = append(eventTypes, RoomStateEventTypeServerAcl)
+	}
+
+	if me.JoinRule != "" {
+		eventTypes = append(eventTypes, RoomStateEventTypeJoinRules)
+	}
+
+	if me.GuestAccess != "" {
+		eventTypes = append(eventTypes, RoomStateEventTypeGuestAccess)
+	}
+
+	if me.HistoryVisibility != "" {
+		eventTypes = append(eventTypes, RoomStateEventTypeHistoryVisibility)
+	}
+
+	if me.CanonicalAlias != "" {
+		eventTypes = append(eventTypes, RoomStateEventTypeCanonicalAlias)
+	}
+
+	if len(me.UserPowerLevels) != 0 || me.PowerLevels != nil {
+		eventTypes = append(eventTypes, RoomStateEventTypePowerLevels)
+	}
+
+	return eventTypes
+}
+
+// IsStateEventContentAllowed tells whether the given state event content (for an empty state key) complies with this room policy.
+// A nil content means that there's no such state event in the room.
+func (me RoomPolicy) IsStateEventContentAllowed(eventType string, content map[string]interface{}) bool {
+	switch eventType {
+	case RoomStateEventTypeRetention:
+		if me.Retention != nil {
+			return me.Retention.IsSatisfiedBy(content)
+		}
+	case RoomStateEventTypeServerAcl:
+		if me.ServerAcl != nil {
+			return me.ServerAcl.IsSatisfiedBy(content)
+		}
+	case RoomStateEventTypeJoinRules:
+		if me.JoinRule != "" {
+			return getStateEventContentString(content, "join_rule", "") == me.JoinRule
+		}
+	case RoomStateEventTypeGuestAccess:
+		if me.GuestAccess != "" {
+			// Rooms without this state event don't allow guests in.
+			return getStateEventContentString(content, "guest_access", "forbidden") == me.GuestAccess
+		}
+	case RoomStateEventTypeHistoryVisibility:
+		if me.HistoryVisibility != "" {
+			// Rooms without this state event default to `shared` history.
+			return getStateEventContentString(content, "history_visibility", "shared") == me.HistoryVisibility
+		}
+	case RoomStateEventTypeCanonicalAlias:
+		if me.CanonicalAlias != "" {
+			// Alternative aliases (`alt_aliases`) are left for room admins to decide.
+			return getStateEventContentString(content, "alias", "") == me.CanonicalAlias
+		}
+	case RoomStateEventTypePowerLevels:
+		if me.PowerLevels != nil && !me.PowerLevels.IsSatisfiedBy(content) {
+			return false
+		}
+		return isPowerLevelsContentSatisfying(content, me.UserPowerLevels)
+	}
+
+	return true
+}
+
+// CreateStateEventContent returns the state event content that the reconciler sets, when the current one is not allowed.
+// The current content (nil, if there's no such state event) is built upon where it makes sense.
+func (me RoomPolicy) CreateStateEventContent(eventType string, currentContent map[string]interface{}) map[string]interface{} {
+	switch eventType {
+	case RoomStateEventTypeRetention:
+		if me.Retention != nil {
+			return me.Retention.ToStateEventContent()
+		}
+	case RoomStateEventTypeServerAcl:
+		if me.ServerAcl != nil {
+			return me.ServerAcl.ApplyToStateEventContent(currentContent)
+		}
+	case RoomStateEventTypeJoinRules:
+		if me.JoinRule != "" {
+			// Other fields (like the `allow` list for `restricted` rooms) are preserved.
+			return copyStateEventContentWith(currentContent, "join_rule", me.JoinRule)
+		}
+	case RoomStateEventTypeGuestAccess:
+		if me.GuestAccess != "" {
+			return copyStateEventContentWith(currentContent, "guest_access", me.GuestAccess)
+		}
+	case RoomStateEventTypeHistoryVisibility:
+		if me.HistoryVisibility != "" {
+			return copyStateEventContentWith(currentContent, "history_visibility", me.HistoryVisibility)
+		}
+	case RoomStateEventTypeCanonicalAlias:
+		if me.CanonicalAlias != "" {
+			return copyStateEventContentWith(currentContent, "alias", me.CanonicalAlias)
+		}
+	case RoomStateEventTypePowerLevels:
+		if len(me.UserPowerLevels) != 0 || me.PowerLevels != nil {
+			content := currentContent
+			if len(me.UserPowerLevels) != 0 {
+				content = applyUserPowerLevelsToContent(content, me.UserPowerLevels)
+			}
+			if me.PowerLevels != nil {
+				content = me.PowerLevels.ApplyToStateEventContent(content)
+			}
+			return content
+		}
+	}
+
+	return nil
+}
+
+// RoomRetention represents `m.room.retention` settings (see https://github.com/matrix-org/matrix-spec-proposals/pull/1763).
+// Values are in milliseconds.
+type RoomRetention struct {
+	// MinLifetime is how long messages need to be kept for (at least).
+	// Room admins cannot lower it (or unset it), when specified.
+	MinLifetime *int64 `json:"minLifetime"`
+
+	// MaxLifetime is how long messages can be kept for (at most).
+	// Room admins cannot raise it (or unset it), when specified.
+	MaxLifetime *int64 `json:"maxLifetime"`
+}
+
+func (me RoomRetention) Validate() error {
+	if me.MinLifetime == nil && me.MaxLifetime == nil {
+		return fmt.Errorf("either minLifetime or maxLifetime needs to be specified")
+	}
+
+	if me.MinLifetime != nil && *me.MinLifetime < 0 {
+		return fmt.Errorf("minLifetime cannot be negative")
+	}
+
+	if me.MaxLifetime != nil && *me.MaxLifetime <= 0 {
+		return fmt.Errorf("maxLifetime needs to be positive")
+	}
+
+	if me.MinLifetime != nil && me.MaxLifetime != nil && *me.MinLifetime > *me.MaxLifetime {
+		return fmt.Errorf("minLifetime cannot be larger than maxLifetime")
+	}
+
+	return nil
+}
+
+// IsSatisfiedBy tells whether the given `m.room.retention` state event content is at least as strict as these settings.
+func (me RoomRetention) IsSatisfiedBy(content map[string]interface{}) bool {
+	minLifetime, minLifetimeExists := getStateEventContentInt64(content, "min_lifetime")
+	maxLifetime, maxLifetimeExists := getStateEventContentInt64(content, "max_lifetime")
+
+	if me.MinLifetime != nil {
+		if !minLifetimeExists || minLifetime < *me.MinLifetime {
+			return false
+		}
+	}
+
+	if me.MaxLifetime != nil {
+		if !maxLifetimeExists || maxLifetime > *me.MaxLifetime {
+			return false
+		}
+	}
+
+	if minLifetimeExists && maxLifetimeExists && minLifetime > maxLifetime {
+		return false
+	}
+
+	return true
+}
+
+func (me RoomRetention) ToStateEventContent() map[string]interface{} {
+	content := map[string]interface{}{}
+
+	if me.MinLifetime != nil {
+		content["min_lifetime"] = *me.MinLifetime
+	}
+
+	if me.MaxLifetime != nil {
+		content["max_lifetime"] = *me.MaxLifetime
+	}
+
+	return content
+}
+
+// RoomServerAcl represents a server ACL baseline (see https://spec.matrix.org/latest/client-server-api/#server-access-control-lists-acls-for-rooms).
+//
+// Rooms can be stricter than the baseline (deny more servers), but not more lenient.
+type RoomServerAcl struct {
+	// Deny contains server names (or glob patterns, like `*.example.com`) which are to be denied.
+	Deny []string `json:"deny"`
+
+	// AllowIpLiterals tells whether servers identified by an IP address (instead of a domain name) are allowed.
+	// When nil, it's left for room admins to decide.
+	AllowIpLiterals *bool `json:"allowIpLiterals"`
+}
+
+func (me RoomServerAcl) Validate() error {
+	for _, server := range me.Deny {
+		if server == "" {
+			return fmt.Errorf("deny list contains an empty server name")
+		}
+	}
+
+	return nil
+}
+
+// IsSatisfiedBy tells whether the given `m.room.server_acl` state event content is at least as strict as this baseline.
+func (me RoomServerAcl) IsSatisfiedBy(content map[string]interface{}) bool {
+	if content == nil {
+		return len(me.Deny) == 0 && (me.AllowIpLiterals == nil || *me.AllowIpLiterals)
+	}
+
+	deniedServers := getStateEventContentStringList(content, "deny")
+	for _, server := range me.Deny {
+		if !util.IsStringInArray(server, deniedServers) {
+			return false
+		}
+	}
+
+	if me.AllowIpLiterals != nil && !*me.AllowIpLiterals {
+		// `allow_ip_literals` defaults to true, when missing.
+		allowIpLiterals, ok := content["allow_ip_literals"].(bool)
+		if !ok || allowIpLiterals {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ApplyToStateEventContent makes the given `m.room.server_acl` state event content comply with this baseline.
+// Whatever (stricter) rules are found in the current content are preserved.
+func (me RoomServerAcl) ApplyToStateEventContent(currentContent map[string]interface{}) map[string]interface{} {
+	content := map[string]interface{}{}
+	for key, value := range currentContent {
+		content[key] = value
+	}
+
+	if _, exists := content["allow"]; !exists {
+		// A missing allow list means no server is allowed (not even our own), so we need to be explicit.
+		content["allow"] = []string{"*"}
+	}
+
+	deniedServers := getStateEventContentStringList(content, "deny")
+	for _, server := range me.Deny {
+		if !util.IsStringInArray(server, deniedServers) {
+			deniedServers = append(deniedServers, server)
+		}
+	}
+	content["deny"] = deniedServers
+
+	if me.AllowIpLiterals != nil && !*me.AllowIpLiterals {
+		content["allow_ip_literals"] = false
+	}
+
+	return content
+}
+
+func copyStateEventContentWith(currentContent map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	content := map[string]interface{}{}
+	for k, v := range currentContent {
+		content[k] = v
+	}
+	content[key] = value
+
+	return content
+}
+
+func getStateEventContentString(content map[string]interface{}, key string, defaultValue string) string {
+	value, ok := content[key].(string)
+	if !ok {
+		return defaultValue
+	}
+	return value
+}
+
+func getStateEventContentStringList(content map[string]interface{}, key string) []string {
+	list := make([]string, 0)
+
+	switch values := content[key].(type) {
+	case []interface{}:
+		for _, value := range values {
+			if valueString, ok := value.(string); ok {
+				list = append(list, valueString)
+			}
+		}
+	case []string:
+		list = append(list, values...)
+	}
+
+	return list
+}
+
+func getStateEventContentInt64(content map[string]interface{}, key string) (int64, bool) {
+	value, exists := content[key]
+	if !exists {
+		return 0, false
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case json.Number:
+		number, err := v.Int64()
+		return number, err == nil
+	}
+
+	return 0, false
+}
@@ -0,0 +1,44 @@
+package policy
+
+// RoomStateEventTypeTombstone is the state event which marks a room as replaced by another one (as done when upgrading rooms).
+// Its `replacement_room` content field contains the id of the successor room.
+const RoomStateEventTypeTombstone = "m.room.tombstone"
+
+// roomSuccessorChainMaxLength limits how many upgrades are followed, to guard against (bogus) tombstones pointing in circles
+const roomSuccessorChainMaxLength = 100
+
+// ResolveRoomSuccessorId follows the chain of upgrades (tombstones) starting at the given room and returns the id of the last room in it.
+// The given map contains the direct successor of each room known to have been upgraded.
+//
+// Rooms which haven't been upgraded resolve to themselves.
+func ResolveRoomSuccessorId(roomSuccessorIds map[string]string, roomId string) string {
+	for i := 0; i < roomSuccessorChainMaxLength; i++ {
+		successorRoomId, exists := roomSuccessorIds[roomId]
+		if !exists || successorRoomId == "" {
+			break
+		}
+		roomId = successorRoomId
+	}
+	return roomId
+}
+
+// WithRoomUpgradesResolved returns a copy of the policy, with upgraded rooms replaced by their (last) successor.
+// The given map contains the direct successor of each room known to have been upgraded (see ResolveRoomSuccessorId).
+//
+// This way, an upgraded managed room keeps being managed under its new id, instead of its dead predecessor being managed.
+func (me Policy) WithRoomUpgradesResolved(roomSuccessorIds map[string]string) Policy {
+	if len(roomSuccessorIds) == 0 {
+		return me
+	}
+
+	return me.withRoomIdsResolved(func(roomId string) (string, bool) {
+		return ResolveRoomSuccessorId(roomSuccessorIds, roomId), true
+	})
+}
+
+// GetTombstoneReplacementRoomId returns the successor room id out of the given `m.room.tombstone` state event content.
+// An empty string is returned if there's no (valid) content.
+func GetTombstoneReplacementRoomId(content map[string]interface{}) string {
+	replacementRoomId, _ := content["replacement_room"].(string)
+	return replacementRoomId
+}
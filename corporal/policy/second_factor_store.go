@@ -0,0 +1,174 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// SecondFactor is what a user (requiring a second factor, see UserPolicy.Require2fa) can log in with, in addition to their password
+type SecondFactor struct {
+	// TotpSecret is the (base32-encoded) TOTP secret (see UserPolicy.TotpSecret)
+	TotpSecret string `json:"totpSecret"`
+
+	// BackupCodeHashes contains the hashes of single-use backup codes (see UserPolicy.BackupCodeHashes)
+	BackupCodeHashes []string `json:"backupCodeHashes"`
+}
+
+// SecondFactorStore keeps the second factors provisioned via the HTTP API, outside of the policy.
+//
+// Unlike changes made to the policy, these are not lost when a new policy gets loaded,
+// and they don't end up anywhere policies do (the policy history, policy dumps, etc.).
+//
+// If a path is specified, the store is persisted to a local file (optionally encrypted), so that it survives restarts.
+type SecondFactorStore struct {
+	path          string
+	encryptionKey []byte
+
+	lock          sync.RWMutex
+	secondFactors map[string]SecondFactor
+}
+
+// NewSecondFactorStore creates a new second factor store, restoring what was persisted to the given path (if any).
+// A nil encryptionKey means no encryption, otherwise it needs to be a 32-byte AES-256 key.
+func NewSecondFactorStore(path string, encryptionKey []byte) (*SecondFactorStore, error) {
+	if encryptionKey != nil && len(encryptionKey) != 32 {
+		return nil, fmt.Errorf("the encryption key needs to be 32 bytes long, not %d", len(encryptionKey))
+	}
+
+	me := &SecondFactorStore{
+		path:          path,
+		encryptionKey: encryptionKey,
+		secondFactors: map[string]SecondFactor{},
+	}
+
+	// Unlike with the policy history, failing to restore is fatal,
+	// as we'd otherwise start overwriting second factors that users have set up
+	err := me.restore()
+	if err != nil {
+		return nil, fmt.Errorf("failed restoring second factors from %s: %s", path, err)
+	}
+
+	return me, nil
+}
+
+// GetForUser returns the second factor the given user can log in with.
+//
+// Second factors provisioned via the HTTP API (see Set) take precedence over the ones defined in the user's policy.
+// A nil store only ever returns the latter.
+func (me *SecondFactorStore) GetForUser(userPolicy *UserPolicy) SecondFactor {
+	if me != nil {
+		me.lock.RLock()
+		secondFactor, exists := me.secondFactors[userPolicy.Id]
+		me.lock.RUnlock()
+
+		if exists {
+			return secondFactor
+		}
+	}
+
+	return SecondFactor{
+		TotpSecret:       userPolicy.TotpSecret,
+		BackupCodeHashes: userPolicy.BackupCodeHashes,
+	}
+}
+
+// Set stores the given user's second factor (replacing the previous one, if any)
+func (me *SecondFactorStore) Set(userId string, secondFactor SecondFactor) error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	previousSecondFactor, existed := me.secondFactors[userId]
+
+	me.secondFactors[userId] = secondFactor
+
+	err := me.persist()
+	if err != nil {
+		// Only keep what's also persisted, so that nobody relies on a second factor which gets lost on restart
+		if existed {
+			me.secondFactors[userId] = previousSecondFactor
+		} else {
+			delete(me.secondFactors, userId)
+		}
+		return fmt.Errorf("failed persisting second factors to %s: %s", me.path, err)
+	}
+
+	return nil
+}
+
+// Remove forgets about the given user's second factor, telling whether there was one
+func (me *SecondFactorStore) Remove(userId string) (bool, error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	secondFactor, exists := me.secondFactors[userId]
+	if !exists {
+		return false, nil
+	}
+
+	delete(me.secondFactors, userId)
+
+	err := me.persist()
+	if err != nil {
+		me.secondFactors[userId] = secondFactor
+		return false, fmt.Errorf("failed persisting second factors to %s: %s", me.path, err)
+	}
+
+	return true, nil
+}
+
+func (me *SecondFactorStore) persist() error {
+	if me.path == "" {
+		return nil
+	}
+
+	jsonBytes, err := json.Marshal(me.secondFactors)
+	if err != nil {
+		return err
+	}
+
+	if me.encryptionKey != nil {
+		jsonBytes, err = encrypt(me.encryptionKey, jsonBytes)
+		if err != nil {
+			return fmt.Errorf("failed encrypting: %s", err)
+		}
+	}
+
+	// Anyone reading TOTP secrets can generate codes, so the file is only readable by us
+	return writeFileAtomically(me.path, jsonBytes)
+}
+
+func (me *SecondFactorStore) restore() error {
+	if me.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(me.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Nothing provisioned yet. That's OK.
+			return nil
+		}
+
+		return err
+	}
+
+	if me.encryptionKey != nil {
+		data, err = decrypt(me.encryptionKey, data)
+		if err != nil {
+			return fmt.Errorf("failed decrypting (is the encryption key right?): %s", err)
+		}
+	}
+
+	secondFactors := map[string]SecondFactor{}
+	err = json.Unmarshal(data, &secondFactors)
+	if err != nil {
+		return fmt.Errorf("failed to decode JSON (is it encrypted?): %s", err)
+	}
+
+	me.secondFactors = secondFactors
+
+	return nil
+}
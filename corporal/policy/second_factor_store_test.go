@@ -0,0 +1,82 @@
+package policy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecondFactorStorePersistsAndRestores(t *testing.T) {
+	directory, err := ioutil.TempDir("", "second-factor-store")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	for name, encryptionKey := range map[string][]byte{"plain": nil, "encrypted": bytes.Repeat([]byte{0x01}, 32)} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(directory, name+".json")
+
+			store, err := NewSecondFactorStore(path, encryptionKey)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for _, userId := range []string{"@a:example.com", "@b:example.com"} {
+				err = store.Set(userId, SecondFactor{TotpSecret: "SECRET" + userId})
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			removed, err := store.Remove("@b:example.com")
+			if err != nil || !removed {
+				t.Fatalf("expected the second factor to be removed (%v)", err)
+			}
+
+			stat, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if stat.Mode().Perm() != 0600 {
+				t.Errorf("expected the file to only be readable by us, got mode %s", stat.Mode().Perm())
+			}
+
+			fileBytes, _ := ioutil.ReadFile(path)
+			if isPlain := bytes.Contains(fileBytes, []byte("SECRET@a:example.com")); isPlain != (encryptionKey == nil) {
+				t.Errorf("expected the file to be in plain text only without an encryption key")
+			}
+
+			store, err = NewSecondFactorStore(path, encryptionKey)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if secondFactor := store.GetForUser(&UserPolicy{Id: "@a:example.com"}); secondFactor.TotpSecret != "SECRET@a:example.com" {
+				t.Errorf("expected the second factor to be restored, got %#v", secondFactor)
+			}
+			if secondFactor := store.GetForUser(&UserPolicy{Id: "@b:example.com", TotpSecret: "POLICY"}); secondFactor.TotpSecret != "POLICY" {
+				t.Errorf("expected the policy's second factor for a user without a stored one, got %#v", secondFactor)
+			}
+		})
+	}
+
+	// Starting out empty would lead to provisioned second factors getting overwritten, so restoring failures are fatal
+	_, err = NewSecondFactorStore(filepath.Join(directory, "encrypted.json"), bytes.Repeat([]byte{0x02}, 32))
+	if err == nil {
+		t.Errorf("expected an error for the wrong encryption key")
+	}
+}
+
+func TestPolicyWithSecondFactorsRedacted(t *testing.T) {
+	userPolicy := &UserPolicy{Id: "@a:example.com", TotpSecret: "SECRET", BackupCodeHashes: []string{"hash"}}
+	policy := Policy{User: []*UserPolicy{userPolicy, {Id: "@b:example.com"}}}
+
+	redacted := policy.WithSecondFactorsRedacted()
+
+	if redacted.User[0].TotpSecret != "" || redacted.User[0].BackupCodeHashes != nil || redacted.User[1].Id != "@b:example.com" {
+		t.Errorf("expected second factors to be redacted, got %#v", redacted.User[0])
+	}
+	if userPolicy.TotpSecret != "SECRET" || len(userPolicy.BackupCodeHashes) != 1 {
+		t.Errorf("expected the original policy to be left alone")
+	}
+}
@@ -0,0 +1,184 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// secretReferenceKey is the key of objects referencing secrets in policy documents.
+// Example: `"authCredential": {"$vault": "secret/data/matrix-corporal#john-password"}`
+const secretReferenceKey = "$vault"
+
+// SecretResolver resolves secrets referenced in policy documents (see resolveSecrets)
+type SecretResolver interface {
+	// ReadSecret reads the data (fields) of the secret at the given path
+	ReadSecret(path string) (map[string]interface{}, error)
+}
+
+// SetSecretResolver enables resolving secret references in policies.
+// Without a secret resolver, policies containing secret references are rejected.
+func (me *Parser) SetSecretResolver(secretResolver SecretResolver) {
+	me.secretResolver = secretResolver
+}
+
+// resolveSecrets replaces all secret references (`{"$vault": "path#field"}` objects) in the policy document
+// with the (string) values of the secrets they point to.
+//
+// This lets policies (and policy files) carry REST auth tokens, password hashes, etc., without them living in plaintext there.
+//
+// Besides the resolved document, it returns the references that the (non-empty) resolved values came from, keyed by value.
+// These get attached to the resulting policy, so that it can be persisted without the values (see Policy.MarshalWithSecretReferences).
+func (me *Parser) resolveSecrets(data []byte) ([]byte, map[string]string, error) {
+	// Most policies don't make use of secrets. Let's not pay the cost of decoding and re-encoding those.
+	if !bytes.Contains(data, []byte(`"`+secretReferenceKey+`"`)) {
+		return data, nil, nil
+	}
+
+	if me.secretResolver == nil {
+		return nil, nil, fmt.Errorf("policy references secrets (`%s`), but no secret store (Vault) is configured", secretReferenceKey)
+	}
+
+	document, err := decodeDocument(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Many references usually point to the same secret (with different fields). Let's not fetch it again for each one.
+	pathToSecretMap := make(map[string]map[string]interface{})
+
+	valueToReferenceMap := make(map[string]string)
+
+	resolved, err := me.resolveSecretsInValue(document, pathToSecretMap, valueToReferenceMap)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resolvedData, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resolvedData, valueToReferenceMap, nil
+}
+
+func (me *Parser) resolveSecretsInValue(
+	value interface{},
+	pathToSecretMap map[string]map[string]interface{},
+	valueToReferenceMap map[string]string,
+) (interface{}, error) {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		if reference, isReference := typedValue[secretReferenceKey]; isReference {
+			resolved, err := me.resolveSecretReference(reference, len(typedValue), pathToSecretMap)
+			if err != nil {
+				return nil, err
+			}
+
+			if resolved != "" {
+				valueToReferenceMap[resolved] = reference.(string)
+			}
+
+			return resolved, nil
+		}
+
+		for key, subValue := range typedValue {
+			resolved, err := me.resolveSecretsInValue(subValue, pathToSecretMap, valueToReferenceMap)
+			if err != nil {
+				return nil, err
+			}
+			typedValue[key] = resolved
+		}
+	case []interface{}:
+		for idx, subValue := range typedValue {
+			resolved, err := me.resolveSecretsInValue(subValue, pathToSecretMap, valueToReferenceMap)
+			if err != nil {
+				return nil, err
+			}
+			typedValue[idx] = resolved
+		}
+	}
+
+	return value, nil
+}
+
+func (me *Parser) resolveSecretReference(
+	reference interface{},
+	referenceObjectKeysCount int,
+	pathToSecretMap map[string]map[string]interface{},
+) (string, error) {
+	referenceString, ok := reference.(string)
+	if !ok || referenceObjectKeysCount != 1 {
+		return "", fmt.Errorf("secret references are expected to look like this: `{\"%s\": \"path/to/secret#field\"}`", secretReferenceKey)
+	}
+
+	parts := strings.SplitN(referenceString, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("secret reference `%s` is not in the `path/to/secret#field` format", referenceString)
+	}
+
+	path, field := parts[0], parts[1]
+
+	secret, exists := pathToSecretMap[path]
+	if !exists {
+		var err error
+		secret, err = me.secretResolver.ReadSecret(path)
+		if err != nil {
+			return "", fmt.Errorf("failed resolving secret reference `%s`: %s", referenceString, err)
+		}
+		pathToSecretMap[path] = secret
+	}
+
+	value, ok := secret[field].(string)
+	if !ok {
+		return "", fmt.Errorf("failed resolving secret reference `%s`: no such (string) field in the secret", referenceString)
+	}
+
+	return value, nil
+}
+
+// MarshalWithSecretReferences is like json.Marshal, but it puts the secret references that values were resolved from (see resolveSecrets)
+// back in place of the values.
+//
+// This is what is to be used for persisting policies, so that secrets never end up on disk.
+// Persisted policies get their references resolved again when parsed (see Parser.ParseWithoutSignatureVerification).
+//
+// Values are matched as a whole, so any other (string) field which happens to have the same value as a secret gets replaced as well.
+// This is harmless, as it resolves back to the same value.
+func (me *Policy) MarshalWithSecretReferences() ([]byte, error) {
+	data, err := json.Marshal(me)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(me.secretReferences) == 0 {
+		return data, nil
+	}
+
+	document, err := decodeDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(replaceSecretValuesWithReferences(document, me.secretReferences))
+}
+
+func replaceSecretValuesWithReferences(value interface{}, valueToReferenceMap map[string]string) interface{} {
+	switch typedValue := value.(type) {
+	case string:
+		if reference, isSecret := valueToReferenceMap[typedValue]; isSecret {
+			return map[string]interface{}{secretReferenceKey: reference}
+		}
+	case map[string]interface{}:
+		for key, subValue := range typedValue {
+			typedValue[key] = replaceSecretValuesWithReferences(subValue, valueToReferenceMap)
+		}
+	case []interface{}:
+		for idx, subValue := range typedValue {
+			typedValue[idx] = replaceSecretValuesWithReferences(subValue, valueToReferenceMap)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,151 @@
+package policy
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// SignedEnvelope is a wrapper around a policy document, which carries one or more Ed25519 signatures for it.
+//
+// Policy providers (or rather, the systems which generate policies) can produce such envelopes
+// and matrix-corporal would verify them (see SignatureVerifier) before loading the wrapped policy.
+//
+// Example:
+//
+//	{
+//		"payload": "BASE64_OF_THE_POLICY_JSON_DOCUMENT",
+//		"signatures": [
+//			{"keyId": "intranet-2024", "signature": "BASE64_OF_THE_ED25519_SIGNATURE_OF_THE_DECODED_PAYLOAD"}
+//		]
+//	}
+type SignedEnvelope struct {
+	// Payload holds the base64-encoded (standard encoding) bytes of the policy JSON document.
+	// Signatures are calculated against the decoded bytes.
+	Payload string `json:"payload"`
+
+	Signatures []SignedEnvelopeSignature `json:"signatures"`
+}
+
+type SignedEnvelopeSignature struct {
+	// KeyID identifies the public key (see the `PolicySigning.PublicKeys` configuration) that this signature can be verified with.
+	KeyID string `json:"keyId"`
+
+	// Signature holds the base64-encoded (standard encoding) Ed25519 signature.
+	Signature string `json:"signature"`
+}
+
+// SignatureVerifier verifies signed policy envelopes (see SignedEnvelope) against a set of trusted public keys.
+//
+// When no public keys are configured, signature verification is disabled.
+// Envelopes are still unwrapped in that case (without verification), and unsigned policy documents are let through as-is.
+//
+// When public keys are configured, only envelopes carrying a valid signature by one of the trusted keys are accepted.
+// Unsigned policies and envelopes with bad signatures are rejected.
+type SignatureVerifier struct {
+	publicKeys map[string]ed25519.PublicKey
+}
+
+// NewSignatureVerifier creates a verifier from a key identifier to base64-encoded Ed25519 public key map.
+func NewSignatureVerifier(publicKeysBase64 map[string]string) (*SignatureVerifier, error) {
+	publicKeys, err := ParsePublicKeys(publicKeysBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignatureVerifier{
+		publicKeys: publicKeys,
+	}, nil
+}
+
+// ParsePublicKeys decodes a key identifier to base64-encoded Ed25519 public key map.
+func ParsePublicKeys(publicKeysBase64 map[string]string) (map[string]ed25519.PublicKey, error) {
+	publicKeys := map[string]ed25519.PublicKey{}
+
+	for keyID, publicKeyBase64 := range publicKeysBase64 {
+		publicKeyBytes, err := base64.StdEncoding.DecodeString(publicKeyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("failed base64-decoding public key `%s`: %s", keyID, err)
+		}
+
+		if len(publicKeyBytes) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf(
+				"public key `%s` has a bad size (%d bytes), expected %d bytes",
+				keyID,
+				len(publicKeyBytes),
+				ed25519.PublicKeySize,
+			)
+		}
+
+		publicKeys[keyID] = ed25519.PublicKey(publicKeyBytes)
+	}
+
+	return publicKeys, nil
+}
+
+func (me *SignatureVerifier) Enabled() bool {
+	return len(me.publicKeys) > 0
+}
+
+// Verify inspects the given policy document and returns the (unwrapped) policy bytes, if it's deemed trustworthy.
+func (me *SignatureVerifier) Verify(data []byte) ([]byte, error) {
+	envelope, isEnvelope := parseSignedEnvelope(data)
+
+	if !isEnvelope {
+		if me.Enabled() {
+			return nil, fmt.Errorf("refusing to load an unsigned policy, while policy signing is enabled")
+		}
+		return data, nil
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed base64-decoding signed envelope payload: %s", err)
+	}
+
+	if !me.Enabled() {
+		return payload, nil
+	}
+
+	// A single valid signature by a trusted key is enough.
+	// Signatures by keys we don't know about are ignored.
+	lastErr := fmt.Errorf("policy is not signed by any of the trusted keys")
+
+	for _, signature := range envelope.Signatures {
+		publicKey, exists := me.publicKeys[signature.KeyID]
+		if !exists {
+			continue
+		}
+
+		signatureBytes, err := base64.StdEncoding.DecodeString(signature.Signature)
+		if err != nil {
+			lastErr = fmt.Errorf("failed base64-decoding signature by key `%s`: %s", signature.KeyID, err)
+			continue
+		}
+
+		if ed25519.Verify(publicKey, payload, signatureBytes) {
+			return payload, nil
+		}
+
+		lastErr = fmt.Errorf("invalid policy signature by key `%s`", signature.KeyID)
+	}
+
+	return nil, lastErr
+}
+
+// parseSignedEnvelope tries to interpret the data as a SignedEnvelope.
+// Regular policy documents do not have a `payload` field, so we use that to tell them apart.
+func parseSignedEnvelope(data []byte) (*SignedEnvelope, bool) {
+	var envelope SignedEnvelope
+	err := json.Unmarshal(data, &envelope)
+	if err != nil {
+		return nil, false
+	}
+
+	if envelope.Payload == "" {
+		return nil, false
+	}
+
+	return &envelope, true
+}
@@ -0,0 +1,209 @@
+package policy
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSignedPolicyDocument = `{"schemaVersion": 1, "users": [{"id": "@a:example.com", "active": true}]}`
+
+func generateTestSigningKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return publicKey, privateKey
+}
+
+func createTestSignatureVerifier(t *testing.T, publicKeys map[string]ed25519.PublicKey) *SignatureVerifier {
+	publicKeysBase64 := map[string]string{}
+	for keyID, publicKey := range publicKeys {
+		publicKeysBase64[keyID] = base64.StdEncoding.EncodeToString(publicKey)
+	}
+
+	signatureVerifier, err := NewSignatureVerifier(publicKeysBase64)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return signatureVerifier
+}
+
+// createTestEnvelope creates a signed envelope for the payload, with a signature (of signedPayload) by each of the given keys
+func createTestEnvelope(payload string, signedPayload string, privateKeys map[string]ed25519.PrivateKey) []byte {
+	envelope := SignedEnvelope{
+		Payload: base64.StdEncoding.EncodeToString([]byte(payload)),
+	}
+	for keyID, privateKey := range privateKeys {
+		envelope.Signatures = append(envelope.Signatures, SignedEnvelopeSignature{
+			KeyID:     keyID,
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(signedPayload))),
+		})
+	}
+
+	envelopeBytes, _ := json.Marshal(envelope)
+	return envelopeBytes
+}
+
+func TestSignatureVerifierVerify(t *testing.T) {
+	trustedPublicKey, trustedPrivateKey := generateTestSigningKey(t)
+	_, otherPrivateKey := generateTestSigningKey(t)
+
+	signatureVerifier := createTestSignatureVerifier(t, map[string]ed25519.PublicKey{"trusted": trustedPublicKey})
+
+	type testData struct {
+		name    string
+		data    []byte
+		isValid bool
+	}
+
+	tests := []testData{
+		{
+			name:    "valid signature",
+			data:    createTestEnvelope(testSignedPolicyDocument, testSignedPolicyDocument, map[string]ed25519.PrivateKey{"trusted": trustedPrivateKey}),
+			isValid: true,
+		},
+		{
+			name: "valid signature along with an unknown key's",
+			data: createTestEnvelope(testSignedPolicyDocument, testSignedPolicyDocument, map[string]ed25519.PrivateKey{
+				"trusted": trustedPrivateKey,
+				"unknown": otherPrivateKey,
+			}),
+			isValid: true,
+		},
+		{
+			name:    "tampered payload",
+			data:    createTestEnvelope(strings.Replace(testSignedPolicyDocument, "true", "false", 1), testSignedPolicyDocument, map[string]ed25519.PrivateKey{"trusted": trustedPrivateKey}),
+			isValid: false,
+		},
+		{
+			name:    "wrong key",
+			data:    createTestEnvelope(testSignedPolicyDocument, testSignedPolicyDocument, map[string]ed25519.PrivateKey{"trusted": otherPrivateKey}),
+			isValid: false,
+		},
+		{
+			name:    "unknown key id",
+			data:    createTestEnvelope(testSignedPolicyDocument, testSignedPolicyDocument, map[string]ed25519.PrivateKey{"unknown": trustedPrivateKey}),
+			isValid: false,
+		},
+		{
+			name:    "no signatures",
+			data:    createTestEnvelope(testSignedPolicyDocument, testSignedPolicyDocument, nil),
+			isValid: false,
+		},
+		{
+			name:    "signature not in base64",
+			data:    []byte(fmt.Sprintf(`{"payload": %q, "signatures": [{"keyId": "trusted", "signature": "%%%%"}]}`, base64.StdEncoding.EncodeToString([]byte(testSignedPolicyDocument)))),
+			isValid: false,
+		},
+		{
+			name:    "payload not in base64",
+			data:    []byte(`{"payload": "%%", "signatures": []}`),
+			isValid: false,
+		},
+		{
+			name:    "unsigned policy",
+			data:    []byte(testSignedPolicyDocument),
+			isValid: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, err := signatureVerifier.Verify(test.data)
+
+			if !test.isValid {
+				if err == nil {
+					t.Errorf("expected an error, got payload: %s", payload)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(payload) != testSignedPolicyDocument {
+				t.Errorf("expected the unwrapped payload, got: %s", payload)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifierWithoutKeysUnwrapsWithoutVerifying(t *testing.T) {
+	_, privateKey := generateTestSigningKey(t)
+
+	signatureVerifier := createTestSignatureVerifier(t, nil)
+	if signatureVerifier.Enabled() {
+		t.Fatalf("expected signature verification to be disabled")
+	}
+
+	for _, data := range [][]byte{
+		[]byte(testSignedPolicyDocument),
+		createTestEnvelope(testSignedPolicyDocument, "something else", map[string]ed25519.PrivateKey{"any": privateKey}),
+	} {
+		payload, err := signatureVerifier.Verify(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(payload) != testSignedPolicyDocument {
+			t.Errorf("expected the (unwrapped) policy, got: %s", payload)
+		}
+	}
+}
+
+func TestParsePublicKeysRejectsInvalidKeys(t *testing.T) {
+	for name, publicKeyBase64 := range map[string]string{
+		"not base64": "%%",
+		"too short":  base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize-1)),
+		"too long":   base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize+1)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParsePublicKeys(map[string]string{"key": publicKeyBase64})
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestParserVerifiesIncludedDocumentSignatures(t *testing.T) {
+	publicKey, privateKey := generateTestSigningKey(t)
+	signingKeys := map[string]ed25519.PrivateKey{"trusted": privateKey}
+
+	directory, err := ioutil.TempDir("", "policy-signature")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+
+	includedDocument := `{"users": [{"id": "@included:example.com", "active": true}]}`
+
+	unsignedIncludePath := filepath.Join(directory, "unsigned.json")
+	ioutil.WriteFile(unsignedIncludePath, []byte(includedDocument), 0600)
+
+	signedIncludePath := filepath.Join(directory, "signed.json")
+	ioutil.WriteFile(signedIncludePath, createTestEnvelope(includedDocument, includedDocument, signingKeys), 0600)
+
+	parser := NewParser(createTestSignatureVerifier(t, map[string]ed25519.PublicKey{"trusted": publicKey}))
+
+	rootDocument := fmt.Sprintf(`{"schemaVersion": 1, "includes": [%q]}`, unsignedIncludePath)
+	_, err = parser.Parse(createTestEnvelope(rootDocument, rootDocument, signingKeys))
+	if err == nil {
+		t.Errorf("expected a signed policy including an unsigned document to be rejected")
+	}
+
+	rootDocument = fmt.Sprintf(`{"schemaVersion": 1, "includes": [%q]}`, signedIncludePath)
+	policy, err := parser.Parse(createTestEnvelope(rootDocument, rootDocument, signingKeys))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(policy.User) != 1 || policy.User[0].Id != "@included:example.com" {
+		t.Errorf("expected the signed included document to be merged, got users: %#v", policy.User)
+	}
+}
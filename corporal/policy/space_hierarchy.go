@@ -0,0 +1,104 @@
+package policy
+
+import "devture-matrix-corporal/corporal/util"
+
+const (
+	RoomStateEventTypeSpaceChild  = "m.space.child"
+	RoomStateEventTypeSpaceParent = "m.space.parent"
+)
+
+// IsSpace tells whether this room policy manages a space's hierarchy (see RoomPolicy.ChildRoomIds)
+func (me RoomPolicy) IsSpace() bool {
+	return me.ChildRoomIds != nil
+}
+
+// HasSpaces tells whether any managed room is a space, whose hierarchy is managed by the policy
+func (me *Policy) HasSpaces() bool {
+	for _, roomPolicy := range me.Rooms {
+		if roomPolicy.IsSpace() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetHierarchyStateEventTypes returns the (non-empty state key) state event types, which are relevant to the given managed room's place in the space hierarchy.
+//
+// When the policy manages any space hierarchy, all managed rooms need their parent events checked,
+// so that rooms dropped from a space get cleaned up.
+func (me *Policy) GetHierarchyStateEventTypes(roomPolicy *RoomPolicy) []string {
+	var eventTypes []string
+
+	if roomPolicy.IsSpace() {
+		eventTypes = append(eventTypes, RoomStateEventTypeSpaceChild)
+	}
+
+	if me.HasSpaces() {
+		eventTypes = append(eventTypes, RoomStateEventTypeSpaceParent)
+	}
+
+	return eventTypes
+}
+
+// GetHierarchyRoomIds returns the rooms, which the given managed room is supposed to have hierarchy events (of the given type) for.
+// These are the children for spaces (`m.space.child`) and the parent spaces (`m.space.parent`) for all rooms.
+func (me *Policy) GetHierarchyRoomIds(roomPolicy *RoomPolicy, eventType string) []string {
+	switch eventType {
+	case RoomStateEventTypeSpaceChild:
+		return roomPolicy.ChildRoomIds
+	case RoomStateEventTypeSpaceParent:
+		return me.GetParentSpaceIds(roomPolicy.Id)
+	}
+	return nil
+}
+
+// IsHierarchyRoomIdManaged tells whether hierarchy events (of the given type) pointing to the given room are the policy's business.
+//
+// Spaces' child lists are fully managed. Parent events are only managed for parents which are managed spaces,
+// so that rooms can still be added to other spaces.
+func (me *Policy) IsHierarchyRoomIdManaged(eventType string, roomId string) bool {
+	switch eventType {
+	case RoomStateEventTypeSpaceChild:
+		return true
+	case RoomStateEventTypeSpaceParent:
+		parentRoomPolicy := me.GetRoomPolicyByRoomId(roomId)
+		return parentRoomPolicy != nil && parentRoomPolicy.IsSpace()
+	}
+	return false
+}
+
+// GetParentSpaceIds returns the ids of the (managed) spaces, which list the given room as a child
+func (me *Policy) GetParentSpaceIds(roomId string) []string {
+	var spaceIds []string
+	for _, roomPolicy := range me.Rooms {
+		// Room policies are normally for managed rooms, except for declared rooms which haven't been created yet
+		if !util.IsStringInArray(roomPolicy.Id, me.ManagedRoomIds) {
+			continue
+		}
+
+		if util.IsStringInArray(roomId, roomPolicy.ChildRoomIds) {
+			spaceIds = append(spaceIds, roomPolicy.Id)
+		}
+	}
+	return spaceIds
+}
+
+// GetEffectiveJoinedRoomIds returns the rooms that the given user is supposed to be joined to.
+//
+// Besides the rooms listed in the user's `joinedRoomIds`, users are to be joined to all spaces containing these rooms
+// (and to the spaces containing these spaces, etc.), so that they can find their way around the space hierarchy.
+func (me *Policy) GetEffectiveJoinedRoomIds(userPolicy *UserPolicy) []string {
+	if !me.HasSpaces() {
+		return userPolicy.JoinedRoomIds
+	}
+
+	roomIds := append([]string{}, userPolicy.JoinedRoomIds...)
+	for i := 0; i < len(roomIds); i++ {
+		for _, spaceId := range me.GetParentSpaceIds(roomIds[i]) {
+			if !util.IsStringInArray(spaceId, roomIds) {
+				roomIds = append(roomIds, spaceId)
+			}
+		}
+	}
+	return roomIds
+}
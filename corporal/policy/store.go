@@ -1,7 +1,11 @@
 package policy
 
 import (
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -9,9 +13,27 @@ import (
 type Store struct {
 	logger    *logrus.Logger
 	validator *Validator
+	history   *History
 
-	policy     *Policy
-	lockPolicy sync.RWMutex
+	// loadReporter (if set) gets told about each policy load (see SetLoadReporter)
+	loadReporter LoadReporter
+
+	// sourcePolicy is the policy as it was provided, while policy is the same with declared rooms, room upgrades and user id migrations resolved
+	// and removed users retained (see Policy.WithDeclaredRoomsResolved, Policy.WithRoomUpgradesResolved, Policy.WithUserIdMigrationsResolved
+	// and Policy.WithRemovedUsersRetained)
+	sourcePolicy   *Policy
+	policy         *Policy
+	policyLoadedAt time.Time
+	lockPolicy     sync.RWMutex
+
+	// declaredRoomIds maps the keys of declared rooms to the ids of the rooms created for them (see SetDeclaredRoomIds)
+	declaredRoomIds map[string]string
+
+	// roomSuccessorIds maps the ids of rooms known to have been upgraded to the ids of their direct successors (see AddRoomSuccessorIds)
+	roomSuccessorIds map[string]string
+
+	// removedUserIds contains the ids of users known to have been removed from the policy, while still needing deprovisioning (see AddRemovedUserIds)
+	removedUserIds []string
 
 	listenerChannels []chan *Policy
 	lockListeners    sync.RWMutex
@@ -20,15 +42,43 @@ type Store struct {
 func NewStore(
 	logger *logrus.Logger,
 	validator *Validator,
+	history *History,
 ) *Store {
 	return &Store{
 		logger:    logger,
 		validator: validator,
+		history:   history,
+
+		declaredRoomIds:  map[string]string{},
+		roomSuccessorIds: map[string]string{},
 
 		listenerChannels: make([]chan *Policy, 0),
 	}
 }
 
+// SetLoadReporter makes the store report successfully loaded policies to the given reporter.
+// Failures happen before policies make it to the store, so whoever runs into them reports them (see ReportLoadFailure).
+func (me *Store) SetLoadReporter(loadReporter LoadReporter) {
+	me.loadReporter = loadReporter
+}
+
+// ReportLoadFailure lets policy providers (and others) report that they've failed loading a policy
+func (me *Store) ReportLoadFailure(source string, err error) {
+	if me.loadReporter == nil {
+		return
+	}
+	me.loadReporter.ReportLoadFailure(source, err)
+}
+
+// ReportLoadFailureAlert lets policy providers report that they've been failing to load a policy for a while.
+// This is reported instead of (not in addition to) the failure which triggered it.
+func (me *Store) ReportLoadFailureAlert(source string, err error, consecutiveFailures int) {
+	if me.loadReporter == nil {
+		return
+	}
+	me.loadReporter.ReportLoadFailureAlert(source, err, consecutiveFailures)
+}
+
 func (me *Store) Get() *Policy {
 	me.lockPolicy.RLock()
 	defer me.lockPolicy.RUnlock()
@@ -36,16 +86,193 @@ func (me *Store) Get() *Policy {
 	return me.policy
 }
 
-func (me *Store) Set(policy *Policy) error {
+// GetExpirationTime tells when the current policy expires (see Policy.GetExpirationTime).
+// A nil value means that there's no policy yet or that it never expires.
+func (me *Store) GetExpirationTime() *time.Time {
+	me.lockPolicy.RLock()
+	defer me.lockPolicy.RUnlock()
+
+	if me.policy == nil {
+		return nil
+	}
+
+	return me.policy.GetExpirationTime(me.policyLoadedAt)
+}
+
+// Validate checks whether the given policy is valid, without storing it
+func (me *Store) Validate(policy *Policy) error {
+	return me.validator.Validate(policy)
+}
+
+// Set validates and stores the given policy, notifying all listeners about it.
+// The source (a policy provider type, PolicySourceHttpApi, etc.) is recorded in the policy history.
+func (me *Store) Set(policy *Policy, source string) error {
 	err := me.validator.Validate(policy)
 	if err != nil {
 		return err
 	}
 
+	me.lockPolicy.Lock()
+
+	previousPolicy := me.policy
+
+	me.sourcePolicy = policy
+	me.policy = me.resolve(policy)
+	me.policyLoadedAt = time.Now()
+
+	if me.loadReporter != nil {
+		me.loadReporter.ReportLoadSuccess(source, previousPolicy, me.policy)
+	}
+
+	me.notifyListeners(me.policy)
+
+	// History is recorded while holding the lock, so that concurrent changes get recorded in the order they were made.
+	// Persisting an entry only appends to the history file, so this is cheap.
+	me.history.Add(policy, source)
+
+	me.lockPolicy.Unlock()
+
+	return nil
+}
+
+// Modify atomically replaces the current policy with a modified copy of it, as returned by the modifier function.
+//
+// Unlike Set, this doesn't count as loading a new policy (when it comes to policy expiration),
+// as only part of the policy changes.
+// Listeners (e.g. the store-driven reconciler) are only notified if notifyListeners is true,
+// so that callers can take care of reconciling the change themselves.
+func (me *Store) Modify(modifier func(current Policy) (*Policy, error), source string, notifyListeners bool) error {
+	me.lockPolicy.Lock()
+	defer me.lockPolicy.Unlock()
+
+	if me.policy == nil {
+		return fmt.Errorf("there is no policy to modify yet")
+	}
+
+	// Modifications are done to the policy as it was provided, so that references to declared rooms are preserved
+	policy, err := modifier(*me.sourcePolicy)
+	if err != nil {
+		return err
+	}
+
+	err = me.validator.Validate(policy)
+	if err != nil {
+		return err
+	}
+
+	previousPolicy := me.policy
+
+	me.sourcePolicy = policy
+	me.policy = me.resolve(policy)
+
+	if me.loadReporter != nil {
+		me.loadReporter.ReportLoadSuccess(source, previousPolicy, me.policy)
+	}
+
+	if notifyListeners {
+		me.notifyListeners(me.policy)
+	}
+
+	// Like with Set, history is recorded while holding the lock
+	me.history.Add(policy, source)
+
+	return nil
+}
+
+// SetDeclaredRoomIds lets the store know about the rooms created for declared rooms (see DeclaredRoom),
+// mapping declared room keys to room ids.
+//
+// If this changes how the current policy resolves, listeners get notified about the newly resolved policy.
+func (me *Store) SetDeclaredRoomIds(declaredRoomIds map[string]string) {
+	me.lockPolicy.Lock()
+	defer me.lockPolicy.Unlock()
+
+	if reflect.DeepEqual(me.declaredRoomIds, declaredRoomIds) {
+		return
+	}
+
+	me.declaredRoomIds = map[string]string{}
+	for key, roomId := range declaredRoomIds {
+		me.declaredRoomIds[key] = roomId
+	}
+
+	if me.sourcePolicy == nil || len(me.sourcePolicy.DeclaredRooms) == 0 {
+		return
+	}
+
+	me.policy = me.resolve(me.sourcePolicy)
+
+	me.notifyListeners(me.policy)
+}
+
+// AddRoomSuccessorIds lets the store know about upgraded rooms, mapping the ids of upgraded rooms to the ids of their direct successors.
+//
+// Room upgrades can't be undone, so what the store knows about accumulates (and is never forgotten).
+// If this changes how the current policy resolves, listeners get notified about the newly resolved policy.
+func (me *Store) AddRoomSuccessorIds(roomSuccessorIds map[string]string) {
 	me.lockPolicy.Lock()
 	defer me.lockPolicy.Unlock()
 
-	me.policy = policy
+	changed := false
+	for roomId, successorRoomId := range roomSuccessorIds {
+		if me.roomSuccessorIds[roomId] == successorRoomId {
+			continue
+		}
+		me.roomSuccessorIds[roomId] = successorRoomId
+		changed = true
+	}
+
+	if !changed || me.sourcePolicy == nil {
+		return
+	}
+
+	me.policy = me.resolve(me.sourcePolicy)
+
+	me.notifyListeners(me.policy)
+}
+
+// AddRemovedUserIds lets the store know about users which have been removed from the policy, but still need to be deprovisioned
+// (see Deprovisioning.IncludeRemovedUsers). Such users are retained in the policy as inactive users.
+//
+// If this changes how the current policy resolves, listeners get notified about the newly resolved policy.
+func (me *Store) AddRemovedUserIds(removedUserIds []string) {
+	me.lockPolicy.Lock()
+	defer me.lockPolicy.Unlock()
+
+	changed := false
+	for _, userId := range removedUserIds {
+		if util.IsStringInArray(userId, me.removedUserIds) {
+			continue
+		}
+		me.removedUserIds = append(me.removedUserIds, userId)
+		changed = true
+	}
+
+	if !changed || me.sourcePolicy == nil || !me.sourcePolicy.AreRemovedUsersDeprovisioned() {
+		return
+	}
+
+	me.policy = me.resolve(me.sourcePolicy)
+
+	me.notifyListeners(me.policy)
+}
+
+func (me *Store) resolve(policy *Policy) *Policy {
+	if len(policy.DeclaredRooms) == 0 && len(me.roomSuccessorIds) == 0 && len(me.removedUserIds) == 0 && len(policy.UserIdMigrations) == 0 {
+		return policy
+	}
+
+	// Declared rooms are resolved first, as rooms created for them may have been upgraded since
+	resolvedPolicy := policy.WithDeclaredRoomsResolved(me.declaredRoomIds)
+	resolvedPolicy = resolvedPolicy.WithRoomUpgradesResolved(me.roomSuccessorIds)
+	resolvedPolicy = resolvedPolicy.WithUserIdMigrationsResolved()
+	resolvedPolicy = resolvedPolicy.WithRemovedUsersRetained(me.removedUserIds)
+	return &resolvedPolicy
+}
+
+func (me *Store) notifyListeners(policy *Policy) {
+	me.lockListeners.RLock()
+	defer me.lockListeners.RUnlock()
 
 	for _, channel := range me.listenerChannels {
 		// Do it asynchronously. We don't want to block here..
@@ -53,8 +280,6 @@ func (me *Store) Set(policy *Policy) error {
 			channel <- policy
 		}(channel, policy)
 	}
-
-	return nil
 }
 
 func (me *Store) GetNotificationChannel() chan *Policy {
@@ -0,0 +1,81 @@
+package policy
+
+import (
+	"devture-matrix-corporal/corporal/matrix"
+	"fmt"
+)
+
+// UserIdMigration moves a user from one user id (MXID) to another, as user ids cannot be changed on the homeserver.
+//
+// The new user is a regular policy user (provisioned and joined to their rooms as usual).
+// During (full) reconciliation, the old user's profile (display name and avatar) gets copied over once,
+// as far as the policy allows custom profiles (see PolicyFlags.AllowCustomUserDisplayNames and PolicyFlags.AllowCustomUserAvatars).
+type UserIdMigration struct {
+	OldUserId string `json:"oldUserId"`
+	NewUserId string `json:"newUserId"`
+
+	// DeactivateOldUser makes the old user get deprovisioned (as if they were an inactive policy user, see WithUserIdMigrationsResolved).
+	// Otherwise, the old user becomes unmanaged and is left alone.
+	DeactivateOldUser bool `json:"deactivateOldUser"`
+}
+
+func (me UserIdMigration) Validate(homeserverDomainName string) error {
+	for _, userId := range []string{me.OldUserId, me.NewUserId} {
+		if !matrix.IsFullUserIdOfDomain(userId, homeserverDomainName) {
+			return fmt.Errorf("`%s` is not a user hosted on the managed homeserver domain (%s)", userId, homeserverDomainName)
+		}
+	}
+
+	if me.OldUserId == me.NewUserId {
+		return fmt.Errorf("the old and new user ids are the same")
+	}
+
+	return nil
+}
+
+// GetUserIdMigrationByNewUserId returns the migration (if any) which moves some other user to the given user id
+func (me *Policy) GetUserIdMigrationByNewUserId(userId string) *UserIdMigration {
+	for _, migration := range me.UserIdMigrations {
+		if migration.NewUserId == userId {
+			return migration
+		}
+	}
+	return nil
+}
+
+// IsMigratedOldUserId tells whether the given user has been migrated to another user id (see UserIdMigration)
+func (me *Policy) IsMigratedOldUserId(userId string) bool {
+	for _, migration := range me.UserIdMigrations {
+		if migration.OldUserId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// WithUserIdMigrationsResolved returns a copy of the policy, in which old users that are to be deactivated (see UserIdMigration.DeactivateOldUser)
+// are retained as inactive users, so that they'd get deprovisioned.
+func (me Policy) WithUserIdMigrationsResolved() Policy {
+	var oldUserIds []string
+	for _, migration := range me.UserIdMigrations {
+		if migration.DeactivateOldUser && me.GetUserPolicyByUserId(migration.OldUserId) == nil {
+			oldUserIds = append(oldUserIds, migration.OldUserId)
+		}
+	}
+
+	if len(oldUserIds) == 0 {
+		return me
+	}
+
+	users := make([]*UserPolicy, 0, len(me.User)+len(oldUserIds))
+	users = append(users, me.User...)
+	for _, userId := range oldUserIds {
+		users = append(users, &UserPolicy{
+			Id:     userId,
+			Active: false,
+		})
+	}
+	me.User = users
+
+	return me
+}
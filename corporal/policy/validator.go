@@ -2,7 +2,10 @@ package policy
 
 import (
 	"devture-matrix-corporal/corporal/matrix"
+	"devture-matrix-corporal/corporal/util"
 	"fmt"
+	"path"
+	"strings"
 )
 
 type Validator struct {
@@ -20,6 +23,14 @@ func (me *Validator) Validate(policy *Policy) error {
 		return fmt.Errorf("found policy with schema version (%d) that we do not support", policy.SchemaVerson)
 	}
 
+	if policy.MaxAgeSeconds != nil && *policy.MaxAgeSeconds <= 0 {
+		return fmt.Errorf("policy `maxAgeSeconds` needs to be a positive number")
+	}
+
+	if policy.Flags.MaxDeviceIdleDays < 0 {
+		return fmt.Errorf("policy flag `maxDeviceIdleDays` cannot be negative")
+	}
+
 	for _, userId := range policy.GetManagedUserIds() {
 		if !matrix.IsFullUserIdOfDomain(userId, me.homeserverDomainName) {
 			return fmt.Errorf(
@@ -42,6 +53,30 @@ func (me *Validator) Validate(policy *Policy) error {
 		}
 	}
 
+	// External ids are meant to be resolved back to a single user, so they need to be unique.
+	externalIdToUserIdMap := make(map[string]map[string]string)
+
+	for _, userPolicy := range policy.User {
+		for idType, id := range userPolicy.ExternalIds {
+			if _, exists := externalIdToUserIdMap[idType]; !exists {
+				externalIdToUserIdMap[idType] = make(map[string]string)
+			}
+
+			existingUserId, exists := externalIdToUserIdMap[idType][id]
+			if exists {
+				return fmt.Errorf(
+					"user `%s` has the same `%s` external id (%s) as user `%s`",
+					userPolicy.Id,
+					idType,
+					id,
+					existingUserId,
+				)
+			}
+
+			externalIdToUserIdMap[idType][id] = userPolicy.Id
+		}
+	}
+
 	hookIDToIndexMap := make(map[string]int)
 
 	for idx, hook := range policy.Hooks {
@@ -68,5 +103,367 @@ func (me *Validator) Validate(policy *Policy) error {
 		hookIDToIndexMap[hook.ID] = idx
 	}
 
+	// User hooks end up in the same execution chain as global hooks, so their IDs need to be unique across both.
+	hookIDToUserIdMap := make(map[string]string)
+
+	for _, userPolicy := range policy.User {
+		for idx, hook := range userPolicy.Hooks {
+			if existingIndex, exists := hookIDToIndexMap[hook.ID]; exists {
+				return fmt.Errorf(
+					"hook at index `%d` (ID = %s) of user `%s` has the same ID as the global hook at index %d. Assign unique hook IDs to prevent confusion",
+					idx,
+					hook.ID,
+					userPolicy.Id,
+					existingIndex,
+				)
+			}
+
+			if existingUserId, exists := hookIDToUserIdMap[hook.ID]; exists {
+				return fmt.Errorf(
+					"hook at index `%d` (ID = %s) of user `%s` has the same ID as a hook of user `%s`. Assign unique hook IDs to prevent confusion",
+					idx,
+					hook.ID,
+					userPolicy.Id,
+					existingUserId,
+				)
+			}
+
+			err := hook.Validate()
+			if err != nil {
+				return fmt.Errorf(
+					"hook at index `%d` (ID = %s) of user `%s` is invalid: %s",
+					idx,
+					hook.ID,
+					userPolicy.Id,
+					err,
+				)
+			}
+
+			if hook.IsReconciliationRunHook() {
+				return fmt.Errorf(
+					"hook at index `%d` (ID = %s) of user `%s` is for eventType=%s, which only global hooks can use",
+					idx,
+					hook.ID,
+					userPolicy.Id,
+					hook.EventType,
+				)
+			}
+
+			hookIDToUserIdMap[hook.ID] = userPolicy.Id
+		}
+	}
+
+	if policy.ServerAcl != nil {
+		err := policy.ServerAcl.Validate()
+		if err != nil {
+			return fmt.Errorf("server ACL validation failed: %s", err)
+		}
+
+		err = me.validateServerAclDoesNotDenyOwnServer(*policy.ServerAcl)
+		if err != nil {
+			return fmt.Errorf("server ACL validation failed: %s", err)
+		}
+	}
+
+	err := me.validateDeclaredRooms(policy)
+	if err != nil {
+		return err
+	}
+
+	roomIdToIndexMap := make(map[string]int)
+	aliasToRoomIdMap := make(map[string]string)
+
+	for idx, roomPolicy := range policy.Rooms {
+		existingIndex, exists := roomIdToIndexMap[roomPolicy.Id]
+		if exists {
+			return fmt.Errorf(
+				"room policy at index `%d` (ID = %s) has the same ID as the room policy at index %d",
+				idx,
+				roomPolicy.Id,
+				existingIndex,
+			)
+		}
+
+		err := roomPolicy.Validate()
+		if err != nil {
+			return fmt.Errorf("room policy validation for `%s` (index %d) failed: %s", roomPolicy.Id, idx, err)
+		}
+
+		if roomPolicy.ServerAcl != nil {
+			err = me.validateServerAclDoesNotDenyOwnServer(*roomPolicy.ServerAcl)
+			if err != nil {
+				return fmt.Errorf("room policy validation for `%s` (index %d) failed: %s", roomPolicy.Id, idx, err)
+			}
+		}
+
+		if roomPolicy.StewardUserId != "" && !matrix.IsFullUserIdOfDomain(roomPolicy.StewardUserId, me.homeserverDomainName) {
+			return fmt.Errorf(
+				"room policy `%s` (index %d) has a steward (%s), which is not hosted on the managed homeserver domain (%s)",
+				roomPolicy.Id,
+				idx,
+				roomPolicy.StewardUserId,
+				me.homeserverDomainName,
+			)
+		}
+
+		if !util.IsStringInArray(roomPolicy.Id, policy.ManagedRoomIds) {
+			return fmt.Errorf("room policy `%s` (index %d) is for a room which is not listed in managedRoomIds", roomPolicy.Id, idx)
+		}
+
+		for _, alias := range roomPolicy.Aliases {
+			if !matrix.IsFullRoomAliasOfDomain(alias, me.homeserverDomainName) {
+				return fmt.Errorf(
+					"room policy `%s` (index %d) has an alias (%s), which is not hosted on the managed homeserver domain (%s)",
+					roomPolicy.Id,
+					idx,
+					alias,
+					me.homeserverDomainName,
+				)
+			}
+
+			if otherRoomId, exists := aliasToRoomIdMap[alias]; exists {
+				return fmt.Errorf("room policy `%s` (index %d) has an alias (%s), which is also used by room %s", roomPolicy.Id, idx, alias, otherRoomId)
+			}
+			aliasToRoomIdMap[alias] = roomPolicy.Id
+		}
+
+		for _, childRoomId := range roomPolicy.ChildRoomIds {
+			if childRoomId == roomPolicy.Id {
+				return fmt.Errorf("room policy `%s` (index %d) lists itself as a child room", roomPolicy.Id, idx)
+			}
+
+			if !util.IsStringInArray(childRoomId, policy.ManagedRoomIds) {
+				return fmt.Errorf(
+					"room policy `%s` (index %d) has a child room (%s), which is not listed in managedRoomIds",
+					roomPolicy.Id,
+					idx,
+					childRoomId,
+				)
+			}
+		}
+
+		roomIdToIndexMap[roomPolicy.Id] = idx
+	}
+
+	powerLevelTemplateIdToIndexMap := make(map[string]int)
+
+	for idx, template := range policy.PowerLevelTemplates {
+		existingIndex, exists := powerLevelTemplateIdToIndexMap[template.Id]
+		if exists {
+			return fmt.Errorf(
+				"power level template at index `%d` (ID = %s) has the same ID as the power level template at index %d",
+				idx,
+				template.Id,
+				existingIndex,
+			)
+		}
+
+		err := template.Validate()
+		if err != nil {
+			return fmt.Errorf("power level template at index `%d` is invalid: %s", idx, err)
+		}
+
+		for _, roomId := range template.RoomIds {
+			if !util.IsStringInArray(roomId, policy.ManagedRoomIds) {
+				return fmt.Errorf("power level template #%s is for a room (%s) which is not listed in managedRoomIds", template.Id, roomId)
+			}
+		}
+
+		powerLevelTemplateIdToIndexMap[template.Id] = idx
+	}
+
+	for _, userPolicy := range policy.User {
+		for _, templateId := range userPolicy.PowerLevelTemplates {
+			if _, exists := powerLevelTemplateIdToIndexMap[templateId]; !exists {
+				return fmt.Errorf("user `%s` references a power level template (%s) which does not exist", userPolicy.Id, templateId)
+			}
+		}
+	}
+
+	serverNoticeIDToIndexMap := make(map[string]int)
+
+	for idx, serverNotice := range policy.ServerNotices {
+		existingIndex, exists := serverNoticeIDToIndexMap[serverNotice.ID]
+		if exists {
+			return fmt.Errorf(
+				"server notice at index `%d` (ID = %s) has the same ID as the server notice at index %d",
+				idx,
+				serverNotice.ID,
+				existingIndex,
+			)
+		}
+
+		err := serverNotice.Validate()
+		if err != nil {
+			return fmt.Errorf("server notice at index `%d` is invalid: %s", idx, err)
+		}
+
+		serverNoticeIDToIndexMap[serverNotice.ID] = idx
+	}
+
+	if policy.UnmanagedUserDefaults != nil {
+		err := policy.UnmanagedUserDefaults.Validate()
+		if err != nil {
+			return fmt.Errorf("unmanaged user defaults are invalid: %s", err)
+		}
+	}
+
+	if policy.Deprovisioning != nil {
+		err := policy.Deprovisioning.Validate()
+		if err != nil {
+			return fmt.Errorf("deprovisioning is invalid: %s", err)
+		}
+	}
+
+	if policy.LifecycleNotices != nil {
+		err := policy.LifecycleNotices.Validate()
+		if err != nil {
+			return fmt.Errorf("lifecycle notices are invalid: %s", err)
+		}
+
+		welcomeNotice := policy.LifecycleNotices.Welcome
+		if welcomeNotice != nil && welcomeNotice.SenderUserId != "" && !matrix.IsFullUserIdOfDomain(welcomeNotice.SenderUserId, me.homeserverDomainName) {
+			return fmt.Errorf(
+				"lifecycle notices are invalid: the sender of `welcome` (%s) is not a user hosted on the managed homeserver domain (%s)",
+				welcomeNotice.SenderUserId,
+				me.homeserverDomainName,
+			)
+		}
+	}
+
+	if policy.AccountCleanup != nil {
+		err := policy.AccountCleanup.Validate()
+		if err != nil {
+			return fmt.Errorf("account cleanup is invalid: %s", err)
+		}
+	}
+
+	if policy.LoginLockout != nil {
+		err := policy.LoginLockout.Validate()
+		if err != nil {
+			return fmt.Errorf("login lockout is invalid: %s", err)
+		}
+	}
+
+	for idx, room := range policy.AutoJoinRooms {
+		if !strings.HasPrefix(room, "!") && !strings.HasPrefix(room, "#") {
+			return fmt.Errorf("auto-join room at index `%d` (%s) is neither a room id, nor a room alias", idx, room)
+		}
+
+		if util.IsStringInArray(room, policy.ManagedRoomIds) {
+			return fmt.Errorf("auto-join room `%s` is a managed room, so users are to be joined to it via joinedRoomIds instead", room)
+		}
+	}
+
+	if policy.OrphanedRooms != nil {
+		err := policy.OrphanedRooms.Validate()
+		if err != nil {
+			return fmt.Errorf("orphaned rooms settings are invalid: %s", err)
+		}
+	}
+
+	err = me.validateUserIdMigrations(policy)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateServerAclDoesNotDenyOwnServer guards against server ACLs which would lock our own server out of managed rooms.
+func (me *Validator) validateServerAclDoesNotDenyOwnServer(serverAcl RoomServerAcl) error {
+	for _, pattern := range serverAcl.Deny {
+		// Server ACL globs only support `*` and `?`, which path.Match handles the same way for values without slashes.
+		matches, err := path.Match(pattern, me.homeserverDomainName)
+		if err != nil {
+			return fmt.Errorf("bad deny pattern `%s`: %s", pattern, err)
+		}
+
+		if matches {
+			return fmt.Errorf("deny pattern `%s` matches the managed homeserver domain (%s)", pattern, me.homeserverDomainName)
+		}
+	}
+
+	return nil
+}
+
+func (me *Validator) validateDeclaredRooms(policy *Policy) error {
+	declaredRoomKeyToIndexMap := make(map[string]int)
+
+	for idx, declaredRoom := range policy.DeclaredRooms {
+		existingIndex, exists := declaredRoomKeyToIndexMap[declaredRoom.Key]
+		if exists {
+			return fmt.Errorf(
+				"declared room at index `%d` (key = %s) has the same key as the declared room at index %d",
+				idx,
+				declaredRoom.Key,
+				existingIndex,
+			)
+		}
+
+		err := declaredRoom.Validate()
+		if err != nil {
+			return fmt.Errorf("declared room validation for `%s` (index %d) failed: %s", declaredRoom.Key, idx, err)
+		}
+
+		if !util.IsStringInArray(declaredRoom.GetReference(), policy.ManagedRoomIds) {
+			return fmt.Errorf(
+				"declared room `%s` (index %d) is not listed in managedRoomIds (as `%s`)",
+				declaredRoom.Key,
+				idx,
+				declaredRoom.GetReference(),
+			)
+		}
+
+		declaredRoomKeyToIndexMap[declaredRoom.Key] = idx
+	}
+
+	// References elsewhere (e.g. in joinedRoomIds) only take effect for managed rooms,
+	// so it's enough to check that managed room references point to declared rooms.
+	for _, roomId := range policy.ManagedRoomIds {
+		if !IsDeclaredRoomReference(roomId) {
+			continue
+		}
+
+		if policy.GetDeclaredRoomByKey(strings.TrimPrefix(roomId, DeclaredRoomReferencePrefix)) == nil {
+			return fmt.Errorf("managed room `%s` references a room which is not declared (in declaredRooms)", roomId)
+		}
+	}
+
+	return nil
+}
+
+func (me *Validator) validateUserIdMigrations(policy *Policy) error {
+	// Each user can only be part of a single migration (either as the old or as the new user)
+	userIdToIndexMap := make(map[string]int)
+
+	for idx, migration := range policy.UserIdMigrations {
+		err := migration.Validate(me.homeserverDomainName)
+		if err != nil {
+			return fmt.Errorf("user id migration at index `%d` is invalid: %s", idx, err)
+		}
+
+		for _, userId := range []string{migration.OldUserId, migration.NewUserId} {
+			existingIndex, exists := userIdToIndexMap[userId]
+			if exists {
+				return fmt.Errorf(
+					"user id migration at index `%d` involves the same user (%s) as the user id migration at index %d",
+					idx,
+					userId,
+					existingIndex,
+				)
+			}
+			userIdToIndexMap[userId] = idx
+		}
+
+		if policy.GetUserPolicyByUserId(migration.NewUserId) == nil {
+			return fmt.Errorf("user id migration at index `%d` is for a new user (%s), who is not part of the policy", idx, migration.NewUserId)
+		}
+
+		if policy.GetUserPolicyByUserId(migration.OldUserId) != nil {
+			return fmt.Errorf("user id migration at index `%d` is for an old user (%s), who is still part of the policy", idx, migration.OldUserId)
+		}
+	}
+
 	return nil
 }
@@ -1,14 +1,53 @@
 package reconciliation
 
 // All reconciliation actions must have a corresponding
-// reconciliation handler function in `reconciler.go`.
+// reconciliation handler function in the `reconciler` package.
 const (
 	ActionUserCreate         = "user.create"
 	ActionUserSetDisplayName = "user.set_display_name"
 	ActionUserSetAvatar      = "user.set_avatar"
+	ActionUserSetServerAdmin = "user.set_server_admin"
+	ActionUserSetUserType    = "user.set_user_type"
 	ActionUserActivate       = "user.activate"
 	ActionUserDeactivate     = "user.deactivate"
+	ActionUserLogout         = "user.logout"
+	ActionUserErase          = "user.erase"
+	ActionUserDeleteDevices  = "user.delete_devices"
+
+	ActionUserSetShadowBanned = "user.set_shadow_banned"
+
+	ActionUserDeactivateAccount = "user.deactivate_account"
+
+	ActionUserAddThreePid    = "user.add_3pid"
+	ActionUserRemoveThreePid = "user.remove_3pid"
+
+	ActionUserSendServerNotice = "user.send_server_notice"
+
+	ActionUserSetPushRule    = "user.set_push_rule"
+	ActionUserDeletePushRule = "user.delete_push_rule"
+
+	ActionUserSetAccountData = "user.set_account_data"
+
+	ActionUserCopyProfile = "user.copy_profile"
 
 	ActionRoomJoin  = "room.join"
 	ActionRoomLeave = "room.leave"
+	ActionRoomKick  = "room.kick"
+
+	ActionRoomAutoJoin = "room.auto_join"
+
+	ActionRoomSetState = "room.set_state"
+
+	ActionRoomSetDirectoryVisibility = "room.set_directory_visibility"
+	ActionRoomCreateAlias            = "room.create_alias"
+	ActionRoomDeleteAlias            = "room.delete_alias"
+
+	ActionRoomCreate = "room.create"
+	ActionRoomDelete = "room.delete"
+
+	ActionDeprovisioningSetManagedUsers = "deprovisioning.set_managed_users"
+
+	ActionOrphanedRoomsSetManagedRooms = "orphaned_rooms.set_managed_rooms"
+
+	ActionUserIdMigrationComplete = "user_id_migration.complete"
 )
@@ -3,11 +3,17 @@ package computator
 import (
 	"devture-matrix-corporal/corporal/avatar"
 	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/matrix"
 	"devture-matrix-corporal/corporal/policy"
 	"devture-matrix-corporal/corporal/reconciliation"
 	"devture-matrix-corporal/corporal/userauth"
 	"devture-matrix-corporal/corporal/util"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -30,6 +36,13 @@ func (me *ReconciliationStateComputator) Compute(
 		Actions: make([]*reconciliation.StateAction, 0),
 	}
 
+	// Declared rooms are created first. Everything else concerning them happens during subsequent runs,
+	// once references to them get resolved (see policy.Policy.WithDeclaredRoomsResolved).
+	reconciliationState.Actions = append(
+		reconciliationState.Actions,
+		me.computeDeclaredRoomChanges(currentState, policy)...,
+	)
+
 	for _, userPolicy := range policy.User {
 		userId := userPolicy.Id
 
@@ -38,6 +51,7 @@ func (me *ReconciliationStateComputator) Compute(
 		actions := me.computeUserChanges(
 			userId,
 			currentUserStateOrNil,
+			currentState.Deprovisioning,
 			policy,
 			userPolicy,
 		)
@@ -45,155 +59,1376 @@ func (me *ReconciliationStateComputator) Compute(
 		reconciliationState.Actions = append(reconciliationState.Actions, actions...)
 	}
 
-	return reconciliationState, nil
+	for _, roomId := range policy.ManagedRoomIds {
+		roomPolicy := policy.GetEffectiveRoomPolicy(roomId)
+
+		currentRoomStateOrNil := currentState.GetRoomStateByRoomId(roomId)
+
+		// Aliases get created before the canonical alias (room state) gets pointed to them,
+		// while stray ones get deleted afterwards (in case they're still referenced by the current canonical alias).
+		actions := me.computeRoomAliasCreations(currentRoomStateOrNil, roomPolicy)
+		reconciliationState.Actions = append(reconciliationState.Actions, actions...)
+
+		actions = me.computeRoomStateChanges(currentRoomStateOrNil, roomPolicy)
+		reconciliationState.Actions = append(reconciliationState.Actions, actions...)
+
+		actions = me.computeRoomAliasDeletions(currentRoomStateOrNil, roomPolicy, policy)
+		reconciliationState.Actions = append(reconciliationState.Actions, actions...)
+
+		actions = me.computeRoomDirectoryVisibilityChanges(currentRoomStateOrNil, roomPolicy)
+		reconciliationState.Actions = append(reconciliationState.Actions, actions...)
+
+		actions = me.computeRoomMembershipChanges(currentRoomStateOrNil, roomPolicy, policy)
+		reconciliationState.Actions = append(reconciliationState.Actions, actions...)
+
+		actions = me.computeRoomHierarchyChanges(currentRoomStateOrNil, roomPolicy, policy)
+		reconciliationState.Actions = append(reconciliationState.Actions, actions...)
+	}
+
+	reconciliationState.Actions = append(
+		reconciliationState.Actions,
+		me.computeUserIdMigrationChanges(currentState, policy)...,
+	)
+
+	reconciliationState.Actions = append(
+		reconciliationState.Actions,
+		me.computeAccountCleanupChanges(currentState, policy)...,
+	)
+
+	reconciliationState.Actions = append(
+		reconciliationState.Actions,
+		me.computeDeprovisioningStateChanges(currentState, policy)...,
+	)
+
+	reconciliationState.Actions = append(
+		reconciliationState.Actions,
+		me.computeOrphanedRoomChanges(currentState, policy)...,
+	)
+
+	return reconciliationState, nil
+}
+
+// ComputeForUser is like Compute, but only computes the changes for the given (managed) user.
+// Room state changes are not taken into account.
+func (me *ReconciliationStateComputator) ComputeForUser(
+	currentState *connector.CurrentState,
+	policy *policy.Policy,
+	userId string,
+) (*reconciliation.State, error) {
+	userPolicy := policy.GetUserPolicyByUserId(userId)
+	if userPolicy == nil {
+		return nil, fmt.Errorf("user %s is not part of the policy", userId)
+	}
+
+	actions := me.computeUserChanges(
+		userId,
+		currentState.GetUserStateByUserId(userId),
+		currentState.Deprovisioning,
+		policy,
+		userPolicy,
+	)
+
+	return &reconciliation.State{
+		Actions: append(make([]*reconciliation.StateAction, 0), actions...),
+	}, nil
+}
+
+func (me *ReconciliationStateComputator) computeRoomStateChanges(
+	currentRoomState *connector.CurrentRoomState,
+	roomPolicy *policy.RoomPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	stateEventTypes := roomPolicy.GetEnforcedStateEventTypes()
+	if len(stateEventTypes) == 0 {
+		return actions
+	}
+
+	if currentRoomState == nil {
+		me.logger.Warnf("Room %s has a room policy, but its current state is unknown", roomPolicy.Id)
+		return actions
+	}
+
+	for _, eventType := range stateEventTypes {
+		currentContent := currentRoomState.GetStateEventContent(eventType)
+
+		if roomPolicy.IsStateEventContentAllowed(eventType, currentContent) {
+			continue
+		}
+
+		content := roomPolicy.CreateStateEventContent(eventType, currentContent)
+
+		if eventType == policy.RoomStateEventTypePowerLevels && currentRoomState.ActingUserId != "" {
+			var revertedChanges []string
+			var hasChanges bool
+			content, revertedChanges, hasChanges = policy.ConstrainPowerLevelsContentChangesForUser(
+				currentContent,
+				content,
+				currentRoomState.ActingUserId,
+			)
+
+			if len(revertedChanges) != 0 {
+				me.logger.Warnf(
+					"Cannot fully enforce power levels in room %s, as these changes are beyond what %s can (safely) make: %s",
+					roomPolicy.Id,
+					currentRoomState.ActingUserId,
+					strings.Join(revertedChanges, ", "),
+				)
+			}
+
+			if !hasChanges {
+				continue
+			}
+		}
+
+		actions = append(actions, newRoomSetStateAction(roomPolicy, eventType, "", content))
+	}
+
+	return actions
+}
+
+// computeRoomDirectoryVisibilityChanges makes the room be listed in the public room directory (or not), as its policy says
+func (me *ReconciliationStateComputator) computeRoomDirectoryVisibilityChanges(
+	currentRoomState *connector.CurrentRoomState,
+	roomPolicy *policy.RoomPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if roomPolicy.DirectoryVisibility == "" {
+		return actions
+	}
+
+	if currentRoomState == nil {
+		me.logger.Warnf("Room %s has a directory visibility policy, but its current state is unknown", roomPolicy.Id)
+		return actions
+	}
+
+	if currentRoomState.DirectoryVisibility == roomPolicy.DirectoryVisibility {
+		return actions
+	}
+
+	payload := map[string]interface{}{
+		"roomId":     roomPolicy.Id,
+		"visibility": roomPolicy.DirectoryVisibility,
+	}
+	if roomPolicy.StewardUserId != "" {
+		payload["actorUserId"] = roomPolicy.StewardUserId
+	}
+
+	actions = append(actions, &reconciliation.StateAction{
+		Type:    reconciliation.ActionRoomSetDirectoryVisibility,
+		Payload: payload,
+	})
+
+	return actions
+}
+
+// computeRoomAliasCreations makes the aliases listed in the room's policy (see policy.RoomPolicy.Aliases) point to the room
+func (me *ReconciliationStateComputator) computeRoomAliasCreations(
+	currentRoomState *connector.CurrentRoomState,
+	roomPolicy *policy.RoomPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if roomPolicy.Aliases == nil {
+		return actions
+	}
+
+	if currentRoomState == nil {
+		me.logger.Warnf("Room %s has an aliases policy, but its current state is unknown", roomPolicy.Id)
+		return actions
+	}
+
+	for _, alias := range roomPolicy.Aliases {
+		if util.IsStringInArray(alias, currentRoomState.Aliases) {
+			continue
+		}
+
+		actions = append(actions, newRoomAliasAction(reconciliation.ActionRoomCreateAlias, roomPolicy, alias))
+	}
+
+	return actions
+}
+
+// computeRoomAliasDeletions deletes the room's aliases, which are in the alias namespace (see policy.Policy.RoomAliasNamespace),
+// but are not listed in the room's policy
+func (me *ReconciliationStateComputator) computeRoomAliasDeletions(
+	currentRoomState *connector.CurrentRoomState,
+	roomPolicy *policy.RoomPolicy,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if roomPolicy.Aliases == nil || currentRoomState == nil {
+		return actions
+	}
+
+	for _, alias := range currentRoomState.Aliases {
+		if util.IsStringInArray(alias, roomPolicy.Aliases) || !policy.IsRoomAliasInNamespace(alias) {
+			continue
+		}
+
+		actions = append(actions, newRoomAliasAction(reconciliation.ActionRoomDeleteAlias, roomPolicy, alias))
+	}
+
+	return actions
+}
+
+// computeRoomHierarchyChanges makes spaces have exactly the children listed in their policy (see policy.RoomPolicy.ChildRoomIds)
+// and makes children point back to their parent spaces.
+//
+// Existing (valid) child and parent events are left as they are, so that space admins can still customize them (e.g. mark children as suggested).
+func (me *ReconciliationStateComputator) computeRoomHierarchyChanges(
+	currentRoomState *connector.CurrentRoomState,
+	roomPolicy *policy.RoomPolicy,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	eventTypes := policy.GetHierarchyStateEventTypes(roomPolicy)
+	if len(eventTypes) == 0 {
+		return actions
+	}
+
+	if currentRoomState == nil {
+		me.logger.Warnf("Room %s is part of a managed space hierarchy, but its current state is unknown", roomPolicy.Id)
+		return actions
+	}
+
+	for _, eventType := range eventTypes {
+		actions = append(
+			actions,
+			me.computeRoomHierarchyEventChanges(currentRoomState, roomPolicy, policy, eventType)...,
+		)
+	}
+
+	return actions
+}
+
+// computeRoomHierarchyEventChanges makes the room have hierarchy events (of the given type) for exactly the rooms the policy wants.
+// Existing events for other rooms are removed, as long as they're the policy's business.
+func (me *ReconciliationStateComputator) computeRoomHierarchyEventChanges(
+	currentRoomState *connector.CurrentRoomState,
+	roomPolicy *policy.RoomPolicy,
+	policy *policy.Policy,
+	eventType string,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	wantedRoomIds := policy.GetHierarchyRoomIds(roomPolicy, eventType)
+
+	for _, roomId := range wantedRoomIds {
+		currentContent := currentRoomState.GetKeyedStateEventContent(eventType, roomId)
+		if isHierarchyEventContentValid(currentContent) {
+			continue
+		}
+
+		content := map[string]interface{}{}
+		for key, value := range currentContent {
+			content[key] = value
+		}
+		content["via"] = []interface{}{determineHierarchyViaServerName(currentRoomState, roomId)}
+
+		actions = append(actions, newRoomSetStateAction(roomPolicy, eventType, roomId, content))
+	}
+
+	for _, roomId := range currentRoomState.GetStateKeys(eventType) {
+		if util.IsStringInArray(roomId, wantedRoomIds) || !policy.IsHierarchyRoomIdManaged(eventType, roomId) {
+			continue
+		}
+
+		// Hierarchy events get removed by replacing them with an empty one
+		actions = append(actions, newRoomSetStateAction(roomPolicy, eventType, roomId, map[string]interface{}{}))
+	}
+
+	return actions
+}
+
+// computeDeclaredRoomChanges creates the declared rooms, which haven't been created yet
+func (me *ReconciliationStateComputator) computeDeclaredRoomChanges(
+	currentState *connector.CurrentState,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	for _, declaredRoom := range policy.DeclaredRooms {
+		if _, exists := currentState.DeclaredRoomIds[declaredRoom.Key]; exists {
+			continue
+		}
+
+		payload := map[string]interface{}{
+			"key":         declaredRoom.Key,
+			"alias":       declaredRoom.Alias,
+			"name":        declaredRoom.Name,
+			"topic":       declaredRoom.Topic,
+			"avatarUri":   declaredRoom.AvatarUri,
+			"preset":      declaredRoom.Preset,
+			"roomVersion": declaredRoom.RoomVersion,
+			"space":       declaredRoom.Space,
+		}
+
+		// The room's future steward creates it, so that it gets to be the room's admin
+		if roomPolicy := policy.GetRoomPolicyByRoomId(declaredRoom.GetReference()); roomPolicy != nil && roomPolicy.StewardUserId != "" {
+			payload["creatorUserId"] = roomPolicy.StewardUserId
+		}
+
+		if len(declaredRoom.InitialState) != 0 {
+			initialState := make([]connector.CreateRoomRequestStateEvent, 0, len(declaredRoom.InitialState))
+			for _, event := range declaredRoom.InitialState {
+				initialState = append(initialState, connector.CreateRoomRequestStateEvent{
+					Type:     event.Type,
+					StateKey: event.StateKey,
+					Content:  event.Content,
+				})
+			}
+			payload["initialState"] = initialState
+		}
+
+		actions = append(actions, &reconciliation.StateAction{
+			Type:    reconciliation.ActionRoomCreate,
+			Payload: payload,
+		})
+	}
+
+	return actions
+}
+
+// computeRoomMembershipChanges kicks users who are not entitled to be in rooms with exclusive membership.
+//
+// Managed users, who are joined to a room they're no longer supposed to be in, are not kicked.
+// They are made to leave instead (see computeUserRoomChanges).
+func (me *ReconciliationStateComputator) computeRoomMembershipChanges(
+	currentRoomState *connector.CurrentRoomState,
+	roomPolicy *policy.RoomPolicy,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if !roomPolicy.ExclusiveMembership {
+		return actions
+	}
+
+	if currentRoomState == nil || currentRoomState.Members == nil {
+		me.logger.Warnf("Room %s has exclusive membership, but its current members are unknown", roomPolicy.Id)
+		return actions
+	}
+
+	memberIds := make([]string, 0, len(currentRoomState.Members))
+	for userId := range currentRoomState.Members {
+		memberIds = append(memberIds, userId)
+	}
+	sort.Strings(memberIds)
+
+	for _, userId := range memberIds {
+		if roomPolicy.IsMemberEntitled(userId, currentRoomState.ActingUserId, policy) {
+			continue
+		}
+
+		userPolicy := policy.GetUserPolicyByUserId(userId)
+		if userPolicy != nil && currentRoomState.Members[userId] == "join" {
+			continue
+		}
+
+		payload := map[string]interface{}{
+			"userId": userId,
+			"roomId": roomPolicy.Id,
+		}
+		if currentRoomState.ActingUserId != "" {
+			payload["actorUserId"] = currentRoomState.ActingUserId
+		}
+
+		actions = append(actions, &reconciliation.StateAction{
+			Type:    reconciliation.ActionRoomKick,
+			Payload: payload,
+		})
+	}
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	deprovisioningState *connector.DeprovisioningState,
+	policy *policy.Policy,
+	userPolicy *policy.UserPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if currentUserState != nil && currentUserState.ServerDeactivated {
+		// There's nothing we can do for such accounts anymore.
+		if userPolicy.IsActive() {
+			me.logger.Warnf("User %s is supposed to be active, but their account has been deactivated on the homeserver", userId)
+		}
+		return actions
+	}
+
+	actions = append(
+		actions,
+		me.computeUserActivationChanges(userId, currentUserState, deprovisioningState, policy, userPolicy)...,
+	)
+
+	if !userPolicy.IsActive() {
+		// Accounts that have never been active or are being deactivated now,
+		// should not go through the other changes that appear below.
+		return actions
+	}
+
+	actions = append(
+		actions,
+		me.computeUserProfileDataChanges(userId, currentUserState, policy, userPolicy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserServerAdminChanges(userId, currentUserState, userPolicy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserTypeChanges(userId, currentUserState, userPolicy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserShadowBanChanges(userId, currentUserState, userPolicy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserMembershipChanges(userId, currentUserState, userPolicy, policy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserThreePidChanges(userId, currentUserState, userPolicy, !policy.Flags.AllowCustomUserThreePids)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserServerNoticeChanges(userId, currentUserState, policy, userPolicy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserPushRuleChanges(userId, currentUserState, userPolicy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserAccountDataChanges(userId, currentUserState, userPolicy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserDeviceChanges(userId, currentUserState, policy.GetMaxDeviceIdleDuration(userPolicy))...,
+	)
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserActivationChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	deprovisioningState *connector.DeprovisioningState,
+	policy *policy.Policy,
+	userPolicy *policy.UserPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if currentUserState == nil {
+		if userPolicy.IsActive() {
+			action := &reconciliation.StateAction{
+				Type: reconciliation.ActionUserCreate,
+				Payload: map[string]interface{}{
+					"userId":   userPolicy.Id,
+					"password": me.GenerateInitialPasswordForUser(*userPolicy),
+				},
+			}
+			if userPolicy.UserType != nil && *userPolicy.UserType != "" {
+				// Created accounts get the right type right away (see computeUserTypeChanges)
+				action.Payload["userType"] = *userPolicy.UserType
+			}
+			actions = append(actions, action)
+		}
+
+		return actions
+	}
+
+	if !userPolicy.IsActive() {
+		return me.computeUserDeprovisioningChanges(userId, currentUserState, deprovisioningState, policy, userPolicy)
+	}
+
+	_, isDeprovisioned := deprovisioningState.GetDeprovisionedAt(userId)
+
+	if !currentUserState.Active || isDeprovisioned {
+		actions = append(actions, &reconciliation.StateAction{
+			Type: reconciliation.ActionUserActivate,
+			Payload: map[string]interface{}{
+				"userId": userPolicy.Id,
+				// Reactivation cancels any pending (destructive) deprovisioning
+				"clearDeprovisioning": isDeprovisioned,
+			},
+		})
+	}
+
+	return actions
+}
+
+// computeUserDeprovisioningChanges deprovisions an (existing) inactive user, as the policy's deprovisioning mode says (see policy.Deprovisioning).
+//
+// When deprovisioning is tracked (see policy.Policy.IsDeprovisioningTracked), users who are already deactivated,
+// but whose deprovisioning hasn't been recorded yet (e.g. users deactivated before deprovisioning got configured), get deactivated again.
+// This way, we know when the grace period (for destructive deprovisioning modes) starts.
+func (me *ReconciliationStateComputator) computeUserDeprovisioningChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	deprovisioningState *connector.DeprovisioningState,
+	policy *policy.Policy,
+	userPolicy *policy.UserPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	deprovisioning := policy.GetDeprovisioning()
+
+	isTracked := policy.IsDeprovisioningTracked()
+	deprovisionedAt, isDeprovisioned := deprovisioningState.GetDeprovisionedAt(userId)
+
+	deprovisioningNotice := policy.GetLifecycleNotices().Deprovisioning
+
+	if deprovisioning.IsLogoutOnly() {
+		// There's no deactivation marker to go by, so we only log users out once (when their deprovisioning gets recorded).
+		if !isDeprovisioned {
+			if deprovisioningNotice != nil {
+				actions = append(actions, newUserLifecycleNoticeAction(userId, "", deprovisioningNotice, map[string]string{
+					"userId": userId,
+				}))
+			}
+
+			actions = append(actions, &reconciliation.StateAction{
+				Type: reconciliation.ActionUserLogout,
+				Payload: map[string]interface{}{
+					"userId":               userPolicy.Id,
+					"recordDeprovisioning": isTracked,
+				},
+			})
+		}
+		return actions
+	}
+
+	if deprovisioningNotice != nil && currentUserState.Active {
+		// Sent before anything else, while the user is still around to see it
+		actions = append(actions, newUserLifecycleNoticeAction(userId, "", deprovisioningNotice, map[string]string{
+			"userId": userId,
+		}))
+	}
+
+	// If the user is supposed to be inactive,
+	// we want to ensure that it has left all rooms first,
+	// before possibly proceeding with a deactivation process.
+	actions = append(
+		actions,
+		me.computeUserMembershipChanges(userId, currentUserState, userPolicy, policy)...,
+	)
+
+	if currentUserState.Active || (isTracked && !isDeprovisioned) {
+		actions = append(actions, &reconciliation.StateAction{
+			Type: reconciliation.ActionUserDeactivate,
+			Payload: map[string]interface{}{
+				"userId":               userPolicy.Id,
+				"recordDeprovisioning": isTracked,
+			},
+		})
+		return actions
+	}
+
+	if !deprovisioning.IsDestructive() || !isDeprovisioned {
+		return actions
+	}
+
+	if time.Now().Before(deprovisionedAt.Add(deprovisioning.GetGracePeriod())) {
+		// Still within the grace period
+		return actions
+	}
+
+	actions = append(actions, &reconciliation.StateAction{
+		Type: reconciliation.ActionUserErase,
+		Payload: map[string]interface{}{
+			"userId":     userPolicy.Id,
+			"purgeMedia": deprovisioning.IsMediaPurged(),
+		},
+	})
+
+	return actions
+}
+
+// computeOrphanedRoomChanges handles rooms which are no longer managed, as the policy says (see policy.OrphanedRooms),
+// and records the rooms which are managed now (once the orphaned ones have been handled).
+func (me *ReconciliationStateComputator) computeOrphanedRoomChanges(
+	currentState *connector.CurrentState,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if !policy.IsOrphanedRoomHandlingEnabled() || currentState.ManagedRooms == nil {
+		return actions
+	}
+
+	joinedUserIdsByRoomId := currentState.GetJoinedUserIdsByRoomId()
+
+	for _, roomId := range currentState.ManagedRooms.OrphanedRoomIds {
+		actions = append(actions, me.computeOrphanedRoomHandling(roomId, currentState, joinedUserIdsByRoomId[roomId], *policy.OrphanedRooms, policy.GetManagedUserIds())...)
+	}
+
+	managedRoomIds := policy.GetManagedRoomIdsResolved()
+	sort.Strings(managedRoomIds)
+
+	recordedRoomIds := append(make([]string, 0, len(currentState.ManagedRooms.RecordedRoomIds)), currentState.ManagedRooms.RecordedRoomIds...)
+	sort.Strings(recordedRoomIds)
+
+	if currentState.ManagedRooms.RecordedRoomIds != nil && reflect.DeepEqual(managedRoomIds, recordedRoomIds) {
+		return actions
+	}
+
+	actions = append(actions, &reconciliation.StateAction{
+		Type: reconciliation.ActionOrphanedRoomsSetManagedRooms,
+		Payload: map[string]interface{}{
+			"roomIds": managedRoomIds,
+		},
+	})
+
+	return actions
+}
+
+// computeOrphanedRoomHandling handles a single orphaned room (see computeOrphanedRoomChanges).
+// joinedUserIds are the (known) users joined to the room (see connector.CurrentState.GetJoinedUserIdsByRoomId).
+func (me *ReconciliationStateComputator) computeOrphanedRoomHandling(
+	roomId string,
+	currentState *connector.CurrentState,
+	joinedUserIds map[string]bool,
+	orphanedRooms policy.OrphanedRooms,
+	managedUserIds []string,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	switch orphanedRooms.Mode {
+	case policy.OrphanedRoomModeRemoveManagedUsers:
+		for _, userId := range managedUserIds {
+			if !joinedUserIds[userId] {
+				continue
+			}
+
+			actions = append(actions, &reconciliation.StateAction{
+				Type: reconciliation.ActionRoomLeave,
+				Payload: map[string]interface{}{
+					"userId":   userId,
+					"roomId":   roomId,
+					"orphaned": true,
+				},
+			})
+		}
+	case policy.OrphanedRoomModeArchive:
+		if orphanedRooms.Delete {
+			// Deleting takes care of kicking everyone out and of deleting aliases
+			actions = append(actions, &reconciliation.StateAction{
+				Type: reconciliation.ActionRoomDelete,
+				Payload: map[string]interface{}{
+					"roomId": roomId,
+				},
+			})
+			break
+		}
+
+		currentRoomState := currentState.GetRoomStateByRoomId(roomId)
+		if currentRoomState == nil || currentRoomState.Members == nil {
+			me.logger.Warnf("Orphaned room %s is to be archived, but its current members are unknown", roomId)
+			break
+		}
+
+		memberIds := make([]string, 0, len(currentRoomState.Members))
+		for userId := range currentRoomState.Members {
+			if userId != currentRoomState.ActingUserId {
+				memberIds = append(memberIds, userId)
+			}
+		}
+		sort.Strings(memberIds)
+
+		for _, userId := range memberIds {
+			actions = append(actions, &reconciliation.StateAction{
+				Type: reconciliation.ActionRoomKick,
+				Payload: map[string]interface{}{
+					"userId":      userId,
+					"roomId":      roomId,
+					"actorUserId": currentRoomState.ActingUserId,
+					"orphaned":    true,
+				},
+			})
+		}
+
+		for _, alias := range currentRoomState.Aliases {
+			actions = append(actions, &reconciliation.StateAction{
+				Type: reconciliation.ActionRoomDeleteAlias,
+				Payload: map[string]interface{}{
+					"roomId":   roomId,
+					"alias":    alias,
+					"orphaned": true,
+				},
+			})
+		}
+	}
+
+	return actions
+}
+
+// computeDeprovisioningStateChanges keeps track of the users being managed (see connector.DeprovisioningState.ManagedUserIds),
+// so that users removed from the policy can be told apart during subsequent runs.
+//
+// Users whose accounts are gone (or deactivated on the homeserver) are done with and are no longer kept track of.
+func (me *ReconciliationStateComputator) computeDeprovisioningStateChanges(
+	currentState *connector.CurrentState,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if !policy.IsDeprovisioningTracked() || currentState.Deprovisioning == nil {
+		return actions
+	}
+
+	managedUserIds := make([]string, 0, len(policy.User))
+	for _, userPolicy := range policy.User {
+		currentUserState := currentState.GetUserStateByUserId(userPolicy.Id)
+		if currentUserState == nil && !userPolicy.IsActive() {
+			continue
+		}
+		if currentUserState != nil && currentUserState.ServerDeactivated {
+			continue
+		}
+		managedUserIds = append(managedUserIds, userPolicy.Id)
+	}
+	sort.Strings(managedUserIds)
+
+	currentManagedUserIds := append(make([]string, 0, len(currentState.Deprovisioning.ManagedUserIds)), currentState.Deprovisioning.ManagedUserIds...)
+	sort.Strings(currentManagedUserIds)
+
+	hasChanges := !reflect.DeepEqual(managedUserIds, currentManagedUserIds)
+	for userId := range currentState.Deprovisioning.DeprovisionedAt {
+		if !util.IsStringInArray(userId, managedUserIds) {
+			// This record is to be cleaned up
+			hasChanges = true
+		}
+	}
+
+	if !hasChanges {
+		return actions
+	}
+
+	actions = append(actions, &reconciliation.StateAction{
+		Type: reconciliation.ActionDeprovisioningSetManagedUsers,
+		Payload: map[string]interface{}{
+			"userIds": managedUserIds,
+		},
+	})
+
+	return actions
+}
+
+// computeAccountCleanupChanges deactivates the guest and unmanaged accounts (see policy.AccountCleanup), which are old enough.
+// Accounts whose age is unknown are left alone, and so are server admins, application service users and users having a user type (unless asked otherwise).
+func (me *ReconciliationStateComputator) computeAccountCleanupChanges(
+	currentState *connector.CurrentState,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if !policy.IsAccountCleanupEnabled() {
+		return actions
+	}
+
+	accountCleanup := policy.AccountCleanup
+	createdBefore := time.Now().Add(-accountCleanup.GetMinAge())
+
+	for _, unmanagedUserState := range currentState.UnmanagedUsers {
+		if unmanagedUserState.Guest && !accountCleanup.DeactivateGuests {
+			continue
+		}
+		if !unmanagedUserState.Guest && !accountCleanup.DeactivateUnmanagedUsers {
+			continue
+		}
+
+		if policy.GetUserPolicyByUserId(unmanagedUserState.Id) != nil || util.IsStringInArray(unmanagedUserState.Id, policy.GetAccountCleanupExemptUserIds()) {
+			continue
+		}
+
+		if unmanagedUserState.ServerAdmin && !accountCleanup.DeactivateServerAdmins {
+			continue
+		}
+		if unmanagedUserState.AppServiceId != "" && !accountCleanup.DeactivateAppServiceUsers {
+			continue
+		}
+		if unmanagedUserState.UserType != "" && !accountCleanup.DeactivateUsersWithType {
+			continue
+		}
+
+		if unmanagedUserState.CreatedAt == 0 {
+			continue
+		}
+
+		createdAt := time.Unix(0, unmanagedUserState.CreatedAt*int64(time.Millisecond))
+		if createdAt.After(createdBefore) {
+			continue
+		}
+
+		actions = append(actions, &reconciliation.StateAction{
+			Type: reconciliation.ActionUserDeactivateAccount,
+			Payload: map[string]interface{}{
+				"userId": unmanagedUserState.Id,
+				"guest":  unmanagedUserState.Guest,
+				"erase":  accountCleanup.Erase,
+			},
+		})
+	}
+
+	return actions
+}
+
+// computeUserIdMigrationChanges copies the old users' profiles over to the new users (see policy.UserIdMigration),
+// recording each migration as completed afterwards, so that it only happens once.
+//
+// Migrations only happen once the new user is active. They're put after all users' other changes,
+// so that new users get created (and joined to their rooms, etc.) first.
+func (me *ReconciliationStateComputator) computeUserIdMigrationChanges(
+	currentState *connector.CurrentState,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if currentState.UserIdMigrations == nil {
+		return actions
+	}
+
+	for _, migration := range policy.UserIdMigrations {
+		if currentState.UserIdMigrations.IsCompleted(migration.OldUserId, migration.NewUserId) {
+			continue
+		}
+
+		newUserPolicy := policy.GetUserPolicyByUserId(migration.NewUserId)
+		if newUserPolicy == nil || !newUserPolicy.IsActive() {
+			continue
+		}
+
+		newUserState := currentState.GetUserStateByUserId(migration.NewUserId)
+		if newUserState != nil && newUserState.ServerDeactivated {
+			continue
+		}
+
+		oldUserState := currentState.GetUserStateByUserId(migration.OldUserId)
+		if oldUserState != nil && !oldUserState.ServerDeactivated {
+			payload := map[string]interface{}{}
+
+			// Custom profiles carry over, while policy-enforced ones are taken care of by the new user's own policy
+			if policy.Flags.AllowCustomUserDisplayNames && oldUserState.DisplayName != "" {
+				if newUserState == nil || newUserState.DisplayName != oldUserState.DisplayName {
+					payload["displayName"] = oldUserState.DisplayName
+				}
+			}
+
+			if policy.Flags.AllowCustomUserAvatars && oldUserState.AvatarMxcUri != "" {
+				if newUserState == nil || newUserState.AvatarMxcUri != oldUserState.AvatarMxcUri {
+					payload["avatarMxcUri"] = oldUserState.AvatarMxcUri
+					payload["avatarSourceUriHash"] = oldUserState.AvatarSourceUriHash
+				}
+			}
+
+			if len(payload) != 0 {
+				payload["userId"] = migration.NewUserId
+				payload["fromUserId"] = migration.OldUserId
+
+				actions = append(actions, &reconciliation.StateAction{
+					Type:    reconciliation.ActionUserCopyProfile,
+					Payload: payload,
+				})
+			}
+		}
+
+		actions = append(actions, &reconciliation.StateAction{
+			Type: reconciliation.ActionUserIdMigrationComplete,
+			Payload: map[string]interface{}{
+				"oldUserId": migration.OldUserId,
+				"newUserId": migration.NewUserId,
+			},
+		})
+	}
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserProfileDataChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	policy *policy.Policy,
+	userPolicy *policy.UserPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	actions = append(
+		actions,
+		me.computeUserProfileDisplayNameChanges(userId, currentUserState, policy, userPolicy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserProfileAvatarChanges(userId, currentUserState, policy, userPolicy)...,
+	)
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserProfileDisplayNameChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	policy *policy.Policy,
+	userPolicy *policy.UserPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	shouldSetDisplayName := false
+	if currentUserState == nil {
+		if userPolicy.DisplayName != "" {
+			// Newly-created users should get their name set to whatever's in the policy
+			// (regardless if custom names are allowed or not).
+			shouldSetDisplayName = true
+		}
+	} else {
+		if policy.Flags.AllowCustomUserDisplayNames {
+			if currentUserState.DisplayName == "" && userPolicy.DisplayName != "" {
+				// Even if we allow custom names, we still want to avoid
+				// people having empty names.
+				// If we have something to set it to, that is..
+				shouldSetDisplayName = true
+			}
+		} else {
+			if currentUserState.DisplayName != userPolicy.DisplayName {
+				// Existing users may be locked into a specific display name,
+				// given that there's a policy flag that requires that.
+				shouldSetDisplayName = true
+			}
+		}
+	}
+
+	if shouldSetDisplayName {
+		actions = append(actions, &reconciliation.StateAction{
+			Type: reconciliation.ActionUserSetDisplayName,
+			Payload: map[string]interface{}{
+				"userId":      userPolicy.Id,
+				"displayName": userPolicy.DisplayName,
+			},
+		})
+	}
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserProfileAvatarChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	policy *policy.Policy,
+	userPolicy *policy.UserPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	shouldSetAvatar := false
+	if currentUserState == nil {
+		if userPolicy.AvatarUri != "" {
+			// Newly-created users should get their avatar set to whatever's in the policy
+			// (regardless if custom avatars are allowed or not).
+			shouldSetAvatar = true
+		}
+	} else {
+		if policy.Flags.AllowCustomUserAvatars {
+			if currentUserState.AvatarSourceUriHash == avatar.UriHash("") && userPolicy.AvatarUri != "" {
+				// Even if we allow custom avatars, we still want to avoid
+				// people having empty avatars.
+				// If we have something to set it to, that is..
+				shouldSetAvatar = true
+			}
+		} else {
+			// Existing users may be locked into a specific avatar,
+			// given that there's a policy flag that requires that.
+			if currentUserState.AvatarSourceUriHash != avatar.UriHash(userPolicy.AvatarUri) {
+				shouldSetAvatar = true
+			}
+		}
+	}
+
+	if shouldSetAvatar {
+		actions = append(actions, &reconciliation.StateAction{
+			Type: reconciliation.ActionUserSetAvatar,
+			Payload: map[string]interface{}{
+				"userId":    userPolicy.Id,
+				"avatarUri": userPolicy.AvatarUri,
+			},
+		})
+	}
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserServerAdminChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	userPolicy *policy.UserPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if userPolicy.ServerAdmin == nil {
+		// The admin status is not managed for this user.
+		return actions
+	}
+
+	isServerAdmin := false
+	if currentUserState != nil {
+		isServerAdmin = currentUserState.ServerAdmin
+	}
+
+	if isServerAdmin == *userPolicy.ServerAdmin {
+		return actions
+	}
+
+	actions = append(actions, &reconciliation.StateAction{
+		Type: reconciliation.ActionUserSetServerAdmin,
+		Payload: map[string]interface{}{
+			"userId": userId,
+			"admin":  *userPolicy.ServerAdmin,
+		},
+	})
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserTypeChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	userPolicy *policy.UserPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if userPolicy.UserType == nil {
+		// The user type is not managed for this user.
+		return actions
+	}
+
+	if currentUserState == nil {
+		// The account is only being created now, with the right type (see computeUserActivationChanges)
+		return actions
+	}
+
+	if currentUserState.UserType == *userPolicy.UserType {
+		return actions
+	}
+
+	actions = append(actions, &reconciliation.StateAction{
+		Type: reconciliation.ActionUserSetUserType,
+		Payload: map[string]interface{}{
+			"userId":   userId,
+			"userType": *userPolicy.UserType,
+		},
+	})
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserShadowBanChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	userPolicy *policy.UserPolicy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if userPolicy.ShadowBanned == nil {
+		// The shadow-ban status is not managed for this user.
+		return actions
+	}
+
+	isShadowBanned := false
+	if currentUserState != nil {
+		isShadowBanned = currentUserState.ShadowBanned
+	}
+
+	if isShadowBanned == *userPolicy.ShadowBanned {
+		return actions
+	}
+
+	actions = append(actions, &reconciliation.StateAction{
+		Type: reconciliation.ActionUserSetShadowBanned,
+		Payload: map[string]interface{}{
+			"userId":       userId,
+			"shadowBanned": *userPolicy.ShadowBanned,
+		},
+	})
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserMembershipChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	userPolicy *policy.UserPolicy,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	actions = append(
+		actions,
+		me.computeUserRoomChanges(userId, currentUserState, userPolicy, policy)...,
+	)
+
+	actions = append(
+		actions,
+		me.computeUserAutoJoinChanges(userId, currentUserState, policy.AutoJoinRooms)...,
+	)
+
+	return actions
+}
+
+// computeUserAutoJoinChanges joins users whose account is being created now to the auto-join rooms (see policy.Policy.AutoJoinRooms).
+// Existing users are left alone, so that they're free to leave such rooms.
+func (me *ReconciliationStateComputator) computeUserAutoJoinChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	autoJoinRooms []string,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	if currentUserState != nil {
+		return actions
+	}
+
+	for _, room := range autoJoinRooms {
+		actions = append(actions, &reconciliation.StateAction{
+			Type: reconciliation.ActionRoomAutoJoin,
+			Payload: map[string]interface{}{
+				"userId": userId,
+				"room":   room,
+			},
+		})
+	}
+
+	return actions
+}
+
+func (me *ReconciliationStateComputator) computeUserRoomChanges(
+	userId string,
+	currentUserState *connector.CurrentUserState,
+	userPolicy *policy.UserPolicy,
+	policy *policy.Policy,
+) []*reconciliation.StateAction {
+	var actions []*reconciliation.StateAction
+
+	joinedRoomIds := policy.GetEffectiveJoinedRoomIds(userPolicy)
+
+	// Membership gets checked for each (managed) room, so it's worth having the room ids as sets
+	wantedRoomIds := util.StringArrayToSet(joinedRoomIds)
+	managedRoomIds := util.StringArrayToSet(policy.ManagedRoomIds)
+	var currentJoinedRoomIds map[string]bool
+	if currentUserState != nil {
+		currentJoinedRoomIds = util.StringArrayToSet(currentUserState.JoinedRoomIds)
+	}
+
+	for _, roomId := range joinedRoomIds {
+		if !managedRoomIds[roomId] {
+			me.logger.Warnf(
+				"User %s is supposed to be joined to the %s room, but that room is not managed",
+				userPolicy.Id,
+				roomId,
+			)
+			continue
+		}
+
+		if currentJoinedRoomIds[roomId] {
+			continue
+		}
+
+		payload := map[string]interface{}{
+			"userId": userId,
+			"roomId": roomId,
+		}
+		if roomPolicy := policy.GetRoomPolicyByRoomId(roomId); roomPolicy != nil && roomPolicy.StewardUserId != "" {
+			// Invite-only (or restricted) rooms may need someone other than matrix-corporal to invite the user
+			payload["inviterUserId"] = roomPolicy.StewardUserId
+		}
+
+		actions = append(actions, &reconciliation.StateAction{
+			Type:    reconciliation.ActionRoomJoin,
+			Payload: payload,
+		})
+	}
+
+	if currentUserState != nil {
+		for _, roomId := range currentUserState.JoinedRoomIds {
+			if !managedRoomIds[roomId] {
+				//We rightfully ignore rooms we don't care about.
+				continue
+			}
+
+			if wantedRoomIds[roomId] {
+				continue
+			}
+
+			// Inactive users are leaving all rooms, which the deprovisioning notice (if any) is about
+			if roomRemovalNotice := policy.GetLifecycleNotices().RoomRemoval; roomRemovalNotice != nil && userPolicy.IsActive() {
+				actions = append(actions, newUserLifecycleNoticeAction(userId, "", roomRemovalNotice, map[string]string{
+					"userId": userId,
+					"roomId": roomId,
+				}))
+			}
+
+			actions = append(actions, &reconciliation.StateAction{
+				Type: reconciliation.ActionRoomLeave,
+				Payload: map[string]interface{}{
+					"userId": userId,
+					"roomId": roomId,
+				},
+			})
+		}
+	}
+
+	return actions
 }
 
-func (me *ReconciliationStateComputator) computeUserChanges(
+// computeUserPushRuleChanges makes the user's managed push rules (see policy.PushRuleIdPrefix) match the ones in the user's policy.
+// Other push rules (e.g. ones created by the user) are left untouched.
+func (me *ReconciliationStateComputator) computeUserPushRuleChanges(
 	userId string,
 	currentUserState *connector.CurrentUserState,
-	policy *policy.Policy,
 	userPolicy *policy.UserPolicy,
 ) []*reconciliation.StateAction {
 	var actions []*reconciliation.StateAction
 
-	actions = append(
-		actions,
-		me.computeUserActivationChanges(userId, currentUserState, policy, userPolicy)...,
-	)
-
-	if !userPolicy.Active {
-		// Accounts that have never been active or are being deactivated now,
-		// should not go through the other changes that appear below.
+	if userPolicy.PushRules == nil {
+		// Push rules are not managed for this user.
 		return actions
 	}
 
-	actions = append(
-		actions,
-		me.computeUserProfileDataChanges(userId, currentUserState, policy, userPolicy)...,
-	)
+	var currentPushRules []connector.CurrentUserPushRule
+	if currentUserState != nil {
+		currentPushRules = currentUserState.PushRules
+	}
 
-	actions = append(
-		actions,
-		me.computeUserMembershipChanges(userId, currentUserState, userPolicy, policy.ManagedRoomIds)...,
-	)
+	currentPushRulesByRuleId := make(map[string]connector.CurrentUserPushRule)
+	for _, currentPushRule := range currentPushRules {
+		currentPushRulesByRuleId[currentPushRule.RuleId] = currentPushRule
+	}
 
-	return actions
-}
+	wantedRuleIds := make(map[string]bool)
+	for _, pushRule := range userPolicy.PushRules {
+		ruleId := pushRule.GetRuleId()
+		wantedRuleIds[ruleId] = true
 
-func (me *ReconciliationStateComputator) computeUserActivationChanges(
-	userId string,
-	currentUserState *connector.CurrentUserState,
-	policy *policy.Policy,
-	userPolicy *policy.UserPolicy,
-) []*reconciliation.StateAction {
-	var actions []*reconciliation.StateAction
+		currentPushRule, exists := currentPushRulesByRuleId[ruleId]
+		if exists {
+			if currentPushRule.Kind == pushRule.Kind && isPushRuleUpToDate(currentPushRule, pushRule) {
+				continue
+			}
 
-	if currentUserState == nil {
-		if userPolicy.Active {
-			actions = append(actions, &reconciliation.StateAction{
-				Type: reconciliation.ActionUserCreate,
-				Payload: map[string]interface{}{
-					"userId":   userPolicy.Id,
-					"password": me.generateInitialPasswordForUser(*userPolicy),
-				},
-			})
+			if currentPushRule.Kind != pushRule.Kind {
+				// Rules are identified by kind and id, so changing the kind means replacing the rule
+				actions = append(actions, newUserDeletePushRuleAction(userId, currentPushRule))
+			}
 		}
 
-		return actions
-	}
-
-	if !userPolicy.Active {
-		// If the user is supposed to be inactive,
-		// we want to ensure that it has left all rooms first,
-		// before possibly proceeding with a deactivation process.
-		actions = append(
-			actions,
-			me.computeUserMembershipChanges(userId, currentUserState, userPolicy, policy.ManagedRoomIds)...,
-		)
+		actions = append(actions, &reconciliation.StateAction{
+			Type: reconciliation.ActionUserSetPushRule,
+			Payload: map[string]interface{}{
+				"userId":     userId,
+				"kind":       pushRule.Kind,
+				"ruleId":     ruleId,
+				"actions":    pushRule.Actions,
+				"conditions": pushRule.Conditions,
+				"pattern":    pushRule.Pattern,
+			},
+		})
 	}
 
-	if currentUserState.Active {
-		if !userPolicy.Active {
-			actions = append(actions, &reconciliation.StateAction{
-				Type: reconciliation.ActionUserDeactivate,
-				Payload: map[string]interface{}{
-					"userId": userPolicy.Id,
-				},
-			})
-		}
-	} else {
-		if userPolicy.Active {
-			actions = append(actions, &reconciliation.StateAction{
-				Type: reconciliation.ActionUserActivate,
-				Payload: map[string]interface{}{
-					"userId": userPolicy.Id,
-				},
-			})
+	for _, currentPushRule := range currentPushRules {
+		if wantedRuleIds[currentPushRule.RuleId] {
+			continue
 		}
+
+		actions = append(actions, newUserDeletePushRuleAction(userId, currentPushRule))
 	}
 
 	return actions
 }
 
-func (me *ReconciliationStateComputator) computeUserProfileDataChanges(
-	userId string,
-	currentUserState *connector.CurrentUserState,
-	policy *policy.Policy,
-	userPolicy *policy.UserPolicy,
-) []*reconciliation.StateAction {
-	var actions []*reconciliation.StateAction
+func newUserDeletePushRuleAction(userId string, currentPushRule connector.CurrentUserPushRule) *reconciliation.StateAction {
+	return &reconciliation.StateAction{
+		Type: reconciliation.ActionUserDeletePushRule,
+		Payload: map[string]interface{}{
+			"userId": userId,
+			"kind":   currentPushRule.Kind,
+			"ruleId": currentPushRule.RuleId,
+		},
+	}
+}
 
-	actions = append(
-		actions,
-		me.computeUserProfileDisplayNameChanges(userId, currentUserState, policy, userPolicy)...,
-	)
+// isPushRuleUpToDate tells whether the current push rule has the actions, conditions and pattern that the policy wants.
+// Missing and empty conditions are considered the same.
+func isPushRuleUpToDate(currentPushRule connector.CurrentUserPushRule, pushRule *policy.UserPushRule) bool {
+	if currentPushRule.Pattern != pushRule.Pattern {
+		return false
+	}
 
-	actions = append(
-		actions,
-		me.computeUserProfileAvatarChanges(userId, currentUserState, policy, userPolicy)...,
-	)
+	if len(currentPushRule.Conditions) != 0 || len(pushRule.Conditions) != 0 {
+		if !isSameJson(currentPushRule.Conditions, pushRule.Conditions) {
+			return false
+		}
+	}
 
-	return actions
+	return isSameJson(currentPushRule.Actions, pushRule.Actions)
 }
 
-func (me *ReconciliationStateComputator) computeUserProfileDisplayNameChanges(
+// computeUserAccountDataChanges sets the account data entries listed in the user's policy,
+// unless the user's account data already is what it would become (see policy.AccountDataModeMerge, etc.)
+func (me *ReconciliationStateComputator) computeUserAccountDataChanges(
 	userId string,
 	currentUserState *connector.CurrentUserState,
-	policy *policy.Policy,
 	userPolicy *policy.UserPolicy,
 ) []*reconciliation.StateAction {
 	var actions []*reconciliation.StateAction
 
-	shouldSetDisplayName := false
-	if currentUserState == nil {
-		if userPolicy.DisplayName != "" {
-			// Newly-created users should get their name set to whatever's in the policy
-			// (regardless if custom names are allowed or not).
-			shouldSetDisplayName = true
+	for _, accountData := range userPolicy.AccountData {
+		currentContent := map[string]interface{}{}
+		if currentUserState != nil {
+			for _, currentAccountData := range currentUserState.AccountData {
+				if currentAccountData.Type == accountData.Type && currentAccountData.RoomId == accountData.RoomId {
+					currentContent = currentAccountData.Content
+					break
+				}
+			}
 		}
-	} else {
-		if policy.Flags.AllowCustomUserDisplayNames {
-			if currentUserState.DisplayName == "" && userPolicy.DisplayName != "" {
-				// Even if we allow custom names, we still want to avoid
-				// people having empty names.
-				// If we have something to set it to, that is..
-				shouldSetDisplayName = true
+
+		content := accountData.Content
+		if !accountData.IsOverwritten() {
+			content = make(map[string]interface{})
+			for key, value := range currentContent {
+				content[key] = value
 			}
-		} else {
-			if currentUserState.DisplayName != userPolicy.DisplayName {
-				// Existing users may be locked into a specific display name,
-				// given that there's a policy flag that requires that.
-				shouldSetDisplayName = true
+			for key, value := range accountData.Content {
+				content[key] = value
 			}
 		}
-	}
 
-	if shouldSetDisplayName {
+		if isSameJson(currentContent, content) {
+			continue
+		}
+
 		actions = append(actions, &reconciliation.StateAction{
-			Type: reconciliation.ActionUserSetDisplayName,
+			Type: reconciliation.ActionUserSetAccountData,
 			Payload: map[string]interface{}{
-				"userId":      userPolicy.Id,
-				"displayName": userPolicy.DisplayName,
+				"userId":  userId,
+				"roomId":  accountData.RoomId,
+				"type":    accountData.Type,
+				"content": content,
 			},
 		})
 	}
@@ -201,123 +1436,225 @@ func (me *ReconciliationStateComputator) computeUserProfileDisplayNameChanges(
 	return actions
 }
 
-func (me *ReconciliationStateComputator) computeUserProfileAvatarChanges(
+// computeUserDeviceChanges deletes the user's devices, which have not been seen for longer than the given duration.
+// Devices which have never been seen are left alone, as we can't tell how long they've been idle.
+func (me *ReconciliationStateComputator) computeUserDeviceChanges(
 	userId string,
 	currentUserState *connector.CurrentUserState,
-	policy *policy.Policy,
-	userPolicy *policy.UserPolicy,
+	maxDeviceIdleDuration time.Duration,
 ) []*reconciliation.StateAction {
 	var actions []*reconciliation.StateAction
 
-	shouldSetAvatar := false
-	if currentUserState == nil {
-		if userPolicy.AvatarUri != "" {
-			// Newly-created users should get their avatar set to whatever's in the policy
-			// (regardless if custom avatars are allowed or not).
-			shouldSetAvatar = true
+	if maxDeviceIdleDuration == 0 || currentUserState == nil {
+		return actions
+	}
+
+	idleSince := time.Now().Add(-maxDeviceIdleDuration)
+
+	var staleDeviceIds []string
+	for _, device := range currentUserState.Devices {
+		if device.LastSeenTs == 0 {
+			continue
 		}
-	} else {
-		if policy.Flags.AllowCustomUserAvatars {
-			if currentUserState.AvatarSourceUriHash == avatar.UriHash("") && userPolicy.AvatarUri != "" {
-				// Even if we allow custom avatars, we still want to avoid
-				// people having empty avatars.
-				// If we have something to set it to, that is..
-				shouldSetAvatar = true
-			}
-		} else {
-			// Existing users may be locked into a specific avatar,
-			// given that there's a policy flag that requires that.
-			if currentUserState.AvatarSourceUriHash != avatar.UriHash(userPolicy.AvatarUri) {
-				shouldSetAvatar = true
-			}
+
+		if time.Unix(0, device.LastSeenTs*int64(time.Millisecond)).Before(idleSince) {
+			staleDeviceIds = append(staleDeviceIds, device.Id)
 		}
 	}
 
-	if shouldSetAvatar {
-		actions = append(actions, &reconciliation.StateAction{
-			Type: reconciliation.ActionUserSetAvatar,
-			Payload: map[string]interface{}{
-				"userId":    userPolicy.Id,
-				"avatarUri": userPolicy.AvatarUri,
-			},
-		})
+	if len(staleDeviceIds) == 0 {
+		return actions
 	}
 
+	actions = append(actions, &reconciliation.StateAction{
+		Type: reconciliation.ActionUserDeleteDevices,
+		Payload: map[string]interface{}{
+			"userId":    userId,
+			"deviceIds": staleDeviceIds,
+		},
+	})
+
 	return actions
 }
 
-func (me *ReconciliationStateComputator) computeUserMembershipChanges(
+// isSameJson tells whether both values serialize to the same JSON (object keys are always sorted, so their order doesn't matter)
+func isSameJson(a interface{}, b interface{}) bool {
+	aJson, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJson, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(aJson) == string(bJson)
+}
+
+// computeUserThreePidChanges adds the 3pids listed in the user's policy (which the user doesn't have yet).
+// With removeUnlisted, the user's other 3pids get removed, so that they match the policy exactly.
+func (me *ReconciliationStateComputator) computeUserThreePidChanges(
 	userId string,
 	currentUserState *connector.CurrentUserState,
 	userPolicy *policy.UserPolicy,
-	managedRoomIds []string,
+	removeUnlisted bool,
 ) []*reconciliation.StateAction {
 	var actions []*reconciliation.StateAction
 
-	actions = append(
-		actions,
-		me.computeUserRoomChanges(userId, currentUserState, userPolicy, managedRoomIds)...,
-	)
+	if userPolicy.ThreePids == nil {
+		// 3pids are not managed for this user.
+		return actions
+	}
+
+	currentThreePidKeys := make(map[string]bool)
+	if currentUserState != nil {
+		for _, threePid := range currentUserState.ThreePids {
+			currentThreePidKeys[policy.ThreePidKey(threePid.Medium, threePid.Address)] = true
+		}
+	}
+
+	policyThreePidKeys := make(map[string]bool)
+	for _, threePid := range userPolicy.ThreePids {
+		policyThreePidKeys[threePid.Key()] = true
+
+		if currentThreePidKeys[threePid.Key()] {
+			continue
+		}
+
+		actions = append(actions, &reconciliation.StateAction{
+			Type: reconciliation.ActionUserAddThreePid,
+			Payload: map[string]interface{}{
+				"userId":  userId,
+				"medium":  threePid.Medium,
+				"address": threePid.Address,
+			},
+		})
+	}
+
+	if currentUserState != nil && removeUnlisted {
+		for _, threePid := range currentUserState.ThreePids {
+			if policyThreePidKeys[policy.ThreePidKey(threePid.Medium, threePid.Address)] {
+				continue
+			}
+
+			actions = append(actions, &reconciliation.StateAction{
+				Type: reconciliation.ActionUserRemoveThreePid,
+				Payload: map[string]interface{}{
+					"userId":  userId,
+					"medium":  threePid.Medium,
+					"address": threePid.Address,
+				},
+			})
+		}
+	}
 
 	return actions
 }
 
-func (me *ReconciliationStateComputator) computeUserRoomChanges(
+func (me *ReconciliationStateComputator) computeUserServerNoticeChanges(
 	userId string,
 	currentUserState *connector.CurrentUserState,
+	policy *policy.Policy,
 	userPolicy *policy.UserPolicy,
-	managedRoomIds []string,
 ) []*reconciliation.StateAction {
 	var actions []*reconciliation.StateAction
 
-	for _, roomId := range userPolicy.JoinedRoomIds {
-		if !util.IsStringInArray(roomId, managedRoomIds) {
-			me.logger.Warnf(
-				"User %s is supposed to be joined to the %s room, but that room is not managed",
-				userPolicy.Id,
-				roomId,
-			)
+	for _, serverNotice := range policy.ServerNotices {
+		if !serverNotice.IsTargetingUserId(userId) {
 			continue
 		}
 
-		if currentUserState != nil && util.IsStringInArray(roomId, currentUserState.JoinedRoomIds) {
+		if currentUserState != nil && util.IsStringInArray(serverNotice.ID, currentUserState.DeliveredServerNoticeIds) {
 			continue
 		}
 
 		actions = append(actions, &reconciliation.StateAction{
-			Type: reconciliation.ActionRoomJoin,
+			Type: reconciliation.ActionUserSendServerNotice,
 			Payload: map[string]interface{}{
-				"userId": userId,
-				"roomId": roomId,
+				"userId":   userId,
+				"noticeId": serverNotice.ID,
+				"message":  serverNotice.Message,
 			},
 		})
 	}
 
-	if currentUserState != nil {
-		for _, roomId := range currentUserState.JoinedRoomIds {
-			if !util.IsStringInArray(roomId, managedRoomIds) {
-				//We rightfully ignore rooms we don't care about.
-				continue
-			}
+	accountExpiringNotice := policy.GetLifecycleNotices().AccountExpiring
+	if accountExpiringNotice != nil && userPolicy.ExpiresAt != nil && time.Now().After(userPolicy.ExpiresAt.Add(-accountExpiringNotice.GetTimeBefore())) {
+		// Each expiration time gets its own notice id, so that extending the account (and having it about to expire again) causes re-delivery
+		noticeId := fmt.Sprintf("%s%d", accountExpiringNoticeIdPrefix, userPolicy.ExpiresAt.Unix())
 
-			if util.IsStringInArray(roomId, userPolicy.JoinedRoomIds) {
-				continue
-			}
+		if currentUserState == nil || !util.IsStringInArray(noticeId, currentUserState.DeliveredServerNoticeIds) {
+			actions = append(actions, newUserLifecycleNoticeAction(userId, noticeId, accountExpiringNotice, map[string]string{
+				"userId":    userId,
+				"expiresAt": userPolicy.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"),
+			}))
+		}
+	}
 
-			actions = append(actions, &reconciliation.StateAction{
-				Type: reconciliation.ActionRoomLeave,
-				Payload: map[string]interface{}{
-					"userId": userId,
-					"roomId": roomId,
-				},
-			})
+	welcomeNotice := policy.GetLifecycleNotices().Welcome
+	if welcomeNotice != nil && isWelcomeNoticeDue(currentUserState) {
+		action := newUserLifecycleNoticeAction(userId, welcomeNoticeId, welcomeNotice, map[string]string{
+			"userId":      userId,
+			"displayName": userPolicy.DisplayName,
+		})
+		if welcomeNotice.SenderUserId != "" {
+			action.Payload["senderUserId"] = welcomeNotice.SenderUserId
 		}
+		actions = append(actions, action)
 	}
 
 	return actions
 }
 
-func (me *ReconciliationStateComputator) generateInitialPasswordForUser(userPolicy policy.UserPolicy) string {
+// isWelcomeNoticeDue tells whether the welcome notice (see policy.LifecycleNotices.Welcome) is to be sent to the given user.
+//
+// It's sent to users whose account is being created now. If sending it fails, it's retried during subsequent runs,
+// for as long as the account is new (see welcomeNoticeRetryPeriod), so that users who have been around for a while don't get welcomed.
+func isWelcomeNoticeDue(currentUserState *connector.CurrentUserState) bool {
+	if currentUserState == nil {
+		return true
+	}
+
+	if util.IsStringInArray(welcomeNoticeId, currentUserState.DeliveredServerNoticeIds) {
+		return false
+	}
+
+	if currentUserState.CreatedAt == 0 {
+		return false
+	}
+
+	createdAt := time.Unix(0, currentUserState.CreatedAt*int64(time.Millisecond))
+	return time.Since(createdAt) < welcomeNoticeRetryPeriod
+}
+
+// welcomeNoticeId is the id that welcome notices (see policy.LifecycleNotices.Welcome) get recorded as delivered with
+const welcomeNoticeId = "com.devture.matrix.corporal.lifecycle.welcome"
+
+// welcomeNoticeRetryPeriod is for how long after an account gets created sending the welcome notice (if it has failed) is retried
+const welcomeNoticeRetryPeriod = 24 * time.Hour
+
+// accountExpiringNoticeIdPrefix is what the ids of delivered account expiration notices (see policy.LifecycleNotices.AccountExpiring) start with
+const accountExpiringNoticeIdPrefix = "com.devture.matrix.corporal.lifecycle.account_expiring."
+
+// newUserLifecycleNoticeAction creates an action for sending a lifecycle notice (see policy.LifecycleNotices).
+// Notices without an id are not recorded as delivered, as they're about one-time changes (which won't be computed again once done).
+func newUserLifecycleNoticeAction(userId string, noticeId string, notice *policy.LifecycleNotice, values map[string]string) *reconciliation.StateAction {
+	payload := map[string]interface{}{
+		"userId":  userId,
+		"message": notice.Render(values),
+	}
+	if noticeId != "" {
+		payload["noticeId"] = noticeId
+	}
+
+	return &reconciliation.StateAction{
+		Type:    reconciliation.ActionUserSendServerNotice,
+		Payload: payload,
+	}
+}
+
+// GenerateInitialPasswordForUser returns the password to create the given user with (see reconciliation.ActionUserCreate).
+// Unless the user's password is specified in the policy, a new random one gets generated each time.
+func (me *ReconciliationStateComputator) GenerateInitialPasswordForUser(userPolicy policy.UserPolicy) string {
 	// UserAuthTypePassthrough is a special AuthType. Users are created with an initial password as specified in the policy.
 	// For such users, authentication is delegated to the homeserver.
 	// We can do password matching on our side as well (at least initially), but delegating authentication to the homeserver,
@@ -344,3 +1681,58 @@ func (me *ReconciliationStateComputator) generateInitialPasswordForUser(userPoli
 	}
 	return fmt.Sprintf("%x", passwordBytes)
 }
+
+func newRoomSetStateAction(
+	roomPolicy *policy.RoomPolicy,
+	eventType string,
+	stateKey string,
+	content map[string]interface{},
+) *reconciliation.StateAction {
+	payload := map[string]interface{}{
+		"roomId":    roomPolicy.Id,
+		"eventType": eventType,
+		"content":   content,
+	}
+	if stateKey != "" {
+		payload["stateKey"] = stateKey
+	}
+	if roomPolicy.StewardUserId != "" {
+		payload["actorUserId"] = roomPolicy.StewardUserId
+	}
+
+	return &reconciliation.StateAction{
+		Type:    reconciliation.ActionRoomSetState,
+		Payload: payload,
+	}
+}
+
+func newRoomAliasAction(actionType string, roomPolicy *policy.RoomPolicy, alias string) *reconciliation.StateAction {
+	payload := map[string]interface{}{
+		"roomId": roomPolicy.Id,
+		"alias":  alias,
+	}
+	if roomPolicy.StewardUserId != "" {
+		payload["actorUserId"] = roomPolicy.StewardUserId
+	}
+
+	return &reconciliation.StateAction{
+		Type:    actionType,
+		Payload: payload,
+	}
+}
+
+// isHierarchyEventContentValid tells whether a `m.space.child` or `m.space.parent` event content is valid (has non-empty `via`).
+// Events without one are considered removed by clients.
+func isHierarchyEventContentValid(content map[string]interface{}) bool {
+	via, ok := content["via"].([]interface{})
+	return ok && len(via) > 0
+}
+
+// determineHierarchyViaServerName returns the server to route through (`via`) when pointing to a managed room in the hierarchy.
+// Managed rooms are always reachable through the managed homeserver.
+func determineHierarchyViaServerName(currentRoomState *connector.CurrentRoomState, roomId string) string {
+	if currentRoomState.ActingUserId != "" {
+		return matrix.DetermineServerNameFromId(currentRoomState.ActingUserId)
+	}
+	return matrix.DetermineServerNameFromId(roomId)
+}
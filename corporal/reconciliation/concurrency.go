@@ -0,0 +1,192 @@
+package reconciliation
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+)
+
+// API categories group the homeserver APIs that reconciliation calls, so that concurrency can be limited per category
+// (e.g. to go easy on expensive APIs, like account creation), in addition to limiting the overall number of workers.
+const (
+	// ApiCategoryState is for determining the current state of users (profiles, joined rooms, 3pids, etc.)
+	ApiCategoryState = "state"
+
+	// ApiCategoryAccounts is for creating, activating, deactivating (logging out, erasing, etc.) user accounts and deleting their devices
+	ApiCategoryAccounts = "accounts"
+
+	// ApiCategoryProfiles is for setting display names and avatars
+	ApiCategoryProfiles = "profiles"
+
+	// ApiCategoryThreePids is for adding and removing 3pids
+	ApiCategoryThreePids = "threepids"
+
+	// ApiCategoryServerNotices is for sending server notices
+	ApiCategoryServerNotices = "server_notices"
+
+	// ApiCategoryUserSettings is for changing users' settings (push rules, account data)
+	ApiCategoryUserSettings = "user_settings"
+
+	// ApiCategoryMembership is for joining, leaving and kicking users from rooms
+	ApiCategoryMembership = "membership"
+
+	// ApiCategoryRooms is for creating rooms and changing their state
+	ApiCategoryRooms = "rooms"
+)
+
+var KnownApiCategories = []string{
+	ApiCategoryState,
+	ApiCategoryAccounts,
+	ApiCategoryProfiles,
+	ApiCategoryThreePids,
+	ApiCategoryServerNotices,
+	ApiCategoryUserSettings,
+	ApiCategoryMembership,
+	ApiCategoryRooms,
+}
+
+var actionApiCategories = map[string]string{
+	ActionUserCreate:     ApiCategoryAccounts,
+	ActionUserActivate:   ApiCategoryAccounts,
+	ActionUserDeactivate: ApiCategoryAccounts,
+	ActionUserLogout:     ApiCategoryAccounts,
+	ActionUserErase:      ApiCategoryAccounts,
+
+	ActionUserDeleteDevices: ApiCategoryAccounts,
+
+	ActionUserDeactivateAccount: ApiCategoryAccounts,
+
+	ActionUserSetDisplayName: ApiCategoryProfiles,
+	ActionUserSetAvatar:      ApiCategoryProfiles,
+	ActionUserCopyProfile:    ApiCategoryProfiles,
+
+	ActionUserSetServerAdmin:  ApiCategoryAccounts,
+	ActionUserSetUserType:     ApiCategoryAccounts,
+	ActionUserSetShadowBanned: ApiCategoryAccounts,
+
+	ActionUserAddThreePid:    ApiCategoryThreePids,
+	ActionUserRemoveThreePid: ApiCategoryThreePids,
+
+	ActionUserSendServerNotice: ApiCategoryServerNotices,
+
+	ActionUserSetPushRule:    ApiCategoryUserSettings,
+	ActionUserDeletePushRule: ApiCategoryUserSettings,
+	ActionUserSetAccountData: ApiCategoryUserSettings,
+
+	ActionRoomJoin:  ApiCategoryMembership,
+	ActionRoomLeave: ApiCategoryMembership,
+	ActionRoomKick:  ApiCategoryMembership,
+
+	ActionRoomAutoJoin: ApiCategoryMembership,
+
+	ActionRoomSetState:               ApiCategoryRooms,
+	ActionRoomSetDirectoryVisibility: ApiCategoryRooms,
+	ActionRoomCreateAlias:            ApiCategoryRooms,
+	ActionRoomDeleteAlias:            ApiCategoryRooms,
+	ActionRoomCreate:                 ApiCategoryRooms,
+	ActionRoomDelete:                 ApiCategoryRooms,
+}
+
+// userScopedActionTypes lists the action types which only concern the user they're for (see GetActionUserId),
+// so that actions for different users can be performed at the same time.
+//
+// Other actions (like kicking users out of a room) concern rooms and are performed one at a time, in order.
+var userScopedActionTypes = map[string]bool{
+	ActionUserCreate:            true,
+	ActionUserSetDisplayName:    true,
+	ActionUserSetAvatar:         true,
+	ActionUserSetServerAdmin:    true,
+	ActionUserSetUserType:       true,
+	ActionUserSetShadowBanned:   true,
+	ActionUserActivate:          true,
+	ActionUserDeactivate:        true,
+	ActionUserLogout:            true,
+	ActionUserErase:             true,
+	ActionUserDeleteDevices:     true,
+	ActionUserDeactivateAccount: true,
+	ActionUserAddThreePid:       true,
+	ActionUserRemoveThreePid:    true,
+	ActionUserSendServerNotice:  true,
+	ActionUserSetPushRule:       true,
+	ActionUserDeletePushRule:    true,
+	ActionUserSetAccountData:    true,
+	ActionUserCopyProfile:       true,
+	ActionRoomJoin:              true,
+	ActionRoomLeave:             true,
+	ActionRoomAutoJoin:          true,
+}
+
+func GetActionApiCategory(actionType string) string {
+	return actionApiCategories[actionType]
+}
+
+// GetActionUserId returns the id of the user that a user-scoped action is for (see userScopedActionTypes).
+// An empty string is returned for actions which are not user-scoped.
+func GetActionUserId(action *StateAction) string {
+	if !userScopedActionTypes[action.Type] {
+		return ""
+	}
+	userId, _ := action.Payload["userId"].(string)
+	return userId
+}
+
+// ConcurrencyLimiter limits how many reconciliation calls happen at the same time,
+// both overall (the number of workers) and per API category (see KnownApiCategories).
+type ConcurrencyLimiter struct {
+	workers int
+
+	// categorySemaphores contains a semaphore (a channel with a buffer as large as the limit) for each limited API category
+	categorySemaphores map[string]chan struct{}
+}
+
+// NewConcurrencyLimiter creates a limiter. Categories without a limit (in categoryLimits) are only limited by the number of workers.
+func NewConcurrencyLimiter(workers int, categoryLimits map[string]int) (*ConcurrencyLimiter, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("the number of workers needs to be a positive number")
+	}
+
+	categorySemaphores := map[string]chan struct{}{}
+	for category, limit := range categoryLimits {
+		if !util.IsStringInArray(category, KnownApiCategories) {
+			return nil, fmt.Errorf("unknown API category: %s", category)
+		}
+		if limit < 1 {
+			return nil, fmt.Errorf("the concurrency limit for API category %s needs to be a positive number", category)
+		}
+		if limit < workers {
+			categorySemaphores[category] = make(chan struct{}, limit)
+		}
+	}
+
+	return &ConcurrencyLimiter{
+		workers:            workers,
+		categorySemaphores: categorySemaphores,
+	}, nil
+}
+
+func (me *ConcurrencyLimiter) GetWorkers() int {
+	return me.workers
+}
+
+// GetLimit tells how many calls of the given API category can happen at the same time
+func (me *ConcurrencyLimiter) GetLimit(category string) int {
+	semaphore, exists := me.categorySemaphores[category]
+	if !exists {
+		return me.workers
+	}
+	return cap(semaphore)
+}
+
+// Run calls the callback as soon as the API category's concurrency limit allows it
+func (me *ConcurrencyLimiter) Run(category string, callback func() error) error {
+	semaphore, exists := me.categorySemaphores[category]
+	if !exists {
+		return callback()
+	}
+
+	semaphore <- struct{}{}
+	defer func() {
+		<-semaphore
+	}()
+
+	return callback()
+}
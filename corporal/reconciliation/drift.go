@@ -0,0 +1,167 @@
+package reconciliation
+
+import "fmt"
+
+// Drift describes a way in which the homeserver's state differs from the policy,
+// as found out by computing the actions which would correct it (see ActionStatusPlanned).
+type Drift struct {
+	// ActionType is the type of action which would correct the drift (e.g. `user.set_display_name`)
+	ActionType string `json:"actionType"`
+
+	UserId *string `json:"userId"`
+	RoomId *string `json:"roomId"`
+
+	// Description is a human-readable description of the drift (e.g. "display name is not `John`")
+	Description string `json:"description"`
+}
+
+// driftDescribers turn actions into drift descriptions.
+// Actions which don't correspond to the homeserver's state differing from the policy (like bookkeeping ones) are not here.
+var driftDescribers = map[string]func(action *StateAction) string{
+	ActionUserCreate: func(action *StateAction) string {
+		return "user does not exist"
+	},
+	ActionUserSetDisplayName: func(action *StateAction) string {
+		return fmt.Sprintf("display name is not `%s`", getDriftPayloadString(action, "displayName"))
+	},
+	ActionUserSetAvatar: func(action *StateAction) string {
+		if getDriftPayloadString(action, "avatarUri") == "" {
+			return "user has an avatar, although they're not supposed to"
+		}
+		return "avatar differs"
+	},
+	ActionUserSetServerAdmin: func(action *StateAction) string {
+		if admin, _ := action.Payload["admin"].(bool); admin {
+			return "user is not a server admin, although they're supposed to be"
+		}
+		return "user is a server admin, although they're not supposed to be"
+	},
+	ActionUserSetUserType: func(action *StateAction) string {
+		if userType := getDriftPayloadString(action, "userType"); userType != "" {
+			return fmt.Sprintf("user type is not `%s`", userType)
+		}
+		return "user has a user type, although they're supposed to be a regular user"
+	},
+	ActionUserSetShadowBanned: func(action *StateAction) string {
+		if shadowBanned, _ := action.Payload["shadowBanned"].(bool); shadowBanned {
+			return "user is not shadow-banned, although they're supposed to be"
+		}
+		return "user is shadow-banned, although they're not supposed to be"
+	},
+	ActionUserActivate: func(action *StateAction) string {
+		return "user is inactive, although they're supposed to be active"
+	},
+	ActionUserDeactivate: func(action *StateAction) string {
+		return "user is active, although they're supposed to be inactive"
+	},
+	ActionUserLogout: func(action *StateAction) string {
+		return "user is not logged out, although they're supposed to be deprovisioned"
+	},
+	ActionUserErase: func(action *StateAction) string {
+		return "user is not erased, although their deprovisioning grace period is over"
+	},
+	ActionUserDeleteDevices: func(action *StateAction) string {
+		deviceIds, _ := action.Payload["deviceIds"].([]string)
+		return fmt.Sprintf("user has %d devices which have been idle for too long", len(deviceIds))
+	},
+	ActionUserDeactivateAccount: func(action *StateAction) string {
+		if guest, _ := action.Payload["guest"].(bool); guest {
+			return "guest account exists, although only provisioned users are supposed to"
+		}
+		return "unmanaged account exists, although only provisioned users are supposed to"
+	},
+	ActionUserAddThreePid: func(action *StateAction) string {
+		return fmt.Sprintf("3pid `%s` (%s) is missing", getDriftPayloadString(action, "address"), getDriftPayloadString(action, "medium"))
+	},
+	ActionUserRemoveThreePid: func(action *StateAction) string {
+		return fmt.Sprintf("3pid `%s` (%s) is not supposed to be there", getDriftPayloadString(action, "address"), getDriftPayloadString(action, "medium"))
+	},
+	ActionUserSendServerNotice: func(action *StateAction) string {
+		return "server notice has not been delivered"
+	},
+	ActionUserSetPushRule: func(action *StateAction) string {
+		return fmt.Sprintf("push rule `%s` is missing or differs", getDriftPayloadString(action, "ruleId"))
+	},
+	ActionUserDeletePushRule: func(action *StateAction) string {
+		return fmt.Sprintf("push rule `%s` is not supposed to be there", getDriftPayloadString(action, "ruleId"))
+	},
+	ActionUserSetAccountData: func(action *StateAction) string {
+		return fmt.Sprintf("account data `%s` differs", getDriftPayloadString(action, "type"))
+	},
+	ActionUserCopyProfile: func(action *StateAction) string {
+		return fmt.Sprintf("profile has not been copied over from `%s` (user id migration)", getDriftPayloadString(action, "fromUserId"))
+	},
+	ActionRoomJoin: func(action *StateAction) string {
+		return "user is not joined to the room, although they're supposed to be"
+	},
+	ActionRoomLeave: func(action *StateAction) string {
+		if orphaned, _ := action.Payload["orphaned"].(bool); orphaned {
+			return "user is joined to the room, although it's no longer managed"
+		}
+		return "user is joined to the room, although they're not supposed to be"
+	},
+	ActionRoomAutoJoin: func(action *StateAction) string {
+		return "new user has not been auto-joined to the room yet"
+	},
+	ActionRoomKick: func(action *StateAction) string {
+		if orphaned, _ := action.Payload["orphaned"].(bool); orphaned {
+			return "user is a member of the room, although it's no longer managed (and is to be archived)"
+		}
+		return "user is a member of the room (which has exclusive membership), although they're not supposed to be"
+	},
+	ActionRoomSetState: func(action *StateAction) string {
+		eventType := getDriftPayloadString(action, "eventType")
+		if stateKey := getDriftPayloadString(action, "stateKey"); stateKey != "" {
+			return fmt.Sprintf("`%s` state (for `%s`) differs", eventType, stateKey)
+		}
+		return fmt.Sprintf("`%s` state differs", eventType)
+	},
+	ActionRoomSetDirectoryVisibility: func(action *StateAction) string {
+		if getDriftPayloadString(action, "visibility") == "public" {
+			return "room is not listed in the room directory, although it's supposed to be"
+		}
+		return "room is listed in the room directory, although it's not supposed to be"
+	},
+	ActionRoomCreateAlias: func(action *StateAction) string {
+		return fmt.Sprintf("alias `%s` does not point to the room", getDriftPayloadString(action, "alias"))
+	},
+	ActionRoomDeleteAlias: func(action *StateAction) string {
+		if orphaned, _ := action.Payload["orphaned"].(bool); orphaned {
+			return fmt.Sprintf("alias `%s` points to the room, although it's no longer managed (and is to be archived)", getDriftPayloadString(action, "alias"))
+		}
+		return fmt.Sprintf("alias `%s` points to the room, although it's not supposed to", getDriftPayloadString(action, "alias"))
+	},
+	ActionRoomCreate: func(action *StateAction) string {
+		return fmt.Sprintf("declared room `%s` does not exist", getDriftPayloadString(action, "key"))
+	},
+	ActionRoomDelete: func(action *StateAction) string {
+		return "room still exists, although it's no longer managed (and is to be deleted)"
+	},
+}
+
+// NewDrift describes the drift, which the given action would correct.
+// nil is returned for actions which don't correct drift (see driftDescribers).
+func NewDrift(action *StateAction) *Drift {
+	describer, exists := driftDescribers[action.Type]
+	if !exists {
+		return nil
+	}
+
+	drift := &Drift{
+		ActionType:  action.Type,
+		Description: describer(action),
+	}
+	if userId := getDriftPayloadString(action, "userId"); userId != "" {
+		drift.UserId = &userId
+	}
+	if roomId := getDriftPayloadString(action, "roomId"); roomId != "" {
+		drift.RoomId = &roomId
+	}
+
+	return drift
+}
+
+func getDriftPayloadString(action *StateAction, key string) string {
+	value, _ := action.GetOptionalStringPayloadDataByKey(key, "")
+	return value
+}
@@ -0,0 +1,104 @@
+package reconciler
+
+import (
+	"devture-matrix-corporal/corporal/avatar"
+	"devture-matrix-corporal/corporal/connector"
+	"fmt"
+)
+
+// setUserAvatarFromUri sets the user's avatar to the image found at the given (non-empty) URI.
+//
+// Previous uploads (see connector.AvatarUploadCache) are reused when possible,
+// so that avatars shared by many users (or set again) are not downloaded and uploaded over and over again.
+// Uploads happen as the matrix-corporal user, so that deleting some user's media (see policy.DeprovisioningModePurge)
+// doesn't break the avatars of others.
+func (me *Reconciler) setUserAvatarFromUri(ctx *connector.AccessTokenContext, userId string, avatarUri string) error {
+	sourceUriHash := avatar.UriHash(avatarUri)
+
+	upload, exists, err := me.findAvatarUpload(ctx, func(avatarUploadCache *connector.AvatarUploadCache) (connector.AvatarUpload, bool) {
+		upload, exists := avatarUploadCache.Uploads[sourceUriHash]
+		return upload, exists
+	})
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		userAvatar, err := me.avatarReader.Read(avatarUri)
+		if err != nil {
+			return fmt.Errorf("Failed reading user avatar from %s: %s", avatarUri, err)
+		}
+
+		upload, exists, err = me.findAvatarUpload(ctx, func(avatarUploadCache *connector.AvatarUploadCache) (connector.AvatarUpload, bool) {
+			return avatarUploadCache.FindByContentHash(userAvatar.ContentHash)
+		})
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			mxcUri, err := me.connector.UploadAvatar(ctx, me.reconciliatorUserId, userAvatar)
+			if err != nil {
+				return fmt.Errorf("Failed uploading user avatar for %s: %s", userId, err)
+			}
+
+			upload = connector.AvatarUpload{
+				MxcUri:      mxcUri,
+				ContentHash: userAvatar.ContentHash,
+			}
+		}
+
+		err = me.storeAvatarUpload(ctx, sourceUriHash, upload)
+		if err != nil {
+			return fmt.Errorf("Failed storing avatar upload cache: %s", err)
+		}
+	}
+
+	return me.connector.SetUserAvatarMxcUri(ctx, userId, upload.MxcUri, sourceUriHash)
+}
+
+// findAvatarUpload looks up an upload in the avatar upload cache, loading the cache first (if not loaded already)
+func (me *Reconciler) findAvatarUpload(
+	ctx *connector.AccessTokenContext,
+	find func(avatarUploadCache *connector.AvatarUploadCache) (connector.AvatarUpload, bool),
+) (connector.AvatarUpload, bool, error) {
+	me.lockAvatarUploadCache.Lock()
+	defer me.lockAvatarUploadCache.Unlock()
+
+	err := me.loadAvatarUploadCacheIfNecessary(ctx)
+	if err != nil {
+		return connector.AvatarUpload{}, false, err
+	}
+
+	upload, exists := find(me.avatarUploadCache)
+	return upload, exists, nil
+}
+
+// storeAvatarUpload adds the given upload to the avatar upload cache and persists the cache (in the matrix-corporal user's account data)
+func (me *Reconciler) storeAvatarUpload(ctx *connector.AccessTokenContext, sourceUriHash string, upload connector.AvatarUpload) error {
+	me.lockAvatarUploadCache.Lock()
+	defer me.lockAvatarUploadCache.Unlock()
+
+	err := me.loadAvatarUploadCacheIfNecessary(ctx)
+	if err != nil {
+		return err
+	}
+
+	me.avatarUploadCache.Uploads[sourceUriHash] = upload
+
+	return me.connector.StoreAvatarUploadCache(ctx, me.reconciliatorUserId, me.avatarUploadCache)
+}
+
+func (me *Reconciler) loadAvatarUploadCacheIfNecessary(ctx *connector.AccessTokenContext) error {
+	if me.avatarUploadCache != nil {
+		return nil
+	}
+
+	avatarUploadCache, err := me.connector.GetAvatarUploadCache(ctx, me.reconciliatorUserId)
+	if err != nil {
+		return fmt.Errorf("Failed loading avatar upload cache: %s", err)
+	}
+	me.avatarUploadCache = avatarUploadCache
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package reconciler
+
+import (
+	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/reconciliation"
+	"devture-matrix-corporal/corporal/util"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// runCheckpointer keeps track of which actions of a full run have been performed,
+// storing a checkpoint (see connector.ReconciliationCheckpoint) every once in a while (see Reconciler.SetCheckpointInterval).
+type runCheckpointer struct {
+	reconciler *Reconciler
+	ctx        *connector.AccessTokenContext
+	policyHash string
+
+	actions          []*reconciliation.StateAction
+	performedActions map[*reconciliation.StateAction]bool
+
+	lastProcessedUserId string
+	lastStoredAt        time.Time
+
+	// lock guards against actions being marked as performed from multiple workers at the same time
+	lock sync.Mutex
+}
+
+func newRunCheckpointer(
+	reconciler *Reconciler,
+	ctx *connector.AccessTokenContext,
+	policyHash string,
+	actions []*reconciliation.StateAction,
+) *runCheckpointer {
+	return &runCheckpointer{
+		reconciler:       reconciler,
+		ctx:              ctx,
+		policyHash:       policyHash,
+		actions:          actions,
+		performedActions: map[*reconciliation.StateAction]bool{},
+	}
+}
+
+// start stores the initial checkpoint (with all actions pending)
+func (me *runCheckpointer) start() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.store()
+}
+
+// markPerformed records that the given action has been performed, storing a checkpoint if it's time for one
+func (me *runCheckpointer) markPerformed(action *reconciliation.StateAction) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.performedActions[action] = true
+
+	if userId := reconciliation.GetActionUserId(action); userId != "" {
+		me.lastProcessedUserId = userId
+	}
+
+	if time.Since(me.lastStoredAt) >= me.reconciler.checkpointInterval {
+		me.store()
+	}
+}
+
+// finish stores a checkpoint for resuming the run (when it fails after having performed some actions) or clears it.
+//
+// Runs which fail before performing anything have their checkpoint cleared too,
+// so that a resumed run that keeps failing (e.g. because of an action which no longer makes sense) does not get resumed forever.
+func (me *runCheckpointer) finish(err error) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if err != nil && len(me.performedActions) != 0 {
+		me.store()
+		return
+	}
+
+	me.clear()
+}
+
+// store stores a checkpoint (with the actions which have not been performed yet). The lock needs to be held.
+func (me *runCheckpointer) store() {
+	pendingActions := make([]*reconciliation.StateAction, 0, len(me.actions)-len(me.performedActions))
+	for _, action := range me.actions {
+		if !me.performedActions[action] {
+			pendingActions = append(pendingActions, action)
+		}
+	}
+
+	me.lastStoredAt = time.Now()
+
+	err := me.reconciler.connector.StoreReconciliationCheckpoint(me.ctx, me.reconciler.reconciliatorUserId, &connector.ReconciliationCheckpoint{
+		PolicyHash:          me.policyHash,
+		StoredAt:            me.lastStoredAt.UnixNano() / int64(time.Millisecond),
+		LastProcessedUserId: me.lastProcessedUserId,
+		PendingActions:      reconciliation.RedactActions(pendingActions),
+	})
+	if err != nil {
+		// Not being able to store a checkpoint only means that the run may need to start over (if interrupted)
+		me.reconciler.logger.Warnf("Failed storing reconciliation checkpoint: %s", err)
+	}
+}
+
+// clear clears the checkpoint. The lock needs to be held.
+func (me *runCheckpointer) clear() {
+	err := me.reconciler.connector.StoreReconciliationCheckpoint(me.ctx, me.reconciler.reconciliatorUserId, nil)
+	if err != nil {
+		me.reconciler.logger.Warnf("Failed clearing reconciliation checkpoint: %s", err)
+	}
+}
+
+// reconcileWithCheckpoints is like reconcile, but resumes an interrupted run for the same policy (if there's one)
+// and keeps track of the run's progress (see runCheckpointer).
+func (me *Reconciler) reconcileWithCheckpoints(
+	ctx *connector.AccessTokenContext,
+	policy *policy.Policy,
+	runReport *reconciliation.RunReport,
+) error {
+	policyHash, err := hashPolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	checkpoint, err := me.connector.GetReconciliationCheckpoint(ctx, me.reconciliatorUserId)
+	if err != nil {
+		return fmt.Errorf("Failure determining reconciliation checkpoint: %s", err)
+	}
+
+	actions, err := me.resumeFromCheckpoint(ctx, policy, policyHash, checkpoint)
+	if err != nil {
+		return err
+	}
+
+	if actions == nil {
+		reconciliationState, err := me.computeReconciliationState(ctx, policy, false)
+		if err != nil {
+			return err
+		}
+		actions = reconciliationState.Actions
+	}
+
+	if len(actions) == 0 {
+		// There's no progress to keep track of, but an outdated checkpoint (if any) should not be resumed later on
+		if checkpoint != nil {
+			err = me.connector.StoreReconciliationCheckpoint(ctx, me.reconciliatorUserId, nil)
+			if err != nil {
+				me.logger.Warnf("Failed clearing reconciliation checkpoint: %s", err)
+			}
+		}
+
+		return me.executeActions(ctx, policy, actions, runReport, nil)
+	}
+
+	checkpointer := newRunCheckpointer(me, ctx, policyHash, actions)
+	checkpointer.start()
+
+	err = me.executeActions(ctx, policy, actions, runReport, checkpointer)
+	checkpointer.finish(err)
+
+	return err
+}
+
+// resumeFromCheckpoint returns the pending actions of the given checkpoint (if it's for the same policy), ready to be performed.
+// If there's nothing to resume, nil is returned.
+func (me *Reconciler) resumeFromCheckpoint(
+	ctx *connector.AccessTokenContext,
+	policy *policy.Policy,
+	policyHash string,
+	checkpoint *connector.ReconciliationCheckpoint,
+) ([]*reconciliation.StateAction, error) {
+	if checkpoint == nil || len(checkpoint.PendingActions) == 0 {
+		return nil, nil
+	}
+
+	if checkpoint.PolicyHash != policyHash {
+		me.logger.Infof("Not resuming from the reconciliation checkpoint, as it's for a different policy")
+		return nil, nil
+	}
+
+	// Listeners need to hear about what's been recorded, even if nothing gets computed
+	preparation, err := me.prepareRun(ctx, policy, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initial passwords don't get stored, so they need to be generated again
+	for _, action := range checkpoint.PendingActions {
+		if action.Type != reconciliation.ActionUserCreate {
+			continue
+		}
+
+		userId, err := action.GetStringPayloadDataByKey("userId")
+		if err != nil {
+			return nil, err
+		}
+
+		userPolicy := preparation.policy.GetUserPolicyByUserId(userId)
+		if userPolicy == nil {
+			me.logger.Warnf("Not resuming from the reconciliation checkpoint, as %s (to be created) is not part of the policy", userId)
+			return nil, nil
+		}
+
+		action.Payload["password"] = me.computator.GenerateInitialPasswordForUser(*userPolicy)
+	}
+
+	me.logger.Infof(
+		"Resuming reconciliation from the checkpoint stored at %s (last processed user: %s), with %d pending actions",
+		time.Unix(0, checkpoint.StoredAt*int64(time.Millisecond)).UTC().Format(time.RFC3339),
+		checkpoint.LastProcessedUserId,
+		len(checkpoint.PendingActions),
+	)
+
+	return checkpoint.PendingActions, nil
+}
+
+// hashPolicy returns a hash, which identifies the policy's contents
+func hashPolicy(policy *policy.Policy) (string, error) {
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return "", fmt.Errorf("Failed serializing policy: %s", err)
+	}
+	return util.Sha512(string(policyBytes)), nil
+}
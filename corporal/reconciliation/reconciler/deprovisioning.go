@@ -0,0 +1,134 @@
+package reconciler
+
+import (
+	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/reconciliation"
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+	"time"
+)
+
+// determineRemovedUserIds returns the ids of users, which were managed as of the last reconciliation run, but are no longer part of the policy.
+//
+// Users who have been migrated to another user id (see policy.UserIdMigration) are not considered removed,
+// as the migration decides what happens to them.
+func determineRemovedUserIds(deprovisioningState *connector.DeprovisioningState, policy *policy.Policy) []string {
+	var removedUserIds []string
+	for _, userId := range deprovisioningState.ManagedUserIds {
+		if policy.GetUserPolicyByUserId(userId) == nil && !policy.IsMigratedOldUserId(userId) {
+			removedUserIds = append(removedUserIds, userId)
+		}
+	}
+	return removedUserIds
+}
+
+func (me *Reconciler) reconcileForActionUserLogout(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.LogoutAllAccessTokensForUser(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("Failed logging out all access tokens: %s", err)
+	}
+
+	return me.recordUserDeprovisioningIfRequested(ctx, action, userId)
+}
+
+func (me *Reconciler) reconcileForActionUserErase(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	// Media goes first, as we may not be able to find out what belongs to the user after erasure
+	if purgeMedia, _ := action.Payload["purgeMedia"].(bool); purgeMedia {
+		err = me.connector.DeleteUserMedia(ctx, userId)
+		if err != nil {
+			return fmt.Errorf("Failed deleting the media of %s: %s", userId, err)
+		}
+	}
+
+	err = me.connector.DeactivateUserAccount(ctx, userId, true)
+	if err != nil {
+		return fmt.Errorf("Failed erasing %s: %s", userId, err)
+	}
+
+	return nil
+}
+
+// reconcileForActionUserDeactivateAccount deactivates an account, which is not part of the policy (see policy.AccountCleanup)
+func (me *Reconciler) reconcileForActionUserDeactivateAccount(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	erase, _ := action.Payload["erase"].(bool)
+
+	err = me.connector.DeactivateUserAccount(ctx, userId, erase)
+	if err != nil {
+		return fmt.Errorf("Failed deactivating the account of %s: %s", userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionDeprovisioningSetManagedUsers(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	var userIds []string
+	err := action.DecodePayloadDataByKey("userIds", &userIds)
+	if err != nil {
+		return err
+	}
+
+	return me.updateDeprovisioningState(ctx, func(deprovisioningState *connector.DeprovisioningState) {
+		deprovisioningState.ManagedUserIds = userIds
+
+		// Records for users we're done with are no longer needed
+		for userId := range deprovisioningState.DeprovisionedAt {
+			if !util.IsStringInArray(userId, userIds) {
+				delete(deprovisioningState.DeprovisionedAt, userId)
+			}
+		}
+	})
+}
+
+// recordUserDeprovisioningIfRequested records when the user got deprovisioned (unless that's already known),
+// if the action asks for it (see policy.Policy.IsDeprovisioningTracked).
+func (me *Reconciler) recordUserDeprovisioningIfRequested(ctx *connector.AccessTokenContext, action *reconciliation.StateAction, userId string) error {
+	if recordDeprovisioning, _ := action.Payload["recordDeprovisioning"].(bool); !recordDeprovisioning {
+		return nil
+	}
+
+	err := me.updateDeprovisioningState(ctx, func(deprovisioningState *connector.DeprovisioningState) {
+		if _, exists := deprovisioningState.DeprovisionedAt[userId]; !exists {
+			deprovisioningState.DeprovisionedAt[userId] = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("Failed recording the deprovisioning of %s: %s", userId, err)
+	}
+
+	return nil
+}
+
+// updateDeprovisioningState makes the given changes to the deprovisioning state (stored in the matrix-corporal user's account data).
+// Updates happen one at a time, so that concurrent ones don't undo each other.
+func (me *Reconciler) updateDeprovisioningState(
+	ctx *connector.AccessTokenContext,
+	update func(deprovisioningState *connector.DeprovisioningState),
+) error {
+	me.lockDeprovisioningState.Lock()
+	defer me.lockDeprovisioningState.Unlock()
+
+	deprovisioningState, err := me.connector.GetDeprovisioningState(ctx, me.reconciliatorUserId)
+	if err != nil {
+		return err
+	}
+
+	update(deprovisioningState)
+
+	return me.connector.StoreDeprovisioningState(ctx, me.reconciliatorUserId, deprovisioningState)
+}
@@ -0,0 +1,120 @@
+package reconciler
+
+import (
+	"devture-matrix-corporal/corporal/hook"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/reconciliation"
+	"fmt"
+)
+
+// beforeRunHookData is what EventTypeBeforeReconciliationRun hooks get to see.
+// Like with reports, sensitive action payload data (like initial passwords) is redacted.
+type beforeRunHookData struct {
+	Scope   string                        `json:"scope"`
+	UserId  *string                       `json:"userId"`
+	Actions []*reconciliation.StateAction `json:"actions"`
+}
+
+// afterUserHookData is what EventTypeAfterReconciliationUser hooks get to see
+type afterUserHookData struct {
+	UserId  string                        `json:"userId"`
+	Actions []*reconciliation.StateAction `json:"actions"`
+}
+
+// afterRunHookData is what EventTypeAfterReconciliationRun hooks get to see
+type afterRunHookData struct {
+	Report *reconciliation.RunReport `json:"report"`
+}
+
+// runBeforeRunHooks asks the hooks (if any) whether the run is allowed to perform the given actions.
+// An error is returned if a hook vetoes the run or fails (unless it has a contingency hook, see hook.Hook.RESTServiceContingencyHook).
+func (me *Reconciler) runBeforeRunHooks(policy *policy.Policy, runReport *reconciliation.RunReport, actions []*reconciliation.StateAction) error {
+	if me.hookExecutor == nil {
+		return nil
+	}
+
+	result := me.hookExecutor.RunAllMatchingType(policy.Hooks, hook.EventTypeBeforeReconciliationRun, beforeRunHookData{
+		Scope:   runReport.Scope,
+		UserId:  runReport.UserId,
+		Actions: reconciliation.RedactActions(actions),
+	}, me.logger.WithField("scope", runReport.Scope))
+
+	if result.ProcessingError != nil {
+		return fmt.Errorf("Failed executing hooks (%s): %s", hook.ListToChain(result.Hooks), result.ProcessingError)
+	}
+
+	if result.Rejected {
+		return fmt.Errorf("Reconciliation vetoed by hooks (%s): %s", hook.ListToChain(result.Hooks), result.RejectionErrorMessage)
+	}
+
+	return nil
+}
+
+// runAfterUserHooks tells the hooks (if any) about the actions performed for the given user.
+// There's nothing left to veto, so rejections and failures only get logged.
+func (me *Reconciler) runAfterUserHooks(policy *policy.Policy, userId string, actions []*reconciliation.StateAction) {
+	if me.hookExecutor == nil {
+		return
+	}
+
+	result := me.hookExecutor.RunAllMatchingType(policy.GetHooksForUserId(userId), hook.EventTypeAfterReconciliationUser, afterUserHookData{
+		UserId:  userId,
+		Actions: reconciliation.RedactActions(actions),
+	}, me.logger.WithField("userId", userId))
+
+	me.logIgnoredHookResult(result)
+}
+
+// runAfterRunHooks tells the hooks (if any) about how the run went (see reconciliation.RunReport).
+// Like with runAfterUserHooks, rejections and failures only get logged.
+func (me *Reconciler) runAfterRunHooks(policy *policy.Policy, runReport *reconciliation.RunReport) {
+	if me.hookExecutor == nil {
+		return
+	}
+
+	result := me.hookExecutor.RunAllMatchingType(policy.Hooks, hook.EventTypeAfterReconciliationRun, afterRunHookData{
+		Report: runReport,
+	}, me.logger.WithField("scope", runReport.Scope))
+
+	me.logIgnoredHookResult(result)
+}
+
+func (me *Reconciler) logIgnoredHookResult(result hook.ReconciliationExecutionResult) {
+	if result.ProcessingError != nil {
+		me.logger.Warnf("Ignoring failure of hooks (%s): %s", hook.ListToChain(result.Hooks), result.ProcessingError)
+	}
+
+	if result.Rejected {
+		me.logger.Warnf("Ignoring rejection by hooks (%s), as there's nothing left to veto: %s", hook.ListToChain(result.Hooks), result.RejectionErrorMessage)
+	}
+}
+
+// groupBatchActionsByUserId returns each user's actions (across all batches),
+// along with the ids of the users whose last actions are in each batch (by batch index).
+func groupBatchActionsByUserId(batches []*actionBatch) (map[string][]*reconciliation.StateAction, map[int][]string) {
+	userActions := map[string][]*reconciliation.StateAction{}
+	userLastBatchIndexes := map[string]int{}
+
+	for batchIndex, batch := range batches {
+		for _, lane := range batch.lanes {
+			userId := reconciliation.GetActionUserId(lane[0])
+			if userId == "" {
+				continue
+			}
+			userActions[userId] = append(userActions[userId], lane...)
+			userLastBatchIndexes[userId] = batchIndex
+		}
+	}
+
+	finishedUserIds := map[int][]string{}
+	for batchIndex, batch := range batches {
+		for _, lane := range batch.lanes {
+			userId := reconciliation.GetActionUserId(lane[0])
+			if userId != "" && userLastBatchIndexes[userId] == batchIndex {
+				finishedUserIds[batchIndex] = append(finishedUserIds[batchIndex], userId)
+			}
+		}
+	}
+
+	return userActions, finishedUserIds
+}
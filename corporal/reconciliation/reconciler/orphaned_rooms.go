@@ -0,0 +1,101 @@
+package reconciler
+
+import (
+	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/reconciliation"
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+)
+
+// determineOrphanedRoomIds returns the ids of the rooms, which were managed as of the last reconciliation run, but are no longer part of the policy.
+//
+// Upgraded rooms (see determineRoomSuccessorIds) are not considered orphaned, as their successors are managed in their place.
+func determineOrphanedRoomIds(recordedRoomIds []string, policy *policy.Policy, roomSuccessorIds map[string]string) []string {
+	var orphanedRoomIds []string
+	for _, roomId := range recordedRoomIds {
+		if util.IsStringInArray(roomId, policy.ManagedRoomIds) {
+			continue
+		}
+		if _, upgraded := roomSuccessorIds[roomId]; upgraded {
+			continue
+		}
+		orphanedRoomIds = append(orphanedRoomIds, roomId)
+	}
+	return orphanedRoomIds
+}
+
+// determineOrphanedRoomStates determines the current state (members and aliases) of orphaned rooms, which are to be archived
+// (see policy.OrphanedRoomModeArchive), as seen by the matrix-corporal user.
+//
+// Rooms that the matrix-corporal user can't see into (e.g. because it's not joined to them) only cause a warning,
+// as there's nothing we could do about them anyway.
+func (me *Reconciler) determineOrphanedRoomStates(ctx *connector.AccessTokenContext, currentState *connector.CurrentState, orphanedRooms *policy.OrphanedRooms) {
+	if currentState.ManagedRooms == nil || orphanedRooms == nil {
+		return
+	}
+
+	if orphanedRooms.Mode != policy.OrphanedRoomModeArchive || orphanedRooms.Delete {
+		// Nothing to kick or unlink
+		return
+	}
+
+	for _, roomId := range currentState.ManagedRooms.OrphanedRoomIds {
+		currentRoomState, err := me.determineOrphanedRoomState(ctx, roomId)
+		if err != nil {
+			me.logger.Warnf("Not archiving orphaned room %s, as its current state could not be determined: %s", roomId, err)
+			continue
+		}
+
+		currentState.Rooms = append(currentState.Rooms, *currentRoomState)
+	}
+}
+
+func (me *Reconciler) determineOrphanedRoomState(ctx *connector.AccessTokenContext, roomId string) (*connector.CurrentRoomState, error) {
+	currentRoomState, err := me.connector.DetermineCurrentRoomState(ctx, roomId, nil, me.reconciliatorUserId)
+	if err != nil {
+		return nil, err
+	}
+	currentRoomState.ActingUserId = me.reconciliatorUserId
+
+	currentRoomState.Members, err = me.connector.DetermineCurrentRoomMembers(ctx, roomId, me.reconciliatorUserId)
+	if err != nil {
+		return nil, fmt.Errorf("failed determining members: %s", err)
+	}
+
+	currentRoomState.Aliases, err = me.connector.GetRoomAliases(ctx, roomId, me.reconciliatorUserId)
+	if err != nil {
+		return nil, fmt.Errorf("failed determining aliases: %s", err)
+	}
+
+	return currentRoomState, nil
+}
+
+func (me *Reconciler) reconcileForActionRoomDelete(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	roomId, err := action.GetStringPayloadDataByKey("roomId")
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.DeleteRoom(ctx, roomId)
+	if err != nil {
+		return fmt.Errorf("Failed deleting %s: %s", roomId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionOrphanedRoomsSetManagedRooms(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	var roomIds []string
+	err := action.DecodePayloadDataByKey("roomIds", &roomIds)
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.StoreManagedRoomIds(ctx, me.reconciliatorUserId, roomIds)
+	if err != nil {
+		return fmt.Errorf("Failed recording the managed rooms: %s", err)
+	}
+
+	return nil
+}
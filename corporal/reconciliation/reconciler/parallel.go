@@ -0,0 +1,163 @@
+package reconciler
+
+import (
+	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/reconciliation"
+	"sync"
+)
+
+// actionBatch is a group of actions, which can be performed at the same time as long as each lane's actions are performed in order.
+// Each lane contains the actions for a single user.
+type actionBatch struct {
+	lanes [][]*reconciliation.StateAction
+}
+
+// splitActionsIntoBatches groups actions into batches, which are to be performed one after another.
+//
+// Consecutive user-scoped actions (see reconciliation.GetActionUserId) make up a batch, with a lane for each user.
+// Other actions (e.g. room creation, which users' actions may depend on) get a batch of their own,
+// so that they happen after everything before them and before everything after them.
+func splitActionsIntoBatches(actions []*reconciliation.StateAction) []*actionBatch {
+	batches := make([]*actionBatch, 0)
+
+	var currentBatch *actionBatch
+	var currentBatchLaneIndexes map[string]int
+
+	for _, action := range actions {
+		userId := reconciliation.GetActionUserId(action)
+
+		if userId == "" {
+			batches = append(batches, &actionBatch{
+				lanes: [][]*reconciliation.StateAction{{action}},
+			})
+			currentBatch = nil
+			continue
+		}
+
+		if currentBatch == nil {
+			currentBatch = &actionBatch{
+				lanes: make([][]*reconciliation.StateAction, 0),
+			}
+			currentBatchLaneIndexes = map[string]int{}
+			batches = append(batches, currentBatch)
+		}
+
+		laneIndex, exists := currentBatchLaneIndexes[userId]
+		if !exists {
+			laneIndex = len(currentBatch.lanes)
+			currentBatchLaneIndexes[userId] = laneIndex
+			currentBatch.lanes = append(currentBatch.lanes, make([]*reconciliation.StateAction, 0))
+		}
+		currentBatch.lanes[laneIndex] = append(currentBatch.lanes[laneIndex], action)
+	}
+
+	return batches
+}
+
+// executeBatch performs the batch's lanes using as many workers as the concurrency limiter allows.
+// Performed actions are reported to the checkpointer (if any).
+//
+// When an action fails, the rest of its lane is skipped and no new lanes get started.
+// Lanes which are already in progress are completed, after which the first error is returned.
+// Likewise, no new lanes get started while runs are paused and once they get cancelled (see runControl).
+//
+// The lanes of quarantined users are skipped, while lanes failing often enough to get their user quarantined
+// don't stop the others (see Reconciler.SetQuarantineThreshold).
+func (me *Reconciler) executeBatch(
+	ctx *connector.AccessTokenContext,
+	batch *actionBatch,
+	runReport *reconciliation.RunReport,
+	checkpointer *runCheckpointer,
+) error {
+	workers := me.concurrencyLimiter.GetWorkers()
+	if workers > len(batch.lanes) {
+		workers = len(batch.lanes)
+	}
+
+	var lock sync.Mutex
+	var firstErr error
+	nextLaneIndex := 0
+
+	takeLane := func() []*reconciliation.StateAction {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if firstErr != nil || nextLaneIndex == len(batch.lanes) {
+			return nil
+		}
+		lane := batch.lanes[nextLaneIndex]
+		nextLaneIndex++
+		return lane
+	}
+
+	recordErr := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+
+			for lane := takeLane(); lane != nil; lane = takeLane() {
+				// The lane's actions don't get performed (nor marked as such) when cancelled, so a checkpoint would still have them pending
+				err := me.runControl.waitUntilProceedable()
+				if err != nil {
+					recordErr(err)
+					return
+				}
+
+				userId := reconciliation.GetActionUserId(lane[0])
+				if me.isUserQuarantined(userId) {
+					me.logger.Warnf("Skipping %d actions for %s, as they're quarantined", len(lane), userId)
+					runReport.AddQuarantinedUserId(userId)
+					me.progressTracker.skipActions(runReport, len(lane))
+					continue
+				}
+
+				if userId != "" {
+					me.progressTracker.startUser(runReport, userId)
+				}
+
+				for actionIndex, action := range lane {
+					err := me.executeAction(ctx, action, runReport)
+					if err != nil {
+						if userId != "" && me.userQuarantine != nil && me.userQuarantine.recordFailure(userId, err) {
+							me.logger.Warnf("Quarantined %s, as reconciling them has failed too many times in a row: %s", userId, err)
+							runReport.AddQuarantinedUserId(userId)
+							me.progressTracker.skipActions(runReport, len(lane)-actionIndex-1)
+							break
+						}
+
+						recordErr(err)
+						break
+					}
+
+					if checkpointer != nil {
+						checkpointer.markPerformed(action)
+					}
+				}
+
+				if userId != "" {
+					me.progressTracker.finishUser(runReport, userId)
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	return firstErr
+}
+
+func newSequentialConcurrencyLimiter() *reconciliation.ConcurrencyLimiter {
+	// This can't fail, as there's a valid number of workers and no category limits
+	concurrencyLimiter, _ := reconciliation.NewConcurrencyLimiter(1, nil)
+	return concurrencyLimiter
+}
@@ -0,0 +1,210 @@
+package reconciler
+
+import (
+	"devture-matrix-corporal/corporal/reconciliation"
+	"sync"
+	"time"
+)
+
+const (
+	// progressRecentActionsCount is how many of the most recently completed actions RunProgress contains
+	progressRecentActionsCount = 20
+
+	// progressSubscriberBufferSize is how many progress updates can be waiting for each subscriber.
+	// Updates which don't fit (because a subscriber is too slow) get dropped.
+	progressSubscriberBufferSize = 64
+)
+
+// RunProgress describes how far along a reconciliation run (which performs actions) is
+type RunProgress struct {
+	Scope     string    `json:"scope"`
+	UserId    *string   `json:"userId"`
+	StartedAt time.Time `json:"startedAt"`
+
+	// Finished tells whether the run is over, in which case Success and Error tell how it went
+	Finished bool    `json:"finished"`
+	Success  bool    `json:"success"`
+	Error    *string `json:"error"`
+
+	TotalActions int `json:"totalActions"`
+
+	// CompletedActions counts the actions which have been performed, have failed or have been skipped (for quarantined users)
+	CompletedActions int `json:"completedActions"`
+
+	PercentComplete float64 `json:"percentComplete"`
+
+	// CurrentUserIds lists the users whose actions are being performed right now.
+	// There may be more than one, when actions are performed in parallel (see Reconciler.SetConcurrencyLimiter).
+	CurrentUserIds []string `json:"currentUserIds"`
+
+	// RecentActions lists the most recently completed actions (see progressRecentActionsCount), oldest first
+	RecentActions []*reconciliation.ActionRunReport `json:"recentActions"`
+}
+
+// runProgressTracker keeps track of the progress of the runs in progress, telling subscribers about each change (see Reconciler.SubscribeToProgress).
+// Runs are told apart by their run report.
+type runProgressTracker struct {
+	lock sync.Mutex
+
+	runs map[*reconciliation.RunReport]*RunProgress
+
+	subscribers map[chan RunProgress]bool
+}
+
+func newRunProgressTracker() *runProgressTracker {
+	return &runProgressTracker{
+		runs:        map[*reconciliation.RunReport]*RunProgress{},
+		subscribers: map[chan RunProgress]bool{},
+	}
+}
+
+// start begins tracking the run, which is about to perform the given number of actions
+func (me *runProgressTracker) start(runReport *reconciliation.RunReport, totalActions int) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	progress := &RunProgress{
+		Scope:          runReport.Scope,
+		UserId:         runReport.UserId,
+		StartedAt:      runReport.StartedAt,
+		TotalActions:   totalActions,
+		CurrentUserIds: []string{},
+		RecentActions:  []*reconciliation.ActionRunReport{},
+	}
+	me.runs[runReport] = progress
+
+	me.publish(progress)
+}
+
+// startUser records that the actions of the given user are being performed now
+func (me *runProgressTracker) startUser(runReport *reconciliation.RunReport, userId string) {
+	me.update(runReport, func(progress *RunProgress) {
+		progress.CurrentUserIds = append(progress.CurrentUserIds, userId)
+	})
+}
+
+// finishUser records that the actions of the given user are no longer being performed (successfully or not)
+func (me *runProgressTracker) finishUser(runReport *reconciliation.RunReport, userId string) {
+	me.update(runReport, func(progress *RunProgress) {
+		currentUserIds := make([]string, 0, len(progress.CurrentUserIds))
+		for _, currentUserId := range progress.CurrentUserIds {
+			if currentUserId != userId {
+				currentUserIds = append(currentUserIds, currentUserId)
+			}
+		}
+		progress.CurrentUserIds = currentUserIds
+	})
+}
+
+// completeAction records that the given action has been performed (or has failed)
+func (me *runProgressTracker) completeAction(runReport *reconciliation.RunReport, actionReport *reconciliation.ActionRunReport) {
+	me.update(runReport, func(progress *RunProgress) {
+		progress.CompletedActions++
+
+		progress.RecentActions = append(progress.RecentActions, actionReport)
+		if len(progress.RecentActions) > progressRecentActionsCount {
+			progress.RecentActions = progress.RecentActions[len(progress.RecentActions)-progressRecentActionsCount:]
+		}
+	})
+}
+
+// skipActions records that the given number of actions won't be performed (e.g. because their user is quarantined)
+func (me *runProgressTracker) skipActions(runReport *reconciliation.RunReport, count int) {
+	me.update(runReport, func(progress *RunProgress) {
+		progress.CompletedActions += count
+	})
+}
+
+// finish stops tracking the (completed) run. Runs which haven't been tracked (e.g. ones failing before performing actions) are ignored.
+func (me *runProgressTracker) finish(runReport *reconciliation.RunReport) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	progress, exists := me.runs[runReport]
+	if !exists {
+		return
+	}
+	delete(me.runs, runReport)
+
+	progress.Finished = true
+	progress.Success = runReport.Success
+	progress.Error = runReport.Error
+	progress.CurrentUserIds = []string{}
+
+	me.publish(progress)
+}
+
+// update changes the progress of the given run (if tracked) and tells subscribers about it
+func (me *runProgressTracker) update(runReport *reconciliation.RunReport, modifier func(progress *RunProgress)) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	progress, exists := me.runs[runReport]
+	if !exists {
+		return
+	}
+
+	modifier(progress)
+
+	me.publish(progress)
+}
+
+// publish hands a snapshot of the given progress to all subscribers, without waiting for slow ones. The lock needs to be held.
+func (me *runProgressTracker) publish(progress *RunProgress) {
+	snapshot := progress.snapshot()
+
+	for subscriber := range me.subscribers {
+		select {
+		case subscriber <- snapshot:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel delivering progress updates, which starts with the progress of the runs in progress (if any).
+// The returned function needs to be called to unsubscribe.
+func (me *runProgressTracker) subscribe() (<-chan RunProgress, func()) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	subscriber := make(chan RunProgress, progressSubscriberBufferSize)
+	for _, progress := range me.runs {
+		select {
+		case subscriber <- progress.snapshot():
+		default:
+		}
+	}
+	me.subscribers[subscriber] = true
+
+	unsubscribe := func() {
+		me.lock.Lock()
+		defer me.lock.Unlock()
+
+		delete(me.subscribers, subscriber)
+	}
+
+	return subscriber, unsubscribe
+}
+
+// snapshot returns a copy of the progress, which doesn't change along with it
+func (me *RunProgress) snapshot() RunProgress {
+	snapshot := *me
+
+	snapshot.CurrentUserIds = append([]string{}, me.CurrentUserIds...)
+	snapshot.RecentActions = append([]*reconciliation.ActionRunReport{}, me.RecentActions...)
+
+	if snapshot.TotalActions == 0 {
+		snapshot.PercentComplete = 100
+	} else {
+		snapshot.PercentComplete = float64(snapshot.CompletedActions) * 100 / float64(snapshot.TotalActions)
+	}
+
+	return snapshot
+}
+
+// SubscribeToProgress returns a channel delivering progress updates about runs performing actions (see RunProgress),
+// starting with the progress of the runs in progress (if any).
+// Updates get dropped for subscribers which don't keep up. The returned function needs to be called to unsubscribe.
+func (me *Reconciler) SubscribeToProgress() (<-chan RunProgress, func()) {
+	return me.progressTracker.subscribe()
+}
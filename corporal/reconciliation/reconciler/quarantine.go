@@ -0,0 +1,142 @@
+package reconciler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuarantinedUser describes a user whose actions get skipped, as reconciling them has failed too many times in a row (see SetQuarantineThreshold)
+type QuarantinedUser struct {
+	UserId string `json:"userId"`
+
+	// Failures tells how many runs in a row have failed to reconcile the user
+	Failures int `json:"failures"`
+
+	// LastError is the error that the user's last failing action has failed with
+	LastError string `json:"lastError"`
+
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+// userQuarantine keeps track of users whose actions keep failing, quarantining them after a number of failed runs in a row.
+//
+// This is in-memory only, so everything is forgotten (and quarantined users get released) when matrix-corporal restarts.
+type userQuarantine struct {
+	threshold int
+
+	lock        sync.Mutex
+	failures    map[string]int
+	quarantined map[string]*QuarantinedUser
+}
+
+func newUserQuarantine(threshold int) *userQuarantine {
+	return &userQuarantine{
+		threshold:   threshold,
+		failures:    map[string]int{},
+		quarantined: map[string]*QuarantinedUser{},
+	}
+}
+
+func (me *userQuarantine) isQuarantined(userId string) bool {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	_, exists := me.quarantined[userId]
+	return exists
+}
+
+// recordFailure records that a run has failed to reconcile the given user, telling whether this got the user quarantined
+func (me *userQuarantine) recordFailure(userId string, err error) bool {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.failures[userId]++
+	if me.failures[userId] < me.threshold {
+		return false
+	}
+
+	me.quarantined[userId] = &QuarantinedUser{
+		UserId:        userId,
+		Failures:      me.failures[userId],
+		LastError:     err.Error(),
+		QuarantinedAt: time.Now().UTC(),
+	}
+	delete(me.failures, userId)
+
+	return true
+}
+
+// recordSuccess records that a run has reconciled the given user, so that previous failures no longer count
+func (me *userQuarantine) recordSuccess(userId string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	delete(me.failures, userId)
+}
+
+func (me *userQuarantine) list() []QuarantinedUser {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	users := make([]QuarantinedUser, 0, len(me.quarantined))
+	for _, quarantinedUser := range me.quarantined {
+		users = append(users, *quarantinedUser)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserId < users[j].UserId
+	})
+
+	return users
+}
+
+// release takes the given user out of quarantine, telling whether they were quarantined
+func (me *userQuarantine) release(userId string) bool {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if _, exists := me.quarantined[userId]; !exists {
+		return false
+	}
+	delete(me.quarantined, userId)
+
+	return true
+}
+
+// SetQuarantineThreshold makes users whose actions have failed during this many runs in a row get quarantined:
+// their actions get skipped (instead of making runs fail), until they're released (see ReleaseQuarantinedUser).
+// The run which gets a user quarantined proceeds with the other users as well.
+//
+// Only the actions of individual users (see reconciliation.GetActionUserId) can get a user quarantined.
+// By default (zero), there's no quarantining and failing actions make runs fail.
+func (me *Reconciler) SetQuarantineThreshold(threshold int) {
+	me.userQuarantine = newUserQuarantine(threshold)
+}
+
+// isUserQuarantined tells whether the given user's actions are to be skipped (see SetQuarantineThreshold)
+func (me *Reconciler) isUserQuarantined(userId string) bool {
+	return me.userQuarantine != nil && userId != "" && me.userQuarantine.isQuarantined(userId)
+}
+
+// GetQuarantinedUsers returns the users which are quarantined (see SetQuarantineThreshold), sorted by user id
+func (me *Reconciler) GetQuarantinedUsers() []QuarantinedUser {
+	if me.userQuarantine == nil {
+		return []QuarantinedUser{}
+	}
+	return me.userQuarantine.list()
+}
+
+// ReleaseQuarantinedUser takes the given user out of quarantine (see SetQuarantineThreshold), telling whether they were quarantined.
+// The user's actions get performed again during subsequent runs.
+func (me *Reconciler) ReleaseQuarantinedUser(userId string) bool {
+	if me.userQuarantine == nil {
+		return false
+	}
+
+	released := me.userQuarantine.release(userId)
+	if released {
+		me.logger.Infof("Released %s from quarantine", userId)
+	}
+	return released
+}
@@ -3,21 +3,43 @@ package reconciler
 import (
 	"devture-matrix-corporal/corporal/avatar"
 	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/hook"
 	"devture-matrix-corporal/corporal/matrix"
 	"devture-matrix-corporal/corporal/policy"
 	"devture-matrix-corporal/corporal/reconciliation"
 	"devture-matrix-corporal/corporal/reconciliation/computator"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	deviceIdReconciler = "Matrix-Corporal-Reconciler"
+
+	// roomStateCacheTtl is how long the state of a room (fetched during a run) is reused for, before being fetched anew (see connector.RoomStateCache)
+	roomStateCacheTtl = 30 * time.Second
 )
 
 type ReconciliationHandlerFunc func(*connector.AccessTokenContext, *reconciliation.StateAction) error
 
+// DeclaredRoomIdsListener gets told about the rooms created for declared rooms (see policy.DeclaredRoom), by declared room key
+type DeclaredRoomIdsListener interface {
+	SetDeclaredRoomIds(declaredRoomIds map[string]string)
+}
+
+// RoomSuccessorIdsListener gets told about upgraded managed rooms, mapping the ids of upgraded rooms to the ids of their direct successors
+type RoomSuccessorIdsListener interface {
+	AddRoomSuccessorIds(roomSuccessorIds map[string]string)
+}
+
+// RemovedUserIdsListener gets told about users which have been removed from the policy, but still need to be deprovisioned
+// (see policy.Deprovisioning.IncludeRemovedUsers)
+type RemovedUserIdsListener interface {
+	AddRemovedUserIds(removedUserIds []string)
+}
+
 type Reconciler struct {
 	logger              *logrus.Logger
 	connector           connector.MatrixConnector
@@ -26,6 +48,50 @@ type Reconciler struct {
 	avatarReader        *avatar.AvatarReader
 
 	handlers map[string]ReconciliationHandlerFunc
+
+	// concurrencyLimiter controls how many actions are performed at the same time (see SetConcurrencyLimiter)
+	concurrencyLimiter *reconciliation.ConcurrencyLimiter
+
+	// serverNoticesUserId (if set) is left alone by account cleanup (see SetServerNoticesUserId)
+	serverNoticesUserId string
+
+	// runReporter (if set) gets a report after each reconciliation run (see SetRunReporter)
+	runReporter reconciliation.RunReporter
+
+	// checkpointInterval (if non-zero) makes full runs store checkpoints this often, so they can be resumed (see SetCheckpointInterval)
+	checkpointInterval time.Duration
+
+	// hookExecutor (if set) runs the policy's reconciliation hooks (see SetHookExecutor)
+	hookExecutor *hook.ReconciliationExecutor
+
+	// declaredRoomIdsListener (if set) gets told about declared rooms' ids (see SetDeclaredRoomIdsListener)
+	declaredRoomIdsListener DeclaredRoomIdsListener
+
+	// roomSuccessorIdsListener (if set) gets told about upgraded managed rooms (see SetRoomSuccessorIdsListener)
+	roomSuccessorIdsListener RoomSuccessorIdsListener
+
+	// removedUserIdsListener (if set) gets told about users removed from the policy (see SetRemovedUserIdsListener)
+	removedUserIdsListener RemovedUserIdsListener
+
+	// accessTokenStore (if set) persists the access tokens obtained for managed users (see SetAccessTokenStore)
+	accessTokenStore *connector.AccessTokenStore
+
+	// lockDeprovisioningState guards updates to the deprovisioning state (see updateDeprovisioningState),
+	// which actions for different users may be doing at the same time.
+	lockDeprovisioningState sync.Mutex
+
+	// avatarUploadCache is loaded on first use (see setUserAvatarFromUri) and guarded by lockAvatarUploadCache
+	avatarUploadCache     *connector.AvatarUploadCache
+	lockAvatarUploadCache sync.Mutex
+
+	// runControl lets runs be paused, resumed and cancelled (see PauseRuns, ResumeRuns and CancelRuns)
+	runControl *runControl
+
+	// userQuarantine (if set) keeps track of users whose actions keep failing (see SetQuarantineThreshold)
+	userQuarantine *userQuarantine
+
+	// progressTracker keeps track of how far along runs are (see SubscribeToProgress)
+	progressTracker *runProgressTracker
 }
 
 func New(
@@ -41,24 +107,130 @@ func New(
 		computator:          computator,
 		reconciliatorUserId: reconciliatorUserId,
 		avatarReader:        avatarReader,
+
+		concurrencyLimiter: newSequentialConcurrencyLimiter(),
+
+		runControl: newRunControl(logger),
+
+		progressTracker: newRunProgressTracker(),
 	}
 
 	me.handlers = map[string]ReconciliationHandlerFunc{
 		reconciliation.ActionUserCreate:         me.reconcileForActionUserCreate,
 		reconciliation.ActionUserSetDisplayName: me.reconcileForActionUserSetDisplayName,
 		reconciliation.ActionUserSetAvatar:      me.reconcileForActionUserSetAvatar,
+		reconciliation.ActionUserSetServerAdmin: me.reconcileForActionUserSetServerAdmin,
+		reconciliation.ActionUserSetUserType:    me.reconcileForActionUserSetUserType,
 		reconciliation.ActionUserActivate:       me.reconcileForActionUserActivate,
 		reconciliation.ActionUserDeactivate:     me.reconcileForActionUserDeactivate,
+		reconciliation.ActionUserLogout:         me.reconcileForActionUserLogout,
+		reconciliation.ActionUserErase:          me.reconcileForActionUserErase,
+
+		reconciliation.ActionUserSetShadowBanned: me.reconcileForActionUserSetShadowBanned,
+
+		reconciliation.ActionUserDeactivateAccount: me.reconcileForActionUserDeactivateAccount,
+
+		reconciliation.ActionUserAddThreePid:    me.reconcileForActionUserAddThreePid,
+		reconciliation.ActionUserRemoveThreePid: me.reconcileForActionUserRemoveThreePid,
+
+		reconciliation.ActionUserSendServerNotice: me.reconcileForActionUserSendServerNotice,
+
+		reconciliation.ActionUserSetPushRule:    me.reconcileForActionUserSetPushRule,
+		reconciliation.ActionUserDeletePushRule: me.reconcileForActionUserDeletePushRule,
+
+		reconciliation.ActionUserSetAccountData: me.reconcileForActionUserSetAccountData,
+
+		reconciliation.ActionUserDeleteDevices: me.reconcileForActionUserDeleteDevices,
+
+		reconciliation.ActionUserCopyProfile: me.reconcileForActionUserCopyProfile,
 
 		reconciliation.ActionRoomJoin:  me.reconcileForActionRoomJoin,
 		reconciliation.ActionRoomLeave: me.reconcileForActionRoomLeave,
+		reconciliation.ActionRoomKick:  me.reconcileForActionRoomKick,
+
+		reconciliation.ActionRoomAutoJoin: me.reconcileForActionRoomAutoJoin,
+
+		reconciliation.ActionRoomSetState:               me.reconcileForActionRoomSetState,
+		reconciliation.ActionRoomSetDirectoryVisibility: me.reconcileForActionRoomSetDirectoryVisibility,
+		reconciliation.ActionRoomCreateAlias:            me.reconcileForActionRoomCreateAlias,
+		reconciliation.ActionRoomDeleteAlias:            me.reconcileForActionRoomDeleteAlias,
+
+		reconciliation.ActionRoomCreate: me.reconcileForActionRoomCreate,
+		reconciliation.ActionRoomDelete: me.reconcileForActionRoomDelete,
+
+		reconciliation.ActionDeprovisioningSetManagedUsers: me.reconcileForActionDeprovisioningSetManagedUsers,
+
+		reconciliation.ActionOrphanedRoomsSetManagedRooms: me.reconcileForActionOrphanedRoomsSetManagedRooms,
+
+		reconciliation.ActionUserIdMigrationComplete: me.reconcileForActionUserIdMigrationComplete,
 	}
 
 	return me
 }
 
+// SetConcurrencyLimiter makes actions for different users get performed in parallel, within the given limits.
+// By default, all actions are performed one at a time.
+func (me *Reconciler) SetConcurrencyLimiter(concurrencyLimiter *reconciliation.ConcurrencyLimiter) {
+	me.concurrencyLimiter = concurrencyLimiter
+}
+
+// SetServerNoticesUserId tells which user the homeserver sends server notices as, so that account cleanup leaves it alone (see policy.AccountCleanup).
+// This is to be called before any reconciliation runs.
+func (me *Reconciler) SetServerNoticesUserId(serverNoticesUserId string) {
+	me.serverNoticesUserId = serverNoticesUserId
+}
+
+// SetRunReporter makes a report get delivered to the given reporter after each reconciliation run
+func (me *Reconciler) SetRunReporter(runReporter reconciliation.RunReporter) {
+	me.runReporter = runReporter
+}
+
+// SetCheckpointInterval makes full reconciliation runs keep track of their progress (storing it at most this often),
+// so that a run interrupted by a restart (or crash) gets resumed, instead of started over (see connector.ReconciliationCheckpoint).
+// By default (zero), there's no checkpointing.
+func (me *Reconciler) SetCheckpointInterval(checkpointInterval time.Duration) {
+	me.checkpointInterval = checkpointInterval
+}
+
+// SetHookExecutor makes the policy's reconciliation hooks (see hook.EventTypeBeforeReconciliationRun, etc.) run with the given executor.
+// Without one, such hooks are ignored.
+func (me *Reconciler) SetHookExecutor(hookExecutor *hook.ReconciliationExecutor) {
+	me.hookExecutor = hookExecutor
+}
+
+// SetDeclaredRoomIdsListener makes the given listener get told about the ids of declared rooms,
+// both when they're determined (at the start of each reconciliation run) and when new rooms get created.
+func (me *Reconciler) SetDeclaredRoomIdsListener(declaredRoomIdsListener DeclaredRoomIdsListener) {
+	me.declaredRoomIdsListener = declaredRoomIdsListener
+}
+
+// SetRoomSuccessorIdsListener makes the given listener get told about upgraded managed rooms,
+// as found out (by following tombstones) at the start of each reconciliation run.
+func (me *Reconciler) SetRoomSuccessorIdsListener(roomSuccessorIdsListener RoomSuccessorIdsListener) {
+	me.roomSuccessorIdsListener = roomSuccessorIdsListener
+}
+
+// SetRemovedUserIdsListener makes the given listener get told about users which have been removed from the policy,
+// but still need to be deprovisioned, as found out at the start of each reconciliation run.
+func (me *Reconciler) SetRemovedUserIdsListener(removedUserIdsListener RemovedUserIdsListener) {
+	me.removedUserIdsListener = removedUserIdsListener
+}
+
+// SetAccessTokenStore makes the access tokens obtained for managed users be persisted to the given store (see connector.AccessTokenContext.SetAccessTokenStore),
+// so that subsequent runs (even after a restart) can reuse them, for as long as they're valid.
+func (me *Reconciler) SetAccessTokenStore(accessTokenStore *connector.AccessTokenStore) {
+	me.accessTokenStore = accessTokenStore
+}
+
 func (me *Reconciler) Reconcile(policy *policy.Policy) error {
-	// We clean up tokens after ourselves, but it's good to specify some validity anyway.
+	runReport := reconciliation.NewRunReport("", false)
+	err := me.reconcile(policy, runReport)
+	me.reportRun(policy, runReport, err)
+	return err
+}
+
+func (me *Reconciler) reconcile(policy *policy.Policy, runReport *reconciliation.RunReport) error {
+	// We clean up tokens after ourselves (unless they're persisted, see SetAccessTokenStore), but it's good to specify some validity anyway.
 	// Even if reconciliation takes longer than the validity, it likely wouldn't be a problem,
 	// because the token context checks validity times and gives us a fresh token if it encounters an expired one.
 	//
@@ -66,38 +238,486 @@ func (me *Reconciler) Reconcile(policy *policy.Policy) error {
 	tokenValiditySeconds := 12 * 60
 
 	ctx := connector.NewAccessTokenContext(me.connector, deviceIdReconciler, tokenValiditySeconds)
+	ctx.SetRoomStateCache(connector.NewRoomStateCache(roomStateCacheTtl))
+	ctx.SetAccessTokenStore(me.accessTokenStore)
+	defer ctx.Release()
+
+	me.runControl.begin()
+	defer me.runControl.end()
+
+	if me.checkpointInterval != 0 {
+		return me.reconcileWithCheckpoints(ctx, policy, runReport)
+	}
+
+	reconciliationState, err := me.computeReconciliationState(ctx, policy, false)
+	if err != nil {
+		return err
+	}
+
+	return me.executeActions(ctx, policy, reconciliationState.Actions, runReport, nil)
+}
+
+// DryRun computes the actions that Reconcile would take for the given policy, without executing any of them.
+//
+// Only the current state gets read from the homeserver, using admin APIs (see newDryRunAccessTokenContext).
+// Nothing gets changed, not even what the listeners keep track of (see prepareRun).
+func (me *Reconciler) DryRun(policy *policy.Policy) (*reconciliation.Report, error) {
+	ctx := me.newDryRunAccessTokenContext()
+	defer ctx.Release()
+
+	reconciliationState, err := me.computeReconciliationState(ctx, policy, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return reconciliation.NewReport(reconciliationState.Actions, true), nil
+}
+
+// DryRunUser is like DryRun, but only for the given (managed) user (see ReconcileUser).
+func (me *Reconciler) DryRunUser(policy *policy.Policy, userId string) (*reconciliation.Report, error) {
+	ctx := me.newDryRunAccessTokenContext()
 	defer ctx.Release()
 
-	currentState, err := me.connector.DetermineCurrentState(ctx, policy.GetManagedUserIds(), me.reconciliatorUserId)
+	reconciliationState, err := me.computeUserReconciliationState(ctx, policy, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return reconciliation.NewReport(reconciliationState.Actions, true), nil
+}
+
+// newDryRunAccessTokenContext creates a read-only context (see connector.AccessTokenContext.SetReadOnly) for dry runs.
+// Logging in as users would create devices for them, so the connector determines the current state using admin APIs instead.
+func (me *Reconciler) newDryRunAccessTokenContext() *connector.AccessTokenContext {
+	ctx := connector.NewAccessTokenContext(me.connector, deviceIdReconciler, 0)
+	ctx.SetRoomStateCache(connector.NewRoomStateCache(roomStateCacheTtl))
+	ctx.SetReadOnly()
+	return ctx
+}
+
+// computeReconciliationState determines the current state and computes the actions which reconcile it with the policy.
+// For dry runs, the listeners don't get told about anything (see prepareRun).
+func (me *Reconciler) computeReconciliationState(ctx *connector.AccessTokenContext, policy *policy.Policy, dryRun bool) (*reconciliation.State, error) {
+	preparation, err := me.prepareRun(ctx, policy, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	policy = preparation.policy
+
+	stateUserIds := determineStateUserIds(policy, preparation.userIdMigrationState)
+
+	currentState, err := me.connector.DetermineCurrentState(ctx, stateUserIds, me.reconciliatorUserId)
+	if err != nil {
+		return nil, fmt.Errorf("Failure determining current state: %s", err)
+	}
+	currentState.Deprovisioning = preparation.deprovisioningState
+	currentState.DeclaredRoomIds = preparation.declaredRoomIds
+	currentState.UserIdMigrations = preparation.userIdMigrationState
+	currentState.ManagedRooms = preparation.managedRoomsState
+
+	if policy.IsAccountCleanupEnabled() {
+		// Exemptions (see policy.AccountCleanup) are up to the computator, but our own user (and the server notices one) is something only we know about
+		knownUserIds := append(stateUserIds, me.reconciliatorUserId)
+		if me.serverNoticesUserId != "" {
+			knownUserIds = append(knownUserIds, me.serverNoticesUserId)
+		}
+
+		currentState.UnmanagedUsers, err = me.connector.DetermineUnmanagedUsers(ctx, knownUserIds, me.reconciliatorUserId)
+		if err != nil {
+			return nil, fmt.Errorf("Failure determining unmanaged users: %s", err)
+		}
+	}
+
+	err = me.determineCurrentUserSettings(ctx, currentState, policy)
 	if err != nil {
-		return fmt.Errorf("Failure determining current state: %s", err)
+		return nil, err
+	}
+
+	for _, roomId := range policy.ManagedRoomIds {
+		roomPolicy := policy.GetEffectiveRoomPolicy(roomId)
+
+		keyedStateEventTypes := policy.GetHierarchyStateEventTypes(roomPolicy)
+
+		stateEventTypes := roomPolicy.GetEnforcedStateEventTypes()
+		if len(stateEventTypes) == 0 && !roomPolicy.ExclusiveMembership && len(keyedStateEventTypes) == 0 &&
+			roomPolicy.DirectoryVisibility == "" && roomPolicy.Aliases == nil {
+			continue
+		}
+
+		actingUserId := roomPolicy.GetActingUserId(me.reconciliatorUserId)
+
+		currentRoomState, err := me.connector.DetermineCurrentRoomState(ctx, roomId, stateEventTypes, actingUserId)
+		if err != nil {
+			return nil, fmt.Errorf("Failure determining current state for room %s: %s", roomId, err)
+		}
+		currentRoomState.ActingUserId = actingUserId
+
+		if roomPolicy.ExclusiveMembership {
+			currentRoomState.Members, err = me.connector.DetermineCurrentRoomMembers(ctx, roomId, actingUserId)
+			if err != nil {
+				return nil, fmt.Errorf("Failure determining current members for room %s: %s", roomId, err)
+			}
+		}
+
+		if len(keyedStateEventTypes) != 0 {
+			currentRoomState.KeyedStateEventContents, err = me.connector.DetermineCurrentKeyedRoomState(ctx, roomId, keyedStateEventTypes, actingUserId)
+			if err != nil {
+				return nil, fmt.Errorf("Failure determining current keyed state for room %s: %s", roomId, err)
+			}
+		}
+
+		if roomPolicy.DirectoryVisibility != "" {
+			currentRoomState.DirectoryVisibility, err = me.connector.GetRoomDirectoryVisibility(ctx, roomId, actingUserId)
+			if err != nil {
+				return nil, fmt.Errorf("Failure determining current directory visibility for room %s: %s", roomId, err)
+			}
+		}
+
+		if roomPolicy.Aliases != nil {
+			currentRoomState.Aliases, err = me.connector.GetRoomAliases(ctx, roomId, actingUserId)
+			if err != nil {
+				return nil, fmt.Errorf("Failure determining current aliases for room %s: %s", roomId, err)
+			}
+		}
+
+		currentState.Rooms = append(currentState.Rooms, *currentRoomState)
+	}
+
+	me.determineOrphanedRoomStates(ctx, currentState, policy.OrphanedRooms)
+
+	return me.computator.Compute(currentState, policy)
+}
+
+// runPreparation is what a full run finds out (see prepareRun), before determining the current state
+type runPreparation struct {
+	// policy is the policy to reconcile, with removed users retained and room upgrades and user id migrations resolved
+	policy *policy.Policy
+
+	deprovisioningState *connector.DeprovisioningState
+
+	declaredRoomIds map[string]string
+
+	userIdMigrationState *connector.UserIdMigrationState
+
+	managedRoomsState *connector.ManagedRoomsState
+}
+
+// prepareRun determines what's been recorded during previous runs (deprovisioning state, declared rooms, user id migrations, managed rooms)
+// and which managed rooms got upgraded, telling the listeners about it and resolving the policy accordingly.
+//
+// For dry runs, the listeners are not told about anything, as they'd persist it (e.g. in the policy store) as if a real run had happened.
+func (me *Reconciler) prepareRun(ctx *connector.AccessTokenContext, policy *policy.Policy, dryRun bool) (*runPreparation, error) {
+	preparation := &runPreparation{}
+
+	if len(policy.UserIdMigrations) != 0 {
+		var err error
+		preparation.userIdMigrationState, err = me.connector.GetUserIdMigrationState(ctx, me.reconciliatorUserId)
+		if err != nil {
+			return nil, fmt.Errorf("Failure determining user id migration state: %s", err)
+		}
+
+		resolvedPolicy := policy.WithUserIdMigrationsResolved()
+		policy = &resolvedPolicy
+	}
+
+	if policy.IsDeprovisioningTracked() {
+		var err error
+		preparation.deprovisioningState, err = me.connector.GetDeprovisioningState(ctx, me.reconciliatorUserId)
+		if err != nil {
+			return nil, fmt.Errorf("Failure determining deprovisioning state: %s", err)
+		}
+	}
+
+	if policy.AreRemovedUsersDeprovisioned() {
+		removedUserIds := determineRemovedUserIds(preparation.deprovisioningState, policy)
+		if len(removedUserIds) != 0 {
+			if me.removedUserIdsListener != nil && !dryRun {
+				me.removedUserIdsListener.AddRemovedUserIds(removedUserIds)
+			}
+
+			// Deprovisioning removed users right away, instead of during the next run
+			resolvedPolicy := policy.WithRemovedUsersRetained(removedUserIds)
+			policy = &resolvedPolicy
+		}
+	}
+
+	if len(policy.DeclaredRooms) != 0 {
+		var err error
+		preparation.declaredRoomIds, err = me.connector.GetDeclaredRoomIds(ctx, me.reconciliatorUserId)
+		if err != nil {
+			return nil, fmt.Errorf("Failure determining declared room ids: %s", err)
+		}
+
+		if me.declaredRoomIdsListener != nil && !dryRun {
+			me.declaredRoomIdsListener.SetDeclaredRoomIds(preparation.declaredRoomIds)
+		}
+	}
+
+	roomSuccessorIds := me.determineRoomSuccessorIds(ctx, policy)
+	if len(roomSuccessorIds) != 0 {
+		if me.roomSuccessorIdsListener != nil && !dryRun {
+			me.roomSuccessorIdsListener.AddRoomSuccessorIds(roomSuccessorIds)
+		}
+
+		// Reconciling against the successor rooms right away, instead of against their dead predecessors
+		resolvedPolicy := policy.WithRoomUpgradesResolved(roomSuccessorIds)
+		policy = &resolvedPolicy
+	}
+
+	if policy.IsOrphanedRoomHandlingEnabled() {
+		recordedRoomIds, err := me.connector.GetManagedRoomIds(ctx, me.reconciliatorUserId)
+		if err != nil {
+			return nil, fmt.Errorf("Failure determining recorded managed room ids: %s", err)
+		}
+
+		preparation.managedRoomsState = &connector.ManagedRoomsState{
+			RecordedRoomIds: recordedRoomIds,
+			OrphanedRoomIds: determineOrphanedRoomIds(recordedRoomIds, policy, roomSuccessorIds),
+		}
+	}
+
+	preparation.policy = policy
+
+	return preparation, nil
+}
+
+// determineRoomSuccessorIds checks the managed rooms for tombstones (following them to successor rooms, which may have been upgraded too)
+// and returns the direct successor of each upgraded room.
+//
+// Rooms whose state the acting user (see policy.RoomPolicy.GetActingUserId) can't see are not checked.
+func (me *Reconciler) determineRoomSuccessorIds(ctx *connector.AccessTokenContext, policy *policy.Policy) map[string]string {
+	roomSuccessorIds := map[string]string{}
+	checkedRoomIds := map[string]bool{}
+
+	for _, managedRoomId := range policy.ManagedRoomIds {
+		actingUserId := policy.GetEffectiveRoomPolicy(managedRoomId).GetActingUserId(me.reconciliatorUserId)
+
+		roomId := managedRoomId
+		for !checkedRoomIds[roomId] {
+			checkedRoomIds[roomId] = true
+
+			currentRoomState, err := me.connector.DetermineCurrentRoomState(ctx, roomId, tombstoneStateEventTypes, actingUserId)
+			if err != nil {
+				me.logger.Debugf("Cannot check room %s for upgrades as %s: %s", roomId, actingUserId, err)
+				break
+			}
+
+			successorRoomId := getTombstoneReplacementRoomId(currentRoomState)
+			if successorRoomId == "" {
+				break
+			}
+
+			me.logger.Infof("Room %s has been upgraded to %s", roomId, successorRoomId)
+			roomSuccessorIds[roomId] = successorRoomId
+			roomId = successorRoomId
+		}
 	}
 
-	reconciliationState, err := me.computator.Compute(currentState, policy)
+	return roomSuccessorIds
+}
+
+// tombstoneStateEventTypes is what's fetched when checking a room for upgrades
+var tombstoneStateEventTypes = []string{policy.RoomStateEventTypeTombstone}
+
+// pushRuleIdPrefix is what the ids of managed push rules start with
+const pushRuleIdPrefix = policy.PushRuleIdPrefix
+
+func getTombstoneReplacementRoomId(currentRoomState *connector.CurrentRoomState) string {
+	return policy.GetTombstoneReplacementRoomId(currentRoomState.GetStateEventContent(policy.RoomStateEventTypeTombstone))
+}
+
+// ReconcileUser is like Reconcile, but only reconciles the given (managed) user.
+// This is much cheaper than reconciling everything, when only a single user's policy has changed.
+//
+// The returned report describes what was done (even if reconciliation fails).
+func (me *Reconciler) ReconcileUser(policy *policy.Policy, userId string) (*reconciliation.RunReport, error) {
+	runReport := reconciliation.NewRunReport(userId, false)
+	err := me.reconcileUser(policy, userId, runReport)
+	me.reportRun(policy, runReport, err)
+	return runReport, err
+}
+
+func (me *Reconciler) reconcileUser(policy *policy.Policy, userId string, runReport *reconciliation.RunReport) error {
+	tokenValiditySeconds := 12 * 60
+
+	ctx := connector.NewAccessTokenContext(me.connector, deviceIdReconciler, tokenValiditySeconds)
+	ctx.SetRoomStateCache(connector.NewRoomStateCache(roomStateCacheTtl))
+	ctx.SetAccessTokenStore(me.accessTokenStore)
+	defer ctx.Release()
+
+	me.runControl.begin()
+	defer me.runControl.end()
+
+	reconciliationState, err := me.computeUserReconciliationState(ctx, policy, userId)
 	if err != nil {
 		return err
 	}
 
-	for _, action := range reconciliationState.Actions {
-		logger := me.logger.WithField("action", action.Type)
-		logger = logger.WithFields(logrus.Fields(action.Payload))
+	return me.executeActions(ctx, policy, reconciliationState.Actions, runReport, nil)
+}
 
-		handlerFunc, exists := me.handlers[action.Type]
-		if !exists {
-			err = fmt.Errorf("Missing reconciliation handler")
-			logger.Errorf(err.Error())
-			return err
+func (me *Reconciler) computeUserReconciliationState(
+	ctx *connector.AccessTokenContext,
+	policy *policy.Policy,
+	userId string,
+) (*reconciliation.State, error) {
+	currentState, err := me.connector.DetermineCurrentState(ctx, []string{userId}, me.reconciliatorUserId)
+	if err != nil {
+		return nil, fmt.Errorf("Failure determining current state: %s", err)
+	}
+
+	if policy.IsDeprovisioningTracked() {
+		currentState.Deprovisioning, err = me.connector.GetDeprovisioningState(ctx, me.reconciliatorUserId)
+		if err != nil {
+			return nil, fmt.Errorf("Failure determining deprovisioning state: %s", err)
+		}
+	}
+
+	err = me.determineCurrentUserSettings(ctx, currentState, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return me.computator.ComputeForUser(currentState, policy, userId)
+}
+
+// determineCurrentUserSettings fetches those settings of the (existing, active) users, which their policy manages:
+// managed push rules (see policy.PushRuleIdPrefix), account data of the declared types (see policy.UserPolicy.AccountData)
+// and devices (when idle ones get deleted, see policy.Policy.GetMaxDeviceIdleDuration).
+func (me *Reconciler) determineCurrentUserSettings(ctx *connector.AccessTokenContext, currentState *connector.CurrentState, policy *policy.Policy) error {
+	for idx, currentUserState := range currentState.Users {
+		if !currentUserState.Active || currentUserState.ServerDeactivated {
+			continue
 		}
 
-		err = handlerFunc(ctx, action)
+		userPolicy := policy.GetUserPolicyByUserId(currentUserState.Id)
+		if userPolicy == nil || !userPolicy.IsActive() {
+			continue
+		}
+
+		if userPolicy.PushRules != nil {
+			pushRules, err := me.connector.DetermineCurrentPushRules(ctx, currentUserState.Id, pushRuleIdPrefix)
+			if err != nil {
+				return fmt.Errorf("Failure determining current push rules for %s: %s", currentUserState.Id, err)
+			}
+			currentState.Users[idx].PushRules = pushRules
+		}
+
+		for _, accountData := range userPolicy.AccountData {
+			content, err := me.connector.GetUserAccountData(ctx, currentUserState.Id, accountData.RoomId, accountData.Type)
+			if err != nil {
+				return fmt.Errorf("Failure determining current account data (%s) for %s: %s", accountData.Type, currentUserState.Id, err)
+			}
+			currentState.Users[idx].AccountData = append(currentState.Users[idx].AccountData, connector.CurrentUserAccountData{
+				Type:    accountData.Type,
+				RoomId:  accountData.RoomId,
+				Content: content,
+			})
+		}
+
+		if policy.GetMaxDeviceIdleDuration(userPolicy) != 0 {
+			devices, err := me.connector.DetermineCurrentDevices(ctx, currentUserState.Id)
+			if err != nil {
+				return fmt.Errorf("Failure determining current devices for %s: %s", currentUserState.Id, err)
+			}
+
+			// Our own device (see deviceIdReconciler) is in use right now and should not be touched
+			currentState.Users[idx].Devices = make([]connector.CurrentUserDevice, 0, len(devices))
+			for _, device := range devices {
+				if device.Id != deviceIdReconciler {
+					currentState.Users[idx].Devices = append(currentState.Users[idx].Devices, device)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// reportRun completes the run report and hands it over to the hooks and the run reporter (if any)
+func (me *Reconciler) reportRun(policy *policy.Policy, runReport *reconciliation.RunReport, err error) {
+	runReport.Finish(err)
+
+	me.progressTracker.finish(runReport)
+
+	me.runAfterRunHooks(policy, runReport)
+
+	if me.runReporter == nil {
+		return
+	}
+
+	me.runReporter.ReportRun(runReport)
+}
+
+func (me *Reconciler) executeActions(
+	ctx *connector.AccessTokenContext,
+	policy *policy.Policy,
+	actions []*reconciliation.StateAction,
+	runReport *reconciliation.RunReport,
+	checkpointer *runCheckpointer,
+) error {
+	err := me.runBeforeRunHooks(policy, runReport, actions)
+	if err != nil {
+		return err
+	}
+
+	me.progressTracker.start(runReport, len(actions))
+
+	batches := splitActionsIntoBatches(actions)
+	userActions, finishedUserIds := groupBatchActionsByUserId(batches)
+
+	for batchIndex, batch := range batches {
+		err := me.executeBatch(ctx, batch, runReport, checkpointer)
 		if err != nil {
-			err = fmt.Errorf("Failed reconciliation handler: %s", err)
-			logger.Errorf(err.Error())
 			return err
 		}
 
-		logger.Infof("Completed reconciliation handler")
+		for _, userId := range finishedUserIds[batchIndex] {
+			if me.isUserQuarantined(userId) {
+				// Their actions have been skipped (at least partially), so there's nothing to tell about
+				continue
+			}
+
+			if me.userQuarantine != nil {
+				me.userQuarantine.recordSuccess(userId)
+			}
+
+			me.runAfterUserHooks(policy, userId, userActions[userId])
+		}
+	}
+
+	return nil
+}
+
+func (me *Reconciler) executeAction(
+	ctx *connector.AccessTokenContext,
+	action *reconciliation.StateAction,
+	runReport *reconciliation.RunReport,
+) error {
+	logger := me.logger.WithField("action", action.Type)
+	logger = logger.WithFields(logrus.Fields(action.Payload))
+
+	handlerFunc, exists := me.handlers[action.Type]
+	if !exists {
+		err := fmt.Errorf("Missing reconciliation handler")
+		logger.Errorf(err.Error())
+		me.progressTracker.completeAction(runReport, runReport.AddAction(action, reconciliation.ActionStatusFailed, err, 0))
+		return err
+	}
+
+	startedAt := time.Now()
+	err := me.concurrencyLimiter.Run(reconciliation.GetActionApiCategory(action.Type), func() error {
+		return handlerFunc(ctx, action)
+	})
+	if err != nil {
+		err = fmt.Errorf("Failed reconciliation handler: %s", err)
+		logger.Errorf(err.Error())
+		me.progressTracker.completeAction(runReport, runReport.AddAction(action, reconciliation.ActionStatusFailed, err, time.Since(startedAt)))
+		return err
 	}
+	me.progressTracker.completeAction(runReport, runReport.AddAction(action, reconciliation.ActionStatusPerformed, nil, time.Since(startedAt)))
+
+	logger.Infof("Completed reconciliation handler")
 
 	return nil
 }
@@ -113,7 +733,12 @@ func (me *Reconciler) reconcileForActionUserCreate(ctx *connector.AccessTokenCon
 		return err
 	}
 
-	err = me.connector.EnsureUserAccountExists(userId, password)
+	userType, err := action.GetOptionalStringPayloadDataByKey("userType", "")
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.EnsureUserAccountExists(userId, password, userType)
 	if err != nil {
 		return fmt.Errorf("Failed ensuring %s is created: %s", userId, err)
 	}
@@ -151,6 +776,15 @@ func (me *Reconciler) reconcileForActionUserSetAvatar(ctx *connector.AccessToken
 		return err
 	}
 
+	if avatarUri != "" {
+		err = me.setUserAvatarFromUri(ctx, userId, avatarUri)
+		if err != nil {
+			return fmt.Errorf("Failed setting user avatar for %s: %s", userId, err)
+		}
+		return nil
+	}
+
+	// Avatar removal
 	avatar, err := me.avatarReader.Read(avatarUri)
 	if err != nil {
 		return fmt.Errorf("Failed reading user avatar from %s: %s", avatarUri, err)
@@ -164,44 +798,316 @@ func (me *Reconciler) reconcileForActionUserSetAvatar(ctx *connector.AccessToken
 	return nil
 }
 
-func (me *Reconciler) reconcileForActionUserActivate(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+func (me *Reconciler) reconcileForActionUserSetServerAdmin(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
 	userId, err := action.GetStringPayloadDataByKey("userId")
 	if err != nil {
 		return err
 	}
 
-	userProfile, err := me.connector.GetUserProfileByUserId(ctx, userId)
-	if err != nil {
-		return fmt.Errorf("Failed retrieving user profile: %s", err)
-	}
-
-	if !matrix.IsUserDeactivatedAccordingToDisplayName(userProfile.DisplayName) {
-		// Already done. Nothing to do.
-		return nil
+	admin, ok := action.Payload["admin"].(bool)
+	if !ok {
+		return fmt.Errorf("Failed casting payload data for: admin")
 	}
 
-	newDisplayName := matrix.CleanDeactivationMarkerFromDisplayName(userProfile.DisplayName)
-
-	err = me.connector.SetUserDisplayName(ctx, userId, newDisplayName)
+	err = me.connector.SetUserServerAdmin(ctx, userId, admin)
 	if err != nil {
-		return fmt.Errorf("Failed setting display name (%s) for %s: %s", newDisplayName, userId, err)
+		return fmt.Errorf("Failed setting the server admin status (%t) of %s: %s", admin, userId, err)
 	}
 
 	return nil
 }
 
-func (me *Reconciler) reconcileForActionUserDeactivate(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+func (me *Reconciler) reconcileForActionUserSetUserType(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
 	userId, err := action.GetStringPayloadDataByKey("userId")
 	if err != nil {
 		return err
 	}
 
-	userProfile, err := me.connector.GetUserProfileByUserId(ctx, userId)
+	userType, err := action.GetOptionalStringPayloadDataByKey("userType", "")
 	if err != nil {
-		return fmt.Errorf("Failed retrieving user profile: %s", err)
+		return err
 	}
 
-	err = me.connector.LogoutAllAccessTokensForUser(ctx, userId)
+	err = me.connector.SetUserType(ctx, userId, userType)
+	if err != nil {
+		return fmt.Errorf("Failed setting the user type (%s) of %s: %s", userType, userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserSetShadowBanned(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	shadowBanned, ok := action.Payload["shadowBanned"].(bool)
+	if !ok {
+		return fmt.Errorf("Failed casting payload data for: shadowBanned")
+	}
+
+	err = me.connector.SetUserShadowBanned(ctx, userId, shadowBanned)
+	if err != nil {
+		return fmt.Errorf("Failed setting the shadow-ban status (%t) of %s: %s", shadowBanned, userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserActivate(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	userProfile, err := me.connector.GetUserProfileByUserId(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("Failed retrieving user profile: %s", err)
+	}
+
+	if matrix.IsUserDeactivatedAccordingToDisplayName(userProfile.DisplayName) {
+		newDisplayName := matrix.CleanDeactivationMarkerFromDisplayName(userProfile.DisplayName)
+
+		err = me.connector.SetUserDisplayName(ctx, userId, newDisplayName)
+		if err != nil {
+			return fmt.Errorf("Failed setting display name (%s) for %s: %s", newDisplayName, userId, err)
+		}
+	}
+
+	if clearDeprovisioning, _ := action.Payload["clearDeprovisioning"].(bool); clearDeprovisioning {
+		err = me.updateDeprovisioningState(ctx, func(deprovisioningState *connector.DeprovisioningState) {
+			delete(deprovisioningState.DeprovisionedAt, userId)
+		})
+		if err != nil {
+			return fmt.Errorf("Failed clearing the deprovisioning record of %s: %s", userId, err)
+		}
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserAddThreePid(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	medium, err := action.GetStringPayloadDataByKey("medium")
+	if err != nil {
+		return err
+	}
+
+	address, err := action.GetStringPayloadDataByKey("address")
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.AddThreePid(ctx, userId, medium, address)
+	if err != nil {
+		return fmt.Errorf("Failed adding 3pid (%s, %s) to %s: %s", medium, address, userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserRemoveThreePid(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	medium, err := action.GetStringPayloadDataByKey("medium")
+	if err != nil {
+		return err
+	}
+
+	address, err := action.GetStringPayloadDataByKey("address")
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.RemoveThreePid(ctx, userId, medium, address)
+	if err != nil {
+		return fmt.Errorf("Failed removing 3pid (%s, %s) from %s: %s", medium, address, userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserSendServerNotice(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	// Lifecycle notices about one-time changes have no id (see policy.LifecycleNotices)
+	noticeId, err := action.GetOptionalStringPayloadDataByKey("noticeId", "")
+	if err != nil {
+		return err
+	}
+
+	message, err := action.GetStringPayloadDataByKey("message")
+	if err != nil {
+		return err
+	}
+
+	// Some lifecycle notices get sent as direct messages instead (see policy.LifecycleNotice.SenderUserId)
+	senderUserId, err := action.GetOptionalStringPayloadDataByKey("senderUserId", "")
+	if err != nil {
+		return err
+	}
+
+	if senderUserId != "" {
+		err = me.connector.SendDirectMessage(ctx, senderUserId, userId, noticeId, message)
+		if err != nil {
+			return fmt.Errorf("Failed sending direct message (%s) from %s to %s: %s", noticeId, senderUserId, userId, err)
+		}
+		return nil
+	}
+
+	err = me.connector.SendServerNotice(ctx, userId, noticeId, message)
+	if err != nil {
+		return fmt.Errorf("Failed sending server notice (%s) to %s: %s", noticeId, userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserSetPushRule(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	kind, err := action.GetStringPayloadDataByKey("kind")
+	if err != nil {
+		return err
+	}
+
+	ruleId, err := action.GetStringPayloadDataByKey("ruleId")
+	if err != nil {
+		return err
+	}
+
+	pattern, err := action.GetOptionalStringPayloadDataByKey("pattern", "")
+	if err != nil {
+		return err
+	}
+
+	actions, ok := action.Payload["actions"].([]interface{})
+	if !ok {
+		return fmt.Errorf("Failed casting payload data for: actions")
+	}
+
+	// Conditions are optional
+	var conditions []map[string]interface{}
+	if _, exists := action.Payload["conditions"]; exists {
+		err = action.DecodePayloadDataByKey("conditions", &conditions)
+		if err != nil {
+			return err
+		}
+	}
+
+	rule := &matrix.ApiPushRuleRequest{
+		Actions:    actions,
+		Conditions: conditions,
+		Pattern:    pattern,
+	}
+
+	err = me.connector.SetPushRule(ctx, userId, kind, ruleId, rule)
+	if err != nil {
+		return fmt.Errorf("Failed setting push rule (%s, %s) for %s: %s", kind, ruleId, userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserDeletePushRule(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	kind, err := action.GetStringPayloadDataByKey("kind")
+	if err != nil {
+		return err
+	}
+
+	ruleId, err := action.GetStringPayloadDataByKey("ruleId")
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.DeletePushRule(ctx, userId, kind, ruleId)
+	if err != nil {
+		return fmt.Errorf("Failed deleting push rule (%s, %s) of %s: %s", kind, ruleId, userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserSetAccountData(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	roomId, err := action.GetOptionalStringPayloadDataByKey("roomId", "")
+	if err != nil {
+		return err
+	}
+
+	accountDataType, err := action.GetStringPayloadDataByKey("type")
+	if err != nil {
+		return err
+	}
+
+	content, ok := action.Payload["content"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Failed casting payload data for: content")
+	}
+
+	err = me.connector.SetUserAccountData(ctx, userId, roomId, accountDataType, content)
+	if err != nil {
+		return fmt.Errorf("Failed setting account data (%s) for %s: %s", accountDataType, userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserDeleteDevices(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	var deviceIds []string
+	err = action.DecodePayloadDataByKey("deviceIds", &deviceIds)
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.DeleteDevices(ctx, userId, deviceIds)
+	if err != nil {
+		return fmt.Errorf("Failed deleting %d idle devices of %s: %s", len(deviceIds), userId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserDeactivate(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	userProfile, err := me.connector.GetUserProfileByUserId(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("Failed retrieving user profile: %s", err)
+	}
+
+	err = me.connector.LogoutAllAccessTokensForUser(ctx, userId)
 	if err != nil {
 		return fmt.Errorf("Failed logging out all access tokens: %s", err)
 	}
@@ -218,7 +1124,7 @@ func (me *Reconciler) reconcileForActionUserDeactivate(ctx *connector.AccessToke
 		}
 	}
 
-	return nil
+	return me.recordUserDeprovisioningIfRequested(ctx, action, userId)
 }
 
 func (me *Reconciler) reconcileForActionRoomJoin(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
@@ -232,7 +1138,13 @@ func (me *Reconciler) reconcileForActionRoomJoin(ctx *connector.AccessTokenConte
 		return err
 	}
 
-	err = me.connector.InviteUserToRoom(ctx, me.reconciliatorUserId, userId, roomId)
+	// Rooms with a steward (see policy.RoomPolicy.StewardUserId) get invites sent by it
+	inviterUserId, err := action.GetOptionalStringPayloadDataByKey("inviterUserId", me.reconciliatorUserId)
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.InviteUserToRoom(ctx, inviterUserId, userId, roomId)
 	if err != nil {
 		return err
 	}
@@ -240,6 +1152,26 @@ func (me *Reconciler) reconcileForActionRoomJoin(ctx *connector.AccessTokenConte
 	return me.connector.JoinRoom(ctx, userId, roomId)
 }
 
+func (me *Reconciler) reconcileForActionRoomAutoJoin(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	// This may also be a room alias (see policy.Policy.AutoJoinRooms)
+	room, err := action.GetStringPayloadDataByKey("room")
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.ForceJoinRoom(ctx, userId, room)
+	if err != nil {
+		return fmt.Errorf("Failed auto-joining %s to %s: %s", userId, room, err)
+	}
+
+	return nil
+}
+
 func (me *Reconciler) reconcileForActionRoomLeave(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
 	userId, err := action.GetStringPayloadDataByKey("userId")
 	if err != nil {
@@ -253,3 +1185,205 @@ func (me *Reconciler) reconcileForActionRoomLeave(ctx *connector.AccessTokenCont
 
 	return me.connector.LeaveRoom(ctx, userId, roomId)
 }
+
+func (me *Reconciler) reconcileForActionRoomKick(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	roomId, err := action.GetStringPayloadDataByKey("roomId")
+	if err != nil {
+		return err
+	}
+
+	actorUserId, err := action.GetOptionalStringPayloadDataByKey("actorUserId", me.reconciliatorUserId)
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.KickUserFromRoom(ctx, actorUserId, userId, roomId)
+	if err != nil {
+		return fmt.Errorf("Failed kicking %s from %s: %s", userId, roomId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionRoomSetState(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	roomId, err := action.GetStringPayloadDataByKey("roomId")
+	if err != nil {
+		return err
+	}
+
+	eventType, err := action.GetStringPayloadDataByKey("eventType")
+	if err != nil {
+		return err
+	}
+
+	content, err := action.GetMapPayloadDataByKey("content")
+	if err != nil {
+		return err
+	}
+
+	actorUserId, err := action.GetOptionalStringPayloadDataByKey("actorUserId", me.reconciliatorUserId)
+	if err != nil {
+		return err
+	}
+
+	stateKey, err := action.GetOptionalStringPayloadDataByKey("stateKey", "")
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.SetRoomState(ctx, actorUserId, roomId, eventType, stateKey, content)
+	if err != nil {
+		return fmt.Errorf("Failed setting %s state in %s: %s", eventType, roomId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionRoomSetDirectoryVisibility(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	roomId, err := action.GetStringPayloadDataByKey("roomId")
+	if err != nil {
+		return err
+	}
+
+	visibility, err := action.GetStringPayloadDataByKey("visibility")
+	if err != nil {
+		return err
+	}
+
+	actorUserId, err := action.GetOptionalStringPayloadDataByKey("actorUserId", me.reconciliatorUserId)
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.SetRoomDirectoryVisibility(ctx, actorUserId, roomId, visibility)
+	if err != nil {
+		return fmt.Errorf("Failed setting the directory visibility (%s) of %s: %s", visibility, roomId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionRoomCreateAlias(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	roomId, err := action.GetStringPayloadDataByKey("roomId")
+	if err != nil {
+		return err
+	}
+
+	alias, err := action.GetStringPayloadDataByKey("alias")
+	if err != nil {
+		return err
+	}
+
+	actorUserId, err := action.GetOptionalStringPayloadDataByKey("actorUserId", me.reconciliatorUserId)
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.CreateRoomAlias(ctx, actorUserId, roomId, alias)
+	if err != nil {
+		return fmt.Errorf("Failed creating alias %s for %s (it may already point to another room): %s", alias, roomId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionRoomDeleteAlias(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	roomId, err := action.GetStringPayloadDataByKey("roomId")
+	if err != nil {
+		return err
+	}
+
+	alias, err := action.GetStringPayloadDataByKey("alias")
+	if err != nil {
+		return err
+	}
+
+	actorUserId, err := action.GetOptionalStringPayloadDataByKey("actorUserId", me.reconciliatorUserId)
+	if err != nil {
+		return err
+	}
+
+	err = me.connector.DeleteRoomAlias(ctx, actorUserId, alias)
+	if err != nil {
+		return fmt.Errorf("Failed deleting alias %s of %s: %s", alias, roomId, err)
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionRoomCreate(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	key, err := action.GetStringPayloadDataByKey("key")
+	if err != nil {
+		return err
+	}
+
+	creatorUserId, err := action.GetOptionalStringPayloadDataByKey("creatorUserId", me.reconciliatorUserId)
+	if err != nil {
+		return err
+	}
+
+	request := &connector.CreateRoomRequest{}
+	for payloadKey, field := range map[string]*string{
+		"alias":       &request.RoomAliasName,
+		"name":        &request.Name,
+		"topic":       &request.Topic,
+		"preset":      &request.Preset,
+		"roomVersion": &request.RoomVersion,
+	} {
+		*field, err = action.GetOptionalStringPayloadDataByKey(payloadKey, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	if space, _ := action.Payload["space"].(bool); space {
+		request.CreationContent = map[string]interface{}{"type": "m.space"}
+	}
+
+	if _, exists := action.Payload["initialState"]; exists {
+		err = action.DecodePayloadDataByKey("initialState", &request.InitialState)
+		if err != nil {
+			return err
+		}
+	}
+
+	var roomAvatar *avatar.Avatar
+	avatarUri, err := action.GetOptionalStringPayloadDataByKey("avatarUri", "")
+	if err != nil {
+		return err
+	}
+	if avatarUri != "" {
+		roomAvatar, err = me.avatarReader.Read(avatarUri)
+		if err != nil {
+			return fmt.Errorf("Failed reading room avatar from %s: %s", avatarUri, err)
+		}
+	}
+
+	roomId, err := me.connector.CreateRoom(ctx, creatorUserId, request, roomAvatar)
+	if err != nil {
+		return fmt.Errorf("Failed creating declared room %s: %s", key, err)
+	}
+
+	me.logger.Infof("Created declared room %s: %s", key, roomId)
+
+	err = me.connector.StoreDeclaredRoomId(ctx, me.reconciliatorUserId, key, roomId)
+	if err != nil {
+		// Subsequent runs would create another room, so the room id needs to be recorded manually.
+		return fmt.Errorf("Failed recording the id (%s) of created declared room %s: %s", roomId, key, err)
+	}
+
+	if me.declaredRoomIdsListener != nil {
+		declaredRoomIds, err := me.connector.GetDeclaredRoomIds(ctx, me.reconciliatorUserId)
+		if err != nil {
+			return fmt.Errorf("Failure determining declared room ids: %s", err)
+		}
+		me.declaredRoomIdsListener.SetDeclaredRoomIds(declaredRoomIds)
+	}
+
+	return nil
+}
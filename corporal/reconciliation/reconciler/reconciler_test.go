@@ -0,0 +1,230 @@
+package reconciler
+
+import (
+	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/reconciliation/computator"
+	"devture-matrix-corporal/corporal/util"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testReconciliatorUserId = "@matrix-corporal:example.com"
+
+// dryRunTestConnector serves what a run preparation reads (recorded deprovisioning state, declared rooms and a room upgrade).
+// Calling anything else panics (as the embedded connector is nil), which also covers nothing being changed.
+type dryRunTestConnector struct {
+	connector.MatrixConnector
+
+	t *testing.T
+
+	obtainedAccessTokens int
+
+	// unmanagedUsersKnownUserIds are the known users that unmanaged users were last determined with
+	unmanagedUsersKnownUserIds []string
+}
+
+func (me *dryRunTestConnector) checkReadOnly(ctx *connector.AccessTokenContext) {
+	if !ctx.IsReadOnly() {
+		me.t.Errorf("expected a read-only access token context")
+	}
+}
+
+func (me *dryRunTestConnector) ObtainNewAccessTokenForUserId(userId, deviceId string, validUntil *time.Time) (string, error) {
+	me.obtainedAccessTokens++
+	return "", fmt.Errorf("not expected to log in as %s", userId)
+}
+
+func (me *dryRunTestConnector) GetDeprovisioningState(ctx *connector.AccessTokenContext, userId string) (*connector.DeprovisioningState, error) {
+	me.checkReadOnly(ctx)
+	deprovisioningState := connector.NewDeprovisioningState()
+	deprovisioningState.ManagedUserIds = []string{"@a:example.com", "@removed:example.com"}
+	return deprovisioningState, nil
+}
+
+func (me *dryRunTestConnector) GetDeclaredRoomIds(ctx *connector.AccessTokenContext, userId string) (map[string]string, error) {
+	me.checkReadOnly(ctx)
+	return map[string]string{"lobby": "!lobby:example.com"}, nil
+}
+
+func (me *dryRunTestConnector) DetermineCurrentRoomState(ctx *connector.AccessTokenContext, roomId string, stateEventTypes []string, adminUserId string) (*connector.CurrentRoomState, error) {
+	me.checkReadOnly(ctx)
+
+	roomState := &connector.CurrentRoomState{
+		Id:                 roomId,
+		StateEventContents: map[string]map[string]interface{}{},
+	}
+	if roomId == "!old:example.com" {
+		roomState.StateEventContents[policy.RoomStateEventTypeTombstone] = map[string]interface{}{"replacement_room": "!new:example.com"}
+	}
+	return roomState, nil
+}
+
+func (me *dryRunTestConnector) DetermineCurrentState(ctx *connector.AccessTokenContext, managedUserIds []string, adminUserId string) (*connector.CurrentState, error) {
+	me.checkReadOnly(ctx)
+	return &connector.CurrentState{
+		Users: []connector.CurrentUserState{
+			{Id: "@a:example.com", Active: true, JoinedRoomIds: []string{}},
+		},
+	}, nil
+}
+
+func (me *dryRunTestConnector) DetermineUnmanagedUsers(ctx *connector.AccessTokenContext, knownUserIds []string, adminUserId string) ([]connector.CurrentUnmanagedUserState, error) {
+	me.checkReadOnly(ctx)
+	me.unmanagedUsersKnownUserIds = knownUserIds
+	return []connector.CurrentUnmanagedUserState{}, nil
+}
+
+// recordingListener records what it's told about, before passing it on to the policy store
+type recordingListener struct {
+	*policy.Store
+
+	calls []string
+}
+
+func (me *recordingListener) SetDeclaredRoomIds(declaredRoomIds map[string]string) {
+	me.calls = append(me.calls, "SetDeclaredRoomIds")
+	me.Store.SetDeclaredRoomIds(declaredRoomIds)
+}
+
+func (me *recordingListener) AddRoomSuccessorIds(roomSuccessorIds map[string]string) {
+	me.calls = append(me.calls, "AddRoomSuccessorIds")
+	me.Store.AddRoomSuccessorIds(roomSuccessorIds)
+}
+
+func (me *recordingListener) AddRemovedUserIds(removedUserIds []string) {
+	me.calls = append(me.calls, "AddRemovedUserIds")
+	me.Store.AddRemovedUserIds(removedUserIds)
+}
+
+func TestDryRunDoesNotTouchListenersOrLogIn(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	signatureVerifier, err := policy.NewSignatureVerifier(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	currentPolicy, err := policy.NewParser(signatureVerifier).Parse([]byte(`{
+		"schemaVersion": 1,
+		"deprovisioning": {"includeRemovedUsers": true},
+		"declaredRooms": [{"key": "lobby", "name": "Lobby"}],
+		"managedRoomIds": ["!old:example.com", "declared:lobby"],
+		"users": [{"id": "@a:example.com", "active": true, "authType": "plain", "authCredential": "secret"}]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	history, err := policy.NewHistory(logger, 0, "", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store := policy.NewStore(logger, policy.NewValidator("example.com"), history)
+	err = store.Set(currentPolicy, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	storedPolicy := store.Get()
+
+	testConnector := &dryRunTestConnector{t: t}
+	listener := &recordingListener{Store: store}
+
+	reconciler := New(logger, testConnector, computator.NewReconciliationStateComputator(logger), testReconciliatorUserId, nil)
+	reconciler.SetDeclaredRoomIdsListener(listener)
+	reconciler.SetRoomSuccessorIdsListener(listener)
+	reconciler.SetRemovedUserIdsListener(listener)
+
+	_, err = reconciler.DryRun(store.Get())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = reconciler.DryRunUser(store.Get(), "@a:example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(listener.calls) != 0 {
+		t.Errorf("expected no listener calls during dry runs, got: %v", listener.calls)
+	}
+	if store.Get() != storedPolicy {
+		t.Errorf("expected the stored policy to be left alone during dry runs")
+	}
+	if testConnector.obtainedAccessTokens != 0 {
+		t.Errorf("expected no access tokens to be obtained during dry runs, got %d", testConnector.obtainedAccessTokens)
+	}
+
+	// Preparing a real run (with the same connector) does tell the listeners, which is what the dry runs above must have skipped
+	ctx := reconciler.newDryRunAccessTokenContext()
+	_, err = reconciler.prepareRun(ctx, store.Get(), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(listener.calls) != 3 {
+		t.Errorf("expected all listeners to be told about things during real runs, got: %v", listener.calls)
+	}
+	if store.Get() == storedPolicy {
+		t.Errorf("expected the stored policy to be resolved anew during real runs")
+	}
+}
+
+func TestReadOnlyAccessTokenContextRefusesToObtainAccessTokens(t *testing.T) {
+	testConnector := &dryRunTestConnector{t: t}
+
+	ctx := connector.NewAccessTokenContext(testConnector, deviceIdReconciler, 0)
+	ctx.SetReadOnly()
+
+	_, err := ctx.GetAccessTokenForUserId("@a:example.com")
+	if err != connector.ErrReadOnlyAccessTokenContext {
+		t.Errorf("expected ErrReadOnlyAccessTokenContext, got: %v", err)
+	}
+
+	_, err = ctx.RefreshAccessTokenForUserId("@a:example.com", "invalid")
+	if err != connector.ErrReadOnlyAccessTokenContext {
+		t.Errorf("expected ErrReadOnlyAccessTokenContext, got: %v", err)
+	}
+
+	if testConnector.obtainedAccessTokens != 0 {
+		t.Errorf("expected no access tokens to be obtained, got %d", testConnector.obtainedAccessTokens)
+	}
+}
+
+func TestAccountCleanupLeavesOurUsersAlone(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	signatureVerifier, err := policy.NewSignatureVerifier(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	currentPolicy, err := policy.NewParser(signatureVerifier).Parse([]byte(`{
+		"schemaVersion": 1,
+		"accountCleanup": {"deactivateUnmanagedUsers": true},
+		"users": [{"id": "@a:example.com", "active": true, "authType": "plain", "authCredential": "secret"}]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	testConnector := &dryRunTestConnector{t: t}
+
+	reconciler := New(logger, testConnector, computator.NewReconciliationStateComputator(logger), testReconciliatorUserId, nil)
+	reconciler.SetServerNoticesUserId("@notices:example.com")
+
+	_, err = reconciler.DryRun(currentPolicy)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Known users are not among the unmanaged ones, so they never get deactivated
+	for _, userId := range []string{"@a:example.com", testReconciliatorUserId, "@notices:example.com"} {
+		if !util.IsStringInArray(userId, testConnector.unmanagedUsersKnownUserIds) {
+			t.Errorf("expected %s to be known when determining unmanaged users, got: %v", userId, testConnector.unmanagedUsersKnownUserIds)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package reconciler
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errRunCancelled is what runs which got cancelled (see Reconciler.CancelRuns) fail with
+var errRunCancelled = fmt.Errorf("reconciliation run cancelled")
+
+// RunControlStatus describes whether reconciliation is paused and whether a run is in progress
+type RunControlStatus struct {
+	Paused     bool `json:"paused"`
+	InProgress bool `json:"inProgress"`
+}
+
+// runControl lets runs be paused, resumed and cancelled from the outside (e.g. via the HTTP API).
+//
+// Runs only get paused (or cancelled) in between users: before starting the actions of the next user (see actionBatch lanes).
+// Actions which are already in progress (and the rest of the current user's actions) are completed first.
+type runControl struct {
+	logger *logrus.Logger
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	paused         bool
+	cancelled      bool
+	runsInProgress int
+}
+
+func newRunControl(logger *logrus.Logger) *runControl {
+	me := &runControl{
+		logger: logger,
+	}
+	me.cond = sync.NewCond(&me.lock)
+	return me
+}
+
+// begin marks a run as being in progress. It needs to be followed by end.
+func (me *runControl) begin() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.runsInProgress++
+}
+
+// end marks a run as no longer in progress. Cancellation only applies to runs in progress, so it gets cleared once they're all over.
+func (me *runControl) end() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.runsInProgress--
+	if me.runsInProgress == 0 {
+		me.cancelled = false
+	}
+}
+
+// waitUntilProceedable blocks for as long as runs are paused.
+// errRunCancelled is returned if runs get cancelled (before or while waiting).
+func (me *runControl) waitUntilProceedable() error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if me.paused && !me.cancelled {
+		me.logger.Infof("Reconciliation is paused, waiting for it to be resumed or cancelled..")
+	}
+
+	for me.paused && !me.cancelled {
+		me.cond.Wait()
+	}
+
+	if me.cancelled {
+		return errRunCancelled
+	}
+
+	return nil
+}
+
+func (me *runControl) pause() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.paused = true
+}
+
+func (me *runControl) resume() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.paused = false
+	me.cond.Broadcast()
+}
+
+// cancel cancels the runs in progress (if any), telling whether there were any
+func (me *runControl) cancel() bool {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if me.runsInProgress == 0 {
+		return false
+	}
+
+	me.cancelled = true
+	me.cond.Broadcast()
+
+	return true
+}
+
+func (me *runControl) getStatus() RunControlStatus {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return RunControlStatus{
+		Paused:     me.paused,
+		InProgress: me.runsInProgress != 0,
+	}
+}
+
+// PauseRuns makes runs (the one in progress, if any, and any subsequent ones) wait before proceeding with the next user,
+// until resumed (see ResumeRuns) or cancelled (see CancelRuns).
+func (me *Reconciler) PauseRuns() {
+	me.runControl.pause()
+	me.logger.Infof("Reconciliation paused")
+}
+
+// ResumeRuns lets paused runs (see PauseRuns) proceed
+func (me *Reconciler) ResumeRuns() {
+	me.runControl.resume()
+	me.logger.Infof("Reconciliation resumed")
+}
+
+// CancelRuns makes the runs in progress stop before proceeding with the next user (even if paused), telling whether there were any.
+//
+// Cancelled runs fail (and are not retried), but keep their checkpoint (if checkpointing is enabled, see SetCheckpointInterval),
+// so that the next run for the same policy resumes from where they stopped.
+func (me *Reconciler) CancelRuns() bool {
+	cancelled := me.runControl.cancel()
+	if cancelled {
+		me.logger.Infof("Reconciliation cancelled")
+	}
+	return cancelled
+}
+
+// GetRunControlStatus tells whether reconciliation is paused and whether a run is in progress
+func (me *Reconciler) GetRunControlStatus() RunControlStatus {
+	return me.runControl.getStatus()
+}
@@ -2,6 +2,8 @@ package reconciler
 
 import (
 	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/reconciliation"
+	"fmt"
 	"sync"
 	"time"
 
@@ -14,6 +16,20 @@ type StoreDrivenReconciler struct {
 	reconciler                *Reconciler
 	retryIntervalMilliseconds int
 
+	// dryRun makes policy changes only get reported (see Reconciler.DryRun), instead of reconciled
+	dryRun bool
+
+	// reconcileOnPolicyLoad tells whether policies received from the store get reconciled (see SetReconcileOnPolicyLoad)
+	reconcileOnPolicyLoad bool
+
+	// schedule (if set) makes full reconciliation happen periodically (see SetSchedule)
+	schedule       *reconciliation.Schedule
+	scheduleCancel chan bool
+
+	// driftDetectionSchedule (if set) makes drift detection happen periodically (see SetDriftDetectionSchedule)
+	driftDetectionSchedule       *reconciliation.Schedule
+	driftDetectionScheduleCancel chan bool
+
 	lockReconciler sync.Mutex
 	channel        chan *policy.Policy
 	retryTicker    *time.Ticker
@@ -25,21 +41,61 @@ func NewStoreDrivenReconciler(
 	store *policy.Store,
 	reconciler *Reconciler,
 	retryIntervalMilliseconds int,
+	dryRun bool,
 ) *StoreDrivenReconciler {
 	return &StoreDrivenReconciler{
 		logger:                    logger,
 		store:                     store,
 		reconciler:                reconciler,
 		retryIntervalMilliseconds: retryIntervalMilliseconds,
+		dryRun:                    dryRun,
+
+		reconcileOnPolicyLoad: true,
 	}
 }
 
+// SetReconcileOnPolicyLoad controls whether new policies (and policy changes) get reconciled as soon as the store receives them.
+// Disabling this is useful for very large deployments, which only reconcile on a schedule (see SetSchedule).
+func (me *StoreDrivenReconciler) SetReconcileOnPolicyLoad(enabled bool) {
+	me.reconcileOnPolicyLoad = enabled
+}
+
+// SetSchedule makes a full reconciliation of the current policy happen whenever the given schedule fires
+func (me *StoreDrivenReconciler) SetSchedule(schedule *reconciliation.Schedule) {
+	me.schedule = schedule
+}
+
+// SetDriftDetectionSchedule makes the current policy get compared to the homeserver's state whenever the given schedule fires,
+// reporting how they differ (see reconciliation.Drift) without correcting anything (even when not in dry-run mode).
+func (me *StoreDrivenReconciler) SetDriftDetectionSchedule(schedule *reconciliation.Schedule) {
+	me.driftDetectionSchedule = schedule
+}
+
 func (me *StoreDrivenReconciler) Start() error {
 	me.channel = me.store.GetNotificationChannel()
 
 	go me.listenOnChannel(me.channel)
 
-	me.logger.Infof("Started store-driven reconciler")
+	if me.schedule != nil {
+		// Buffered signalling channel, so we can avoid getting stuck if the scheduler had exited
+		me.scheduleCancel = make(chan bool, 1)
+		go me.runSchedule(me.schedule, me.scheduleCancel, "reconciliation", me.reconcileWithRetries)
+	}
+
+	if me.driftDetectionSchedule != nil {
+		me.driftDetectionScheduleCancel = make(chan bool, 1)
+		go me.runSchedule(me.driftDetectionSchedule, me.driftDetectionScheduleCancel, "drift detection", me.detectDrift)
+	}
+
+	if !me.reconcileOnPolicyLoad {
+		me.logger.Warnf("Reconciliation on policy load is disabled. Policy changes will only be reconciled on schedule")
+	}
+
+	if me.dryRun {
+		me.logger.Warnf("Started store-driven reconciler in dry-run mode. Policy changes will only be reported, not reconciled")
+	} else {
+		me.logger.Infof("Started store-driven reconciler")
+	}
 
 	return nil
 }
@@ -47,9 +103,56 @@ func (me *StoreDrivenReconciler) Start() error {
 func (me *StoreDrivenReconciler) Stop() {
 	me.store.DestroyNotificationChannel(me.channel)
 
+	if me.scheduleCancel != nil {
+		me.scheduleCancel <- true
+	}
+
+	if me.driftDetectionScheduleCancel != nil {
+		me.driftDetectionScheduleCancel <- true
+	}
+
 	me.logger.Infof("Stopped store-driven reconciler")
 }
 
+// ReconcileUser reconciles a single user against the current policy.
+// It's meant to be used after modifying the policy in the store without notifying listeners (see policy.Store.Modify),
+// or for reconciling a user right away (instead of waiting for the next full reconciliation).
+//
+// Unless there's no policy yet, a report describing what was done (or planned, in dry-run mode) is returned, even if reconciliation fails.
+func (me *StoreDrivenReconciler) ReconcileUser(userId string) (*reconciliation.RunReport, error) {
+	policy := me.store.Get()
+	if policy == nil {
+		return nil, fmt.Errorf("there is no policy yet")
+	}
+
+	me.lockReconciler.Lock()
+	defer me.lockReconciler.Unlock()
+
+	me.logger.Infof("Reconciling user %s..", userId)
+
+	var runReport *reconciliation.RunReport
+	var err error
+	if me.dryRun {
+		runReport = reconciliation.NewRunReport(userId, true)
+		var report *reconciliation.Report
+		report, err = me.reconciler.DryRunUser(policy, userId)
+		if err == nil {
+			me.logDryRunReport(report, runReport)
+		}
+		me.reconciler.reportRun(policy, runReport, err)
+	} else {
+		runReport, err = me.reconciler.ReconcileUser(policy, userId)
+	}
+	if err != nil {
+		me.logger.Warnf("Reconciliation for user %s failed: %s", userId, err)
+		return runReport, err
+	}
+
+	me.logger.Infof("Reconciliation for user %s completed", userId)
+
+	return runReport, nil
+}
+
 func (me *StoreDrivenReconciler) listenOnChannel(channel chan *policy.Policy) {
 	for {
 		policy, more := <-channel
@@ -60,38 +163,112 @@ func (me *StoreDrivenReconciler) listenOnChannel(channel chan *policy.Policy) {
 
 		me.logger.Infof("Store-driven reconciler received a new policy from the store")
 
-		me.lockReconciler.Lock()
+		if !me.reconcileOnPolicyLoad {
+			me.logger.Infof("Not reconciling the new policy, as reconciliation on policy load is disabled")
+			continue
+		}
 
-		// We may still be potentially retrying some old policy.
-		// Let's stop that and attempt to load the new one below.
-		if me.retryTicker != nil {
-			me.retryTicker.Stop()
-			me.retryCancel <- true
+		me.reconcileWithRetries(policy)
+	}
+}
 
-			me.retryTicker = nil
-			me.retryCancel = nil
+// runSchedule runs the given function for the current policy whenever the schedule fires, until cancelled
+func (me *StoreDrivenReconciler) runSchedule(schedule *reconciliation.Schedule, cancel chan bool, name string, run func(policy *policy.Policy)) {
+	for {
+		nextAt, ok := schedule.Next(time.Now())
+		if !ok {
+			me.logger.Errorf("Schedule (%s) for %s does not fire anymore", schedule, name)
+			return
 		}
 
-		me.logger.Infof("Reconciling..")
-		err := me.reconciler.Reconcile(policy)
-		if err == nil {
-			me.logger.Infof("Reconciliation completed")
-		} else {
-			me.logger.Warnf("Reconciliation failed: %s", err)
-		}
+		me.logger.Infof("Next scheduled %s will happen at %s", name, nextAt)
 
-		me.lockReconciler.Unlock()
+		timer := time.NewTimer(time.Until(nextAt))
+		select {
+		case <-timer.C:
+		case <-cancel:
+			timer.Stop()
+			return
+		}
 
-		if err != nil {
-			me.retryTicker = time.NewTicker(
-				time.Duration(me.retryIntervalMilliseconds) * time.Millisecond,
-			)
-			// Buffered signalling channel, so we can avoid getting stuck if the retrier had exited
-			me.retryCancel = make(chan bool, 1)
-			go me.retryReconciliation(me.retryTicker, me.retryCancel, policy)
-			me.logger.Infof("Will retry reconciliation after %d ms..", me.retryIntervalMilliseconds)
+		policy := me.store.Get()
+		if policy == nil {
+			me.logger.Infof("Skipping scheduled %s, as there is no policy yet", name)
+			continue
 		}
+
+		me.logger.Infof("Starting scheduled %s", name)
+
+		run(policy)
+	}
+}
+
+// detectDrift compares the given policy to the homeserver's state, reporting (but not correcting) how they differ.
+// Unlike reconciliation, this is not retried on failure, as the next scheduled detection will try again anyway.
+func (me *StoreDrivenReconciler) detectDrift(policy *policy.Policy) {
+	me.lockReconciler.Lock()
+	defer me.lockReconciler.Unlock()
+
+	runReport := reconciliation.NewRunReport("", true)
+
+	report, err := me.reconciler.DryRun(policy)
+	if err == nil {
+		me.logDryRunReport(report, runReport)
 	}
+
+	me.reconciler.reportRun(policy, runReport, err)
+
+	if err != nil {
+		me.logger.Warnf("Drift detection failed: %s", err)
+		return
+	}
+
+	if len(runReport.Drift) == 0 {
+		me.logger.Infof("Drift detection completed: the homeserver's state matches the policy")
+		return
+	}
+
+	me.logger.Warnf("Drift detection completed: the homeserver's state differs from the policy in %d ways", len(runReport.Drift))
+}
+
+// reconcileWithRetries reconciles the given policy, retrying (in the background) until it succeeds
+// or until another reconcileWithRetries call supersedes it.
+func (me *StoreDrivenReconciler) reconcileWithRetries(policy *policy.Policy) {
+	me.lockReconciler.Lock()
+	defer me.lockReconciler.Unlock()
+
+	// We may still be potentially retrying some old policy.
+	// Let's stop that and attempt to load the new one below.
+	if me.retryTicker != nil {
+		me.retryTicker.Stop()
+		me.retryCancel <- true
+
+		me.retryTicker = nil
+		me.retryCancel = nil
+	}
+
+	me.logger.Infof("Reconciling..")
+	err := me.reconcile(policy)
+	if err == nil {
+		me.logger.Infof("Reconciliation completed")
+		return
+	}
+
+	if err == errRunCancelled {
+		// Cancelling is deliberate, so retrying would defeat its purpose
+		me.logger.Infof("Reconciliation cancelled, not retrying")
+		return
+	}
+
+	me.logger.Warnf("Reconciliation failed: %s", err)
+
+	me.retryTicker = time.NewTicker(
+		time.Duration(me.retryIntervalMilliseconds) * time.Millisecond,
+	)
+	// Buffered signalling channel, so we can avoid getting stuck if the retrier had exited
+	me.retryCancel = make(chan bool, 1)
+	go me.retryReconciliation(me.retryTicker, me.retryCancel, policy)
+	me.logger.Infof("Will retry reconciliation after %d ms..", me.retryIntervalMilliseconds)
 }
 
 func (me *StoreDrivenReconciler) retryReconciliation(ticker *time.Ticker, cancel chan bool, policy *policy.Policy) {
@@ -102,7 +279,7 @@ func (me *StoreDrivenReconciler) retryReconciliation(ticker *time.Ticker, cancel
 
 			me.logger.Infof("Retrying reconciliation..")
 
-			err := me.reconciler.Reconcile(policy)
+			err := me.reconcile(policy)
 
 			if err == nil {
 				me.logger.Infof("Reconciliation completed")
@@ -111,6 +288,13 @@ func (me *StoreDrivenReconciler) retryReconciliation(ticker *time.Ticker, cancel
 				return
 			}
 
+			if err == errRunCancelled {
+				me.logger.Infof("Reconciliation cancelled, not retrying anymore")
+				ticker.Stop()
+				me.lockReconciler.Unlock()
+				return
+			}
+
 			me.logger.Warnf("Reconciliation failed: %s", err)
 			me.lockReconciler.Unlock()
 
@@ -119,3 +303,87 @@ func (me *StoreDrivenReconciler) retryReconciliation(ticker *time.Ticker, cancel
 		}
 	}
 }
+
+// PauseRuns pauses reconciliation (see Reconciler.PauseRuns).
+// Unlike most other methods, it doesn't wait for the run in progress (if any) to complete.
+func (me *StoreDrivenReconciler) PauseRuns() {
+	me.reconciler.PauseRuns()
+}
+
+// ResumeRuns resumes paused reconciliation (see Reconciler.ResumeRuns)
+func (me *StoreDrivenReconciler) ResumeRuns() {
+	me.reconciler.ResumeRuns()
+}
+
+// CancelRuns cancels the reconciliation runs in progress (see Reconciler.CancelRuns), telling whether there were any.
+// Cancelled runs are not retried.
+func (me *StoreDrivenReconciler) CancelRuns() bool {
+	return me.reconciler.CancelRuns()
+}
+
+// GetRunControlStatus tells whether reconciliation is paused and whether a run is in progress
+func (me *StoreDrivenReconciler) GetRunControlStatus() RunControlStatus {
+	return me.reconciler.GetRunControlStatus()
+}
+
+// GetQuarantinedUsers returns the users whose actions get skipped, as reconciling them has failed too many times in a row
+// (see Reconciler.SetQuarantineThreshold)
+func (me *StoreDrivenReconciler) GetQuarantinedUsers() []QuarantinedUser {
+	return me.reconciler.GetQuarantinedUsers()
+}
+
+// ReleaseQuarantinedUser takes the given user out of quarantine (see Reconciler.ReleaseQuarantinedUser), telling whether they were quarantined
+func (me *StoreDrivenReconciler) ReleaseQuarantinedUser(userId string) bool {
+	return me.reconciler.ReleaseQuarantinedUser(userId)
+}
+
+// SubscribeToProgress returns a channel delivering progress updates about runs (see Reconciler.SubscribeToProgress)
+func (me *StoreDrivenReconciler) SubscribeToProgress() (<-chan RunProgress, func()) {
+	return me.reconciler.SubscribeToProgress()
+}
+
+// DryRun computes the actions that reconciling the given policy would take, without executing any of them (see Reconciler.DryRun).
+// It can be used regardless of whether the store-driven reconciler itself is in dry-run mode.
+func (me *StoreDrivenReconciler) DryRun(policy *policy.Policy) (*reconciliation.Report, error) {
+	me.lockReconciler.Lock()
+	defer me.lockReconciler.Unlock()
+
+	return me.reconciler.DryRun(policy)
+}
+
+// reconcile reconciles the given policy, or only reports what reconciling it would do (when in dry-run mode)
+func (me *StoreDrivenReconciler) reconcile(policy *policy.Policy) error {
+	if !me.dryRun {
+		return me.reconciler.Reconcile(policy)
+	}
+
+	runReport := reconciliation.NewRunReport("", true)
+
+	report, err := me.reconciler.DryRun(policy)
+	if err == nil {
+		me.logDryRunReport(report, runReport)
+	}
+
+	me.reconciler.reportRun(policy, runReport, err)
+
+	return err
+}
+
+// logDryRunReport logs the actions that a dry-run has computed, recording them (as planned) in the run report as well
+func (me *StoreDrivenReconciler) logDryRunReport(report *reconciliation.Report, runReport *reconciliation.RunReport) {
+	for _, action := range report.Actions {
+		runReport.AddAction(action, reconciliation.ActionStatusPlanned, nil, 0)
+
+		logger := me.logger.WithField("action", action.Type)
+		logger = logger.WithFields(logrus.Fields(action.Payload))
+		if drift := reconciliation.NewDrift(action); drift != nil {
+			logger = logger.WithField("drift", drift.Description)
+		}
+		logger.Infof("Dry-run: would execute reconciliation handler")
+	}
+
+	me.logger.WithFields(logrus.Fields{"summary": report.Summary}).Infof(
+		"Dry-run: reconciliation would execute %d actions",
+		len(report.Actions),
+	)
+}
@@ -0,0 +1,105 @@
+package reconciler
+
+import (
+	"devture-matrix-corporal/corporal/connector"
+	"devture-matrix-corporal/corporal/policy"
+	"devture-matrix-corporal/corporal/reconciliation"
+	"fmt"
+	"time"
+)
+
+// determineStateUserIds returns the ids of the users whose current state is needed:
+// the managed users, along with the old users of pending user id migrations (see policy.UserIdMigration), whose profiles get copied.
+func determineStateUserIds(policy *policy.Policy, userIdMigrationState *connector.UserIdMigrationState) []string {
+	userIds := policy.GetManagedUserIds()
+
+	if userIdMigrationState == nil {
+		return userIds
+	}
+
+	for _, migration := range policy.UserIdMigrations {
+		if userIdMigrationState.IsCompleted(migration.OldUserId, migration.NewUserId) {
+			continue
+		}
+		if policy.GetUserPolicyByUserId(migration.OldUserId) != nil {
+			// Already there (see policy.UserIdMigration.DeactivateOldUser)
+			continue
+		}
+		userIds = append(userIds, migration.OldUserId)
+	}
+
+	return userIds
+}
+
+func (me *Reconciler) reconcileForActionUserCopyProfile(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	userId, err := action.GetStringPayloadDataByKey("userId")
+	if err != nil {
+		return err
+	}
+
+	fromUserId, err := action.GetStringPayloadDataByKey("fromUserId")
+	if err != nil {
+		return err
+	}
+
+	displayName, err := action.GetOptionalStringPayloadDataByKey("displayName", "")
+	if err != nil {
+		return err
+	}
+
+	if displayName != "" {
+		err = me.connector.SetUserDisplayName(ctx, userId, displayName)
+		if err != nil {
+			return fmt.Errorf("Failed copying display name (%s) from %s to %s: %s", displayName, fromUserId, userId, err)
+		}
+	}
+
+	avatarMxcUri, err := action.GetOptionalStringPayloadDataByKey("avatarMxcUri", "")
+	if err != nil {
+		return err
+	}
+
+	if avatarMxcUri != "" {
+		avatarSourceUriHash, err := action.GetOptionalStringPayloadDataByKey("avatarSourceUriHash", "")
+		if err != nil {
+			return err
+		}
+
+		// The image is reused as it is (no need to upload it again), along with what it's derived from
+		err = me.connector.SetUserAvatarMxcUri(ctx, userId, avatarMxcUri, avatarSourceUriHash)
+		if err != nil {
+			return fmt.Errorf("Failed copying avatar from %s to %s: %s", fromUserId, userId, err)
+		}
+	}
+
+	return nil
+}
+
+func (me *Reconciler) reconcileForActionUserIdMigrationComplete(ctx *connector.AccessTokenContext, action *reconciliation.StateAction) error {
+	oldUserId, err := action.GetStringPayloadDataByKey("oldUserId")
+	if err != nil {
+		return err
+	}
+
+	newUserId, err := action.GetStringPayloadDataByKey("newUserId")
+	if err != nil {
+		return err
+	}
+
+	userIdMigrationState, err := me.connector.GetUserIdMigrationState(ctx, me.reconciliatorUserId)
+	if err != nil {
+		return fmt.Errorf("Failed determining user id migration state: %s", err)
+	}
+
+	userIdMigrationState.Completed[oldUserId] = connector.CompletedUserIdMigration{
+		NewUserId:   newUserId,
+		CompletedAt: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	err = me.connector.StoreUserIdMigrationState(ctx, me.reconciliatorUserId, userIdMigrationState)
+	if err != nil {
+		return fmt.Errorf("Failed recording the migration of %s to %s: %s", oldUserId, newUserId, err)
+	}
+
+	return nil
+}
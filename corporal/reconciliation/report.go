@@ -0,0 +1,59 @@
+package reconciliation
+
+import "time"
+
+// reportRedactedPayloadKeys lists action payload keys whose values are not to be included in reports
+var reportRedactedPayloadKeys = []string{"password"}
+
+// Report describes the actions that a reconciliation computed (see Reconciler.DryRun)
+type Report struct {
+	DryRun     bool      `json:"dryRun"`
+	ComputedAt time.Time `json:"computedAt"`
+
+	// Summary maps action types (e.g. `user.create`) to how many actions of that type there are
+	Summary map[string]int `json:"summary"`
+
+	Actions []*StateAction `json:"actions"`
+}
+
+// NewReport builds a report out of the given actions, redacting sensitive payload data (like initial passwords)
+func NewReport(actions []*StateAction, dryRun bool) *Report {
+	report := &Report{
+		DryRun:     dryRun,
+		ComputedAt: time.Now().UTC(),
+		Summary:    map[string]int{},
+		Actions:    RedactActions(actions),
+	}
+
+	for _, action := range actions {
+		report.Summary[action.Type]++
+	}
+
+	return report
+}
+
+// RedactActions returns copies of the given actions, without sensitive payload data in them (see redactPayload)
+func RedactActions(actions []*StateAction) []*StateAction {
+	redactedActions := make([]*StateAction, 0, len(actions))
+	for _, action := range actions {
+		redactedActions = append(redactedActions, &StateAction{
+			Type:    action.Type,
+			Payload: redactPayload(action.Payload),
+		})
+	}
+	return redactedActions
+}
+
+// redactPayload returns a copy of the action payload, without sensitive data in it (see reportRedactedPayloadKeys)
+func redactPayload(actionPayload map[string]interface{}) map[string]interface{} {
+	payload := make(map[string]interface{}, len(actionPayload))
+	for key, value := range actionPayload {
+		payload[key] = value
+	}
+	for _, key := range reportRedactedPayloadKeys {
+		if _, exists := payload[key]; exists {
+			payload[key] = "<redacted>"
+		}
+	}
+	return payload
+}
@@ -0,0 +1,174 @@
+package reconciliation
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// RunScopeFull is for runs reconciling the whole policy
+	RunScopeFull = "full"
+
+	// RunScopeUser is for runs reconciling a single user
+	RunScopeUser = "user"
+
+	ActionStatusPerformed = "performed"
+	ActionStatusFailed    = "failed"
+
+	// ActionStatusPlanned is for actions which were only computed, as part of a dry-run
+	ActionStatusPlanned = "planned"
+)
+
+// RunReporter gets told about each reconciliation run (successful or not)
+type RunReporter interface {
+	ReportRun(report *RunReport)
+}
+
+// RunReport is a machine-readable summary of a reconciliation run
+type RunReport struct {
+	Scope  string  `json:"scope"`
+	UserId *string `json:"userId"`
+	DryRun bool    `json:"dryRun"`
+
+	StartedAt            time.Time `json:"startedAt"`
+	FinishedAt           time.Time `json:"finishedAt"`
+	DurationMilliseconds int64     `json:"durationMilliseconds"`
+
+	Success bool    `json:"success"`
+	Error   *string `json:"error"`
+
+	// Summary maps action types (e.g. `user.create`) to how many actions of that type were performed (or planned, for dry-runs)
+	Summary map[string]int `json:"summary"`
+
+	// Users holds per-user statistics, for all users that actions were performed on (or planned for)
+	Users map[string]*UserRunReport `json:"users"`
+
+	// Actions lists the actions in the order they were performed (or completed, when actions are performed in parallel).
+	// Reconciliation stops at the first failing action, so actions after it are not listed
+	// (unless the failure gets the action's user quarantined, see QuarantinedUserIds).
+	Actions []*ActionRunReport `json:"actions"`
+
+	// Drift describes how the homeserver's state differs from the policy, as found out by dry-runs (see NewDrift).
+	// It's empty for runs which correct the drift, instead of only planning to.
+	Drift []*Drift `json:"drift"`
+
+	// QuarantinedUserIds lists the users whose (remaining) actions got skipped during the run, as they're quarantined
+	// (because reconciling them has failed too many times in a row)
+	QuarantinedUserIds []string `json:"quarantinedUserIds"`
+
+	// lock guards against actions being added from multiple workers at the same time
+	lock sync.Mutex
+}
+
+type UserRunReport struct {
+	ActionsPerformed int `json:"actionsPerformed"`
+	ActionsFailed    int `json:"actionsFailed"`
+	ActionsPlanned   int `json:"actionsPlanned"`
+}
+
+type ActionRunReport struct {
+	Type                 string                 `json:"type"`
+	Payload              map[string]interface{} `json:"payload"`
+	Status               string                 `json:"status"`
+	Error                *string                `json:"error"`
+	DurationMilliseconds int64                  `json:"durationMilliseconds"`
+}
+
+// NewRunReport starts a report for a run beginning now. An empty userId means a full run.
+func NewRunReport(userId string, dryRun bool) *RunReport {
+	report := &RunReport{
+		Scope:     RunScopeFull,
+		DryRun:    dryRun,
+		StartedAt: time.Now().UTC(),
+		Summary:   map[string]int{},
+		Users:     map[string]*UserRunReport{},
+		Actions:   []*ActionRunReport{},
+		Drift:     []*Drift{},
+
+		QuarantinedUserIds: []string{},
+	}
+
+	if userId != "" {
+		report.Scope = RunScopeUser
+		report.UserId = &userId
+	}
+
+	return report
+}
+
+// AddAction records an action, which has been performed (err being nil), has failed or was only planned (see ActionStatusPlanned),
+// returning what got recorded for it
+func (me *RunReport) AddAction(action *StateAction, status string, err error, duration time.Duration) *ActionRunReport {
+	actionReport := &ActionRunReport{
+		Type:                 action.Type,
+		Payload:              redactPayload(action.Payload),
+		Status:               status,
+		DurationMilliseconds: duration.Milliseconds(),
+	}
+	if err != nil {
+		errorMessage := err.Error()
+		actionReport.Error = &errorMessage
+	}
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.Actions = append(me.Actions, actionReport)
+
+	if status == ActionStatusPlanned {
+		if drift := NewDrift(action); drift != nil {
+			me.Drift = append(me.Drift, drift)
+		}
+	}
+
+	if status != ActionStatusFailed {
+		me.Summary[action.Type]++
+	}
+
+	userId, ok := action.Payload["userId"].(string)
+	if !ok {
+		return actionReport
+	}
+
+	userReport, exists := me.Users[userId]
+	if !exists {
+		userReport = &UserRunReport{}
+		me.Users[userId] = userReport
+	}
+
+	switch status {
+	case ActionStatusPerformed:
+		userReport.ActionsPerformed++
+	case ActionStatusFailed:
+		userReport.ActionsFailed++
+	case ActionStatusPlanned:
+		userReport.ActionsPlanned++
+	}
+
+	return actionReport
+}
+
+// AddQuarantinedUserId records that the given user's actions got skipped, as they're quarantined
+func (me *RunReport) AddQuarantinedUserId(userId string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	for _, quarantinedUserId := range me.QuarantinedUserIds {
+		if quarantinedUserId == userId {
+			return
+		}
+	}
+	me.QuarantinedUserIds = append(me.QuarantinedUserIds, userId)
+}
+
+// Finish completes the report, with err telling whether the run has failed
+func (me *RunReport) Finish(err error) {
+	me.FinishedAt = time.Now().UTC()
+	me.DurationMilliseconds = me.FinishedAt.Sub(me.StartedAt).Milliseconds()
+	me.Success = err == nil
+
+	if err != nil {
+		errorMessage := err.Error()
+		me.Error = &errorMessage
+	}
+}
@@ -0,0 +1,145 @@
+package reconciliation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runReportNotifierQueueSize specifies how many reports may be waiting to be delivered, before we start dropping new ones
+const runReportNotifierQueueSize = 100
+
+// RunReportNotifier is a RunReporter, which POSTs each report to the configured webhook URLs and/or writes it to a directory.
+//
+// Reports are delivered in order, from a single goroutine, so that reporting never slows down reconciliation.
+type RunReportNotifier struct {
+	logger                   *logrus.Logger
+	webhookUrls              []string
+	authorizationBearerToken string
+	directory                string
+	httpClient               *http.Client
+
+	queue       chan *RunReport
+	stopChannel chan struct{}
+}
+
+func NewRunReportNotifier(
+	logger *logrus.Logger,
+	webhookUrls []string,
+	authorizationBearerToken string,
+	timeout time.Duration,
+	directory string,
+) *RunReportNotifier {
+	return &RunReportNotifier{
+		logger:                   logger,
+		webhookUrls:              webhookUrls,
+		authorizationBearerToken: authorizationBearerToken,
+		directory:                directory,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+
+		queue:       make(chan *RunReport, runReportNotifierQueueSize),
+		stopChannel: make(chan struct{}),
+	}
+}
+
+func (me *RunReportNotifier) Start() error {
+	if me.directory != "" {
+		err := os.MkdirAll(me.directory, 0700)
+		if err != nil {
+			return fmt.Errorf("failed creating reconciliation report directory: %s", err)
+		}
+	}
+
+	go me.deliver()
+
+	return nil
+}
+
+func (me *RunReportNotifier) Stop() {
+	close(me.stopChannel)
+}
+
+func (me *RunReportNotifier) ReportRun(report *RunReport) {
+	select {
+	case me.queue <- report:
+	default:
+		me.logger.Warnf("Dropping reconciliation report (started at %s), as too many are waiting to be delivered", report.StartedAt)
+	}
+}
+
+func (me *RunReportNotifier) deliver() {
+	for {
+		select {
+		case <-me.stopChannel:
+			return
+		case report := <-me.queue:
+			reportBytes, err := json.Marshal(report)
+			if err != nil {
+				me.logger.Warnf("Failed serializing reconciliation report: %s", err)
+				continue
+			}
+
+			if me.directory != "" {
+				err := me.write(report, reportBytes)
+				if err != nil {
+					me.logger.Warnf("Failed writing reconciliation report to %s: %s", me.directory, err)
+				}
+			}
+
+			for _, webhookUrl := range me.webhookUrls {
+				err := me.send(webhookUrl, reportBytes)
+				if err != nil {
+					me.logger.Warnf("Failed delivering reconciliation report to %s: %s", webhookUrl, err)
+				}
+			}
+		}
+	}
+}
+
+// write stores the report in a file named after the time the run started (e.g. `20240510T120000.123456789Z-full.json`),
+// so that listing the directory lists reports chronologically.
+func (me *RunReportNotifier) write(report *RunReport, reportBytes []byte) error {
+	fileName := fmt.Sprintf("%s-%s.json", report.StartedAt.Format("20060102T150405.000000000Z"), report.Scope)
+	path := filepath.Join(me.directory, fileName)
+
+	// Writing to a temporary file and renaming it, so that archiving tools never pick up a partially-written report.
+	temporaryPath := filepath.Join(me.directory, "."+fileName+".tmp")
+	err := ioutil.WriteFile(temporaryPath, reportBytes, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, path)
+}
+
+func (me *RunReportNotifier) send(webhookUrl string, reportBytes []byte) error {
+	req, err := http.NewRequest("POST", webhookUrl, bytes.NewReader(reportBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if me.authorizationBearerToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", me.authorizationBearerToken))
+	}
+
+	resp, err := me.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("non-2xx response: %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package reconciliation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduleMaxIterations bounds the search for the next time a schedule fires,
+// which is more than enough for any schedule that fires at least once every few years.
+const scheduleMaxIterations = 100000
+
+var scheduleShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// Schedule is a cron-style schedule (e.g. `0 2 * * *` for nightly at 02:00), with the usual 5 fields:
+// minute, hour, day of month, month and day of week (0-7, with both 0 and 7 being Sunday).
+//
+// Fields support `*`, single values, ranges (`1-5`), steps (`*/15`, `0-30/10`) and lists of these (`1,15,30`).
+// Like with cron, a day matches if either the day of month or the day of week matches (when both are restricted).
+// The `@hourly`, `@daily`, `@weekly` and `@monthly` shortcuts are supported as well.
+type Schedule struct {
+	expression string
+
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+
+	daysOfMonthRestricted bool
+	daysOfWeekRestricted  bool
+}
+
+func ParseSchedule(expression string) (*Schedule, error) {
+	fieldsExpression := strings.TrimSpace(expression)
+	if shortcutExpression, exists := scheduleShortcuts[fieldsExpression]; exists {
+		fieldsExpression = shortcutExpression
+	}
+
+	fields := strings.Fields(fieldsExpression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields (minute, hour, day of month, month, day of week), not %d", len(fields))
+	}
+
+	schedule := &Schedule{
+		expression:            expression,
+		daysOfMonthRestricted: fields[2] != "*",
+		daysOfWeekRestricted:  fields[4] != "*",
+	}
+
+	var err error
+	if schedule.minutes, err = parseScheduleField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("bad minute field: %s", err)
+	}
+	if schedule.hours, err = parseScheduleField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("bad hour field: %s", err)
+	}
+	if schedule.daysOfMonth, err = parseScheduleField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("bad day of month field: %s", err)
+	}
+	if schedule.months, err = parseScheduleField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("bad month field: %s", err)
+	}
+	if schedule.daysOfWeek, err = parseScheduleField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("bad day of week field: %s", err)
+	}
+	if schedule.daysOfWeek[7] {
+		schedule.daysOfWeek[0] = true
+	}
+
+	if _, ok := schedule.Next(time.Now()); !ok {
+		return nil, fmt.Errorf("the schedule never fires")
+	}
+
+	return schedule, nil
+}
+
+func (me *Schedule) String() string {
+	return me.expression
+}
+
+// Next returns the first time (after the given time) when the schedule fires.
+// If it doesn't fire within the next few years (e.g. `0 0 30 2 *`), false is returned.
+func (me *Schedule) Next(after time.Time) (time.Time, bool) {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+
+	for i := 0; i < scheduleMaxIterations; i++ {
+		if !me.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !me.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !me.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !me.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+
+	return time.Time{}, false
+}
+
+func (me *Schedule) matchesDay(t time.Time) bool {
+	dayOfMonthMatches := me.daysOfMonth[t.Day()]
+	dayOfWeekMatches := me.daysOfWeek[int(t.Weekday())]
+
+	if me.daysOfMonthRestricted && me.daysOfWeekRestricted {
+		return dayOfMonthMatches || dayOfWeekMatches
+	}
+	return dayOfMonthMatches && dayOfWeekMatches
+}
+
+func parseScheduleField(field string, min int, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if idx := strings.Index(part, "/"); idx != -1 {
+			rangePart = part[:idx]
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("bad step in `%s`", part)
+			}
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+
+			var err error
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("bad value in `%s`", part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("bad value in `%s`", part)
+				}
+			} else if step != 1 {
+				// Like with cron, `5/10` means "from 5 onwards, every 10"
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("`%s` is out of range (%d-%d)", part, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
@@ -1,6 +1,9 @@
 package reconciliation
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 type State struct {
 	Actions []*StateAction `json:"actions"`
@@ -24,6 +27,49 @@ func (me *StateAction) GetStringPayloadDataByKey(key string) (string, error) {
 	return dataCasted, nil
 }
 
+// GetOptionalStringPayloadDataByKey is like GetStringPayloadDataByKey, but returns the default value when there's no such payload data
+func (me *StateAction) GetOptionalStringPayloadDataByKey(key string, defaultValue string) (string, error) {
+	if _, exists := me.Payload[key]; !exists {
+		return defaultValue, nil
+	}
+	return me.GetStringPayloadDataByKey(key)
+}
+
+func (me *StateAction) GetMapPayloadDataByKey(key string) (map[string]interface{}, error) {
+	data, err := me.getPayloadDataByKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dataCasted, castOk := data.(map[string]interface{})
+	if !castOk {
+		return nil, fmt.Errorf("Failed casting payload data for: %s", key)
+	}
+	return dataCasted, nil
+}
+
+// DecodePayloadDataByKey puts the given payload data into the target (a pointer), going through JSON.
+//
+// Unlike casting, this works for actions restored from JSON as well (see connector.ReconciliationCheckpoint),
+// where payload data is no longer of the type it was computed as (e.g. `[]interface{}` instead of `[]string`).
+func (me *StateAction) DecodePayloadDataByKey(key string, target interface{}) error {
+	data, err := me.getPayloadDataByKey(key)
+	if err != nil {
+		return err
+	}
+
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("Failed serializing payload data for %s: %s", key, err)
+	}
+
+	err = json.Unmarshal(dataBytes, target)
+	if err != nil {
+		return fmt.Errorf("Failed decoding payload data for %s: %s", key, err)
+	}
+	return nil
+}
+
 func (me *StateAction) getPayloadDataByKey(key string) (interface{}, error) {
 	data, exists := me.Payload[key]
 	if !exists {
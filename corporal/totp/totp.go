@@ -0,0 +1,161 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"devture-matrix-corporal/corporal/util"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// stepDuration is how long each code is valid for (the default used by authenticator apps)
+	stepDuration = 30 * time.Second
+
+	// digits is how long codes are (the default used by authenticator apps)
+	digits = 6
+
+	// allowedSkewSteps is how many steps before or after the current one are accepted, to account for clock differences
+	allowedSkewSteps = 1
+
+	// secretSize is the size (in bytes) of generated secrets (160 bits, as recommended by RFC 4226)
+	secretSize = 20
+
+	// backupCodeSize is the size (in bytes) of generated backup codes (before encoding)
+	backupCodeSize = 5
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret generates a new (base32-encoded) secret
+func GenerateSecret() (string, error) {
+	secretBytes, err := util.GenerateRandomBytes(secretSize)
+	if err != nil {
+		return "", fmt.Errorf("failed generating secret: %s", err)
+	}
+
+	return secretEncoding.EncodeToString(secretBytes), nil
+}
+
+// DecodeSecret decodes a base32-encoded secret (as shown by authenticator apps), tolerating spaces, lowercase letters and padding
+func DecodeSecret(secret string) ([]byte, error) {
+	normalized := strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	normalized = strings.TrimRight(normalized, "=")
+
+	secretBytes, err := secretEncoding.DecodeString(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32 secret: %s", err)
+	}
+	if len(secretBytes) == 0 {
+		return nil, fmt.Errorf("empty secret")
+	}
+
+	return secretBytes, nil
+}
+
+// Verify checks the given code against the secret (see RFC 6238), as of the given time.
+//
+// To prevent codes from being replayed, codes from steps not after lastUsedStep are rejected.
+// If the code is valid, the step it belongs to is returned (to be used as lastUsedStep the next time).
+func Verify(secret string, code string, now time.Time, lastUsedStep int64) (int64, bool, error) {
+	secretBytes, err := DecodeSecret(secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != digits {
+		return 0, false, nil
+	}
+
+	currentStep := now.Unix() / int64(stepDuration/time.Second)
+	for step := currentStep - allowedSkewSteps; step <= currentStep+allowedSkewSteps; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(generateCode(secretBytes, step)), []byte(code)) == 1 {
+			return step, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// generateCode generates the HOTP code (see RFC 4226) for the given counter (step)
+func generateCode(secretBytes []byte, counter int64) string {
+	counterBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(counterBytes, uint64(counter))
+
+	mac := hmac.New(sha1.New, secretBytes)
+	mac.Write(counterBytes)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
+
+// CreateKeyUri creates an `otpauth://` URI for the secret, which authenticator apps can import (usually by scanning it as a QR code)
+func CreateKeyUri(issuer string, accountName string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", digits))
+	query.Set("period", fmt.Sprintf("%d", int(stepDuration/time.Second)))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(accountName)
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+// GenerateBackupCodes generates the given number of (single-use) backup codes, also returning their hashes (see HashBackupCode)
+func GenerateBackupCodes(count int) ([]string, []string, error) {
+	codes := make([]string, 0, count)
+	hashes := make([]string, 0, count)
+
+	for i := 0; i < count; i++ {
+		codeBytes, err := util.GenerateRandomBytes(backupCodeSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed generating backup code: %s", err)
+		}
+
+		code := strings.ToLower(secretEncoding.EncodeToString(codeBytes))
+
+		codes = append(codes, code)
+		hashes = append(hashes, HashBackupCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// HashBackupCode returns the hash (hex-encoded SHA-256) of a backup code, which is what gets stored in the policy.
+// Backup codes are random enough for a fast hash to be fine. Spaces and dashes, as well as case differences, are ignored.
+func HashBackupCode(code string) string {
+	normalized := strings.ToLower(code)
+	normalized = strings.Replace(normalized, " ", "", -1)
+	normalized = strings.Replace(normalized, "-", "", -1)
+
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsValidBackupCodeHash tells whether the given value looks like something that HashBackupCode returns
+func IsValidBackupCodeHash(hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size
+}
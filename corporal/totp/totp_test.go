@@ -0,0 +1,143 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret used by the test vectors of RFC 6238 (Appendix B), base32-encoded
+var rfc6238Secret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// rfc6238Vectors maps times to the (6-digit) codes for them, i.e. the last 6 digits of the 8-digit codes found in RFC 6238
+var rfc6238Vectors = []struct {
+	unixTime int64
+	code     string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestVerifyAcceptsRfc6238Vectors(t *testing.T) {
+	for _, vector := range rfc6238Vectors {
+		step, isValid, err := Verify(rfc6238Secret, vector.code, time.Unix(vector.unixTime, 0), 0)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", vector.unixTime, err)
+			continue
+		}
+		if !isValid {
+			t.Errorf("%d: expected `%s` to be valid", vector.unixTime, vector.code)
+			continue
+		}
+		if step != vector.unixTime/30 {
+			t.Errorf("%d: expected step %d, got %d", vector.unixTime, vector.unixTime/30, step)
+		}
+	}
+}
+
+func TestVerifyToleratesOneStepOfSkew(t *testing.T) {
+	// The code for 1111111111 (step 37037037) is accepted a step before and after, but not two steps away
+	for offset, expectedValid := range map[int64]bool{-60: false, -30: true, 0: true, 30: true, 60: false} {
+		_, isValid, err := Verify(rfc6238Secret, "050471", time.Unix(1111111111+offset, 0), 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if isValid != expectedValid {
+			t.Errorf("offset %d: expected validity %t, got %t", offset, expectedValid, isValid)
+		}
+	}
+}
+
+func TestVerifyRejectsReplayedCodes(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	step, isValid, _ := Verify(rfc6238Secret, "287082", now, 0)
+	if !isValid {
+		t.Fatalf("expected the code to be valid the first time")
+	}
+
+	_, isValid, _ = Verify(rfc6238Secret, "287082", now, step)
+	if isValid {
+		t.Errorf("expected the code to be rejected when replayed")
+	}
+}
+
+func TestVerifyRejectsInvalidCodes(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	for _, code := range []string{"", "28708", "2870822", "287083", "abcdef"} {
+		_, isValid, err := Verify(rfc6238Secret, code, now, 0)
+		if err != nil {
+			t.Errorf("`%s`: unexpected error: %s", code, err)
+		}
+		if isValid {
+			t.Errorf("`%s`: expected the code to be invalid", code)
+		}
+	}
+
+	_, _, err := Verify("not base32!", "287082", now, 0)
+	if err == nil {
+		t.Errorf("expected an error for an invalid secret")
+	}
+}
+
+func TestDecodeSecretToleratesFormatting(t *testing.T) {
+	formatted := strings.ToLower(rfc6238Secret[:8]) + " " + rfc6238Secret[8:] + "===="
+
+	decoded, err := DecodeSecret(formatted)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(decoded) != "12345678901234567890" {
+		t.Errorf("unexpected secret: %q", decoded)
+	}
+
+	if _, err := DecodeSecret(""); err == nil {
+		t.Errorf("expected an error for an empty secret")
+	}
+}
+
+func TestGeneratedSecretsAndBackupCodes(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	decoded, err := DecodeSecret(secret)
+	if err != nil {
+		t.Fatalf("generated secret does not decode: %s", err)
+	}
+	if len(decoded) != secretSize {
+		t.Errorf("expected a %d-byte secret, got %d bytes", secretSize, len(decoded))
+	}
+
+	codes, hashes, err := GenerateBackupCodes(3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(codes) != 3 || len(hashes) != 3 {
+		t.Fatalf("expected 3 codes and hashes, got %d and %d", len(codes), len(hashes))
+	}
+	for i, code := range codes {
+		if HashBackupCode(code) != hashes[i] {
+			t.Errorf("hash of backup code %d does not match", i)
+		}
+		if !IsValidBackupCodeHash(hashes[i]) {
+			t.Errorf("hash of backup code %d is not considered valid", i)
+		}
+
+		// Formatting differences are ignored
+		formatted := strings.ToUpper(code[:4]) + "-" + code[4:]
+		if HashBackupCode(formatted) != hashes[i] {
+			t.Errorf("hash of formatted backup code %d does not match", i)
+		}
+	}
+
+	if IsValidBackupCodeHash("abcd") {
+		t.Errorf("expected a short hash to be invalid")
+	}
+}
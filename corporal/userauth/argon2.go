@@ -0,0 +1,57 @@
+package userauth
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2idAuthenticator is a user authenticator using argon2id-hashed credentials,
+// encoded in the PHC string format (e.g. `$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>`), like the ones produced by the reference implementation.
+type Argon2idAuthenticator struct {
+}
+
+func NewArgon2idAuthenticator() *Argon2idAuthenticator {
+	return &Argon2idAuthenticator{}
+}
+
+func (me *Argon2idAuthenticator) Type() string {
+	return UserAuthTypeArgon2id
+}
+
+func (me *Argon2idAuthenticator) Authenticate(userId, givenPassword, authCredential string) (bool, error) {
+	if len(givenPassword) > maxHashedPasswordLength {
+		return false, fmt.Errorf("Rejecting long password (%d)", len(givenPassword))
+	}
+
+	hash, err := parsePhcHash(authCredential)
+	if err != nil {
+		return false, err
+	}
+	if hash.id != "argon2id" {
+		return false, fmt.Errorf("Unexpected hash type: %s", hash.id)
+	}
+	if hash.version != "" && hash.version != "19" {
+		// Only the current version (0x13) is supported by the argon2 package
+		return false, fmt.Errorf("Unsupported argon2id version: %s", hash.version)
+	}
+
+	// Bounds prevent excessive memory (in KiB) or CPU usage
+	memory, err := hash.intParam("m", 8, 4*1024*1024)
+	if err != nil {
+		return false, err
+	}
+	iterations, err := hash.intParam("t", 1, 1000)
+	if err != nil {
+		return false, err
+	}
+	parallelism, err := hash.intParam("p", 1, 255)
+	if err != nil {
+		return false, err
+	}
+
+	computedHash := argon2.IDKey([]byte(givenPassword), hash.salt, uint32(iterations), uint32(memory), uint8(parallelism), uint32(len(hash.hash)))
+
+	return subtle.ConstantTimeCompare(computedHash, hash.hash) == 1, nil
+}
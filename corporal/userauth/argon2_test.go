@@ -0,0 +1,65 @@
+package userauth
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test vectors of the Argon2 reference implementation (github.com/P-H-C/phc-winner-argon2, src/test.c), for argon2id v19
+const (
+	argon2idReferenceHash                  = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	argon2idReferenceHashLowMemory         = "$argon2id$v=19$m=256,t=2,p=1$c29tZXNhbHQ$nf65EOgLrQMR/uIPnA4rEsF5h7TKyQwu9U1bMCHGi/4"
+	argon2idReferenceHashLowMemoryParallel = "$argon2id$v=19$m=256,t=2,p=2$c29tZXNhbHQ$bQk8UB/VmZZF4Oo79iDXuL5/0ttZwg2f/5U52iv1cDc"
+	argon2idReferenceHashOtherPassword     = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$C4TWUs9rDEvq7w3+J4umqA32aWKB1+DSiRuBfYxFj94"
+	argon2idReferenceHashOtherSalt         = "$argon2id$v=19$m=65536,t=2,p=1$ZGlmZnNhbHQ$vfMrBczELrFdWP0ZsfhWsRPaHppYdP3MVEMIVlqoFBw"
+)
+
+func TestArgon2idAuthenticator(t *testing.T) {
+	type testData struct {
+		name              string
+		givenPassword     string
+		authCredential    string
+		expectedValid     bool
+		expectedWithError bool
+	}
+
+	tests := []testData{
+		{"reference", "password", argon2idReferenceHash, true, false},
+		{"reference (low memory)", "password", argon2idReferenceHashLowMemory, true, false},
+		{"reference (low memory, parallel)", "password", argon2idReferenceHashLowMemoryParallel, true, false},
+		{"reference (other password)", "differentpassword", argon2idReferenceHashOtherPassword, true, false},
+		{"reference (other salt)", "password", argon2idReferenceHashOtherSalt, true, false},
+		{"without version", "password", strings.Replace(argon2idReferenceHashLowMemory, "$v=19", "", 1), true, false},
+
+		{"wrong password", "Password", argon2idReferenceHash, false, false},
+		{"wrong password (empty)", "", argon2idReferenceHashLowMemory, false, false},
+		{"password of another hash", "differentpassword", argon2idReferenceHash, false, false},
+		{"other parameters", "password", strings.Replace(argon2idReferenceHashLowMemory, "t=2", "t=3", 1), false, false},
+
+		{"argon2i", "password", strings.Replace(argon2idReferenceHashLowMemory, "$argon2id$", "$argon2i$", 1), false, true},
+		{"unsupported version", "password", strings.Replace(argon2idReferenceHashLowMemory, "v=19", "v=16", 1), false, true},
+		{"missing memory parameter", "password", strings.Replace(argon2idReferenceHashLowMemory, "m=256,", "", 1), false, true},
+		{"missing parallelism parameter", "password", strings.Replace(argon2idReferenceHashLowMemory, ",p=1", "", 1), false, true},
+		{"non-numeric parameter", "password", strings.Replace(argon2idReferenceHashLowMemory, "t=2", "t=two", 1), false, true},
+		{"too little memory", "password", strings.Replace(argon2idReferenceHashLowMemory, "m=256", "m=4", 1), false, true},
+		{"too much memory", "password", strings.Replace(argon2idReferenceHashLowMemory, "m=256", "m=99999999", 1), false, true},
+		{"too many iterations", "password", strings.Replace(argon2idReferenceHashLowMemory, "t=2", "t=1001", 1), false, true},
+		{"zero parallelism", "password", strings.Replace(argon2idReferenceHashLowMemory, "p=1", "p=0", 1), false, true},
+		{"not PHC-formatted", "password", "argon2id:password", false, true},
+		{"too long password", strings.Repeat("a", maxHashedPasswordLength+1), argon2idReferenceHashLowMemory, false, true},
+	}
+
+	authenticator := NewArgon2idAuthenticator()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			isValid, err := authenticator.Authenticate("@john:example.com", test.givenPassword, test.authCredential)
+			if test.expectedWithError != (err != nil) {
+				t.Fatalf("expected error: %t, got: %v", test.expectedWithError, err)
+			}
+			if isValid != test.expectedValid {
+				t.Errorf("expected %t, got %t", test.expectedValid, isValid)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package userauth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/sirupsen/logrus"
+)
+
+// DecisionCachingAuthenticator is a user authenticator which wraps another authenticator,
+// reusing its recent decisions for the same credentials, instead of asking it again.
+//
+// This is especially useful for the RestAuthenticator, as clients re-authenticating in bursts
+// would otherwise result in just as many requests to the remote REST server.
+// Concurrent attempts with the same credentials are coalesced into a single call to the wrapped authenticator as well.
+//
+// Successful (positive) and unsuccessful (negative) decisions are cached for a different amount of time (0 disables caching them).
+// Failures of the wrapped authenticator are never cached.
+//
+// Unlike CacheFallbackAuthenticator (which only uses its cache when the wrapped authenticator fails),
+// cached decisions are used before the wrapped authenticator is even consulted.
+type DecisionCachingAuthenticator struct {
+	authType    string
+	other       Authenticator
+	cache       *lru.Cache
+	positiveTtl time.Duration
+	negativeTtl time.Duration
+	logger      *logrus.Logger
+
+	inFlight     map[string]*inFlightAuthentication
+	inFlightLock sync.Mutex
+}
+
+type cachedDecision struct {
+	isAuthenticated bool
+	expiresAt       time.Time
+}
+
+type inFlightAuthentication struct {
+	done            chan struct{}
+	isAuthenticated bool
+	err             error
+}
+
+func NewDecisionCachingAuthenticator(
+	authType string,
+	other Authenticator,
+	cache *lru.Cache,
+	positiveTtl time.Duration,
+	negativeTtl time.Duration,
+	logger *logrus.Logger,
+) *DecisionCachingAuthenticator {
+	return &DecisionCachingAuthenticator{
+		authType:    authType,
+		other:       other,
+		cache:       cache,
+		positiveTtl: positiveTtl,
+		negativeTtl: negativeTtl,
+		logger:      logger,
+
+		inFlight: map[string]*inFlightAuthentication{},
+	}
+}
+
+func (me *DecisionCachingAuthenticator) Type() string {
+	return me.authType
+}
+
+func (me *DecisionCachingAuthenticator) Authenticate(userId, givenPassword, authCredential string) (bool, error) {
+	m := sha256.New()
+	// Null bytes can't be part of any of these, so they keep the key unambiguous
+	m.Write([]byte(fmt.Sprintf("%s\x00%s\x00%s", userId, givenPassword, authCredential)))
+	cacheKey := string(m.Sum(nil))
+
+	if cachedDecisionInterface, ok := me.cache.Get(cacheKey); ok {
+		decision := cachedDecisionInterface.(cachedDecision)
+		if time.Now().Before(decision.expiresAt) {
+			me.logger.Debugf("Reusing cached auth decision (%t) for user %s", decision.isAuthenticated, userId)
+			return decision.isAuthenticated, nil
+		}
+		me.cache.Remove(cacheKey)
+	}
+
+	me.inFlightLock.Lock()
+	if authentication, ok := me.inFlight[cacheKey]; ok {
+		me.inFlightLock.Unlock()
+
+		<-authentication.done
+		return authentication.isAuthenticated, authentication.err
+	}
+
+	authentication := &inFlightAuthentication{done: make(chan struct{})}
+	me.inFlight[cacheKey] = authentication
+	me.inFlightLock.Unlock()
+
+	authentication.isAuthenticated, authentication.err = me.other.Authenticate(userId, givenPassword, authCredential)
+
+	if authentication.err == nil {
+		ttl := me.negativeTtl
+		if authentication.isAuthenticated {
+			ttl = me.positiveTtl
+		}
+		if ttl > 0 {
+			me.cache.Add(cacheKey, cachedDecision{
+				isAuthenticated: authentication.isAuthenticated,
+				expiresAt:       time.Now().Add(ttl),
+			})
+		}
+	}
+
+	me.inFlightLock.Lock()
+	delete(me.inFlight, cacheKey)
+	me.inFlightLock.Unlock()
+
+	close(authentication.done)
+
+	return authentication.isAuthenticated, authentication.err
+}
@@ -0,0 +1,51 @@
+package userauth
+
+import (
+	"devture-matrix-corporal/corporal/jwt"
+)
+
+// JwtAuthenticator is a user authenticator which treats the given password as a signed JSON Web Token (e.g. an assertion issued by an SSO identity provider),
+// and validates it against the issuer's published keys (see jwt.Verifier).
+//
+// The token is considered valid for the user if it's valid in general (signature, issuer, audience, expiration, etc.),
+// and if its subject claim (see subjectClaim) matches the one expected for the user.
+// The expected subject would be specified in the `authCredential` argument passed to Authenticate().
+// If empty, the user's id (e.g. `@john:example.com`) is expected instead.
+type JwtAuthenticator struct {
+	verifier *jwt.Verifier
+
+	// subjectClaim is the claim which identifies who the token was issued to (e.g. `sub`, `preferred_username` or `email`)
+	subjectClaim string
+}
+
+func NewJwtAuthenticator(verifier *jwt.Verifier, subjectClaim string) *JwtAuthenticator {
+	return &JwtAuthenticator{
+		verifier:     verifier,
+		subjectClaim: subjectClaim,
+	}
+}
+
+func (me *JwtAuthenticator) Type() string {
+	return UserAuthTypeJwt
+}
+
+func (me *JwtAuthenticator) Authenticate(userId, givenPassword, authCredential string) (bool, error) {
+	if givenPassword == "" {
+		return false, nil
+	}
+
+	expectedSubject := authCredential
+	if expectedSubject == "" {
+		expectedSubject = userId
+	}
+
+	claims, err := me.verifier.Verify(givenPassword)
+	if err != nil {
+		if _, ok := err.(jwt.ValidationError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return claims.String(me.subjectClaim) == expectedSubject, nil
+}
@@ -0,0 +1,33 @@
+package userauth
+
+import (
+	"devture-matrix-corporal/corporal/ldap"
+	"strings"
+)
+
+// LdapAuthenticator is a user authenticator which verifies credentials by binding to an LDAP (or Active Directory) server as the user (see ldap.Client).
+//
+// The username that the user's DN is determined with (see ldap.Options) would be specified in the `authCredential` argument passed to Authenticate().
+// If empty, the localpart of the user's id is used instead (e.g. `john` for `@john:example.com`).
+type LdapAuthenticator struct {
+	client *ldap.Client
+}
+
+func NewLdapAuthenticator(client *ldap.Client) *LdapAuthenticator {
+	return &LdapAuthenticator{
+		client: client,
+	}
+}
+
+func (me *LdapAuthenticator) Type() string {
+	return UserAuthTypeLdap
+}
+
+func (me *LdapAuthenticator) Authenticate(userId, givenPassword, authCredential string) (bool, error) {
+	username := authCredential
+	if username == "" {
+		username = strings.SplitN(strings.TrimPrefix(userId, "@"), ":", 2)[0]
+	}
+
+	return me.client.Authenticate(username, givenPassword)
+}
@@ -0,0 +1,236 @@
+package userauth
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// lockoutPruneInterval is how often entries which no longer matter get dropped (see LockoutTracker.pruneIfDue)
+const lockoutPruneInterval = 1 * time.Minute
+
+// LockoutThresholds controls when a LockoutTracker locks out a user or an IP address and for how long
+type LockoutThresholds struct {
+	// MaxFailures is how many failed attempts are tolerated, before locking out (0 disables locking out)
+	MaxFailures int
+
+	// FailureWindow is how long failures are remembered for (after the last failure or lockout)
+	FailureWindow time.Duration
+
+	// LockoutDuration is how long the first lockout lasts. It doubles with each subsequent failure.
+	LockoutDuration time.Duration
+
+	// MaxLockoutDuration is how long lockouts can last at most
+	MaxLockoutDuration time.Duration
+}
+
+// LockedOutEntry describes a user or an IP address which is locked out (see LockoutTracker)
+type LockedOutEntry struct {
+	// Key is the user id or the IP address
+	Key string `json:"key"`
+
+	// Failures tells how many failed attempts have been recorded (within the failure window)
+	Failures int `json:"failures"`
+
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+type lockoutState struct {
+	failures      int
+	lastFailureAt time.Time
+	lockedUntil   time.Time
+}
+
+// isStale tells whether the state no longer matters (and is to be forgotten), as it's been quiet for longer than the failure window
+func (me *lockoutState) isStale(now time.Time, failureWindow time.Duration) bool {
+	lastActivityAt := me.lastFailureAt
+	if me.lockedUntil.After(lastActivityAt) {
+		lastActivityAt = me.lockedUntil
+	}
+	return now.Sub(lastActivityAt) > failureWindow
+}
+
+// LockoutTracker keeps track of failed authentication attempts per user and per IP address, locking them out for a while
+// after too many failures (see LockoutThresholds).
+//
+// This is in-memory only, so everything is forgotten (and lockouts get lifted) when matrix-corporal restarts.
+type LockoutTracker struct {
+	now func() time.Time
+
+	lock         sync.Mutex
+	users        map[string]*lockoutState
+	ips          map[string]*lockoutState
+	lastPrunedAt time.Time
+
+	// failureWindow is the failure window that was last used, which is what pruning goes by
+	failureWindow time.Duration
+}
+
+func NewLockoutTracker() *LockoutTracker {
+	return &LockoutTracker{
+		now:   time.Now,
+		users: map[string]*lockoutState{},
+		ips:   map[string]*lockoutState{},
+	}
+}
+
+// GetLockoutRemaining tells how long the given user or IP address (whichever is locked out for longer) remains locked out for (zero if neither is)
+func (me *LockoutTracker) GetLockoutRemaining(userId string, ip string) time.Duration {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	now := me.now()
+
+	remaining := lockoutRemaining(me.users[userId], now)
+	if ip != "" {
+		ipRemaining := lockoutRemaining(me.ips[ip], now)
+		if ipRemaining > remaining {
+			remaining = ipRemaining
+		}
+	}
+
+	return remaining
+}
+
+func lockoutRemaining(state *lockoutState, now time.Time) time.Duration {
+	if state == nil || !state.lockedUntil.After(now) {
+		return 0
+	}
+	return state.lockedUntil.Sub(now)
+}
+
+// RecordFailure records a failed authentication attempt for the given user, made from the given IP address (if known)
+func (me *LockoutTracker) RecordFailure(userId string, ip string, userThresholds LockoutThresholds, ipThresholds LockoutThresholds) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	now := me.now()
+
+	recordFailure(me.users, userId, userThresholds, now)
+	if ip != "" {
+		recordFailure(me.ips, ip, ipThresholds, now)
+	}
+
+	me.failureWindow = userThresholds.FailureWindow
+	if ipThresholds.FailureWindow > me.failureWindow {
+		me.failureWindow = ipThresholds.FailureWindow
+	}
+
+	me.pruneIfDue(now)
+}
+
+func recordFailure(states map[string]*lockoutState, key string, thresholds LockoutThresholds, now time.Time) {
+	if thresholds.MaxFailures == 0 {
+		return
+	}
+
+	state, exists := states[key]
+	if !exists || state.isStale(now, thresholds.FailureWindow) {
+		state = &lockoutState{}
+		states[key] = state
+	}
+
+	state.failures++
+	state.lastFailureAt = now
+
+	if state.failures < thresholds.MaxFailures {
+		return
+	}
+
+	// Each failure past the threshold doubles the lockout duration
+	lockoutDuration := thresholds.LockoutDuration
+	for i := thresholds.MaxFailures; i < state.failures && lockoutDuration < thresholds.MaxLockoutDuration; i++ {
+		lockoutDuration *= 2
+	}
+	if lockoutDuration > thresholds.MaxLockoutDuration {
+		lockoutDuration = thresholds.MaxLockoutDuration
+	}
+
+	state.lockedUntil = now.Add(lockoutDuration)
+}
+
+// RecordSuccess records a successful authentication attempt for the given user, so that the user's previous failures no longer count.
+// Failures from IP addresses keep counting, so that guessing the passwords of many users from the same place still gets noticed.
+func (me *LockoutTracker) RecordSuccess(userId string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	delete(me.users, userId)
+}
+
+// pruneIfDue drops entries which no longer matter, so that memory usage doesn't keep growing
+func (me *LockoutTracker) pruneIfDue(now time.Time) {
+	if now.Sub(me.lastPrunedAt) < lockoutPruneInterval {
+		return
+	}
+	me.lastPrunedAt = now
+
+	for _, states := range []map[string]*lockoutState{me.users, me.ips} {
+		for key, state := range states {
+			if state.isStale(now, me.failureWindow) {
+				delete(states, key)
+			}
+		}
+	}
+}
+
+// GetLockedOutUsers returns the users which are currently locked out, sorted by user id
+func (me *LockoutTracker) GetLockedOutUsers() []LockedOutEntry {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return listLockedOut(me.users, me.now())
+}
+
+// GetLockedOutIps returns the IP addresses which are currently locked out, sorted by IP address
+func (me *LockoutTracker) GetLockedOutIps() []LockedOutEntry {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return listLockedOut(me.ips, me.now())
+}
+
+func listLockedOut(states map[string]*lockoutState, now time.Time) []LockedOutEntry {
+	entries := make([]LockedOutEntry, 0)
+	for key, state := range states {
+		if !state.lockedUntil.After(now) {
+			continue
+		}
+
+		entries = append(entries, LockedOutEntry{
+			Key:         key,
+			Failures:    state.failures,
+			LockedUntil: state.lockedUntil.UTC(),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
+
+// ClearUser lifts the given user's lockout and forgets about their failures, telling whether anything was recorded for them
+func (me *LockoutTracker) ClearUser(userId string) bool {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return forget(me.users, userId)
+}
+
+// ClearIp lifts the given IP address's lockout and forgets about its failures, telling whether anything was recorded for it
+func (me *LockoutTracker) ClearIp(ip string) bool {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return forget(me.ips, ip)
+}
+
+func forget(states map[string]*lockoutState, key string) bool {
+	if _, exists := states[key]; !exists {
+		return false
+	}
+	delete(states, key)
+	return true
+}
@@ -0,0 +1,220 @@
+package userauth
+
+import (
+	"testing"
+	"time"
+)
+
+var testLockoutThresholds = LockoutThresholds{
+	MaxFailures:        3,
+	FailureWindow:      15 * time.Minute,
+	LockoutDuration:    1 * time.Minute,
+	MaxLockoutDuration: 8 * time.Minute,
+}
+
+var disabledLockoutThresholds = LockoutThresholds{}
+
+// createTestLockoutTracker creates a tracker whose clock only moves when told to (by changing the returned time)
+func createTestLockoutTracker() (*LockoutTracker, *time.Time) {
+	now := time.Unix(1600000000, 0)
+
+	tracker := NewLockoutTracker()
+	tracker.now = func() time.Time {
+		return now
+	}
+
+	return tracker, &now
+}
+
+func TestLockoutBacksOffExponentiallyUpToTheCap(t *testing.T) {
+	tracker, now := createTestLockoutTracker()
+
+	for i := 1; i < testLockoutThresholds.MaxFailures; i++ {
+		tracker.RecordFailure("@john:example.com", "", testLockoutThresholds, disabledLockoutThresholds)
+		if remaining := tracker.GetLockoutRemaining("@john:example.com", ""); remaining != 0 {
+			t.Fatalf("failure %d: expected no lockout yet, got %s", i, remaining)
+		}
+	}
+
+	// Each failure (once the previous lockout is over) doubles the lockout, until reaching the cap
+	for _, expectedLockout := range []time.Duration{1 * time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 8 * time.Minute} {
+		tracker.RecordFailure("@john:example.com", "", testLockoutThresholds, disabledLockoutThresholds)
+
+		remaining := tracker.GetLockoutRemaining("@john:example.com", "")
+		if remaining != expectedLockout {
+			t.Fatalf("expected a lockout of %s, got %s", expectedLockout, remaining)
+		}
+
+		*now = now.Add(remaining - 1*time.Second)
+		if remaining := tracker.GetLockoutRemaining("@john:example.com", ""); remaining != 1*time.Second {
+			t.Fatalf("expected 1s of the lockout to remain, got %s", remaining)
+		}
+
+		*now = now.Add(1 * time.Second)
+		if remaining := tracker.GetLockoutRemaining("@john:example.com", ""); remaining != 0 {
+			t.Fatalf("expected the lockout to be over, got %s", remaining)
+		}
+	}
+
+	if remaining := tracker.GetLockoutRemaining("@other:example.com", ""); remaining != 0 {
+		t.Errorf("expected other users not to be locked out, got %s", remaining)
+	}
+}
+
+func TestLockoutFailuresExpire(t *testing.T) {
+	tracker, now := createTestLockoutTracker()
+
+	for i := 1; i < testLockoutThresholds.MaxFailures; i++ {
+		tracker.RecordFailure("@john:example.com", "", testLockoutThresholds, disabledLockoutThresholds)
+	}
+
+	// Failures are forgotten after the failure window
+	*now = now.Add(testLockoutThresholds.FailureWindow + 1*time.Second)
+
+	tracker.RecordFailure("@john:example.com", "", testLockoutThresholds, disabledLockoutThresholds)
+	if remaining := tracker.GetLockoutRemaining("@john:example.com", ""); remaining != 0 {
+		t.Fatalf("expected earlier failures to have been forgotten, got a lockout of %s", remaining)
+	}
+
+	tracker.RecordFailure("@john:example.com", "", testLockoutThresholds, disabledLockoutThresholds)
+	tracker.RecordFailure("@john:example.com", "", testLockoutThresholds, disabledLockoutThresholds)
+	if remaining := tracker.GetLockoutRemaining("@john:example.com", ""); remaining != 1*time.Minute {
+		t.Fatalf("expected a lockout of 1m, got %s", remaining)
+	}
+
+	// The failure window counts from the end of the lockout, so failing right after it doubles the lockout..
+	*now = now.Add(1*time.Minute + testLockoutThresholds.FailureWindow)
+	tracker.RecordFailure("@john:example.com", "", testLockoutThresholds, disabledLockoutThresholds)
+	if remaining := tracker.GetLockoutRemaining("@john:example.com", ""); remaining != 2*time.Minute {
+		t.Fatalf("expected a lockout of 2m, got %s", remaining)
+	}
+
+	// ..while failing after the window has passed starts over
+	*now = now.Add(2*time.Minute + testLockoutThresholds.FailureWindow + 1*time.Second)
+	tracker.RecordFailure("@john:example.com", "", testLockoutThresholds, disabledLockoutThresholds)
+	if remaining := tracker.GetLockoutRemaining("@john:example.com", ""); remaining != 0 {
+		t.Fatalf("expected earlier failures to have been forgotten, got a lockout of %s", remaining)
+	}
+}
+
+func TestLockoutIsResetOnSuccessForUsersOnly(t *testing.T) {
+	tracker, _ := createTestLockoutTracker()
+
+	for i := 1; i < testLockoutThresholds.MaxFailures; i++ {
+		tracker.RecordFailure("@john:example.com", "192.0.2.1", testLockoutThresholds, testLockoutThresholds)
+	}
+
+	tracker.RecordSuccess("@john:example.com")
+
+	// The user's failures no longer count, but the IP address's do
+	tracker.RecordFailure("@john:example.com", "192.0.2.1", testLockoutThresholds, testLockoutThresholds)
+	if remaining := tracker.GetLockoutRemaining("@john:example.com", ""); remaining != 0 {
+		t.Errorf("expected the user's failures to have been reset, got a lockout of %s", remaining)
+	}
+	if remaining := tracker.GetLockoutRemaining("@other:example.com", "192.0.2.1"); remaining != 1*time.Minute {
+		t.Errorf("expected the IP address to be locked out for 1m, got %s", remaining)
+	}
+}
+
+func TestLockoutOfIpAddresses(t *testing.T) {
+	tracker, _ := createTestLockoutTracker()
+
+	// Guessing the passwords of different users from the same IP address
+	for _, userId := range []string{"@a:example.com", "@b:example.com", "@c:example.com", "@d:example.com"} {
+		tracker.RecordFailure(userId, "192.0.2.1", testLockoutThresholds, testLockoutThresholds)
+	}
+
+	if remaining := tracker.GetLockoutRemaining("@e:example.com", "192.0.2.1"); remaining != 2*time.Minute {
+		t.Errorf("expected the IP address to be locked out for 2m, got %s", remaining)
+	}
+	if remaining := tracker.GetLockoutRemaining("@e:example.com", "192.0.2.2"); remaining != 0 {
+		t.Errorf("expected other IP addresses not to be locked out, got %s", remaining)
+	}
+	if remaining := tracker.GetLockoutRemaining("@a:example.com", ""); remaining != 0 {
+		t.Errorf("expected the user not to be locked out, got %s", remaining)
+	}
+
+	// The longest lockout applies, whether it's the user's or the IP address's
+	for i := 0; i < testLockoutThresholds.MaxFailures; i++ {
+		tracker.RecordFailure("@f:example.com", "", testLockoutThresholds, testLockoutThresholds)
+	}
+	if remaining := tracker.GetLockoutRemaining("@f:example.com", "192.0.2.1"); remaining != 2*time.Minute {
+		t.Errorf("expected a lockout of 2m, got %s", remaining)
+	}
+	if remaining := tracker.GetLockoutRemaining("@f:example.com", "192.0.2.2"); remaining != 1*time.Minute {
+		t.Errorf("expected a lockout of 1m, got %s", remaining)
+	}
+}
+
+func TestLockoutCanBeDisabled(t *testing.T) {
+	tracker, _ := createTestLockoutTracker()
+
+	for i := 0; i < 10; i++ {
+		tracker.RecordFailure("@john:example.com", "192.0.2.1", disabledLockoutThresholds, disabledLockoutThresholds)
+	}
+
+	if remaining := tracker.GetLockoutRemaining("@john:example.com", "192.0.2.1"); remaining != 0 {
+		t.Errorf("expected no lockout, got %s", remaining)
+	}
+	if tracker.ClearUser("@john:example.com") || tracker.ClearIp("192.0.2.1") {
+		t.Errorf("expected nothing to have been recorded")
+	}
+}
+
+func TestLockoutListingAndClearing(t *testing.T) {
+	tracker, now := createTestLockoutTracker()
+
+	for i := 0; i < testLockoutThresholds.MaxFailures; i++ {
+		tracker.RecordFailure("@b:example.com", "192.0.2.1", testLockoutThresholds, testLockoutThresholds)
+		tracker.RecordFailure("@a:example.com", "192.0.2.2", testLockoutThresholds, disabledLockoutThresholds)
+	}
+	tracker.RecordFailure("@c:example.com", "", testLockoutThresholds, disabledLockoutThresholds)
+
+	users := tracker.GetLockedOutUsers()
+	if len(users) != 2 || users[0].Key != "@a:example.com" || users[1].Key != "@b:example.com" {
+		t.Fatalf("unexpected locked out users: %#v", users)
+	}
+	if users[0].Failures != 3 || !users[0].LockedUntil.Equal(now.Add(1*time.Minute)) {
+		t.Errorf("unexpected entry: %#v", users[0])
+	}
+
+	ips := tracker.GetLockedOutIps()
+	if len(ips) != 1 || ips[0].Key != "192.0.2.1" {
+		t.Fatalf("unexpected locked out IP addresses: %#v", ips)
+	}
+
+	if !tracker.ClearUser("@a:example.com") || tracker.ClearUser("@a:example.com") {
+		t.Errorf("expected the user to be cleared once")
+	}
+	if !tracker.ClearIp("192.0.2.1") || tracker.ClearIp("192.0.2.1") {
+		t.Errorf("expected the IP address to be cleared once")
+	}
+	if remaining := tracker.GetLockoutRemaining("@a:example.com", "192.0.2.1"); remaining != 0 {
+		t.Errorf("expected no lockout after clearing, got %s", remaining)
+	}
+
+	// Lockouts which are over are not listed
+	*now = now.Add(1 * time.Minute)
+	if users := tracker.GetLockedOutUsers(); len(users) != 0 {
+		t.Errorf("expected no locked out users, got %#v", users)
+	}
+}
+
+func TestLockoutPrunesStaleEntries(t *testing.T) {
+	tracker, now := createTestLockoutTracker()
+
+	tracker.RecordFailure("@a:example.com", "192.0.2.1", testLockoutThresholds, testLockoutThresholds)
+
+	*now = now.Add(testLockoutThresholds.FailureWindow + 1*time.Second)
+	tracker.RecordFailure("@b:example.com", "192.0.2.2", testLockoutThresholds, testLockoutThresholds)
+
+	if _, exists := tracker.users["@a:example.com"]; exists {
+		t.Errorf("expected the stale user entry to have been pruned")
+	}
+	if _, exists := tracker.ips["192.0.2.1"]; exists {
+		t.Errorf("expected the stale IP address entry to have been pruned")
+	}
+	if len(tracker.users) != 1 || len(tracker.ips) != 1 {
+		t.Errorf("expected only the recent entries to remain, got %d users and %d IP addresses", len(tracker.users), len(tracker.ips))
+	}
+}
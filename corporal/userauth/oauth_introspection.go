@@ -0,0 +1,140 @@
+package userauth
+
+import (
+	"devture-matrix-corporal/corporal/util"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OAuthIntrospectionAuthenticator is a user authenticator which treats the given password as an OAuth access token,
+// and validates it via token introspection (RFC 7662) against an OAuth authorization server (the IdP).
+//
+// The token is considered valid for the user if the introspection endpoint says that it's active,
+// and if the subject it was issued to (see subjectField) matches the one expected for the user.
+// The expected subject would be specified in the `authCredential` argument passed to Authenticate().
+// If empty, the user's id (e.g. `@john:example.com`) is expected instead.
+type OAuthIntrospectionAuthenticator struct {
+	introspectionUrl string
+	clientId         string
+	clientSecret     string
+
+	// subjectField is the introspection response field which identifies who the token was issued to (e.g. `sub`, `client_id` or `username`)
+	subjectField string
+
+	// requiredScopes lists the scopes that tokens need to have (all of them)
+	requiredScopes []string
+
+	httpClient *http.Client
+}
+
+func NewOAuthIntrospectionAuthenticator(
+	introspectionUrl string,
+	clientId string,
+	clientSecret string,
+	subjectField string,
+	requiredScopes []string,
+	timeout time.Duration,
+) *OAuthIntrospectionAuthenticator {
+	return &OAuthIntrospectionAuthenticator{
+		introspectionUrl: introspectionUrl,
+		clientId:         clientId,
+		clientSecret:     clientSecret,
+
+		subjectField:   subjectField,
+		requiredScopes: requiredScopes,
+
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+func (me *OAuthIntrospectionAuthenticator) Type() string {
+	return UserAuthTypeOAuthIntrospection
+}
+
+func (me *OAuthIntrospectionAuthenticator) Authenticate(userId, givenPassword, authCredential string) (bool, error) {
+	if givenPassword == "" {
+		return false, nil
+	}
+
+	expectedSubject := authCredential
+	if expectedSubject == "" {
+		expectedSubject = userId
+	}
+
+	introspection, err := me.introspect(givenPassword)
+	if err != nil {
+		return false, err
+	}
+
+	active, _ := introspection["active"].(bool)
+	if !active {
+		return false, nil
+	}
+
+	// The authorization server is supposed to report expired tokens as inactive, but we double-check
+	if expiresAt, ok := introspection["exp"].(float64); ok && time.Now().Unix() >= int64(expiresAt) {
+		return false, nil
+	}
+
+	subject, _ := introspection[me.subjectField].(string)
+	if subject != expectedSubject {
+		return false, nil
+	}
+
+	if len(me.requiredScopes) != 0 {
+		scope, _ := introspection["scope"].(string)
+		grantedScopes := strings.Fields(scope)
+		for _, requiredScope := range me.requiredScopes {
+			if !util.IsStringInArray(requiredScope, grantedScopes) {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+func (me *OAuthIntrospectionAuthenticator) introspect(token string) (map[string]interface{}, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	request, err := http.NewRequest("POST", me.introspectionUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	// Client credentials are to be form-encoded before being used for Basic authentication (see RFC 6749, section 2.3.1)
+	request.SetBasicAuth(url.QueryEscape(me.clientId), url.QueryEscape(me.clientSecret))
+
+	response, err := me.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("Non-OK HTTP response for %s: %d", me.introspectionUrl, response.StatusCode)
+	}
+
+	responseBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var introspection map[string]interface{}
+	err = json.Unmarshal(responseBytes, &introspection)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode introspection response JSON for %s: %s", me.introspectionUrl, err)
+	}
+
+	return introspection, nil
+}
@@ -0,0 +1,144 @@
+package userauth
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// maxPbkdf2Iterations prevents excessive CPU usage
+const maxPbkdf2Iterations = 10 * 1000 * 1000
+
+var pbkdf2HashFunctions = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Pbkdf2Authenticator is a user authenticator using PBKDF2-hashed credentials, in one of these encoded formats:
+//
+// - passlib's (e.g. `$pbkdf2-sha256$29000$<salt>$<hash>`, with `-sha256` being optional for SHA-1)
+//
+// - the PHC string format (e.g. `$pbkdf2-sha256$i=29000,l=32$<salt>$<hash>`)
+//
+// - Django's (e.g. `pbkdf2_sha256$600000$<salt>$<hash>`)
+type Pbkdf2Authenticator struct {
+}
+
+func NewPbkdf2Authenticator() *Pbkdf2Authenticator {
+	return &Pbkdf2Authenticator{}
+}
+
+func (me *Pbkdf2Authenticator) Type() string {
+	return UserAuthTypePbkdf2
+}
+
+func (me *Pbkdf2Authenticator) Authenticate(userId, givenPassword, authCredential string) (bool, error) {
+	if len(givenPassword) > maxHashedPasswordLength {
+		return false, fmt.Errorf("Rejecting long password (%d)", len(givenPassword))
+	}
+
+	var hashFunctionName string
+	var iterations int
+	var salt []byte
+	var expectedHash []byte
+	var err error
+
+	if strings.HasPrefix(authCredential, "pbkdf2_") {
+		hashFunctionName, iterations, salt, expectedHash, err = parseDjangoPbkdf2Hash(authCredential)
+	} else {
+		hashFunctionName, iterations, salt, expectedHash, err = parsePasslibPbkdf2Hash(authCredential)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	hashFunction, ok := pbkdf2HashFunctions[hashFunctionName]
+	if !ok {
+		return false, fmt.Errorf("Unsupported PBKDF2 hash function: %s", hashFunctionName)
+	}
+	if iterations < 1 || iterations > maxPbkdf2Iterations {
+		return false, fmt.Errorf("PBKDF2 iterations (%d) need to be between 1 and %d", iterations, maxPbkdf2Iterations)
+	}
+
+	computedHash := pbkdf2.Key([]byte(givenPassword), salt, iterations, len(expectedHash), hashFunction)
+
+	return subtle.ConstantTimeCompare(computedHash, expectedHash) == 1, nil
+}
+
+// parsePasslibPbkdf2Hash parses hashes in passlib's format or in the PHC string format (which only differ in how iterations are specified)
+func parsePasslibPbkdf2Hash(value string) (string, int, []byte, []byte, error) {
+	segments := strings.Split(value, "$")
+	if len(segments) != 5 || segments[0] != "" {
+		return "", 0, nil, nil, fmt.Errorf("Not a PBKDF2 hash")
+	}
+
+	hashFunctionName := "sha1"
+	switch {
+	case segments[1] == "pbkdf2":
+	case strings.HasPrefix(segments[1], "pbkdf2-"):
+		hashFunctionName = strings.TrimPrefix(segments[1], "pbkdf2-")
+	default:
+		return "", 0, nil, nil, fmt.Errorf("Unexpected hash type: %s", segments[1])
+	}
+
+	if strings.Contains(segments[2], "=") {
+		hash, err := parsePhcHash(value)
+		if err != nil {
+			return "", 0, nil, nil, err
+		}
+		iterations, err := hash.intParam("i", 1, maxPbkdf2Iterations)
+		if err != nil {
+			return "", 0, nil, nil, err
+		}
+		return hashFunctionName, iterations, hash.salt, hash.hash, nil
+	}
+
+	iterations, err := strconv.Atoi(segments[2])
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("Invalid PBKDF2 iterations: %s", segments[2])
+	}
+	salt, err := decodeHashBase64(segments[3])
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("Invalid salt: %s", err)
+	}
+	expectedHash, err := decodeHashBase64(segments[4])
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("Invalid hash: %s", err)
+	}
+	if len(expectedHash) == 0 {
+		return "", 0, nil, nil, fmt.Errorf("Empty hash")
+	}
+
+	return hashFunctionName, iterations, salt, expectedHash, nil
+}
+
+// parseDjangoPbkdf2Hash parses hashes in Django's format, where the salt is used as-is (not base64-encoded)
+func parseDjangoPbkdf2Hash(value string) (string, int, []byte, []byte, error) {
+	segments := strings.Split(value, "$")
+	if len(segments) != 4 {
+		return "", 0, nil, nil, fmt.Errorf("Not a Django PBKDF2 hash")
+	}
+
+	iterations, err := strconv.Atoi(segments[1])
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("Invalid PBKDF2 iterations: %s", segments[1])
+	}
+	expectedHash, err := base64.StdEncoding.DecodeString(segments[3])
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("Invalid hash: %s", err)
+	}
+	if len(expectedHash) == 0 {
+		return "", 0, nil, nil, fmt.Errorf("Empty hash")
+	}
+
+	return strings.TrimPrefix(segments[0], "pbkdf2_"), iterations, []byte(segments[2]), expectedHash, nil
+}
@@ -0,0 +1,79 @@
+package userauth
+
+import (
+	"strings"
+	"testing"
+)
+
+// Hashes of `password` from passlib's test suite (passlib/tests/test_handlers_pbkdf2.py)
+const (
+	pbkdf2PasslibSha1Hash   = "$pbkdf2$1212$OB.dtnSEXZK8U5cgxU/GYQ$y5LKPOplRmok7CZp/aqVDVg8zGI"
+	pbkdf2PasslibSha256Hash = "$pbkdf2-sha256$1212$4vjV83LKPjQzk31VI4E0Vw$hsYF68OiOUPdDZ1Fg.fJPeq1h/gXXY7acBp9/6c.tmQ"
+	pbkdf2PasslibSha512Hash = "$pbkdf2-sha512$1212$RHY0Fr3IDMSVO/RSZyb5ow$eNLfBK.eVozomMr.1gYa17k9B7KIK25NOEshvhrSX.esqY3s.FvWZViXz4KoLlQI.BzY/YTNJOiKc5gBYFYGww"
+
+	// pbkdf2PhcSha256Hash is passlib's `$pbkdf2-sha256$6400$.6UI/S.nXIk8jcbdHx3Fhg$98jZicV16ODfEsEZeYPGHU3kbrUrvUEXOPimVSQDD44`,
+	// re-encoded in the PHC string format
+	pbkdf2PhcSha256Hash = "$pbkdf2-sha256$i=6400,l=32$+6UI/S+nXIk8jcbdHx3Fhg$98jZicV16ODfEsEZeYPGHU3kbrUrvUEXOPimVSQDD44"
+)
+
+// Hashes of `lètmein` (with the `seasalt` salt) from Django's test suite (tests/auth_tests/test_hashers.py)
+const (
+	pbkdf2DjangoSha256Hash      = "pbkdf2_sha256$24000$seasalt$V9DfCAVoweeLwxC/L2mb+7swhzF0XYdyQMqmusZqiTc="
+	pbkdf2DjangoSha256HashOlder = "pbkdf2_sha256$20000$seasalt$oBSd886ysm3AqYun62DOdin8YcfbU1z9cksZSuLP9r0="
+)
+
+func TestPbkdf2Authenticator(t *testing.T) {
+	type testData struct {
+		name              string
+		givenPassword     string
+		authCredential    string
+		expectedValid     bool
+		expectedWithError bool
+	}
+
+	tests := []testData{
+		{"passlib SHA-1", "password", pbkdf2PasslibSha1Hash, true, false},
+		{"passlib SHA-256", "password", pbkdf2PasslibSha256Hash, true, false},
+		{"passlib SHA-512", "password", pbkdf2PasslibSha512Hash, true, false},
+		{"PHC SHA-256", "password", pbkdf2PhcSha256Hash, true, false},
+		{"Django SHA-256", "lètmein", pbkdf2DjangoSha256Hash, true, false},
+		{"Django SHA-256 (older)", "lètmein", pbkdf2DjangoSha256HashOlder, true, false},
+
+		{"passlib SHA-256, wrong password", "Password", pbkdf2PasslibSha256Hash, false, false},
+		{"passlib SHA-512, wrong password", "", pbkdf2PasslibSha512Hash, false, false},
+		{"PHC SHA-256, wrong password", "password1", pbkdf2PhcSha256Hash, false, false},
+		{"Django SHA-256, wrong password", "letmein", pbkdf2DjangoSha256Hash, false, false},
+		{"passlib SHA-256, other iterations", "password", strings.Replace(pbkdf2PasslibSha256Hash, "$1212$", "$1213$", 1), false, false},
+		{"Django SHA-256, other salt", "lètmein", strings.Replace(pbkdf2DjangoSha256Hash, "$seasalt$", "$seasalr$", 1), false, false},
+
+		{"unsupported hash function", "password", strings.Replace(pbkdf2PasslibSha256Hash, "sha256", "md5", 1), false, true},
+		{"unsupported Django hash function", "lètmein", strings.Replace(pbkdf2DjangoSha256Hash, "sha256", "md5", 1), false, true},
+		{"unexpected hash type", "password", strings.Replace(pbkdf2PasslibSha256Hash, "$pbkdf2-sha256$", "$bcrypt-sha256$", 1), false, true},
+		{"non-numeric iterations", "password", strings.Replace(pbkdf2PasslibSha256Hash, "$1212$", "$many$", 1), false, true},
+		{"zero iterations", "password", strings.Replace(pbkdf2PasslibSha256Hash, "$1212$", "$0$", 1), false, true},
+		{"too many iterations", "password", strings.Replace(pbkdf2PasslibSha256Hash, "$1212$", "$99999999$", 1), false, true},
+		{"invalid salt", "password", strings.Replace(pbkdf2PasslibSha256Hash, "4vjV83LKPjQzk31VI4E0Vw", "4vjV83LKPjQzk31VI4E0V!", 1), false, true},
+		{"empty hash", "password", strings.TrimSuffix(pbkdf2PasslibSha256Hash, "hsYF68OiOUPdDZ1Fg.fJPeq1h/gXXY7acBp9/6c.tmQ"), false, true},
+		{"missing segment", "password", "$pbkdf2-sha256$1212$4vjV83LKPjQzk31VI4E0Vw", false, true},
+		{"PHC without iterations", "password", strings.Replace(pbkdf2PhcSha256Hash, "i=6400,", "", 1), false, true},
+		{"PHC with invalid parameter", "password", strings.Replace(pbkdf2PhcSha256Hash, "i=6400,l=32", "i=6400,l", 1), false, true},
+		{"Django with non-numeric iterations", "lètmein", strings.Replace(pbkdf2DjangoSha256Hash, "$24000$", "$many$", 1), false, true},
+		{"Django with missing segment", "lètmein", "pbkdf2_sha256$24000$seasalt", false, true},
+		{"Django with invalid hash", "lètmein", "pbkdf2_sha256$24000$seasalt$!!!", false, true},
+		{"too long password", strings.Repeat("a", maxHashedPasswordLength+1), pbkdf2PasslibSha256Hash, false, true},
+	}
+
+	authenticator := NewPbkdf2Authenticator()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			isValid, err := authenticator.Authenticate("@john:example.com", test.givenPassword, test.authCredential)
+			if test.expectedWithError != (err != nil) {
+				t.Fatalf("expected error: %t, got: %v", test.expectedWithError, err)
+			}
+			if isValid != test.expectedValid {
+				t.Errorf("expected %t, got %t", test.expectedValid, isValid)
+			}
+		})
+	}
+}
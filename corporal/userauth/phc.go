@@ -0,0 +1,100 @@
+package userauth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxHashedPasswordLength is the longest password we hash with the (expensive) key derivation functions.
+// To avoid a DoS, we avoid dealing with longer inputs.
+const maxHashedPasswordLength = 4096
+
+// phcHash is a password hash encoded in the PHC string format (`$<id>[$v=<version>][$<param>=<value>(,<param>=<value>)*]$<salt>$<hash>`).
+// See https://github.com/P-H-C/phc-string-format/blob/master/phc-sf-spec.md
+type phcHash struct {
+	id      string
+	version string
+	params  map[string]string
+	salt    []byte
+	hash    []byte
+}
+
+func parsePhcHash(value string) (*phcHash, error) {
+	segments := strings.Split(value, "$")
+	if len(segments) < 4 || segments[0] != "" {
+		return nil, fmt.Errorf("not a PHC-formatted hash")
+	}
+
+	result := &phcHash{
+		id:     segments[1],
+		params: map[string]string{},
+	}
+
+	// Salt and hash are always last. Optional version and parameter segments come in between.
+	middleSegments := segments[2 : len(segments)-2]
+	if len(middleSegments) > 2 {
+		return nil, fmt.Errorf("too many segments")
+	}
+	if len(middleSegments) == 2 {
+		if !strings.HasPrefix(middleSegments[0], "v=") {
+			return nil, fmt.Errorf("expected a version segment, found `%s`", middleSegments[0])
+		}
+		result.version = strings.TrimPrefix(middleSegments[0], "v=")
+		middleSegments = middleSegments[1:]
+	}
+	if len(middleSegments) == 1 {
+		if strings.HasPrefix(middleSegments[0], "v=") && !strings.Contains(middleSegments[0], ",") {
+			result.version = strings.TrimPrefix(middleSegments[0], "v=")
+		} else {
+			for _, param := range strings.Split(middleSegments[0], ",") {
+				parts := strings.SplitN(param, "=", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("invalid parameter `%s`", param)
+				}
+				result.params[parts[0]] = parts[1]
+			}
+		}
+	}
+
+	var err error
+	result.salt, err = decodeHashBase64(segments[len(segments)-2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %s", err)
+	}
+	result.hash, err = decodeHashBase64(segments[len(segments)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash: %s", err)
+	}
+	if len(result.hash) == 0 {
+		return nil, fmt.Errorf("empty hash")
+	}
+
+	return result, nil
+}
+
+// intParam returns the value of the given (required) parameter, which needs to be within the given bounds
+func (me *phcHash) intParam(name string, min int, max int) (int, error) {
+	value, ok := me.params[name]
+	if !ok {
+		return 0, fmt.Errorf("missing `%s` parameter", name)
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid `%s` parameter: %s", name, value)
+	}
+	if number < min || number > max {
+		return 0, fmt.Errorf("`%s` parameter (%d) needs to be between %d and %d", name, number, min, max)
+	}
+	return number, nil
+}
+
+// decodeHashBase64 decodes the base64 used for salts and hashes by the PHC string format (standard alphabet, without padding)
+// and by passlib's modular crypt formats (`.` instead of `+`, without padding).
+// Padding is tolerated as well.
+func decodeHashBase64(value string) ([]byte, error) {
+	value = strings.TrimRight(strings.Replace(value, ".", "+", -1), "=")
+	return base64.RawStdEncoding.DecodeString(value)
+}
@@ -0,0 +1,94 @@
+package userauth
+
+import (
+	"testing"
+)
+
+func TestParsePhcHash(t *testing.T) {
+	type testData struct {
+		value           string
+		expectedId      string
+		expectedVersion string
+		expectedParams  map[string]string
+		expectedSalt    string
+		expectedHash    string
+	}
+
+	tests := []testData{
+		{"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$aGFzaA", "argon2id", "19", map[string]string{"m": "65536", "t": "2", "p": "1"}, "somesalt", "hash"},
+		{"$argon2id$m=65536,t=2,p=1$c29tZXNhbHQ$aGFzaA", "argon2id", "", map[string]string{"m": "65536", "t": "2", "p": "1"}, "somesalt", "hash"},
+		{"$argon2id$v=19$c29tZXNhbHQ$aGFzaA", "argon2id", "19", map[string]string{}, "somesalt", "hash"},
+		{"$scrypt$ln=4$c29tZXNhbHQ$aGFzaA", "scrypt", "", map[string]string{"ln": "4"}, "somesalt", "hash"},
+		{"$custom$$aGFzaA", "custom", "", map[string]string{}, "", "hash"},
+		// Padding, as well as the `.` used instead of `+` by passlib, are tolerated
+		{"$custom$c29tZXNhbHQ=$aGFzaA==", "custom", "", map[string]string{}, "somesalt", "hash"},
+		{"$custom$c29tZXNhbHQ$.+8", "custom", "", map[string]string{}, "somesalt", "\xfb\xef"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			hash, err := parsePhcHash(test.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if hash.id != test.expectedId || hash.version != test.expectedVersion {
+				t.Errorf("unexpected id/version: %s/%s", hash.id, hash.version)
+			}
+			if len(hash.params) != len(test.expectedParams) {
+				t.Errorf("expected params %v, got %v", test.expectedParams, hash.params)
+			}
+			for name, value := range test.expectedParams {
+				if hash.params[name] != value {
+					t.Errorf("expected params %v, got %v", test.expectedParams, hash.params)
+				}
+			}
+			if string(hash.salt) != test.expectedSalt || string(hash.hash) != test.expectedHash {
+				t.Errorf("unexpected salt/hash: %q/%q", hash.salt, hash.hash)
+			}
+		})
+	}
+}
+
+func TestParsePhcHashRejectsMalformedValues(t *testing.T) {
+	values := []string{
+		"",
+		"argon2id",
+		"argon2id$v=19$m=65536$c29tZXNhbHQ$aGFzaA",
+		"$argon2id$aGFzaA",
+		"$argon2id$v=19$m=65536$extra$c29tZXNhbHQ$aGFzaA",
+		"$argon2id$m=65536$t=2$c29tZXNhbHQ$aGFzaA",
+		"$argon2id$v=19$m=65536,t$c29tZXNhbHQ$aGFzaA",
+		"$argon2id$v=19$m=65536$c29tZXNhbHQ!$aGFzaA",
+		"$argon2id$v=19$m=65536$c29tZXNhbHQ$aGFzaA!",
+		"$argon2id$v=19$m=65536$c29tZXNhbHQ$",
+	}
+
+	for _, value := range values {
+		_, err := parsePhcHash(value)
+		if err == nil {
+			t.Errorf("`%s`: expected an error", value)
+		}
+	}
+}
+
+func TestPhcHashIntParam(t *testing.T) {
+	hash, err := parsePhcHash("$argon2id$v=19$m=65536,t=two,p=-1$c29tZXNhbHQ$aGFzaA")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if value, err := hash.intParam("m", 8, 65536); err != nil || value != 65536 {
+		t.Errorf("expected 65536, got %d (error: %v)", value, err)
+	}
+
+	for _, name := range []string{"t", "p", "missing"} {
+		if _, err := hash.intParam(name, 1, 10); err == nil {
+			t.Errorf("`%s`: expected an error", name)
+		}
+	}
+
+	if _, err := hash.intParam("m", 8, 65535); err == nil {
+		t.Errorf("expected an error for a value above the maximum")
+	}
+}
@@ -2,10 +2,17 @@ package userauth
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // RestAuthenticator is a user authenticator which verifies credentials with a remote server via a REST HTTP call.
@@ -20,11 +27,52 @@ import (
 // actually requires that `matrix-synapse-rest-auth` is installed and used.
 // We just reuse the same data format for compatibility reasons and so that people who had
 // previously implemented `matrix-synapse-rest-auth` could easily bridge with us.
+//
+// Requests can be hardened with a TLS client certificate and pinned certificate authorities (see SetTlsConfig),
+// as well as with HMAC signatures (see SetHmacSecret).
 type RestAuthenticator struct {
+	httpClient *http.Client
+
+	// requireHttps makes non-https:// URLs get refused (see SetTlsConfig)
+	requireHttps bool
+
+	// hmacSecret (if set) is used for signing requests (see SetHmacSecret)
+	hmacSecret []byte
 }
 
+const (
+	// RestAuthTimestampHeader and RestAuthSignatureHeader are the request headers which carry HMAC signatures (see SetHmacSecret)
+	RestAuthTimestampHeader = "X-Matrix-Corporal-Timestamp"
+	RestAuthSignatureHeader = "X-Matrix-Corporal-Signature"
+)
+
 func NewRestAuthenticator() *RestAuthenticator {
-	return &RestAuthenticator{}
+	return &RestAuthenticator{
+		httpClient: &http.Client{},
+	}
+}
+
+// SetTlsConfig makes requests use the given TLS configuration (e.g. one with a client certificate or with pinned certificate authorities, see httphelp.NewTlsConfig).
+// To prevent such hardening from being bypassed, requests to non-https:// URLs get refused afterwards.
+//
+// This is to be called before any requests are made.
+func (me *RestAuthenticator) SetTlsConfig(tlsConfig *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	me.httpClient.Transport = transport
+
+	me.requireHttps = true
+}
+
+// SetHmacSecret makes requests get signed with the given secret, so that REST endpoints can tell that requests really come from us.
+//
+// Requests carry the current UNIX timestamp (in RestAuthTimestampHeader) and a signature (in RestAuthSignatureHeader),
+// which is `sha256=` followed by the hex-encoded HMAC-SHA256 of the timestamp, a `.` and the request body.
+// Endpoints are expected to reject requests with old timestamps (e.g. older than a few minutes), to prevent replays.
+//
+// This is to be called before any requests are made.
+func (me *RestAuthenticator) SetHmacSecret(secret []byte) {
+	me.hmacSecret = secret
 }
 
 func (me *RestAuthenticator) Type() string {
@@ -43,10 +91,32 @@ func (me *RestAuthenticator) Authenticate(userId, givenPassword, authCredential
 		return false, err
 	}
 
-	response, err := http.Post(restAuthApiUrl, "application/json", bytes.NewReader(payloadBytes))
+	if me.requireHttps && !strings.HasPrefix(restAuthApiUrl, "https://") {
+		return false, fmt.Errorf("Refusing to make a non-HTTPS request to %s, as TLS hardening is configured", restAuthApiUrl)
+	}
+
+	request, err := http.NewRequest("POST", restAuthApiUrl, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	if len(me.hmacSecret) != 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+		mac := hmac.New(sha256.New, me.hmacSecret)
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(payloadBytes)
+
+		request.Header.Set(RestAuthTimestampHeader, timestamp)
+		request.Header.Set(RestAuthSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := me.httpClient.Do(request)
 	if err != nil {
 		return false, err
 	}
+	defer response.Body.Close()
 
 	if response.StatusCode != 200 {
 		return false, fmt.Errorf("Non-OK HTTP response for %s: %d", restAuthApiUrl, response.StatusCode)
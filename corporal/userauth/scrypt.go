@@ -0,0 +1,60 @@
+package userauth
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ScryptAuthenticator is a user authenticator using scrypt-hashed credentials,
+// encoded in the PHC string format (e.g. `$scrypt$ln=16,r=8,p=1$<salt>$<hash>`, where the cost parameter N is `2^ln`), like the ones produced by passlib.
+type ScryptAuthenticator struct {
+}
+
+func NewScryptAuthenticator() *ScryptAuthenticator {
+	return &ScryptAuthenticator{}
+}
+
+func (me *ScryptAuthenticator) Type() string {
+	return UserAuthTypeScrypt
+}
+
+func (me *ScryptAuthenticator) Authenticate(userId, givenPassword, authCredential string) (bool, error) {
+	if len(givenPassword) > maxHashedPasswordLength {
+		return false, fmt.Errorf("Rejecting long password (%d)", len(givenPassword))
+	}
+
+	hash, err := parsePhcHash(authCredential)
+	if err != nil {
+		return false, err
+	}
+	if hash.id != "scrypt" {
+		return false, fmt.Errorf("Unexpected hash type: %s", hash.id)
+	}
+
+	logCost, err := hash.intParam("ln", 1, 24)
+	if err != nil {
+		return false, err
+	}
+	blockSize, err := hash.intParam("r", 1, 64)
+	if err != nil {
+		return false, err
+	}
+	parallelism, err := hash.intParam("p", 1, 64)
+	if err != nil {
+		return false, err
+	}
+
+	// scrypt needs 128 * r * N bytes of memory, which we keep below 4 GiB
+	if 128*blockSize<<uint(logCost) > 4*1024*1024*1024 {
+		return false, fmt.Errorf("Rejecting scrypt parameters requiring too much memory (ln=%d, r=%d)", logCost, blockSize)
+	}
+
+	computedHash, err := scrypt.Key([]byte(givenPassword), hash.salt, 1<<uint(logCost), blockSize, parallelism, len(hash.hash))
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(computedHash, hash.hash) == 1, nil
+}
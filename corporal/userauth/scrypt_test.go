@@ -0,0 +1,58 @@
+package userauth
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	// scryptPasslibHash is a hash of `password` from passlib's documentation (passlib.hash.scrypt)
+	scryptPasslibHash = "$scrypt$ln=16,r=8,p=1$aM15713r3Xsvxbi31lqr1Q$nFNh2CVHVjNldFVKDHDlm4CbdRSCdEBsjjJxD+iCs5E"
+
+	// scryptLowCostHash is a (cheap to verify) hash of `password` with the `somesalt` salt,
+	// generated with Python's hashlib.scrypt and encoded the way passlib does it
+	scryptLowCostHash = "$scrypt$ln=4,r=8,p=2$c29tZXNhbHQ$KRx91AeAO20+VV/hpktCBc5oonLRs7A5myF3ZDrROXs"
+)
+
+func TestScryptAuthenticator(t *testing.T) {
+	type testData struct {
+		name              string
+		givenPassword     string
+		authCredential    string
+		expectedValid     bool
+		expectedWithError bool
+	}
+
+	tests := []testData{
+		{"passlib", "password", scryptPasslibHash, true, false},
+		{"low cost", "password", scryptLowCostHash, true, false},
+
+		{"wrong password", "Password", scryptLowCostHash, false, false},
+		{"wrong password (empty)", "", scryptLowCostHash, false, false},
+		{"other parameters", "password", strings.Replace(scryptLowCostHash, "p=2", "p=1", 1), false, false},
+
+		{"unexpected hash type", "password", strings.Replace(scryptLowCostHash, "$scrypt$", "$argon2id$", 1), false, true},
+		{"missing cost parameter", "password", strings.Replace(scryptLowCostHash, "ln=4,", "", 1), false, true},
+		{"missing block size parameter", "password", strings.Replace(scryptLowCostHash, "r=8,", "", 1), false, true},
+		{"non-numeric parameter", "password", strings.Replace(scryptLowCostHash, "ln=4", "ln=four", 1), false, true},
+		{"too high cost", "password", strings.Replace(scryptLowCostHash, "ln=4", "ln=25", 1), false, true},
+		{"too much memory", "password", strings.Replace(scryptLowCostHash, "ln=4,r=8", "ln=24,r=64", 1), false, true},
+		{"zero parallelism", "password", strings.Replace(scryptLowCostHash, "p=2", "p=0", 1), false, true},
+		{"not PHC-formatted", "password", "scrypt:password", false, true},
+		{"too long password", strings.Repeat("a", maxHashedPasswordLength+1), scryptLowCostHash, false, true},
+	}
+
+	authenticator := NewScryptAuthenticator()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			isValid, err := authenticator.Authenticate("@john:example.com", test.givenPassword, test.authCredential)
+			if test.expectedWithError != (err != nil) {
+				t.Fatalf("expected error: %t, got: %v", test.expectedWithError, err)
+			}
+			if isValid != test.expectedValid {
+				t.Errorf("expected %t, got %t", test.expectedValid, isValid)
+			}
+		})
+	}
+}
@@ -15,7 +15,14 @@ const (
 	UserAuthTypeSha256      = "sha256"
 	UserAuthTypeSha512      = "sha512"
 	UserAuthTypeBcrypt      = "bcrypt"
+	UserAuthTypeArgon2id    = "argon2id"
+	UserAuthTypeScrypt      = "scrypt"
+	UserAuthTypePbkdf2      = "pbkdf2"
 	UserAuthTypeREST        = "rest"
+	UserAuthTypeLdap        = "ldap"
+	UserAuthTypeJwt         = "jwt"
+
+	UserAuthTypeOAuthIntrospection = "oauth-introspection"
 )
 
 var knownUserAuthTypes = []string{
@@ -26,7 +33,13 @@ var knownUserAuthTypes = []string{
 	UserAuthTypeSha256,
 	UserAuthTypeSha512,
 	UserAuthTypeBcrypt,
+	UserAuthTypeArgon2id,
+	UserAuthTypeScrypt,
+	UserAuthTypePbkdf2,
 	UserAuthTypeREST,
+	UserAuthTypeLdap,
+	UserAuthTypeJwt,
+	UserAuthTypeOAuthIntrospection,
 }
 
 func IsKnownUserAuthType(value string) bool {
@@ -15,6 +15,15 @@ func IsStringInArray(needle string, haystack []string) bool {
 	return false
 }
 
+// StringArrayToSet turns the given values into a set (a map with a true value for each), for when membership needs to be checked often
+func StringArrayToSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
 // GenerateRandomBytes returns securely generated random bytes.
 // It will return an error if the system's secure random
 // number generator fails to function correctly, in which
@@ -0,0 +1,244 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// minRenewalInterval prevents us from hammering Vault with renewal requests for tokens with a very short TTL
+const minRenewalInterval = 10 * time.Second
+
+// renewalRetryInterval is how long to wait before retrying, after a token renewal fails
+const renewalRetryInterval = 30 * time.Second
+
+// Client is a minimal HashiCorp Vault client, which can read secrets and keep its token alive.
+//
+// The token is either provided directly (and renewed by us, if renewable),
+// or read from a file (e.g. a Vault Agent sink), in which case whoever writes the file is in charge of renewing it.
+type Client struct {
+	logger     *logrus.Logger
+	address    string
+	token      string
+	tokenPath  string
+	namespace  string
+	httpClient *http.Client
+
+	renewalTimer *time.Timer
+	stopped      bool
+	lockRenewal  sync.Mutex
+}
+
+type secretResponse struct {
+	Data map[string]interface{} `json:"data"`
+
+	Auth *struct {
+		LeaseDuration int  `json:"lease_duration"`
+		Renewable     bool `json:"renewable"`
+	} `json:"auth"`
+}
+
+func NewClient(
+	logger *logrus.Logger,
+	address string,
+	token string,
+	tokenPath string,
+	namespace string,
+	timeout time.Duration,
+) *Client {
+	return &Client{
+		logger:    logger,
+		address:   strings.TrimSuffix(address, "/"),
+		token:     token,
+		tokenPath: tokenPath,
+		namespace: namespace,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// Start starts renewing the token in the background (if it's a renewable token that we're in charge of).
+func (me *Client) Start() error {
+	if me.tokenPath != "" {
+		// Whoever writes the token file is in charge of renewing the token.
+		return nil
+	}
+
+	var response secretResponse
+	err := me.doRequest("GET", "/v1/auth/token/lookup-self", nil, &response)
+	if err != nil {
+		return fmt.Errorf("failed looking up Vault token: %s", err)
+	}
+
+	renewable, _ := response.Data["renewable"].(bool)
+	ttlSeconds, _ := response.Data["ttl"].(float64)
+
+	if !renewable || ttlSeconds <= 0 {
+		me.logger.Debugf("Vault token is not renewable or does not expire, so it won't be renewed")
+		return nil
+	}
+
+	// Renewing at half the TTL leaves us enough time to retry a few times if Vault is temporarily unavailable.
+	me.scheduleRenewal(time.Duration(ttlSeconds) * time.Second / 2)
+
+	return nil
+}
+
+func (me *Client) Stop() {
+	me.lockRenewal.Lock()
+	defer me.lockRenewal.Unlock()
+
+	me.stopped = true
+
+	if me.renewalTimer != nil {
+		me.renewalTimer.Stop()
+		me.renewalTimer = nil
+	}
+}
+
+// ReadSecret reads the secret at the given path (e.g. `secret/data/matrix-corporal`) and returns its data.
+//
+// For KV version 2 secrets engines, the path needs to contain the `data/` segment,
+// and the secret's data is unwrapped from the versioned response.
+func (me *Client) ReadSecret(path string) (map[string]interface{}, error) {
+	var response secretResponse
+	err := me.doRequest("GET", "/v1/"+strings.TrimPrefix(path, "/"), nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Data == nil {
+		return nil, fmt.Errorf("secret `%s` not found", path)
+	}
+
+	// KV v2 responses look like this: `{"data": {"data": {..}, "metadata": {..}}}`
+	if data, ok := response.Data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := response.Data["metadata"]; hasMetadata {
+			return data, nil
+		}
+	}
+
+	return response.Data, nil
+}
+
+// ReadSecretField reads a single (string) field out of the secret at the given path.
+func (me *Client) ReadSecretField(path string, field string) (string, error) {
+	data, err := me.ReadSecret(path)
+	if err != nil {
+		return "", err
+	}
+
+	value, exists := data[field]
+	if !exists {
+		return "", fmt.Errorf("secret `%s` does not contain a `%s` field", path, field)
+	}
+
+	valueString, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field `%s` of secret `%s` is not a string", field, path)
+	}
+
+	return valueString, nil
+}
+
+func (me *Client) scheduleRenewal(interval time.Duration) {
+	me.lockRenewal.Lock()
+	defer me.lockRenewal.Unlock()
+
+	if me.stopped {
+		return
+	}
+
+	if interval < minRenewalInterval {
+		interval = minRenewalInterval
+	}
+
+	me.logger.Debugf("Vault token will be renewed in %s", interval)
+
+	me.renewalTimer = time.AfterFunc(interval, me.renew)
+}
+
+func (me *Client) renew() {
+	var response secretResponse
+	err := me.doRequest("POST", "/v1/auth/token/renew-self", map[string]interface{}{}, &response)
+	if err != nil {
+		me.logger.Warnf("Failed renewing Vault token: %s", err)
+		me.scheduleRenewal(renewalRetryInterval)
+		return
+	}
+
+	if response.Auth == nil || !response.Auth.Renewable || response.Auth.LeaseDuration <= 0 {
+		me.logger.Warnf("Vault token cannot be renewed anymore (it likely reached its max TTL)")
+		return
+	}
+
+	me.logger.Debugf("Renewed Vault token (TTL: %d seconds)", response.Auth.LeaseDuration)
+
+	me.scheduleRenewal(time.Duration(response.Auth.LeaseDuration) * time.Second / 2)
+}
+
+func (me *Client) getToken() (string, error) {
+	if me.tokenPath == "" {
+		return me.token, nil
+	}
+
+	// Token files get rewritten (e.g. by Vault Agent), so we always read the current token.
+	tokenBytes, err := ioutil.ReadFile(me.tokenPath)
+	if err != nil {
+		return "", fmt.Errorf("failed reading Vault token file: %s", err)
+	}
+
+	return strings.TrimSpace(string(tokenBytes)), nil
+}
+
+func (me *Client) doRequest(method string, path string, requestPayload interface{}, responsePayload interface{}) error {
+	var body *bytes.Reader
+	if requestPayload == nil {
+		body = bytes.NewReader(nil)
+	} else {
+		requestBytes, err := json.Marshal(requestPayload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(requestBytes)
+	}
+
+	req, err := http.NewRequest(method, me.address+path, body)
+	if err != nil {
+		return err
+	}
+
+	token, err := me.getToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	if me.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", me.namespace)
+	}
+
+	resp, err := me.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("not found: %s", path)
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("non-200 response from Vault (%s): %d", path, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(responsePayload)
+}
@@ -23,13 +23,19 @@ import (
 	"devture-matrix-corporal/corporal/container"
 	"devture-matrix-corporal/corporal/httpapi"
 	"devture-matrix-corporal/corporal/httpgateway"
+	"devture-matrix-corporal/corporal/httphelp"
+	"devture-matrix-corporal/corporal/policy"
 	"devture-matrix-corporal/corporal/policy/provider"
 	"devture-matrix-corporal/corporal/reconciliation/reconciler"
+	"devture-matrix-corporal/corporal/vault"
 	"flag"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -55,6 +61,10 @@ var BuildDate string
 // Version holds contents of ./VERSION file, if exists, or the value passed via the -version option
 var Version string
 
+// policyProviderStartRetryInterval specifies how often to retry starting the policy provider,
+// if it failed to start initially (see retryStartingPolicyProvider)
+const policyProviderStartRetryInterval = 30 * time.Second
+
 func main() {
 	fmt.Printf(`
                  _        _                                                _
@@ -88,6 +98,22 @@ BuildDate: %s
 		logger.Level = logrus.InfoLevel
 	}
 
+	if configuration.OutboundProxy.Url != "" {
+		// This needs to happen before anything makes use of (or copies) the default transport.
+		directApiEndpoints := []string{
+			configuration.Matrix.HomeserverApiEndpoint,
+			configuration.Matrix.AdminApiEndpoint,
+		}
+		if configuration.Matrix.AuthenticationService.Enabled {
+			directApiEndpoints = append(directApiEndpoints, configuration.Matrix.AuthenticationService.ApiEndpoint)
+		}
+
+		err = setupOutboundProxy(configuration.OutboundProxy, directApiEndpoints)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	container, shutdownHandler := container.BuildContainer(*configuration, logger)
 
 	httpGatewayServer := container.Get("httpgateway.server").(*httpgateway.Server)
@@ -114,10 +140,47 @@ BuildDate: %s
 		panic(err)
 	}
 
+	if configuration.Vault.Address != "" {
+		// This needs to start before the policy provider, as policies may be fetched from (or reference secrets in) Vault.
+		vaultClient := container.Get("vault.client").(*vault.Client)
+		err = vaultClient.Start()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	policyFreshnessGuard := container.Get("policy.freshness_guard").(*policy.FreshnessGuard)
+	err = policyFreshnessGuard.Start()
+	if err != nil {
+		panic(err)
+	}
+
+	// This needs to start before the policy provider, so that it doesn't miss any policies that need persisting.
+	lastKnownGoodCache := container.Get("policy.last_known_good_cache").(*policy.LastKnownGoodCache)
+	err = lastKnownGoodCache.Start()
+	if err != nil {
+		panic(err)
+	}
+
+	policyStore := container.Get("policy.store").(*policy.Store)
+
 	policyProvider := container.Get("policy.provider").(provider.Provider)
 	err = policyProvider.Start()
 	if err != nil {
-		panic(err)
+		policyStore.ReportLoadFailure(policyProvider.Type(), err)
+
+		if !lastKnownGoodCache.IsEnabled() {
+			panic(err)
+		}
+
+		logger.Errorf("Failed starting policy provider: %s. Trying to restore the last-known-good policy", err)
+
+		errCache := lastKnownGoodCache.Restore()
+		if errCache != nil {
+			panic(fmt.Errorf("failed starting policy provider (%s) and restoring the last-known-good policy (%s)", err, errCache))
+		}
+
+		go retryStartingPolicyProvider(policyProvider, policyStore, logger)
 	}
 
 	channelComplete := make(chan bool)
@@ -129,6 +192,46 @@ BuildDate: %s
 	<-channelComplete
 }
 
+// setupOutboundProxy makes the default HTTP transport used by all outbound HTTP requests
+// (policy providers, hooks, REST auth, avatar downloads, etc.) go through the configured proxy.
+// Traffic to the Matrix homeserver and to matrix-authentication-service (the given endpoints) is always kept direct.
+func setupOutboundProxy(outboundProxy configuration.OutboundProxy, directApiEndpoints []string) error {
+	bypassRules := append([]string{}, outboundProxy.Bypass...)
+
+	for _, apiEndpoint := range directApiEndpoints {
+		apiEndpointUrl, err := url.Parse(apiEndpoint)
+		if err == nil && apiEndpointUrl.Hostname() != "" {
+			bypassRules = append(bypassRules, apiEndpointUrl.Hostname())
+		}
+	}
+
+	proxyFunc, err := httphelp.NewProxyFunc(outboundProxy.Url, bypassRules)
+	if err != nil {
+		return fmt.Errorf("OutboundProxy: %s", err)
+	}
+
+	http.DefaultTransport.(*http.Transport).Proxy = proxyFunc
+
+	return nil
+}
+
+// retryStartingPolicyProvider keeps trying to start the policy provider, until it succeeds.
+// This is used while we're serving the last-known-good policy, because the policy provider failed to start initially.
+func retryStartingPolicyProvider(policyProvider provider.Provider, policyStore *policy.Store, logger *logrus.Logger) {
+	for {
+		time.Sleep(policyProviderStartRetryInterval)
+
+		err := policyProvider.Start()
+		if err == nil {
+			logger.Infof("Policy provider started successfully (after a previous failure)")
+			return
+		}
+
+		logger.Errorf("Failed starting policy provider (will retry in %s): %s", policyProviderStartRetryInterval, err)
+		policyStore.ReportLoadFailure(policyProvider.Type(), err)
+	}
+}
+
 func setupSignalHandling(
 	channelComplete chan bool,
 	shutdownHandler *container.ContainerShutdownHandler,